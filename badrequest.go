@@ -0,0 +1,45 @@
+package appleseed
+
+import (
+	"errors"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// WithFrameReadTimeout 开始读取一个请求之后，整个请求需要在 d 之内到达，否则连接被关闭，避免客户端每次只发送几个字节
+// 长时间占用连接和读取 goroutine。等待下一个请求的空闲连接不受限制，被拆分传输的请求每个 fragment 分别计时。
+// 默认不限制。只对 Serve 接受的、使用二进制协议的连接生效
+func WithFrameReadTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.frameReadTimeout = d
+	}
+}
+
+// setFrameReadTimeout 将 WithFrameReadTimeout 的设置交给 codec
+func (s *Server) setFrameReadTimeout(c codec.ServerCodec, cc *codec.CountConn) {
+	if s.frameReadTimeout <= 0 {
+		return
+	}
+	fc, ok := c.(codec.FrameReadTimeouter)
+	d, ok2 := cc.ReadWriteCloser.(readDeadliner)
+	if ok && ok2 {
+		fc.SetFrameReadTimeout(s.frameReadTimeout, d.SetReadDeadline)
+	}
+}
+
+// readDeadliner 可以设置读取期限的连接，net.Conn 实现了它
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// badRequest 读取请求的错误是无法解码的请求（见 codec.MessageError）时，返回发送给客户端的 InvalidArgument 错误，
+// 这个请求已经被跳过，连接继续使用
+func badRequest(err error) (*status.Status, bool) {
+	var me *codec.MessageError
+	if !errors.As(err, &me) {
+		return nil, false
+	}
+	return status.New(status.InvalidArgument, me.Error()), true
+}
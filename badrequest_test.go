@@ -0,0 +1,128 @@
+package appleseed
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+// rawFrame 返回 data 组成的 frame
+func rawFrame(data []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(data)))
+	return append(b[:n:n], data...)
+}
+
+// startBadRequestServer 启动一个注册了 XXX 的 server，返回 inproc 上的连接和连接断开时的统计
+func startBadRequestServer(t *testing.T, opts ...ServerOption) (*inproc.Conn, chan ConnStats) {
+	t.Helper()
+	disconnected := make(chan ConnStats, 1)
+	opts = append(opts, WithOnDisconnect(func(_ net.Addr, _ error, stats ConnStats) { disconnected <- stats }))
+	s, err := NewServer(context.Background(), "poison", "127.0.0.1", "0", memory.New(nil), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	lis := inproc.Listen("poison")
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	conn, err := lis.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, disconnected
+}
+
+// TestBadRequest 无法解码的请求只让这个请求失败，返回 InvalidArgument，连接上之后的请求正常处理
+func TestBadRequest(t *testing.T) {
+	conn, disconnected := startBadRequestServer(t)
+	cc := codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"))
+	if err := cc.WriteRequest(&codec.RequestHeader{ServiceMethod: "XXX.Add", Seq: 1}, &Args{X: 1, Y: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// seq 2 使用没有绑定的方法 ID（flagMethodID）；seq 3 的 body 不是合法的 json；最后一个 frame 连 seq 都没有
+	conn.Write(rawFrame([]byte{2, 1, 5}))
+	conn.Write(rawFrame(append([]byte{3, 0, 7}, "XXX.Add{"...)))
+	conn.Write(rawFrame(nil))
+	if err := cc.WriteRequest(&codec.RequestHeader{ServiceMethod: "XXX.Add", Seq: 4}, &Args{X: 3, Y: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[uint64]codec.ResponseHeader)
+	for i := 0; i < 4; i++ {
+		var resp codec.ResponseHeader
+		var reply Reply
+		if err := cc.ReadResponseHeader(&resp); err != nil {
+			t.Fatalf("ReadResponseHeader() = %v", err)
+		}
+		if err := cc.ReadResponseBody(&reply); err != nil {
+			t.Fatalf("ReadResponseBody() = %v", err)
+		}
+		if resp.Error == "" && reply.Add != map[uint64]int64{1: 3, 4: 7}[resp.Seq] {
+			t.Fatalf("seq %d: reply = %+v", resp.Seq, reply)
+		}
+		got[resp.Seq] = resp
+	}
+	for seq, code := range map[uint64]status.Code{1: status.OK, 2: status.InvalidArgument, 3: status.InvalidArgument, 4: status.OK} {
+		if resp, ok := got[seq]; !ok || status.Code(resp.Code) != code {
+			t.Fatalf("seq %d: response = %+v, want code %v", seq, resp, code)
+		}
+	}
+
+	cc.Close()
+	select {
+	case stats := <-disconnected:
+		if stats.Requests != 5 || stats.BadRequests != 3 {
+			t.Fatalf("stats = %+v, want 5 requests with 3 bad ones", stats)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+// TestServerFrameReadTimeout 请求只发送了一部分时，连接在 WithFrameReadTimeout 之后被关闭
+func TestServerFrameReadTimeout(t *testing.T) {
+	conn, disconnected := startBadRequestServer(t, WithFrameReadTimeout(50*time.Millisecond))
+	cc := codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"))
+	if err := cc.WriteRequest(&codec.RequestHeader{ServiceMethod: "XXX.Add", Seq: 1}, &Args{X: 1, Y: 2}); err != nil {
+		t.Fatal(err)
+	}
+	var resp codec.ResponseHeader
+	if err := cc.ReadResponseHeader(&resp); err != nil {
+		t.Fatal(err)
+	}
+	cc.ReadResponseBody(nil)
+	// 空闲的连接不受限制
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case stats := <-disconnected:
+		t.Fatalf("idle connection closed: %+v", stats)
+	default:
+	}
+	// 长度为 10 的 frame 只发送了 2 个字节
+	start := time.Now()
+	conn.Write([]byte{10, 2, 0})
+	select {
+	case <-disconnected:
+		if d := time.Since(start); d < 40*time.Millisecond {
+			t.Fatalf("connection closed after %v, before the frame read timeout", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("trickled request was not timed out")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() after the timeout = %v, want the connection closed", err)
+	}
+}
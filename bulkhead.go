@@ -0,0 +1,264 @@
+package appleseed
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// BulkheadLimits 一个 bulkhead 的限制，见 WithBulkhead
+type BulkheadLimits struct {
+	MaxConcurrent int // 同时执行的请求数量，SetBulkhead 时小于等于 0 表示删除这个 bulkhead
+	MaxQueue      int // 超出 MaxConcurrent 时最多等待的请求数量，为 0 时直接拒绝
+}
+
+// BulkheadStats 一个 bulkhead 当前的使用情况和累计统计
+type BulkheadStats struct {
+	BulkheadLimits
+	InFlight   int    // 正在执行的请求数量
+	QueueDepth int    // 正在等待的请求数量
+	Admitted   uint64 // 放行的请求数量，包括等待后放行的
+	Queued     uint64 // 等待过的请求数量
+	Rejected   uint64 // 因为队列已满返回 ResourceExhausted 的请求数量
+	Expired    uint64 // ctx 在等待期间结束（超时或者连接断开）的请求数量
+}
+
+// WithMethodConcurrency 同 WithBulkhead(pattern, BulkheadLimits{MaxConcurrent: maxConcurrent})，超出的请求直接拒绝
+func WithMethodConcurrency(pattern string, maxConcurrent int) ServerOption {
+	return WithBulkhead(pattern, BulkheadLimits{MaxConcurrent: maxConcurrent})
+}
+
+// WithBulkhead 匹配 pattern 的方法共享一个 bulkhead：最多同时执行 limits.MaxConcurrent 个请求，超出的请求按到达的顺序
+// 最多等待 limits.MaxQueue 个，队列已满时返回 ResourceExhausted，请求的 ctx 在等待期间结束时返回 ctx 的错误。
+// 一个慢方法因此只能占用自己的额度，不会影响其他方法的请求。
+//
+// pattern 为 "Service.Method"（只匹配该方法）、以 * 结尾的前缀（比如 "Report.*"）或者 "*"（其他所有方法）。
+// 一个请求只使用一个 bulkhead：完全匹配的方法优先，其次是最长的前缀，最后是 "*"。等待发生在拦截器之前，
+// 等待的时间计入 ServerInfo.Queued 之后的排队时间，不计入慢请求的 handler 时间。
+// WithOrderedMethod 的方法在执行队列中等待 bulkhead，此时同一个执行队列中之后的请求也一起等待
+func WithBulkhead(pattern string, limits BulkheadLimits) ServerOption {
+	return func(s *Server) {
+		s.SetBulkhead(pattern, limits)
+	}
+}
+
+// SetBulkhead 在运行时添加、修改或者删除（limits.MaxConcurrent 小于等于 0）pattern 的 bulkhead，之后的请求立即使用
+// 新的限制。修改时正在执行和等待的请求保留：放宽限制后等待的请求立即放行，收紧限制时不会中断正在执行的请求，
+// 多出的请求执行完之后才放行新的请求；删除时所有等待的请求立即放行
+func (s *Server) SetBulkhead(pattern string, limits BulkheadLimits) {
+	if limits.MaxQueue < 0 {
+		limits.MaxQueue = 0
+	}
+	s.bulkheadMu.Lock()
+	defer s.bulkheadMu.Unlock()
+	old := s.bulkheadTable()
+	b, ok := old.all[pattern]
+	if ok && limits.MaxConcurrent > 0 {
+		b.set(limits)
+		return
+	}
+	if !ok && limits.MaxConcurrent <= 0 {
+		return
+	}
+	all := make(map[string]*bulkhead, len(old.all)+1)
+	for p, b := range old.all {
+		all[p] = b
+	}
+	if ok {
+		delete(all, pattern)
+		b.set(BulkheadLimits{})
+	} else {
+		all[pattern] = &bulkhead{pattern: pattern, limits: limits}
+	}
+	s.bulkheads.Store(newBulkheadTable(all))
+}
+
+// BulkheadStats 返回每个 bulkhead 的统计，key 为 pattern
+func (s *Server) BulkheadStats() map[string]BulkheadStats {
+	t := s.bulkheadTable()
+	stats := make(map[string]BulkheadStats, len(t.all))
+	for pattern, b := range t.all {
+		stats[pattern] = b.snapshot()
+	}
+	return stats
+}
+
+func (s *Server) bulkheadTable() *bulkheadTable {
+	t, _ := s.bulkheads.Load().(*bulkheadTable)
+	if t == nil {
+		return emptyBulkheads
+	}
+	return t
+}
+
+// bulkheadOf 返回 serviceMethod 使用的 bulkhead，没有匹配的 bulkhead 时返回 nil
+func (s *Server) bulkheadOf(serviceMethod string) *bulkhead {
+	t, _ := s.bulkheads.Load().(*bulkheadTable)
+	if t == nil {
+		return nil
+	}
+	return t.resolve(serviceMethod)
+}
+
+type bulkheadPrefix struct {
+	prefix string
+	b      *bulkhead
+}
+
+// bulkheadTable 一组 bulkhead 的匹配规则，创建后不再修改，SetBulkhead 增删 bulkhead 时整体替换
+type bulkheadTable struct {
+	all      map[string]*bulkhead // key: pattern
+	exact    map[string]*bulkhead
+	prefixes []bulkheadPrefix // 按前缀从长到短排列
+	def      *bulkhead        // "*"
+}
+
+var emptyBulkheads = newBulkheadTable(nil)
+
+func newBulkheadTable(all map[string]*bulkhead) *bulkheadTable {
+	t := &bulkheadTable{all: all, exact: make(map[string]*bulkhead)}
+	for pattern, b := range all {
+		switch {
+		case pattern == "*":
+			t.def = b
+		case strings.HasSuffix(pattern, "*"):
+			t.prefixes = append(t.prefixes, bulkheadPrefix{prefix: strings.TrimSuffix(pattern, "*"), b: b})
+		default:
+			t.exact[pattern] = b
+		}
+	}
+	sort.Slice(t.prefixes, func(i, j int) bool {
+		return len(t.prefixes[i].prefix) > len(t.prefixes[j].prefix)
+	})
+	return t
+}
+
+func (t *bulkheadTable) resolve(serviceMethod string) *bulkhead {
+	if b, ok := t.exact[serviceMethod]; ok {
+		return b
+	}
+	for _, p := range t.prefixes {
+		if strings.HasPrefix(serviceMethod, p.prefix) {
+			return p.b
+		}
+	}
+	return t.def
+}
+
+// bulkheadWaiter 等待放行的请求
+type bulkheadWaiter struct {
+	ready    chan struct{} // 放行时关闭
+	admitted bool          // 是否已经放行，需要持有 bulkhead.mu
+}
+
+// bulkhead 一组方法的并发限制和 FIFO 等待队列。为 nil 时 acquire 和 release 什么也不做
+type bulkhead struct {
+	pattern string
+
+	mu       sync.Mutex
+	limits   BulkheadLimits // MaxConcurrent 小于等于 0 时（已经删除）不做限制
+	inflight int
+	queue    []*bulkheadWaiter
+	stats    BulkheadStats
+}
+
+// available 返回当前的限制是否允许再放行一个请求，调用时需要持有 b.mu
+func (b *bulkhead) available() bool {
+	return b.limits.MaxConcurrent <= 0 || b.inflight < b.limits.MaxConcurrent
+}
+
+// acquire 等待 serviceMethod 的请求被放行，返回 nil 时请求结束后需要调用 release
+func (b *bulkhead) acquire(ctx context.Context, serviceMethod string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	if b.available() && len(b.queue) == 0 {
+		b.inflight++
+		b.stats.Admitted++
+		b.mu.Unlock()
+		return nil
+	}
+	if len(b.queue) >= b.limits.MaxQueue {
+		b.stats.Rejected++
+		inflight, waiting := b.inflight, len(b.queue)
+		b.mu.Unlock()
+		return status.New(status.ResourceExhausted, fmt.Sprintf("rpc: bulkhead %s is full (%d running, %d waiting), rejected %s",
+			b.pattern, inflight, waiting, serviceMethod))
+	}
+	w := &bulkheadWaiter{ready: make(chan struct{})}
+	b.queue = append(b.queue, w)
+	b.stats.Queued++
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if w.admitted {
+		// 同时被放行了，交还额度
+		b.inflight--
+		b.dispatch()
+	} else {
+		for i, x := range b.queue {
+			if x == w {
+				b.queue = append(b.queue[:i:i], b.queue[i+1:]...)
+				break
+			}
+		}
+		b.stats.Expired++
+	}
+	return ctx.Err()
+}
+
+// release 请求结束，放行等待中的请求
+func (b *bulkhead) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.inflight--
+	b.dispatch()
+	b.mu.Unlock()
+}
+
+// set 修改限制并放行新的限制允许的请求
+func (b *bulkhead) set(limits BulkheadLimits) {
+	b.mu.Lock()
+	b.limits = limits
+	b.dispatch()
+	b.mu.Unlock()
+}
+
+// dispatch 在额度允许时按到达的顺序放行等待的请求，调用时需要持有 b.mu
+func (b *bulkhead) dispatch() {
+	for b.available() && len(b.queue) > 0 {
+		w := b.queue[0]
+		b.queue[0] = nil
+		b.queue = b.queue[1:]
+		b.inflight++
+		b.stats.Admitted++
+		w.admitted = true
+		close(w.ready)
+	}
+	if len(b.queue) == 0 {
+		b.queue = nil
+	}
+}
+
+func (b *bulkhead) snapshot() BulkheadStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.stats
+	st.BulkheadLimits = b.limits
+	st.InFlight = b.inflight
+	st.QueueDepth = len(b.queue)
+	return st
+}
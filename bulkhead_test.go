@@ -0,0 +1,157 @@
+package appleseed
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// Report Generate 阻塞到 release 被关闭
+type Report struct {
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+// unblock 关闭 release，可以多次调用。测试失败时也需要调用，否则 Shutdown 会一直等待阻塞的 handler
+func (r *Report) unblock() {
+	r.once.Do(func() { close(r.release) })
+}
+
+func (r *Report) Generate(args *Args, reply *Reply) error {
+	r.entered <- struct{}{}
+	<-r.release
+	return nil
+}
+
+func startReport(t *testing.T, opts ...ServerOption) (*Server, *Report, *client.Client) {
+	s, lis := startHooksServer(t, opts...)
+	report := &Report{entered: make(chan struct{}, 64), release: make(chan struct{})}
+	if err := s.Register(report); err != nil {
+		t.Fatal(err)
+	}
+	return s, report, dialHooks(t, lis)
+}
+
+// TestBulkheadIsolation 慢方法的请求占满自己的 bulkhead 并排队时，其他方法的请求延迟不受影响
+func TestBulkheadIsolation(t *testing.T) {
+	s, report, cli := startReport(t,
+		WithMethodConcurrency("*", 4),
+		WithBulkhead("Report.*", BulkheadLimits{MaxConcurrent: 2, MaxQueue: 16}))
+	defer s.Shutdown(context.Background())
+	defer report.unblock()
+	defer cli.Close()
+
+	done := make(chan *client.Call, 16)
+	for i := 0; i < 16; i++ {
+		cli.Go(context.Background(), "Report.Generate", &Args{}, new(Reply), done)
+	}
+	<-report.entered
+	<-report.entered
+	for i := int64(0); i < 50; i++ {
+		start := time.Now()
+		var reply Reply
+		if err := cli.Call(context.Background(), "XXX.Add", &Args{X: i, Y: 1}, &reply); err != nil || reply.Add != i+1 {
+			t.Fatalf("XXX.Add = %+v, %v", reply, err)
+		}
+		if d := time.Since(start); d > 200*time.Millisecond {
+			t.Fatalf("XXX.Add took %v while Report.Generate was flooded", d)
+		}
+	}
+	waitBulkhead(t, s, "Report.*", func(st BulkheadStats) bool { return st.QueueDepth == 14 })
+	st := s.BulkheadStats()
+	if r := st["Report.*"]; r.InFlight != 2 || r.QueueDepth != 14 || r.Rejected != 0 {
+		t.Fatalf("Report.* stats = %+v", r)
+	}
+	if d := st["*"]; d.InFlight != 0 || d.Admitted != 50 {
+		t.Fatalf("* stats = %+v", d)
+	}
+
+	report.unblock()
+	for i := 0; i < 16; i++ {
+		if call := <-done; call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+	if r := s.BulkheadStats()["Report.*"]; r.InFlight != 0 || r.QueueDepth != 0 || r.Admitted != 16 || r.Queued != 14 {
+		t.Fatalf("Report.* stats after release = %+v", r)
+	}
+}
+
+// TestBulkheadQueueFull 队列已满的请求返回 ResourceExhausted，等待中超时的请求返回 DeadlineExceeded，
+// SetBulkhead 放宽限制后等待的请求立即放行，删除后不再限制
+func TestBulkheadQueueFull(t *testing.T) {
+	s, report, cli := startReport(t, WithBulkhead("Report.Generate", BulkheadLimits{MaxConcurrent: 1, MaxQueue: 1}))
+	defer s.Shutdown(context.Background())
+	defer report.unblock()
+	defer cli.Close()
+
+	done := make(chan *client.Call, 8)
+	cli.Go(context.Background(), "Report.Generate", &Args{}, new(Reply), done)
+	<-report.entered
+	queued := cli.Go(context.Background(), "Report.Generate", &Args{X: 1}, new(Reply), make(chan *client.Call, 1))
+	waitBulkhead(t, s, "Report.Generate", func(st BulkheadStats) bool { return st.QueueDepth == 1 })
+
+	err := cli.Call(context.Background(), "Report.Generate", &Args{X: 2}, new(Reply))
+	if status.CodeOf(err) != status.ResourceExhausted {
+		t.Fatalf("overflow call = %v, want ResourceExhausted", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// 额度和队列都已满时，超时的请求同样被拒绝而不是等待
+	if err := cli.Call(ctx, "Report.Generate", &Args{X: 3}, new(Reply)); status.CodeOf(err) != status.ResourceExhausted {
+		t.Fatalf("overflow call with deadline = %v, want ResourceExhausted", err)
+	}
+	if st := s.BulkheadStats()["Report.Generate"]; st.InFlight != 1 || st.QueueDepth != 1 || st.Rejected != 2 ||
+		st.MaxConcurrent != 1 || st.MaxQueue != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	// 放宽限制，等待的请求立即放行
+	s.SetBulkhead("Report.Generate", BulkheadLimits{MaxConcurrent: 2, MaxQueue: 1})
+	<-report.entered
+	if st := s.BulkheadStats()["Report.Generate"]; st.InFlight != 2 || st.QueueDepth != 0 || st.MaxConcurrent != 2 {
+		t.Fatalf("stats after raising the limit = %+v", st)
+	}
+
+	// 额度已满时等待的请求在 ctx 结束时返回 DeadlineExceeded
+	cli.Go(context.Background(), "Report.Generate", &Args{}, new(Reply), done)
+	waitBulkhead(t, s, "Report.Generate", func(st BulkheadStats) bool { return st.QueueDepth == 1 })
+	s.SetBulkhead("Report.Generate", BulkheadLimits{MaxConcurrent: 2, MaxQueue: 2})
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := cli.Call(ctx, "Report.Generate", &Args{X: 4}, new(Reply)); status.CodeOf(err) != status.DeadlineExceeded {
+		t.Fatalf("queued call with deadline = %v, want DeadlineExceeded", err)
+	}
+	waitBulkhead(t, s, "Report.Generate", func(st BulkheadStats) bool { return st.Expired == 1 && st.QueueDepth == 1 })
+
+	// 删除 bulkhead，等待的请求立即放行
+	s.SetBulkhead("Report.Generate", BulkheadLimits{})
+	<-report.entered
+	if _, ok := s.BulkheadStats()["Report.Generate"]; ok {
+		t.Fatal("bulkhead not removed")
+	}
+	report.unblock()
+	<-queued.Done
+	for _, call := range []*client.Call{queued, <-done, <-done} {
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+}
+
+// waitBulkhead 等待 pattern 的统计满足 cond
+func waitBulkhead(t *testing.T, s *Server, pattern string, cond func(BulkheadStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond(s.BulkheadStats()[pattern]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bulkhead %s stats = %+v", pattern, s.BulkheadStats()[pattern])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,25 @@
+package appleseed
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+)
+
+// SetCacheTTL 在 handler 或者拦截器中调用，告诉客户端（见 client.Cache）这个响应可以缓存 ttl，覆盖客户端为方法
+// 配置的 TTL。ttl 向上取整到秒，<= 0 时表示不缓存。随响应 metadata 发送，经过 gateway 时原样转发，
+// 值和 HTTP 的 Cache-Control 头相同，可以直接作为 HTTP 响应头。ctx 不是 handler 的 ctx 时返回 false
+func SetCacheTTL(ctx context.Context, ttl time.Duration) bool {
+	seconds := int64(0)
+	if ttl > 0 {
+		seconds = int64((ttl + time.Second - 1) / time.Second)
+	}
+	return SetResponseMetadata(ctx, metadata.CacheControlKey, "max-age="+strconv.FormatInt(seconds, 10))
+}
+
+// SetNoStore 同 SetCacheTTL，告诉客户端这个响应不能被缓存，比如结果中包含只属于这一次请求的数据
+func SetNoStore(ctx context.Context) bool {
+	return SetResponseMetadata(ctx, metadata.CacheControlKey, "no-store")
+}
@@ -0,0 +1,51 @@
+package appleseed
+
+import (
+	"log"
+	"sync"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// WithChunking 客户端开启了拆分传输（见 codec.WithChunking）时，超过 chunkSize 的响应被拆分发送，
+// 接收的被拆分的请求最多拼接 maxBody 字节，超过时这个请求返回错误。参数 <= 0 时使用
+// codec.DefaultChunkSize 和 codec.DefaultMaxBodySize，这也是没有设置时的默认值
+func WithChunking(chunkSize int, maxBody int64) ServerOption {
+	return func(s *Server) {
+		s.chunkSize, s.maxBody = chunkSize, maxBody
+	}
+}
+
+// writeFragments 写入被拆分的响应剩余的 fragment，返回写入的大小。每个 fragment 单独加锁，
+// 其他请求的响应可以插在两个 fragment 之间发送
+func (s *Server) writeFragments(sendLock *sync.Mutex, c codec.ServerCodec, cc *codec.CountConn, seq uint64) (sent codec.MessageSize) {
+	fw, ok := c.(codec.FragmentWriter)
+	if !ok {
+		return sent
+	}
+	r, _ := c.(codec.SizeReporter)
+	for more := true; more; {
+		sendLock.Lock()
+		if !fw.Pending(seq) {
+			sendLock.Unlock()
+			return sent
+		}
+		var err error
+		s.setWriteDeadline(cc)
+		more, err = fw.WriteFragment(seq)
+		if err == nil && r != nil {
+			sent = sent.Add(r.LastWriteSize())
+		}
+		sendLock.Unlock()
+		if err != nil {
+			// 接收方已经收到了一部分 fragment，剩余的部分无法发送（写入失败或者 BodySource 读取失败），
+			// 关闭连接让客户端的调用失败，而不是一直等待
+			log.Println("rpc server: write response err: ", err)
+			if cc != nil {
+				cc.Close()
+			}
+			return sent
+		}
+	}
+	return sent
+}
@@ -0,0 +1,184 @@
+package appleseed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// blobSink 以流的方式接收 Blob.Get 的响应，done 之后再被写入时报错
+type blobSink struct {
+	t    *testing.T
+	n    int64 // 原子操作
+	done int32 // 原子操作
+}
+
+func (b *blobSink) BodyWriter() io.Writer { return b }
+
+func (b *blobSink) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&b.done) == 1 {
+		b.t.Error("sink written after Call returned")
+	}
+	atomic.AddInt64(&b.n, int64(len(p)))
+	return len(p), nil
+}
+
+type blob struct {
+	Data []byte
+}
+
+// startBlobServer Blob.Get 返回参数指定大小的数据，Blob.Put 返回收到的数据的大小
+func startBlobServer(t *testing.T, puts *int64) (*client.Client, func()) {
+	ctx := context.Background()
+	h := func(ctx context.Context, serviceMethod string, req, reply *codec.RawMessage) error {
+		switch serviceMethod {
+		case "Blob.Get":
+			n, _ := strconv.Atoi(string(req.Data))
+			*reply = codec.RawMessage{Codec: req.Codec, Data: bytes.Repeat([]byte("a"), n)}
+		case "Blob.Put":
+			atomic.AddInt64(puts, 1)
+			var b blob
+			if err := json.Unmarshal(req.Data, &b); err != nil {
+				return err
+			}
+			*reply = codec.RawMessage{Codec: req.Codec, Data: []byte(strconv.Itoa(len(b.Data)))}
+		}
+		return nil
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(ctx, "blob", "127.0.0.1", "0", memory.New(nil), WithUnknownServiceHandler(h), WithChunking(1024, 64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	cli, err := client.Dial(ctx, "tcp", lis.Addr().String(), client.WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+		return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"), codec.WithChunking(1024, 64<<10))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 收到服务端的 preface 之后才会拆分
+	var n int
+	if err := cli.Call(ctx, "Blob.Put", &blob{}, &n); err != nil {
+		t.Fatal(err)
+	}
+	return cli, func() {
+		cli.Close()
+		s.Shutdown(ctx)
+	}
+}
+
+func get(ctx context.Context, cli *client.Client, n int, reply any) error {
+	return cli.Call(ctx, "Blob.Get", codec.RawMessage{Codec: "json", Data: []byte(strconv.Itoa(n))}, reply)
+}
+
+// TestChunkingInterleaving 下载很大的响应期间，同一个连接上的小调用不需要等待它完成
+func TestChunkingInterleaving(t *testing.T) {
+	cli, stop := startBlobServer(t, new(int64))
+	defer stop()
+	ctx := context.Background()
+
+	const size = 32 << 20
+	sink := &blobSink{t: t}
+	errc := make(chan error, 1)
+	go func() { errc <- get(ctx, cli, size, sink) }()
+	var during int
+	for during == 0 {
+		var n int
+		if err := cli.Call(ctx, "Blob.Put", &blob{Data: []byte("small")}, &n); err != nil || n != 5 {
+			t.Fatalf("Put() = %v, %v", n, err)
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("download finished before a small call, err = %v", err)
+		default:
+		}
+		if got := atomic.LoadInt64(&sink.n); got > 0 && got < size {
+			during++
+		}
+	}
+	if err := <-errc; err != nil || sink.n != size {
+		t.Fatalf("Get() = %v, sink %d bytes", err, sink.n)
+	}
+
+	// 不实现 BodySink 的 reply 在内存中拼接，超过 maxBody 时只有这个调用失败
+	var raw codec.RawMessage
+	if err := get(ctx, cli, 32<<10, &raw); err != nil || len(raw.Data) != 32<<10 {
+		t.Fatalf("Get() = %d bytes, %v", len(raw.Data), err)
+	}
+	if err := get(ctx, cli, 128<<10, &raw); !errors.Is(err, codec.ErrBodyTooLarge) {
+		t.Fatalf("Get() = %v", err)
+	}
+}
+
+// TestChunkingMaxBody 服务端拼接的请求超过 maxBody 时返回 ResourceExhausted，连接仍然可用
+func TestChunkingMaxBody(t *testing.T) {
+	cli, stop := startBlobServer(t, new(int64))
+	defer stop()
+	ctx := context.Background()
+	var n int
+	if err := cli.Call(ctx, "Blob.Put", &blob{Data: make([]byte, 32<<10)}, &n); err != nil || n != 32<<10 {
+		t.Fatalf("Put() = %v, %v", n, err)
+	}
+	err := cli.Call(ctx, "Blob.Put", &blob{Data: make([]byte, 128<<10)}, &n)
+	if status.CodeOf(err) != status.ResourceExhausted {
+		t.Fatalf("Put() = %v", err)
+	}
+	if err := cli.Call(ctx, "Blob.Put", &blob{Data: []byte("small")}, &n); err != nil || n != 5 {
+		t.Fatalf("Put() = %v, %v", n, err)
+	}
+}
+
+// TestChunkingCancel 传输期间取消调用，双方都丢弃已经传输的部分，连接仍然可用
+func TestChunkingCancel(t *testing.T) {
+	var puts int64
+	cli, stop := startBlobServer(t, &puts)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &blobSink{t: t}
+	errc := make(chan error, 1)
+	go func() { errc <- get(ctx, cli, 32<<20, sink) }()
+	for atomic.LoadInt64(&sink.n) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Get() = %v", err)
+	}
+	atomic.StoreInt32(&sink.done, 1)
+
+	// 请求在发送期间被取消，服务端丢弃收到的部分，不会调用 handler
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { errc <- cli.Call(ctx, "Blob.Put", &blob{Data: make([]byte, 8<<20)}, new(int)) }()
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+	// ctx 也可能在发起调用之前就已经结束
+	if err := <-errc; err == nil {
+		t.Skip("upload finished before cancel")
+	}
+
+	var n int
+	if err := cli.Call(context.Background(), "Blob.Put", &blob{Data: []byte("small")}, &n); err != nil || n != 5 {
+		t.Fatalf("Put() = %v, %v", n, err)
+	}
+	// 加上 startBlobServer 中的一次
+	if p := atomic.LoadInt64(&puts); p != 2 {
+		t.Fatalf("handler called %d times", p)
+	}
+}
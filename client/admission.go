@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueueFull 开启了准入控制（WithAdmission）并且等待队列已满时，调用直接返回该错误
+var ErrQueueFull = errors.New("rpc: client queue is full")
+
+// WithAdmission 限制连接上同时进行的调用数量为 maxConcurrent，超出的调用进入最多 maxQueue 个的等待队列，
+// 队列已满时返回 ErrQueueFull。等待的调用按照方法轮流放行，一个调用很多的方法不会让其他方法一直等待；
+// ctx 在等待期间结束的调用返回 ctx.Err()，不会被发送。maxConcurrent 小于等于 0 时不做限制
+func WithAdmission(maxConcurrent, maxQueue int) ClientOption {
+	return func(c *Client) {
+		if maxConcurrent > 0 {
+			c.admission = newAdmission(NewAdmissionLimits(maxConcurrent, maxQueue))
+		}
+	}
+}
+
+// WithAdmissionLimits 和 WithAdmission 相同，但是限制来自 l，可以在运行时通过 l.Set 修改。l 可以在多个 Client
+// 之间共享（比如通过 WithClientOptions 传给 Pool），每个 Client 分别按照 l 的值限制自己的调用
+func WithAdmissionLimits(l *AdmissionLimits) ClientOption {
+	return func(c *Client) {
+		c.admission = newAdmission(l)
+	}
+}
+
+// AdmissionLimits 可以在运行时修改的准入控制的限制，见 WithAdmissionLimits。并发安全
+type AdmissionLimits struct {
+	v atomic.Value // admissionLimits
+}
+
+type admissionLimits struct {
+	maxConcurrent, maxQueue int
+}
+
+// NewAdmissionLimits 返回初始值为 maxConcurrent、maxQueue 的 AdmissionLimits，含义见 Set
+func NewAdmissionLimits(maxConcurrent, maxQueue int) *AdmissionLimits {
+	l := new(AdmissionLimits)
+	l.Set(maxConcurrent, maxQueue)
+	return l
+}
+
+// Set 修改限制，之后的调用立即使用新的限制。maxConcurrent 小于等于 0 时不做限制，maxQueue 小于 0 时为 0。
+// 放宽限制后已经在等待的调用在下一个调用结束时放行
+func (l *AdmissionLimits) Set(maxConcurrent, maxQueue int) {
+	if maxQueue < 0 {
+		maxQueue = 0
+	}
+	l.v.Store(admissionLimits{maxConcurrent: maxConcurrent, maxQueue: maxQueue})
+}
+
+// Get 返回当前的限制
+func (l *AdmissionLimits) Get() (maxConcurrent, maxQueue int) {
+	v, _ := l.v.Load().(admissionLimits)
+	return v.maxConcurrent, v.maxQueue
+}
+
+// ClientStats Client 的统计
+type ClientStats struct {
+	InFlight   int           // 正在进行的调用数量，只在开启准入控制时统计
+	QueueDepth int           // 正在等待的调用数量
+	Queued     uint64        // 等待过的调用数量
+	Rejected   uint64        // 因为队列已满被拒绝的调用数量
+	Expired    uint64        // ctx 在等待期间结束的调用数量
+	WaitTime   time.Duration // 所有调用等待的总时间
+
+	// Methods 每个方法的累计统计，key 为 "Service.Method"，不需要开启准入控制
+	Methods map[string]MethodStats
+	// SendQueue 每个优先级的发送队列的统计，不需要开启准入控制
+	SendQueue map[Priority]SendQueueStats
+	// OrphanResponses 收到的没有对应调用的响应数量，见 WithOrphanResponseHandler
+	OrphanResponses uint64
+	// BadResponses 无法解码而跳过的响应数量，见 ErrBadResponse
+	BadResponses uint64
+}
+
+// waiter 等待放行的调用
+type waiter struct {
+	method   string
+	ready    chan struct{} // 放行时关闭
+	admitted bool          // 是否已经放行，需要持有 admission.mu
+}
+
+// admission 并发限制以及按照方法公平调度的等待队列
+type admission struct {
+	mu       sync.Mutex
+	limits   *AdmissionLimits
+	inflight int
+	queues   map[string][]*waiter // key: serviceMethod
+	methods  []string             // 有调用在等待的方法，按照 next 轮流放行
+	next     int
+	stats    ClientStats
+}
+
+func newAdmission(limits *AdmissionLimits) *admission {
+	return &admission{limits: limits, queues: make(map[string][]*waiter)}
+}
+
+// available 返回当前的限制是否允许再放行一个调用，调用时需要持有 a.mu
+func (a *admission) available() bool {
+	limit, _ := a.limits.Get()
+	return limit <= 0 || a.inflight < limit
+}
+
+// acquire 等待 method 的调用被放行，返回 nil 时调用结束后需要调用 release
+func (a *admission) acquire(ctx context.Context, method string) error {
+	a.mu.Lock()
+	if a.available() && a.stats.QueueDepth == 0 {
+		a.inflight++
+		a.mu.Unlock()
+		return nil
+	}
+	if _, maxQueue := a.limits.Get(); a.stats.QueueDepth >= maxQueue {
+		a.stats.Rejected++
+		a.mu.Unlock()
+		return ErrQueueFull
+	}
+	w := &waiter{method: method, ready: make(chan struct{})}
+	if len(a.queues[method]) == 0 {
+		a.methods = append(a.methods, method)
+	}
+	a.queues[method] = append(a.queues[method], w)
+	a.stats.QueueDepth++
+	a.stats.Queued++
+	a.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-w.ready:
+		a.mu.Lock()
+		a.stats.WaitTime += time.Since(start)
+		a.mu.Unlock()
+		return nil
+	case <-ctx.Done():
+	}
+	a.mu.Lock()
+	a.stats.WaitTime += time.Since(start)
+	if w.admitted {
+		// 同时被放行了，交还额度
+		a.inflight--
+		a.dispatch()
+	} else {
+		a.remove(w)
+		a.stats.Expired++
+	}
+	a.mu.Unlock()
+	return ctx.Err()
+}
+
+// release 调用结束，放行等待中的调用
+func (a *admission) release() {
+	a.mu.Lock()
+	a.inflight--
+	a.dispatch()
+	a.mu.Unlock()
+}
+
+// dispatch 在额度允许时，从每个方法的队列中轮流放行一个调用，调用时需要持有 a.mu
+func (a *admission) dispatch() {
+	for a.available() && len(a.methods) > 0 {
+		if a.next >= len(a.methods) {
+			a.next = 0
+		}
+		method := a.methods[a.next]
+		queue := a.queues[method]
+		w := queue[0]
+		queue[0] = nil
+		if len(queue) == 1 {
+			delete(a.queues, method)
+			a.methods = append(a.methods[:a.next], a.methods[a.next+1:]...)
+		} else {
+			a.queues[method] = queue[1:]
+			a.next++
+		}
+		a.stats.QueueDepth--
+		a.inflight++
+		w.admitted = true
+		close(w.ready)
+	}
+}
+
+// remove 将 ctx 已经结束的 w 从队列中移除，调用时需要持有 a.mu
+func (a *admission) remove(w *waiter) {
+	queue := a.queues[w.method]
+	for i, x := range queue {
+		if x == w {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	a.stats.QueueDepth--
+	if len(queue) > 0 {
+		a.queues[w.method] = queue
+		return
+	}
+	delete(a.queues, w.method)
+	for i, m := range a.methods {
+		if m == w.method {
+			a.methods = append(a.methods[:i], a.methods[i+1:]...)
+			if a.next > i {
+				a.next--
+			}
+			break
+		}
+	}
+}
+
+func (a *admission) snapshot() ClientStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.stats
+	s.InFlight = a.inflight
+	return s
+}
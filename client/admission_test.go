@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+// Sched 记录方法被执行的顺序，每次调用耗时 delay
+type Sched struct {
+	delay time.Duration
+	mu    sync.Mutex
+	order []string
+}
+
+func (s *Sched) record(method string) {
+	s.mu.Lock()
+	s.order = append(s.order, method)
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+}
+
+func (s *Sched) Chatty(args *int, reply *int) error {
+	s.record("Chatty")
+	return nil
+}
+
+func (s *Sched) Quiet(args *int, reply *int) error {
+	s.record("Quiet")
+	return nil
+}
+
+func (s *Sched) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.order...)
+}
+
+func startSched(t *testing.T, delay time.Duration, opts ...ClientOption) (*Sched, *Client) {
+	t.Helper()
+	s, _, addr := startEcho(t, memory.New(nil), "sched", 0)
+	sched := &Sched{delay: delay}
+	if err := s.Register(sched); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := NewClient(conn, addr, opts...)
+	t.Cleanup(func() { cli.Close() })
+	return sched, cli
+}
+
+// waitQueue 等待 cli 的等待队列中有 n 个调用
+func waitQueue(t *testing.T, cli *Client, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for cli.Stats().QueueDepth != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth = %d, want %d", cli.Stats().QueueDepth, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdmissionFairness(t *testing.T) {
+	sched, cli := startSched(t, 10*time.Millisecond, WithAdmission(1, 100))
+	var wg sync.WaitGroup
+	call := func(method string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var arg, reply int
+			if err := cli.Call(context.Background(), method, &arg, &reply); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// 20 个 Chatty 调用先进入队列，之后才到达的 Quiet 调用不需要等它们全部完成
+	for i := 0; i < 20; i++ {
+		call("Sched.Chatty")
+	}
+	waitQueue(t, cli, 19)
+	call("Sched.Quiet")
+	call("Sched.Quiet")
+	waitQueue(t, cli, 21)
+	wg.Wait()
+
+	order := sched.calls()
+	if len(order) != 22 {
+		t.Fatalf("got %d calls", len(order))
+	}
+	var quiet []int
+	for i, m := range order {
+		if m == "Quiet" {
+			quiet = append(quiet, i)
+		}
+	}
+	if len(quiet) != 2 || quiet[1] > 5 {
+		t.Fatalf("Quiet executed at %v, order %v", quiet, order)
+	}
+	s := cli.Stats()
+	if s.InFlight != 0 || s.QueueDepth != 0 || s.Queued != 21 || s.WaitTime <= 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	sched, cli := startSched(t, 100*time.Millisecond, WithAdmission(1, 1))
+	var arg, reply int
+	first := cli.Go(context.Background(), "Sched.Chatty", &arg, &reply, nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for cli.Stats().InFlight != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("first call not admitted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// ctx 在等待期间结束的调用不会被发送
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cli.Call(ctx, "Sched.Quiet", &arg, &reply); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 队列已满
+	queued := cli.Go(context.Background(), "Sched.Quiet", &arg, &reply, nil)
+	waitQueue(t, cli, 1)
+	if err := cli.Call(context.Background(), "Sched.Quiet", &arg, &reply); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("err = %v", err)
+	}
+
+	for _, c := range []*Call{first, queued} {
+		if c = <-c.Done; c.Error != nil {
+			t.Fatal(c.Error)
+		}
+	}
+	if order := sched.calls(); len(order) != 2 || order[0] != "Chatty" || order[1] != "Quiet" {
+		t.Fatalf("server saw %v", order)
+	}
+	s := cli.Stats()
+	if s.InFlight != 0 || s.QueueDepth != 0 || s.Queued != 2 || s.Expired != 1 || s.Rejected != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestAdmissionReleasedOnTimeout(t *testing.T) {
+	_, cli := startSched(t, 50*time.Millisecond, WithAdmission(1, 0))
+	var arg, reply int
+	// 已经发送的调用超时后交还额度，不需要等待响应
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cli.Call(ctx, "Sched.Chatty", &arg, &reply); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	if s := cli.Stats(); s.InFlight != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+	if err := cli.Call(context.Background(), "Sched.Chatty", &arg, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// 连接关闭后交还额度
+	cli.Close()
+	if err := cli.Call(context.Background(), "Sched.Chatty", &arg, &reply); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("err = %v", err)
+	}
+	if s := cli.Stats(); s.InFlight != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+// TestAdmissionLimitsSet 运行时修改的限制对之后的调用立即生效
+func TestAdmissionLimitsSet(t *testing.T) {
+	limits := NewAdmissionLimits(1, 0)
+	_, cli := startSched(t, 50*time.Millisecond, WithAdmissionLimits(limits))
+	done := make(chan error, 1)
+	go func() {
+		var arg, reply int
+		done <- cli.Call(context.Background(), "Sched.Chatty", &arg, &reply)
+	}()
+	for cli.Stats().InFlight != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	var arg, reply int
+	if err := cli.Call(context.Background(), "Sched.Quiet", &arg, &reply); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Call() = %v, want ErrQueueFull", err)
+	}
+	// 不限制时不需要等待正在进行的调用
+	limits.Set(0, 0)
+	if err := cli.Call(context.Background(), "Sched.Quiet", &arg, &reply); err != nil {
+		t.Fatalf("Call() after raising the limit = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := limits.Get(); got != 0 {
+		t.Fatalf("Get() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// ErrBadResponse 收到了完整的响应但是无法解码（header 不合法或者 body 无法解码到 reply），可以使用 errors.Is 判断。
+// 只有这个响应对应的调用失败，连接上的其他调用不受影响，跳过的响应数量见 ClientStats.BadResponses
+var ErrBadResponse = errors.New("rpc: bad response")
+
+// badResponseError 无法解码的响应，errors.Is 对 ErrBadResponse 成立，errors.As 可以得到 *codec.MessageError
+type badResponseError struct {
+	err error
+}
+
+func (e *badResponseError) Error() string {
+	return ErrBadResponse.Error() + ": " + e.err.Error()
+}
+
+func (e *badResponseError) Unwrap() error {
+	return e.err
+}
+
+func (e *badResponseError) Is(target error) bool {
+	return target == ErrBadResponse
+}
+
+// WithFrameReadTimeout 开始读取一个响应之后，整个响应需要在 d 之内到达，否则连接被关闭，避免服务端（或者中间的代理）
+// 每次只发送几个字节时接收 goroutine 一直阻塞，连接上的调用都无法结束。等待下一个响应的空闲连接不受限制，
+// 被拆分传输的响应每个 fragment 分别计时。默认不限制。只对二进制协议和实现了 SetReadDeadline 的连接生效
+func WithFrameReadTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.frameReadTimeout = d
+	}
+}
+
+// readDeadliner 可以设置读取期限的连接，net.Conn 实现了它
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// setFrameReadTimeout 将 WithFrameReadTimeout 的设置交给 codec，conn 为传给 NewClient 的连接
+func (c *Client) setFrameReadTimeout(conn any) {
+	if c.frameReadTimeout <= 0 {
+		return
+	}
+	fc, ok := c.codec.(codec.FrameReadTimeouter)
+	d, ok2 := conn.(readDeadliner)
+	if !ok || !ok2 {
+		log.Printf("rpc: frame read timeout is not supported by %T over %T\n", c.codec, conn)
+		return
+	}
+	fc.SetFrameReadTimeout(c.frameReadTimeout, d.SetReadDeadline)
+}
+
+// badResponse 处理无法解码的响应 header：结束 seq 对应的调用，连接继续使用。只计入 ClientStats.BadResponses，
+// 不记录日志，对端持续发送无法解码的响应时不会刷屏
+func (c *Client) badResponse(me *codec.MessageError) {
+	atomic.AddUint64(&c.badResponses, 1)
+	if !me.SeqKnown {
+		return
+	}
+	if call := c.pending.remove(me.Seq); call != nil {
+		call.Error = &badResponseError{err: me}
+		call.done()
+	}
+}
+
+// bodyError 转换读取响应 body 的错误，无法解码的 body 只影响这个调用
+func (c *Client) bodyError(err error) error {
+	var me *codec.MessageError
+	if errors.As(err, &me) {
+		atomic.AddUint64(&c.badResponses, 1)
+		return &badResponseError{err: err}
+	}
+	return err
+}
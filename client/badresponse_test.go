@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+// rawFrame 返回 data 组成的 frame
+func rawFrame(data []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(data)))
+	return append(b[:n:n], data...)
+}
+
+// poisonClient 返回使用二进制协议连接到 inproc.Pipe 的 Client 和服务端的连接，服务端读取 n 个请求后调用 respond
+func poisonClient(t testing.TB, n int, respond func(s *inproc.Conn, sc *codec.BinaryServerCodec, reqs []codec.RequestHeader), opts ...ClientOption) *Client {
+	c, s := inproc.Pipe()
+	opts = append(opts, WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+		return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"))
+	}))
+	cli := NewClient(c, "pipe", opts...)
+	t.Cleanup(func() {
+		cli.Close()
+		s.Close()
+	})
+	go func() {
+		sc := codec.NewBinaryServerCodec(s)
+		var reqs []codec.RequestHeader
+		for i := 0; i < n; i++ {
+			var req codec.RequestHeader
+			if sc.ReadRequestHeader(&req) != nil || sc.ReadRequestBody(nil) != nil {
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		respond(s, sc, reqs)
+	}()
+	return cli
+}
+
+// TestBadResponse 无法解码的响应只让对应的调用失败，连接上的其他调用正常结束
+func TestBadResponse(t *testing.T) {
+	cli := poisonClient(t, 3, func(s *inproc.Conn, sc *codec.BinaryServerCodec, reqs []codec.RequestHeader) {
+		// header 在错误信息中间截断
+		s.Write(rawFrame([]byte{byte(reqs[0].Seq), 1 << 3, 2, 10, 'b', 'o'}))
+		// body 不是合法的 json
+		s.Write(rawFrame([]byte{byte(reqs[1].Seq), 0, '{'}))
+		sc.WriteResponse(&codec.ResponseHeader{Seq: reqs[2].Seq}, 42)
+	})
+	done := make(chan *Call, 3)
+	calls := make(map[uint64]*Call)
+	for i := 0; i < 3; i++ {
+		call := cli.Go(context.Background(), "Echo.Ping", i, new(int), done)
+		calls[call.seq] = call
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	var bad []*Call
+	for _, call := range calls {
+		if call.Error == nil {
+			if *call.Reply.(*int) != 42 {
+				t.Fatalf("reply = %v", *call.Reply.(*int))
+			}
+			continue
+		}
+		if !errors.Is(call.Error, ErrBadResponse) {
+			t.Fatalf("call %d err = %v, want ErrBadResponse", call.seq, call.Error)
+		}
+		var me *codec.MessageError
+		if !errors.As(call.Error, &me) {
+			t.Fatalf("call %d err = %#v, want a codec.MessageError", call.seq, call.Error)
+		}
+		bad = append(bad, call)
+	}
+	if len(bad) != 2 {
+		t.Fatalf("%d calls failed, want 2", len(bad))
+	}
+	if n := cli.Stats().BadResponses; n != 2 {
+		t.Fatalf("BadResponses = %d, want 2", n)
+	}
+	if cli.State() != ConnReady {
+		t.Fatalf("state = %v, want the connection kept", cli.State())
+	}
+}
+
+// TestFrameReadTimeout 响应只发送了一部分时，连接在超时之后关闭，调用不会一直等待
+func TestFrameReadTimeout(t *testing.T) {
+	cli := poisonClient(t, 1, func(s *inproc.Conn, sc *codec.BinaryServerCodec, reqs []codec.RequestHeader) {
+		s.Write([]byte{10, byte(reqs[0].Seq)})
+	}, WithFrameReadTimeout(50*time.Millisecond))
+	start := time.Now()
+	err := cli.Call(context.Background(), "Echo.Ping", 1, new(int))
+	if !errors.Is(err, ErrConnectionLost) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Call() = %v, want a lost connection after the read deadline", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Call() took %v", d)
+	}
+}
+
+// FuzzRecv 服务端发送任意内容时，接收 goroutine 不会 panic，连接断开后所有的调用都会结束并从 pending 中移除
+func FuzzRecv(f *testing.F) {
+	f.Add(byte(0), []byte{1, 0, '4', '2'})
+	f.Add(byte(0), []byte{2, 1 << 3, 2, 10, 'b', 'o'})
+	f.Add(byte(0), []byte{1, 1 << 6, '1'})
+	f.Add(byte(0), []byte{3, 1 << 7, 0, 1, 'x'})
+	f.Add(byte(0), []byte{1, 1 << 2, 200, 1})
+	f.Add(byte(1), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f})
+	f.Fuzz(func(t *testing.T, mode byte, data []byte) {
+		cli := poisonClient(t, 3, func(s *inproc.Conn, sc *codec.BinaryServerCodec, reqs []codec.RequestHeader) {
+			if mode&1 == 0 {
+				s.Write(rawFrame(data))
+				s.Write(rawFrame(data))
+			} else {
+				s.Write(data)
+			}
+			s.Close()
+		})
+		done := make(chan *Call, 3)
+		for i := 0; i < 3; i++ {
+			cli.Go(context.Background(), "Echo.Ping", i, new(int), done)
+		}
+		for i := 0; i < 3; i++ {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("call not finished after the connection was closed")
+			}
+		}
+		if n := cli.pending.len(); n != 0 {
+			t.Fatalf("%d calls left in pending", n)
+		}
+	})
+}
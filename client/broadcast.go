@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// defaultBroadcastParallelism Broadcast 默认同时进行的调用数
+const defaultBroadcastParallelism = 16
+
+// InstanceResult Broadcast 中对一个实例的调用结果
+type InstanceResult struct {
+	Addr    string
+	Reply   any // 和 Broadcast 传入的 reply 类型相同的新值，调用失败时为 nil
+	Err     error
+	Latency time.Duration // 包括建立连接的时间
+}
+
+// BroadcastError Broadcast 中有实例调用失败时返回，每个实例的错误见返回的 []InstanceResult
+type BroadcastError struct {
+	Failed int // 失败的实例数
+	Total  int
+	First  error // 第一个失败的调用的错误，带有实例的地址
+}
+
+func (e *BroadcastError) Error() string {
+	return fmt.Sprintf("rpc: broadcast failed on %d of %d instances, first error: %v", e.Failed, e.Total, e.First)
+}
+
+func (e *BroadcastError) Unwrap() error {
+	return e.First
+}
+
+// BroadcastOption 用于配置 Broadcast
+type BroadcastOption func(*broadcastOptions)
+
+type broadcastOptions struct {
+	failFast    bool
+	parallelism int
+}
+
+// WithFailFast 第一个实例调用失败时取消其他还在进行以及还没有开始的调用，并返回该错误。
+// 默认等待所有实例完成，有失败时返回 *BroadcastError
+func WithFailFast() BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.failFast = true
+	}
+}
+
+// WithBroadcastParallelism 最多同时调用 n 个实例，默认为 16
+func WithBroadcastParallelism(n int) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.parallelism = n
+	}
+}
+
+// Broadcast 调用注册中心中 serviceName 的每一个实例（而不是通过负载均衡器选择其中一个），用于缓存失效、
+// 推送配置等场景。reply 只用于确定响应的类型，不会被修改，每个实例的响应保存在各自的 InstanceResult.Reply 中。
+//
+// 实例列表每次都从注册中心获取，包括没有交给负载均衡器的实例（比如 WithSubset 之外的实例）。调用复用 Pool
+// 中的连接，无法建立连接的实例不会留在 Pool 中。ctx 的 deadline 对整个 Broadcast 生效，ctx 结束后还没有开始的
+// 调用直接以 ctx.Err() 结束。Broadcast 不经过负载均衡器，调用结果也不会上报给它。
+//
+// 返回的结果和注册中心中实例的顺序相同，除了获取实例失败，总是返回所有实例的结果
+func (p *Pool) Broadcast(ctx context.Context, serviceMethod string, arg, reply any, opts ...BroadcastOption) ([]InstanceResult, error) {
+	o := broadcastOptions{parallelism: defaultBroadcastParallelism}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.parallelism <= 0 {
+		o.parallelism = 1
+	}
+	replyType := reflect.TypeOf(reply)
+	if replyType == nil || replyType.Kind() != reflect.Pointer {
+		return nil, fmt.Errorf("rpc: broadcast reply must be a pointer, got %T", reply)
+	}
+	instances, err := p.reg.GetInstances(ctx, p.serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("this service[%v] no address", p.serviceName)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]InstanceResult, len(instances))
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+		sem   = make(chan struct{}, o.parallelism)
+	)
+	for i, ins := range instances {
+		results[i].Addr = ins.Addr
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(r *InstanceResult) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			start := time.Now()
+			rep := reflect.New(replyType.Elem()).Interface()
+			r.Err = p.callAddr(ctx, r.Addr, serviceMethod, arg, rep)
+			r.Latency = time.Since(start)
+			if r.Err == nil {
+				r.Reply = rep
+				return
+			}
+			mu.Lock()
+			if first == nil {
+				first = fmt.Errorf("%s: %w", r.Addr, r.Err)
+				if o.failFast {
+					cancel()
+				}
+			}
+			mu.Unlock()
+		}(&results[i])
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r.Err == nil {
+			continue
+		}
+		failed++
+		if first == nil {
+			// 没有开始的调用是因为 ctx 结束
+			first = fmt.Errorf("%s: %w", r.Addr, r.Err)
+		}
+	}
+	switch {
+	case failed == 0:
+		return results, nil
+	case o.failFast:
+		return results, first
+	}
+	return results, &BroadcastError{Failed: failed, Total: len(results), First: first}
+}
+
+// callAddr 通过 Pool 中到 addr 的连接发起调用，不经过负载均衡器
+func (p *Pool) callAddr(ctx context.Context, addr, serviceMethod string, arg, reply any) error {
+	cli, err := p.client(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return cli.Call(ctx, serviceMethod, arg, reply)
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+// downAddr 返回一个没有服务监听的地址
+func downAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func TestBroadcast(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	_, e1, addr1 := startEcho(t, reg, "echo", 0)
+	_, e2, addr2 := startEcho(t, reg, "echo", 0)
+	down := downAddr(t)
+	if err := reg.Register(ctx, "echo", down); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := NewPool(ctx, reg, "echo", WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	arg := 42
+	results, err := pool.Broadcast(ctx, "Echo.Ping", &arg, new(int))
+	var be *BroadcastError
+	if !errors.As(err, &be) || be.Failed != 1 || be.Total != 3 {
+		t.Fatalf("err = %v", err)
+	}
+	ok := map[string]bool{}
+	for _, r := range results {
+		switch r.Addr {
+		case addr1, addr2:
+			if r.Err != nil || *r.Reply.(*int) != 42 || r.Latency <= 0 {
+				t.Fatalf("%s: reply = %v, err = %v", r.Addr, r.Reply, r.Err)
+			}
+			ok[r.Addr] = true
+		case down:
+			var opErr *net.OpError
+			if r.Err == nil || r.Reply != nil || !errors.As(r.Err, &opErr) || opErr.Op != "dial" {
+				t.Fatalf("down instance: reply = %v, err = %v", r.Reply, r.Err)
+			}
+		default:
+			t.Fatalf("unexpected addr %s", r.Addr)
+		}
+	}
+	if len(results) != 3 || len(ok) != 2 || atomic.LoadInt64(&e1.calls) != 1 || atomic.LoadInt64(&e2.calls) != 1 {
+		t.Fatalf("results = %+v", results)
+	}
+	// 无法建立连接的实例不会留在 Pool 中
+	pool.mu.Lock()
+	_, poisoned := pool.clients[connKey{down, 0}]
+	n := len(pool.clients)
+	pool.mu.Unlock()
+	if poisoned || n != 2 {
+		t.Fatalf("pool has %d clients, down instance pooled: %v", n, poisoned)
+	}
+}
+
+func TestBroadcastFailFast(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	_, slow, _ := startEcho(t, reg, "echo", 2*time.Second)
+	if err := reg.Register(ctx, "echo", downAddr(t)); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool(ctx, reg, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	start := time.Now()
+	arg := 1
+	results, err := pool.Broadcast(ctx, "Echo.Ping", &arg, new(int), WithFailFast())
+	if err == nil || errors.As(err, new(*BroadcastError)) {
+		t.Fatalf("err = %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("fail-fast broadcast took %v", d)
+	}
+	if len(results) != 2 || atomic.LoadInt64(&slow.calls) > 1 {
+		t.Fatalf("results = %+v", results)
+	}
+}
+
+// TestBroadcastDeadline ctx 的 deadline 对整个 Broadcast 生效，并发数为 1 时后面的实例不会开始
+func TestBroadcastDeadline(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	for i := 0; i < 3; i++ {
+		startEcho(t, reg, "echo", 200*time.Millisecond)
+	}
+	pool, err := NewPool(ctx, reg, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	arg := 1
+	results, err := pool.Broadcast(ctx, "Echo.Ping", &arg, new(int), WithBroadcastParallelism(1))
+	var be *BroadcastError
+	if !errors.As(err, &be) || be.Failed != 3 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("broadcast took %v after the deadline", d)
+	}
+	for _, r := range results {
+		if !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Fatalf("%s: err = %v", r.Addr, r.Err)
+		}
+	}
+}
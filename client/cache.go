@@ -0,0 +1,266 @@
+package client
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+var _ Caller = &Cache{}
+
+// DefaultCacheEntries Cache 默认最多保存的结果数
+const DefaultCacheEntries = 1000
+
+// CacheStats Cache 的统计
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64 // 因为超过 WithCacheMaxEntries 被淘汰的结果数，过期和 Invalidate 移除的不计入
+	Entries   int    // 当前保存的结果数
+}
+
+// CacheOption 用于配置 Cache
+type CacheOption func(*Cache)
+
+// WithCacheMethod 缓存 method（格式为 "Service.Method"）成功的结果 ttl
+func WithCacheMethod(method string, ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		m := c.methods[method]
+		m.ttl = ttl
+		c.methods[method] = m
+	}
+}
+
+// WithNegativeCache 缓存 method 返回 status.NotFound 的结果 ttl，和 WithCacheMethod 分别配置，
+// 比如不存在的 key 只缓存更短的时间。其他错误都不会被缓存
+func WithNegativeCache(method string, ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		m := c.methods[method]
+		m.notFoundTTL = ttl
+		c.methods[method] = m
+	}
+}
+
+// WithCacheMaxEntries 最多保存 n 个结果（默认为 DefaultCacheEntries），超过时淘汰最久没有被使用的结果
+func WithCacheMaxEntries(n int) CacheOption {
+	return func(c *Cache) {
+		if n > 0 {
+			c.maxEntries = n
+		}
+	}
+}
+
+type cacheMethod struct {
+	ttl         time.Duration // <= 0 时不缓存成功的结果
+	notFoundTTL time.Duration // <= 0 时不缓存 NotFound
+}
+
+// withDirective 服务端在响应中给出了缓存指示（见 metadata.CacheControlKey）时，返回按照指示修改后的配置：
+// no-store 时不缓存，max-age 替换 TTL。没有指示时返回 m
+func (m cacheMethod) withDirective(md metadata.MD) cacheMethod {
+	v, ok := md[metadata.CacheControlKey]
+	if !ok {
+		return m
+	}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		switch {
+		case d == "no-store":
+			return cacheMethod{}
+		case strings.HasPrefix(d, "max-age="):
+			if n, err := strconv.ParseInt(d[len("max-age="):], 10, 64); err == nil {
+				m.ttl = time.Duration(n) * time.Second
+				m.notFoundTTL = m.ttl
+			}
+		}
+	}
+	return m
+}
+
+// cacheEntry 一个缓存的结果
+type cacheEntry struct {
+	key     string
+	method  string
+	reply   []byte // gob 编码后的 reply，每次命中都重新解码
+	err     error  // NotFound 时不为 nil
+	expires time.Time
+}
+
+// Cache 在客户端缓存幂等的读方法（比如开关配置、静态的目录）的结果：对于配置的方法，serviceMethod 和 gob
+// 编码后的参数都相同的调用在 TTL 内直接返回缓存的结果，不再发起调用。结果以 gob 编码后的形式保存，每次命中都
+// 重新解码到调用方的 reply 中，所以调用方修改 reply 不会影响其他调用方。
+//
+// 服务端可以通过 appleseed.SetCacheTTL、appleseed.SetNoStore 为每个响应指定缓存的时间或者禁止缓存，
+// 优先于 WithCacheMethod、WithNegativeCache 的配置，只对配置了的方法生效。
+//
+// 参数中含有 map 时 gob 编码的结果不固定，这样的调用可能不会命中。相同的调用同时未命中时都会发起调用，
+// 需要合并时可以和 Dedup 组合使用：NewCache(NewDedup(pool, methods...), opts...)
+type Cache struct {
+	next       Caller
+	methods    map[string]cacheMethod
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List               // 最近使用的在前面
+	entries map[string]*list.Element // key: serviceMethod + 参数编码
+	gen     uint64                   // 每次 Invalidate 加 1，之前发起的调用的结果不再保存
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewCache 创建一个缓存 WithCacheMethod、WithNegativeCache 指定的方法的结果的 Caller，其他方法直接交给 next
+func NewCache(next Caller, opts ...CacheOption) *Cache {
+	c := &Cache{
+		next:       next,
+		methods:    make(map[string]cacheMethod),
+		maxEntries: DefaultCacheEntries,
+		now:        time.Now,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Stats 返回缓存的统计
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Entries:   n,
+	}
+}
+
+func (c *Cache) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	m, ok := c.methods[serviceMethod]
+	if rv := reflect.ValueOf(reply); !ok || rv.Kind() != reflect.Ptr || rv.IsNil() {
+		// reply 为 nil 时无法保存和写入结果，直接交给 next
+		return c.next.Call(ctx, serviceMethod, arg, reply)
+	}
+	key, ok := callKey(serviceMethod, arg)
+	if !ok {
+		// 无法编码的参数也无法发送，交给 next 返回错误
+		return c.next.Call(ctx, serviceMethod, arg, reply)
+	}
+
+	e, gen, ok := c.get(key)
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+		if e.err != nil {
+			return e.err
+		}
+		return gob.NewDecoder(bytes.NewReader(e.reply)).Decode(reply)
+	}
+	atomic.AddUint64(&c.misses, 1)
+	var md metadata.MD
+	err := c.next.Call(WithResponseMetadata(ctx, &md), serviceMethod, arg, reply)
+	if p, ok := ctx.Value(responseMetadataKey{}).(*metadata.MD); ok {
+		*p = md
+	}
+	c.put(gen, m.withDirective(md), &cacheEntry{key: key, method: serviceMethod, err: err}, reply)
+	return err
+}
+
+// get 返回 key 对应的没有过期的结果，同时返回当前的 gen
+func (c *Cache) get(key string) (e *cacheEntry, gen uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, c.gen, false
+	}
+	e = elem.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.remove(elem)
+		return nil, c.gen, false
+	}
+	c.lru.MoveToFront(elem)
+	return e, c.gen, true
+}
+
+// put 根据调用的结果保存 e：成功时编码 reply，NotFound 时保存错误，其他错误不保存。
+// 调用期间发生过 Invalidate 时不保存
+func (c *Cache) put(gen uint64, m cacheMethod, e *cacheEntry, reply any) {
+	ttl := m.ttl
+	if e.err != nil {
+		if s, _ := status.FromError(e.err); s.Code() != status.NotFound {
+			return
+		}
+		ttl = m.notFoundTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	if e.err == nil {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(reply); err != nil {
+			return
+		}
+		e.reply = buf.Bytes()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	e.expires = c.now().Add(ttl)
+	if elem, ok := c.entries[e.key]; ok {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// remove 移除 elem，调用方持有 mu
+func (c *Cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// Invalidate 移除 method 的所有结果，正在进行的调用的结果也不会被保存
+func (c *Cache) Invalidate(method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*cacheEntry).method == method {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// InvalidateAll 移除所有的结果
+func (c *Cache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// catalogCaller 返回以参数结尾的 Catalog，参数为 "missing" 时返回 NotFound，"fail" 时返回 Internal
+type catalogCaller struct {
+	calls int64
+}
+
+func (c *catalogCaller) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	atomic.AddInt64(&c.calls, 1)
+	switch name := *arg.(*string); name {
+	case "missing":
+		return status.New(status.NotFound, name+" not found")
+	case "fail":
+		return errBoom
+	default:
+		r := reply.(*Catalog)
+		r.Items = []string{"a", "b", name}
+		r.Index = map[string]int{"a": 0, "b": 1}
+		return nil
+	}
+}
+
+// fakeClock 手动前进的时钟
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestCache(opts ...CacheOption) (*Cache, *catalogCaller, *fakeClock) {
+	next := new(catalogCaller)
+	c := NewCache(next, opts...)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c.now = clock.Now
+	return c, next, clock
+}
+
+func get(t *testing.T, c *Cache, method, name string) (*Catalog, error) {
+	t.Helper()
+	reply := new(Catalog)
+	err := c.Call(context.Background(), method, &name, reply)
+	return reply, err
+}
+
+func TestCacheTTL(t *testing.T) {
+	c, next, clock := newTestCache(WithCacheMethod("Catalog.Get", time.Minute))
+	for i := 0; i < 3; i++ {
+		if r, err := get(t, c, "Catalog.Get", "x"); err != nil || r.Items[2] != "x" {
+			t.Fatalf("Get() = %+v, %v", r, err)
+		}
+	}
+	// 没有配置的方法不缓存
+	get(t, c, "Catalog.Other", "x")
+	get(t, c, "Catalog.Other", "x")
+	if next.calls != 3 {
+		t.Fatalf("%d calls, want 3", next.calls)
+	}
+
+	clock.now = clock.now.Add(59 * time.Second)
+	get(t, c, "Catalog.Get", "x")
+	if next.calls != 3 {
+		t.Fatalf("%d calls before ttl", next.calls)
+	}
+	clock.now = clock.now.Add(time.Second)
+	get(t, c, "Catalog.Get", "x")
+	if next.calls != 4 {
+		t.Fatalf("%d calls after ttl", next.calls)
+	}
+	if st := c.Stats(); st.Hits != 3 || st.Misses != 2 || st.Entries != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c, next, _ := newTestCache(WithCacheMethod("Catalog.Get", time.Minute), WithCacheMaxEntries(2))
+	get(t, c, "Catalog.Get", "a")
+	get(t, c, "Catalog.Get", "b")
+	get(t, c, "Catalog.Get", "a") // a 变为最近使用
+	get(t, c, "Catalog.Get", "c") // 淘汰 b
+	if next.calls != 3 {
+		t.Fatalf("%d calls, want 3", next.calls)
+	}
+	get(t, c, "Catalog.Get", "a")
+	get(t, c, "Catalog.Get", "c")
+	if next.calls != 3 {
+		t.Fatalf("a or c evicted, %d calls", next.calls)
+	}
+	get(t, c, "Catalog.Get", "b")
+	if next.calls != 4 {
+		t.Fatalf("b not evicted, %d calls", next.calls)
+	}
+	if st := c.Stats(); st.Evictions != 2 || st.Entries != 2 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+// TestCacheMutationIsolation 修改命中缓存得到的 reply 不影响缓存的结果
+func TestCacheMutationIsolation(t *testing.T) {
+	c, _, _ := newTestCache(WithCacheMethod("Catalog.Get", time.Minute))
+	first, _ := get(t, c, "Catalog.Get", "x")
+	first.Items[0] = "changed"
+	first.Index["a"] = 100
+	second, _ := get(t, c, "Catalog.Get", "x")
+	second.Items = append(second.Items[:0], "changed")
+	delete(second.Index, "b")
+	third, err := get(t, c, "Catalog.Get", "x")
+	if err != nil || third.Items[0] != "a" || len(third.Items) != 3 || third.Index["a"] != 0 || third.Index["b"] != 1 {
+		t.Fatalf("Get() = %+v, %v", third, err)
+	}
+	if c.Stats().Hits != 2 {
+		t.Fatalf("stats = %+v", c.Stats())
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c, next, clock := newTestCache(WithCacheMethod("Catalog.Get", time.Minute), WithNegativeCache("Catalog.Get", time.Second))
+	for i := 0; i < 2; i++ {
+		if _, err := get(t, c, "Catalog.Get", "missing"); !errors.Is(err, status.New(status.NotFound, "")) {
+			t.Fatalf("err = %v", err)
+		}
+	}
+	if next.calls != 1 {
+		t.Fatalf("NotFound not cached, %d calls", next.calls)
+	}
+	clock.now = clock.now.Add(time.Second)
+	get(t, c, "Catalog.Get", "missing")
+	if next.calls != 2 {
+		t.Fatalf("NotFound cached after ttl, %d calls", next.calls)
+	}
+	// 其他错误不缓存
+	get(t, c, "Catalog.Get", "fail")
+	get(t, c, "Catalog.Get", "fail")
+	if next.calls != 4 {
+		t.Fatalf("error cached, %d calls", next.calls)
+	}
+
+	// 没有配置 WithNegativeCache 时不缓存 NotFound
+	c, next, _ = newTestCache(WithCacheMethod("Catalog.Get", time.Minute))
+	get(t, c, "Catalog.Get", "missing")
+	get(t, c, "Catalog.Get", "missing")
+	if next.calls != 2 {
+		t.Fatalf("NotFound cached by default, %d calls", next.calls)
+	}
+}
+
+// TestCacheNilReply reply 为 nil 的调用直接交给 next，不会被缓存
+func TestCacheNilReply(t *testing.T) {
+	c, next, _ := newTestCache(WithCacheMethod("Catalog.Get", time.Minute), WithNegativeCache("Catalog.Get", time.Minute))
+	name := "missing"
+	for _, reply := range []any{nil, (*Catalog)(nil), nil} {
+		if err := c.Call(context.Background(), "Catalog.Get", &name, reply); status.CodeOf(err) != status.NotFound {
+			t.Fatalf("Call(%#v) = %v", reply, err)
+		}
+	}
+	if next.calls != 3 {
+		t.Fatalf("%d calls, want every nil reply passed to next", next.calls)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c, next, _ := newTestCache(WithCacheMethod("Catalog.Get", time.Minute), WithCacheMethod("Catalog.List", time.Minute))
+	get(t, c, "Catalog.Get", "x")
+	get(t, c, "Catalog.List", "x")
+	c.Invalidate("Catalog.Get")
+	get(t, c, "Catalog.Get", "x")
+	get(t, c, "Catalog.List", "x")
+	if next.calls != 3 {
+		t.Fatalf("%d calls, want 3", next.calls)
+	}
+	c.InvalidateAll()
+	if st := c.Stats(); st.Entries != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+	get(t, c, "Catalog.Get", "x")
+	get(t, c, "Catalog.List", "x")
+	if next.calls != 5 {
+		t.Fatalf("%d calls, want 5", next.calls)
+	}
+}
+
+// invalidatingCaller 在调用期间执行 Invalidate
+type invalidatingCaller struct {
+	catalogCaller
+	cache *Cache
+}
+
+func (c *invalidatingCaller) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	c.cache.Invalidate(serviceMethod)
+	return c.catalogCaller.Call(ctx, serviceMethod, arg, reply)
+}
+
+// TestCacheInvalidateInFlight Invalidate 之前发起的调用的结果可能已经过时，不会被保存
+func TestCacheInvalidateInFlight(t *testing.T) {
+	next := new(invalidatingCaller)
+	c := NewCache(next, WithCacheMethod("Catalog.Get", time.Minute))
+	next.cache = c
+	get(t, c, "Catalog.Get", "x")
+	if st := c.Stats(); st.Entries != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+// Fresh 返回调用的次数，参数 > 0 时让客户端缓存这么久，< 0 时禁止缓存，= 0 时不给出缓存指示
+type Fresh struct {
+	calls int64
+}
+
+func (f *Fresh) Get(ctx context.Context, ttl *time.Duration, reply *int64) error {
+	switch {
+	case *ttl > 0:
+		appleseed.SetCacheTTL(ctx, *ttl)
+	case *ttl < 0:
+		appleseed.SetNoStore(ctx)
+	}
+	*reply = atomic.AddInt64(&f.calls, 1)
+	return nil
+}
+
+// TestCacheServerTTL 服务端为每个响应指定的 TTL 覆盖 WithCacheMethod 的配置，no-store 的响应不会被缓存
+func TestCacheServerTTL(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(ctx, "fresh", "127.0.0.1", port, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := new(Fresh)
+	if err := s.Register(fresh); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(ctx)
+	pool, err := NewPool(ctx, reg, "fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	c := NewCache(pool, WithCacheMethod("Fresh.Get", time.Hour))
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c.now = clock.Now
+
+	fetch := func(ttl time.Duration) int64 {
+		t.Helper()
+		var n int64
+		if err := c.Call(ctx, "Fresh.Get", &ttl, &n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	// 1s 和 5s 的响应分别在各自的 TTL 之后过期，不是 WithCacheMethod 的 1h
+	short, long := fetch(time.Second), fetch(5*time.Second)
+	clock.now = clock.now.Add(999 * time.Millisecond)
+	if fetch(time.Second) != short || fetch(5*time.Second) != long {
+		t.Fatal("responses expired before the server ttl")
+	}
+	clock.now = clock.now.Add(time.Millisecond)
+	if fetch(time.Second) == short {
+		t.Fatal("1s response still cached after 1s")
+	}
+	clock.now = clock.now.Add(4 * time.Second)
+	if fetch(5*time.Second) == long {
+		t.Fatal("5s response still cached after 5s")
+	}
+	// no-store 每次都调用服务端，没有缓存指示时使用 WithCacheMethod 的 1h
+	if a, b := fetch(-1), fetch(-1); a == b {
+		t.Fatal("no-store response cached")
+	}
+	static := fetch(0)
+	clock.now = clock.now.Add(59 * time.Minute)
+	if fetch(0) != static {
+		t.Fatal("response without a directive not cached for the configured ttl")
+	}
+
+	// 调用方同时获取响应 metadata 时仍然可以拿到
+	var md metadata.MD
+	ttl := 30 * time.Second
+	if err := c.Call(WithResponseMetadata(ctx, &md), "Fresh.Get", &ttl, new(int64)); err != nil {
+		t.Fatal(err)
+	}
+	if md.Get(metadata.CacheControlKey) != "max-age=30" {
+		t.Fatalf("response metadata = %v", md)
+	}
+}
@@ -6,11 +6,19 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/internal/slowcall"
 	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
 	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport"
 )
 
 func GetServerAddr(ctx context.Context, reg registry.Client, lb loadbalance.Balancer, serviceName string) (addr string, err error) {
@@ -26,48 +34,284 @@ func GetServerAddr(ctx context.Context, reg registry.Client, lb loadbalance.Bala
 	for _, addr := range addrs {
 		lb.Add(addr)
 	}
-	// 通过负载均衡选择其中的一个
-	addr = lb.Get()
+	// 通过负载均衡选择其中的一个，ctx 中可能带有 hash key 等信息
+	addr = loadbalance.Pick(ctx, lb)
 	return
 }
 
+// ErrShutdown 连接已经关闭后发起调用时返回，调用 Close 时未完成的调用也返回它
+var ErrShutdown = errors.New("connection is shut down")
+
+var (
+	// ErrConnectionClosed 服务端正常关闭了连接（在两个响应之间读到 EOF）时，未完成的调用返回的错误。
+	// 服务端可能还没有处理这些请求，也可能已经处理完成，只有幂等的调用可以重试
+	ErrConnectionClosed = errors.New("rpc: connection closed by server")
+	// ErrConnectionLost 连接因为其他原因断开时，未完成的调用返回的错误包装了它和底层的错误，
+	// 可以使用 errors.Is 判断
+	ErrConnectionLost = errors.New("rpc: connection lost")
+)
+
+// connLostError 连接意外断开时未完成的调用返回的错误，errors.Is 对 ErrConnectionLost 和底层的错误都成立
+type connLostError struct {
+	err error
+}
+
+func (e *connLostError) Error() string {
+	return ErrConnectionLost.Error() + ": " + e.err.Error()
+}
+
+func (e *connLostError) Unwrap() error {
+	return e.err
+}
+
+func (e *connLostError) Is(target error) bool {
+	return target == ErrConnectionLost
+}
+
 type Client struct {
-	//reqMu     sync.Mutex // 似乎没什么用，一把锁足以
-	codec      codec.ClientCodec
-	request    codec.RequestHeader
-	mu         sync.Mutex       // 保护 pending
-	globalSeq  uint64           // 为 request 分配 seq
-	pending    map[uint64]*Call // 保存所有请求，请求完成后，会进行移除
-	serverAddr string           // 当前调用的服务的地址，如果 watch 到该地址下线或者变更，可以进行相应的处理
-	closing    bool             // user has called Close
-	shutdown   bool             // server has told us to stop
+	globalSeq    uint64             // 原子操作，为 request 分配 seq，放在第一个保证 32 位平台上 64 位对齐
+	enqueued     [numClasses]uint64 // 原子操作，每个优先级排过队的调用数量，紧跟 globalSeq 保证 64 位对齐
+	orphans      uint64             // 原子操作，收到的没有对应调用的响应数量
+	badResponses uint64             // 原子操作，无法解码而跳过的响应数量，见 ErrBadResponse
+	striped      int64              // 原子操作，Pool 在这个连接上正在进行的调用数量，见 WithConnsPerAddr
+	codec        codec.ClientCodec
+	request      codec.RequestHeader
+	pending      *pendingTable    // 保存所有请求，请求完成后，会进行移除
+	serverAddr   string           // 当前调用的服务的地址，如果 watch 到该地址下线或者变更，可以进行相应的处理
+	closing      int32            // 原子操作，user has called Close
+	shutdown     int32            // 原子操作，server has told us to stop
+	draining     int32            // 原子操作，收到服务端的 GOAWAY 之后为 1，见 goAway
+	conn         *codec.CountConn // 统计每个请求和响应的大小，使用自定义 codec 时为 nil
+	admission    *admission       // 并发限制和等待队列，没有开启准入控制时为 nil
+	newCodec     func(io.ReadWriteCloser) codec.ClientCodec
+	transport    []transport.Option // 只在 Dial 中使用
+	dialer       Dialer             // 只在 Dial 和 DialWebSocket 中使用，为 nil 时使用 net.Dialer
+
+	maxLifetime time.Duration // 调用的最长存活时间，<= 0 时不限制
+	epoch       uint32        // 原子操作，过期扫描的当前周期，发送时记录到 call 中
+	recvDone    chan struct{} // recv 退出时关闭
+	sweepDone   chan struct{} // 过期扫描的 goroutine 退出时关闭，没有开启过期时为 nil
+
+	// 请求由发送 goroutine 按照优先级和入队的顺序写入连接，见 sendLoop
+	sendq            [numClasses]chan *Call // 每个优先级一个队列，下标为 sendClass
+	sendQueue        int                    // 每个队列的长度
+	credits          [numClasses]int        // 当前一轮中每个优先级剩余的发送额度，只在发送 goroutine 中访问
+	writeMu          sync.Mutex             // 保护 request、buf、unflushed、transfers、writeErr、writeDeadline 以及对 codec 的写入
+	buf              *bufferedConn          // 写入连接的缓冲
+	deadliner        writeDeadliner         // 用于设置写入的期限，连接不支持时为 nil，见 setWriteDeadline
+	writeDeadline    time.Time              // 当前这批写入的期限，零值表示不限制
+	writeTimeout     time.Duration          // 没有 deadline 的调用写入的期限，<= 0 时不限制
+	frameReadTimeout time.Duration          // 读取一个响应的期限，见 WithFrameReadTimeout
+	unflushed        []*Call                // 已经写入缓冲、还没有写入连接的调用
+	transfers        []*Call                // 还有 fragment 没有写入的被拆分的请求，见 writeTransfers
+	wake             chan struct{}          // 有新的 transfers 时通知发送 goroutine
+	writeErr         error                  // 写入连接失败后不为 nil
+
+	closeOnce  sync.Once
+	closeErr   error           // 关闭 codec 的结果
+	onConnLost func(err error) // 连接不是因为 Close 断开时调用
+	onOrphan   func(seq uint64, header codec.ResponseHeader)
+	onGoAway   func() // 见 withGoAway
+	hooks      ConnHooks
+	configs    *MethodConfigStore // 每个方法的调用配置，见 WithMethodConfig
+
+	statsHandlers []StatsHandler
+	methods       sync.Map // 每个方法的累计统计，key: serviceMethod val: *methodCounter
+
+	slow         slowConfig
+	slowDetector *slowcall.Detector // 没有开启慢调用检测时为 nil
 }
 
-func NewClient(conn io.ReadWriteCloser, serverAddr string) *Client {
-	cc := codec.NewGobClientCodec(conn)
-	c := newClientWithCodec(cc)
-	c.serverAddr = serverAddr
-	return c
+// ClientOption 用于配置 Client
+type ClientOption func(*Client)
+
+// WithCodec 使用 f 创建的 codec 代替默认的 gob，比如使用二进制协议：
+//
+//	client.WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+//		return codec.NewBinaryClientCodec(conn, codec.WithMethodInterning())
+//	})
+func WithCodec(f func(conn io.ReadWriteCloser) codec.ClientCodec) ClientOption {
+	return func(c *Client) {
+		c.newCodec = f
+	}
 }
 
-func newClientWithCodec(codec codec.ClientCodec) *Client {
+// WithOnConnectionLost 连接不是因为调用 Close 而断开时（服务端关闭了连接、网络错误等）调用 f，
+// err 和未完成的调用收到的错误相同，为 ErrConnectionClosed 或者包装了 ErrConnectionLost 的错误。
+// f 在接收响应的 goroutine 中调用，调用时所有未完成的调用都已经结束，可以在 f 中重新建立连接
+func WithOnConnectionLost(f func(err error)) ClientOption {
+	return func(c *Client) {
+		c.onConnLost = f
+	}
+}
+
+// WithOrphanResponseHandler 收到没有对应调用的响应时调用 f，比如调用被取消或者过期之后才到达的响应、
+// 服务端重复发送的响应、seq 错乱。这类响应的 body 会被丢弃，数量见 ClientStats.OrphanResponses。
+// f 在接收响应的 goroutine 中调用，不能阻塞
+func WithOrphanResponseHandler(f func(seq uint64, header codec.ResponseHeader)) ClientOption {
+	return func(c *Client) {
+		c.onOrphan = f
+	}
+}
+
+// WithTransport Dial 建立连接时使用的 socket 选项，见 transport.Option。对 NewClient 传入的连接没有作用
+func WithTransport(opts ...transport.Option) ClientOption {
+	return func(c *Client) {
+		c.transport = append(c.transport, opts...)
+	}
+}
+
+// Dialer 建立连接的方式，比如经过 SOCKS5 代理（见 contrib/socks5）或者 SSH 隧道，*net.Dialer 实现了它
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// WithDialer Dial 和 DialWebSocket 通过 d 建立连接，默认使用 net.Dialer。WithTransport 的连接超时同样生效，
+// 其他 socket 选项在连接建立之后设置，d 返回的不是 tcp 连接时 Dial 返回错误。对 NewClient 传入的连接没有作用
+func WithDialer(d Dialer) ClientOption {
+	return func(c *Client) {
+		c.dialer = d
+	}
+}
+
+func NewClient(conn io.ReadWriteCloser, serverAddr string, opts ...ClientOption) *Client {
+	// 缓冲在 CountConn 下面，统计的大小仍然是每个请求编码后的大小
+	buf := newBufferedConn(conn)
+	cc := codec.NewCountConn(buf)
 	cli := &Client{
-		codec:   codec,
-		pending: make(map[uint64]*Call),
+		pending:     newPendingTable(),
+		conn:        cc,
+		buf:         buf,
+		serverAddr:  serverAddr,
+		maxLifetime: DefaultMaxCallLifetime,
+		recvDone:    make(chan struct{}),
+		sendQueue:   DefaultSendQueueSize,
+	}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	if cli.configs == nil {
+		cli.configs = new(MethodConfigStore)
+	}
+	cli.deadliner, _ = conn.(writeDeadliner)
+	for class := range cli.sendq {
+		cli.sendq[class] = make(chan *Call, cli.sendQueue)
+	}
+	cli.wake = make(chan struct{}, 1)
+	cli.slowDetector = cli.slow.newDetector()
+	if cli.newCodec != nil {
+		cli.codec = cli.newCodec(cc)
+	} else {
+		cli.codec = codec.NewGobClientCodec(cc)
 	}
+	cli.setFrameReadTimeout(conn)
+	cli.connected()
 	go cli.recv()
+	go cli.sendLoop()
+	if cli.maxLifetime > 0 {
+		cli.sweepDone = make(chan struct{})
+		go cli.sweep()
+	}
 	return cli
 }
 
+// Dial 连接到 network 上的 address 并返回 Client，network 为 "tcp" 或者 "unix"，比如
+// Dial(ctx, "unix", "/var/run/app.sock")
+//
+// WithTransport 指定的选项不合法或者当前平台不支持时返回错误
+func Dial(ctx context.Context, network, address string, opts ...ClientOption) (*Client, error) {
+	// 建立连接之前还没有 Client，先在一个临时的 Client 上取出 WithTransport 和 WithDialer 指定的选项
+	var o Client
+	for _, opt := range opts {
+		opt(&o)
+	}
+	tc, err := transport.New(o.transport...)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tc.DialWith(ctx, o.dialer, network, address)
+	if err != nil {
+		return nil, err
+	}
+	addr := address
+	if network == "unix" {
+		addr = registry.UnixAddr(address)
+	}
+	return NewClient(conn, addr, opts...), nil
+}
+
+// Stats 返回 Client 的统计
+func (c *Client) Stats() ClientStats {
+	var s ClientStats
+	if c.admission != nil {
+		s = c.admission.snapshot()
+	}
+	s.Methods = c.methodStats()
+	s.SendQueue = c.sendQueueStats()
+	s.OrphanResponses = atomic.LoadUint64(&c.orphans)
+	s.BadResponses = atomic.LoadUint64(&c.badResponses)
+	return s
+}
+
+// PeerInfo 返回服务端的版本和能力（见 codec.PeerInfo），用于排查不同版本之间的兼容问题。使用二进制协议时，
+// 收到服务端的 preface（第一个调用的响应）之前返回 false；gob 协议没有握手，返回 codec.LegacyPeerInfo
+func (c *Client) PeerInfo() (codec.PeerInfo, bool) {
+	if p, ok := c.codec.(codec.PeerInfoer); ok {
+		return p.PeerInfo()
+	}
+	return codec.LegacyPeerInfo(), true
+}
+
 type Call struct {
 	ServiceMethod string
+	RequestID     string // 本次调用的 request id，服务端的日志和返回的错误中都会带有它
 	Args          any
 	Reply         any
 	Error         error
 	Done          chan *Call
+	// ResponseMetadata 服务端随响应返回的 metadata，见 appleseed.SetResponseMetadata
+	ResponseMetadata metadata.MD
+	// Config 本次调用生效的配置，见 MethodConfigStore
+	Config MethodConfig
+
+	seq      uint64    // 在 pending 中的 key，调用超时后用于将其从 pending 中移除
+	epoch    uint32    // 发送时过期扫描所在的周期
+	class    sendClass // 优先级对应的发送队列
+	metadata metadata.MD
+	deadline time.Time         // ctx 或者 MethodConfig.Timeout 的期限，零值表示没有
+	timer    *time.Timer       // Go 发起的调用的 deadline 到达时结束调用，见 Client.timeout
+	sent     codec.MessageSize // 请求编码后的大小
+	received codec.MessageSize // 响应编码后的大小
+	client   *Client           // 调用结束时记录统计
+	start    time.Time         // 发起调用的时间，只在有 StatsHandler 时记录
+	load     *codec.LoadReport // 服务端在响应中上报的负载
+	release  func()            // 交还准入控制的额度，没有开启准入控制时为 nil
+	released int32             // 原子操作，保证 release 只被调用一次
+	writing  sync.Mutex        // 发送 goroutine 编码请求期间持有
+}
+
+// waitWritten 等待发送 goroutine 编码完 call（如果正在编码），之后 Args 可以交还给调用方
+func (c *Call) waitWritten() {
+	c.writing.Lock()
+	c.writing.Unlock()
+}
+
+// releaseSlot 交还 call 占用的并发额度，只有第一次调用生效
+func (c *Call) releaseSlot() {
+	if c.release != nil && atomic.CompareAndSwapInt32(&c.released, 0, 1) {
+		c.release()
+	}
 }
 
 func (c *Call) done() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.waitWritten()
+	c.releaseSlot()
+	if c.client != nil {
+		c.client.record(c, c.Error)
+	}
 	select {
 	case c.Done <- c:
 	default:
@@ -76,85 +320,276 @@ func (c *Call) done() {
 	}
 }
 
-func (c *Client) send(call *Call) {
-	//c.reqMu.Lock()
-	//defer c.reqMu.Unlock()
-
-	c.mu.Lock()
-	seq := c.globalSeq
-	c.globalSeq++
-	c.pending[seq] = call
-	c.mu.Unlock()
-
-	c.request.Seq = seq
-	c.request.ServiceMethod = call.ServiceMethod
-	if err := c.codec.WriteRequest(&c.request, call.Args); err != nil {
-		c.mu.Lock()
-		call := c.pending[seq]
-		delete(c.pending, seq)
-		c.mu.Unlock()
+// send 为 call 分配 seq 并加入 pending，然后交给发送 goroutine。发送队列已满时等待，ctx 在等待期间结束时
+// call 以 ctx.Err() 结束。写入连接失败时，call 以及排在它后面的调用都以 ErrConnectionLost 结束
+func (c *Client) send(ctx context.Context, call *Call) {
+	// 连接断开后 pending 会拒绝新的调用
+	call.seq = atomic.AddUint64(&c.globalSeq, 1) - 1
+	call.epoch = atomic.LoadUint32(&c.epoch)
+	if atomic.LoadInt32(&c.closing) == 1 || !c.pending.add(call) {
+		call.Error = ErrShutdown
+		call.done()
+		return
+	}
+	if atomic.LoadInt32(&c.draining) == 1 && c.pending.removeCall(call) {
+		call.Error = ErrDraining
+		call.done()
+		return
+	}
+	// 队列为空并且没有正在写入的请求时直接在调用方的 goroutine 中写入，省去一次 goroutine 切换，
+	// 否则交给发送 goroutine，由它合并写入
+	if c.queued() == 0 && c.writeMu.TryLock() {
+		c.write(call)
+		c.flush()
+		c.writeMu.Unlock()
+		return
+	}
+	c.enqueue(ctx, call)
+}
 
-		if call != nil {
-			call.Error = err
-			call.done()
-		}
+// serverError 将响应中的错误还原为 *status.Status，旧版本的服务端只返回错误信息，此时错误码为 Unknown
+func serverError(resp *codec.ResponseHeader) error {
+	code := status.Code(resp.Code)
+	if code == status.OK {
+		code = status.Unknown
 	}
+	return status.New(code, resp.Error).WithDetails(resp.Details)
 }
 
 func (c *Client) recv() {
 	var resp codec.ResponseHeader
 	var err error
 	for err == nil {
+		// gob 不会传输值为零的字段，复用 resp 前必须清空，否则 seq 为 0 的响应会沿用上一个响应的 seq
+		resp.Reset()
+		var read int64
+		if c.conn != nil {
+			read = c.conn.BytesRead()
+		}
 		if err = c.codec.ReadResponseHeader(&resp); err != nil {
-			log.Println("read response header error: ", err)
+			var me *codec.MessageError
+			if errors.As(err, &me) {
+				// frame 完整，只是无法解码，跳过它继续读取
+				c.badResponse(me)
+				err = nil
+				continue
+			}
 			break
 		}
-		seq := resp.Seq
-		c.mu.Lock()
+		if resp.Seq == codec.GoAwaySeq {
+			err = readBody(c.codec, nil)
+			c.goAway(&resp)
+			continue
+		}
 		// 从 pending 中获取对应（seq 相同）的 call，并移除
-		call := c.pending[seq]
-		delete(c.pending, seq)
-		c.mu.Unlock()
+		call := c.pending.remove(resp.Seq)
+		if call != nil {
+			call.ResponseMetadata = resp.Metadata
+			call.load = resp.Load
+		}
 
 		switch {
-		// 源码里对这一情况也进行了判断，但是注释用机翻完全看不懂，seq 既然是从 response
-		// 中获取的，那么怎么可能在 pending 中找不到呢？
+		// 调用超时或者过期后会从 pending 中移除，之后才收到的响应就属于这种情况，服务端重复发送响应
+		// 或者 seq 错乱时也是。同样需要消费掉 body，否则会读错后续的响应
 		case call == nil:
-		case resp.Error != "":
-			call.Error = errors.New(resp.Error)
+			err = readBody(c.codec, nil)
+			c.orphan(&resp)
+		case resp.Error != "" || resp.Code != 0:
+			call.Error = serverError(&resp)
 			// 虽然发生了错误，但是仍然需要将连接中的剩余数据（body）消费掉
 			// 如果 gob.Decode() 传入的是 nil，那么 gob 会读取连接中的一个值并
 			// 将该值丢弃，比如 conn 中使用 gob 序列化了 a，b 两个对象，此时
 			// 第一次 decode(nil)，那么 gob 将从 conn 中读取 a 并将其丢弃，
 			// 第二次 decode(&b)，gob 会读取下一个值 b
-			if err := c.codec.ReadResponseBody(nil); err != nil {
-				call.Error = err
+			if err := readBody(c.codec, nil); err != nil {
+				call.Error = c.bodyError(err)
 			}
+			c.received(call, read)
 			call.done()
 		default:
-			if err := c.codec.ReadResponseBody(call.Reply); err != nil {
-				call.Error = err
+			if err := readBody(c.codec, call.Reply); err != nil {
+				call.Error = c.bodyError(err)
 			}
+			c.received(call, read)
 			call.done()
 		}
 	}
-	// 如果流程走到这里，说明发生了 err
-	c.mu.Lock()
-	c.shutdown = true
-	// 连接中没有数据可读了，这种情况可能是服务端已经下线了
-	if err == io.EOF {
+	atomic.StoreInt32(&c.shutdown, 1)
+	c.closeCodec()
 
+	closing := atomic.LoadInt32(&c.closing) == 1
+	switch {
+	case closing:
+		err = ErrShutdown
+	case err == io.EOF, atomic.LoadInt32(&c.draining) == 1:
+		// 在两个响应之间读到 EOF，服务端正常关闭了连接；收到 GOAWAY 之后由 drain 关闭连接，同样是服务端要求的
+		err = ErrConnectionClosed
+	default:
+		log.Println("rpc: connection lost:", err)
+		err = &connLostError{err: err}
 	}
-	// 通知所有剩余的 call 发生了错误
-	for _, call := range c.pending {
+	// 通知所有剩余的 call 发生了错误，closeAll 之后 send 不会再加入新的 call。
+	// pending 只在 closeAll 内部加锁，结束调用时已经解锁
+	for _, call := range c.pending.closeAll() {
 		call.Error = err
 		call.done()
 	}
+	close(c.recvDone)
+	c.disconnected(err)
+	if !closing && c.onConnLost != nil {
+		c.onConnLost(err)
+	}
 }
 
+// orphan 记录一个没有对应调用的响应
+func (c *Client) orphan(resp *codec.ResponseHeader) {
+	atomic.AddUint64(&c.orphans, 1)
+	if f := c.onOrphan; f != nil {
+		runHook("OrphanResponse", func() { f(resp.Seq, *resp) })
+	}
+}
+
+// readBody 读取响应的 body，读到 header 之后连接断开时返回 io.ErrUnexpectedEOF，
+// 避免下一次读取 header 时得到的 io.EOF 被当作正常关闭
+func readBody(cc codec.ClientCodec, body any) error {
+	err := cc.ReadResponseBody(body)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// closeCodec 关闭 codec，Close 和 recv 都会调用，只有第一次生效
+func (c *Client) closeCodec() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.codec.Close()
+	})
+	return c.closeErr
+}
+
+// received 记录 call 的响应大小，read 为开始读取响应前已经读取的字节数
+func (c *Client) received(call *Call, read int64) {
+	if r, ok := c.codec.(codec.SizeReporter); ok {
+		call.received = r.LastReadSize()
+	} else if c.conn != nil {
+		call.received = codec.UnknownSize(c.conn.BytesRead() - read)
+	}
+}
+
+// WithRequestID 使用 ctx 发起的调用都会使用 id 作为 request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, metadata.RequestIDKey, id)
+}
+
+// RequestIDFromContext 返回使用 ctx 发起调用时携带的 request id：WithRequestID 或者 outgoing metadata
+// 中设置的 request id，或者 ctx 是服务端 handler 的 ctx 时，沿用上游调用的 request id。都没有时返回
+// 空字符串，此时每次调用都会生成一个新的 request id
+func RequestIDFromContext(ctx context.Context) string {
+	return metadata.RequestID(ctx)
+}
+
+// outgoingMetadata 返回随调用发送的 metadata，其中一定带有 request id，ctx 设置了 deadline 时
+// 还会带上剩余的超时时间
+func outgoingMetadata(ctx context.Context) metadata.MD {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	if deadline, ok := ctx.Deadline(); ok {
+		md[metadata.TimeoutKey] = time.Until(deadline).String()
+	}
+	if md[metadata.RequestIDKey] == "" {
+		id := metadata.RequestID(ctx)
+		if id == "" {
+			id = metadata.NewRequestID()
+		}
+		md[metadata.RequestIDKey] = id
+	}
+	return md
+}
+
+type responseMetadataKey struct{}
+
+// WithResponseMetadata 使用返回的 ctx 调用 Call 时，调用结束后会将服务端返回的 metadata 保存到 md 中，
+// 比如被限流时服务端建议的重试间隔
+func WithResponseMetadata(ctx context.Context, md *metadata.MD) context.Context {
+	return context.WithValue(ctx, responseMetadataKey{}, md)
+}
+
+// Go 异步地发起调用，调用结束后 call 会被发送到 done 中。开启了准入控制时，调用在后台等待放行。
+// ctx 有 deadline 或者配置了 MethodConfig.Timeout 时，调用在 deadline 时以 context.DeadlineExceeded 结束，
+// 之后才收到的响应会被丢弃。ctx 的取消不会结束已经发出的调用
 func (c *Client) Go(ctx context.Context, serviceMethod string, arg, reply any, done chan *Call) *Call {
+	cfg, _ := c.configs.Resolve(ctx, serviceMethod)
+	call := c.newCall(ctx, cfg, serviceMethod, arg, reply, done)
+	if call.Error != nil {
+		return call
+	}
+	if !call.deadline.IsZero() {
+		// 先创建不会触发的 timer，send 分配 seq 之后才设置触发的时间，回调中读取 seq 时已经分配完
+		call.timer = time.AfterFunc(math.MaxInt64, func() { c.timeout(call) })
+	}
+	if c.admission != nil {
+		go func() {
+			if c.admit(ctx, call) {
+				c.send(ctx, call)
+				call.startTimer()
+			}
+		}()
+		return call
+	}
+	c.send(ctx, call)
+	call.startTimer()
+	return call
+}
+
+// startTimer 在 deadline 时触发 call 的 timer，没有 deadline 时什么也不做
+func (c *Call) startTimer() {
+	if c.timer != nil {
+		c.timer.Reset(time.Until(c.deadline))
+	}
+}
+
+// timeout Go 发起的调用到达 deadline 时以 context.DeadlineExceeded 结束，和 Call 的 ctx 结束时相同。
+// 调用已经结束时什么也不做
+func (c *Client) timeout(call *Call) {
+	if !c.pending.removeCall(call) {
+		return
+	}
+	call.waitWritten()
+	c.discard(call)
+	call.Error = context.DeadlineExceeded
+	call.done()
+}
+
+// admit 等待 call 被准入控制放行，ctx 在等待期间结束或者队列已满时结束 call 并返回 false
+func (c *Client) admit(ctx context.Context, call *Call) bool {
+	if err := c.admission.acquire(ctx, call.ServiceMethod); err != nil {
+		call.Error = err
+		call.done()
+		return false
+	}
+	call.release = c.admission.release
+	return true
+}
+
+// newCall 使用配置 cfg 创建 call，ctx 已经结束时 call 直接以错误结束
+func (c *Client) newCall(ctx context.Context, cfg MethodConfig, serviceMethod string, arg, reply any, done chan *Call) *Call {
 	call := new(Call)
+	call.client = c
+	if len(c.statsHandlers) > 0 || c.slowDetector != nil {
+		call.start = time.Now()
+	}
 	call.ServiceMethod = serviceMethod
+	call.metadata = outgoingMetadata(ctx)
+	call.Config = cfg
+	cfg.applyTo(ctx, call.metadata)
+	call.deadline, _ = ctx.Deadline()
+	if cfg.Timeout > 0 {
+		if d := time.Now().Add(cfg.Timeout); call.deadline.IsZero() || d.Before(call.deadline) {
+			call.deadline = d
+		}
+	}
+	call.RequestID = call.metadata[metadata.RequestIDKey]
+	call.class = classOf(call.metadata)
 	call.Args = arg
 	call.Reply = reply
 	if done == nil {
@@ -174,12 +609,61 @@ func (c *Client) Go(ctx context.Context, serviceMethod string, arg, reply any, d
 		return call
 	default:
 	}
-
-	c.send(call)
 	return call
 }
 
+// Call 发起调用并等待结果，ctx 结束时不再等待并返回 ctx.Err()，之后才收到的响应会被丢弃
 func (c *Client) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
-	call := <-c.Go(ctx, serviceMethod, arg, reply, make(chan *Call, 1)).Done
-	return call.Error
+	_, err := c.call(ctx, serviceMethod, arg, reply)
+	return err
+}
+
+// call 同 Call，同时返回 call，用于获取请求和响应的大小
+func (c *Client) call(ctx context.Context, serviceMethod string, arg, reply any) (call *Call, err error) {
+	if md, ok := ctx.Value(responseMetadataKey{}).(*metadata.MD); ok {
+		defer func() { *md = call.ResponseMetadata }()
+	}
+	cfg, _ := c.configs.Resolve(ctx, serviceMethod)
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	call = c.newCall(ctx, cfg, serviceMethod, arg, reply, make(chan *Call, 1))
+	if call.Error != nil {
+		return call, call.Error
+	}
+	// 同步地等待放行，放行之后才会发送，ctx 在等待期间结束的调用不会被发送
+	if c.admission != nil && !c.admit(ctx, call) {
+		return call, call.Error
+	}
+	c.send(ctx, call)
+	select {
+	case call = <-call.Done:
+		return call, call.Error
+	case <-ctx.Done():
+		if !c.pending.removeCall(call) {
+			// 调用已经结束，或者响应已经被 recv 取走，等待它处理完，避免 reply 在返回后还被修改
+			call = <-call.Done
+			return call, call.Error
+		}
+		call.waitWritten()
+		c.discard(call)
+		call.releaseSlot()
+		c.record(call, ctx.Err())
+		return call, ctx.Err()
+	}
+}
+
+// Close 关闭连接，所有未完成的调用都会返回 ErrShutdown
+func (c *Client) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		return ErrShutdown
+	}
+	return c.closeCodec()
+}
+
+// closed 返回连接是否已经不可用
+func (c *Client) closed() bool {
+	return atomic.LoadInt32(&c.closing) == 1 || atomic.LoadInt32(&c.shutdown) == 1
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
 	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
 	"log"
 	"testing"
 )
@@ -14,10 +15,8 @@ func TestGetServerAddr(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	prefix := "/register-servier"
-
 	for i := 0; i < 1000; i++ {
-		addr, err := GetServerAddr(context.Background(), reg, &loadbalance.RoundRobin{}, prefix, "service1")
+		addr, err := GetServerAddr(context.Background(), reg, &loadbalance.RoundRobin{}, "service1")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -25,3 +24,26 @@ func TestGetServerAddr(t *testing.T) {
 	}
 
 }
+
+func TestGetServerAddrWithHashKey(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	for _, addr := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"} {
+		if err := reg.Register(ctx, "cache", addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lb := loadbalance.NewConsistentHash(0, nil)
+	for _, user := range []string{"user:1", "user:2", "user:42"} {
+		hctx := loadbalance.WithHashKey(ctx, user)
+		want, err := GetServerAddr(hctx, reg, lb, "cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if got, _ := GetServerAddr(hctx, reg, lb, "cache"); got != want {
+				t.Fatalf("%v routed to %v and %v", user, want, got)
+			}
+		}
+	}
+}
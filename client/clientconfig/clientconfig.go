@@ -0,0 +1,306 @@
+// Package clientconfig 在运行时从配置源（比如文件，见 File）加载客户端的配置，新版本的配置到达后整体替换
+// Pool 正在使用的方法配置（超时时间、优先级）、路由规则和准入控制的限制，不需要重新部署：
+//
+//	r, err := clientconfig.New(clientconfig.NewFile("/etc/app/orders.yaml"),
+//		clientconfig.WithDefaults(defaults), clientconfig.WithErrorHandler(alert))
+//	pool, err := r.NewPool(ctx, reg, "orders")
+//
+// 每个版本在替换之前先检查，不合法时保留当前的配置并调用 WithErrorHandler 指定的函数。
+// 新的配置是相对于默认配置（WithDefaults）的，而不是相对于上一个版本：配置中没有出现的项使用默认值，
+// 上一个版本中设置过的值不会保留。其中 methods 按照 pattern、routes 按照 service 和 method、admission 整体合并，
+// 比如上一个版本设置了 "Orders.*" 的超时时间，新版本中删除这一项后，"Orders.*" 恢复为默认配置中的值（没有时不设置）
+package clientconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+// Config 一个版本的配置，格式为 JSON 或者 YAML，例如：
+//
+//	version: "42"
+//	methods:
+//	  "*":            {timeout: 2s}
+//	  "Orders.Place": {timeout: 500ms, priority: high}
+//	routes:
+//	  - service: orders
+//	    default: v1
+//	    splits: [{version: v2, percent: 5}]
+//	admission: {max_concurrent: 64, max_queue: 256}
+type Config struct {
+	// Version 配置的版本，只用于日志和 Current，不影响替换
+	Version string `json:"version" yaml:"version"`
+	// Methods key 为方法的 pattern，格式见 client.MethodConfigStore
+	Methods map[string]Method `json:"methods" yaml:"methods"`
+	// Routes 路由规则，要求见 loadbalance.RouteTable.Set
+	Routes []loadbalance.RouteRule `json:"routes" yaml:"routes"`
+	// Admission 每个连接的准入控制，为 nil 时使用默认配置中的值，都没有时不做限制
+	Admission *Admission `json:"admission" yaml:"admission"`
+}
+
+// Method 一类方法的配置，见 client.MethodConfig
+type Method struct {
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// Priority "low"、"normal"、"high" 或者整数，为空时不设置
+	Priority string `json:"priority" yaml:"priority"`
+}
+
+// Admission 见 client.WithAdmission
+type Admission struct {
+	MaxConcurrent int `json:"max_concurrent" yaml:"max_concurrent"`
+	MaxQueue      int `json:"max_queue" yaml:"max_queue"`
+}
+
+// Duration 以 time.ParseDuration 的格式（比如 "250ms"）保存的时间
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("clientconfig: duration %s is not a string like \"250ms\"", b)
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("clientconfig: %w", err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Provider 配置源
+type Provider interface {
+	// Load 返回当前的配置
+	Load() (Config, error)
+	// Watch 每当配置发生变化时发送新的配置，ctx 结束后关闭返回的 channel
+	Watch(ctx context.Context) (<-chan Config, error)
+}
+
+// Option 用于配置 Reloader
+type Option func(*Reloader)
+
+// WithDefaults 配置中没有出现的项使用 cfg 中的值，合并的方式见包的说明。cfg 本身也需要是合法的
+func WithDefaults(cfg Config) Option {
+	return func(r *Reloader) {
+		r.defaults = cfg
+	}
+}
+
+// WithErrorHandler 新版本的配置不合法时调用 f，此时继续使用当前的配置。默认打印日志
+func WithErrorHandler(f func(error)) Option {
+	return func(r *Reloader) {
+		r.onError = f
+	}
+}
+
+// WithNewBalancer 路由规则选出一组实例后，由 f 创建的负载均衡器从中选择，默认为 loadbalance.NewWeightedRoundRobin
+func WithNewBalancer(f func() loadbalance.Balancer) Option {
+	return func(r *Reloader) {
+		r.newBalancer = f
+	}
+}
+
+// Reloader 从 Provider 加载配置，并在新版本到达时替换通过 PoolOptions、ClientOptions 或者 NewPool 使用它的
+// Pool 和 Client 的配置。替换对之后发起的调用立即生效，正在进行的调用不受影响。并发安全
+type Reloader struct {
+	provider    Provider
+	defaults    Config
+	onError     func(error)
+	newBalancer func() loadbalance.Balancer
+
+	methods *client.MethodConfigStore
+	routes  *loadbalance.RouteTable
+	limits  *client.AdmissionLimits
+	current atomic.Value // Config
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New 加载 p 当前的配置并开始监听之后的版本，当前的配置不合法或者无法监听时返回错误
+func New(p Provider, opts ...Option) (*Reloader, error) {
+	r := &Reloader{
+		provider: p,
+		onError: func(err error) {
+			log.Printf("clientconfig: %v, keep the current config\n", err)
+		},
+		newBalancer: func() loadbalance.Balancer { return loadbalance.NewWeightedRoundRobin() },
+		methods:     client.NewMethodConfigStore(nil),
+		routes:      new(loadbalance.RouteTable),
+		limits:      client.NewAdmissionLimits(0, 0),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.apply(Config{}); err != nil {
+		return nil, fmt.Errorf("invalid defaults: %w", err)
+	}
+	cfg, err := p.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.apply(cfg); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := p.Watch(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r.cancel = cancel
+	go r.watch(ctx, ch)
+	return r, nil
+}
+
+func (r *Reloader) watch(ctx context.Context, ch <-chan Config) {
+	defer close(r.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cfg, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := r.apply(cfg); err != nil {
+				r.onError(err)
+			}
+		}
+	}
+}
+
+// merge 返回 cfg 和默认配置合并后的配置
+func (r *Reloader) merge(cfg Config) Config {
+	merged := Config{Version: cfg.Version, Admission: r.defaults.Admission}
+	merged.Methods = make(map[string]Method, len(r.defaults.Methods)+len(cfg.Methods))
+	for pattern, m := range r.defaults.Methods {
+		merged.Methods[pattern] = m
+	}
+	for pattern, m := range cfg.Methods {
+		merged.Methods[pattern] = m
+	}
+	type routeKey struct{ service, method string }
+	overridden := make(map[routeKey]bool, len(cfg.Routes))
+	for _, rule := range cfg.Routes {
+		overridden[routeKey{rule.Service, rule.Method}] = true
+	}
+	for _, rule := range r.defaults.Routes {
+		if !overridden[routeKey{rule.Service, rule.Method}] {
+			merged.Routes = append(merged.Routes, rule)
+		}
+	}
+	merged.Routes = append(merged.Routes, cfg.Routes...)
+	if cfg.Admission != nil {
+		merged.Admission = cfg.Admission
+	}
+	return merged
+}
+
+// apply 检查 cfg 和默认配置合并后的配置，全部合法时才替换当前的配置
+func (r *Reloader) apply(cfg Config) error {
+	merged := r.merge(cfg)
+	methods := make(map[string]client.MethodConfig, len(merged.Methods))
+	for pattern, m := range merged.Methods {
+		mc, err := m.compile()
+		if err != nil {
+			return fmt.Errorf("version %q: method %q: %w", cfg.Version, pattern, err)
+		}
+		methods[pattern] = mc
+	}
+	if _, err := loadbalance.NewRouteTable(merged.Routes...); err != nil {
+		return fmt.Errorf("version %q: %w", cfg.Version, err)
+	}
+	var admission Admission
+	if merged.Admission != nil {
+		admission = *merged.Admission
+	}
+	if admission.MaxConcurrent < 0 || admission.MaxQueue < 0 {
+		return fmt.Errorf("version %q: negative admission limits %+v", cfg.Version, admission)
+	}
+
+	r.methods.Store(methods)
+	r.routes.Set(merged.Routes)
+	r.limits.Set(admission.MaxConcurrent, admission.MaxQueue)
+	r.current.Store(merged)
+	return nil
+}
+
+func (m *Method) compile() (client.MethodConfig, error) {
+	if m.Timeout < 0 {
+		return client.MethodConfig{}, errors.New("negative timeout")
+	}
+	mc := client.MethodConfig{Timeout: time.Duration(m.Timeout)}
+	switch m.Priority {
+	case "", "normal":
+	case "low":
+		mc.Priority = client.PriorityLow
+	case "high":
+		mc.Priority = client.PriorityHigh
+	default:
+		p, err := strconv.Atoi(m.Priority)
+		if err != nil {
+			return client.MethodConfig{}, fmt.Errorf("unknown priority %q", m.Priority)
+		}
+		mc.Priority = client.Priority(p)
+	}
+	return mc, nil
+}
+
+// Current 返回正在使用的配置（已经和默认配置合并）
+func (r *Reloader) Current() Config {
+	cfg, _ := r.current.Load().(Config)
+	return cfg
+}
+
+// ClientOptions 返回让 Client 使用 r 的方法配置和准入控制的 ClientOption
+func (r *Reloader) ClientOptions() []client.ClientOption {
+	return []client.ClientOption{client.WithMethodConfigs(r.methods), client.WithAdmissionLimits(r.limits)}
+}
+
+// PoolOptions 返回让 serviceName 的 Pool 使用 r 的配置的 PoolOption，包括按照路由规则选择实例的负载均衡器，
+// 会覆盖之前的 WithBalancer
+func (r *Reloader) PoolOptions(serviceName string) []client.PoolOption {
+	return []client.PoolOption{
+		client.WithBalancer(loadbalance.NewRouter(serviceName, r.routes, r.newBalancer)),
+		client.WithClientOptions(r.ClientOptions()...),
+	}
+}
+
+// NewPool 创建使用 r 的配置的 Pool，同 client.NewPool(ctx, reg, serviceName, append(opts, r.PoolOptions(serviceName)...)...)
+func (r *Reloader) NewPool(ctx context.Context, reg registry.Client, serviceName string, opts ...client.PoolOption) (*client.Pool, error) {
+	return client.NewPool(ctx, reg, serviceName, append(opts, r.PoolOptions(serviceName)...)...)
+}
+
+// Close 停止监听新的配置，已经替换的配置继续生效
+func (r *Reloader) Close() error {
+	r.cancel()
+	<-r.done
+	return nil
+}
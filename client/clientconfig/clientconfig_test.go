@@ -0,0 +1,214 @@
+package clientconfig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+// Deadline 返回服务端看到的剩余超时时间
+type Deadline struct{}
+
+func (Deadline) Remaining(ctx context.Context, args *int, reply *time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		*reply = time.Until(deadline)
+	}
+	return nil
+}
+
+func startDeadline(t *testing.T, reg *memory.Registry) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(context.Background(), "deadline", "127.0.0.1", port, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(Deadline)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+}
+
+// writeFile 通过写临时文件再 rename 的方式替换文件，和大多数部署工具一样
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitVersion 等待 r 使用 version 的配置
+func waitVersion(t *testing.T, r *Reloader, version string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for r.Current().Version != version {
+		if time.Now().After(deadline) {
+			t.Fatalf("config version = %q, want %q", r.Current().Version, version)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestReloadMidTraffic 调用不断进行期间修改文件，之后的调用使用新的超时时间，没有调用失败
+func TestReloadMidTraffic(t *testing.T) {
+	reg := memory.New(nil)
+	startDeadline(t, reg)
+	path := filepath.Join(t.TempDir(), "client.json")
+	writeFile(t, path, `{"version": "1", "methods": {"Deadline.*": {"timeout": "1s"}}}`)
+	r, err := New(NewFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	pool, err := r.NewPool(context.Background(), reg, "deadline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var stop int32
+	var max int64 // 观察到的最大剩余时间，原子操作
+	var calls int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				var remaining time.Duration
+				if err := pool.Call(context.Background(), "Deadline.Remaining", 1, &remaining); err != nil {
+					t.Errorf("Call() = %v", err)
+					return
+				}
+				atomic.AddInt64(&calls, 1)
+				for m := atomic.LoadInt64(&max); int64(remaining) > m; m = atomic.LoadInt64(&max) {
+					if atomic.CompareAndSwapInt64(&max, m, int64(remaining)) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := time.Duration(atomic.LoadInt64(&max)); got <= 0 || got > time.Second {
+		t.Fatalf("remaining = %v with a 1s timeout", got)
+	}
+	writeFile(t, path, `{"version": "2", "methods": {"Deadline.*": {"timeout": "1m"}}}`)
+	waitVersion(t, r, "2")
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Duration(atomic.LoadInt64(&max)) <= time.Second && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	if got := time.Duration(atomic.LoadInt64(&max)); got <= time.Second {
+		t.Fatalf("remaining = %v after the timeout was raised to 1m", got)
+	}
+	if atomic.LoadInt64(&calls) == 0 {
+		t.Fatal("no calls made")
+	}
+}
+
+// TestReloadDefaults 新版本中没有出现的项使用默认值，而不是上一个版本的值
+func TestReloadDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	writeFile(t, path, `
+version: "1"
+methods:
+  "*": {timeout: 5s}
+  "Orders.Place": {timeout: 500ms, priority: high}
+admission: {max_concurrent: 2, max_queue: 4}
+`)
+	r, err := New(NewFile(path), WithDefaults(Config{
+		Methods:   map[string]Method{"*": {Timeout: Duration(time.Second)}},
+		Admission: &Admission{MaxConcurrent: 64, MaxQueue: 128},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+	if cfg, _ := r.methods.Resolve(ctx, "Orders.Place"); cfg != (client.MethodConfig{Timeout: 500 * time.Millisecond, Priority: client.PriorityHigh}) {
+		t.Fatalf("Orders.Place config = %+v", cfg)
+	}
+	if n, q := r.limits.Get(); n != 2 || q != 4 {
+		t.Fatalf("admission = %d, %d, want 2, 4", n, q)
+	}
+
+	writeFile(t, path, `
+version: "2"
+methods:
+  "Orders.Get": {timeout: 2s}
+`)
+	waitVersion(t, r, "2")
+	for method, want := range map[string]time.Duration{
+		"Orders.Get":   2 * time.Second,
+		"Orders.Place": time.Second, // 删除后回到默认的 "*"，不是上一个版本的 500ms 或者 "*" 的 5s
+	} {
+		if cfg, _ := r.methods.Resolve(ctx, method); cfg.Timeout != want {
+			t.Errorf("%s timeout = %v, want %v", method, cfg.Timeout, want)
+		}
+	}
+	if n, q := r.limits.Get(); n != 64 || q != 128 {
+		t.Fatalf("admission = %d, %d, want the defaults 64, 128", n, q)
+	}
+}
+
+// TestReloadInvalid 不合法的版本不会替换当前的配置
+func TestReloadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.json")
+	writeFile(t, path, `{"version": "1", "methods": {"*": {"timeout": "1s"}}}`)
+	errs := make(chan error, 1)
+	r, err := New(NewFile(path), WithErrorHandler(func(err error) { errs <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	writeFile(t, path, `{"version": "2", "methods": {"*": {"timeout": "1m"}},
+		"routes": [{"service": "orders", "splits": [{"version": "v2", "percent": 60}, {"version": "v3", "percent": 60}]}]}`)
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "percent sum") {
+			t.Fatalf("error = %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("invalid version was not reported")
+	}
+	if cfg, _ := r.methods.Resolve(context.Background(), "Orders.Get"); r.Current().Version != "1" || cfg.Timeout != time.Second {
+		t.Fatalf("config = %q %+v, want version 1 kept", r.Current().Version, cfg)
+	}
+
+	// 拼写错误的字段、不合法的初始配置
+	writeFile(t, path, `{"version": "3", "methods": {"*": {"timout": "1s"}}}`)
+	if _, err := New(NewFile(path)); err == nil || !strings.Contains(err.Error(), "timout") {
+		t.Fatalf("New() with an unknown field = %v", err)
+	}
+	writeFile(t, path, `{"admission": {"max_concurrent": -1}}`)
+	if _, err := New(NewFile(path)); err == nil {
+		t.Fatal("New() with negative admission succeeded")
+	}
+	if _, err := New(NewFile(filepath.Join(t.TempDir(), "missing.json"))); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("New() with a missing file = %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package clientconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+)
+
+var _ Provider = &File{}
+
+const defaultPollInterval = time.Second
+
+// File 从本地文件读取配置的 Provider，扩展名为 .yaml 或者 .yml 时按照 YAML 解析，否则按照 JSON 解析，
+// 不认识的字段视为错误（通常是拼写错误）。通过 fsnotify 监听文件的变化（不可用时退化为定时检查修改时间），
+// 无法读取或者解析的版本被跳过，等待下一次修改
+type File struct {
+	path         string
+	pollInterval time.Duration
+}
+
+// NewFile 返回读取 path 的 File
+func NewFile(path string) *File {
+	return &File{path: path, pollInterval: defaultPollInterval}
+}
+
+func (f *File) Load() (Config, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return Config{}, err
+	}
+	return f.parse(data)
+}
+
+func (f *File) parse(data []byte) (Config, error) {
+	var cfg Config
+	switch strings.ToLower(filepath.Ext(f.path)) {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("parse %v: %w", f.path, err)
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return Config{}, fmt.Errorf("parse %v: %w", f.path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Watch 文件的内容发生变化并且可以解析时发送新的配置
+func (f *File) Watch(ctx context.Context) (<-chan Config, error) {
+	last, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Config)
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default: // 已经有未处理的通知，会读取最新的内容
+		}
+	}
+	if w, err := f.newWatcher(); err != nil {
+		log.Printf("clientconfig: fsnotify unavailable: %v, fallback to polling\n", err)
+		go f.watchPoll(ctx, notify)
+	} else {
+		go f.watchNotify(ctx, w, notify)
+	}
+
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+			data, err := os.ReadFile(f.path)
+			if err != nil || bytes.Equal(data, last) {
+				// 一次写入可能产生多个事件
+				continue
+			}
+			cfg, err := f.parse(data)
+			if err != nil {
+				// 可能只写入了一部分，等待下一次修改
+				log.Printf("clientconfig: reload %v error: %v, keep the current config\n", f.path, err)
+				continue
+			}
+			last = data
+			select {
+			case ch <- cfg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// newWatcher 监听文件所在的目录，原因见 registry/file
+func (f *File) newWatcher() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(filepath.Dir(f.path)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (f *File) watchNotify(ctx context.Context, w *fsnotify.Watcher, notify func()) {
+	defer w.Close()
+	name := filepath.Clean(f.path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) == name && ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				notify()
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Println("clientconfig: fsnotify error: ", err)
+		}
+	}
+}
+
+func (f *File) watchPoll(ctx context.Context, notify func()) {
+	var modTime time.Time
+	var size int64
+	if fi, err := os.Stat(f.path); err == nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	}
+	ticker := time.NewTicker(f.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(f.path)
+			if err != nil || (fi.ModTime().Equal(modTime) && fi.Size() == size) {
+				continue
+			}
+			modTime, size = fi.ModTime(), fi.Size()
+			notify()
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// TestBinaryCodec 服务端根据第一个字节自动识别二进制协议，同一个服务端同时支持 gob 和二进制协议的客户端
+func TestBinaryCodec(t *testing.T) {
+	_, _, addr := startEcho(t, memory.New(nil), "binary", 0)
+	for _, c := range []struct {
+		name string
+		opts []ClientOption
+	}{
+		{"gob", nil},
+		{"binary", []ClientOption{WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+			return codec.NewBinaryClientCodec(conn)
+		})}},
+		{"binary-json-intern", []ClientOption{WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+			return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"), codec.WithMethodInterning())
+		})}},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli := NewClient(conn, addr, c.opts...)
+		for i := 0; i < 5; i++ {
+			ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("k", "v"))
+			reply := 0
+			if err := cli.Call(ctx, "Echo.Ping", &i, &reply); err != nil || reply != i {
+				t.Fatalf("%v: reply = %v, err = %v", c.name, reply, err)
+			}
+		}
+		var arg, reply int
+		if err := cli.Call(context.Background(), "Echo.Nope", &arg, &reply); err == nil || !strings.Contains(err.Error(), "Nope") {
+			t.Fatalf("%v: err = %v", c.name, err)
+		}
+		// 出错之后连接仍然可用
+		if err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		cli.Close()
+	}
+}
+
+// TestLegacyServerError 旧版本的服务端的响应 header 中只有错误信息，客户端收到的错误码为 Unknown
+func TestLegacyServerError(t *testing.T) {
+	type legacyResponse struct {
+		ServiceMethod string
+		Seq           uint64
+		Error         string
+	}
+	c, s := net.Pipe()
+	go func() {
+		dec, enc := gob.NewDecoder(s), gob.NewEncoder(s)
+		var req codec.RequestHeader
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		dec.DecodeValue(reflect.Value{})
+		enc.Encode(legacyResponse{ServiceMethod: req.ServiceMethod, Seq: req.Seq, Error: "legacy failure"})
+		enc.Encode(struct{}{})
+	}()
+	cli := NewClient(c, "pipe")
+	defer cli.Close()
+	var arg, reply int
+	err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply)
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != status.Unknown || st.Message() != "legacy failure" || err.Error() != "legacy failure" {
+		t.Fatalf("err = %v (%v)", err, st.Code())
+	}
+}
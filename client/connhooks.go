@@ -0,0 +1,57 @@
+package client
+
+import (
+	"log"
+	"time"
+)
+
+// ConnHooks 连接事件的回调，都可以为 nil。回调不在任何锁中调用，panic 会被恢复并记录日志
+type ConnHooks struct {
+	// OnConnected 连接建立后、发送第一个请求之前调用
+	OnConnected func(addr string)
+	// OnDisconnected 连接断开并且所有未完成的调用都已经结束后调用，err 和未完成的调用收到的错误相同，
+	// 调用 Close 时为 ErrShutdown
+	OnDisconnected func(addr string, err error)
+	// OnReconnecting Pool 重新建立到 addr 的连接之前调用，attempt 为连接断开后第几次尝试（从 1 开始）。
+	// nextDelay 为这次失败时距离下一次尝试的时间：开启了 WithMinIdle 时为后台补充连接的间隔，
+	// 否则为 0，表示下一次调用时立即重试
+	OnReconnecting func(addr string, attempt int, nextDelay time.Duration)
+	// OnGoAway 收到服务端的 GOAWAY（服务端正在关闭）时调用，之后连接进入 ConnDraining 状态，最多等待 drainTimeout
+	// 后关闭。可以在这里提前从注册中心重新获取实例，Pool 会自动将 addr 从负载均衡器中移除
+	OnGoAway func(addr string, drainTimeout time.Duration)
+}
+
+// WithConnHooks 设置连接事件的回调，通过 WithClientOptions 传给 Pool 时，Pool 的每个连接都使用它们
+func WithConnHooks(h ConnHooks) ClientOption {
+	return func(c *Client) {
+		c.hooks = h
+	}
+}
+
+// runHook 调用连接事件的回调，回调 panic 时记录日志，不影响连接
+func runHook(name string, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rpc: %s hook panic: %v", name, r)
+		}
+	}()
+	f()
+}
+
+func (c *Client) connected() {
+	if f := c.hooks.OnConnected; f != nil {
+		runHook("OnConnected", func() { f(c.serverAddr) })
+	}
+}
+
+func (c *Client) disconnected(err error) {
+	if f := c.hooks.OnDisconnected; f != nil {
+		runHook("OnDisconnected", func() { f(c.serverAddr, err) })
+	}
+}
+
+func (c *Client) reconnecting(attempt int, nextDelay time.Duration) {
+	if f := c.hooks.OnReconnecting; f != nil {
+		runHook("OnReconnecting", func() { f(c.serverAddr, attempt, nextDelay) })
+	}
+}
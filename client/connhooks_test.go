@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+// TestPoolReconnectHooks 服务端关闭连接后，Pool 在下一次调用时重新建立连接，依次触发
+// OnConnected、OnDisconnected、OnReconnecting、OnConnected
+func TestPoolReconnectHooks(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	// 拒绝第一个连接
+	var conns int32
+	_, _, addr := startEcho(t, reg, "hooks", 0, appleseed.WithOnConnect(func(net.Addr) bool {
+		return atomic.AddInt32(&conns, 1) == 1
+	}))
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(format string, args ...any) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+	hooks := ConnHooks{
+		OnConnected:    func(addr string) { record("connected %s", addr) },
+		OnDisconnected: func(addr string, err error) { record("disconnected %s", addr) },
+		OnReconnecting: func(addr string, attempt int, nextDelay time.Duration) {
+			record("reconnecting %s %d %v", addr, attempt, nextDelay)
+			// 回调 panic 不影响重新建立连接
+			panic("boom")
+		},
+	}
+	pool, err := NewPool(ctx, reg, "hooks", WithClientOptions(WithConnHooks(hooks)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	arg, reply := 1, 0
+	if err := pool.Call(ctx, "Echo.Ping", &arg, &reply); err == nil {
+		t.Fatal("call on a rejected connection succeeded")
+	}
+	if err := pool.Call(ctx, "Echo.Ping", &arg, &reply); err != nil {
+		t.Fatal(err)
+	}
+	pool.Close()
+
+	// pool.Close 关闭连接时还会有一次 OnDisconnected，在接收响应的 goroutine 中异步调用
+	want := fmt.Sprint([]string{
+		"connected " + addr,
+		"disconnected " + addr,
+		"reconnecting " + addr + " 1 0s",
+		"connected " + addr,
+		"disconnected " + addr,
+	})
+	var got string
+	for deadline := time.Now().Add(time.Second); got != want && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		got = fmt.Sprint(events)
+		mu.Unlock()
+	}
+	if got != want {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if len(pool.redials) != 0 {
+		t.Fatalf("redials = %v after reconnect", pool.redials)
+	}
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Caller 发起一次调用并等待结果，*Client 和 *Pool 都实现了它
+type Caller interface {
+	Call(ctx context.Context, serviceMethod string, arg, reply any) error
+}
+
+var (
+	_ Caller = &Client{}
+	_ Caller = &Pool{}
+	_ Caller = &Dedup{}
+)
+
+// DedupStats Dedup 的统计
+type DedupStats struct {
+	Hits   uint64 // 复用了正在进行的调用的次数
+	Misses uint64 // 发起了新调用的次数
+}
+
+// Dedup 合并相同的并发调用（singleflight）：对于指定的方法，serviceMethod 和 gob 编码后的参数都相同的调用，
+// 如果已经有一个正在进行，就等待它的结果而不是再发起一次。每个调用方都会得到 reply 的一份独立的拷贝
+// （由共享调用的 reply 重新编码解码得到），以及相同的错误。
+//
+// 共享的调用不会因为某一个调用方的 ctx 结束而取消，只有所有调用方都已经不再等待时才会取消。
+// 参数中含有 map 时 gob 编码的结果不固定，这样的调用可能不会被合并。只应该用于没有副作用的方法
+type Dedup struct {
+	next    Caller
+	methods map[string]bool
+
+	mu      sync.Mutex
+	flights map[string]*flight // key: serviceMethod + 参数编码
+
+	hits   uint64
+	misses uint64
+}
+
+// flight 一次正在进行的共享调用
+type flight struct {
+	done    chan struct{}
+	waiters int // 仍在等待结果的调用方数量，调用时需要持有 Dedup.mu
+	cancel  context.CancelFunc
+
+	reply []byte // gob 编码后的 reply
+	err   error
+}
+
+// NewDedup 创建一个合并 methods（格式为 "Service.Method"）相同并发调用的 Caller，其他方法直接交给 next
+func NewDedup(next Caller, methods ...string) *Dedup {
+	d := &Dedup{
+		next:    next,
+		methods: make(map[string]bool, len(methods)),
+		flights: make(map[string]*flight),
+	}
+	for _, m := range methods {
+		d.methods[m] = true
+	}
+	return d
+}
+
+// Stats 返回合并调用的统计
+func (d *Dedup) Stats() DedupStats {
+	return DedupStats{
+		Hits:   atomic.LoadUint64(&d.hits),
+		Misses: atomic.LoadUint64(&d.misses),
+	}
+}
+
+func (d *Dedup) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	if !d.methods[serviceMethod] || reflect.TypeOf(reply).Kind() != reflect.Ptr {
+		return d.next.Call(ctx, serviceMethod, arg, reply)
+	}
+	key, ok := callKey(serviceMethod, arg)
+	if !ok {
+		// 无法编码的参数也无法发送，交给 next 返回错误
+		return d.next.Call(ctx, serviceMethod, arg, reply)
+	}
+
+	d.mu.Lock()
+	f, ok := d.flights[key]
+	if ok {
+		atomic.AddUint64(&d.hits, 1)
+	} else {
+		atomic.AddUint64(&d.misses, 1)
+		f = &flight{done: make(chan struct{})}
+		var callCtx context.Context
+		callCtx, f.cancel = context.WithCancel(detached{ctx})
+		d.flights[key] = f
+		go d.do(callCtx, key, f, serviceMethod, arg, reflect.TypeOf(reply))
+	}
+	f.waiters++
+	d.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return f.err
+		}
+		return gob.NewDecoder(bytes.NewReader(f.reply)).Decode(reply)
+	case <-ctx.Done():
+		d.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// 最后一个调用方也不再等待，取消共享的调用，之后相同的调用会重新发起
+			f.cancel()
+			if d.flights[key] == f {
+				delete(d.flights, key)
+			}
+		}
+		d.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// callKey 返回 serviceMethod 和 gob 编码后的 arg 组成的 key，arg 无法编码时 ok 为 false
+func callKey(serviceMethod string, arg any) (key string, ok bool) {
+	var buf bytes.Buffer
+	buf.WriteString(serviceMethod)
+	buf.WriteByte(0)
+	if err := gob.NewEncoder(&buf).Encode(arg); err != nil {
+		return "", false
+	}
+	return buf.String(), true
+}
+
+// do 发起共享的调用，使用新创建的 reply 接收结果，再编码保存起来供每个调用方解码
+func (d *Dedup) do(ctx context.Context, key string, f *flight, serviceMethod string, arg any, replyType reflect.Type) {
+	defer f.cancel()
+	reply := reflect.New(replyType.Elem())
+	err := d.next.Call(ctx, serviceMethod, arg, reply.Interface())
+	if err == nil {
+		var buf bytes.Buffer
+		if err = gob.NewEncoder(&buf).EncodeValue(reply); err == nil {
+			f.reply = buf.Bytes()
+		}
+	}
+	f.err = err
+
+	d.mu.Lock()
+	if d.flights[key] == f {
+		delete(d.flights, key)
+	}
+	d.mu.Unlock()
+	close(f.done)
+}
+
+// detached 保留 ctx 中的值（request id、metadata 等），但是不会随 ctx 结束
+type detached struct {
+	ctx context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+func (d detached) Value(key any) any         { return d.ctx.Value(key) }
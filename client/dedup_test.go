@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+type Catalog struct {
+	Items []string
+	Index map[string]int
+}
+
+// gateCaller 所有调用阻塞到 gate 关闭，记录调用和取消的次数
+type gateCaller struct {
+	gate     chan struct{}
+	calls    int64
+	canceled int64
+}
+
+var errBoom = status.New(status.Internal, "boom")
+
+func (g *gateCaller) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	atomic.AddInt64(&g.calls, 1)
+	select {
+	case <-g.gate:
+	case <-ctx.Done():
+		atomic.AddInt64(&g.canceled, 1)
+		return ctx.Err()
+	}
+	if serviceMethod == "Catalog.Fail" {
+		return errBoom
+	}
+	r := reply.(*Catalog)
+	r.Items = []string{"a", "b", *arg.(*string)}
+	r.Index = map[string]int{"a": 0, "b": 1}
+	return nil
+}
+
+// waitHits 等待 d 的 hits 达到 n
+func waitHits(t *testing.T, d *Dedup, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for d.Stats().Hits < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("hits = %d, want %d", d.Stats().Hits, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDedupConcurrentWaiters(t *testing.T) {
+	g := &gateCaller{gate: make(chan struct{})}
+	d := NewDedup(g, "Catalog.GetAll", "Catalog.Fail")
+	ctx := context.Background()
+
+	const n = 10
+	replies := make([]Catalog, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			arg := "all"
+			errs[i] = d.Call(ctx, "Catalog.GetAll", &arg, &replies[i])
+		}(i)
+	}
+	waitHits(t, d, n-1)
+	close(g.gate)
+	wg.Wait()
+
+	if calls := atomic.LoadInt64(&g.calls); calls != 1 {
+		t.Fatalf("underlying calls = %d, want 1", calls)
+	}
+	if s := d.Stats(); s.Hits != n-1 || s.Misses != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+	for i := range replies {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if len(replies[i].Items) != 3 || replies[i].Items[2] != "all" || replies[i].Index["b"] != 1 {
+			t.Fatalf("reply %d = %+v", i, replies[i])
+		}
+	}
+	// 每个调用方得到独立的拷贝，修改其中一个不会影响其他调用方
+	replies[0].Items[0] = "changed"
+	replies[0].Index["a"] = 42
+	for i := 1; i < n; i++ {
+		if replies[i].Items[0] != "a" || replies[i].Index["a"] != 0 {
+			t.Fatalf("reply %d aliases reply 0: %+v", i, replies[i])
+		}
+	}
+
+	// 调用结束后相同的调用会重新发起，参数不同的调用不会合并
+	g2 := &gateCaller{gate: make(chan struct{})}
+	close(g2.gate)
+	d = NewDedup(g2, "Catalog.GetAll")
+	for _, arg := range []string{"x", "y", "x"} {
+		var reply Catalog
+		if err := d.Call(ctx, "Catalog.GetAll", &arg, &reply); err != nil || reply.Items[2] != arg {
+			t.Fatalf("reply = %+v, err = %v", reply, err)
+		}
+	}
+	if calls := atomic.LoadInt64(&g2.calls); calls != 3 {
+		t.Fatalf("underlying calls = %d, want 3", calls)
+	}
+}
+
+func TestDedupSharedError(t *testing.T) {
+	g := &gateCaller{gate: make(chan struct{})}
+	d := NewDedup(g, "Catalog.Fail")
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			arg := "all"
+			errs <- d.Call(context.Background(), "Catalog.Fail", &arg, &Catalog{})
+		}()
+	}
+	waitHits(t, d, 1)
+	close(g.gate)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != errBoom {
+			t.Fatalf("err = %v", err)
+		}
+	}
+}
+
+func TestDedupCancellation(t *testing.T) {
+	g := &gateCaller{gate: make(chan struct{})}
+	d := NewDedup(g, "Catalog.GetAll")
+	arg := "all"
+
+	// 第一个调用方取消后，共享的调用继续进行
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	err1 := make(chan error, 1)
+	go func() { err1 <- d.Call(ctx1, "Catalog.GetAll", &arg, &Catalog{}) }()
+	var reply Catalog
+	err2 := make(chan error, 1)
+	go func() {
+		waitHits(t, d, 0)
+		err2 <- d.Call(context.Background(), "Catalog.GetAll", &arg, &reply)
+	}()
+	waitHits(t, d, 1)
+	cancel1()
+	if err := <-err1; err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	close(g.gate)
+	if err := <-err2; err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Items) != 3 || atomic.LoadInt64(&g.canceled) != 0 {
+		t.Fatalf("reply = %+v, canceled = %d", reply, g.canceled)
+	}
+
+	// 所有调用方都取消后，共享的调用被取消
+	g = &gateCaller{gate: make(chan struct{})}
+	d = NewDedup(g, "Catalog.GetAll")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.Call(ctx, "Catalog.GetAll", &arg, &Catalog{}); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&g.canceled) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("shared call not canceled after the last waiter left")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDedupPassThrough(t *testing.T) {
+	g := &gateCaller{gate: make(chan struct{})}
+	close(g.gate)
+	d := NewDedup(g, "Catalog.GetAll")
+	arg := "all"
+	for i := 0; i < 3; i++ {
+		if err := d.Call(context.Background(), "Catalog.Other", &arg, &Catalog{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := d.Stats(); atomic.LoadInt64(&g.calls) != 3 || s.Hits != 0 || s.Misses != 0 {
+		t.Fatalf("calls = %d, stats = %+v", g.calls, s)
+	}
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+var errInjected = errors.New("injected dial failure")
+
+// recordDialer 记录每次建立连接的地址，fail 大于 0 时接下来的 fail 次返回 errInjected
+type recordDialer struct {
+	mu    sync.Mutex
+	addrs []string
+	fail  int
+}
+
+func (d *recordDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, network+" "+address)
+	fail := d.fail > 0
+	if fail {
+		d.fail--
+	}
+	d.mu.Unlock()
+	if fail {
+		return nil, errInjected
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+func (d *recordDialer) dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.addrs)
+}
+
+func (d *recordDialer) injectFailures(n int) {
+	d.mu.Lock()
+	d.fail = n
+	d.mu.Unlock()
+}
+
+func TestDialer(t *testing.T) {
+	ctx := context.Background()
+	_, _, addr := startEcho(t, memory.New(nil), "echo", 0)
+	d := &recordDialer{fail: 1}
+	if _, err := Dial(ctx, "tcp", addr, WithDialer(d)); !errors.Is(err, errInjected) {
+		t.Fatalf("err = %v", err)
+	}
+	cli, err := Dial(ctx, "tcp", addr, WithDialer(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	var reply int
+	if err := cli.Call(ctx, "Echo.Ping", new(int), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if d.addrs[1] != "tcp "+addr {
+		t.Fatalf("dials %v", d.addrs)
+	}
+
+	// WebSocket 的 tcp 连接同样通过 d 建立
+	s, _, _ := startEcho(t, memory.New(nil), "echo", 0)
+	hs := httptest.NewServer(s.WebSocketHandler())
+	defer hs.Close()
+	ws, err := DialWebSocket(ctx, "ws"+strings.TrimPrefix(hs.URL, "http"), WithWSClientOptions(WithDialer(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := ws.Call(ctx, "Echo.Ping", new(int), &reply); err != nil || d.dials() != 3 {
+		t.Fatalf("err = %v, dials %v", err, d.addrs)
+	}
+}
+
+// TestPoolDialer 第一次调用、重连、Warmup 和 WithMinIdle 都通过 WithPoolDialer 指定的 dialer 建立连接
+func TestPoolDialer(t *testing.T) {
+	ctx := context.Background()
+	_, _, addr := startEcho(t, memory.New(nil), "echo", 0)
+	reg := memory.New(nil)
+	if _, err := reg.RegisterInstance(ctx, "echo", registry.Instance{Addr: addr}); err != nil {
+		t.Fatal(err)
+	}
+	d := &recordDialer{}
+	pool, err := NewPool(ctx, reg, "echo", WithPoolDialer(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var reply int
+	if err := pool.Call(ctx, "Echo.Ping", new(int), &reply); err != nil || d.dials() != 1 {
+		t.Fatalf("err = %v, dials %v", err, d.addrs)
+	}
+	// 连接断开后重连失败，下一次调用重新建立连接
+	pool.pooled(addr).Close()
+	d.injectFailures(1)
+	if err := pool.Call(ctx, "Echo.Ping", new(int), &reply); !errors.Is(err, errInjected) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := pool.Call(ctx, "Echo.Ping", new(int), &reply); err != nil || d.dials() != 3 {
+		t.Fatalf("err = %v, dials %v", err, d.addrs)
+	}
+
+	// Warmup 和 WithMinIdle 的后台连接
+	reg2 := memory.New(nil)
+	_, _, addr1 := startEcho(t, reg2, "echo", 0)
+	_, _, addr2 := startEcho(t, reg2, "echo", 0)
+	wd := &recordDialer{}
+	wp, err := NewPool(ctx, reg2, "echo", WithPoolDialer(wd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wp.Close()
+	results, err := wp.Warmup(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+	if wd.dials() != 2 {
+		t.Fatalf("dials %v", wd.addrs)
+	}
+
+	idle := &recordDialer{}
+	warm, err := NewPool(ctx, reg2, "echo", WithPoolDialer(idle), WithMinIdle(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer warm.Close()
+	deadline := time.Now().Add(3 * minIdleInterval)
+	for warm.pooled(addr1) == nil || warm.pooled(addr2) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("min idle connections not dialed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if idle.dials() != 2 {
+		t.Fatalf("dials %v", idle.addrs)
+	}
+}
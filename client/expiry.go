@@ -0,0 +1,54 @@
+package client
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCallExpired 调用超过了最长存活时间仍然没有收到响应，见 WithMaxCallLifetime
+var ErrCallExpired = errors.New("rpc: call expired without response")
+
+// DefaultMaxCallLifetime 调用默认的最长存活时间
+const DefaultMaxCallLifetime = 2 * time.Minute
+
+// expirySlots 每个存活时间内扫描 pending 的次数。调用只记录发送时所在的周期，所以实际的存活时间在
+// lifetime 到 lifetime*(1+1/expirySlots) 之间
+const expirySlots = 8
+
+// WithMaxCallLifetime 没有 deadline（ctx 和 MethodConfig.Timeout 都没有设置）的调用发送之后超过 d 仍然没有
+// 收到响应时以 ErrCallExpired 结束，并从 pending 中移除，避免服务端一直不响应的调用永远留在 pending 中。
+// 有 deadline 的调用在 deadline 时结束，不受 d 的限制。默认为 DefaultMaxCallLifetime，d <= 0 时不限制。
+// 之后才收到的响应会被丢弃
+//
+// 过期由每个 Client 一个的 goroutine 按周期扫描 pending 实现，发送时只需要读取一次当前的周期，
+// 不会为每个调用创建 time.Timer
+func WithMaxCallLifetime(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.maxLifetime = d
+	}
+}
+
+// sweep 每隔 maxLifetime/expirySlots 推进一次周期，结束所有过期的调用，连接断开后退出
+func (c *Client) sweep() {
+	defer close(c.sweepDone)
+	interval := c.maxLifetime / expirySlots
+	if interval <= 0 {
+		interval = c.maxLifetime
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.recvDone:
+			return
+		case <-ticker.C:
+		}
+		epoch := atomic.AddUint32(&c.epoch, 1)
+		for _, call := range c.pending.expire(epoch, expirySlots) {
+			c.discard(call)
+			call.Error = ErrCallExpired
+			call.done()
+		}
+	}
+}
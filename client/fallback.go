@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// FallbackFunc 调用失败时代替服务端返回结果，cause 为调用失败的错误。返回 nil 时 Pool.Call 返回 nil，
+// f 应该在 reply 中填入默认值；返回错误时 Pool.Call 返回包装了它和 cause 的 *FallbackError。
+// f 在调用方的 goroutine 中执行，应该遵守 ctx 的 deadline
+type FallbackFunc func(ctx context.Context, arg, reply any, cause error) error
+
+// fallback 一个方法的降级配置
+type fallback struct {
+	f     FallbackFunc
+	codes map[status.Code]bool // 除了连接错误和 Unavailable 之外，还会触发降级的错误码
+
+	invoked   uint64 // 原子操作
+	recovered uint64 // 原子操作
+}
+
+// WithFallback Pool 调用 serviceMethod 因为连接错误（无法建立连接、连接断开、没有可用的实例）或者服务端返回
+// Unavailable 失败时，调用 f 降级。服务端 handler 返回的其他错误不会触发降级，除非在 codes 中指定了它的错误码。
+// 超时和取消不会触发降级，调用时 ctx 已经结束的也不会
+func WithFallback(serviceMethod string, f FallbackFunc, codes ...status.Code) PoolOption {
+	return func(p *Pool) {
+		fb := &fallback{f: f, codes: make(map[status.Code]bool, len(codes))}
+		for _, code := range codes {
+			fb.codes[code] = true
+		}
+		if p.fallbacks == nil {
+			p.fallbacks = make(map[string]*fallback)
+		}
+		p.fallbacks[serviceMethod] = fb
+	}
+}
+
+// FallbackError 降级函数返回的错误，Cause 为触发降级的调用错误
+type FallbackError struct {
+	Cause error
+	Err   error
+}
+
+func (e *FallbackError) Error() string {
+	return fmt.Sprintf("rpc: fallback failed: %v (cause: %v)", e.Err, e.Cause)
+}
+
+func (e *FallbackError) Unwrap() error {
+	return e.Err
+}
+
+type fallbackCauseKey struct{}
+
+// WithFallbackCause 使用返回的 ctx 调用 Pool.Call 时，如果触发了降级，调用失败的错误会被保存到 cause 中，
+// 降级函数成功返回时也可以知道原本的错误
+func WithFallbackCause(ctx context.Context, cause *error) context.Context {
+	return context.WithValue(ctx, fallbackCauseKey{}, cause)
+}
+
+// triggers 返回 err 是否触发降级
+func (fb *fallback) triggers(err error) bool {
+	class := classify(err)
+	if class == loadbalance.ErrorTransport {
+		return true
+	}
+	if class != loadbalance.ErrorServer {
+		return false
+	}
+	code := status.CodeOf(err)
+	return code == status.Unavailable || fb.codes[code]
+}
+
+// fallback 调用 serviceMethod 失败后按照配置降级，返回 Pool.Call 最终的错误
+func (p *Pool) fallback(ctx context.Context, serviceMethod string, arg, reply any, cause error) error {
+	fb, ok := p.fallbacks[serviceMethod]
+	if !ok || !fb.triggers(cause) || ctx.Err() != nil {
+		return cause
+	}
+	if c, ok := ctx.Value(fallbackCauseKey{}).(*error); ok {
+		*c = cause
+	}
+	atomic.AddUint64(&fb.invoked, 1)
+	if err := fb.f(ctx, arg, reply, cause); err != nil {
+		return &FallbackError{Cause: cause, Err: err}
+	}
+	atomic.AddUint64(&fb.recovered, 1)
+	return nil
+}
+
+// FallbackStats 一个方法的降级统计
+type FallbackStats struct {
+	Invoked   uint64 // 调用降级函数的次数
+	Recovered uint64 // 降级函数返回 nil，调用方没有收到错误的次数
+}
+
+// PoolStats Pool 的统计
+type PoolStats struct {
+	// Fallbacks 每个配置了降级的方法的统计，key 为 "Service.Method"
+	Fallbacks map[string]FallbackStats
+	// Conns 每个连接的统计，按照地址和 Stripe 排序，见 WithConnsPerAddr
+	Conns []PoolConnStats
+}
+
+// Stats 返回 Pool 的统计
+func (p *Pool) Stats() PoolStats {
+	s := PoolStats{Fallbacks: make(map[string]FallbackStats, len(p.fallbacks))}
+	for method, fb := range p.fallbacks {
+		s.Fallbacks[method] = FallbackStats{
+			Invoked:   atomic.LoadUint64(&fb.invoked),
+			Recovered: atomic.LoadUint64(&fb.recovered),
+		}
+	}
+	s.Conns = p.connStats()
+	return s
+}
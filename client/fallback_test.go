@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// Reco 参数为 "fail" 时返回业务错误，"busy" 时返回 Unavailable
+type Reco struct{}
+
+func (Reco) Get(user *string, reply *[]string) error {
+	switch *user {
+	case "fail":
+		return status.New(status.FailedPrecondition, "no profile")
+	case "busy":
+		return status.New(status.Unavailable, "busy")
+	}
+	*reply = []string{"personal", *user}
+	return nil
+}
+
+// Other 同 Get
+func (r Reco) Other(user *string, reply *[]string) error {
+	return r.Get(user, reply)
+}
+
+var defaultReco = []string{"popular"}
+
+func recoFallback(ctx context.Context, arg, reply any, cause error) error {
+	if *arg.(*string) == "transform" {
+		return errors.New("degraded")
+	}
+	*reply.(*[]string) = defaultReco
+	return nil
+}
+
+func TestFallbackDeadBackend(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	if _, err := reg.RegisterInstance(ctx, "reco", registry.Instance{Addr: downAddr(t)}); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool(ctx, reg, "reco", WithFallback("Reco.Get", recoFallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var (
+		reply []string
+		cause error
+	)
+	user := "alice"
+	if err := pool.Call(WithFallbackCause(ctx, &cause), "Reco.Get", &user, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 1 || reply[0] != "popular" || classify(cause) != loadbalance.ErrorTransport {
+		t.Fatalf("reply = %v, cause = %v", reply, cause)
+	}
+
+	// 降级函数返回的错误和原本的错误都可以获取
+	user = "transform"
+	err = pool.Call(ctx, "Reco.Get", &user, &reply)
+	var fe *FallbackError
+	if !errors.As(err, &fe) || fe.Err.Error() != "degraded" || fe.Cause == nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 没有配置降级的方法和已经结束的 ctx 不降级
+	if err := pool.Call(ctx, "Reco.Other", &user, &reply); err == nil {
+		t.Fatal("call without fallback succeeded")
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := pool.Call(canceled, "Reco.Get", &user, &reply); err == nil {
+		t.Fatal("fallback ran after ctx ended")
+	}
+	if s := pool.Stats().Fallbacks["Reco.Get"]; s.Invoked != 2 || s.Recovered != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+// TestFallbackBusinessError handler 返回的业务错误不降级，除非指定了它的错误码；Unavailable 总是降级
+func TestFallbackBusinessError(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	s, _, _ := startEcho(t, reg, "reco", 0)
+	if err := s.Register(new(Reco)); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool(ctx, reg, "reco",
+		WithFallback("Reco.Get", recoFallback),
+		WithFallback("Reco.Other", recoFallback, status.FailedPrecondition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var reply []string
+	user := "fail"
+	err = pool.Call(ctx, "Reco.Get", &user, &reply)
+	if status.CodeOf(err) != status.FailedPrecondition || reply != nil {
+		t.Fatalf("reply = %v, err = %v", reply, err)
+	}
+	// 指定了错误码的业务错误降级
+	if err := pool.Call(ctx, "Reco.Other", &user, &reply); err != nil || reply[0] != "popular" {
+		t.Fatalf("reply = %v, err = %v", reply, err)
+	}
+	user = "busy"
+	if err := pool.Call(ctx, "Reco.Get", &user, &reply); err != nil || reply[0] != "popular" {
+		t.Fatalf("reply = %v, err = %v", reply, err)
+	}
+	user = "bob"
+	if err := pool.Call(ctx, "Reco.Get", &user, &reply); err != nil || reply[0] != "personal" {
+		t.Fatalf("reply = %v, err = %v", reply, err)
+	}
+
+	// 超时不降级
+	short, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	if err := pool.Call(short, "Reco.Get", &user, &reply); err == nil {
+		t.Fatal("timed out call succeeded")
+	}
+	stats := pool.Stats().Fallbacks
+	if stats["Reco.Get"].Invoked != 1 || stats["Reco.Other"].Invoked != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
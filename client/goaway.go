@@ -0,0 +1,100 @@
+package client
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+)
+
+// ErrDraining 服务端通过 GOAWAY 要求客户端离开这个连接之后发起的调用返回它，调用没有发送给服务端，
+// 可以安全地在其他连接上重试。Pool 会自动换到其他实例
+var ErrDraining = errors.New("connection is draining")
+
+// DefaultDrainTimeout 收到 GOAWAY 之后最多等待未完成的调用多久，服务端在 GOAWAY 中给出了更短的时间时使用服务端的
+const DefaultDrainTimeout = 30 * time.Second
+
+// drainPollInterval 收到 GOAWAY 之后检查未完成的调用是否已经结束的间隔
+const drainPollInterval = 5 * time.Millisecond
+
+// drainRetries Pool 的调用因为 ErrDraining 失败后，换一个实例重试的次数
+const drainRetries = 3
+
+// ConnState 连接的状态
+type ConnState int32
+
+const (
+	// ConnReady 可以发起调用
+	ConnReady ConnState = iota
+	// ConnDraining 收到了服务端的 GOAWAY，新的调用返回 ErrDraining，已经发出的调用继续等待响应，
+	// 全部结束或者超时后连接关闭
+	ConnDraining
+	// ConnClosed 连接已经关闭
+	ConnClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnReady:
+		return "ready"
+	case ConnDraining:
+		return "draining"
+	case ConnClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// State 返回连接当前的状态
+func (c *Client) State() ConnState {
+	switch {
+	case c.closed():
+		return ConnClosed
+	case atomic.LoadInt32(&c.draining) == 1:
+		return ConnDraining
+	}
+	return ConnReady
+}
+
+// withGoAway 收到 GOAWAY 时、开始拒绝新的调用之前调用 f，Pool 用它将地址从负载均衡器中移除
+func withGoAway(f func()) ClientOption {
+	return func(c *Client) {
+		c.onGoAway = f
+	}
+}
+
+// goAway 在 recv 中收到 GOAWAY 之后调用：之后写入的调用以 ErrDraining 结束，已经写入的调用继续等待响应
+func (c *Client) goAway(resp *codec.ResponseHeader) {
+	if atomic.LoadInt32(&c.draining) == 1 {
+		return
+	}
+	timeout := DefaultDrainTimeout
+	if d, err := time.ParseDuration(resp.Metadata[metadata.DrainTimeoutKey]); err == nil && d < timeout {
+		timeout = d
+	}
+	if c.onGoAway != nil {
+		c.onGoAway()
+	}
+	atomic.StoreInt32(&c.draining, 1)
+	if f := c.hooks.OnGoAway; f != nil {
+		runHook("OnGoAway", func() { f(c.serverAddr, timeout) })
+	}
+	go c.drain(time.Now().Add(timeout))
+}
+
+// drain 等待未完成的调用全部结束或者到达 deadline 之后关闭连接。和服务端关闭连接一样，OnDisconnected 和
+// WithOnConnectionLost 收到 ErrConnectionClosed，到达 deadline 时剩余的调用也以它结束
+func (c *Client) drain(deadline time.Time) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for c.pending.len() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ticker.C:
+		case <-c.recvDone:
+			return
+		}
+	}
+	c.closeCodec()
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+// TestGoAway 服务端关闭时正在进行的调用正常完成，之后的调用返回 ErrDraining，客户端在调用结束后关闭连接
+func TestGoAway(t *testing.T) {
+	ctx := context.Background()
+	s, _, addr := startEcho(t, memory.New(nil), "echo", 200*time.Millisecond)
+	goaway := make(chan time.Duration, 1)
+	cli, err := Dial(ctx, "tcp", addr, WithConnHooks(ConnHooks{
+		OnGoAway: func(_ string, drainTimeout time.Duration) { goaway <- drainTimeout },
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	var reply int
+	inflight := cli.Go(ctx, "Echo.Ping", new(int), &reply, make(chan *Call, 1))
+	time.Sleep(50 * time.Millisecond)
+	shutdownDone := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		shutdownDone <- s.Shutdown(sctx)
+	}()
+
+	select {
+	case d := <-goaway:
+		if d <= 0 || d > 10*time.Second {
+			t.Fatalf("drain timeout %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no goaway")
+	}
+	if st := cli.State(); st != ConnDraining {
+		t.Fatalf("state %v", st)
+	}
+	if err := cli.Call(ctx, "Echo.Ping", new(int), &reply); !errors.Is(err, ErrDraining) {
+		t.Fatalf("call after goaway: %v", err)
+	}
+	if call := <-inflight.Done; call.Error != nil {
+		t.Fatalf("in-flight call: %v", call.Error)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Fatal(err)
+	}
+	// 客户端主动关闭了连接，Shutdown 不需要等到 grace 结束
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+	for cli.State() != ConnClosed {
+		if time.Since(start) > time.Second {
+			t.Fatalf("state %v", cli.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// noWatch 隐藏注册中心的 Watcher，Pool 只能通过 GOAWAY 知道实例正在关闭
+type noWatch struct {
+	registry.Client
+}
+
+// TestPoolGoAwayUnderLoad 持续调用期间关闭其中一个实例，没有调用失败
+func TestPoolGoAwayUnderLoad(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	s1, e1, _ := startEcho(t, reg, "echo", 2*time.Millisecond)
+	_, e2, _ := startEcho(t, reg, "echo", 2*time.Millisecond)
+	pool, err := NewPool(ctx, noWatch{reg}, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var (
+		wg       sync.WaitGroup
+		stop     = make(chan struct{})
+		calls    int64
+		failures int64
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var reply int
+				if err := pool.Call(ctx, "Echo.Ping", new(int), &reply); err != nil {
+					atomic.AddInt64(&failures, 1)
+					t.Log(err)
+				}
+				atomic.AddInt64(&calls, 1)
+			}
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if atomic.LoadInt64(&e1.calls) == 0 {
+		t.Fatal("first instance received no calls")
+	}
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := s1.Shutdown(sctx); err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt64(&e2.calls)
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&failures); n != 0 {
+		t.Fatalf("%d of %d calls failed", n, atomic.LoadInt64(&calls))
+	}
+	if atomic.LoadInt64(&e2.calls) == before {
+		t.Fatal("calls did not move to the remaining instance")
+	}
+}
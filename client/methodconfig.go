@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+)
+
+// MethodConfig 一类方法的调用配置，每次调用时按照方法名选出最具体的一个（见 MethodConfigStore），
+// 字段为零值时不修改调用
+type MethodConfig struct {
+	// Timeout 调用的超时时间，调用方 ctx 的 deadline 更早时以 ctx 为准。Call 和 Go 发起的调用都在超时后以
+	// context.DeadlineExceeded 结束，剩余的超时时间同时传给服务端
+	Timeout time.Duration
+	// Priority 调用的优先级，ctx 中已经通过 WithPriority 设置了优先级时以 ctx 为准
+	Priority Priority
+}
+
+// methodPrefix 以 * 结尾的配置
+type methodPrefix struct {
+	prefix string
+	config MethodConfig
+}
+
+// methodConfigTable 一组编译好的配置，创建后不再修改
+type methodConfigTable struct {
+	exact    map[string]MethodConfig
+	prefixes []methodPrefix // 按前缀从长到短排列
+	def      MethodConfig   // "*" 的配置
+	hasDef   bool
+	patterns map[string]MethodConfig // 原始的配置，用于 Load
+}
+
+func newMethodConfigTable(configs map[string]MethodConfig) *methodConfigTable {
+	t := &methodConfigTable{exact: make(map[string]MethodConfig), patterns: make(map[string]MethodConfig, len(configs))}
+	for pattern, cfg := range configs {
+		t.patterns[pattern] = cfg
+		switch {
+		case pattern == "*":
+			t.def, t.hasDef = cfg, true
+		case strings.HasSuffix(pattern, "*"):
+			t.prefixes = append(t.prefixes, methodPrefix{prefix: strings.TrimSuffix(pattern, "*"), config: cfg})
+		default:
+			t.exact[pattern] = cfg
+		}
+	}
+	sort.Slice(t.prefixes, func(i, j int) bool {
+		return len(t.prefixes[i].prefix) > len(t.prefixes[j].prefix)
+	})
+	return t
+}
+
+func (t *methodConfigTable) resolve(serviceMethod string) (MethodConfig, bool) {
+	if cfg, ok := t.exact[serviceMethod]; ok {
+		return cfg, true
+	}
+	for _, p := range t.prefixes {
+		if strings.HasPrefix(serviceMethod, p.prefix) {
+			return p.config, true
+		}
+	}
+	return t.def, t.hasDef
+}
+
+// MethodConfigStore 按方法名保存的调用配置，key 为 "Service.Method"（只匹配该方法）、以 * 结尾的前缀
+// （比如 "Orders.*"）或者 "*"（默认配置）。一次调用只使用一个配置：完全匹配的方法优先，其次是最长的前缀，
+// 最后是默认配置，WithCallConfig 可以为单次调用覆盖它们。
+//
+// 配置可以在运行时通过 Store 整体替换，之后发起的调用立即使用新的配置，同一个调用不会看到新旧配置的混合。
+// 多个 Client（比如通过 WithClientOptions 传给 Pool）可以共享同一个 MethodConfigStore
+type MethodConfigStore struct {
+	mu sync.Mutex   // 只用于 add 的读-改-写
+	v  atomic.Value // *methodConfigTable
+}
+
+// NewMethodConfigStore 使用 configs 创建 MethodConfigStore，configs 可以为 nil
+func NewMethodConfigStore(configs map[string]MethodConfig) *MethodConfigStore {
+	s := new(MethodConfigStore)
+	s.Store(configs)
+	return s
+}
+
+// Store 使用 configs 整体替换所有的配置，之后修改 configs 不影响 s
+func (s *MethodConfigStore) Store(configs map[string]MethodConfig) {
+	s.v.Store(newMethodConfigTable(configs))
+}
+
+// Load 返回当前所有的配置，修改返回值不影响 s
+func (s *MethodConfigStore) Load() map[string]MethodConfig {
+	t := s.table()
+	configs := make(map[string]MethodConfig, len(t.patterns))
+	for pattern, cfg := range t.patterns {
+		configs[pattern] = cfg
+	}
+	return configs
+}
+
+// Resolve 返回使用 ctx 调用 serviceMethod 时生效的配置，没有匹配的配置时返回零值和 false
+func (s *MethodConfigStore) Resolve(ctx context.Context, serviceMethod string) (MethodConfig, bool) {
+	if cfg, ok := ctx.Value(callConfigKey{}).(MethodConfig); ok {
+		return cfg, true
+	}
+	return s.table().resolve(serviceMethod)
+}
+
+func (s *MethodConfigStore) table() *methodConfigTable {
+	t, _ := s.v.Load().(*methodConfigTable)
+	if t == nil {
+		return emptyMethodConfigs
+	}
+	return t
+}
+
+// add 在当前的配置中加入一项
+func (s *MethodConfigStore) add(pattern string, cfg MethodConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	configs := s.Load()
+	configs[pattern] = cfg
+	s.Store(configs)
+}
+
+var emptyMethodConfigs = newMethodConfigTable(nil)
+
+type callConfigKey struct{}
+
+// WithCallConfig 使用 ctx 发起的调用使用 cfg，代替 MethodConfigStore 中匹配的配置
+func WithCallConfig(ctx context.Context, cfg MethodConfig) context.Context {
+	return context.WithValue(ctx, callConfigKey{}, cfg)
+}
+
+// WithMethodConfigs Client 使用 s 中的配置，s 可以在多个 Client 之间共享，并且在运行时整体替换
+func WithMethodConfigs(s *MethodConfigStore) ClientOption {
+	return func(c *Client) {
+		c.configs = s
+	}
+}
+
+// WithMethodConfig 在 Client 的配置中加入 pattern 的配置，pattern 的格式见 MethodConfigStore。
+// 和 WithMethodConfigs 一起使用时会修改共享的 MethodConfigStore，此时应当直接使用 Store
+func WithMethodConfig(pattern string, cfg MethodConfig) ClientOption {
+	return func(c *Client) {
+		if c.configs == nil {
+			c.configs = new(MethodConfigStore)
+		}
+		c.configs.add(pattern, cfg)
+	}
+}
+
+// WithDefaultMethodConfig 没有更具体的配置时使用 cfg，同 WithMethodConfig("*", cfg)
+func WithDefaultMethodConfig(cfg MethodConfig) ClientOption {
+	return WithMethodConfig("*", cfg)
+}
+
+// MethodConfigs 返回 Client 使用的配置，可以通过它在运行时替换配置
+func (c *Client) MethodConfigs() *MethodConfigStore {
+	return c.configs
+}
+
+// applyTo 将配置应用到 ctx 派生的调用的 metadata 上，调用方已经设置的超时时间和优先级优先
+func (cfg *MethodConfig) applyTo(ctx context.Context, md metadata.MD) {
+	if cfg.Timeout > 0 {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > cfg.Timeout {
+			md[metadata.TimeoutKey] = cfg.Timeout.String()
+		}
+	}
+	if cfg.Priority != PriorityNormal && md.Get(metadata.PriorityKey) == "" {
+		md[metadata.PriorityKey] = strconv.Itoa(int(cfg.Priority))
+	}
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+func TestMethodConfigPrecedence(t *testing.T) {
+	s := NewMethodConfigStore(map[string]MethodConfig{
+		"*":            {Timeout: time.Second},
+		"Orders.*":     {Timeout: 2 * time.Second},
+		"Orders.Get*":  {Timeout: 3 * time.Second},
+		"Orders.Place": {Timeout: 4 * time.Second, Priority: PriorityHigh},
+	})
+	ctx := context.Background()
+	for method, want := range map[string]time.Duration{
+		"Orders.Place":  4 * time.Second,
+		"Orders.GetOne": 3 * time.Second,
+		"Orders.Cancel": 2 * time.Second,
+		"Users.Get":     time.Second,
+	} {
+		if cfg, ok := s.Resolve(ctx, method); !ok || cfg.Timeout != want {
+			t.Errorf("Resolve(%q) = %+v, %v, want timeout %v", method, cfg, ok, want)
+		}
+	}
+	override := MethodConfig{Priority: PriorityLow}
+	if cfg, _ := s.Resolve(WithCallConfig(ctx, override), "Orders.Place"); cfg != override {
+		t.Errorf("Resolve with call config = %+v, want %+v", cfg, override)
+	}
+	if _, ok := NewMethodConfigStore(nil).Resolve(ctx, "Orders.Place"); ok {
+		t.Error("empty store resolved a config")
+	}
+}
+
+// configRecorder 记录每个调用的 CallStats
+type configRecorder struct {
+	mu    sync.Mutex
+	stats []CallStats
+}
+
+func (r *configRecorder) HandleRPC(s *CallStats) {
+	r.mu.Lock()
+	r.stats = append(r.stats, *s)
+	r.mu.Unlock()
+}
+
+func (r *configRecorder) last() CallStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats[len(r.stats)-1]
+}
+
+func TestMethodConfigApplied(t *testing.T) {
+	_, _, addr := startEcho(t, memory.New(nil), "Echo", 100*time.Millisecond)
+	rec := new(configRecorder)
+	cli, err := Dial(context.Background(), "tcp", addr, WithStatsHandler(rec),
+		WithDefaultMethodConfig(MethodConfig{Priority: PriorityLow}),
+		WithMethodConfig("Echo.*", MethodConfig{Timeout: 20 * time.Millisecond, Priority: PriorityHigh}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	var reply int
+	start := time.Now()
+	err = cli.Call(context.Background(), "Echo.Ping", 1, &reply)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Call() = %v, want deadline exceeded", err)
+	}
+	if d := time.Since(start); d > 90*time.Millisecond {
+		t.Fatalf("Call() took %v with a 20ms configured timeout", d)
+	}
+	if got := rec.last().Config; got.Priority != PriorityHigh {
+		t.Fatalf("stats config = %+v, want the Echo.* config", got)
+	}
+
+	// ctx 中的优先级和更早的 deadline 优先于配置
+	call := cli.newCall(WithPriority(context.Background(), PriorityLow), MethodConfig{Timeout: time.Hour, Priority: PriorityHigh},
+		"Echo.Ping", 1, &reply, nil)
+	if call.class != classLow {
+		t.Fatalf("class = %v, want low", call.class)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	call = cli.newCall(ctx, MethodConfig{Timeout: time.Minute}, "Echo.Ping", 1, &reply, nil)
+	if got := call.metadata[metadata.TimeoutKey]; got != time.Minute.String() {
+		t.Fatalf("timeout metadata = %q, want %v", got, time.Minute)
+	}
+
+	// 运行时替换后新的调用立即使用新的配置
+	cli.MethodConfigs().Store(map[string]MethodConfig{"Echo.Ping": {Timeout: time.Second}})
+	if err := cli.Call(context.Background(), "Echo.Ping", 1, &reply); err != nil {
+		t.Fatalf("Call() after swap = %v", err)
+	}
+	if got := rec.last().Config; got != (MethodConfig{Timeout: time.Second}) {
+		t.Fatalf("stats config after swap = %+v", got)
+	}
+}
+
+// TestMethodConfigSwap 并发地替换配置，Resolve 只会看到完整的旧配置或者新配置
+func TestMethodConfigSwap(t *testing.T) {
+	a := map[string]MethodConfig{"Orders.*": {Timeout: time.Second, Priority: PriorityLow}}
+	b := map[string]MethodConfig{"Orders.Get": {Timeout: time.Minute, Priority: PriorityHigh}}
+	s := NewMethodConfigStore(a)
+	var stop int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				cfg, _ := s.Resolve(context.Background(), "Orders.Get")
+				if cfg != a["Orders.*"] && cfg != b["Orders.Get"] {
+					t.Errorf("Resolve() = %+v, a mix of two tables", cfg)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		if i%2 == 0 {
+			s.Store(b)
+		} else {
+			s.Store(a)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	if got := s.Load(); len(got) != 1 || got["Orders.*"] != a["Orders.*"] {
+		t.Fatalf("Load() = %v, want the last stored table", got)
+	}
+}
+
+// TestMethodConfigTimeoutGo Go 发起的调用同样在 MethodConfig.Timeout 后结束，之后收到的响应被丢弃
+func TestMethodConfigTimeoutGo(t *testing.T) {
+	cli, srv := newPipeServer(t, WithMethodConfig("Echo.*", MethodConfig{Timeout: 30 * time.Millisecond}))
+
+	start := time.Now()
+	arg, reply := 1, 0
+	call := cli.Go(context.Background(), "Echo.Ping", &arg, &reply, make(chan *Call, 1))
+	select {
+	case <-call.Done:
+	case <-time.After(time.Second):
+		t.Fatal("Go() not timed out after MethodConfig.Timeout")
+	}
+	if !errors.Is(call.Error, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", call.Error)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("timed out after %v, before MethodConfig.Timeout", d)
+	}
+	if n := cli.pending.len(); n != 0 {
+		t.Fatalf("%d calls left in pending", n)
+	}
+
+	// 迟到的响应不会写入 reply
+	if err := srv.reply(<-srv.reqs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; atomic.LoadUint64(&cli.orphans) == 0; i++ {
+		if i == 100 {
+			t.Fatal("late response not counted as orphan")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply != 0 {
+		t.Fatalf("reply = %d, late response written after timeout", reply)
+	}
+
+	// 只有 ctx 的 deadline 的调用在服务端及时响应时正常结束
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	call = cli.Go(ctx, "Other.Ping", &arg, &reply, make(chan *Call, 1))
+	if err := srv.reply(<-srv.reqs); err != nil {
+		t.Fatal(err)
+	}
+	if call = <-call.Done; call.Error != nil || reply != 1 {
+		t.Fatalf("Go() = %d, %v", reply, call.Error)
+	}
+}
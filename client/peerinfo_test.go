@@ -0,0 +1,105 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+// oldServer 模拟不认识 FeaturePeerInfo、方法名驻留和拆分传输的旧版本服务端，记录每个请求的 flags，
+// 每个请求都回复 "ok"
+type oldServer struct {
+	mu    sync.Mutex
+	flags []byte
+}
+
+func (o *oldServer) serve(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var p [5]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return
+	}
+	features, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > 256 {
+		return
+	}
+	if _, err := io.ReadFull(r, make([]byte, n)); err != nil {
+		return
+	}
+	reply := append(p[:], byte(features&(codec.FeatureErrorDetails|codec.FeatureLoadReport)), 0)
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return
+		}
+		_, n := binary.Uvarint(frame)
+		o.mu.Lock()
+		o.flags = append(o.flags, frame[n])
+		o.mu.Unlock()
+		if _, err := conn.Write(rawFrame(append(frame[:n:n], append([]byte{0}, `"ok"`...)...))); err != nil {
+			return
+		}
+	}
+}
+
+// TestPeerInfoOldServer 新版本的客户端连接旧版本的服务端：PeerInfo 为根据握手推断的保守值，
+// 客户端请求开启的方法名驻留和拆分传输没有被服务端接受，调用不使用它们，都能成功
+func TestPeerInfoOldServer(t *testing.T) {
+	c, s := inproc.Pipe()
+	old := new(oldServer)
+	go old.serve(s)
+	cli := NewClient(c, "pipe", WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+		return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"), codec.WithMethodInterning(), codec.WithChunking(64, 0))
+	}))
+	defer cli.Close()
+
+	arg := strings.Repeat("x", 1024)
+	for i := 0; i < 3; i++ {
+		var reply string
+		if err := cli.Call(context.Background(), "Echo.Say", arg, &reply); err != nil || reply != "ok" {
+			t.Fatalf("Call() = %q, %v", reply, err)
+		}
+	}
+	p, ok := cli.PeerInfo()
+	if !ok || !p.Legacy || p.Version != "" || p.Features != codec.FeatureErrorDetails|codec.FeatureLoadReport {
+		t.Fatalf("PeerInfo() = %+v, %v", p, ok)
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	for i, flags := range old.flags {
+		// flagMethodID、flagMethodBind 和 flagChunked
+		if flags&(1<<0|1<<1|1<<6) != 0 {
+			t.Fatalf("request %d flags = %08b, want no interning or chunking", i, flags)
+		}
+	}
+}
+
+// TestPeerInfoGob gob 协议没有握手，PeerInfo 为 codec.LegacyPeerInfo
+func TestPeerInfoGob(t *testing.T) {
+	c, s := inproc.Pipe()
+	defer s.Close()
+	cli := NewClient(c, "pipe")
+	defer cli.Close()
+	if p, ok := cli.PeerInfo(); !ok || !p.Legacy || p.Protocol != 0 || len(p.Codecs) != 1 || p.Codecs[0] != "gob" {
+		t.Fatalf("PeerInfo() = %+v, %v", p, ok)
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// pendingTable 保存所有已经发送、还没有收到响应的调用，由一个 mutex 保护。seq 由 Client 原子地分配，
+// 不需要持有这里的锁。
+//
+// 和按 seq 分片、sync.Map 的对比见 pending_test.go 中的 BenchmarkPendingTable
+type pendingTable struct {
+	mu     sync.Mutex
+	calls  map[uint64]*Call
+	closed bool // 连接已经不可用，不再接受新的调用
+}
+
+func newPendingTable() *pendingTable {
+	return &pendingTable{calls: make(map[uint64]*Call)}
+}
+
+// add 保存 call，连接已经不可用（调用过 closeAll）时返回 false
+func (t *pendingTable) add(call *Call) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.calls[call.seq] = call
+	return true
+}
+
+// remove 移除并返回 seq 对应的调用，不存在时返回 nil。同一个调用只会被一个调用方取走，
+// 取走它的一方负责结束它
+func (t *pendingTable) remove(seq uint64) *Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	call := t.calls[seq]
+	delete(t.calls, seq)
+	return call
+}
+
+// removeCall 只有 seq 对应的调用就是 call 时才移除，返回是否移除
+func (t *pendingTable) removeCall(call *Call) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.calls[call.seq] != call {
+		return false
+	}
+	delete(t.calls, call.seq)
+	return true
+}
+
+// has 返回 call 是否仍然在 pending 中
+func (t *pendingTable) has(call *Call) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls[call.seq] == call
+}
+
+// addSent 在 call 仍然在 pending 中时累加请求的大小，被拆分的请求每写入一个 fragment 累加一次。
+// 响应可能在 send 记录大小之前就被 recv 取走并结束，此时不再修改 call，这个调用的请求大小记为 0
+func (t *pendingTable) addSent(call *Call, size codec.MessageSize) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.calls[call.seq] == call {
+		call.sent = call.sent.Add(size)
+	}
+}
+
+// len 返回未完成的调用数量
+func (t *pendingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.calls)
+}
+
+// closeAll 拒绝之后的 add，并移除返回所有的调用。关闭和清空在同一次加锁期间完成，
+// 所以返回的调用不会再被 remove 取走，之后也不会有新的调用加入
+func (t *pendingTable) closeAll() []*Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	calls := make([]*Call, 0, len(t.calls))
+	for seq, call := range t.calls {
+		delete(t.calls, seq)
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// expire 移除并返回所有在 epoch 之前 slots 个周期以上加入、并且没有 deadline 的调用，和 remove 一样，
+// 取走的一方负责结束它们
+func (t *pendingTable) expire(epoch, slots uint32) []*Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var calls []*Call
+	for seq, call := range t.calls {
+		// epoch 回绕之后相减的结果仍然正确
+		if call.deadline.IsZero() && epoch-call.epoch > slots {
+			delete(t.calls, seq)
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
@@ -0,0 +1,388 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport"
+)
+
+const (
+	defaultDialTimeout = 3 * time.Second
+	// rewatchInterval Watch 返回错误后重新 watch 的间隔
+	rewatchInterval = time.Second
+)
+
+// PoolOption 用于配置 Pool
+type PoolOption func(*Pool)
+
+// WithBalancer 指定 Pool 使用的负载均衡器，默认使用 loadbalance.NewWeightedRoundRobin()。
+// 如果 lb 实现了 loadbalance.Picker，由它选择地址并接收每次调用的结果；否则如果 lb 实现了
+// loadbalance.Reporter，每次调用的开始和结束都会上报给它
+func WithBalancer(lb loadbalance.Balancer) PoolOption {
+	return func(p *Pool) {
+		p.lb = lb
+	}
+}
+
+// WithSubset 后端实例非常多时，只从中确定性地选择 size 个实例交给负载均衡器（见 loadbalance.Subset），
+// clientID 需要在客户端之间唯一且稳定，比如客户端实例的序号
+func WithSubset(clientID uint64, size int) PoolOption {
+	return func(p *Pool) {
+		p.subset = true
+		p.clientID, p.subsetSize = clientID, size
+	}
+}
+
+// WithDialTimeout 指定建立连接的超时时间
+func WithDialTimeout(d time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.dialTimeout = d
+	}
+}
+
+// WithClientOptions 指定 Pool 建立的每个连接使用的 ClientOption，比如 WithAdmission、WithTransport
+func WithClientOptions(opts ...ClientOption) PoolOption {
+	return func(p *Pool) {
+		p.clientOpts = append(p.clientOpts, opts...)
+	}
+}
+
+// WithPoolDialer Pool 通过 d 建立所有的连接，包括第一次调用、连接断开后的重连、Warmup 以及 WithMinIdle 的
+// 后台连接，ws:// 和 wss:// 地址的 tcp 连接也通过 d 建立。同 WithClientOptions(WithDialer(d))
+func WithPoolDialer(d Dialer) PoolOption {
+	return WithClientOptions(WithDialer(d))
+}
+
+// WithWebSocketOptions 注册中心中的地址为 ws:// 或者 wss:// 时，通过 DialWebSocket 建立连接并使用 opts，
+// WithClientOptions 指定的 ClientOption 同样生效
+func WithWebSocketOptions(opts ...WSOption) PoolOption {
+	return func(p *Pool) {
+		p.wsOpts = append(p.wsOpts, opts...)
+	}
+}
+
+// Pool 调用注册中心中 serviceName 的所有实例：每次调用通过负载均衡器选择一个实例，
+// 并复用到该实例的连接，连接断开后会在下次调用时重新建立。如果注册中心实现了
+// registry.Watcher，实例的变化会同步到负载均衡器中
+type Pool struct {
+	reg         registry.Client
+	serviceName string
+	lb          loadbalance.Balancer
+	picker      loadbalance.Picker
+	dialTimeout time.Duration
+	subset      bool
+	clientID    uint64
+	subsetSize  int
+	clientOpts  []ClientOption
+	wsOpts      []WSOption
+	minIdle     int
+	fallbacks   map[string]*fallback // 见 WithFallback，key: serviceMethod
+
+	conns int // 到每个地址的连接数量，见 WithConnsPerAddr
+
+	mu      sync.Mutex
+	clients map[connKey]*Client
+	redials map[connKey]int  // 连接断开后重新建立连接的次数，成功后删除
+	dialing map[connKey]bool // 正在后台重新建立的连接，见 redial
+	next    int              // 选择连接时轮转的起点
+	closed  bool
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	idleDone chan struct{} // WithMinIdle 的后台任务结束时关闭，没有开启时为 nil
+}
+
+// NewPool 从 reg 中获取 serviceName 的所有地址并初始化负载均衡器
+func NewPool(ctx context.Context, reg registry.Client, serviceName string, opts ...PoolOption) (*Pool, error) {
+	p := &Pool{
+		reg:         reg,
+		serviceName: serviceName,
+		dialTimeout: defaultDialTimeout,
+		conns:       1,
+		clients:     make(map[connKey]*Client),
+		redials:     make(map[connKey]int),
+		dialing:     make(map[connKey]bool),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.lb == nil {
+		p.lb = loadbalance.NewWeightedRoundRobin()
+	}
+	// 在交给负载均衡器之前先选出子集，注册中心的全量同步和 watch 到的变化都会经过子集
+	if p.subset {
+		p.lb = loadbalance.NewSubset(p.lb, p.clientID, p.subsetSize)
+	}
+	p.picker = loadbalance.AsPicker(p.lb)
+	if err := p.resolve(ctx); err != nil {
+		return nil, err
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	if w, ok := reg.(registry.Watcher); ok {
+		go p.watch(watchCtx, w)
+	} else {
+		close(p.done)
+	}
+	if p.minIdle > 0 {
+		p.idleDone = make(chan struct{})
+		go p.keepWarm(watchCtx)
+	}
+	return p, nil
+}
+
+// resolve 从注册中心中获取最新的实例，并替换负载均衡器中的所有地址，负载均衡器实现了
+// loadbalance.InstanceBalancer 时会收到实例的完整信息（权重、zone 等）
+func (p *Pool) resolve(ctx context.Context) error {
+	instances, err := p.reg.GetInstances(ctx, p.serviceName)
+	if err != nil {
+		return err
+	}
+	loadbalance.SetInstances(p.lb, instances)
+	return nil
+}
+
+func (p *Pool) watch(ctx context.Context, w registry.Watcher) {
+	defer close(p.done)
+	for {
+		err := w.Watch(ctx, p.serviceName, p.lb)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("rpc: pool watch %v error: %v, rewatch after %v\n", p.serviceName, err, rewatchInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rewatchInterval):
+		}
+		// watch 中断期间的变化不会被同步，重新 watch 前先全量同步一次
+		if err := p.resolve(ctx); err != nil {
+			log.Printf("rpc: pool resolve %v error: %v\n", p.serviceName, err)
+		}
+	}
+}
+
+// Balancer 返回 Pool 使用的负载均衡器
+func (p *Pool) Balancer() loadbalance.Balancer {
+	return p.lb
+}
+
+// Call 通过负载均衡器选择一个实例并发起调用，ctx 中可能带有 hash key 等信息。选择的实例正在关闭（见 ErrDraining）时
+// 换一个实例重试。调用失败并且 serviceMethod 配置了降级时（见 WithFallback），返回降级的结果
+func (p *Pool) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	info := loadbalance.PickInfo{ServiceMethod: serviceMethod}
+	err := p.attempt(ctx, info, arg, reply)
+	// 实例正在关闭（收到了 GOAWAY），调用没有发送，换一个实例重试
+	for i := 0; i < drainRetries && errors.Is(err, ErrDraining); i++ {
+		err = p.attempt(ctx, info, arg, reply)
+	}
+	if err != nil && p.fallbacks != nil {
+		err = p.fallback(ctx, serviceMethod, arg, reply, err)
+	}
+	return err
+}
+
+// WithRouteLabel 设置本次调用的路由标签，Pool 使用 loadbalance.Router 时，调用会被发送到路由规则中该标签
+// 对应的版本（比如 "canary"），见 loadbalance.RouteRule
+func WithRouteLabel(ctx context.Context, label string) context.Context {
+	return loadbalance.WithRouteLabel(ctx, label)
+}
+
+// attempt 选择一个实例并发起一次调用。无论调用以什么方式结束（成功、失败、超时、连接断开、
+// 无法建立连接），Pick 返回的 done 都会且只会被调用一次，否则负载均衡器中的统计会出现偏差。
+// 重试等需要多次调用的场景，每次尝试都应该单独调用 attempt
+func (p *Pool) attempt(ctx context.Context, info loadbalance.PickInfo, arg, reply any) (err error) {
+	addr, done, err := p.picker.Pick(ctx, info)
+	if err != nil {
+		if errors.Is(err, loadbalance.ErrNoAddr) {
+			return fmt.Errorf("this service[%v] no address", p.serviceName)
+		}
+		return err
+	}
+	start := time.Now()
+	var call *Call
+	defer func() {
+		class := classify(err)
+		di := loadbalance.DoneInfo{Err: err, Class: class, Code: errorCode(err, class), Latency: time.Since(start)}
+		if call != nil {
+			di.BytesSent, di.BytesReceived = call.sent.Total(), call.received.Total()
+			if call.load != nil {
+				di.Load = &loadbalance.Load{Inflight: call.load.Inflight, Utilization: call.load.Utilization}
+			}
+		}
+		done(di)
+	}()
+	cli, err := p.client(ctx, addr)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&cli.striped, 1)
+	call, err = cli.call(ctx, info.ServiceMethod, arg, reply)
+	atomic.AddInt64(&cli.striped, -1)
+	return err
+}
+
+// classify 返回 err 的分类
+func classify(err error) loadbalance.ErrorClass {
+	var se *status.Status
+	switch {
+	case err == nil:
+		return loadbalance.ErrorNone
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrCallExpired):
+		return loadbalance.ErrorTimeout
+	case errors.Is(err, context.Canceled):
+		return loadbalance.ErrorCanceled
+	case errors.As(err, &se):
+		return loadbalance.ErrorServer
+	}
+	return loadbalance.ErrorTransport
+}
+
+// errorCode 返回 err 的错误码，不是服务端返回的错误时根据分类选择
+func errorCode(err error, class loadbalance.ErrorClass) status.Code {
+	switch class {
+	case loadbalance.ErrorNone:
+		return status.OK
+	case loadbalance.ErrorTimeout:
+		return status.DeadlineExceeded
+	case loadbalance.ErrorCanceled:
+		return status.Canceled
+	case loadbalance.ErrorTransport:
+		return status.Unavailable
+	}
+	return status.CodeOf(err)
+}
+
+// client 返回到 addr 的一个连接（见 WithConnsPerAddr），没有可用的连接时重新建立
+func (p *Pool) client(ctx context.Context, addr string) (*Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrShutdown
+	}
+	cli, key, draining := p.pickConn(addr)
+	var missing []connKey
+	if !draining {
+		// 没有可用的连接时由调用方建立 key，其余的连接都在后台建立
+		missing = p.missingConns(addr, cli == nil, key)
+	}
+	p.mu.Unlock()
+	for _, k := range missing {
+		go p.redial(k)
+	}
+	if cli != nil {
+		return cli, nil
+	}
+	if draining {
+		// 实例正在关闭，不再建立新的连接
+		return nil, ErrDraining
+	}
+	return p.connect(ctx, key)
+}
+
+// connect 建立 key 对应的连接，其他调用同时建立了连接时使用先建立的连接
+func (p *Pool) connect(ctx context.Context, key connKey) (*Client, error) {
+	p.mu.Lock()
+	old, ok := p.clients[key]
+	var attempt int
+	if ok {
+		p.redials[key]++
+		attempt = p.redials[key]
+	}
+	p.mu.Unlock()
+	if ok {
+		old.reconnecting(attempt, p.redialDelay())
+	}
+
+	cli, err := p.dial(ctx, key.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		cli.Close()
+		return nil, ErrShutdown
+	}
+	if old, ok := p.clients[key]; ok && !old.closed() {
+		cli.Close()
+		return old, nil
+	}
+	p.clients[key] = cli
+	delete(p.redials, key)
+	return cli, nil
+}
+
+// redialDelay 重新建立连接失败后距离下一次尝试的时间，见 ConnHooks.OnReconnecting
+func (p *Pool) redialDelay() time.Duration {
+	if p.minIdle > 0 {
+		return minIdleInterval
+	}
+	return 0
+}
+
+// dial 建立到 addr 的连接，注册中心中的地址可能是 host:port、unix://path 或者 ws(s)://host/path
+func (p *Pool) dial(ctx context.Context, addr string) (*Client, error) {
+	// 实例开始关闭时不再选择它，直到注册中心中的状态恢复
+	goAway := withGoAway(func() { p.lb.Delete(addr) })
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		ctx, cancel := context.WithTimeout(ctx, p.dialTimeout)
+		defer cancel()
+		opts := append([]WSOption{WithWSClientOptions(append(append([]ClientOption(nil), p.clientOpts...), goAway)...)}, p.wsOpts...)
+		return DialWebSocket(ctx, addr, opts...)
+	}
+	// WithClientOptions 中的 WithTransport 可以覆盖 WithDialTimeout
+	opts := append([]ClientOption{WithTransport(transport.WithConnectTimeout(p.dialTimeout)), goAway}, p.clientOpts...)
+	network, address := registry.ParseAddr(addr)
+	return Dial(ctx, network, address, opts...)
+}
+
+// Start 什么也不做，连接池在 NewPool 时已经开始工作。和 Stop 一起实现 appleseed.Component
+func (p *Pool) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop 同 Close，已经关闭时返回 nil。放在 appleseed.Lifecycle 中时应当先于使用它的 server 添加，
+// server 停止、正在处理的请求都完成之后才关闭
+func (p *Pool) Stop(ctx context.Context) error {
+	if err := p.Close(); err != ErrShutdown {
+		return err
+	}
+	return nil
+}
+
+// Close 停止 watch 并关闭所有连接
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrShutdown
+	}
+	p.closed = true
+	clients := p.clients
+	p.clients = nil
+	p.mu.Unlock()
+
+	p.cancel()
+	<-p.done
+	if p.idleDone != nil {
+		<-p.idleDone
+	}
+	for _, cli := range clients {
+		cli.Close()
+	}
+	return nil
+}
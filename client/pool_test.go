@@ -0,0 +1,440 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+type Echo struct {
+	delay time.Duration
+	calls int64
+}
+
+func (e *Echo) Ping(args *int, reply *int) error {
+	atomic.AddInt64(&e.calls, 1)
+	time.Sleep(e.delay)
+	*reply = *args
+	return nil
+}
+
+// startEcho 启动一个注册到 reg 的 Echo 服务，每次调用耗时 delay
+func startEcho(t testing.TB, reg *memory.Registry, serviceName string, delay time.Duration, opts ...appleseed.ServerOption) (*appleseed.Server, *Echo, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(context.Background(), serviceName, "127.0.0.1", port, reg, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Echo{delay: delay}
+	if err := s.Register(e); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return s, e, lis.Addr().String()
+}
+
+func TestPoolLeastConnPrefersFastBackend(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	_, slow, slowAddr := startEcho(t, reg, "echo", 50*time.Millisecond)
+	_, fast, fastAddr := startEcho(t, reg, "echo", time.Millisecond)
+
+	lb := loadbalance.NewLeastConn()
+	pool, err := NewPool(ctx, reg, "echo", WithBalancer(lb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var reply int
+				if err := pool.Call(ctx, "Echo.Ping", &i, &reply); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s, f := atomic.LoadInt64(&slow.calls), atomic.LoadInt64(&fast.calls)
+	t.Logf("slow: %d, fast: %d", s, f)
+	// 随机或者轮询时两者各占一半
+	if f < 3*s {
+		t.Fatalf("traffic not shifted to the fast backend, slow: %d, fast: %d", s, f)
+	}
+	for _, addr := range []string{slowAddr, fastAddr} {
+		if n := lb.Inflight(addr); n != 0 {
+			t.Fatalf("%v inflight = %d after all calls done", addr, n)
+		}
+	}
+}
+
+// TestPoolServerLoad 两个延迟相同的实例上报不同的负载，P2C 把大部分请求发给空闲的实例
+func TestPoolServerLoad(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	constant := func(util uint32) appleseed.LoadFunc {
+		return func(int64) uint32 { return util }
+	}
+	_, busy, _ := startEcho(t, reg, "echo", time.Millisecond, appleseed.WithLoadReport(constant(90)))
+	_, idle, _ := startEcho(t, reg, "echo", time.Millisecond, appleseed.WithLoadReport(constant(10)))
+
+	pool, err := NewPool(ctx, reg, "echo", WithBalancer(loadbalance.NewP2C(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	for i := 0; i < 200; i++ {
+		reply := 0
+		if err := pool.Call(ctx, "Echo.Ping", &i, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, i := atomic.LoadInt64(&busy.calls), atomic.LoadInt64(&idle.calls)
+	if i < 4*b {
+		t.Fatalf("busy got %d calls, idle got %d", b, i)
+	}
+}
+
+func TestPoolReportsEveryCompletion(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	s, _, addr := startEcho(t, reg, "echo", 100*time.Millisecond)
+
+	lb := loadbalance.NewLeastConn()
+	pool, err := NewPool(ctx, reg, "echo", WithBalancer(lb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	check := func(name string) {
+		t.Helper()
+		if n := lb.Inflight(addr); n != 0 {
+			t.Fatalf("%v: inflight = %d", name, n)
+		}
+	}
+	arg, reply := 1, 0
+
+	// 成功
+	if err := pool.Call(ctx, "Echo.Ping", &arg, &reply); err != nil {
+		t.Fatal(err)
+	}
+	check("success")
+
+	// 服务端返回错误
+	if err := pool.Call(ctx, "Echo.NotFound", &arg, &reply); err == nil {
+		t.Fatal("want error")
+	}
+	check("error")
+
+	// 超时
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	err = pool.Call(timeoutCtx, "Echo.Ping", &arg, &reply)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	check("timeout")
+
+	// 调用期间连接断开
+	done := make(chan error, 1)
+	go func() { done <- pool.Call(ctx, "Echo.Ping", &arg, &reply) }()
+	time.Sleep(20 * time.Millisecond)
+	if n := lb.Inflight(addr); n != 1 {
+		t.Fatalf("inflight during call = %d", n)
+	}
+	closed, cancel := context.WithCancel(ctx)
+	cancel()
+	s.Shutdown(closed) // ctx 已经结束，不等待请求完成直接关闭连接
+	if err := <-done; err == nil {
+		t.Fatal("want error after connection closed")
+	}
+	check("connection closed")
+
+	// 无法建立连接
+	if err := pool.Call(ctx, "Echo.Ping", &arg, &reply); err == nil {
+		t.Fatal("want dial error")
+	}
+	check("dial error")
+}
+
+func TestPoolRegistryWeights(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	sa, ea, addrA := startEcho(t, reg, "weighted", 0)
+	sb, eb, addrB := startEcho(t, reg, "weighted", 0)
+	if err := sa.Registration().SetWeight(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Registration().SetWeight(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := loadbalance.NewWeightedRoundRobin()
+	pool, err := NewPool(ctx, reg, "weighted", WithBalancer(lb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	split := func() (a, b int64) {
+		t.Helper()
+		a0, b0 := atomic.LoadInt64(&ea.calls), atomic.LoadInt64(&eb.calls)
+		for i := 0; i < 4000; i++ {
+			var reply int
+			if err := pool.Call(ctx, "Echo.Ping", &i, &reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return atomic.LoadInt64(&ea.calls) - a0, atomic.LoadInt64(&eb.calls) - b0
+	}
+	near := func(got, want int64) bool {
+		return got > want*95/100 && got < want*105/100
+	}
+
+	a, b := split()
+	t.Logf("weights 1:3, split %d:%d", a, b)
+	if !near(a, 1000) || !near(b, 3000) {
+		t.Fatalf("split %d:%d, want about 1000:3000", a, b)
+	}
+
+	// 修改权重后不需要重启客户端，watch 到变化后立即生效
+	if err := sa.Registration().SetWeight(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Registration().SetWeight(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for w := lb.Weights(); w[addrA] != 3 || w[addrB] != 1; w = lb.Weights() {
+		if time.Now().After(deadline) {
+			t.Fatalf("weights not updated: %v", w)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	a, b = split()
+	t.Logf("weights 3:1, split %d:%d", a, b)
+	if !near(a, 3000) || !near(b, 1000) {
+		t.Fatalf("split %d:%d, want about 3000:1000", a, b)
+	}
+}
+
+// leakPicker 记录每次 Pick 以及 done 的调用情况
+type leakPicker struct {
+	*loadbalance.RoundRobin
+
+	mu      sync.Mutex
+	picks   int
+	dones   []loadbalance.DoneInfo
+	repeats int // done 被重复调用的次数
+}
+
+func (l *leakPicker) Pick(ctx context.Context, info loadbalance.PickInfo) (string, func(loadbalance.DoneInfo), error) {
+	addr := l.Get()
+	if addr == "" {
+		return "", nil, loadbalance.ErrNoAddr
+	}
+	l.mu.Lock()
+	l.picks++
+	l.mu.Unlock()
+	var called bool
+	return addr, func(di loadbalance.DoneInfo) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if called {
+			l.repeats++
+			return
+		}
+		called = true
+		l.dones = append(l.dones, di)
+	}, nil
+}
+
+// last 检查没有泄漏的 done 并返回最后一次调用的结果
+func (l *leakPicker) last(t *testing.T, name string) loadbalance.DoneInfo {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.picks != len(l.dones) || l.repeats != 0 {
+		t.Fatalf("%v: picks = %d, dones = %d, repeats = %d", name, l.picks, len(l.dones), l.repeats)
+	}
+	return l.dones[len(l.dones)-1]
+}
+
+func TestPoolPickerDoneExactlyOnce(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	s, _, _ := startEcho(t, reg, "echo", 100*time.Millisecond)
+
+	lb := &leakPicker{RoundRobin: &loadbalance.RoundRobin{}}
+	pool, err := NewPool(ctx, reg, "echo", WithBalancer(lb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	arg, reply := 1, 0
+
+	// 成功
+	if err := pool.Call(ctx, "Echo.Ping", &arg, &reply); err != nil {
+		t.Fatal(err)
+	}
+	di := lb.last(t, "success")
+	if di.Class != loadbalance.ErrorNone || di.Code != status.OK || di.BytesSent == 0 || di.BytesReceived == 0 || di.Latency < 100*time.Millisecond {
+		t.Fatalf("success: %+v", di)
+	}
+
+	// 服务端返回错误
+	if err := pool.Call(ctx, "Echo.NotFound", &arg, &reply); err == nil {
+		t.Fatal("want error")
+	}
+	if di := lb.last(t, "server error"); di.Class != loadbalance.ErrorServer || di.Code != status.Unimplemented {
+		t.Fatalf("server error: %+v", di)
+	}
+
+	// 并发调用
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			if err := pool.Call(ctx, "Echo.Ping", &i, &reply); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	lb.last(t, "concurrent")
+
+	// 超时
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	pool.Call(timeoutCtx, "Echo.Ping", &arg, &reply)
+	cancel()
+	if di := lb.last(t, "timeout"); di.Class != loadbalance.ErrorTimeout || di.Code != status.DeadlineExceeded {
+		t.Fatalf("timeout: %+v", di)
+	}
+
+	// 调用期间连接断开
+	done := make(chan error, 1)
+	go func() { done <- pool.Call(ctx, "Echo.Ping", &arg, &reply) }()
+	time.Sleep(20 * time.Millisecond)
+	closed, cancel := context.WithCancel(ctx)
+	cancel()
+	s.Shutdown(closed)
+	if err := <-done; err == nil {
+		t.Fatal("want error after connection closed")
+	}
+	if di := lb.last(t, "connection closed"); di.Class != loadbalance.ErrorTransport || di.Code != status.Unavailable {
+		t.Fatalf("connection closed: %+v", di)
+	}
+
+	// 无法建立连接
+	if err := pool.Call(ctx, "Echo.Ping", &arg, &reply); err == nil {
+		t.Fatal("want dial error")
+	}
+	if di := lb.last(t, "dial error"); di.Class != loadbalance.ErrorTransport {
+		t.Fatalf("dial error: %+v", di)
+	}
+}
+
+func TestPoolSubset(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	echos := make(map[string]*Echo)
+	for i := 0; i < 6; i++ {
+		_, e, addr := startEcho(t, reg, "subset", 0)
+		echos[addr] = e
+	}
+
+	pool, err := NewPool(ctx, reg, "subset", WithSubset(3, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	selected := pool.Balancer().(*loadbalance.Subset).Selected()
+	if len(selected) != 2 {
+		t.Fatalf("selected %v, want 2 addrs", selected)
+	}
+	for i := 0; i < 20; i++ {
+		var reply int
+		if err := pool.Call(ctx, "Echo.Ping", &i, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for addr, e := range echos {
+		n := atomic.LoadInt64(&e.calls)
+		in := addr == selected[0] || addr == selected[1]
+		if in && n == 0 || !in && n != 0 {
+			t.Fatalf("%v (selected: %v) got %d calls", addr, in, n)
+		}
+	}
+}
+
+// TestPoolRouteLabel 带有路由标签的调用发送到实例 metadata 中对应版本的实例，规则修改后不需要重新创建 Pool
+func TestPoolRouteLabel(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	_, stable, _ := startEcho(t, reg, "routed", 0, appleseed.WithInstanceMetadata(map[string]string{registry.MetadataVersion: "v1"}))
+	_, canary, _ := startEcho(t, reg, "routed", 0, appleseed.WithInstanceMetadata(map[string]string{registry.MetadataVersion: "v2"}))
+
+	table, err := loadbalance.NewRouteTable(loadbalance.RouteRule{Service: "routed", Default: "v1", Labels: map[string]string{"canary": "v2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := loadbalance.NewRouter("routed", table, func() loadbalance.Balancer { return loadbalance.NewWeightedRoundRobin() })
+	pool, err := NewPool(ctx, reg, "routed", WithBalancer(router))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	calls := func(ctx context.Context) (v1, v2 int64) {
+		t.Helper()
+		s0, c0 := atomic.LoadInt64(&stable.calls), atomic.LoadInt64(&canary.calls)
+		for i := 0; i < 20; i++ {
+			var reply int
+			if err := pool.Call(ctx, "Echo.Ping", &i, &reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return atomic.LoadInt64(&stable.calls) - s0, atomic.LoadInt64(&canary.calls) - c0
+	}
+	if v1, v2 := calls(ctx); v1 != 20 || v2 != 0 {
+		t.Fatalf("without label %d:%d", v1, v2)
+	}
+	if v1, v2 := calls(WithRouteLabel(ctx, "canary")); v1 != 0 || v2 != 20 {
+		t.Fatalf("canary %d:%d", v1, v2)
+	}
+	if err := table.Set([]loadbalance.RouteRule{{Service: "routed", Default: "v2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if v1, v2 := calls(ctx); v1 != 0 || v2 != 20 {
+		t.Fatalf("after promoting v2 %d:%d", v1, v2)
+	}
+}
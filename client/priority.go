@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+)
+
+// Priority 调用的优先级，越大越重要。发送队列中优先级高的调用先被写入连接，同时随请求的
+// metadata（metadata.PriorityKey）发送给服务端，服务端过载时优先拒绝优先级低的请求（见 loadshed）
+type Priority int
+
+const (
+	PriorityLow    Priority = -1 // 批量任务等可以等待的调用
+	PriorityNormal Priority = 0  // 没有设置优先级时的默认值
+	PriorityHigh   Priority = 1  // 健康检查、控制面等需要及时处理的调用
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return strconv.Itoa(int(p))
+}
+
+// WithPriority 使用 ctx 发起的调用都会使用优先级 p
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, metadata.PriorityKey, strconv.Itoa(int(p)))
+}
+
+// sendClass 发送队列的类别，小于 0 的优先级为 PriorityLow，大于 0 的为 PriorityHigh
+type sendClass int
+
+const (
+	classLow sendClass = iota
+	classNormal
+	classHigh
+	numClasses
+)
+
+// classWeights 每一轮中每个类别最多发送的调用数量：队列都不为空时，高优先级的调用占 8/11 的发送机会，
+// 低优先级的调用不会完全得不到发送
+var classWeights = [numClasses]int{classLow: 1, classNormal: 2, classHigh: 8}
+
+var classPriorities = [numClasses]Priority{classLow: PriorityLow, classNormal: PriorityNormal, classHigh: PriorityHigh}
+
+// classOf 返回 md 中的优先级对应的类别，没有设置或者不合法时为 classNormal
+func classOf(md metadata.MD) sendClass {
+	p, _ := strconv.Atoi(md.Get(metadata.PriorityKey))
+	switch {
+	case p < 0:
+		return classLow
+	case p > 0:
+		return classHigh
+	}
+	return classNormal
+}
+
+// SendQueueStats 一个优先级的发送队列的统计
+type SendQueueStats struct {
+	Depth  int    // 正在排队等待发送的调用数量
+	Queued uint64 // 排过队的调用数量，发送 goroutine 空闲时直接写入的调用不计入
+}
+
+// nextCall 按照权重从发送队列中取出下一个调用：每一轮中每个类别最多取出 classWeights 个调用，
+// 优先级高的先取，有额度的队列都为空时开始下一轮。所有的队列都为空时返回 nil。只在发送 goroutine 中调用
+func (c *Client) nextCall() *Call {
+	for round := 0; round < 2; round++ {
+		for class := numClasses - 1; class >= 0; class-- {
+			if c.credits[class] == 0 {
+				continue
+			}
+			select {
+			case call := <-c.sendq[class]:
+				c.credits[class]--
+				return call
+			default:
+			}
+		}
+		c.credits = classWeights
+	}
+	return nil
+}
+
+// queued 返回所有发送队列中的调用数量
+func (c *Client) queued() int {
+	n := 0
+	for _, q := range c.sendq {
+		n += len(q)
+	}
+	return n
+}
+
+func (c *Client) sendQueueStats() map[Priority]SendQueueStats {
+	stats := make(map[Priority]SendQueueStats, numClasses)
+	for class, q := range c.sendq {
+		stats[classPriorities[class]] = SendQueueStats{
+			Depth:  len(q),
+			Queued: atomic.LoadUint64(&c.enqueued[class]),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+// slowWriteConn 每写入一个字节耗时 perByte，模拟带宽打满的连接
+type slowWriteConn struct {
+	net.Conn
+	perByte time.Duration
+}
+
+func (c *slowWriteConn) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(len(p)) * c.perByte)
+	return c.Conn.Write(p)
+}
+
+func TestNextCallWeights(t *testing.T) {
+	cli := &Client{}
+	for class := range cli.sendq {
+		cli.sendq[class] = make(chan *Call, 20)
+		for i := 0; i < 20; i++ {
+			cli.sendq[class] <- &Call{class: sendClass(class)}
+		}
+	}
+	var got [numClasses]int
+	for i := 0; i < 22; i++ {
+		got[cli.nextCall().class]++
+	}
+	// 两轮，每轮 8 个高优先级、2 个普通、1 个低优先级
+	if want := [numClasses]int{2, 4, 16}; got != want {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+	for i := 0; i < 38; i++ {
+		cli.nextCall()
+	}
+	if call := cli.nextCall(); call != nil || cli.queued() != 0 {
+		t.Fatalf("nextCall() = %v with %d queued", call, cli.queued())
+	}
+}
+
+// TestPriorityUnderSaturation 低优先级的调用占满连接时，高优先级的调用在有限的时间内完成，
+// 优先级随 metadata 发送给服务端
+func TestPriorityUnderSaturation(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		priorities = make(map[string]int)
+	)
+	record := func(ctx context.Context, info *appleseed.ServerInfo, arg, reply any, handler appleseed.Handler) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		mu.Lock()
+		priorities[md.Get(metadata.PriorityKey)]++
+		mu.Unlock()
+		return handler(ctx, arg, reply)
+	}
+	_, _, addr := startEcho(t, memory.New(nil), "priority", 0, appleseed.WithInterceptors(record))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 一个请求大约 100 字节，排满的低优先级队列需要大约 256 * 100 * 10µs = 256ms 才能写完
+	const queueSize = 256
+	cli := NewClient(&slowWriteConn{Conn: conn, perByte: 10 * time.Microsecond}, addr, WithSendQueue(queueSize))
+	defer cli.Close()
+
+	low := WithPriority(context.Background(), PriorityLow)
+	stop := make(chan struct{})
+	done := make(chan *Call, 4*queueSize)
+	var wg sync.WaitGroup
+	// 只有一个调用方时每次都是直接写入，多个调用方才能让队列排满
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				arg := 1
+				cli.Go(low, "Echo.Ping", &arg, new(int), done)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-done:
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		cli.Close()
+		wg.Wait()
+	}()
+
+	for cli.Stats().SendQueue[PriorityLow].Depth < queueSize/2 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	arg, reply := 2, 0
+	if err := cli.Call(WithPriority(context.Background(), PriorityHigh), "Echo.Ping", &arg, &reply); err != nil || reply != 2 {
+		t.Fatalf("reply = %d, err = %v", reply, err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("high priority call took %v", d)
+	}
+
+	stats := cli.Stats().SendQueue
+	if stats[PriorityLow].Queued < queueSize/2 || stats[PriorityHigh].Queued != 1 || stats[PriorityHigh].Depth != 0 {
+		t.Fatalf("send queue stats = %+v", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if priorities["1"] != 1 || priorities["-1"] == 0 || priorities[""] != 0 {
+		t.Fatalf("priorities seen by server = %v", priorities)
+	}
+}
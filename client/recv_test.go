@@ -0,0 +1,253 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+// closeCounter 记录连接被关闭的次数
+type closeCounter struct {
+	io.ReadWriteCloser
+	closed int32
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return c.ReadWriteCloser.Close()
+}
+
+// lostClient 返回连接到 inproc.Pipe 的 Client，连接断开时的错误会被发送到 lost 中
+func lostClient(t *testing.T) (cli *Client, server *inproc.Conn, conn *closeCounter, lost chan error) {
+	c, s := inproc.Pipe()
+	conn = &closeCounter{ReadWriteCloser: c}
+	lost = make(chan error, 2)
+	cli = NewClient(conn, "pipe", WithOnConnectionLost(func(err error) { lost <- err }))
+	t.Cleanup(func() {
+		cli.Close()
+		s.Close()
+	})
+	return cli, s, conn, lost
+}
+
+// waitLost 等待连接断开的回调，返回回调收到的错误
+func waitLost(t *testing.T, lost chan error) error {
+	t.Helper()
+	select {
+	case err := <-lost:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("OnConnectionLost not called")
+		return nil
+	}
+}
+
+// TestServerCloseMidCall 服务端在处理调用期间关闭连接，未完成的调用返回 ErrConnectionClosed
+func TestServerCloseMidCall(t *testing.T) {
+	cli, s, conn, lost := lostClient(t)
+	srv := codec.NewGobServerCodec(s)
+	go func() {
+		var req codec.RequestHeader
+		var arg int
+		srv.ReadRequestHeader(&req)
+		srv.ReadRequestBody(&arg)
+		srv.Close()
+	}()
+
+	arg, reply := 1, 0
+	err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply)
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("err = %v, want ErrConnectionClosed", err)
+	}
+	if err := waitLost(t, lost); err != ErrConnectionClosed {
+		t.Fatalf("OnConnectionLost(%v)", err)
+	}
+	if err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply); err != ErrShutdown {
+		t.Fatalf("call after close: err = %v", err)
+	}
+	cli.Close()
+	if n := atomic.LoadInt32(&conn.closed); n != 1 {
+		t.Fatalf("conn closed %d times", n)
+	}
+}
+
+// TestServerCloseAfterLastResponse 服务端发送完最后一个响应后立即关闭连接，调用正常完成
+func TestServerCloseAfterLastResponse(t *testing.T) {
+	cli, s, _, lost := lostClient(t)
+	srv := codec.NewGobServerCodec(s)
+	go func() {
+		var req codec.RequestHeader
+		var arg int
+		srv.ReadRequestHeader(&req)
+		srv.ReadRequestBody(&arg)
+		srv.WriteResponse(&codec.ResponseHeader{ServiceMethod: req.ServiceMethod, Seq: req.Seq}, arg)
+		srv.Close()
+	}()
+
+	arg, reply := 7, 0
+	if err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply); err != nil || reply != 7 {
+		t.Fatalf("reply = %d, err = %v", reply, err)
+	}
+	if err := waitLost(t, lost); err != ErrConnectionClosed {
+		t.Fatalf("OnConnectionLost(%v)", err)
+	}
+}
+
+// TestConnectionLostPartialResponse 响应只发送了一部分时连接断开，错误同时是 ErrConnectionLost 和底层的错误
+func TestConnectionLostPartialResponse(t *testing.T) {
+	cli, s, _, lost := lostClient(t)
+	go func() {
+		dec := gob.NewDecoder(s)
+		var req codec.RequestHeader
+		var arg int
+		dec.Decode(&req)
+		dec.Decode(&arg)
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(&codec.ResponseHeader{ServiceMethod: req.ServiceMethod, Seq: req.Seq})
+		s.Write(buf.Bytes()[:buf.Len()/2])
+		s.Close()
+	}()
+
+	arg, reply := 1, 0
+	err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply)
+	if !errors.Is(err, ErrConnectionLost) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err = %v, want ErrConnectionLost wrapping io.ErrUnexpectedEOF", err)
+	}
+	if errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("partial response reported as clean close: %v", err)
+	}
+	if lostErr := waitLost(t, lost); lostErr.Error() != err.Error() {
+		t.Fatalf("OnConnectionLost(%v), call error %v", lostErr, err)
+	}
+}
+
+// TestConnectionDroppedMidResponse 服务端的响应只传输了一部分时连接被断开，调用返回包装了底层错误的
+// ErrConnectionLost，之前已经完整收到的响应不受影响
+func TestConnectionDroppedMidResponse(t *testing.T) {
+	cli, s, _, lost := lostClient(t)
+	srv := codec.NewGobServerCodec(s)
+	go func() {
+		var reqs []codec.RequestHeader
+		for i := 0; i < 2; i++ {
+			var req codec.RequestHeader
+			var arg int
+			if srv.ReadRequestHeader(&req) != nil || srv.ReadRequestBody(&arg) != nil {
+				return
+			}
+			reqs = append(reqs, req)
+			srv.WriteResponse(&codec.ResponseHeader{ServiceMethod: req.ServiceMethod, Seq: req.Seq}, arg)
+			// 第一个响应完整发送，第二个响应只发送 3 个字节
+			s.Inject(inproc.Faults{DropAfter: 3})
+		}
+	}()
+
+	arg, reply := 1, 0
+	if err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply); err != nil || reply != 1 {
+		t.Fatalf("reply = %d, err = %v", reply, err)
+	}
+	err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply)
+	if !errors.Is(err, ErrConnectionLost) || !errors.Is(err, inproc.ErrDropped) {
+		t.Fatalf("err = %v, want ErrConnectionLost wrapping inproc.ErrDropped", err)
+	}
+	if lostErr := waitLost(t, lost); !errors.Is(lostErr, inproc.ErrDropped) {
+		t.Fatalf("OnConnectionLost(%v)", lostErr)
+	}
+}
+
+// TestCloseDoesNotReportLost 调用 Close 时未完成的调用返回 ErrShutdown，不会调用 OnConnectionLost
+func TestCloseDoesNotReportLost(t *testing.T) {
+	cli, s, conn, lost := lostClient(t)
+	go io.Copy(io.Discard, s)
+
+	arg, reply := 1, 0
+	call := cli.Go(context.Background(), "Echo.Ping", &arg, &reply, nil)
+	time.Sleep(10 * time.Millisecond)
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if call := <-call.Done; call.Error != ErrShutdown {
+		t.Fatalf("err = %v, want ErrShutdown", call.Error)
+	}
+	<-cli.recvDone
+	select {
+	case err := <-lost:
+		t.Fatalf("OnConnectionLost(%v) after Close", err)
+	default:
+	}
+	if err := cli.Close(); err != ErrShutdown {
+		t.Fatalf("second Close: %v", err)
+	}
+	if n := atomic.LoadInt32(&conn.closed); n != 1 {
+		t.Fatalf("conn closed %d times", n)
+	}
+}
+
+type lateReply struct {
+	Items []string
+}
+
+// TestOrphanResponse 调用被取消之后才到达的响应被丢弃，之后的响应仍然可以正常解码
+func TestOrphanResponse(t *testing.T) {
+	c, s := inproc.Pipe()
+	orphans := make(chan codec.ResponseHeader, 2)
+	cli := NewClient(c, "pipe", WithOrphanResponseHandler(func(seq uint64, header codec.ResponseHeader) {
+		orphans <- header
+		panic("boom")
+	}))
+	defer cli.Close()
+	defer s.Close()
+
+	srv := codec.NewGobServerCodec(s)
+	received := make(chan codec.RequestHeader)
+	go func() {
+		var reqs []codec.RequestHeader
+		for i := 0; i < 2; i++ {
+			var req codec.RequestHeader
+			var arg int
+			if srv.ReadRequestHeader(&req) != nil || srv.ReadRequestBody(&arg) != nil {
+				return
+			}
+			reqs = append(reqs, req)
+			received <- req
+		}
+		// 先发送已经被取消的调用的响应，body 的类型和第二个调用的 reply 不同
+		srv.WriteResponse(&codec.ResponseHeader{ServiceMethod: reqs[0].ServiceMethod, Seq: reqs[0].Seq},
+			&lateReply{Items: []string{"late"}})
+		srv.WriteResponse(&codec.ResponseHeader{ServiceMethod: reqs[1].ServiceMethod, Seq: reqs[1].Seq}, 42)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var first codec.RequestHeader
+	go func() {
+		first = <-received
+		cancel()
+	}()
+	arg, reply := 1, 0
+	if err := cli.Call(ctx, "Echo.Ping", &arg, &reply); err != context.Canceled {
+		t.Fatalf("canceled call err = %v", err)
+	}
+	go func() { <-received }()
+	if err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply); err != nil || reply != 42 {
+		t.Fatalf("reply = %d, err = %v", reply, err)
+	}
+
+	select {
+	case h := <-orphans:
+		if h.Seq != first.Seq || h.ServiceMethod != "Echo.Ping" {
+			t.Fatalf("orphan header = %+v, want seq %d", h, first.Seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("orphan handler not called")
+	}
+	if n := cli.Stats().OrphanResponses; n != 1 {
+		t.Fatalf("OrphanResponses = %d, want 1", n)
+	}
+}
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// DefaultSendQueueSize 等待发送的请求队列的默认长度
+const DefaultSendQueueSize = 1024
+
+// WithSendQueue 每个优先级等待发送的请求最多 n 个（默认为 DefaultSendQueueSize），队列已满时发起调用会等待，
+// 直到队列有空位或者调用的 ctx 结束。n <= 0 时使用默认值。优先级低的队列已满不影响优先级高的调用，见 WithPriority
+func WithSendQueue(n int) ClientOption {
+	return func(c *Client) {
+		if n > 0 {
+			c.sendQueue = n
+		}
+	}
+}
+
+// ErrWriteTimeout 对端长时间不读取（比如接收窗口为 0）导致写入超过了期限，没有写完的调用返回的错误包装了它，
+// 可以使用 errors.Is 判断。写入中断后连接处于未知的状态，会被关闭，所以错误同时包装了 ErrConnectionLost
+var ErrWriteTimeout = errors.New("rpc: write timeout")
+
+// writeTimeoutError 写入超时的错误，errors.Is 对 ErrWriteTimeout 和底层的错误都成立
+type writeTimeoutError struct {
+	err error
+}
+
+func (e *writeTimeoutError) Error() string {
+	return ErrWriteTimeout.Error() + ": " + e.err.Error()
+}
+
+func (e *writeTimeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *writeTimeoutError) Is(target error) bool {
+	return target == ErrWriteTimeout
+}
+
+func (e *writeTimeoutError) Timeout() bool {
+	return true
+}
+
+// writeDeadliner 可以设置写入期限的连接，net.Conn 实现了它
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// WithWriteTimeout 没有 deadline 的调用（ctx 和 MethodConfig 都没有设置超时时间）写入连接时最多等待 d，
+// 默认不限制。有 deadline 的调用总是最多等待到 deadline。超时后没有写完的调用返回包装了 ErrWriteTimeout 的错误，
+// 连接被关闭（WithOnConnectionLost 和 Pool 会重新建立连接）。只对实现了 SetWriteDeadline 的连接生效，
+// Dial、DialWebSocket 和 inproc 的连接都实现了它
+func WithWriteTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.writeTimeout = d
+	}
+}
+
+// bufferedConn 写入先进入缓冲，发送队列中暂时没有请求时才 Flush，
+// 高并发时多个请求合并为一次写入。读取不经过缓冲
+type bufferedConn struct {
+	io.ReadWriteCloser
+	w   *bufio.Writer
+	err error // 第一次写入连接失败的错误，之后连接不可用
+}
+
+func newBufferedConn(conn io.ReadWriteCloser) *bufferedConn {
+	return &bufferedConn{ReadWriteCloser: conn, w: bufio.NewWriter(conn)}
+}
+
+func (b *bufferedConn) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *bufferedConn) Flush() error {
+	if err := b.w.Flush(); err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return err
+	}
+	return nil
+}
+
+// enqueue 将已经加入 pending 的 call 放入它的优先级的队列，交给发送 goroutine。队列已满时等待，
+// ctx 在等待期间结束时以 ctx.Err() 结束 call
+func (c *Client) enqueue(ctx context.Context, call *Call) {
+	select {
+	case c.sendq[call.class] <- call:
+		atomic.AddUint64(&c.enqueued[call.class], 1)
+	case <-ctx.Done():
+		if c.pending.removeCall(call) {
+			call.Error = ctx.Err()
+			call.done()
+		}
+	case <-c.recvDone:
+		// closeAll 已经结束了 call
+	}
+}
+
+// sendLoop 每个连接一个的发送 goroutine，按照优先级的权重（见 nextCall）从队列中取出请求，同一个优先级
+// 按照入队的顺序编码并写入，队列中暂时没有请求时才写入连接，直到 recv 退出。发送 goroutine 空闲时
+// 调用方直接写入，见 send
+func (c *Client) sendLoop() {
+	for {
+		call := c.nextCall()
+		if call == nil {
+			// 队列都为空时等待任意一个队列的调用，此时不存在优先级的竞争
+			select {
+			case call = <-c.sendq[classHigh]:
+			case call = <-c.sendq[classNormal]:
+			case call = <-c.sendq[classLow]:
+			case <-c.wake:
+				c.writeTransfers()
+				continue
+			case <-c.recvDone:
+				return
+			}
+		}
+		c.writeMu.Lock()
+		c.write(call)
+		if c.queued() == 0 {
+			c.flush()
+		}
+		c.writeMu.Unlock()
+	}
+}
+
+// chunkedCodec 支持拆分传输的 codec，见 codec.WithChunking
+type chunkedCodec interface {
+	codec.FragmentWriter
+	Chunking() bool
+	SetSink(seq uint64, w io.Writer)
+	Discard(seq uint64)
+}
+
+// writeTransfers 轮流写入每个被拆分的请求的下一个 fragment，直到全部写完。每写入一个 fragment 之前
+// 先写入队列中已有的请求，调用方的 goroutine 也可以在两个 fragment 之间直接写入，所以一个很大的请求
+// 不会阻塞同一个连接上的其他调用
+func (c *Client) writeTransfers() {
+	for {
+		c.writeMu.Lock()
+		for n := c.queued(); n > 0; n-- {
+			c.write(c.nextCall())
+		}
+		if c.writeErr != nil || len(c.transfers) == 0 {
+			c.transfers = nil
+			c.flush()
+			c.writeMu.Unlock()
+			return
+		}
+		call := c.transfers[0]
+		c.transfers = c.transfers[1:]
+		if c.writeFragment(call) {
+			c.transfers = append(c.transfers, call)
+		}
+		c.flush()
+		c.writeMu.Unlock()
+	}
+}
+
+// writeFragment 写入 call 的下一个 fragment，返回是否还有剩余的 fragment。call 已经超时或者被取消时
+// 通知服务端丢弃已经收到的部分。调用方持有 writeMu
+func (c *Client) writeFragment(call *Call) (more bool) {
+	cc := c.codec.(chunkedCodec)
+	// 和 write 一样持有 call.writing，RawMessage 参数的数据在写入时才被读取
+	call.writing.Lock()
+	defer call.writing.Unlock()
+	if !c.pending.has(call) {
+		if err := cc.AbortFragments(call.seq); err != nil {
+			c.fail(err)
+		}
+		return false
+	}
+	c.setWriteDeadline(call)
+	more, err := cc.WriteFragment(call.seq)
+	if err != nil {
+		c.unflushed = append(c.unflushed, call)
+		c.fail(err)
+		return false
+	}
+	if r, ok := c.codec.(codec.SizeReporter); ok {
+		c.pending.addSent(call, r.LastWriteSize())
+	}
+	c.unflushed = append(c.unflushed, call)
+	return more
+}
+
+// discard 调用被取消或者过期后，丢弃 call 已经收到的被拆分的响应，之后不再写入 reply 的 BodySink
+func (c *Client) discard(call *Call) {
+	if cc, ok := c.codec.(chunkedCodec); ok {
+		cc.Discard(call.seq)
+	}
+}
+
+// write 编码 call 并写入缓冲。已经超时或者被取消的 call 不再发送，收到 GOAWAY 之后的 call 以 ErrDraining 结束。
+// 调用方持有 writeMu
+func (c *Client) write(call *Call) {
+	if c.writeErr != nil {
+		// 连接已经写入失败，recv 会结束剩余的调用
+		return
+	}
+	if atomic.LoadInt32(&c.draining) == 1 {
+		// 收到 GOAWAY 之后不再发送新的调用，已经开始拆分传输的调用仍然由 writeFragment 写完
+		if c.pending.removeCall(call) {
+			call.Error = ErrDraining
+			call.done()
+		}
+		return
+	}
+	if !call.deadline.IsZero() && !time.Now().Before(call.deadline) {
+		// 在队列中等待期间已经过期，Go 发起的调用没有调用方在等待 ctx
+		if c.pending.removeCall(call) {
+			call.Error = context.DeadlineExceeded
+			call.done()
+		}
+		return
+	}
+	// 持有 call.writing 直到编码完成，调用结束时会等待它，保证调用返回之后不再读取 Args
+	call.writing.Lock()
+	if !c.pending.has(call) {
+		call.writing.Unlock()
+		return
+	}
+	c.setWriteDeadline(call)
+	c.request.Seq = call.seq
+	c.request.ServiceMethod = call.ServiceMethod
+	c.request.Metadata = call.metadata
+	cc, chunked := c.codec.(chunkedCodec)
+	chunked = chunked && cc.Chunking()
+	if sink, ok := call.Reply.(codec.BodySink); ok && chunked {
+		cc.SetSink(call.seq, sink.BodyWriter())
+	}
+	var written int64
+	if c.conn != nil {
+		written = c.conn.BytesWritten()
+	}
+	err := c.codec.WriteRequest(&c.request, call.Args)
+	var sent codec.MessageSize
+	if r, ok := c.codec.(codec.SizeReporter); ok {
+		sent = r.LastWriteSize()
+	} else if c.conn != nil {
+		sent = codec.UnknownSize(c.conn.BytesWritten() - written)
+	}
+	call.writing.Unlock()
+	if err != nil {
+		if c.buf.err != nil {
+			// 写入连接失败，不只是 call 的参数无法编码
+			c.unflushed = append(c.unflushed, call)
+			c.fail(c.buf.err)
+			return
+		}
+		if c.pending.removeCall(call) {
+			call.sent = sent
+			call.Error = err
+			call.done()
+		}
+		return
+	}
+	// call 已经在 pending 中，recv 可能同时在结束它
+	c.pending.addSent(call, sent)
+	c.unflushed = append(c.unflushed, call)
+	if chunked && cc.Pending(call.seq) {
+		// 剩余的 fragment 由发送 goroutine 写入
+		c.transfers = append(c.transfers, call)
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// setWriteDeadline 在写入 call 之前设置连接的写入期限，调用方持有 writeMu。同一批写入（直到 flush）使用其中
+// 最晚的期限，有不限制的调用时不限制，所以一个调用的期限不会使同一批中期限更长的调用失败
+func (c *Client) setWriteDeadline(call *Call) {
+	if c.deadliner == nil {
+		return
+	}
+	d := call.deadline
+	if d.IsZero() && c.writeTimeout > 0 {
+		d = time.Now().Add(c.writeTimeout)
+	}
+	if len(c.unflushed) > 0 && (c.writeDeadline.IsZero() || (!d.IsZero() && d.Before(c.writeDeadline))) {
+		return
+	}
+	if d.IsZero() && c.writeDeadline.IsZero() {
+		return
+	}
+	c.writeDeadline = d
+	c.deadliner.SetWriteDeadline(d)
+}
+
+// flush 将缓冲中的请求写入连接，调用方持有 writeMu
+func (c *Client) flush() {
+	if c.writeErr != nil {
+		return
+	}
+	if err := c.buf.Flush(); err != nil {
+		c.fail(err)
+		return
+	}
+	c.unflushed = c.unflushed[:0]
+}
+
+// fail 写入连接失败，以写入的错误结束还没有写入连接的调用，并关闭连接，recv 退出时结束其余的调用
+func (c *Client) fail(err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = &writeTimeoutError{err: err}
+	}
+	c.writeErr = &connLostError{err: err}
+	if atomic.LoadInt32(&c.closing) == 1 {
+		c.writeErr = ErrShutdown
+	}
+	for _, call := range c.unflushed {
+		if c.pending.removeCall(call) {
+			call.Error = c.writeErr
+			call.done()
+		}
+	}
+	c.unflushed = nil
+	c.closeCodec()
+}
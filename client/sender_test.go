@@ -0,0 +1,281 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+var errWrite = errors.New("write failed")
+
+// stuckConn 写入阻塞到 unblock 关闭，然后返回 errWrite；读取阻塞到 Close
+type stuckConn struct {
+	writing chan struct{} // 第一次写入时关闭
+	unblock chan struct{}
+	closed  chan struct{}
+}
+
+func newStuckConn() *stuckConn {
+	return &stuckConn{writing: make(chan struct{}), unblock: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *stuckConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.writing:
+	default:
+		close(c.writing)
+	}
+	<-c.unblock
+	return 0, errWrite
+}
+
+func (c *stuckConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *stuckConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+// TestSendQueue 队列已满时调用等待 ctx，写入失败的错误返回给写入的调用，排在后面的调用立即失败
+func TestSendQueue(t *testing.T) {
+	conn := newStuckConn()
+	cli := NewClient(conn, "stuck", WithSendQueue(1))
+	defer cli.Close()
+
+	arg, reply := 1, 0
+	// 队列为空时调用方直接写入，阻塞在写入连接上
+	firstDone := make(chan *Call, 1)
+	go cli.Go(context.Background(), "Echo.Ping", &arg, &reply, firstDone)
+	<-conn.writing
+	// 发送 goroutine 取走第一个排队的调用后阻塞在等待写入上，第二个留在队列中
+	queued := []*Call{cli.Go(context.Background(), "Echo.Ping", &arg, &reply, nil)}
+	for cli.queued() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued = append(queued, cli.Go(context.Background(), "Echo.Ping", &arg, &reply, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cli.Call(ctx, "Echo.Ping", &arg, &reply); err != context.DeadlineExceeded {
+		t.Fatalf("Call() with full queue = %v", err)
+	}
+
+	close(conn.unblock)
+	wait := func(done chan *Call, want error) {
+		t.Helper()
+		select {
+		case call := <-done:
+			if !errors.Is(call.Error, want) || !errors.Is(call.Error, ErrConnectionLost) {
+				t.Fatalf("err = %v, want %v", call.Error, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("call not failed")
+		}
+	}
+	wait(firstDone, errWrite)
+	for _, call := range queued {
+		wait(call.Done, ErrConnectionLost)
+	}
+	if !cli.closed() {
+		t.Fatal("client usable after write error")
+	}
+}
+
+// blockingCodec WriteRequest 在编码之前通知 encoding 并等待 release
+type blockingCodec struct {
+	codec.ClientCodec
+	encoding chan struct{}
+	release  chan struct{}
+}
+
+func (c *blockingCodec) WriteRequest(h *codec.RequestHeader, body any) error {
+	c.encoding <- struct{}{}
+	<-c.release
+	return c.ClientCodec.WriteRequest(h, body)
+}
+
+// TestSendCancelWhileEncoding 调用在编码期间因为 ctx 结束时，等编码完成才返回，之后调用方可以修改参数
+func TestSendCancelWhileEncoding(t *testing.T) {
+	_, _, addr := startEcho(t, memory.New(nil), "echo", 0)
+	bc := &blockingCodec{encoding: make(chan struct{}), release: make(chan struct{})}
+	cli, err := Dial(context.Background(), "tcp", addr, WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+		bc.ClientCodec = codec.NewGobClientCodec(conn)
+		return bc
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	arg, reply := 1, 0
+	returned := make(chan error, 1)
+	go func() { returned <- cli.Call(ctx, "Echo.Ping", &arg, &reply) }()
+	<-bc.encoding
+	cancel()
+	select {
+	case err := <-returned:
+		t.Fatalf("Call() returned %v while encoding", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(bc.release)
+	if err := <-returned; err != context.Canceled {
+		t.Fatalf("Call() = %v", err)
+	}
+	arg = 2
+}
+
+// TestWriteTimeout 对端不读取时写入阻塞，调用在 deadline 或者 WithWriteTimeout 之后失败，连接被关闭
+func TestWriteTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []ClientOption
+		timeout time.Duration // 调用的 ctx 的超时时间，0 表示没有
+	}{
+		{name: "ctx deadline", timeout: 50 * time.Millisecond},
+		{name: "default write timeout", opts: []ClientOption{WithWriteTimeout(50 * time.Millisecond)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := inproc.Pipe(inproc.WithBufferSize(64))
+			defer b.Close() // b 从不读取
+			lost := make(chan error, 1)
+			cli := NewClient(a, "stalled", append(tc.opts, WithOnConnectionLost(func(err error) { lost <- err }))...)
+			defer cli.Close()
+
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			call := cli.Go(ctx, "Echo.Ping", make([]byte, 4096), new([]byte), nil)
+			select {
+			case call = <-call.Done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("call hung on a stalled connection")
+			}
+			if !errors.Is(call.Error, ErrWriteTimeout) || !errors.Is(call.Error, ErrConnectionLost) {
+				t.Fatalf("call error = %v, want ErrWriteTimeout", call.Error)
+			}
+			if d := time.Since(start); d < 40*time.Millisecond || d > time.Second {
+				t.Fatalf("call failed after %v, want about 50ms", d)
+			}
+			select {
+			case err := <-lost:
+				if !errors.Is(err, ErrConnectionLost) {
+					t.Fatalf("connection lost with %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("connection was not torn down after the write timeout")
+			}
+			if err := cli.Call(context.Background(), "Echo.Ping", 1, new(int)); err != ErrShutdown {
+				t.Fatalf("Call() after teardown = %v, want ErrShutdown", err)
+			}
+		})
+	}
+}
+
+// TestWriteExpiredCall 在发送队列中过期的调用不写入连接，不会因为写入的期限已经过去而关闭连接
+func TestWriteExpiredCall(t *testing.T) {
+	_, _, addr := startEcho(t, memory.New(nil), "Echo", 0)
+	cli, err := Dial(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// 占住 writeMu，两个调用都进入发送队列
+	cli.writeMu.Lock()
+	expired := cli.Go(ctx, "Echo.Ping", 1, new(int), nil)
+	ok := cli.Go(WithCallConfig(context.Background(), MethodConfig{Timeout: time.Second}), "Echo.Ping", 2, new(int), nil)
+	time.Sleep(50 * time.Millisecond)
+	cli.writeMu.Unlock()
+	if call := <-expired.Done; !errors.Is(call.Error, context.DeadlineExceeded) {
+		t.Fatalf("expired call error = %v, want deadline exceeded", call.Error)
+	}
+	if call := <-ok.Done; call.Error != nil {
+		t.Fatalf("call error = %v", call.Error)
+	}
+}
+
+// loopbackCodec 使用 gob 编码请求并写入连接（对端直接丢弃），每写入一个请求立即产生它的响应，
+// 用于只测量客户端的发送路径，不包括服务端的处理和网络
+type loopbackCodec struct {
+	codec.ClientCodec
+	seqs chan uint64
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *loopbackCodec) WriteRequest(h *codec.RequestHeader, body any) error {
+	if err := c.ClientCodec.WriteRequest(h, body); err != nil {
+		return err
+	}
+	c.seqs <- h.Seq
+	return nil
+}
+
+func (c *loopbackCodec) ReadResponseHeader(h *codec.ResponseHeader) error {
+	select {
+	case seq := <-c.seqs:
+		h.Seq = seq
+		return nil
+	case <-c.done:
+		return io.EOF
+	}
+}
+
+func (c *loopbackCodec) ReadResponseBody(any) error {
+	return nil
+}
+
+func (c *loopbackCodec) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.ClientCodec.Close()
+}
+
+// BenchmarkSender 多个 goroutine 通过同一个连接发起调用，只测量请求的编码、写入和调用的分发。
+//
+// before 为使用发送 goroutine 之前（每个调用方加锁后直接写入连接，每个请求 flush 一次），after 为合并写入之后，
+// -cpu 8 -count 4 的中位数。运行的机器只有 1 个 CPU，after 的提升主要来自合并 flush，多核下调用方争抢
+// 写锁的差异需要在多核机器上重新运行：
+//
+//	callers     1          8          64         512
+//	before      6.18 µs    6.63 µs    6.38 µs    7.16 µs
+//	after       5.90 µs    5.90 µs    5.26 µs    4.08 µs
+func BenchmarkSender(b *testing.B) {
+	for _, callers := range callerCounts {
+		b.Run("callers="+strconv.Itoa(callers), func(b *testing.B) {
+			c, s := net.Pipe()
+			go io.Copy(io.Discard, s)
+			cli := NewClient(c, "loopback", WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+				return &loopbackCodec{ClientCodec: codec.NewGobClientCodec(conn), seqs: make(chan uint64, 4096), done: make(chan struct{})}
+			}))
+			defer cli.Close()
+			runCallers(b, callers, func() {
+				arg, reply := 1, 0
+				if err := cli.Call(context.Background(), "Echo.Ping", &arg, &reply); err != nil {
+					b.Error(err)
+				}
+			})
+		})
+	}
+}
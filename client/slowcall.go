@@ -0,0 +1,95 @@
+package client
+
+import (
+	"log"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/internal/slowcall"
+)
+
+// SlowCall 一次耗时超过阈值的调用
+type SlowCall struct {
+	ServiceMethod string
+	Addr          string // 服务端的地址
+	Seq           uint64
+	RequestID     string
+	Elapsed       time.Duration // 从发起调用到结束的时间，包括在准入控制中等待的时间
+	Threshold     time.Duration
+	Err           error
+}
+
+// slowConfig 慢调用检测的配置，NewClient 时据此创建 slowcall.Detector
+type slowConfig struct {
+	threshold time.Duration
+	methods   map[string]time.Duration
+	logLimit  int
+	handler   func(SlowCall)
+}
+
+// WithSlowCallThreshold 耗时超过 d 的调用会被记录到日志中，包括方法、服务端地址、seq、request id 和耗时。
+// 日志的数量受 WithSlowCallLogLimit 限制
+func WithSlowCallThreshold(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.slow.threshold = d
+	}
+}
+
+// WithMethodSlowCallThreshold 为 serviceMethod 单独指定阈值，覆盖 WithSlowCallThreshold，
+// d <= 0 时不检测该方法，用于本来就很慢的方法
+func WithMethodSlowCallThreshold(serviceMethod string, d time.Duration) ClientOption {
+	return func(c *Client) {
+		if c.slow.methods == nil {
+			c.slow.methods = make(map[string]time.Duration)
+		}
+		c.slow.methods[serviceMethod] = d
+	}
+}
+
+// WithSlowCallLogLimit 每秒最多输出 n 条慢调用日志，超出的日志被丢弃，丢弃的数量会在下一条日志中给出。
+// 默认为 10
+func WithSlowCallLogLimit(n int) ClientOption {
+	return func(c *Client) {
+		c.slow.logLimit = n
+	}
+}
+
+// WithSlowCallHandler 使用 f 代替日志处理慢调用，比如发送到告警系统。每个慢调用都会调用 f，不受
+// WithSlowCallLogLimit 限制，f 可能在接收响应的 goroutine 中调用，不能阻塞
+func WithSlowCallHandler(f func(SlowCall)) ClientOption {
+	return func(c *Client) {
+		c.slow.handler = f
+	}
+}
+
+// newDetector 没有设置任何阈值时返回 nil
+func (s *slowConfig) newDetector() *slowcall.Detector {
+	if s.threshold <= 0 && len(s.methods) == 0 {
+		return nil
+	}
+	return slowcall.New(s.threshold, s.methods, s.logLimit)
+}
+
+// checkSlow 调用结束时检查是否为慢调用
+func (c *Client) checkSlow(call *Call, end time.Time, err error) {
+	elapsed := end.Sub(call.start)
+	slow, threshold := c.slowDetector.Slow(call.ServiceMethod, elapsed)
+	if !slow {
+		return
+	}
+	sc := SlowCall{ServiceMethod: call.ServiceMethod, Addr: c.serverAddr, Seq: call.seq, RequestID: call.RequestID,
+		Elapsed: elapsed, Threshold: threshold, Err: err}
+	if c.slow.handler != nil {
+		c.slow.handler(sc)
+		return
+	}
+	ok, dropped := c.slowDetector.Allow(end)
+	if !ok {
+		return
+	}
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	log.Printf("rpc: slow call method=%v addr=%v seq=%v request_id=%v elapsed=%v threshold=%v error=%q suppressed=%d\n",
+		sc.ServiceMethod, sc.Addr, sc.Seq, sc.RequestID, sc.Elapsed, sc.Threshold, errMsg, dropped)
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+func TestSlowCall(t *testing.T) {
+	_, _, addr := startEcho(t, memory.New(nil), "echo", 30*time.Millisecond)
+	slow := make(chan SlowCall, 4)
+	cli, err := Dial(context.Background(), "tcp", addr, WithSlowCallThreshold(10*time.Millisecond),
+		WithSlowCallHandler(func(sc SlowCall) { slow <- sc }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	var reply int
+	ctx := WithRequestID(context.Background(), "slow-1")
+	if err := cli.Call(ctx, "Echo.Ping", new(int), &reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sc := <-slow:
+		if sc.ServiceMethod != "Echo.Ping" || sc.Addr != addr || sc.RequestID != "slow-1" ||
+			sc.Elapsed < 30*time.Millisecond || sc.Threshold != 10*time.Millisecond || sc.Err != nil {
+			t.Fatalf("slow call %+v", sc)
+		}
+	default:
+		t.Fatal("no slow call")
+	}
+}
+
+func TestSlowCallMethodThreshold(t *testing.T) {
+	_, _, addr := startEcho(t, memory.New(nil), "echo", 30*time.Millisecond)
+	slow := make(chan SlowCall, 4)
+	cli, err := Dial(context.Background(), "tcp", addr, WithSlowCallThreshold(10*time.Millisecond),
+		WithMethodSlowCallThreshold("Echo.Ping", time.Minute), WithSlowCallHandler(func(sc SlowCall) { slow <- sc }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	var reply int
+	if err := cli.Call(context.Background(), "Echo.Ping", new(int), &reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sc := <-slow:
+		t.Fatalf("unexpected slow call %+v", sc)
+	default:
+	}
+}
+
+// TestSlowCallLogLimit 超过每秒的日志数量后不再输出
+func TestSlowCallLogLimit(t *testing.T) {
+	_, _, addr := startEcho(t, memory.New(nil), "echo", 30*time.Millisecond)
+	var (
+		mu   sync.Mutex
+		logs bytes.Buffer
+	)
+	log.SetOutput(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return logs.Write(p)
+	}))
+	defer log.SetOutput(os.Stderr)
+	cli, err := Dial(context.Background(), "tcp", addr, WithSlowCallThreshold(10*time.Millisecond), WithSlowCallLogLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			if err := cli.Call(context.Background(), "Echo.Ping", new(int), &reply); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if n := strings.Count(logs.String(), "rpc: slow call method=Echo.Ping"); n != 1 {
+		t.Fatalf("%d slow call logs:\n%s", n, logs.String())
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// CallStats 一次调用的统计
+type CallStats struct {
+	ServiceMethod string
+	RequestID     string
+	Start         time.Time         // 发起调用的时间
+	End           time.Time         // 调用结束的时间
+	Sent          codec.MessageSize // 请求的 header 和 body 各自的大小，没有发送时为零值
+	Received      codec.MessageSize // 响应的大小，没有收到响应（超时、连接断开等）时为零值
+	Err           error
+	Config        MethodConfig // 调用生效的配置，见 MethodConfigStore
+}
+
+// StatsHandler 客户端调用的统计回调，比如 metrics
+type StatsHandler interface {
+	// HandleRPC 在调用结束时调用，每个调用只调用一次。Go 发起的调用在 call 被发送到 Done 之前调用，
+	// 可能在接收响应的 goroutine 中，不能阻塞
+	HandleRPC(stats *CallStats)
+}
+
+// WithStatsHandler 添加调用的统计回调
+func WithStatsHandler(h StatsHandler) ClientOption {
+	return func(c *Client) {
+		c.statsHandlers = append(c.statsHandlers, h)
+	}
+}
+
+// MethodStats 一个方法的累计统计
+type MethodStats struct {
+	Calls         uint64 // 结束的调用数量，包括失败的调用
+	BytesSent     int64  // 所有请求在连接上的大小
+	BytesReceived int64  // 所有响应在连接上的大小
+}
+
+type methodCounter struct {
+	calls         uint64 // 原子操作
+	bytesSent     int64  // 原子操作
+	bytesReceived int64  // 原子操作
+}
+
+// record 在调用结束时更新方法的统计，检查是否为慢调用，并调用 StatsHandler
+func (c *Client) record(call *Call, err error) {
+	v, ok := c.methods.Load(call.ServiceMethod)
+	if !ok {
+		v, _ = c.methods.LoadOrStore(call.ServiceMethod, new(methodCounter))
+	}
+	m := v.(*methodCounter)
+	atomic.AddUint64(&m.calls, 1)
+	atomic.AddInt64(&m.bytesSent, call.sent.Total())
+	atomic.AddInt64(&m.bytesReceived, call.received.Total())
+
+	if len(c.statsHandlers) == 0 && c.slowDetector == nil {
+		return
+	}
+	end := time.Now()
+	if c.slowDetector != nil {
+		c.checkSlow(call, end, err)
+	}
+	if len(c.statsHandlers) == 0 {
+		return
+	}
+	stats := &CallStats{
+		ServiceMethod: call.ServiceMethod,
+		RequestID:     call.RequestID,
+		Start:         call.start,
+		End:           end,
+		Sent:          call.sent,
+		Received:      call.received,
+		Err:           err,
+		Config:        call.Config,
+	}
+	for _, h := range c.statsHandlers {
+		h.HandleRPC(stats)
+	}
+}
+
+func (c *Client) methodStats() map[string]MethodStats {
+	stats := make(map[string]MethodStats)
+	c.methods.Range(func(k, v any) bool {
+		m := v.(*methodCounter)
+		stats[k.(string)] = MethodStats{
+			Calls:         atomic.LoadUint64(&m.calls),
+			BytesSent:     atomic.LoadInt64(&m.bytesSent),
+			BytesReceived: atomic.LoadInt64(&m.bytesReceived),
+		}
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+// WithConnsPerAddr Pool 到每个实例建立 n 个连接（默认为 1），每次调用使用其中正在进行的调用最少的一个，
+// 数量相同时轮流使用。单个连接只有一个接收 goroutine 和一个发送 goroutine，并且受到 TCP 单个连接的
+// 窗口限制，大请求较多、一个连接跑不满带宽时可以增加 n，效果见 BenchmarkPoolStriping。
+//
+// 每个连接的 seq 相互独立，一个连接断开只影响在它上面的调用，之后的调用使用其他连接，断开的连接在后台重新建立。
+// n <= 0 时使用 1。每个连接的统计见 PoolStats.Conns
+func WithConnsPerAddr(n int) PoolOption {
+	return func(p *Pool) {
+		if n > 0 {
+			p.conns = n
+		}
+	}
+}
+
+// connKey Pool 中一个连接的 key，stripe 为到同一个地址的第几个连接
+type connKey struct {
+	addr   string
+	stripe int
+}
+
+// pickConn 从到 addr 的可用连接中选择正在进行的调用最少的一个，从轮转的位置开始比较。没有可用的连接时
+// key 为需要建立的连接，draining 表示实例正在关闭（有连接收到了 GOAWAY），不应该再建立连接。调用方持有 p.mu
+func (p *Pool) pickConn(addr string) (cli *Client, key connKey, draining bool) {
+	start := p.next % p.conns
+	p.next++
+	var min int64
+	missing := -1
+	for i := 0; i < p.conns; i++ {
+		k := connKey{addr, (start + i) % p.conns}
+		c, ok := p.clients[k]
+		switch {
+		case !ok || c.closed():
+			if missing < 0 {
+				missing = k.stripe
+			}
+		case c.State() == ConnDraining:
+			draining = true
+		default:
+			if n := atomic.LoadInt64(&c.striped); cli == nil || n < min {
+				cli, min = c, n
+			}
+		}
+	}
+	if cli == nil && missing >= 0 {
+		key = connKey{addr, missing}
+	}
+	return cli, key, draining
+}
+
+// missingConns 返回到 addr 的需要在后台建立的连接（skip 为 true 时不包括 except），并标记为正在建立。
+// 调用方持有 p.mu
+func (p *Pool) missingConns(addr string, skip bool, except connKey) []connKey {
+	var keys []connKey
+	for stripe := 0; stripe < p.conns; stripe++ {
+		k := connKey{addr, stripe}
+		if c, ok := p.clients[k]; (ok && !c.closed()) || p.dialing[k] || (skip && k == except) {
+			continue
+		}
+		p.dialing[k] = true
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// redial 在后台建立 key 对应的连接，调用不需要等待它
+func (p *Pool) redial(key connKey) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout)
+	defer cancel()
+	if _, err := p.connect(ctx, key); err != nil && err != ErrShutdown {
+		log.Printf("rpc: pool %v connect %v (conn %d) error: %v\n", p.serviceName, key.addr, key.stripe, err)
+	}
+	p.mu.Lock()
+	delete(p.dialing, key)
+	p.mu.Unlock()
+}
+
+// PoolConnStats Pool 中一个连接的统计，可以用来观察调用在连接之间是否均衡
+type PoolConnStats struct {
+	Addr          string
+	Stripe        int // 到同一个地址的第几个连接，从 0 开始，见 WithConnsPerAddr
+	State         ConnState
+	InFlight      int    // 正在进行的调用数量
+	Calls         uint64 // 在这个连接上结束的调用数量，包括失败的调用
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// connStats 返回 Pool 中每个连接的统计
+func (p *Pool) connStats() []PoolConnStats {
+	p.mu.Lock()
+	clients := make(map[connKey]*Client, len(p.clients))
+	for k, c := range p.clients {
+		clients[k] = c
+	}
+	p.mu.Unlock()
+	stats := make([]PoolConnStats, 0, len(clients))
+	for k, c := range clients {
+		s := PoolConnStats{Addr: k.addr, Stripe: k.stripe, State: c.State(), InFlight: c.pending.len()}
+		for _, m := range c.methodStats() {
+			s.Calls += m.Calls
+			s.BytesSent += m.BytesSent
+			s.BytesReceived += m.BytesReceived
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Addr != stats[j].Addr {
+			return stats[i].Addr < stats[j].Addr
+		}
+		return stats[i].Stripe < stats[j].Stripe
+	})
+	return stats
+}
@@ -0,0 +1,253 @@
+// Package vcr 录制和重放客户端的调用，用于调用了其他 appleseed 服务的代码的测试：先通过 Record 对真实的服务
+// 发起调用，把每次调用的方法、参数、结果和错误写入文件，之后的测试通过 Replay 直接返回录制的结果，不需要启动依赖的服务：
+//
+//	// 录制，caller 为 *client.Client、*client.Pool 等
+//	var c client.Caller = vcr.Record(t, caller, "testdata/orders.json")
+//	// 重放
+//	var c client.Caller = vcr.Replay(t, "testdata/orders.json")
+//
+// 文件为 JSON，参数和结果以 base64 保存。参数使用 encoding/json 编码，同样的参数在不同的进程中编码的结果相同
+// （gob 编码中的类型 id 和进程中类型第一次被编码的顺序有关），重放时按照编码后的结果匹配；结果使用 gob 编码，
+// 和在连接上传输时一样保留完整的类型
+package vcr
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+var (
+	_ client.Caller = &Recorder{}
+	_ client.Caller = &Replayer{}
+)
+
+// ErrNoRecording 重放时没有匹配的录制，调用返回它，测试同时失败
+var ErrNoRecording = errors.New("vcr: no matching recording")
+
+// Version 文件格式的版本
+const Version = 1
+
+// Cassette 一个录制文件的内容
+type Cassette struct {
+	Version      int            `json:"version"`
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction 一次调用的录制
+type Interaction struct {
+	Method string `json:"method"`          // "Service.Method"
+	Args   []byte `json:"args"`            // encoding/json 编码后的参数
+	Reply  []byte `json:"reply,omitempty"` // gob 编码后的结果，调用失败时为空
+	Error  *Error `json:"error,omitempty"`
+}
+
+// Error 调用返回的错误，重放时返回 *status.Status。不是服务端返回的错误（比如连接断开）时 Code 为 status.CodeOf(err)
+type Error struct {
+	Code    status.Code       `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e *Error) err() error {
+	return status.New(e.Code, e.Message).WithDetails(e.Details)
+}
+
+// encodeArgs 返回参数的 json 编码，map 的 key 是排序后的，所以结果是确定的
+func encodeArgs(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// encode 返回 v 的 gob 编码
+func encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Recorder 通过 next 发起调用并录制每次调用，测试结束时写入文件
+type Recorder struct {
+	t    testing.TB
+	next client.Caller
+	path string
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// Record 返回通过 next 发起调用的 Recorder，t 结束时按照调用结束的顺序将所有的调用写入 path（覆盖原有的文件），
+// 目录不存在时创建目录。参数或者结果无法编码时这次调用不被录制，t 失败
+func Record(t testing.TB, next client.Caller, path string) *Recorder {
+	r := &Recorder{t: t, next: next, path: path, cassette: Cassette{Version: Version}}
+	t.Cleanup(func() {
+		if err := r.Save(); err != nil {
+			t.Errorf("vcr: %v", err)
+		}
+	})
+	return r
+}
+
+func (r *Recorder) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	args, argErr := encodeArgs(arg)
+	err := r.next.Call(ctx, serviceMethod, arg, reply)
+	if argErr != nil {
+		r.t.Errorf("vcr: encode args of %s: %v", serviceMethod, argErr)
+		return err
+	}
+	in := &Interaction{Method: serviceMethod, Args: args}
+	if err != nil {
+		s := status.Convert(err)
+		in.Error = &Error{Code: s.Code(), Message: s.Message(), Details: s.Details()}
+	} else if b, replyErr := encode(reply); replyErr != nil {
+		r.t.Errorf("vcr: encode reply of %s: %v", serviceMethod, replyErr)
+		return err
+	} else {
+		in.Reply = b
+	}
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, in)
+	r.mu.Unlock()
+	return err
+}
+
+// Save 将已经录制的调用写入文件，Record 会在测试结束时调用它
+func (r *Recorder) Save() error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(&r.cassette, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, append(data, '\n'), 0o644)
+}
+
+// Matcher 判断调用是否匹配录制的调用，args 为调用的参数 json 编码后的结果
+type Matcher func(in *Interaction, serviceMethod string, args []byte) bool
+
+// MatchMethodAndArgs 默认的 Matcher，方法和参数编码后的结果都相同时匹配
+func MatchMethodAndArgs(in *Interaction, serviceMethod string, args []byte) bool {
+	return in.Method == serviceMethod && bytes.Equal(in.Args, args)
+}
+
+// MatchMethod 只比较方法，可以用于参数中有时间戳、随机 id 等每次都不同的字段的调用
+func MatchMethod(in *Interaction, serviceMethod string, args []byte) bool {
+	return in.Method == serviceMethod
+}
+
+// Option 用于配置 Replayer
+type Option func(*Replayer)
+
+// WithMatcher 使用 m 代替 MatchMethodAndArgs 匹配录制的调用
+func WithMatcher(m Matcher) Option {
+	return func(r *Replayer) {
+		r.match = m
+	}
+}
+
+// WithUnordered 调用可以按照任意顺序发生，每次调用使用第一个还没有使用过的匹配的录制。
+// 默认每次调用必须匹配下一个录制，用于检查调用的顺序
+func WithUnordered() Option {
+	return func(r *Replayer) {
+		r.unordered = true
+	}
+}
+
+// Replayer 返回录制的结果，不发起网络请求
+type Replayer struct {
+	t         testing.TB
+	path      string
+	match     Matcher
+	unordered bool
+
+	mu           sync.Mutex
+	interactions []*Interaction
+	used         []bool
+	next         int // 顺序匹配时下一个录制的下标
+}
+
+// Replay 读取 path 中的录制并返回 Replayer，文件不存在或者格式错误时 t 立即失败。
+// 调用没有匹配的录制时 t 失败，并且调用返回 ErrNoRecording
+func Replay(t testing.TB, path string, opts ...Option) *Replayer {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("vcr: %v", err)
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("vcr: parse %s: %v", path, err)
+	}
+	if c.Version != Version {
+		t.Fatalf("vcr: %s has version %d, want %d", path, c.Version, Version)
+	}
+	r := &Replayer{t: t, path: path, match: MatchMethodAndArgs, interactions: c.Interactions, used: make([]bool, len(c.Interactions))}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *Replayer) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	args, err := encodeArgs(arg)
+	if err != nil {
+		return fmt.Errorf("vcr: encode args of %s: %w", serviceMethod, err)
+	}
+	in := r.find(serviceMethod, args)
+	if in == nil {
+		r.t.Errorf("vcr: no recording in %s matches call %s (args %d bytes)", r.path, serviceMethod, len(args))
+		return ErrNoRecording
+	}
+	if in.Error != nil {
+		return in.Error.err()
+	}
+	return gob.NewDecoder(bytes.NewReader(in.Reply)).Decode(reply)
+}
+
+// find 返回匹配的录制并标记为已经使用，没有时返回 nil
+func (r *Replayer) find(serviceMethod string, args []byte) *Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.unordered {
+		if r.next >= len(r.interactions) || !r.match(r.interactions[r.next], serviceMethod, args) {
+			return nil
+		}
+		r.used[r.next] = true
+		r.next++
+		return r.interactions[r.next-1]
+	}
+	for i, in := range r.interactions {
+		if !r.used[i] && r.match(in, serviceMethod, args) {
+			r.used[i] = true
+			return in
+		}
+	}
+	return nil
+}
+
+// Unused 返回还没有被使用的录制，可以在测试结束前检查是否所有录制的调用都发生了
+func (r *Replayer) Unused() []*Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []*Interaction
+	for i, in := range r.interactions {
+		if !r.used[i] {
+			unused = append(unused, in)
+		}
+	}
+	return unused
+}
@@ -0,0 +1,158 @@
+package vcr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+type OrderArgs struct {
+	ID    int
+	Items map[string]int
+}
+
+type Order struct {
+	ID    int
+	Total int
+}
+
+type Orders struct{}
+
+func (o *Orders) Get(args *OrderArgs, reply *Order) error {
+	if args.ID == 0 {
+		return status.New(status.NotFound, "no such order")
+	}
+	*reply = Order{ID: args.ID}
+	for _, n := range args.Items {
+		reply.Total += n
+	}
+	return nil
+}
+
+// startOrders 启动进程内的 Orders 服务，返回连接到它的 Client 和关闭服务的函数
+func startOrders(t *testing.T) (*client.Client, func()) {
+	t.Helper()
+	s, err := appleseed.NewServer(context.Background(), "orders", "127.0.0.1", "0", memory.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(Orders)); err != nil {
+		t.Fatal(err)
+	}
+	lis := inproc.Listen("orders")
+	go s.Serve(lis)
+	conn, err := lis.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := client.NewClient(conn, "orders")
+	return cli, func() {
+		cli.Close()
+		s.Shutdown(context.Background())
+	}
+}
+
+// getOrders 被测试的代码：依次查询几个订单
+func getOrders(c client.Caller) ([]Order, error) {
+	var orders []Order
+	for _, args := range []*OrderArgs{
+		{ID: 1, Items: map[string]int{"a": 1, "b": 2, "c": 3}},
+		{ID: 2, Items: map[string]int{"d": 10}},
+		{ID: 0},
+	} {
+		var o Order
+		if err := c.Call(context.Background(), "Orders.Get", args, &o); err != nil {
+			return orders, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, nil
+}
+
+func checkOrders(t *testing.T, orders []Order, err error) {
+	t.Helper()
+	if want := []Order{{ID: 1, Total: 6}, {ID: 2, Total: 10}}; fmt.Sprint(orders) != fmt.Sprint(want) {
+		t.Fatalf("orders = %v, want %v", orders, want)
+	}
+	if status.CodeOf(err) != status.NotFound || !strings.HasPrefix(err.Error(), "no such order") {
+		t.Fatalf("err = %v, want NotFound", err)
+	}
+}
+
+// TestRecordReplay 对进程内的服务录制，关闭服务之后重放
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.json")
+	t.Run("record", func(t *testing.T) {
+		cli, stop := startOrders(t)
+		defer stop()
+		orders, err := getOrders(Record(t, cli, path))
+		checkOrders(t, orders, err)
+	})
+	t.Run("replay", func(t *testing.T) {
+		r := Replay(t, path)
+		orders, err := getOrders(r)
+		checkOrders(t, orders, err)
+		if unused := r.Unused(); len(unused) != 0 {
+			t.Fatalf("%d recordings unused", len(unused))
+		}
+	})
+}
+
+// TestReplayGolden 重放仓库中的录制文件，录制文件的格式和参数的编码在不同的进程之间保持不变
+func TestReplayGolden(t *testing.T) {
+	orders, err := getOrders(Replay(t, "testdata/orders.json"))
+	checkOrders(t, orders, err)
+}
+
+// recordingT 记录测试失败而不是真的失败
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestReplayOrder(t *testing.T) {
+	first := &OrderArgs{ID: 2, Items: map[string]int{"d": 10}}
+	call := func(c client.Caller, args *OrderArgs) error {
+		return c.Call(context.Background(), "Orders.Get", args, new(Order))
+	}
+
+	// 顺序匹配时第二个录制不能先被使用
+	rt := &recordingT{TB: t}
+	r := Replay(rt, "testdata/orders.json")
+	if err := call(r, first); !errors.Is(err, ErrNoRecording) || len(rt.errors) != 1 {
+		t.Fatalf("out of order call = %v, test errors %q", err, rt.errors)
+	}
+
+	// 不要求顺序时可以，并且每个录制只使用一次
+	rt = &recordingT{TB: t}
+	r = Replay(rt, "testdata/orders.json", WithUnordered())
+	if err := call(r, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(r, first); !errors.Is(err, ErrNoRecording) || len(rt.errors) != 1 {
+		t.Fatalf("second call = %v, test errors %q", err, rt.errors)
+	}
+	if n := len(r.Unused()); n != 2 {
+		t.Fatalf("%d recordings unused, want 2", n)
+	}
+
+	// 自定义的 Matcher
+	rt = &recordingT{TB: t}
+	r = Replay(rt, "testdata/orders.json", WithMatcher(MatchMethod))
+	if err := call(r, &OrderArgs{ID: 42}); err != nil || len(rt.errors) != 0 {
+		t.Fatalf("call with MatchMethod = %v, test errors %q", err, rt.errors)
+	}
+}
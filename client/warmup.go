@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// minIdleInterval WithMinIdle 检查并补充连接的间隔
+const minIdleInterval = time.Second
+
+// WarmupResult Warmup 中一个实例的结果
+type WarmupResult struct {
+	Addr    string
+	Err     error         // 建立连接或者检查失败的原因，失败的连接不会留在 Pool 中
+	Latency time.Duration // 建立连接以及检查的耗时
+	Reused  bool          // 连接在 Warmup 之前已经存在
+}
+
+// WarmupOption 用于配置 Warmup
+type WarmupOption func(*warmupOptions)
+
+type warmupOptions struct {
+	check func(ctx context.Context, cli *Client) error
+}
+
+// WithWarmupCheck 建立连接后使用 f 检查连接是否可用（比如调用一次健康检查方法），同时完成第一次调用才会
+// 发生的开销（比如 gob 发送类型信息），f 返回错误时关闭该连接。已经存在的连接同样会检查
+func WithWarmupCheck(f func(ctx context.Context, cli *Client) error) WarmupOption {
+	return func(o *warmupOptions) {
+		o.check = f
+	}
+}
+
+// WithMinIdle NewPool 之后在后台预热 n 个实例的连接（见 Warmup），并且每隔一秒检查一次，连接断开或者实例变化后
+// 重新补充到 n 个，使服务扩容或者连接断开后的第一次调用不需要等待建立连接。n <= 0 时不预热
+func WithMinIdle(n int) PoolOption {
+	return func(p *Pool) {
+		p.minIdle = n
+	}
+}
+
+// Warmup 提前建立到负载均衡器中 n 个实例的连接（n <= 0 时为所有实例），已经建立的连接直接复用，返回每个实例的结果。
+// 实例来自负载均衡器而不是注册中心，所以 WithSubset 之外的实例不会被预热。
+//
+// 预热失败不影响之后的调用，调用时会像没有预热一样重新建立连接，所以通常只需要记录失败的结果。
+// 只有 Pool 已经关闭时返回错误
+func (p *Pool) Warmup(ctx context.Context, n int, opts ...WarmupOption) ([]WarmupResult, error) {
+	var o warmupOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil, ErrShutdown
+	}
+	addrs := p.lb.Addrs()
+	if n > 0 && len(addrs) > n {
+		addrs = addrs[:n]
+	}
+
+	results := make([]WarmupResult, len(addrs))
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, defaultBroadcastParallelism)
+	)
+	for i, addr := range addrs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *WarmupResult, addr string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r.Addr = addr
+			start := time.Now()
+			r.Reused = p.pooled(addr) != nil
+			r.Err = p.warm(ctx, addr, o.check)
+			r.Latency = time.Since(start)
+		}(&results[i], addr)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// pooled 返回 Pool 中到 addr 的一个可用连接，没有时返回 nil
+func (p *Pool) pooled(addr string) *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for stripe := 0; stripe < p.conns; stripe++ {
+		if cli, ok := p.clients[connKey{addr, stripe}]; ok && !cli.closed() {
+			return cli
+		}
+	}
+	return nil
+}
+
+// warm 建立到 addr 的连接并使用 check 检查，检查失败时从 Pool 中移除并关闭该连接
+func (p *Pool) warm(ctx context.Context, addr string, check func(ctx context.Context, cli *Client) error) error {
+	cli, err := p.client(ctx, addr)
+	if err != nil || check == nil {
+		return err
+	}
+	if err := check(ctx, cli); err != nil {
+		p.mu.Lock()
+		for stripe := 0; stripe < p.conns; stripe++ {
+			if key := (connKey{addr, stripe}); p.clients[key] == cli {
+				delete(p.clients, key)
+			}
+		}
+		p.mu.Unlock()
+		cli.Close()
+		return err
+	}
+	return nil
+}
+
+// keepWarm WithMinIdle 的后台任务，直到 ctx 结束
+func (p *Pool) keepWarm(ctx context.Context) {
+	defer close(p.idleDone)
+	ticker := time.NewTicker(minIdleInterval)
+	defer ticker.Stop()
+	for {
+		results, err := p.Warmup(ctx, p.minIdle)
+		if err != nil {
+			return
+		}
+		for _, r := range results {
+			if r.Err != nil && ctx.Err() == nil {
+				log.Printf("rpc: pool %v warm up %v error: %v\n", p.serviceName, r.Addr, r.Err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+// slowHandshake 转发到 target 的代理，每个新连接在转发第一个字节之前等待 delay，模拟 TLS 等握手的开销
+func slowHandshake(t *testing.T, target string, delay time.Duration) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				time.Sleep(delay)
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func ping(ctx context.Context, cli *Client) error {
+	var reply int
+	return cli.Call(ctx, "Echo.Ping", new(int), &reply)
+}
+
+// firstCall 新建一个 Pool，warm 为 true 时先预热，返回第一次调用的耗时
+func firstCall(t *testing.T, reg *memory.Registry, warm bool) time.Duration {
+	t.Helper()
+	ctx := context.Background()
+	pool, err := NewPool(ctx, reg, "warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if warm {
+		results, err := pool.Warmup(ctx, 0, WithWarmupCheck(ping))
+		if err != nil || len(results) != 1 || results[0].Err != nil || results[0].Reused {
+			t.Fatalf("Warmup() = %+v, %v", results, err)
+		}
+	}
+	start := time.Now()
+	var reply int
+	if err := pool.Call(ctx, "Echo.Ping", new(int), &reply); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestWarmupFirstCallLatency(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	reg := memory.New(nil)
+	_, _, addr := startEcho(t, reg, "echo", 0)
+	if _, err := reg.RegisterInstance(context.Background(), "warm", registry.Instance{Addr: slowHandshake(t, addr, delay)}); err != nil {
+		t.Fatal(err)
+	}
+
+	cold, warm := firstCall(t, reg, false), firstCall(t, reg, true)
+	t.Logf("first call: cold %v, warm %v", cold, warm)
+	if cold < delay || warm > delay/2 {
+		t.Fatalf("first call: cold %v, warm %v", cold, warm)
+	}
+}
+
+// TestWarmupFailure 预热失败的实例不会留在 Pool 中，之后的调用重新建立连接
+func TestWarmupFailure(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	_, _, addr := startEcho(t, reg, "echo", 0)
+	down := downAddr(t)
+	if _, err := reg.RegisterInstance(ctx, "echo", registry.Instance{Addr: down}); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool(ctx, reg, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	failCheck := true
+	check := func(ctx context.Context, cli *Client) error {
+		if failCheck {
+			return ErrShutdown
+		}
+		return ping(ctx, cli)
+	}
+	results, err := pool.Warmup(ctx, 0, WithWarmupCheck(check))
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Warmup() = %+v, %v", results, err)
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			t.Fatalf("%v: warm up succeeded", r.Addr)
+		}
+		if pool.pooled(r.Addr) != nil {
+			t.Fatalf("%v: failed connection pooled", r.Addr)
+		}
+	}
+
+	failCheck = false
+	results, _ = pool.Warmup(ctx, 0, WithWarmupCheck(check))
+	for _, r := range results {
+		if (r.Err == nil) != (r.Addr == addr) {
+			t.Fatalf("%v: err = %v", r.Addr, r.Err)
+		}
+	}
+	results, _ = pool.Warmup(ctx, 1)
+	if len(results) != 1 {
+		t.Fatalf("Warmup(1) = %+v", results)
+	}
+	if results[0].Addr == addr && !results[0].Reused {
+		t.Fatalf("Warmup(1) = %+v, want reused", results)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Warmup(ctx, 0); err != ErrShutdown {
+		t.Fatalf("Warmup() after Close = %v", err)
+	}
+}
+
+// TestMinIdle 后台保持连接，连接断开后重新建立
+func TestMinIdle(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	_, _, addr := startEcho(t, reg, "echo", 0)
+	pool, err := NewPool(ctx, reg, "echo", WithMinIdle(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	waitPooled := func() *Client {
+		t.Helper()
+		deadline := time.Now().Add(3 * minIdleInterval)
+		for {
+			if cli := pool.pooled(addr); cli != nil {
+				return cli
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("connection not warmed up")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cli := waitPooled()
+	cli.Close()
+	if again := waitPooled(); again == cli {
+		t.Fatal("closed connection reused")
+	}
+}
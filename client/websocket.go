@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultKeepaliveInterval = 30 * time.Second
+	defaultKeepaliveTimeout  = 90 * time.Second
+)
+
+// WSOption 用于配置 DialWebSocket
+type WSOption func(*wsOptions)
+
+type wsOptions struct {
+	header     http.Header
+	tlsConfig  *tls.Config
+	interval   time.Duration
+	timeout    time.Duration
+	clientOpts []ClientOption
+}
+
+// WithHeader 握手请求中携带的 header，比如用于鉴权的 Authorization
+func WithHeader(h http.Header) WSOption {
+	return func(o *wsOptions) {
+		o.header = h
+	}
+}
+
+// WithTLSConfig wss 使用的 tls 配置
+func WithTLSConfig(c *tls.Config) WSOption {
+	return func(o *wsOptions) {
+		o.tlsConfig = c
+	}
+}
+
+// WithKeepalive 每隔 interval 发送一次 ping，超过 timeout 没有收到任何数据（包括 pong）时认为连接已经断开
+// 并关闭 Client，interval 为 0 时不发送 ping。默认每 30s 发送一次，90s 超时
+func WithKeepalive(interval, timeout time.Duration) WSOption {
+	return func(o *wsOptions) {
+		o.interval, o.timeout = interval, timeout
+	}
+}
+
+// WithWSClientOptions 指定建立的 Client 使用的 ClientOption
+func WithWSClientOptions(opts ...ClientOption) WSOption {
+	return func(o *wsOptions) {
+		o.clientOpts = append(o.clientOpts, opts...)
+	}
+}
+
+// DialWebSocket 通过 WebSocket 连接到 rawURL（ws:// 或者 wss://），服务端为 appleseed.Server.WebSocketHandler。
+// 连接建立后和 tcp 连接的 Client 完全相同，收到服务端的 close frame 或者 keepalive 超时后 Client 关闭，
+// 正在进行的调用返回错误，Pool 会在下次调用时重新建立连接
+func DialWebSocket(ctx context.Context, rawURL string, opts ...WSOption) (*Client, error) {
+	o := wsOptions{interval: defaultKeepaliveInterval, timeout: defaultKeepaliveTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	// 浏览器之外的客户端没有 origin，使用服务端的地址
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	config, err := websocket.NewConfig(rawURL, origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Header = o.header
+	config.TlsConfig = o.tlsConfig
+
+	// WithWSClientOptions 中的 WithDialer 也用于建立 WebSocket 的 tcp 连接
+	var co Client
+	for _, opt := range o.clientOpts {
+		opt(&co)
+	}
+	conn, err := dialWS(ctx, u, o.tlsConfig, co.dialer)
+	if err != nil {
+		return nil, err
+	}
+	ac := &activityConn{Conn: conn}
+	ac.touch()
+	// 握手不支持 ctx，使用 ctx 的 deadline 作为连接的 deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	ws, err := websocket.NewClient(config, ac)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+
+	cli := NewClient(ws, rawURL, o.clientOpts...)
+	if o.interval > 0 {
+		go keepalive(cli, ws, ac, o.interval, o.timeout)
+	}
+	return cli, nil
+}
+
+func dialWS(ctx context.Context, u *url.URL, tlsConfig *tls.Config, d Dialer) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	if d == nil {
+		d = new(net.Dialer)
+	}
+	switch u.Scheme {
+	case "ws":
+		return d.DialContext(ctx, "tcp", host)
+	case "wss":
+		conn, err := d.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		c := tlsConfig.Clone()
+		if c == nil {
+			c = new(tls.Config)
+		}
+		if c.ServerName == "" {
+			c.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, c)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	default:
+		return nil, errors.New("rpc: websocket url must be ws:// or wss://")
+	}
+}
+
+// pingCodec 发送一个 ping frame，和其他的 frame 一样在 ws 的写锁中发送
+var pingCodec = websocket.Codec{Marshal: func(any) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+// keepalive 定期发送 ping，超过 timeout 没有读到任何数据时关闭连接，recv 随之退出并关闭 Client
+func keepalive(cli *Client, ws *websocket.Conn, ac *activityConn, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if cli.closed() {
+			return
+		}
+		if idle := ac.idle(); timeout > 0 && idle > timeout {
+			log.Printf("rpc: websocket keepalive timeout, no data for %v\n", idle)
+			ac.Conn.Close()
+			return
+		}
+		ac.Conn.SetWriteDeadline(time.Now().Add(interval))
+		err := pingCodec.Send(ws, nil)
+		ac.Conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// activityConn 记录最后一次读到数据的时间，pong 由 websocket 在读取时处理，同样会更新这个时间
+type activityConn struct {
+	net.Conn
+	lastRead int64 // 原子操作，UnixNano
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) touch() {
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+}
+
+func (c *activityConn) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&c.lastRead))
+}
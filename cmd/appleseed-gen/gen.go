@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// service 一个需要生成代码的接口
+type service struct {
+	Name    string
+	Methods []method
+}
+
+// method 接口中的一个方法，Arg 和 Reply 为参数类型在源码中的写法
+type method struct {
+	Name  string
+	Arg   string
+	Reply string
+}
+
+// generator 解析一个包中的接口定义
+type generator struct {
+	fset    *token.FileSet
+	pkg     string
+	files   []*ast.File
+	imports map[string]string // 生成的代码需要导入的包，key: 包名 val: 路径
+}
+
+func newGenerator() *generator {
+	return &generator{fset: token.NewFileSet(), imports: make(map[string]string)}
+}
+
+// parseDir 解析 dir 中除了测试和生成的代码以外的所有 Go 文件
+func parseDir(dir string) (*generator, error) {
+	g := newGenerator()
+	names, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") || strings.HasSuffix(name, generatedSuffix) {
+			continue
+		}
+		src, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.parseFile(name, src); err != nil {
+			return nil, err
+		}
+	}
+	if len(g.files) == 0 {
+		return nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	return g, nil
+}
+
+func (g *generator) parseFile(name string, src []byte) error {
+	f, err := parser.ParseFile(g.fset, name, src, 0)
+	if err != nil {
+		return err
+	}
+	if g.pkg == "" {
+		g.pkg = f.Name.Name
+	} else if g.pkg != f.Name.Name {
+		return fmt.Errorf("%s: package %s, expected %s", name, f.Name.Name, g.pkg)
+	}
+	g.files = append(g.files, f)
+	return nil
+}
+
+// service 查找名为 name 的接口，检查每个方法的签名是否为
+// Method(ctx context.Context, arg T, reply *R) error
+func (g *generator) service(name string) (service, error) {
+	for _, f := range g.files {
+		obj := f.Scope.Lookup(name)
+		if obj == nil || obj.Kind != ast.Typ {
+			continue
+		}
+		spec := obj.Decl.(*ast.TypeSpec)
+		iface, ok := spec.Type.(*ast.InterfaceType)
+		if !ok {
+			return service{}, fmt.Errorf("%s is not an interface", name)
+		}
+		svc := service{Name: name}
+		for _, field := range iface.Methods.List {
+			ft, ok := field.Type.(*ast.FuncType)
+			if !ok || len(field.Names) == 0 {
+				return service{}, fmt.Errorf("%s: embedded interfaces are not supported", name)
+			}
+			m, err := g.method(f, name, field.Names[0].Name, ft)
+			if err != nil {
+				return service{}, err
+			}
+			svc.Methods = append(svc.Methods, m)
+		}
+		if len(svc.Methods) == 0 {
+			return service{}, fmt.Errorf("%s has no methods", name)
+		}
+		return svc, nil
+	}
+	return service{}, fmt.Errorf("interface %s not found", name)
+}
+
+func (g *generator) method(f *ast.File, svc, name string, ft *ast.FuncType) (method, error) {
+	full := svc + "." + name
+	var params []ast.Expr
+	for _, p := range ft.Params.List {
+		n := len(p.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			params = append(params, p.Type)
+		}
+	}
+	if len(params) != 3 || types.ExprString(params[0]) != g.contextName(f)+".Context" {
+		return method{}, fmt.Errorf("%s: parameters must be (ctx context.Context, arg T, reply *R)", full)
+	}
+	if _, ok := params[2].(*ast.StarExpr); !ok {
+		return method{}, fmt.Errorf("%s: reply type %s is not a pointer", full, types.ExprString(params[2]))
+	}
+	if ft.Results == nil || len(ft.Results.List) != 1 || len(ft.Results.List[0].Names) > 1 ||
+		types.ExprString(ft.Results.List[0].Type) != "error" {
+		return method{}, fmt.Errorf("%s: must return exactly one error", full)
+	}
+	for i, what := range []string{"argument", "reply"} {
+		if !exported(params[i+1]) {
+			return method{}, fmt.Errorf("%s: %s type %s is not exported", full, what, types.ExprString(params[i+1]))
+		}
+		if err := g.addImports(f, params[i+1]); err != nil {
+			return method{}, fmt.Errorf("%s: %v", full, err)
+		}
+	}
+	return method{Name: name, Arg: types.ExprString(params[1]), Reply: types.ExprString(params[2])}, nil
+}
+
+// contextName 返回 f 中 context 包的名字
+func (g *generator) contextName(f *ast.File) string {
+	for _, imp := range f.Imports {
+		if path, _ := strconv.Unquote(imp.Path.Value); path == "context" {
+			if imp.Name != nil {
+				return imp.Name.Name
+			}
+			return "context"
+		}
+	}
+	return "context"
+}
+
+// exported 和服务端注册时的检查相同：去掉指针之后必须是可导出的类型或者内置类型
+func exported(expr ast.Expr) bool {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if id, ok := expr.(*ast.Ident); ok {
+		return token.IsExported(id.Name) || types.Universe.Lookup(id.Name) != nil
+	}
+	return true
+}
+
+// addImports 记录 expr 中引用的其他包
+func (g *generator) addImports(f *ast.File, expr ast.Expr) (err error) {
+	ast.Inspect(expr, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		id, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		path, ok := importPath(f, id.Name)
+		if !ok {
+			err = fmt.Errorf("unknown package %s", id.Name)
+			return false
+		}
+		if old, ok := g.imports[id.Name]; ok && old != path {
+			err = fmt.Errorf("package name %s refers to both %s and %s", id.Name, old, path)
+			return false
+		}
+		g.imports[id.Name] = path
+		return false
+	})
+	return err
+}
+
+// importPath 返回 f 中名为 name 的包的路径，没有指定名字时使用路径的最后一个元素
+func importPath(f *ast.File, name string) (string, bool) {
+	for _, imp := range f.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		n := path[strings.LastIndex(path, "/")+1:]
+		if imp.Name != nil {
+			n = imp.Name.Name
+		}
+		if n == name {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// generate 生成 names 中所有接口的客户端和注册函数
+func (g *generator) generate(names []string) ([]byte, error) {
+	var services []service
+	for _, name := range names {
+		svc, err := g.service(name)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+	// 标准库和其他包分为两组
+	std := []string{strconv.Quote("context")}
+	other := []string{strconv.Quote(appleseedPath), strconv.Quote(clientPath)}
+	for name, path := range g.imports {
+		if path == "context" || path == appleseedPath || path == clientPath {
+			continue
+		}
+		imp := strconv.Quote(path)
+		if path[strings.LastIndex(path, "/")+1:] != name {
+			imp = name + " " + imp
+		}
+		if strings.Contains(strings.SplitN(path, "/", 2)[0], ".") {
+			other = append(other, imp)
+		} else {
+			std = append(std, imp)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, struct {
+		Package  string
+		Imports  [][]string
+		Services []service
+	}{g.pkg, [][]string{std, other}, services})
+	if err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %v\n%s", err, buf.Bytes())
+	}
+	return src, nil
+}
+
+const (
+	appleseedPath   = "github.com/YOUSEEBIGGIRL/appleseed"
+	clientPath      = "github.com/YOUSEEBIGGIRL/appleseed/client"
+	generatedSuffix = "_appleseed.go"
+)
+
+var tmpl = template.Must(template.New("").Parse(`// Code generated by appleseed-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{range $i, $group := .Imports}}{{if $i}}
+{{end}}{{range $group}}	{{.}}
+{{end}}{{end}})
+{{range .Services}}{{$svc := .Name}}
+// {{$svc}}ServiceName 服务 {{$svc}} 注册的服务名
+const {{$svc}}ServiceName = "{{$svc}}"
+
+// {{$svc}}Client 通过 client.Client 调用服务 {{$svc}}
+type {{$svc}}Client struct {
+	cli *client.Client
+}
+
+var _ {{$svc}} = (*{{$svc}}Client)(nil)
+
+// New{{$svc}}Client 返回使用 cli 调用服务 {{$svc}} 的客户端
+func New{{$svc}}Client(cli *client.Client) *{{$svc}}Client {
+	return &{{$svc}}Client{cli: cli}
+}
+{{range .Methods}}
+// {{.Name}} 调用 {{$svc}}.{{.Name}}
+func (c *{{$svc}}Client) {{.Name}}(ctx context.Context, arg {{.Arg}}, reply {{.Reply}}) error {
+	return c.cli.Call(ctx, "{{$svc}}.{{.Name}}", arg, reply)
+}
+{{end}}
+// Register{{$svc}} 将 impl 注册为服务 {{$svc}}，impl 需要是结构体或者指向结构体的指针
+func Register{{$svc}}(s *appleseed.Server, impl {{$svc}}) error {
+	return s.RegisterName({{$svc}}ServiceName, impl)
+}
+{{end}}`))
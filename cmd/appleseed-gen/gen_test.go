@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden file")
+
+// internal/arith 中提交的生成代码同时作为 golden 文件，并由 internal/arith 的测试编译和调用
+func TestGolden(t *testing.T) {
+	dir := filepath.Join("internal", "arith")
+	g, err := parseDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := g.generate([]string{"Arith", "Clock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join(dir, "arith"+generatedSuffix)
+	if *update {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("generated code differs from %s, run go generate or go test -update\n%s", golden, got)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	cases := []struct {
+		name, src, err string
+	}{
+		{"missing", "type Other interface{}", "interface S not found"},
+		{"not interface", "type S struct{}", "S is not an interface"},
+		{"empty", "type S interface{}", "S has no methods"},
+		{"embedded", "type S interface{ io.Reader }", "embedded interfaces are not supported"},
+		{"no ctx", "type S interface{ M(a, b *int) error }", "S.M: parameters must be"},
+		{"wrong ctx", "type S interface{ M(ctx int, a int, b *int) error }", "S.M: parameters must be"},
+		{"reply not pointer", "type S interface{ M(ctx context.Context, a int, b int) error }", "reply type int is not a pointer"},
+		{"no error", "type S interface{ M(ctx context.Context, a int, b *int) }", "must return exactly one error"},
+		{"two results", "type S interface{ M(ctx context.Context, a int, b *int) (int, error) }", "must return exactly one error"},
+		{"unexported arg", "type S interface{ M(ctx context.Context, a *args, b *int) error }", "argument type *args is not exported"},
+		{"unexported reply", "type S interface{ M(ctx context.Context, a int, b *reply) error }", "reply type *reply is not exported"},
+		{"unknown package", "type S interface{ M(ctx context.Context, a foo.T, b *int) error }", "unknown package foo"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g := newGenerator()
+			src := "package p\nimport (\n\"context\"\n\"io\"\n)\n" + c.src
+			if err := g.parseFile("p.go", []byte(src)); err != nil {
+				t.Fatal(err)
+			}
+			_, err := g.generate([]string{"S"})
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("err = %v, want %q", err, c.err)
+			}
+		})
+	}
+}
+
+// 重命名导入的包时生成的代码使用同样的名字
+func TestRenamedImport(t *testing.T) {
+	g := newGenerator()
+	src := `package p
+import (
+	stdctx "context"
+	tm "time"
+)
+type S interface{ M(ctx stdctx.Context, d tm.Duration, t *tm.Time) error }`
+	if err := g.parseFile("p.go", []byte(src)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := g.generate([]string{"S"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`tm "time"`, "arg tm.Duration, reply *tm.Time"} {
+		if !strings.Contains(string(got), want) {
+			t.Fatalf("missing %q in\n%s", want, got)
+		}
+	}
+}
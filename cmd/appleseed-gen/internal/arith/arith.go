@@ -0,0 +1,28 @@
+// Package arith appleseed-gen 的示例，生成的 arith_appleseed.go 同时作为生成器的 golden 文件
+package arith
+
+import (
+	"context"
+	"time"
+)
+
+//go:generate go run ../.. -type Arith,Clock
+
+type Args struct {
+	A, B int
+}
+
+type Quotient struct {
+	Quo, Rem int
+}
+
+// Arith 整数运算
+type Arith interface {
+	Multiply(ctx context.Context, args *Args, reply *int) error
+	Divide(ctx context.Context, args Args, reply *Quotient) error
+}
+
+// Clock 参数类型来自其他包
+type Clock interface {
+	Add(ctx context.Context, d time.Duration, reply *time.Time) error
+}
@@ -0,0 +1,66 @@
+// Code generated by appleseed-gen. DO NOT EDIT.
+
+package arith
+
+import (
+	"context"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+)
+
+// ArithServiceName 服务 Arith 注册的服务名
+const ArithServiceName = "Arith"
+
+// ArithClient 通过 client.Client 调用服务 Arith
+type ArithClient struct {
+	cli *client.Client
+}
+
+var _ Arith = (*ArithClient)(nil)
+
+// NewArithClient 返回使用 cli 调用服务 Arith 的客户端
+func NewArithClient(cli *client.Client) *ArithClient {
+	return &ArithClient{cli: cli}
+}
+
+// Multiply 调用 Arith.Multiply
+func (c *ArithClient) Multiply(ctx context.Context, arg *Args, reply *int) error {
+	return c.cli.Call(ctx, "Arith.Multiply", arg, reply)
+}
+
+// Divide 调用 Arith.Divide
+func (c *ArithClient) Divide(ctx context.Context, arg Args, reply *Quotient) error {
+	return c.cli.Call(ctx, "Arith.Divide", arg, reply)
+}
+
+// RegisterArith 将 impl 注册为服务 Arith，impl 需要是结构体或者指向结构体的指针
+func RegisterArith(s *appleseed.Server, impl Arith) error {
+	return s.RegisterName(ArithServiceName, impl)
+}
+
+// ClockServiceName 服务 Clock 注册的服务名
+const ClockServiceName = "Clock"
+
+// ClockClient 通过 client.Client 调用服务 Clock
+type ClockClient struct {
+	cli *client.Client
+}
+
+var _ Clock = (*ClockClient)(nil)
+
+// NewClockClient 返回使用 cli 调用服务 Clock 的客户端
+func NewClockClient(cli *client.Client) *ClockClient {
+	return &ClockClient{cli: cli}
+}
+
+// Add 调用 Clock.Add
+func (c *ClockClient) Add(ctx context.Context, arg time.Duration, reply *time.Time) error {
+	return c.cli.Call(ctx, "Clock.Add", arg, reply)
+}
+
+// RegisterClock 将 impl 注册为服务 Clock，impl 需要是结构体或者指向结构体的指针
+func RegisterClock(s *appleseed.Server, impl Clock) error {
+	return s.RegisterName(ClockServiceName, impl)
+}
@@ -0,0 +1,90 @@
+package arith
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// arith 不可导出的实现，通过 RegisterArith 注册为服务 Arith
+type arith struct{}
+
+func (arith) Multiply(ctx context.Context, args *Args, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func (arith) Divide(ctx context.Context, args Args, reply *Quotient) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	reply.Quo, reply.Rem = args.A/args.B, args.A%args.B
+	return nil
+}
+
+type clock struct{}
+
+func (clock) Add(ctx context.Context, d time.Duration, reply *time.Time) error {
+	*reply = time.Unix(0, 0).UTC().Add(d)
+	return nil
+}
+
+func TestGenerated(t *testing.T) {
+	ctx := context.Background()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(ctx, "arith", "127.0.0.1", port, memory.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterArith(s, arith{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterClock(s, &clock{}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(ctx)
+
+	cli, err := client.Dial(ctx, "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	ac := NewArithClient(cli)
+	var product int
+	if err := ac.Multiply(ctx, &Args{A: 7, B: 8}, &product); err != nil || product != 56 {
+		t.Fatalf("Multiply = %d, %v", product, err)
+	}
+	var q Quotient
+	if err := ac.Divide(ctx, Args{A: 17, B: 5}, &q); err != nil || q != (Quotient{Quo: 3, Rem: 2}) {
+		t.Fatalf("Divide = %+v, %v", q, err)
+	}
+	if err := ac.Divide(ctx, Args{A: 1}, &q); err == nil || !strings.Contains(err.Error(), "divide by zero") {
+		t.Fatalf("err = %v", err)
+	}
+
+	var now time.Time
+	if err := NewClockClient(cli).Add(ctx, time.Hour, &now); err != nil || !now.Equal(time.Unix(3600, 0)) {
+		t.Fatalf("Add = %v, %v", now, err)
+	}
+}
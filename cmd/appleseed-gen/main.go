@@ -0,0 +1,62 @@
+// appleseed-gen 根据接口定义生成带类型的客户端和服务端的注册函数，避免手写 "Service.Method" 字符串：
+//
+//	//go:generate go run github.com/YOUSEEBIGGIRL/appleseed/cmd/appleseed-gen -type Arith
+//	type Arith interface {
+//		Multiply(ctx context.Context, args *Args, reply *Reply) error
+//	}
+//
+// 对于每个接口 Arith 生成：
+//
+//   - ArithClient：包装 *client.Client，每个方法调用 "Arith.<方法名>"，同时实现了 Arith 接口；
+//   - RegisterArith(s, impl)：编译时检查 impl 实现了 Arith，并注册为服务 Arith（而不是 impl 的类型名）。
+//
+// 接口的每个方法都必须是 Method(ctx context.Context, arg T, reply *R) error 的形式，参数类型必须可导出。
+// 生成的代码写入 <第一个接口名的小写>_appleseed.go，可以通过 -output 指定
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	typeNames := flag.String("type", "", "comma-separated list of interface names; required")
+	output := flag.String("output", "", "output file name; default <dir>/<type>_appleseed.go")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: appleseed-gen -type T[,T...] [-output file] [dir]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *typeNames == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	names := strings.Split(*typeNames, ",")
+
+	g, err := parseDir(dir)
+	if err != nil {
+		fatal(err)
+	}
+	src, err := g.generate(names)
+	if err != nil {
+		fatal(err)
+	}
+	if *output == "" {
+		*output = filepath.Join(dir, strings.ToLower(names[0])+generatedSuffix)
+	}
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "appleseed-gen:", err)
+	os.Exit(1)
+}
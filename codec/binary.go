@@ -0,0 +1,998 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// 二进制协议，header 使用定长字段和 varint 编码，body 使用可配置的 BodyCodec 编码。
+//
+// 连接建立后客户端先发送 preface，服务端收到后回复自己的 preface，之后双方都只发送 frame：
+//
+//	client preface := magic(4) version(1) features(uvarint) body-codec(string)
+//	server preface := magic(4) version(1) features(uvarint) error(string) [peer-info(string)]   peer-info 见 FeaturePeerInfo
+//	string         := length(uvarint) bytes
+//
+// magic 为 0xA5 'a' 's' 'b'。gob 的数据以 uvarint 编码的消息长度开头，0xA5 表示后面跟着 91 个字节的
+// 整数，不是合法的 gob 数据，所以服务端可以根据第一个字节区分两种协议（见 IsBinaryPreface）。
+// 客户端的 features 为希望开启的功能，服务端回复其中它支持的部分；error 不为空时表示服务端拒绝了
+// 连接（比如不支持客户端的 body codec），之后会关闭连接。
+//
+// frame := length(uvarint) header body
+//
+// length 为 header 和 body 的总长度，不能超过 MaxFrameSize。header 是自描述的，剩余的部分都是 body：
+//
+//	request header  := seq(uvarint) flags(1) method [metadata]
+//	  method        := string                 flags 中没有 flagMethodID 和 flagMethodBind
+//	                 | id(uvarint)            flagMethodID：使用之前绑定的 ID
+//	                 | string id(uvarint)     flagMethodBind：发送方法名，同时绑定 ID
+//	response header := seq(uvarint) flags(1) [code(uvarint) message(string)] [metadata] [details] [load]
+//	                                          code 和 message 只在 flagError 时存在
+//	metadata        := count(uvarint) count × (key(string) value(string))   只在 flagMetadata 时存在
+//	details         := 同 metadata                                         只在 flagDetails 时存在
+//	load            := inflight(uvarint) utilization(uvarint)             只在 flagLoad 时存在
+//
+// 方法名驻留（FeatureIntern）开启后，客户端第一次调用某个方法时发送方法名并绑定 ID，ID 从 0 开始
+// 依次递增，之后只发送 ID。每个连接最多绑定 MaxInternedMethods 个方法，表满之后，如果服务端也支持
+// FeatureInternEvict，客户端使用 CLOCK 算法选出一个最近没有使用的 ID，发送新的方法名重新绑定这个 ID，
+// 服务端收到后替换表中的方法；否则超出的方法只发送方法名。绑定表属于连接，重新连接后从空表开始。
+// 响应中不包含方法名，客户端通过 seq 找到对应的调用。
+//
+// code 为错误码（status.Code），message 为错误信息，details 为错误的附加信息。客户端开启了
+// FeatureErrorDetails 时服务端才会发送 details，旧版本的客户端不认识 flagDetails。load 为服务端上报的负载，
+// 同样只在客户端开启了 FeatureLoadReport 时发送。
+
+var binaryMagic = [4]byte{0xA5, 'a', 's', 'b'}
+
+const binaryVersion = 1
+
+const (
+	// FeatureIntern 方法名驻留
+	FeatureIntern uint64 = 1 << 0
+	// FeatureErrorDetails 响应中带有错误的附加信息，客户端总是开启
+	FeatureErrorDetails uint64 = 1 << 1
+	// FeatureLoadReport 响应中带有服务端上报的负载，客户端总是开启
+	FeatureLoadReport uint64 = 1 << 2
+	// FeatureInternEvict 方法名驻留的表满之后可以重新绑定已经使用的 ID，WithMethodInterning 同时开启
+	FeatureInternEvict uint64 = 1 << 3
+)
+
+const (
+	// MaxFrameSize frame 的最大长度，超过时认为数据已经损坏并关闭连接
+	MaxFrameSize = 64 << 20
+	// MaxInternedMethods 每个连接最多绑定 ID 的方法数量
+	MaxInternedMethods = 1024
+	// maxMetadata 一个 header 中最多的 metadata 数量
+	maxMetadata = 1024
+)
+
+const (
+	flagMethodID   = 1 << 0
+	flagMethodBind = 1 << 1
+	flagMetadata   = 1 << 2
+	flagError      = 1 << 3
+	flagDetails    = 1 << 4
+	flagLoad       = 1 << 5
+)
+
+// codeUnknown 和 status.Unknown 相同，有错误信息而没有错误码时使用
+const codeUnknown = 2
+
+var (
+	errBadPreface = errors.New("rpc codec: bad preface")
+	errBadHeader  = errors.New("rpc codec: malformed header")
+)
+
+// IsBinaryPreface 返回以 first 开头的连接是否使用二进制协议
+func IsBinaryPreface(first byte) bool {
+	return first == binaryMagic[0]
+}
+
+// BodyCodec 编码 body，同一个 BodyCodec 只会被一个连接使用，可以保存连接级别的状态
+type BodyCodec interface {
+	Name() string
+	// Marshal 编码 v，返回的数据在下一次调用 Marshal 之前有效
+	Marshal(v any) ([]byte, error)
+	// Unmarshal 将 data 解码到 v 中，v 为 nil 时丢弃 data
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	bodyMu     sync.RWMutex
+	bodyCodecs = map[string]func() BodyCodec{
+		"gob":   func() BodyCodec { return newGobBody() },
+		"json":  func() BodyCodec { return jsonBody{} },
+		"proto": func() BodyCodec { return protoBody{} },
+	}
+)
+
+// RegisterBodyCodec 注册一个 BodyCodec，客户端和服务端需要注册相同的名字，每个连接会调用一次 f
+func RegisterBodyCodec(name string, f func() BodyCodec) {
+	bodyMu.Lock()
+	defer bodyMu.Unlock()
+	bodyCodecs[name] = f
+}
+
+func newBodyCodec(name string) (BodyCodec, error) {
+	bodyMu.RLock()
+	defer bodyMu.RUnlock()
+	f, ok := bodyCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("rpc codec: unknown body codec %q", name)
+	}
+	return f(), nil
+}
+
+// gobBody 在整个连接上共享一个 gob 的 encoder 和 decoder，类型信息只会在第一次发送时编码，
+// 所以每个 frame 必须按照发送的顺序解码，丢弃的 body 也需要交给 decoder
+type gobBody struct {
+	encBuf bytes.Buffer
+	enc    *gob.Encoder
+	decBuf bytes.Reader
+	dec    *gob.Decoder
+}
+
+func newGobBody() *gobBody {
+	g := new(gobBody)
+	g.enc = gob.NewEncoder(&g.encBuf)
+	g.dec = gob.NewDecoder(&g.decBuf)
+	return g
+}
+
+func (g *gobBody) Name() string { return "gob" }
+
+func (g *gobBody) Marshal(v any) ([]byte, error) {
+	g.encBuf.Reset()
+	if err := g.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return g.encBuf.Bytes(), nil
+}
+
+func (g *gobBody) Unmarshal(data []byte, v any) error {
+	g.decBuf.Reset(data)
+	return g.dec.Decode(v)
+}
+
+type jsonBody struct{}
+
+func (jsonBody) Name() string { return "json" }
+
+func (jsonBody) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonBody) Unmarshal(data []byte, v any) error {
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// protoBody 参数和返回值必须实现 proto.Message，错误响应的 body 为空
+type protoBody struct{}
+
+func (protoBody) Name() string { return "proto" }
+
+func (protoBody) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		// 错误响应的 body 不是 proto.Message，不需要编码
+		return nil, nil
+	}
+	return proto.Marshal(m)
+}
+
+func (protoBody) Unmarshal(data []byte, v any) error {
+	if v == nil {
+		return nil
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("rpc codec: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// Stateful 由在连接上保存状态的 BodyCodec 实现，比如 gob 只在第一次发送某个类型时编码类型信息。
+// 这样编码的 body 离开了所在的连接就无法解码，所以不支持 RawMessage
+type Stateful interface {
+	Stateful() bool
+}
+
+func (g *gobBody) Stateful() bool { return true }
+
+// RawMessage 已经编码的 body，用于网关等只转发、不关心 body 内容的场景，只有二进制协议支持。
+// 读取到 *RawMessage 时保存 body 的原始数据而不解码；发送 RawMessage 或者 *RawMessage 时直接写入 Data。
+// Codec 为编码 Data 使用的 BodyCodec 的名字，发送时必须和连接使用的相同
+type RawMessage struct {
+	Codec string
+	Data  []byte
+}
+
+// ErrRawUnsupported 连接不支持 RawMessage：使用的是 gob 协议，或者 body 的编码是有状态的（见 Stateful）
+var ErrRawUnsupported = errors.New("rpc codec: raw body requires the binary protocol with a stateless body codec")
+
+func asRawMessage(body any) (*RawMessage, bool) {
+	switch m := body.(type) {
+	case RawMessage:
+		return &m, true
+	case *RawMessage:
+		return m, m != nil
+	}
+	return nil, false
+}
+
+// BinaryOption 用于配置二进制协议的客户端
+type BinaryOption func(*BinaryClientCodec)
+
+// WithBodyCodec 指定 body 的编码方式，默认为 "gob"，服务端需要注册了同名的 BodyCodec
+func WithBodyCodec(name string) BinaryOption {
+	return func(c *BinaryClientCodec) {
+		c.bodyName = name
+	}
+}
+
+// WithMethodInterning 请求开启方法名驻留，服务端不支持时仍然发送方法名
+func WithMethodInterning() BinaryOption {
+	return func(c *BinaryClientCodec) {
+		c.features |= FeatureIntern | FeatureInternEvict
+	}
+}
+
+// frameConn 二进制协议的客户端和服务端共用的读写逻辑
+type frameConn struct {
+	rwc   io.ReadWriteCloser
+	r     byteReader
+	w     *bufio.Writer
+	body  BodyCodec
+	hdr   []byte // 编码 header 的缓冲区
+	frame []byte // 读取 frame 的缓冲区
+	rest  []byte // 当前 frame 中 header 之后的部分，即 body
+
+	frameSize int64 // 最近一次读取的 frame 在连接上的大小，包括长度前缀
+	readSize  MessageSize
+	writeSize MessageSize
+
+	readTimeout time.Duration // 见 SetFrameReadTimeout
+	setDeadline func(t time.Time) error
+
+	chunker
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func newFrameConn(conn io.ReadWriteCloser) frameConn {
+	r, ok := conn.(byteReader)
+	if !ok {
+		r = bufio.NewReader(conn)
+	}
+	return frameConn{rwc: conn, r: r, w: bufio.NewWriter(conn)}
+}
+
+// readFrame 读取一个 frame，返回的数据在下一次调用 readFrame 之前有效
+func (f *frameConn) readFrame() ([]byte, error) {
+	first, err := f.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if f.readTimeout > 0 {
+		// 读到第一个字节之后才开始计时，等待下一个 frame 的空闲连接不受限制
+		f.setDeadline(time.Now().Add(f.readTimeout))
+		defer f.setDeadline(time.Time{})
+	}
+	n, err := readUvarint(first, f.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("rpc codec: frame size %d exceeds %d", n, MaxFrameSize)
+	}
+	if uint64(cap(f.frame)) < n {
+		f.frame = make([]byte, n)
+	}
+	f.frame = f.frame[:n]
+	if _, err := io.ReadFull(f.r, f.frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	f.frameSize = int64(uvarintLen(n)) + int64(n)
+	return f.frame, nil
+}
+
+// setRest 保存当前 frame 中 header 之后的部分，并记录 header 和 body 的大小
+func (f *frameConn) setRest(rest []byte) {
+	f.rest = rest
+	body := int64(len(rest))
+	f.readSize = MessageSize{Header: f.frameSize - body, Body: body, UncompressedBody: body}
+}
+
+// LastReadSize 实现 SizeReporter，header 包括 frame 的长度前缀
+func (f *frameConn) LastReadSize() MessageSize {
+	return f.readSize
+}
+
+// LastWriteSize 实现 SizeReporter，header 包括 frame 的长度前缀
+func (f *frameConn) LastWriteSize() MessageSize {
+	return f.writeSize
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// rawSupported 返回连接的 body 编码是否支持 RawMessage
+func (f *frameConn) rawSupported() bool {
+	st, ok := f.body.(Stateful)
+	return !ok || !st.Stateful()
+}
+
+func (f *frameConn) marshal(body any) ([]byte, error) {
+	raw, ok := asRawMessage(body)
+	if !ok {
+		return f.body.Marshal(body)
+	}
+	if !f.rawSupported() {
+		return nil, ErrRawUnsupported
+	}
+	if raw.Codec != f.body.Name() {
+		return nil, fmt.Errorf("rpc codec: raw body is encoded with %q, but the connection uses %q", raw.Codec, f.body.Name())
+	}
+	return raw.Data, nil
+}
+
+// writeFrame 写入 header 和编码后的 body 并 flush。chunk 为 true 时超过 chunk 大小的 body 被拆分，
+// 只写入 header frame，剩余的部分见 writeFragment
+func (f *frameConn) writeFrame(body any, chunk bool) error {
+	if src, ok := body.(BodySource); ok {
+		return f.writeSource(src.BodyReader(), chunk)
+	}
+	data, err := f.marshal(body)
+	if err != nil {
+		return err
+	}
+	if chunk && len(data) > f.chunk.size {
+		// RawMessage 的数据由调用方保证在写入完成之前不会修改，BodyCodec 编码的结果下一次编码时就会失效
+		_, raw := asRawMessage(body)
+		return f.writeChunked(data, raw)
+	}
+	return f.writeRaw(data)
+}
+
+func (f *frameConn) readBody(body any) error {
+	rest := f.rest
+	f.rest = nil
+	if handled, err := f.chunkedBody(); handled {
+		return err
+	}
+	if sink, ok := body.(BodySink); ok {
+		if !f.rawSupported() {
+			f.body.Unmarshal(rest, nil)
+			return ErrRawUnsupported
+		}
+		_, err := sink.BodyWriter().Write(rest)
+		return err
+	}
+	raw, ok := body.(*RawMessage)
+	if !ok {
+		err := f.body.Unmarshal(rest, body)
+		if err != nil && f.rawSupported() {
+			// 无状态的编码解码失败不影响之后的 body；有状态的编码（gob）的状态可能已经损坏，由调用方决定如何处理
+			return &MessageError{Err: err}
+		}
+		return err
+	}
+	if !f.rawSupported() {
+		// 仍然需要交给 decoder，保持连接上的状态一致
+		f.body.Unmarshal(rest, nil)
+		return ErrRawUnsupported
+	}
+	// rest 指向读取 frame 的缓冲区，下一次读取时会被覆盖
+	raw.Codec = f.body.Name()
+	raw.Data = append(raw.Data[:0], rest...)
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendMetadata(b []byte, md map[string]string) []byte {
+	b = appendUvarint(b, uint64(len(md)))
+	for k, v := range md {
+		b = appendString(b, k)
+		b = appendString(b, v)
+	}
+	return b
+}
+
+// headerReader 解析 header，所有方法在数据不足或者不合法时返回 errBadHeader
+type headerReader struct {
+	b []byte
+}
+
+func (h *headerReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(h.b)
+	if n <= 0 {
+		return 0, errBadHeader
+	}
+	h.b = h.b[n:]
+	return v, nil
+}
+
+func (h *headerReader) byte() (byte, error) {
+	if len(h.b) == 0 {
+		return 0, errBadHeader
+	}
+	c := h.b[0]
+	h.b = h.b[1:]
+	return c, nil
+}
+
+func (h *headerReader) string() (string, error) {
+	n, err := h.uvarint()
+	if err != nil || n > uint64(len(h.b)) {
+		return "", errBadHeader
+	}
+	s := string(h.b[:n])
+	h.b = h.b[n:]
+	return s, nil
+}
+
+func (h *headerReader) metadata() (map[string]string, error) {
+	n, err := h.uvarint()
+	if err != nil || n > maxMetadata {
+		return nil, errBadHeader
+	}
+	md := make(map[string]string, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := h.string()
+		if err != nil {
+			return nil, err
+		}
+		v, err := h.string()
+		if err != nil {
+			return nil, err
+		}
+		md[k] = v
+	}
+	return md, nil
+}
+
+// parseRequestHeader 从 frame 中解析请求的 header 到 req 中，methods 为连接上已经绑定 ID 的方法，
+// 遇到 flagMethodBind 时会追加到其中，evict 为 true 时表满之后替换已经绑定的 ID。返回 header 之后的 body
+func parseRequestHeader(frame []byte, req *RequestHeader, methods *[]string, evict bool) ([]byte, error) {
+	h := headerReader{b: frame}
+	seq, err := h.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	flags, err := h.byte()
+	if err != nil {
+		return nil, err
+	}
+	req.Seq = seq
+	switch {
+	case flags&flagMethodID != 0:
+		id, err := h.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if id >= uint64(len(*methods)) {
+			return nil, fmt.Errorf("rpc codec: unknown method id %d", id)
+		}
+		req.ServiceMethod = (*methods)[id]
+	default:
+		if req.ServiceMethod, err = h.string(); err != nil {
+			return nil, err
+		}
+		if flags&flagMethodBind != 0 {
+			id, err := h.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			// ID 必须依次递增，表满之后才能替换已经绑定的 ID，保证双方的表一致
+			switch n := uint64(len(*methods)); {
+			case id == n && n < MaxInternedMethods:
+				*methods = append(*methods, req.ServiceMethod)
+			case evict && n == MaxInternedMethods && id < n:
+				(*methods)[id] = req.ServiceMethod
+			default:
+				return nil, fmt.Errorf("rpc codec: bad method id %d", id)
+			}
+		}
+	}
+	if flags&flagMetadata != 0 {
+		if req.Metadata, err = h.metadata(); err != nil {
+			return nil, err
+		}
+	}
+	return h.b, nil
+}
+
+// appendResponseHeader 将 r 编码为响应 header 追加到 b 后面，features 为客户端开启的功能，
+// 没有开启 FeatureErrorDetails、FeatureLoadReport 时分别不发送错误的附加信息和负载
+func appendResponseHeader(b []byte, r *ResponseHeader, features uint64) []byte {
+	var flags byte
+	if r.Error != "" || r.Code != 0 {
+		flags |= flagError
+	}
+	if len(r.Metadata) > 0 {
+		flags |= flagMetadata
+	}
+	if features&FeatureErrorDetails != 0 && flags&flagError != 0 && len(r.Details) > 0 {
+		flags |= flagDetails
+	}
+	if features&FeatureLoadReport != 0 && r.Load != nil {
+		flags |= flagLoad
+	}
+	b = appendUvarint(b, r.Seq)
+	b = append(b, flags)
+	if flags&flagError != 0 {
+		code := uint64(r.Code)
+		if code == 0 {
+			code = codeUnknown
+		}
+		b = appendUvarint(b, code)
+		b = appendString(b, r.Error)
+	}
+	if flags&flagMetadata != 0 {
+		b = appendMetadata(b, r.Metadata)
+	}
+	if flags&flagDetails != 0 {
+		b = appendMetadata(b, r.Details)
+	}
+	if flags&flagLoad != 0 {
+		b = appendUvarint(b, uint64(r.Load.Inflight))
+		b = appendUvarint(b, uint64(r.Load.Utilization))
+	}
+	return b
+}
+
+// parseResponseHeader 从 frame 中解析响应的 header 到 resp 中，返回 header 之后的 body
+func parseResponseHeader(frame []byte, resp *ResponseHeader) ([]byte, error) {
+	h := headerReader{b: frame}
+	seq, err := h.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	flags, err := h.byte()
+	if err != nil {
+		return nil, err
+	}
+	resp.Seq = seq
+	if flags&flagError != 0 {
+		code, err := h.uvarint()
+		if err != nil || code > 1<<32-1 {
+			return nil, errBadHeader
+		}
+		resp.Code = uint32(code)
+		if resp.Error, err = h.string(); err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagMetadata != 0 {
+		if resp.Metadata, err = h.metadata(); err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagDetails != 0 {
+		if resp.Details, err = h.metadata(); err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagLoad != 0 {
+		inflight, err := h.uvarint()
+		if err != nil || inflight > 1<<32-1 {
+			return nil, errBadHeader
+		}
+		util, err := h.uvarint()
+		if err != nil || util > 100 {
+			return nil, errBadHeader
+		}
+		resp.Load = &LoadReport{Inflight: uint32(inflight), Utilization: uint32(util)}
+	}
+	return h.b, nil
+}
+
+// BinaryClientCodec 二进制协议的客户端
+type BinaryClientCodec struct {
+	frameConn
+	bodyName string
+	features uint64 // 希望开启的功能
+
+	// 以下字段只在 WriteRequest 中访问，调用方保证 WriteRequest 不会并发调用
+	prefaceSent bool
+	methods     map[string]uint64 // 已经绑定 ID 的方法
+	names       []string          // 下标为 ID
+	used        []bool            // 绑定或者上次被 CLOCK 扫过之后是否再次使用过，只调用过一次的方法最先被替换
+	hand        int               // CLOCK 下一个检查的 ID
+
+	accepted uint64 // 原子操作，服务端接受的功能，收到服务端的 preface 之前为 0
+	gotReply bool   // 是否已经收到服务端的 preface，只在 ReadResponseHeader 中访问
+	peerName string
+	peer     atomic.Value // PeerInfo，收到服务端的 preface 之前为 nil
+}
+
+// NewBinaryClientCodec 使用二进制协议的客户端，preface 会在第一次发送请求时发送
+func NewBinaryClientCodec(conn io.ReadWriteCloser, opts ...BinaryOption) *BinaryClientCodec {
+	c := &BinaryClientCodec{frameConn: newFrameConn(conn), bodyName: "gob", methods: make(map[string]uint64),
+		features: FeatureErrorDetails | FeatureLoadReport | FeaturePeerInfo}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *BinaryClientCodec) WriteRequest(r *RequestHeader, body any) error {
+	md := r.Metadata
+	if !c.prefaceSent {
+		b, err := newBodyCodec(c.bodyName)
+		if err != nil {
+			return err
+		}
+		c.body = b
+		p := append(binaryMagic[:0:0], binaryMagic[:]...)
+		p = append(p, binaryVersion)
+		p = appendUvarint(p, c.features)
+		p = appendString(p, c.bodyName)
+		c.w.Write(p)
+		c.prefaceSent = true
+		if c.features&FeaturePeerInfo != 0 {
+			md = make(map[string]string, len(r.Metadata)+1)
+			for k, v := range r.Metadata {
+				md[k] = v
+			}
+			md[peerInfoKey] = string(appendPeerInfo(nil, localPeerInfo(supportedFeatures, c.peerName)))
+		}
+	}
+
+	var flags byte
+	if len(md) > 0 {
+		flags |= flagMetadata
+	}
+	hdr := appendUvarint(c.hdr[:0], r.Seq)
+	flagsAt := len(hdr)
+	hdr = append(hdr, 0)
+	if id, ok := c.methods[r.ServiceMethod]; ok {
+		flags |= flagMethodID
+		hdr = appendUvarint(hdr, id)
+		c.used[id] = true
+	} else {
+		hdr = appendString(hdr, r.ServiceMethod)
+		if id, ok := c.bind(r.ServiceMethod); ok {
+			flags |= flagMethodBind
+			hdr = appendUvarint(hdr, id)
+		}
+	}
+	hdr[flagsAt] = flags
+	if flags&flagMetadata != 0 {
+		hdr = appendMetadata(hdr, md)
+	}
+	c.hdr = hdr
+	return c.writeFrame(body, c.chunking())
+}
+
+// bind 为 method 分配 ID，服务端没有接受驻留，或者表已满并且服务端不支持重新绑定时返回 false
+func (c *BinaryClientCodec) bind(method string) (uint64, bool) {
+	accepted := atomic.LoadUint64(&c.accepted)
+	if accepted&FeatureIntern == 0 {
+		return 0, false
+	}
+	if len(c.names) < MaxInternedMethods {
+		id := uint64(len(c.names))
+		c.names = append(c.names, method)
+		c.used = append(c.used, false)
+		c.methods[method] = id
+		return id, true
+	}
+	if accepted&FeatureInternEvict == 0 {
+		return 0, false
+	}
+	// CLOCK：跳过并清除使用过的 ID，替换第一个上次扫过之后没有使用过的
+	for c.used[c.hand] {
+		c.used[c.hand] = false
+		c.hand = (c.hand + 1) % len(c.names)
+	}
+	id := c.hand
+	c.hand = (c.hand + 1) % len(c.names)
+	delete(c.methods, c.names[id])
+	c.names[id] = method
+	c.methods[method] = uint64(id)
+	return uint64(id), true
+}
+
+func (c *BinaryClientCodec) ReadResponseHeader(r *ResponseHeader) error {
+	if !c.gotReply {
+		if err := c.readServerPreface(); err != nil {
+			return err
+		}
+		c.gotReply = true
+	}
+	for {
+		frame, a, err := c.nextFrame()
+		if err != nil {
+			return err
+		}
+		if a != nil {
+			*r = a.header.(ResponseHeader)
+			c.setAssembled(a)
+			return nil
+		}
+		r.Reset()
+		rest, err := parseResponseHeader(frame, r)
+		if err != nil {
+			// 被拆分的消息之后的 fragment 找不到对应的消息，会被丢弃
+			me := c.badFrame(frame, err)
+			if me.SeqKnown && c.features&FeatureChunked != 0 {
+				c.takeSink(me.Seq)
+			}
+			return me
+		}
+		if _, flags, _ := frameFlags(frame); flags&flagChunked == 0 {
+			if c.features&FeatureChunked != 0 {
+				c.takeSink(r.Seq)
+			}
+			c.setRest(rest)
+			return err
+		}
+		if err := c.startAssembly(r.Seq, *r, rest); err != nil {
+			return err
+		}
+	}
+}
+
+// chunking 返回是否拆分发送超过 chunk 大小的请求
+func (c *BinaryClientCodec) chunking() bool {
+	return atomic.LoadUint64(&c.accepted)&FeatureChunked != 0
+}
+
+func (c *BinaryClientCodec) readServerPreface() error {
+	var p [5]byte
+	if _, err := io.ReadFull(c.r, p[:]); err != nil {
+		return err
+	}
+	if [4]byte{p[0], p[1], p[2], p[3]} != binaryMagic || p[4] != binaryVersion {
+		return errBadPreface
+	}
+	features, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	msg, err := readString(c.r, 1024)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		return errors.New(msg)
+	}
+	accepted := features & c.features
+	peer := legacyBinaryPeerInfo(features, c.bodyName)
+	if accepted&FeaturePeerInfo != 0 {
+		b, err := readString(c.r, MaxPeerInfoSize)
+		if err != nil {
+			return err
+		}
+		if p, ok := parsePeerInfo([]byte(b)); ok {
+			peer = p
+		}
+	}
+	c.peer.Store(peer)
+	atomic.StoreUint64(&c.accepted, accepted)
+	return nil
+}
+
+// PeerInfo 返回服务端的 PeerInfo，收到服务端的 preface 之前返回 false
+func (c *BinaryClientCodec) PeerInfo() (PeerInfo, bool) {
+	p, ok := c.peer.Load().(PeerInfo)
+	return p, ok
+}
+
+func (c *BinaryClientCodec) ReadResponseBody(body any) error {
+	return c.readBody(body)
+}
+
+func (c *BinaryClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// Interning 返回服务端是否接受了方法名驻留
+func (c *BinaryClientCodec) Interning() bool {
+	return atomic.LoadUint64(&c.accepted)&FeatureIntern != 0
+}
+
+func readString(r byteReader, max uint64) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > max {
+		return "", errBadPreface
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// supportedFeatures 本版本支持的功能，服务端接受其中客户端请求的部分
+const supportedFeatures = FeatureIntern | FeatureErrorDetails | FeatureLoadReport | FeatureInternEvict | FeatureChunked | FeaturePeerInfo
+
+// BinaryServerCodec 二进制协议的服务端
+type BinaryServerCodec struct {
+	frameConn
+	gotPreface bool
+	methods    []string // 客户端绑定的方法，下标为 ID
+	accepted   uint64   // 接受的客户端的功能，handshake 之后不再修改
+	closed     bool
+	peerName   string
+	peerSeen   bool         // 是否已经读取过第一个请求，客户端的 PeerInfo 只会出现在第一个请求中
+	peer       atomic.Value // PeerInfo，handshake 之前为 nil
+}
+
+// NewBinaryServerCodec 使用二进制协议的服务端，第一次读取请求时读取客户端的 preface 并回复
+func NewBinaryServerCodec(conn io.ReadWriteCloser, opts ...BinaryServerOption) *BinaryServerCodec {
+	s := &BinaryServerCodec{frameConn: newFrameConn(conn)}
+	s.chunk = newChunkConfig(0, 0)
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *BinaryServerCodec) ReadRequestHeader(r *RequestHeader) error {
+	if !s.gotPreface {
+		if err := s.handshake(); err != nil {
+			return err
+		}
+		s.gotPreface = true
+	}
+	for {
+		frame, a, err := s.nextFrame()
+		if err != nil {
+			return err
+		}
+		if a != nil {
+			*r = a.header.(RequestHeader)
+			s.setAssembled(a)
+			return nil
+		}
+		r.Reset()
+		rest, err := parseRequestHeader(frame, r, &s.methods, s.accepted&FeatureInternEvict != 0)
+		if err != nil {
+			return s.badFrame(frame, err)
+		}
+		if !s.peerSeen {
+			s.peerSeen = true
+			s.takePeerInfo(r)
+		}
+		if _, flags, _ := frameFlags(frame); flags&flagChunked == 0 {
+			s.setRest(rest)
+			return err
+		}
+		if err := s.startAssembly(r.Seq, *r, rest); err != nil {
+			return err
+		}
+	}
+}
+
+// handshake 读取客户端的 preface 并回复，不支持客户端的 body codec 时回复错误
+func (s *BinaryServerCodec) handshake() error {
+	var p [5]byte
+	if _, err := io.ReadFull(s.r, p[:]); err != nil {
+		return err
+	}
+	if [4]byte{p[0], p[1], p[2], p[3]} != binaryMagic || p[4] != binaryVersion {
+		return errBadPreface
+	}
+	features, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return err
+	}
+	name, err := readString(s.r, 256)
+	if err != nil {
+		return err
+	}
+	body, bodyErr := newBodyCodec(name)
+	reply := append(binaryMagic[:0:0], binaryMagic[:]...)
+	reply = append(reply, binaryVersion)
+	supported := supportedFeatures
+	if st, ok := body.(Stateful); bodyErr != nil || ok && st.Stateful() {
+		// 拆分之后 frame 的解码顺序和发送顺序可能不同，有状态的编码无法拆分
+		supported &^= FeatureChunked
+	}
+	s.accepted = features & supported
+	reply = appendUvarint(reply, s.accepted)
+	if bodyErr != nil {
+		reply = appendString(reply, bodyErr.Error())
+	} else {
+		reply = appendString(reply, "")
+	}
+	if s.accepted&FeaturePeerInfo != 0 {
+		reply = appendString(reply, string(appendPeerInfo(nil, localPeerInfo(supportedFeatures, s.peerName))))
+	}
+	s.peer.Store(legacyBinaryPeerInfo(features, name))
+	s.w.Write(reply)
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if bodyErr != nil {
+		return bodyErr
+	}
+	s.body = body
+	return nil
+}
+
+// takePeerInfo 从第一个请求的 metadata 中取出客户端的 PeerInfo
+func (s *BinaryServerCodec) takePeerInfo(r *RequestHeader) {
+	v, ok := r.Metadata[peerInfoKey]
+	if !ok {
+		return
+	}
+	delete(r.Metadata, peerInfoKey)
+	if len(r.Metadata) == 0 {
+		r.Metadata = nil
+	}
+	if p, ok := parsePeerInfo([]byte(v)); ok {
+		s.peer.Store(p)
+	}
+}
+
+// PeerInfo 返回客户端的 PeerInfo，handshake 之前返回 false。客户端的 PeerInfo 随第一个请求发送，
+// 读取第一个请求之前（以及客户端没有发送时）返回根据 preface 推断的值
+func (s *BinaryServerCodec) PeerInfo() (PeerInfo, bool) {
+	p, ok := s.peer.Load().(PeerInfo)
+	return p, ok
+}
+
+func (s *BinaryServerCodec) ReadRequestBody(body any) error {
+	return s.readBody(body)
+}
+
+func (s *BinaryServerCodec) WriteResponse(r *ResponseHeader, body any) error {
+	s.hdr = appendResponseHeader(s.hdr[:0], r, s.accepted)
+	if err := s.writeFrame(body, s.accepted&FeatureChunked != 0); err != nil {
+		s.rwc.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *BinaryServerCodec) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.rwc.Close()
+}
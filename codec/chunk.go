@@ -0,0 +1,425 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// 拆分传输（FeatureChunked）：开启后，编码后超过 chunk 大小的 body 被拆分为多个 frame 发送，
+// 同一个连接上其他消息的 frame 可以插在这些 frame 之间，一个很大的 body 不会阻塞其他调用：
+//
+//	header frame    := length header(flags 带有 flagChunked) data     data 为 body 的第一段（index 0）
+//	fragment frame  := length seq(uvarint) flags(1) index(uvarint) data
+//	  flags         := flagFragment [| fragmentFinal] [| fragmentAbort]
+//
+// fragment 的 seq 和 header frame 相同，index 从 1 开始依次递增，带有 fragmentFinal 的是最后一段。
+// fragment 的 flags 中只有 flagFragment 和下面两个位有意义（和 header 中的低位含义不同）。
+// 发送方放弃剩余的部分时（比如调用被取消）发送一个带有 fragmentAbort、没有 data 的 fragment，接收方丢弃已经
+// 收到的部分，这个消息不会被交给调用方。
+//
+// 接收方按 seq 拼接，最后一段到达之后才返回 header，拼接的 body 不能超过 max body；响应的 reply 实现了 BodySink 时，
+// 每一段到达后直接写入 BodySink，不在内存中拼接。拆分只在 body 的编码无状态时开启（见 Stateful），
+// 否则 frame 的解码顺序和发送顺序不同会破坏编码的状态。客户端收到服务端的 preface 之前发送的请求不会被拆分。
+
+const (
+	// FeatureChunked 拆分传输超过 chunk 大小的 body，见 WithChunking
+	FeatureChunked uint64 = 1 << 4
+	// DefaultChunkSize 默认的 chunk 大小
+	DefaultChunkSize = 1 << 20
+	// DefaultMaxBodySize 默认最多拼接的 body 大小
+	DefaultMaxBodySize = 256 << 20
+)
+
+const (
+	flagChunked  = 1 << 6 // header frame：body 被拆分，之后还有 fragment
+	flagFragment = 1 << 7 // fragment frame
+
+	fragmentFinal = 1 << 0
+	fragmentAbort = 1 << 1
+)
+
+// ErrBodyTooLarge 拆分传输的 body 超过了接收方的 max body，只有这个调用失败，连接仍然可用
+var ErrBodyTooLarge = errors.New("rpc codec: chunked body exceeds the max body size")
+
+// BodySink 由希望以流的方式接收响应 body 的 reply 实现，用于传输很大的数据而不在内存中保存完整的 body。
+// 写入 BodyWriter 的是 body 编码后的原始数据（和 RawMessage.Data 相同），不经过 BodyCodec 解码，
+// 所以服务端通常返回 RawMessage 或者 StreamBody（见 BodySource）。和 RawMessage 一样只在二进制协议并且 body 的编码无状态时可用
+type BodySink interface {
+	BodyWriter() io.Writer
+}
+
+// FragmentWriter 由支持拆分传输的 codec 实现。body 被拆分时 WriteRequest、WriteResponse 只写入 header frame，
+// 剩余的 fragment 由调用方通过 WriteFragment 逐个写入，两次调用之间可以写入其他消息。
+// 和 WriteRequest、WriteResponse 一样不能并发调用
+type FragmentWriter interface {
+	// Pending 返回 seq 是否还有没有写入的 fragment
+	Pending(seq uint64) bool
+	// WriteFragment 写入 seq 的下一个 fragment，返回是否还有剩余的 fragment
+	WriteFragment(seq uint64) (more bool, err error)
+	// AbortFragments 放弃 seq 剩余的 fragment 并通知接收方丢弃已经收到的部分
+	AbortFragments(seq uint64) error
+}
+
+var (
+	_ FragmentWriter = &BinaryClientCodec{}
+	_ FragmentWriter = &BinaryServerCodec{}
+)
+
+// WithChunking 请求开启拆分传输：发送的 body 超过 chunkSize 时拆分发送，接收的被拆分的 body 最多拼接 maxBody 字节。
+// 参数 <= 0 时使用 DefaultChunkSize 和 DefaultMaxBodySize。服务端不支持或者 body 的编码有状态时不拆分
+func WithChunking(chunkSize int, maxBody int64) BinaryOption {
+	return func(c *BinaryClientCodec) {
+		c.features |= FeatureChunked
+		c.chunk = newChunkConfig(chunkSize, maxBody)
+	}
+}
+
+// BinaryServerOption 用于配置二进制协议的服务端
+type BinaryServerOption func(*BinaryServerCodec)
+
+// WithServerChunking 客户端开启了拆分传输时，服务端发送的 body 超过 chunkSize 时拆分发送，接收的被拆分的 body
+// 最多拼接 maxBody 字节。参数 <= 0 时使用 DefaultChunkSize 和 DefaultMaxBodySize，这也是没有设置时的默认值
+func WithServerChunking(chunkSize int, maxBody int64) BinaryServerOption {
+	return func(s *BinaryServerCodec) {
+		s.chunk = newChunkConfig(chunkSize, maxBody)
+	}
+}
+
+type chunkConfig struct {
+	size    int
+	maxBody int64
+}
+
+func newChunkConfig(size int, maxBody int64) chunkConfig {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	if maxBody <= 0 {
+		maxBody = DefaultMaxBodySize
+	}
+	return chunkConfig{size: size, maxBody: maxBody}
+}
+
+// outgoing 还没有写入的 fragment
+type outgoing struct {
+	data []byte
+	src  io.Reader // 不为 nil 时剩余的部分在写入每个 fragment 时从 src 读取到 buf，见 BodySource
+	buf  []byte
+	next uint64 // 下一个 fragment 的 index
+}
+
+// nextChunk 返回下一个 fragment 的数据，final 表示这是最后一段。从 src 读取时返回的数据在下一次调用之前有效
+func (o *outgoing) nextChunk(size int) (data []byte, final bool, err error) {
+	if o.src == nil {
+		data = o.data
+		if len(data) > size {
+			data = data[:size]
+		}
+		o.data = o.data[len(data):]
+		return data, len(o.data) == 0, nil
+	}
+	n, err := io.ReadFull(o.src, o.buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return o.buf[:n], true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("rpc codec: read body source: %w", err)
+	}
+	return o.buf, false, nil
+}
+
+// close 不再需要 src 时关闭它
+func (o *outgoing) close() {
+	if o.src != nil {
+		closeSource(o.src)
+	}
+}
+
+// assembly 正在拼接的消息
+type assembly struct {
+	header  any    // RequestHeader 或者 ResponseHeader
+	buf     []byte // 拼接的 body，写入 sink 或者出错时为 nil
+	sink    io.Writer
+	err     error // 超过 max body 或者写入 sink 失败，拼接完成后由 readBody 返回
+	next    uint64
+	size    int64 // 已经收到的 body 大小
+	framing int64 // 所有 frame 中 body 之外的大小
+	dropped bool  // 接收方已经不需要这个消息，拼接完成后直接丢弃
+}
+
+// chunker 拆分传输的发送和拼接状态，嵌入在 frameConn 中
+type chunker struct {
+	chunk chunkConfig
+	out   map[uint64]*outgoing // 只在写入的一方访问
+
+	mu       sync.Mutex // 保护 in 和 sinks，客户端的 Discard、SetSink 和读取响应在不同的 goroutine 中
+	in       map[uint64]*assembly
+	sinks    map[uint64]io.Writer
+	streamed bool  // 当前消息的 body 已经写入 sink
+	restErr  error // 当前消息的 body 拼接时的错误
+}
+
+// frameFlags 返回 frame 开头的 seq 和 flags
+func frameFlags(frame []byte) (seq uint64, flags byte, ok bool) {
+	seq, n := binary.Uvarint(frame)
+	if n <= 0 || n >= len(frame) {
+		return 0, 0, false
+	}
+	return seq, frame[n], true
+}
+
+// writeChunked 写入 header frame 和 data 的第一段，保存剩余的部分。data 属于调用方时 owned 为 false，需要复制
+func (f *frameConn) writeChunked(data []byte, owned bool) error {
+	first, rest := data[:f.chunk.size], data[f.chunk.size:]
+	if !owned {
+		rest = append([]byte(nil), rest...)
+	}
+	f.startOutgoing(&outgoing{data: rest, next: 1})
+	return f.writeRaw(first)
+}
+
+// startOutgoing 将 f.hdr 标记为被拆分的消息，并保存剩余的部分 o
+func (f *frameConn) startOutgoing(o *outgoing) {
+	seq, n := binary.Uvarint(f.hdr)
+	f.hdr[n] |= flagChunked
+	if f.out == nil {
+		f.out = make(map[uint64]*outgoing)
+	}
+	f.out[seq] = o
+}
+
+// writeRaw 写入 f.hdr 和 data 组成的 frame 并 flush
+func (f *frameConn) writeRaw(data []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(f.hdr)+len(data)))
+	f.w.Write(lenBuf[:n])
+	f.w.Write(f.hdr)
+	f.w.Write(data)
+	f.writeSize = MessageSize{Header: int64(n + len(f.hdr)), Body: int64(len(data)), UncompressedBody: int64(len(data))}
+	return f.w.Flush()
+}
+
+func (f *frameConn) pending(seq uint64) bool {
+	_, ok := f.out[seq]
+	return ok
+}
+
+func (f *frameConn) writeFragment(seq uint64) (more bool, err error) {
+	o, ok := f.out[seq]
+	if !ok {
+		return false, nil
+	}
+	data, final, err := o.nextChunk(f.chunk.size)
+	if err != nil {
+		// 数据不完整，无法继续发送这个消息，调用方会关闭连接
+		delete(f.out, seq)
+		o.close()
+		return false, err
+	}
+	var flags byte = flagFragment
+	if final {
+		flags |= fragmentFinal
+		delete(f.out, seq)
+		o.close()
+	}
+	f.hdr = appendUvarint(append(appendUvarint(f.hdr[:0], seq), flags), o.next)
+	o.next++
+	return flags&fragmentFinal == 0, f.writeRaw(data)
+}
+
+func (f *frameConn) abortFragments(seq uint64) error {
+	o, ok := f.out[seq]
+	if !ok {
+		return nil
+	}
+	delete(f.out, seq)
+	o.close()
+	f.hdr = appendUvarint(append(appendUvarint(f.hdr[:0], seq), flagFragment|fragmentAbort), o.next)
+	return f.writeRaw(nil)
+}
+
+// startAssembly 收到被拆分的消息的 header frame，header 为解析出的 header，rest 为 body 的第一段
+func (f *frameConn) startAssembly(seq uint64, header any, rest []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.in == nil {
+		f.in = make(map[uint64]*assembly)
+	}
+	if _, ok := f.in[seq]; ok {
+		return fmt.Errorf("rpc codec: duplicate chunked message %d", seq)
+	}
+	a := &assembly{header: header, next: 1, framing: f.frameSize - int64(len(rest))}
+	if w, ok := f.sinks[seq]; ok {
+		a.sink = w
+		delete(f.sinks, seq)
+	}
+	f.in[seq] = a
+	f.appendFragment(a, rest)
+	return nil
+}
+
+// appendFragment 将 data 加入 a，调用方持有 mu
+func (f *frameConn) appendFragment(a *assembly, data []byte) {
+	a.size += int64(len(data))
+	if a.err != nil || a.dropped {
+		return
+	}
+	if a.sink != nil {
+		if _, err := a.sink.Write(data); err != nil {
+			a.err = err
+		}
+		return
+	}
+	if a.size > f.chunk.maxBody {
+		a.err = ErrBodyTooLarge
+		a.buf = nil
+		return
+	}
+	a.buf = append(a.buf, data...)
+}
+
+// addFragment 处理一个 fragment frame，消息拼接完成时返回它。不认识的 seq 的 fragment 直接丢弃，
+// 它属于已经被丢弃的消息
+func (f *frameConn) addFragment(seq uint64, flags byte, frame []byte) (*assembly, error) {
+	h := headerReader{b: frame}
+	h.uvarint()
+	h.byte()
+	index, err := h.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a, ok := f.in[seq]
+	if !ok {
+		return nil, nil
+	}
+	if index != a.next {
+		return nil, fmt.Errorf("rpc codec: fragment %d of message %d out of order, want %d", index, seq, a.next)
+	}
+	a.next++
+	a.framing += f.frameSize - int64(len(h.b))
+	if flags&fragmentAbort != 0 {
+		delete(f.in, seq)
+		return nil, nil
+	}
+	f.appendFragment(a, h.b)
+	if flags&fragmentFinal == 0 {
+		return nil, nil
+	}
+	delete(f.in, seq)
+	if a.dropped {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// nextFrame 读取下一个不是 fragment 的 frame，或者返回拼接完成的消息
+func (f *frameConn) nextFrame() ([]byte, *assembly, error) {
+	for {
+		frame, err := f.readFrame()
+		if err != nil {
+			return nil, nil, err
+		}
+		seq, flags, ok := frameFlags(frame)
+		if !ok || flags&flagFragment == 0 {
+			return frame, nil, nil
+		}
+		a, err := f.addFragment(seq, flags, frame)
+		if err != nil || a != nil {
+			return nil, a, err
+		}
+	}
+}
+
+// setAssembled 将拼接完成的 a 作为当前的消息
+func (f *frameConn) setAssembled(a *assembly) {
+	f.rest = a.buf
+	f.streamed = a.sink != nil
+	f.restErr = a.err
+	f.readSize = MessageSize{Header: a.framing, Body: a.size, UncompressedBody: a.size}
+}
+
+// chunkedBody 返回当前的消息是否已经在拼接时处理过 body，以及处理的结果
+func (f *frameConn) chunkedBody() (handled bool, err error) {
+	handled, err = f.streamed || f.restErr != nil, f.restErr
+	f.streamed, f.restErr = false, nil
+	return handled, err
+}
+
+// Pending 实现 FragmentWriter
+func (c *BinaryClientCodec) Pending(seq uint64) bool {
+	return c.pending(seq)
+}
+
+// WriteFragment 实现 FragmentWriter
+func (c *BinaryClientCodec) WriteFragment(seq uint64) (bool, error) {
+	return c.writeFragment(seq)
+}
+
+// AbortFragments 实现 FragmentWriter
+func (c *BinaryClientCodec) AbortFragments(seq uint64) error {
+	return c.abortFragments(seq)
+}
+
+// Chunking 返回服务端是否接受了拆分传输
+func (c *BinaryClientCodec) Chunking() bool {
+	return c.chunking()
+}
+
+// SetSink 响应 body 被拆分时，seq 的每一段到达后直接写入 w，需要在发送请求之前调用。可以和读取响应并发调用
+func (c *BinaryClientCodec) SetSink(seq uint64, w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sinks == nil {
+		c.sinks = make(map[uint64]io.Writer)
+	}
+	c.sinks[seq] = w
+}
+
+// Discard 调用方不再需要 seq 的响应时调用（比如调用被取消），丢弃已经拼接的部分，之后收到的部分也不再保存或者写入 sink。
+// 返回之后不会再写入 SetSink 设置的 w。可以和读取响应并发调用
+func (c *BinaryClientCodec) Discard(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sinks, seq)
+	if a, ok := c.in[seq]; ok {
+		a.dropped = true
+		a.buf, a.sink = nil, nil
+	}
+}
+
+// takeSink 取出 seq 通过 SetSink 设置的 w，没有拆分的响应到达时调用
+func (c *BinaryClientCodec) takeSink(seq uint64) io.Writer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := c.sinks[seq]
+	delete(c.sinks, seq)
+	return w
+}
+
+// Pending 实现 FragmentWriter
+func (s *BinaryServerCodec) Pending(seq uint64) bool {
+	return s.pending(seq)
+}
+
+// WriteFragment 实现 FragmentWriter，写入失败时关闭连接
+func (s *BinaryServerCodec) WriteFragment(seq uint64) (bool, error) {
+	more, err := s.writeFragment(seq)
+	if err != nil {
+		s.rwc.Close()
+	}
+	return more, err
+}
+
+// AbortFragments 实现 FragmentWriter
+func (s *BinaryServerCodec) AbortFragments(seq uint64) error {
+	err := s.abortFragments(seq)
+	if err != nil {
+		s.rwc.Close()
+	}
+	return err
+}
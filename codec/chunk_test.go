@@ -0,0 +1,239 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+type sinkReply struct {
+	bytes.Buffer
+}
+
+func (s *sinkReply) BodyWriter() io.Writer { return &s.Buffer }
+
+// chunkedPair 返回完成了 handshake 的、开启了拆分传输的一对 codec
+func chunkedPair(t *testing.T, chunkSize int, maxBody int64, opts ...BinaryServerOption) (*BinaryClientCodec, *BinaryServerCodec) {
+	t.Helper()
+	c, s := pair()
+	cc := NewBinaryClientCodec(c, WithBodyCodec("json"), WithChunking(chunkSize, maxBody))
+	sc := NewBinaryServerCodec(s, opts...)
+	roundTrip(t, cc, sc, &RequestHeader{ServiceMethod: "A.B"}, &ResponseHeader{})
+	if !cc.Chunking() {
+		t.Fatal("chunking not accepted")
+	}
+	return cc, sc
+}
+
+func blob(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func readRequest(t *testing.T, sc *BinaryServerCodec) (RequestHeader, Payload) {
+	t.Helper()
+	var req RequestHeader
+	if err := sc.ReadRequestHeader(&req); err != nil {
+		t.Fatal(err)
+	}
+	var p Payload
+	if err := sc.ReadRequestBody(&p); err != nil {
+		t.Fatal(err)
+	}
+	return req, p
+}
+
+// TestChunkedInterleaving 拆分的请求的 fragment 之间可以发送其他请求，服务端先收到完整的小请求
+func TestChunkedInterleaving(t *testing.T) {
+	cc, sc := chunkedPair(t, 32, 0)
+	big := Payload{Data: blob(100)}
+	if err := cc.WriteRequest(&RequestHeader{ServiceMethod: "Blob.Put", Seq: 10, Metadata: map[string]string{"k": "v"}}, &big); err != nil {
+		t.Fatal(err)
+	}
+	if !cc.Pending(10) {
+		t.Fatal("big request not chunked")
+	}
+	small := Payload{Data: []byte("small")}
+	var order []uint64
+	for seq := uint64(11); cc.Pending(10); seq++ {
+		if err := cc.WriteRequest(&RequestHeader{ServiceMethod: "Blob.Small", Seq: seq}, &small); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cc.WriteFragment(10); err != nil {
+			t.Fatal(err)
+		}
+		req, p := readRequest(t, sc)
+		order = append(order, req.Seq)
+		if req.Seq != seq || !bytes.Equal(p.Data, small.Data) {
+			t.Fatalf("got %+v %q, want small request %d", req, p.Data, seq)
+		}
+	}
+	req, p := readRequest(t, sc)
+	if req.Seq != 10 || req.ServiceMethod != "Blob.Put" || req.Metadata["k"] != "v" || !bytes.Equal(p.Data, big.Data) {
+		t.Fatalf("got %+v %v", req, p.Data)
+	}
+	if len(order) < 4 || len(sc.in) != 0 {
+		t.Fatalf("order %v, %d assemblies", order, len(sc.in))
+	}
+	if size := sc.LastReadSize(); size.Body < 100 || size.Header == 0 {
+		t.Fatalf("read size %+v", size)
+	}
+}
+
+// TestChunkedOutOfOrder fragment 的 index 不连续时认为连接已经损坏
+func TestChunkedOutOfOrder(t *testing.T) {
+	cc, sc := chunkedPair(t, 32, 0)
+	if err := cc.WriteRequest(&RequestHeader{ServiceMethod: "Blob.Put", Seq: 10}, &Payload{Data: blob(100)}); err != nil {
+		t.Fatal(err)
+	}
+	// 跳过 index 1
+	cc.out[10].next++
+	if _, err := cc.WriteFragment(10); err != nil {
+		t.Fatal(err)
+	}
+	var req RequestHeader
+	if err := sc.ReadRequestHeader(&req); err == nil {
+		t.Fatalf("out of order fragment accepted: %+v", req)
+	}
+}
+
+// TestChunkedAbort 发送方放弃剩余的 fragment 后，接收方丢弃已经收到的部分
+func TestChunkedAbort(t *testing.T) {
+	cc, sc := chunkedPair(t, 32, 0)
+	if err := cc.WriteRequest(&RequestHeader{ServiceMethod: "Blob.Put", Seq: 10}, &Payload{Data: blob(100)}); err != nil {
+		t.Fatal(err)
+	}
+	cc.WriteFragment(10)
+	if err := cc.AbortFragments(10); err != nil {
+		t.Fatal(err)
+	}
+	if cc.Pending(10) {
+		t.Fatal("fragments pending after abort")
+	}
+	cc.WriteRequest(&RequestHeader{ServiceMethod: "Blob.Small", Seq: 11}, &Payload{Data: []byte("small")})
+	if req, _ := readRequest(t, sc); req.Seq != 11 {
+		t.Fatalf("got request %d", req.Seq)
+	}
+	if len(sc.in) != 0 {
+		t.Fatalf("%d assemblies after abort", len(sc.in))
+	}
+}
+
+// writeResponse 服务端发送 seq 的响应，被拆分时写入所有的 fragment
+func writeResponse(t *testing.T, sc *BinaryServerCodec, seq uint64, body any) {
+	t.Helper()
+	if err := sc.WriteResponse(&ResponseHeader{Seq: seq}, body); err != nil {
+		t.Fatal(err)
+	}
+	for more := sc.Pending(seq); more; {
+		var err error
+		if more, err = sc.WriteFragment(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestChunkedSink reply 实现了 BodySink 时 fragment 直接写入 sink，不在 codec 中拼接
+func TestChunkedSink(t *testing.T) {
+	cc, sc := chunkedPair(t, 32, 32, WithServerChunking(64, 0))
+	data := blob(1000)
+	sink := new(sinkReply)
+	cc.SetSink(10, sink.BodyWriter())
+	writeResponse(t, sc, 10, RawMessage{Codec: "json", Data: data})
+
+	var resp ResponseHeader
+	if err := cc.ReadResponseHeader(&resp); err != nil || resp.Seq != 10 {
+		t.Fatalf("ReadResponseHeader() = %+v, %v", resp, err)
+	}
+	// 超过 maxBody 的数据写入 sink 时不受限制
+	if err := cc.ReadResponseBody(sink); err != nil || !bytes.Equal(sink.Bytes(), data) {
+		t.Fatalf("ReadResponseBody() = %v, sink %d bytes", err, sink.Len())
+	}
+
+	// 没有拆分的响应同样写入 sink
+	small := new(sinkReply)
+	writeResponse(t, sc, 11, RawMessage{Codec: "json", Data: []byte("small")})
+	cc.ReadResponseHeader(&resp)
+	if err := cc.ReadResponseBody(small); err != nil || small.String() != "small" {
+		t.Fatalf("ReadResponseBody() = %v, %q", err, small.String())
+	}
+}
+
+// TestChunkedMaxBody 拼接的 body 超过限制时只有这个响应失败
+func TestChunkedMaxBody(t *testing.T) {
+	cc, sc := chunkedPair(t, 32, 32, WithServerChunking(64, 0))
+	writeResponse(t, sc, 10, &Payload{Data: blob(100)})
+	writeResponse(t, sc, 11, &Payload{Data: []byte("ok")})
+	var resp ResponseHeader
+	var p Payload
+	if err := cc.ReadResponseHeader(&resp); err != nil || resp.Seq != 10 {
+		t.Fatalf("ReadResponseHeader() = %+v, %v", resp, err)
+	}
+	if err := cc.ReadResponseBody(&p); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("ReadResponseBody() = %v", err)
+	}
+	if err := cc.ReadResponseHeader(&resp); err != nil || resp.Seq != 11 {
+		t.Fatalf("ReadResponseHeader() = %+v, %v", resp, err)
+	}
+	if err := cc.ReadResponseBody(&p); err != nil || string(p.Data) != "ok" {
+		t.Fatalf("ReadResponseBody() = %v, %q", err, p.Data)
+	}
+}
+
+// TestChunkedDiscard 调用被取消后，客户端丢弃已经拼接的部分，剩余的 fragment 到达后也不会交给调用方
+func TestChunkedDiscard(t *testing.T) {
+	cc, sc := chunkedPair(t, 32, 0, WithServerChunking(64, 0))
+	sink := new(sinkReply)
+	cc.SetSink(10, sink.BodyWriter())
+	if err := sc.WriteResponse(&ResponseHeader{Seq: 10}, RawMessage{Codec: "json", Data: blob(100)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.WriteResponse(&ResponseHeader{Seq: 12}, RawMessage{Codec: "json", Data: blob(100)}); err != nil {
+		t.Fatal(err)
+	}
+	writeResponse(t, sc, 11, &Payload{Data: []byte("ok")})
+	var resp ResponseHeader
+	if err := cc.ReadResponseHeader(&resp); err != nil || resp.Seq != 11 {
+		t.Fatalf("ReadResponseHeader() = %+v, %v", resp, err)
+	}
+	cc.ReadResponseBody(nil)
+	if len(cc.in) != 2 || sink.Len() != 64 {
+		t.Fatalf("%d assemblies, sink %d bytes", len(cc.in), sink.Len())
+	}
+
+	cc.Discard(10)
+	cc.Discard(12)
+	if cc.in[12].buf != nil {
+		t.Fatal("buffer kept after Discard")
+	}
+	for _, seq := range []uint64{10, 12} {
+		for more := true; more; {
+			more, _ = sc.WriteFragment(seq)
+		}
+	}
+	writeResponse(t, sc, 13, &Payload{Data: []byte("ok")})
+	if err := cc.ReadResponseHeader(&resp); err != nil || resp.Seq != 13 {
+		t.Fatalf("ReadResponseHeader() = %+v, %v", resp, err)
+	}
+	if len(cc.in) != 0 || sink.Len() != 64 {
+		t.Fatalf("%d assemblies, sink %d bytes after Discard", len(cc.in), sink.Len())
+	}
+}
+
+// TestChunkedStatefulBody gob 编码有状态，不开启拆分传输
+func TestChunkedStatefulBody(t *testing.T) {
+	c, s := pair()
+	cc := NewBinaryClientCodec(c, WithChunking(16, 0))
+	sc := NewBinaryServerCodec(s)
+	roundTrip(t, cc, sc, &RequestHeader{ServiceMethod: "A.B"}, &ResponseHeader{})
+	if cc.Chunking() {
+		t.Fatal("chunking accepted with gob body")
+	}
+	if err := cc.WriteRequest(&RequestHeader{ServiceMethod: "A.B", Seq: 1}, &Payload{Data: blob(100)}); err != nil || cc.Pending(1) {
+		t.Fatalf("WriteRequest() = %v, pending %v", err, cc.Pending(1))
+	}
+}
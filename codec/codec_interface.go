@@ -1,5 +1,7 @@
 package codec
 
+import "math"
+
 type ServerCodec interface {
 	ReadRequestHeader(header *RequestHeader) error
 	ReadRequestBody(any) error
@@ -14,24 +16,48 @@ type ClientCodec interface {
 	Close() error
 }
 
+// RequestHeader 和 ResponseHeader 使用 gob 编码时和 net/rpc 的 Request、Response 兼容：gob 按照字段名匹配，
+// 对方没有的字段（Metadata、Code、Details、Load）会被忽略，所以 appleseed 的客户端可以调用 net/rpc 的服务端，
+// net/rpc 的客户端也可以调用 appleseed 的服务端（只支持直接建立的连接，不支持 rpc.DialHTTP）。
+// ServiceMethod、Seq、Error 的名字和类型不能修改
 type RequestHeader struct {
 	ServiceMethod string
 	Seq           uint64
+	Metadata      map[string]string // 请求的元数据，比如 request id
 }
 
 func (r *RequestHeader) Reset() {
 	r.Seq = 0
 	r.ServiceMethod = ""
+	r.Metadata = nil
 }
 
+// GoAwaySeq 服务端发送 GOAWAY 控制帧时响应使用的 seq，客户端的 seq 从 0 开始递增，不会用到它。
+// 不认识它的客户端会将其当作没有对应调用的响应丢弃
+const GoAwaySeq = math.MaxUint64
+
 type ResponseHeader struct {
 	ServiceMethod string
 	Seq           uint64
-	Error         string
+	Error         string            // 错误信息，旧版本的服务端只设置这个字段
+	Code          uint32            // 错误码（status.Code），Error 不为空而 Code 为 0 时表示 Unknown
+	Details       map[string]string // 错误的附加信息
+	Metadata      map[string]string // 响应的元数据，比如限流时建议的重试间隔
+	Load          *LoadReport       // 服务端上报的负载，没有开启时为 nil
+}
+
+// LoadReport 服务端在响应中上报的负载，客户端的负载均衡器据此区分网络慢和服务端过载
+type LoadReport struct {
+	Inflight    uint32 // 服务端正在处理的请求数，包括其他客户端的请求
+	Utilization uint32 // 服务端计算的利用率，0~100
 }
 
 func (r *ResponseHeader) Reset() {
 	r.Seq = 0
 	r.ServiceMethod = ""
 	r.Error = ""
+	r.Code = 0
+	r.Details = nil
+	r.Metadata = nil
+	r.Load = nil
 }
@@ -0,0 +1,78 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+)
+
+// CountConn 统计连接上读写的字节数。它实现了 io.ByteReader，gob 不会再套一层带预读的 bufio，
+// 所以读取的字节数就是 gob 实际解码消费的字节数，可以用来统计每个消息的大小。
+// 读取和写入的计数分别只能在同一个 goroutine 中访问（或者由调用方加锁）
+type CountConn struct {
+	io.ReadWriteCloser
+	r       *bufio.Reader
+	read    int64
+	written int64
+	capR    io.Writer // 不为 nil 时读取的数据同时写入 capR，见 CaptureRead
+	capW    io.Writer
+	one     [1]byte // ReadByte 写入 capR 时使用，避免每个字节分配一次
+}
+
+func NewCountConn(conn io.ReadWriteCloser) *CountConn {
+	return &CountConn{ReadWriteCloser: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *CountConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.capR != nil && n > 0 {
+		c.capR.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *CountConn) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.read++
+		if c.capR != nil {
+			c.one[0] = b
+			c.capR.Write(c.one[:])
+		}
+	}
+	return b, err
+}
+
+// Peek 返回接下来的 n 个字节但不读取它们，不计入读取的字节数
+func (c *CountConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *CountConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.written += int64(n)
+	if c.capW != nil && n > 0 {
+		c.capW.Write(p[:n])
+	}
+	return n, err
+}
+
+// CaptureRead 之后读取的数据同时写入 w，w 为 nil 时停止。和读取的计数一样只能在读取的 goroutine 中调用
+func (c *CountConn) CaptureRead(w io.Writer) {
+	c.capR = w
+}
+
+// CaptureWrite 之后写入连接的数据同时写入 w，w 为 nil 时停止。和写入的计数一样需要和写入互斥
+func (c *CountConn) CaptureWrite(w io.Writer) {
+	c.capW = w
+}
+
+// BytesRead 返回已经读取的字节数
+func (c *CountConn) BytesRead() int64 {
+	return c.read
+}
+
+// BytesWritten 返回已经写入的字节数
+func (c *CountConn) BytesWritten() int64 {
+	return c.written
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"io"
 	"log"
+	"reflect"
 )
 
 type GobServerCodec struct {
@@ -13,15 +14,18 @@ type GobServerCodec struct {
 	decoder *gob.Decoder       // gob 解码
 	encoder *gob.Encoder       // gob 编码
 	closed  bool               // 防止重复关闭
+	sizeCounter
 }
 
 func NewGobServerCodec(conn io.ReadWriteCloser) ServerCodec {
 	buf := bufio.NewWriter(conn)
+	cr, cw := newCountReader(conn), &countWriter{w: buf}
 	return &GobServerCodec{
-		conn:    conn,
-		buf:     buf,
-		decoder: gob.NewDecoder(conn), // 从 conn 中读取数据，并用 gob 解析出来
-		encoder: gob.NewEncoder(buf),  // 将数据写入到 buf 中，并用 gob 编码数据
+		conn:        conn,
+		buf:         buf,
+		decoder:     gob.NewDecoder(cr), // 从 conn 中读取数据，并用 gob 解析出来
+		encoder:     gob.NewEncoder(cw), // 将数据写入到 buf 中，并用 gob 编码数据
+		sizeCounter: sizeCounter{cr: cr, cw: cw},
 	}
 }
 
@@ -35,24 +39,38 @@ func (g *GobServerCodec) Close() error {
 
 // ReadRequestHeader 从 conn 的数据中，使用 gob 解析出 header 部分
 func (g *GobServerCodec) ReadRequestHeader(req *RequestHeader) error {
-	return g.decoder.Decode(req)
+	n := g.cr.n
+	err := g.decoder.Decode(req)
+	g.readSize = MessageSize{Header: g.cr.n - n}
+	return err
 }
 
-// ReadRequestBody 从 conn 的数据中，使用 gob 解析出 body 部分
+// ReadRequestBody 从 conn 的数据中，使用 gob 解析出 body 部分，不支持 RawMessage
 func (g *GobServerCodec) ReadRequestBody(body any) error {
+	n := g.cr.n
+	defer func() { g.readSize.Body, g.readSize.UncompressedBody = g.cr.n-n, g.cr.n-n }()
+	if _, ok := body.(*RawMessage); ok {
+		g.decoder.DecodeValue(reflect.Value{}) // 丢弃 body
+		return ErrRawUnsupported
+	}
 	return g.decoder.Decode(body)
 }
 
 // WriteResponse 使用 gob 对 head 和 body 进行编码，并写入到 conn 中
 func (g *GobServerCodec) WriteResponse(resp *ResponseHeader, body any) error {
+	n := g.cw.n
 	defer func() {
 		err := g.buf.Flush() // 最后写入数据到 conn
 		if err != nil {
 			g.conn.Close()
 		}
+		g.writeSize.Body = g.cw.n - n - g.writeSize.Header
+		g.writeSize.UncompressedBody = g.writeSize.Body
 	}()
 
-	if err := g.encoder.Encode(resp); err != nil {
+	err := g.encoder.Encode(resp)
+	g.writeSize.Header = g.cw.n - n
+	if err != nil {
 		log.Println("rpc codec: gob error encoding header:", err)
 		return err
 	}
@@ -70,20 +88,37 @@ type GobClientCodec struct {
 	dec    *gob.Decoder
 	enc    *gob.Encoder
 	encBuf *bufio.Writer
+	sizeCounter
 }
 
 func NewGobClientCodec(conn io.ReadWriteCloser) *GobClientCodec {
 	buf := bufio.NewWriter(conn)
+	cr, cw := newCountReader(conn), &countWriter{w: conn}
 	return &GobClientCodec{
-		rwc:    conn,
-		dec:    gob.NewDecoder(conn),
-		enc:    gob.NewEncoder(conn),
-		encBuf: buf,
+		rwc:         conn,
+		dec:         gob.NewDecoder(cr),
+		enc:         gob.NewEncoder(cw),
+		encBuf:      buf,
+		sizeCounter: sizeCounter{cr: cr, cw: cw},
 	}
 }
 
 func (c *GobClientCodec) WriteRequest(r *RequestHeader, body any) (err error) {
-	if err = c.enc.Encode(r); err != nil {
+	if _, ok := asRawMessage(body); ok {
+		return ErrRawUnsupported
+	}
+	if src, ok := body.(BodySource); ok {
+		closeSource(src.BodyReader())
+		return ErrRawUnsupported
+	}
+	n := c.cw.n
+	defer func() {
+		c.writeSize.Body = c.cw.n - n - c.writeSize.Header
+		c.writeSize.UncompressedBody = c.writeSize.Body
+	}()
+	err = c.enc.Encode(r)
+	c.writeSize.Header = c.cw.n - n
+	if err != nil {
 		return
 	}
 	if err = c.enc.Encode(body); err != nil {
@@ -93,10 +128,19 @@ func (c *GobClientCodec) WriteRequest(r *RequestHeader, body any) (err error) {
 }
 
 func (c *GobClientCodec) ReadResponseHeader(r *ResponseHeader) error {
-	return c.dec.Decode(r)
+	n := c.cr.n
+	err := c.dec.Decode(r)
+	c.readSize = MessageSize{Header: c.cr.n - n}
+	return err
 }
 
 func (c *GobClientCodec) ReadResponseBody(body any) error {
+	n := c.cr.n
+	defer func() { c.readSize.Body, c.readSize.UncompressedBody = c.cr.n-n, c.cr.n-n }()
+	if _, ok := body.(*RawMessage); ok {
+		c.dec.DecodeValue(reflect.Value{}) // 丢弃 body
+		return ErrRawUnsupported
+	}
 	return c.dec.Decode(body)
 }
 
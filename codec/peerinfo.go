@@ -0,0 +1,181 @@
+package codec
+
+import (
+	"runtime/debug"
+	"sort"
+	"sync"
+)
+
+// 握手时交换的 PeerInfo：客户端在 preface 中请求 FeaturePeerInfo，服务端接受时在自己的 preface 最后附上它的
+// PeerInfo。客户端的 PeerInfo 放在第一个请求的 metadata 中（key 为 peerInfoKey），服务端读取后从 metadata 中
+// 删除，不会交给 handler；旧版本的服务端不认识这个 key，只会把它当作普通的 metadata。
+//
+//	server preface := magic(4) version(1) features(uvarint) error(string) [peer-info(string)]
+//	peer-info      := version(string) protocol(uvarint) features(uvarint) count(uvarint) count × codec(string) name(string)
+//
+// peer-info 不能超过 MaxPeerInfoSize，无法解析时当作对端没有发送。之后的版本可以在最后增加字段，解析时忽略
+
+// FeaturePeerInfo 交换 PeerInfo，客户端总是开启
+const FeaturePeerInfo uint64 = 1 << 5
+
+const (
+	// MaxPeerInfoSize 编码后的 PeerInfo 的最大长度
+	MaxPeerInfoSize = 1024
+	// maxPeerName PeerInfo.Name、PeerInfo.Version 的最大长度，超过时截断
+	maxPeerName = 128
+	// maxPeerCodecs PeerInfo.Codecs 最多的数量，超过时只发送前面的部分
+	maxPeerCodecs = 16
+)
+
+// peerInfoKey 客户端的 PeerInfo 在第一个请求的 metadata 中的 key，以 ':' 开头避免和用户的 key 冲突
+const peerInfoKey = ":peer-info"
+
+// PeerInfo 连接对端的版本和能力，用于排查不同版本之间的兼容问题
+type PeerInfo struct {
+	Version  string   // 对端使用的 appleseed 的模块版本，无法得知时为空
+	Protocol int      // 协议版本，gob 为 0
+	Features uint64   // 对端支持的功能（Feature*），不是本连接协商的结果
+	Codecs   []string // 对端支持的 body 编码
+	Name     string   // 对端的名字，见 WithPeerName、WithServerPeerName
+	Legacy   bool     // 对端没有发送 PeerInfo（旧版本或者 gob），以上字段是根据握手推断的保守值
+}
+
+// PeerInfoer 由握手时交换 PeerInfo 的 codec 实现，没有实现的 codec 的对端见 LegacyPeerInfo
+type PeerInfoer interface {
+	// PeerInfo 返回对端的 PeerInfo，握手完成之前返回 false
+	PeerInfo() (PeerInfo, bool)
+}
+
+var (
+	_ PeerInfoer = &BinaryClientCodec{}
+	_ PeerInfoer = &BinaryServerCodec{}
+)
+
+// LegacyPeerInfo 没有握手的对端（gob 协议）的 PeerInfo：只支持 gob 编码，不支持任何功能
+func LegacyPeerInfo() PeerInfo {
+	return PeerInfo{Codecs: []string{"gob"}, Legacy: true}
+}
+
+// legacyBinaryPeerInfo 没有发送 PeerInfo 的二进制协议的对端：只知道它接受的功能和正在使用的 body 编码
+func legacyBinaryPeerInfo(features uint64, body string) PeerInfo {
+	return PeerInfo{Protocol: binaryVersion, Features: features, Codecs: []string{body}, Legacy: true}
+}
+
+// WithPeerName 随 PeerInfo 发送给服务端的名字，比如服务名或者主机名
+func WithPeerName(name string) BinaryOption {
+	return func(c *BinaryClientCodec) {
+		c.peerName = name
+	}
+}
+
+// WithServerPeerName 同 WithPeerName，用于服务端
+func WithServerPeerName(name string) BinaryServerOption {
+	return func(s *BinaryServerCodec) {
+		s.peerName = name
+	}
+}
+
+var (
+	versionOnce sync.Once
+	version     string
+)
+
+// moduleVersion 返回编译信息中 appleseed 的模块版本，作为主模块编译（比如运行本模块的测试）时为 "(devel)"
+func moduleVersion() string {
+	versionOnce.Do(func() {
+		const path = "github.com/YOUSEEBIGGIRL/appleseed"
+		bi, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		if bi.Main.Path == path {
+			version = bi.Main.Version
+			return
+		}
+		for _, dep := range bi.Deps {
+			if dep.Path == path {
+				version = dep.Version
+				if dep.Replace != nil {
+					version = dep.Replace.Version
+				}
+				return
+			}
+		}
+	})
+	return version
+}
+
+// localPeerInfo 返回本端的 PeerInfo，features 为本端支持的功能
+func localPeerInfo(features uint64, name string) PeerInfo {
+	bodyMu.RLock()
+	codecs := make([]string, 0, len(bodyCodecs))
+	for n := range bodyCodecs {
+		codecs = append(codecs, n)
+	}
+	bodyMu.RUnlock()
+	sort.Strings(codecs)
+	return PeerInfo{Version: moduleVersion(), Protocol: binaryVersion, Features: features, Codecs: codecs, Name: name}
+}
+
+// appendPeerInfo 编码 p，超出 MaxPeerInfoSize 的部分（名字过长、编码过多）被丢弃
+func appendPeerInfo(b []byte, p PeerInfo) []byte {
+	if len(p.Name) > maxPeerName {
+		p.Name = p.Name[:maxPeerName]
+	}
+	if len(p.Version) > maxPeerName {
+		p.Version = p.Version[:maxPeerName]
+	}
+	if len(p.Codecs) > maxPeerCodecs {
+		p.Codecs = p.Codecs[:maxPeerCodecs]
+	}
+	for {
+		e := appendString(nil, p.Version)
+		e = appendUvarint(e, uint64(p.Protocol))
+		e = appendUvarint(e, p.Features)
+		e = appendUvarint(e, uint64(len(p.Codecs)))
+		for _, c := range p.Codecs {
+			e = appendString(e, c)
+		}
+		e = appendString(e, p.Name)
+		if len(e) <= MaxPeerInfoSize || len(p.Codecs) == 0 {
+			return append(b, e...)
+		}
+		p.Codecs = p.Codecs[:len(p.Codecs)-1]
+	}
+}
+
+// parsePeerInfo 解析 appendPeerInfo 编码的 PeerInfo
+func parsePeerInfo(b []byte) (PeerInfo, bool) {
+	if len(b) > MaxPeerInfoSize {
+		return PeerInfo{}, false
+	}
+	h := &headerReader{b: b}
+	var p PeerInfo
+	var err error
+	if p.Version, err = h.string(); err != nil || len(p.Version) > maxPeerName {
+		return PeerInfo{}, false
+	}
+	protocol, err := h.uvarint()
+	if err != nil || protocol > 255 {
+		return PeerInfo{}, false
+	}
+	p.Protocol = int(protocol)
+	if p.Features, err = h.uvarint(); err != nil {
+		return PeerInfo{}, false
+	}
+	n, err := h.uvarint()
+	if err != nil || n > maxPeerCodecs {
+		return PeerInfo{}, false
+	}
+	for i := uint64(0); i < n; i++ {
+		c, err := h.string()
+		if err != nil {
+			return PeerInfo{}, false
+		}
+		p.Codecs = append(p.Codecs, c)
+	}
+	if p.Name, err = h.string(); err != nil || len(p.Name) > maxPeerName {
+		return PeerInfo{}, false
+	}
+	return p, true
+}
@@ -0,0 +1,83 @@
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestPeerInfoExchange 双方在握手时交换 PeerInfo，客户端的 PeerInfo 不会出现在交给 handler 的 metadata 中
+func TestPeerInfoExchange(t *testing.T) {
+	c, s := pair()
+	cc := NewBinaryClientCodec(c, WithBodyCodec("json"), WithPeerName("orders-client"))
+	sc := NewBinaryServerCodec(s, WithServerPeerName("orders-1"))
+	if _, ok := cc.PeerInfo(); ok {
+		t.Fatal("client has peer info before the handshake")
+	}
+	req, _, _ := roundTrip(t, cc, sc, &RequestHeader{ServiceMethod: "A.B", Seq: 1, Metadata: map[string]string{"k": "v"}}, &ResponseHeader{})
+	if len(req.Metadata) != 1 || req.Metadata["k"] != "v" {
+		t.Fatalf("request metadata = %v", req.Metadata)
+	}
+	// 第二个请求不再携带 PeerInfo
+	req, _, _ = roundTrip(t, cc, sc, &RequestHeader{ServiceMethod: "A.B", Seq: 2}, &ResponseHeader{})
+	if req.Metadata != nil {
+		t.Fatalf("second request metadata = %v", req.Metadata)
+	}
+
+	for name, get := range map[string]func() (PeerInfo, bool){"orders-1": cc.PeerInfo, "orders-client": sc.PeerInfo} {
+		p, ok := get()
+		if !ok || p.Legacy || p.Name != name || p.Protocol != binaryVersion || p.Features != supportedFeatures {
+			t.Fatalf("%s: PeerInfo() = %+v, %v", name, p, ok)
+		}
+		if !strings.Contains(strings.Join(p.Codecs, ","), "json") {
+			t.Fatalf("%s: codecs = %v", name, p.Codecs)
+		}
+	}
+}
+
+// TestPeerInfoLegacyClient 没有请求 FeaturePeerInfo 的旧客户端收到的 preface 和之前相同，服务端使用推断的 PeerInfo
+func TestPeerInfoLegacyClient(t *testing.T) {
+	c, s := pair()
+	cc := NewBinaryClientCodec(c, WithBodyCodec("json"))
+	cc.features &^= FeaturePeerInfo
+	sc := NewBinaryServerCodec(s)
+	roundTrip(t, cc, sc, &RequestHeader{ServiceMethod: "A.B", Seq: 1}, &ResponseHeader{})
+	p, ok := sc.PeerInfo()
+	if !ok || !p.Legacy || p.Features != FeatureErrorDetails|FeatureLoadReport || len(p.Codecs) != 1 || p.Codecs[0] != "json" {
+		t.Fatalf("PeerInfo() = %+v, %v", p, ok)
+	}
+	if p, ok := cc.PeerInfo(); !ok || !p.Legacy {
+		t.Fatalf("client PeerInfo() = %+v, %v", p, ok)
+	}
+}
+
+// TestPeerInfoBounds 编码后的 PeerInfo 不超过 MaxPeerInfoSize，不合法的 PeerInfo 被忽略
+func TestPeerInfoBounds(t *testing.T) {
+	p := PeerInfo{Version: strings.Repeat("v", 1000), Name: strings.Repeat("n", 1000)}
+	for i := 0; i < 100; i++ {
+		p.Codecs = append(p.Codecs, strings.Repeat("c", 100))
+	}
+	b := appendPeerInfo(nil, p)
+	if len(b) > MaxPeerInfoSize {
+		t.Fatalf("encoded size = %d", len(b))
+	}
+	got, ok := parsePeerInfo(b)
+	if !ok || len(got.Name) != maxPeerName || len(got.Codecs) == 0 || len(got.Codecs) > maxPeerCodecs {
+		t.Fatalf("parsePeerInfo() = %d codecs, name %d, %v", len(got.Codecs), len(got.Name), ok)
+	}
+
+	for name, b := range map[string][]byte{
+		"empty":     nil,
+		"truncated": appendPeerInfo(nil, PeerInfo{Name: "x"})[:3],
+		"codecs":    append(appendUvarint(appendUvarint(appendString(nil, ""), 1), 0), 200),
+		"too large": bytes.Repeat([]byte{0}, MaxPeerInfoSize+1),
+	} {
+		if _, ok := parsePeerInfo(b); ok {
+			t.Fatalf("%s: parsed", name)
+		}
+	}
+	// 之后的版本在最后增加的字段被忽略
+	if p, ok := parsePeerInfo(append(appendPeerInfo(nil, PeerInfo{Name: "x"}), 1, 2, 3)); !ok || p.Name != "x" {
+		t.Fatalf("parsePeerInfo() with trailing fields = %+v, %v", p, ok)
+	}
+}
@@ -0,0 +1,83 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MessageError 一个完整读取的 frame 无法解码，比如 header 不合法、body 无法解码到目标类型。frame 已经被跳过，
+// 连接上的 frame 边界没有丢失，之后的消息不受影响，调用方只需要让这一个消息对应的调用或者请求失败。
+// 无法读取完整的 frame 时（长度不合法、连接断开、读取超时）返回的不是 MessageError，连接已经不可用
+type MessageError struct {
+	Seq      uint64
+	SeqKnown bool // 是否解析出了 Seq，为 false 时无法知道 frame 属于哪个消息
+	Err      error
+}
+
+func (e *MessageError) Error() string {
+	if e.SeqKnown {
+		return fmt.Sprintf("rpc codec: bad message %d: %v", e.Seq, e.Err)
+	}
+	return fmt.Sprintf("rpc codec: bad message: %v", e.Err)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// badFrame 返回 frame 的 header 无法解析的 MessageError，并丢弃 frame 的 body
+func (f *frameConn) badFrame(frame []byte, err error) *MessageError {
+	f.setRest(nil)
+	seq, n := binary.Uvarint(frame)
+	return &MessageError{Seq: seq, SeqKnown: n > 0, Err: err}
+}
+
+// FrameReadTimeouter 由可以限制读取单个 frame 的时间的 codec 实现，见 client.WithFrameReadTimeout、
+// appleseed.WithFrameReadTimeout
+type FrameReadTimeouter interface {
+	// SetFrameReadTimeout 读到一个 frame 的第一个字节之后，整个 frame 需要在 d 之内读完，否则读取返回超时错误，
+	// 连接应当被关闭。连接空闲、等待下一个 frame 时不受限制。setDeadline 用于设置下层连接的读取期限，
+	// 比如 net.Conn.SetReadDeadline。d <= 0 时不限制
+	SetFrameReadTimeout(d time.Duration, setDeadline func(t time.Time) error)
+}
+
+var (
+	_ FrameReadTimeouter = &BinaryClientCodec{}
+	_ FrameReadTimeouter = &BinaryServerCodec{}
+)
+
+func (f *frameConn) SetFrameReadTimeout(d time.Duration, setDeadline func(t time.Time) error) {
+	f.readTimeout, f.setDeadline = d, setDeadline
+}
+
+var errFrameSizeOverflow = errors.New("rpc codec: frame size overflows a 64-bit integer")
+
+// readUvarint 同 binary.ReadUvarint，first 为已经读取的第一个字节
+func readUvarint(first byte, r io.ByteReader) (uint64, error) {
+	var x uint64
+	var s uint
+	b := first
+	for i := 0; ; i++ {
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				return 0, errFrameSizeOverflow
+			}
+			return x | uint64(b)<<s, nil
+		}
+		if i == binary.MaxVarintLen64-1 {
+			return 0, errFrameSizeOverflow
+		}
+		x |= uint64(b&0x7f) << s
+		s += 7
+		var err error
+		if b, err = r.ReadByte(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+}
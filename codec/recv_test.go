@@ -0,0 +1,93 @@
+package codec
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// appendFrame 将 data 作为一个 frame 追加到 b 后面
+func appendFrame(b, data []byte) []byte {
+	return append(appendUvarint(b, uint64(len(data))), data...)
+}
+
+// TestPoisonFrame 完整的 frame 无法解码时只有这个消息失败，之后的消息正常读取
+func TestPoisonFrame(t *testing.T) {
+	c, s := pair()
+	cc := NewBinaryClientCodec(c, WithBodyCodec("json"))
+	sc := NewBinaryServerCodec(s)
+	roundTrip(t, cc, sc, &RequestHeader{ServiceMethod: "A.B", Seq: 1}, &ResponseHeader{})
+
+	// seq 3 的 header 在错误信息中间截断；seq 4 的 body 不是合法的 json
+	s.w.Write(appendFrame(nil, []byte{3, flagError, 2, 10, 'b', 'o'}))
+	s.w.Write(appendFrame(nil, []byte{4, 0, '{'}))
+	if err := sc.WriteResponse(&ResponseHeader{Seq: 5}, &Payload{Data: []byte("ok")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp ResponseHeader
+	var me *MessageError
+	if err := cc.ReadResponseHeader(&resp); !errors.As(err, &me) || !me.SeqKnown || me.Seq != 3 {
+		t.Fatalf("bad header: err = %v", err)
+	}
+	if err := cc.ReadResponseHeader(&resp); err != nil || resp.Seq != 4 {
+		t.Fatalf("ReadResponseHeader() = %+v, %v", resp, err)
+	}
+	var p Payload
+	if err := cc.ReadResponseBody(&p); !errors.As(err, &me) {
+		t.Fatalf("bad body: err = %v", err)
+	}
+	if err := cc.ReadResponseHeader(&resp); err != nil || resp.Seq != 5 {
+		t.Fatalf("ReadResponseHeader() = %+v, %v", resp, err)
+	}
+	if err := cc.ReadResponseBody(&p); err != nil || string(p.Data) != "ok" {
+		t.Fatalf("ReadResponseBody() = %q, %v", p.Data, err)
+	}
+}
+
+// TestFrameReadTimeout 空闲的连接不受限制，开始读取 frame 之后剩余的部分需要在超时时间内到达
+func TestFrameReadTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sc := NewBinaryServerCodec(a)
+	sc.SetFrameReadTimeout(50*time.Millisecond, a.SetReadDeadline)
+	cc := NewBinaryClientCodec(b, WithBodyCodec("json"))
+	errc := make(chan error, 1)
+	go func() {
+		var req RequestHeader
+		if err := sc.ReadRequestHeader(&req); err != nil {
+			errc <- err
+			return
+		}
+		sc.ReadRequestBody(nil)
+		errc <- sc.ReadRequestHeader(&req)
+	}()
+	go func() {
+		var resp ResponseHeader
+		cc.ReadResponseHeader(&resp) // 读取服务端的 preface
+	}()
+	if err := cc.WriteRequest(&RequestHeader{ServiceMethod: "A.B", Seq: 1}, &Payload{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("idle connection timed out: %v", err)
+	default:
+	}
+	// 长度为 10 的 frame 只发送了 2 个字节
+	if _, err := b.Write([]byte{10, 2, 0}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("ReadRequestHeader() = %v, want deadline exceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("trickled frame was not timed out")
+	}
+}
@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+)
+
+// MessageSize 一个请求或者响应的大小
+type MessageSize struct {
+	Header int64 // header 在连接上的字节数，codec 无法区分 header 和 body 时为 0，全部计入 Body
+	Body   int64 // body 在连接上的字节数
+	// UncompressedBody body 解压缩后（写入时为压缩之前）的大小，codec 没有压缩时和 Body 相同
+	UncompressedBody int64
+}
+
+// Total 返回消息在连接上的字节数
+func (m MessageSize) Total() int64 {
+	return m.Header + m.Body
+}
+
+// Add 返回 m 和 o 相加的结果，用于统计被拆分为多个 frame 发送的消息
+func (m MessageSize) Add(o MessageSize) MessageSize {
+	return MessageSize{Header: m.Header + o.Header, Body: m.Body + o.Body, UncompressedBody: m.UncompressedBody + o.UncompressedBody}
+}
+
+// SizeReporter codec 可以实现的可选接口，返回最近一次读取和写入的消息的大小。实现了它的 codec 可以区分
+// header 和 body，压缩 body 的 codec 还需要给出解压缩后的大小；没有实现时只能按照连接上读写的字节数统计，
+// 见 CountConn。
+//
+// LastReadSize 在读取 body 之后调用，LastWriteSize 在写入之后调用，调用方保证它们和对应的读写不会并发
+type SizeReporter interface {
+	LastReadSize() MessageSize
+	LastWriteSize() MessageSize
+}
+
+// UnknownSize 无法区分 header 和 body 时，连接上的 n 个字节对应的 MessageSize
+func UnknownSize(n int64) MessageSize {
+	return MessageSize{Body: n, UncompressedBody: n}
+}
+
+// countReader 统计 gob 解码消费的字节数。gob 在 reader 没有实现 io.ByteReader 时会包装一层带预读的 bufio，
+// 所以 countReader 总是实现 io.ByteReader，并且在底层的 reader 没有实现它时自己在下面包装 bufio，
+// 这样计数的就是 gob 实际消费的字节数
+type countReader struct {
+	r byteReader
+	n int64
+}
+
+func newCountReader(r io.Reader) *countReader {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &countReader{r: br}
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// countWriter 统计 gob 编码产生的字节数
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sizeCounter 记录 gob 的 header 和 body 各自的大小
+type sizeCounter struct {
+	cr        *countReader
+	cw        *countWriter
+	readSize  MessageSize
+	writeSize MessageSize
+}
+
+func (s *sizeCounter) LastReadSize() MessageSize {
+	return s.readSize
+}
+
+func (s *sizeCounter) LastWriteSize() MessageSize {
+	return s.writeSize
+}
+
+var (
+	_ SizeReporter = (*GobServerCodec)(nil)
+	_ SizeReporter = (*GobClientCodec)(nil)
+	_ SizeReporter = (*BinaryServerCodec)(nil)
+	_ SizeReporter = (*BinaryClientCodec)(nil)
+)
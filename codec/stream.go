@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+)
+
+// BodySource 由希望以流的方式发送 body 的 reply 实现，和 BodySink 对应：BodyReader 中的数据是 body 编码后的
+// 原始数据（和 RawMessage.Data 相同），不经过 BodyCodec 编码，直接作为 body 发送。开启了拆分传输（见 WithChunking）时
+// 每次只从 BodyReader 读取一个 chunk 的数据，发送方不需要在内存中保存完整的 body；否则需要全部读取后作为一个 frame 发送，
+// 不能超过 MaxFrameSize。BodyReader 实现了 io.Closer 时，读取完成或者放弃发送后被关闭。
+// 和 RawMessage 一样只在二进制协议并且 body 的编码无状态时可用
+type BodySource interface {
+	BodyReader() io.Reader
+}
+
+// StreamBody 从 Reader 读取 body 的 BodySource，服务方法的 reply 为 *StreamBody 时，方法返回之前设置 Reader，
+// 返回错误时 Reader 不会被读取，也不会被关闭
+type StreamBody struct {
+	Reader io.Reader
+}
+
+func (b *StreamBody) BodyReader() io.Reader {
+	return b.Reader
+}
+
+// WriterSink 将 body 写入 W 的 BodySink，用于把很大的响应直接写入文件等，接收方只需要保存一个 chunk。
+// Max 大于 0 时最多写入 Max 字节，超过时写入返回 ErrBodyTooLarge，调用失败，连接仍然可用。
+// 拆分传输的 body 写入 BodySink 时不受 max body 的限制，需要限制时应当设置 Max
+type WriterSink struct {
+	W       io.Writer
+	Max     int64
+	written int64
+}
+
+// NewWriterSink 返回写入 w、最多写入 max 字节的 WriterSink，max <= 0 时不限制
+func NewWriterSink(w io.Writer, max int64) *WriterSink {
+	return &WriterSink{W: w, Max: max}
+}
+
+func (s *WriterSink) BodyWriter() io.Writer {
+	return s
+}
+
+func (s *WriterSink) Write(p []byte) (int, error) {
+	if s.Max > 0 && s.written+int64(len(p)) > s.Max {
+		return 0, ErrBodyTooLarge
+	}
+	n, err := s.W.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// Written 返回已经写入的字节数
+func (s *WriterSink) Written() int64 {
+	return s.written
+}
+
+// closeSource 关闭实现了 io.Closer 的 r
+func closeSource(r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// writeSource 写入 f.hdr 和从 r 读取的 body。chunk 为 true 时只读取第一段，剩余的部分在 writeFragment 时读取
+func (f *frameConn) writeSource(r io.Reader, chunk bool) error {
+	if r == nil {
+		return f.writeRaw(nil)
+	}
+	if !f.rawSupported() {
+		closeSource(r)
+		return ErrRawUnsupported
+	}
+	if !chunk {
+		defer closeSource(r)
+		data, err := io.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+		if err != nil {
+			return fmt.Errorf("rpc codec: read body source: %w", err)
+		}
+		if len(data)+len(f.hdr) > MaxFrameSize {
+			return fmt.Errorf("rpc codec: body source exceeds the frame size %d, chunking is required", MaxFrameSize)
+		}
+		return f.writeRaw(data)
+	}
+	buf := make([]byte, f.chunk.size)
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		// 一个 chunk 就是全部
+		closeSource(r)
+		return f.writeRaw(buf[:n])
+	default:
+		closeSource(r)
+		return fmt.Errorf("rpc codec: read body source: %w", err)
+	}
+	// writeRaw 返回之前 buf 已经写入 f.w，之后可以复用
+	f.startOutgoing(&outgoing{src: r, buf: buf, next: 1})
+	return f.writeRaw(buf)
+}
@@ -0,0 +1,52 @@
+package appleseed
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// ConnStats 一个连接的统计，连接断开时交给 WithOnDisconnect 的回调
+type ConnStats struct {
+	Duration     time.Duration // 连接建立到断开的时间
+	Requests     int64         // 读取到的请求数，包括返回错误的请求
+	BadRequests  int64         // 其中无法解码的请求数（header 不合法或者 body 无法解码到参数），见 codec.MessageError
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// WithOnConnect 接收到连接后、读取任何数据之前调用 f，f 返回 true 时直接关闭连接，比如根据地址拒绝连接。
+// f 在连接自己的 goroutine 中调用，不会阻塞接收其他连接
+func WithOnConnect(f func(remoteAddr net.Addr) (reject bool)) ServerOption {
+	return func(s *Server) {
+		s.onConnect = f
+	}
+}
+
+// WithOnDisconnect 连接断开并且连接上的请求都已经处理完时调用 f。err 为连接断开的原因：客户端正常关闭连接时为 nil，
+// 调用 Shutdown 时为 ErrServerClosed，否则为读取请求的错误。被 WithOnConnect 拒绝的连接不会调用 f
+func WithOnDisconnect(f func(remoteAddr net.Addr, err error, stats ConnStats)) ServerOption {
+	return func(s *Server) {
+		s.onDisconnect = f
+	}
+}
+
+// runHook 调用连接事件的回调，回调 panic 时记录日志，不影响连接的处理
+func runHook(name string, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rpc: %s hook panic: %v", name, r)
+		}
+	}()
+	f()
+}
+
+// acceptConn 调用 WithOnConnect 的回调，返回是否继续处理连接
+func (s *Server) acceptConn(conn net.Conn) bool {
+	if s.onConnect == nil {
+		return true
+	}
+	reject := false
+	runHook("OnConnect", func() { reject = s.onConnect(conn.RemoteAddr()) })
+	return !reject
+}
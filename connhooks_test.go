@@ -0,0 +1,159 @@
+package appleseed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+// eventLog 按顺序记录连接事件
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+	notify chan struct{}
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{notify: make(chan struct{}, 100)}
+}
+
+func (l *eventLog) add(format string, args ...any) {
+	l.mu.Lock()
+	l.events = append(l.events, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+	l.notify <- struct{}{}
+}
+
+// wait 等待记录到 n 个事件并返回所有的事件
+func (l *eventLog) wait(t *testing.T, n int) []string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		l.mu.Lock()
+		events := append([]string(nil), l.events...)
+		l.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		select {
+		case <-l.notify:
+		case <-timeout:
+			t.Fatalf("timeout waiting for %d events, got %q", n, events)
+		}
+	}
+}
+
+// startHooksServer 启动监听进程内连接的服务端，不需要真实的端口
+func startHooksServer(t *testing.T, opts ...ServerOption) (*Server, *inproc.Listener) {
+	lis := inproc.Listen("hooks")
+	s, err := NewServer(context.Background(), "hooks", "127.0.0.1", "0", memory.New(nil), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	return s, lis
+}
+
+// dialHooks 建立到 lis 的进程内连接
+func dialHooks(t *testing.T, lis *inproc.Listener, opts ...client.ClientOption) *client.Client {
+	conn, err := lis.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.NewClient(conn, lis.Addr().String(), opts...)
+}
+
+// TestConnHooks 建立连接 → 几次调用 → 服务端关闭连接，两端的事件和顺序
+func TestConnHooks(t *testing.T) {
+	server, clientLog := newEventLog(), newEventLog()
+	var stats ConnStats
+	s, lis := startHooksServer(t,
+		WithOnConnect(func(remoteAddr net.Addr) bool {
+			server.add("connect")
+			return false
+		}),
+		WithOnDisconnect(func(remoteAddr net.Addr, err error, st ConnStats) {
+			stats = st
+			server.add("disconnect %v", err)
+		}))
+	cli := dialHooks(t, lis, client.WithConnHooks(client.ConnHooks{
+		OnConnected: func(addr string) { clientLog.add("connected %s", addr) },
+		OnDisconnected: func(addr string, err error) {
+			clientLog.add("disconnected %s %v", addr, errors.Is(err, client.ErrConnectionClosed))
+		},
+	}))
+	defer cli.Close()
+	for i := int64(0); i < 3; i++ {
+		var reply Reply
+		if err := cli.Call(context.Background(), "XXX.Add", &Args{X: i, Y: 1}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Shutdown(context.Background())
+
+	want := []string{"connect", "disconnect " + ErrServerClosed.Error()}
+	if got := server.wait(t, 2); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("server events = %q, want %q", got, want)
+	}
+	if stats.Requests != 3 || stats.BytesRead == 0 || stats.BytesWritten == 0 || stats.Duration <= 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	addr := lis.Addr().String()
+	want = []string{"connected " + addr, "disconnected " + addr + " true"}
+	if got := clientLog.wait(t, 2); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("client events = %q, want %q", got, want)
+	}
+}
+
+// TestOnConnectReject 被拒绝的连接在读取任何数据之前关闭，回调 panic 不影响连接的处理
+func TestOnConnectReject(t *testing.T) {
+	var mu sync.Mutex
+	reject, disconnects := true, 0
+	s, lis := startHooksServer(t,
+		WithOnConnect(func(remoteAddr net.Addr) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if !reject {
+				panic("boom")
+			}
+			return true
+		}),
+		WithOnDisconnect(func(remoteAddr net.Addr, err error, stats ConnStats) {
+			mu.Lock()
+			disconnects++
+			mu.Unlock()
+		}))
+	defer s.Shutdown(context.Background())
+
+	cli := dialHooks(t, lis)
+	var reply Reply
+	if err := cli.Call(context.Background(), "XXX.Add", &Args{X: 1, Y: 2}, &reply); err == nil {
+		t.Fatal("call on a rejected connection succeeded")
+	}
+	cli.Close()
+
+	mu.Lock()
+	reject = false
+	mu.Unlock()
+	cli = dialHooks(t, lis)
+	if err := cli.Call(context.Background(), "XXX.Add", &Args{X: 1, Y: 2}, &reply); err != nil || reply.Add != 3 {
+		t.Fatalf("reply = %+v, err = %v", reply, err)
+	}
+	cli.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if disconnects > 1 {
+		t.Fatalf("%d disconnects, the rejected connection should not be reported", disconnects)
+	}
+}
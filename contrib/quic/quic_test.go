@@ -0,0 +1,238 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+type Echo struct{}
+
+func (Echo) Echo(args *[]byte, reply *[]byte) error {
+	*reply = *args
+	return nil
+}
+
+func (Echo) Sleep(args *time.Duration, reply *int) error {
+	time.Sleep(*args)
+	return nil
+}
+
+// tlsConfigs 返回使用自签名证书的服务端和客户端 tls 配置
+func tlsConfigs(t testing.TB) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "appleseed"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: pool, ServerName: "localhost"}
+}
+
+// startServer 启动一个处理 QUIC 连接的 Echo 服务，返回地址和客户端的 tls 配置
+func startServer(t testing.TB, conf *quicgo.Config, opts ...appleseed.ServerOption) (*appleseed.Server, string, *tls.Config) {
+	t.Helper()
+	serverTLS, clientTLS := tlsConfigs(t)
+	lis, err := Listen("127.0.0.1:0", serverTLS, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := appleseed.NewServer(context.Background(), "quic", "127.0.0.1", "0", memory.New(nil), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(Echo{}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return s, lis.Addr().String(), clientTLS
+}
+
+func TestRoundTrip(t *testing.T) {
+	_, addr, clientTLS := startServer(t, nil)
+	for _, mode := range []Mode{Multiplex, StreamPerCall} {
+		ctx := context.Background()
+		c, err := Dial(ctx, addr, clientTLS, WithMode(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				arg, reply := bytes.Repeat([]byte{byte(i)}, 100*i), []byte(nil)
+				if err := c.Call(ctx, "Echo.Echo", &arg, &reply); err != nil || !bytes.Equal(arg, reply) {
+					t.Errorf("%v: err = %v", mode, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		var arg, reply int
+		if err := c.Call(ctx, "Echo.Nope", &arg, &reply); err == nil {
+			t.Fatalf("%v: expected error for unknown method", mode)
+		}
+		c.Close()
+	}
+}
+
+func TestCancelResetsStream(t *testing.T) {
+	_, addr, clientTLS := startServer(t, nil)
+	c, err := Dial(context.Background(), addr, clientTLS, WithMode(StreamPerCall))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	d, reply := time.Second, 0
+	start := time.Now()
+	if err := c.Call(ctx, "Echo.Sleep", &d, &reply); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("canceled call waited for the handler")
+	}
+	// 同一个连接上的其他调用不受影响
+	d = 0
+	if err := c.Call(context.Background(), "Echo.Sleep", &d, &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	conf := &quicgo.Config{MaxIdleTimeout: 200 * time.Millisecond}
+	_, addr, clientTLS := startServer(t, conf)
+	for _, keepalive := range []time.Duration{0, 50 * time.Millisecond} {
+		conf := &quicgo.Config{MaxIdleTimeout: 200 * time.Millisecond, KeepAlivePeriod: keepalive}
+		c, err := Dial(context.Background(), addr, clientTLS, WithConfig(conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := c.conn
+		time.Sleep(500 * time.Millisecond)
+		// 没有 keepalive 时连接因为空闲而关闭，调用时重新建立
+		d, reply := time.Duration(0), 0
+		if err := c.Call(context.Background(), "Echo.Sleep", &d, &reply); err != nil {
+			t.Fatalf("keepalive %v: %v", keepalive, err)
+		}
+		if reused := c.conn == first; reused != (keepalive > 0) {
+			t.Fatalf("keepalive %v: connection reused = %v", keepalive, reused)
+		}
+		c.Close()
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		peers []string
+	)
+	record := func(ctx context.Context, info *appleseed.ServerInfo, arg, reply any, handler appleseed.Handler) error {
+		if p, ok := appleseed.PeerFromContext(ctx); ok {
+			mu.Lock()
+			peers = append(peers, p.Addr.String())
+			mu.Unlock()
+		}
+		return handler(ctx, arg, reply)
+	}
+	_, addr, clientTLS := startServer(t, nil, appleseed.WithInterceptors(record))
+	c, err := Dial(context.Background(), addr, clientTLS, WithMode(StreamPerCall))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	call := func() {
+		d, reply := time.Duration(0), 0
+		if err := c.Call(context.Background(), "Echo.Sleep", &d, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call()
+	conn := c.conn
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	call()
+	if c.conn != conn {
+		t.Fatal("connection was re-established instead of migrated")
+	}
+	if len(peers) != 2 || peers[0] == peers[1] {
+		t.Fatalf("server saw peers %v", peers)
+	}
+}
+
+func TestShutdownWaitsForCalls(t *testing.T) {
+	s, addr, clientTLS := startServer(t, nil)
+	for _, mode := range []Mode{Multiplex, StreamPerCall} {
+		c, err := Dial(context.Background(), addr, clientTLS, WithMode(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		done := make(chan error, 1)
+		go func() {
+			d, reply := 100*time.Millisecond, 0
+			done <- c.Call(context.Background(), "Echo.Sleep", &d, &reply)
+		}()
+		if mode == StreamPerCall {
+			time.Sleep(50 * time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := s.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%v: %v", mode, err)
+		}
+	}
+}
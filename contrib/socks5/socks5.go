@@ -0,0 +1,69 @@
+// Package socks5 通过 SOCKS5 代理建立连接，实现了 client.Dialer：
+//
+//	d := socks5.New("proxy:1080", &proxy.Auth{User: "u", Password: "p"}, nil)
+//	pool, err := client.NewPool(ctx, reg, "svc", client.WithPoolDialer(d))
+//
+// 基于 golang.org/x/net/proxy，只支持 tcp
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"golang.org/x/net/proxy"
+)
+
+// Dialer 经过 SOCKS5 代理建立 tcp 连接
+type Dialer struct {
+	proxyAddr string
+	auth      *proxy.Auth
+	forward   client.Dialer
+}
+
+var _ client.Dialer = (*Dialer)(nil)
+
+// New 返回经过 proxyAddr 上的 SOCKS5 代理建立连接的 Dialer，auth 为 nil 时不认证。
+// 到代理的连接通过 forward 建立，为 nil 时使用 net.Dialer，可以用来串联多级代理
+func New(proxyAddr string, auth *proxy.Auth, forward client.Dialer) *Dialer {
+	if forward == nil {
+		forward = new(net.Dialer)
+	}
+	return &Dialer{proxyAddr: proxyAddr, auth: auth, forward: forward}
+}
+
+// DialContext 经过代理连接到 address，握手完成前 ctx 结束时返回 ctx 的错误。
+// 返回的是到代理的 tcp 连接，transport 的 socket 选项可以直接作用在它上面
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("socks5: unsupported network %q", network)
+	}
+	// 每次建立连接使用单独的 socks dialer，以便取出到代理的连接
+	fwd := &captureDialer{d: d.forward}
+	sd, err := proxy.SOCKS5("tcp", d.proxyAddr, d.auth, fwd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sd.(proxy.ContextDialer).DialContext(ctx, network, address); err != nil {
+		return nil, fmt.Errorf("socks5: dial %s via %s: %w", address, d.proxyAddr, err)
+	}
+	return fwd.conn, nil
+}
+
+// captureDialer 记录建立的到代理的连接，socks dialer 在 DialContext 中同步地调用它
+type captureDialer struct {
+	d    client.Dialer
+	conn net.Conn
+}
+
+func (c *captureDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := c.d.DialContext(ctx, network, address)
+	c.conn = conn
+	return conn, err
+}
+
+// Dial 同 DialContext，实现了 proxy.Dialer
+func (c *captureDialer) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"golang.org/x/net/proxy"
+)
+
+type Echo struct{}
+
+func (Echo) Ping(args *int, reply *int) error {
+	*reply = *args
+	return nil
+}
+
+// fakeProxy 只支持用户名密码认证和 CONNECT 的 SOCKS5 代理
+type fakeProxy struct {
+	lis      net.Listener
+	connects int64
+}
+
+func startProxy(t *testing.T) *fakeProxy {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProxy{lis: lis}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 512)
+	// 版本和认证方式
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+	// RFC 1929：版本、用户名、密码
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	user := make([]byte, buf[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, buf[:1])
+	pass := make([]byte, buf[0])
+	io.ReadFull(conn, pass)
+	if string(user) != "u" || string(pass) != "p" {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+	// CONNECT 请求，地址为 ipv4 或者域名
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	io.ReadFull(conn, buf[:2])
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	atomic.AddInt64(&p.connects, 1)
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	ctx := context.Background()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(ctx, "echo", "127.0.0.1", port, memory.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(Echo)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(ctx)
+	p := startProxy(t)
+
+	d := New(p.lis.Addr().String(), &proxy.Auth{User: "u", Password: "p"}, nil)
+	cli, err := client.Dial(ctx, "tcp", lis.Addr().String(), client.WithDialer(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	args, reply := 7, 0
+	if err := cli.Call(ctx, "Echo.Ping", &args, &reply); err != nil || reply != 7 {
+		t.Fatalf("reply = %d, err = %v", reply, err)
+	}
+	if n := atomic.LoadInt64(&p.connects); n != 1 {
+		t.Fatalf("%d connections through the proxy", n)
+	}
+
+	// 认证失败和不支持的 network
+	bad := New(p.lis.Addr().String(), &proxy.Auth{User: "u", Password: "x"}, nil)
+	if _, err := client.Dial(ctx, "tcp", lis.Addr().String(), client.WithDialer(bad)); err == nil {
+		t.Fatal("dial with wrong password succeeded")
+	}
+	if _, err := d.DialContext(ctx, "unix", "/tmp/x.sock"); err == nil {
+		t.Fatal("unix through socks5 succeeded")
+	}
+}
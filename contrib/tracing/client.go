@@ -0,0 +1,39 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+)
+
+// WrapCaller 为每次调用创建 client span，并将 traceparent 以及 ctx 中的 baggage 放入请求的 metadata，
+// next 可以是 *client.Client、*client.Pool 等
+func WrapCaller(next client.Caller, tracer *Tracer) client.Caller {
+	return &tracingCaller{next: next, tracer: tracer}
+}
+
+type tracingCaller struct {
+	next   client.Caller
+	tracer *Tracer
+}
+
+func (c *tracingCaller) Call(ctx context.Context, serviceMethod string, arg, reply any) error {
+	ctx, span := c.tracer.Start(ctx, serviceMethod, SpanKindClient)
+	span.SetAttribute("rpc.method", serviceMethod)
+	kv := []string{TraceparentKey, span.SpanContext().Traceparent()}
+	if b := BaggageFromContext(ctx); len(b) > 0 {
+		kv = append(kv, BaggageKey, b.String())
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, kv...)
+
+	err := c.next.Call(ctx, serviceMethod, arg, reply)
+	if err != nil {
+		span.SetStatus(StatusError, err.Error())
+	} else {
+		span.SetStatus(StatusOK, "")
+	}
+	span.End(time.Time{})
+	return err
+}
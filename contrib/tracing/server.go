@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+)
+
+var _ appleseed.StatsHandler = &ServerHandler{}
+
+// ServerHandler 为服务端的每个请求创建 server span，通过 appleseed.WithStatsHandler 使用：
+//
+//	appleseed.NewServer(ctx, name, host, port, reg, appleseed.WithStatsHandler(tracing.NewServerHandler(tracer)))
+//
+// 请求中带有 traceparent 时 span 作为它的子 span 并沿用它的采样结果，请求中的 baggage 会放入 handler 的 ctx，
+// handler 使用该 ctx 通过 WrapCaller 调用下游服务时，trace 和 baggage 会继续传递下去
+type ServerHandler struct {
+	tracer *Tracer
+}
+
+func NewServerHandler(tracer *Tracer) *ServerHandler {
+	return &ServerHandler{tracer: tracer}
+}
+
+func (h *ServerHandler) TagRPC(ctx context.Context, info *appleseed.ServerInfo) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	// traceparent 无法解析时开始一个新的 trace
+	parent, _ := ParseTraceparent(md.Get(TraceparentKey))
+	if b := md.Get(BaggageKey); b != "" {
+		ctx = ContextWithBaggage(ctx, ParseBaggage(b))
+	}
+	span := h.tracer.start(info.ServiceMethod, SpanKindServer, parent)
+	span.SetAttribute("rpc.method", info.ServiceMethod)
+	if info.RequestID != "" {
+		span.SetAttribute("rpc.request_id", info.RequestID)
+	}
+	return ContextWithSpan(ctx, span)
+}
+
+// HandleRPC 记录请求的结果、耗时以及请求和响应的大小并结束 span，handler panic 以及超过客户端的
+// deadline 时同样会被记录
+func (h *ServerHandler) HandleRPC(ctx context.Context, stats *appleseed.ServerStats) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	span.start = stats.Start // 从开始读取请求算起
+	span.mu.Unlock()
+	span.SetAttribute("rpc.bytes_received", stats.BytesReceived)
+	span.SetAttribute("rpc.bytes_sent", stats.BytesSent)
+	span.SetAttribute("rpc.latency", stats.End.Sub(stats.Start))
+
+	var pe *appleseed.PanicError
+	deadlineExceeded := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	switch {
+	case errors.As(stats.Err, &pe):
+		span.SetAttribute("rpc.panic", fmt.Sprint(pe.Value))
+		span.SetStatus(StatusError, stats.Err.Error())
+	case stats.Err != nil:
+		span.SetStatus(StatusError, stats.Err.Error())
+	case deadlineExceeded:
+		span.SetStatus(StatusError, context.DeadlineExceeded.Error())
+	default:
+		span.SetStatus(StatusOK, "")
+	}
+	if deadlineExceeded {
+		span.SetAttribute("rpc.deadline_exceeded", true)
+	}
+	span.End(stats.End)
+}
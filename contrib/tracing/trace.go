@@ -0,0 +1,351 @@
+// Package tracing 为 appleseed 提供分布式追踪：客户端为每次调用创建 client span，并通过请求的
+// metadata 传递 W3C traceparent 和 baggage；服务端从 metadata 中取出 trace 信息，为每个请求创建
+// server span 并放入 handler 的 ctx。为了不给核心代码引入依赖，这里实现了一个最小的 tracer，
+// 结束的 span 交给 Exporter，可以在 Exporter 中转换为其他 tracing 系统的格式
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceparentKey W3C traceparent 在请求 metadata 中的 key
+	TraceparentKey = "traceparent"
+	// BaggageKey W3C baggage 在请求 metadata 中的 key
+	BaggageKey = "baggage"
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext 在进程之间传递的 span 信息
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool // 是否是从请求中解析出来的
+}
+
+// Valid 返回 TraceID 和 SpanID 是否都不为零
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent 返回 W3C traceparent 格式的字符串
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+var errBadTraceparent = errors.New("tracing: invalid traceparent")
+
+// ParseTraceparent 解析 W3C traceparent，比如 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(s string) (SpanContext, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, errBadTraceparent
+	}
+	var sc SpanContext
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, errBadTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, errBadTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, errBadTraceparent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}, errBadTraceparent
+	}
+	if !sc.Valid() {
+		return SpanContext{}, errBadTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	sc.Remote = true
+	return sc, nil
+}
+
+// Baggage 随 trace 在所有服务之间传递的键值对
+type Baggage map[string]string
+
+// String 返回 W3C baggage 格式的字符串
+func (b Baggage) String() string {
+	members := make([]string, 0, len(b))
+	for k, v := range b {
+		members = append(members, url.QueryEscape(k)+"="+url.QueryEscape(v))
+	}
+	return strings.Join(members, ",")
+}
+
+// ParseBaggage 解析 W3C baggage，忽略无法解析的部分，以及每个值的属性（; 之后的部分）
+func ParseBaggage(s string) Baggage {
+	b := make(Baggage)
+	for _, member := range strings.Split(s, ",") {
+		member, _, _ = strings.Cut(member, ";")
+		k, v, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			continue
+		}
+		key, err1 := url.QueryUnescape(strings.TrimSpace(k))
+		val, err2 := url.QueryUnescape(strings.TrimSpace(v))
+		if err1 != nil || err2 != nil || key == "" {
+			continue
+		}
+		b[key] = val
+	}
+	return b
+}
+
+type baggageKey struct{}
+
+// ContextWithBaggage 设置 ctx 中的 baggage，之后使用 ctx 发起的调用都会带上它
+func ContextWithBaggage(ctx context.Context, b Baggage) context.Context {
+	return context.WithValue(ctx, baggageKey{}, b)
+}
+
+// BaggageFromContext 返回 ctx 中的 baggage，调用方不应该修改它
+func BaggageFromContext(ctx context.Context) Baggage {
+	b, _ := ctx.Value(baggageKey{}).(Baggage)
+	return b
+}
+
+// SpanKind span 的类型
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota
+	SpanKindClient
+	SpanKindServer
+)
+
+// StatusCode span 的结果
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = iota
+	StatusOK
+	StatusError
+)
+
+// Span 一次操作
+type Span struct {
+	tracer *Tracer
+
+	mu         sync.Mutex
+	name       string
+	kind       SpanKind
+	sc         SpanContext
+	parent     SpanContext
+	start      time.Time
+	end        time.Time
+	attributes map[string]any
+	status     StatusCode
+	message    string
+	ended      bool
+}
+
+// SpanData 结束后的 span，交给 Exporter
+type SpanData struct {
+	Name        string
+	Kind        SpanKind
+	SpanContext SpanContext
+	Parent      SpanContext // 没有 parent 时为零值
+	Start       time.Time
+	End         time.Time
+	Attributes  map[string]any
+	Status      StatusCode
+	Message     string
+}
+
+// SpanContext 返回 span 的 SpanContext
+func (s *Span) SpanContext() SpanContext {
+	return s.sc
+}
+
+// SetAttribute 设置 span 的属性
+func (s *Span) SetAttribute(key string, val any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = val
+}
+
+// SetStatus 设置 span 的结果
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.message = code, message
+}
+
+// End 结束 span，end 为零值时使用当前时间，采样的 span 会交给 Exporter，重复调用时只有第一次生效
+func (s *Span) End(end time.Time) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	if end.IsZero() {
+		end = time.Now()
+	}
+	s.end = end
+	data := &SpanData{
+		Name:        s.name,
+		Kind:        s.kind,
+		SpanContext: s.sc,
+		Parent:      s.parent,
+		Start:       s.start,
+		End:         s.end,
+		Attributes:  s.attributes,
+		Status:      s.status,
+		Message:     s.message,
+	}
+	s.mu.Unlock()
+	if s.sc.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(data)
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan 将 span 放入 ctx，之后在 ctx 上创建的 span 和发起的调用都是它的子 span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext 返回 ctx 中的 span，没有时返回 nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Sampler 决定一个新的 trace 是否被采样
+type Sampler interface {
+	ShouldSample(traceID TraceID, name string) bool
+}
+
+// SamplerFunc 将函数适配为 Sampler
+type SamplerFunc func(traceID TraceID, name string) bool
+
+func (f SamplerFunc) ShouldSample(traceID TraceID, name string) bool {
+	return f(traceID, name)
+}
+
+var (
+	// AlwaysSample 采样所有 trace
+	AlwaysSample Sampler = SamplerFunc(func(TraceID, string) bool { return true })
+	// NeverSample 不采样任何 trace
+	NeverSample Sampler = SamplerFunc(func(TraceID, string) bool { return false })
+)
+
+// Exporter 接收结束的采样 span
+type Exporter interface {
+	Export(span *SpanData)
+}
+
+// InMemoryExporter 将所有 span 保存在内存中，用于测试
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (e *InMemoryExporter) Export(span *SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans 返回已经结束的所有 span
+func (e *InMemoryExporter) Spans() []*SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*SpanData(nil), e.spans...)
+}
+
+// TracerOption 用于配置 Tracer
+type TracerOption func(*Tracer)
+
+// WithSampler 指定新 trace 的采样方式，默认为 AlwaysSample。有 parent 的 span（包括从请求中
+// 解析出的 parent）总是沿用 parent 的采样结果，保证同一个 trace 的 span 要么都被采样要么都不被采样
+func WithSampler(s Sampler) TracerOption {
+	return func(t *Tracer) {
+		t.sampler = s
+	}
+}
+
+// Tracer 创建 span
+type Tracer struct {
+	exporter Exporter
+	sampler  Sampler
+}
+
+// NewTracer 创建一个将采样的 span 交给 exporter 的 Tracer
+func NewTracer(exporter Exporter, opts ...TracerOption) *Tracer {
+	t := &Tracer{exporter: exporter, sampler: AlwaysSample}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Start 创建一个 span，ctx 中有 span 时作为它的子 span，返回带有新 span 的 ctx
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.SpanContext()
+	}
+	span := t.start(name, kind, parent)
+	return ContextWithSpan(ctx, span), span
+}
+
+// start 创建一个 parent 的子 span，parent 为零值时开始一个新的 trace
+func (t *Tracer) start(name string, kind SpanKind, parent SpanContext) *Span {
+	sc := SpanContext{SpanID: newSpanID()}
+	if parent.Valid() {
+		sc.TraceID, sc.Sampled = parent.TraceID, parent.Sampled
+	} else {
+		parent = SpanContext{}
+		sc.TraceID = newTraceID()
+		sc.Sampled = t.sampler.ShouldSample(sc.TraceID, name)
+	}
+	return &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		sc:         sc,
+		parent:     parent,
+		start:      time.Now(),
+		attributes: make(map[string]any),
+	}
+}
+
+func newTraceID() (id TraceID) {
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func newSpanID() (id SpanID) {
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return
+}
@@ -0,0 +1,225 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+type Trace struct {
+	next client.Caller // 不为 nil 时将请求转发给下一跳
+}
+
+// Baggage 返回 baggage 中 key 对应的值
+func (t *Trace) Baggage(ctx context.Context, key *string, reply *string) error {
+	if t.next != nil {
+		return t.next.Call(ctx, "Trace.Baggage", key, reply)
+	}
+	*reply = BaggageFromContext(ctx)[*key]
+	return nil
+}
+
+func (t *Trace) Panic(ctx context.Context, arg *int, reply *int) error {
+	panic("boom")
+}
+
+func (t *Trace) Sleep(ctx context.Context, d *time.Duration, reply *int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(*d):
+		return nil
+	}
+}
+
+// startTrace 启动一个使用 tracer 的 server，返回连接到它的客户端
+func startTrace(t *testing.T, tracer *Tracer, next client.Caller) *client.Client {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(context.Background(), "trace", "127.0.0.1", port, memory.New(nil),
+		appleseed.WithStatsHandler(NewServerHandler(tracer)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(&Trace{next: next}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := client.NewClient(conn, lis.Addr().String())
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+// waitSpans 等待 exporter 中有 n 个 span，server span 在响应发送之后才结束
+func waitSpans(t *testing.T, exporter *InMemoryExporter, n int) []*SpanData {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		spans := exporter.Spans()
+		if len(spans) >= n {
+			return spans
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d spans, want %d", len(spans), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func find(t *testing.T, spans []*SpanData, kind SpanKind, parent SpanID) *SpanData {
+	t.Helper()
+	for _, s := range spans {
+		if s.Kind == kind && s.Parent.SpanID == parent {
+			return s
+		}
+	}
+	t.Fatalf("no span of kind %v with parent %v", kind, parent)
+	return nil
+}
+
+func TestEndToEnd(t *testing.T) {
+	exporter := new(InMemoryExporter)
+	tracer := NewTracer(exporter)
+	b := startTrace(t, tracer, nil)
+	a := startTrace(t, tracer, WrapCaller(b, tracer))
+	caller := WrapCaller(a, tracer)
+
+	// client -> a -> b
+	ctx := ContextWithBaggage(context.Background(), Baggage{"tenant": "acme corp"})
+	key, reply := "tenant", ""
+	if err := caller.Call(ctx, "Trace.Baggage", &key, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "acme corp" {
+		t.Fatalf("baggage at last hop = %q", reply)
+	}
+
+	spans := waitSpans(t, exporter, 4)
+	root := find(t, spans, SpanKindClient, SpanID{})
+	serverA := find(t, spans, SpanKindServer, root.SpanContext.SpanID)
+	clientA := find(t, spans, SpanKindClient, serverA.SpanContext.SpanID)
+	serverB := find(t, spans, SpanKindServer, clientA.SpanContext.SpanID)
+	for _, s := range []*SpanData{serverA, clientA, serverB} {
+		if s.SpanContext.TraceID != root.SpanContext.TraceID {
+			t.Fatalf("span %v in trace %v, want %v", s.Name, s.SpanContext.TraceID, root.SpanContext.TraceID)
+		}
+		if s.Status != StatusOK || s.Name != "Trace.Baggage" {
+			t.Fatalf("span = %+v", s)
+		}
+	}
+	if !serverB.Parent.Remote || serverB.Attributes["rpc.bytes_received"].(int64) == 0 || serverB.Attributes["rpc.bytes_sent"].(int64) == 0 {
+		t.Fatalf("server span = %+v", serverB)
+	}
+	if serverA.Attributes["rpc.request_id"] == "" || serverA.Attributes["rpc.request_id"] != serverB.Attributes["rpc.request_id"] {
+		t.Fatalf("request id %v, %v", serverA.Attributes["rpc.request_id"], serverB.Attributes["rpc.request_id"])
+	}
+}
+
+func TestServerSpanStatus(t *testing.T) {
+	exporter := new(InMemoryExporter)
+	tracer := NewTracer(exporter)
+	caller := WrapCaller(startTrace(t, tracer, nil), tracer)
+
+	// panic
+	var arg, reply int
+	if err := caller.Call(context.Background(), "Trace.Panic", &arg, &reply); err == nil {
+		t.Fatal("want error")
+	}
+	spans := waitSpans(t, exporter, 2)
+	server := find(t, spans, SpanKindServer, find(t, spans, SpanKindClient, SpanID{}).SpanContext.SpanID)
+	if server.Status != StatusError || server.Attributes["rpc.panic"] != "boom" {
+		t.Fatalf("panic span = %+v", server)
+	}
+
+	// 超过客户端的 deadline
+	exporter = new(InMemoryExporter)
+	tracer.exporter = exporter
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	d := time.Second
+	// 服务端的 DeadlineExceeded 可能先于客户端 ctx 的超时到达
+	if err := caller.Call(ctx, "Trace.Sleep", &d, &reply); !errors.Is(err, context.DeadlineExceeded) &&
+		status.CodeOf(err) != status.DeadlineExceeded {
+		t.Fatalf("err = %v", err)
+	}
+	spans = waitSpans(t, exporter, 2)
+	server = find(t, spans, SpanKindServer, find(t, spans, SpanKindClient, SpanID{}).SpanContext.SpanID)
+	if server.Status != StatusError || server.Attributes["rpc.deadline_exceeded"] != true {
+		t.Fatalf("deadline span = %+v", server)
+	}
+	if latency := server.End.Sub(server.Start); latency > 500*time.Millisecond {
+		t.Fatalf("server span lasted %v after the deadline", latency)
+	}
+}
+
+func TestSamplerPassThrough(t *testing.T) {
+	// 客户端不采样时，服务端即使使用 AlwaysSample 也沿用客户端的采样结果
+	clientExporter, serverExporter := new(InMemoryExporter), new(InMemoryExporter)
+	cli := startTrace(t, NewTracer(serverExporter, WithSampler(AlwaysSample)), nil)
+	caller := WrapCaller(cli, NewTracer(clientExporter, WithSampler(NeverSample)))
+	key, reply := "k", ""
+	if err := caller.Call(context.Background(), "Trace.Baggage", &key, &reply); err != nil {
+		t.Fatal(err)
+	}
+	// 没有 trace 信息的请求使用服务端的采样方式
+	if err := cli.Call(context.Background(), "Trace.Baggage", &key, &reply); err != nil {
+		t.Fatal(err)
+	}
+	spans := waitSpans(t, serverExporter, 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(clientExporter.Spans()) + len(serverExporter.Spans()); n != 1 || spans[0].Parent.Valid() {
+		t.Fatalf("exported %d spans, server spans %+v", n, spans)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Fatalf("sc = %+v", sc)
+	}
+	if got := sc.Traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("Traceparent() = %v", got)
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Fatalf("ParseTraceparent(%q) should fail", bad)
+		}
+	}
+}
+
+func TestBaggage(t *testing.T) {
+	b := ParseBaggage(Baggage{"user id": "a,b=c", "k": "v"}.String())
+	if len(b) != 2 || b["user id"] != "a,b=c" || b["k"] != "v" {
+		t.Fatalf("baggage = %v", b)
+	}
+	b = ParseBaggage("k1=v1;property, bad, k2 = v2 ")
+	if len(b) != 2 || b["k1"] != "v1" || b["k2"] != "v2" {
+		t.Fatalf("baggage = %v", b)
+	}
+}
@@ -0,0 +1,255 @@
+// Package gateway 转发请求的网关：客户端只连接网关，网关根据 "Service.Method" 中的服务名选择后端服务，
+// 通过负载均衡器选择实例后原样转发请求和响应的 body，不解码：
+//
+//	g := gateway.New(reg)
+//	g.Route("Order", "order-service")        // 服务 Order 转发到注册中心中的 order-service
+//	g.RoutePrefix("Pay", "payment-service")  // 以 Pay 开头的服务
+//	g.SetDefault("legacy-service")           // 其他服务
+//	appleseed.NewServer(ctx, "gateway", host, port, reg, appleseed.WithUnknownServiceHandler(g.Handle))
+//
+// 请求的 metadata、deadline 会转发给后端，后端返回的响应 metadata 会返回给调用方，其中包括后端的缓存指示
+// （见 appleseed.SetCacheTTL），它的值就是 HTTP 的 Cache-Control 头，HTTP 的前端可以直接使用。
+// 调用方断开连接时网关不再等待转发的调用，但是协议中没有取消请求的消息，后端只能通过 deadline 得知调用已经结束。
+// 后端的 handler 返回的错误（包括错误码和附加信息）原样返回给调用方，没有实例、无法建立连接、连接断开等错误
+// 返回错误码为 status.Unavailable 的错误。
+// 到后端的连接按照后端服务分别复用（见 client.Pool）。
+//
+// 因为不解码 body，客户端需要使用二进制协议和无状态的 body 编码（json、proto 等），见 codec.RawMessage
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// Unavailable 后端不可用（没有实例、无法建立连接、连接断开等）时，返回给调用方的错误信息的前缀，
+// 错误码为 status.Unavailable
+const Unavailable = "rpc: unavailable"
+
+// ErrClosed 网关已经关闭
+var ErrClosed = errors.New("rpc: gateway closed")
+
+// Option 用于配置 Gateway
+type Option func(*Gateway)
+
+// WithPoolOptions 指定到后端的 client.Pool 使用的 PoolOption，比如负载均衡器、建立连接的超时时间
+func WithPoolOptions(opts ...client.PoolOption) Option {
+	return func(g *Gateway) {
+		g.poolOpts = append(g.poolOpts, opts...)
+	}
+}
+
+// routes 当前的路由规则，修改时整体替换
+type routes struct {
+	exact    map[string]string // key: 服务名 val: 后端服务
+	prefixes []prefixRoute     // 按照前缀的长度从长到短排序
+	fallback string
+}
+
+type prefixRoute struct {
+	prefix, target string
+}
+
+// poolKey 相同的后端服务使用不同的 body 编码时需要不同的连接
+type poolKey struct {
+	target, codec string
+}
+
+// Gateway 转发请求到后端服务，路由规则可以在运行时修改，并发安全
+type Gateway struct {
+	reg      registry.Client
+	poolOpts []client.PoolOption
+
+	mu     sync.Mutex   // 保证修改路由时不会互相覆盖，同时保护 pools
+	routes atomic.Value // *routes
+	pools  map[poolKey]*client.Pool
+	closed bool
+}
+
+// New 创建网关，从 reg 中查找后端服务的实例
+func New(reg registry.Client, opts ...Option) *Gateway {
+	g := &Gateway{reg: reg, pools: make(map[poolKey]*client.Pool)}
+	g.routes.Store(&routes{exact: map[string]string{}})
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// update 复制当前的路由，交给 f 修改后替换
+func (g *Gateway) update(f func(*routes)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	old := g.routes.Load().(*routes)
+	n := &routes{exact: make(map[string]string, len(old.exact)), fallback: old.fallback}
+	for k, v := range old.exact {
+		n.exact[k] = v
+	}
+	n.prefixes = append(n.prefixes, old.prefixes...)
+	f(n)
+	g.routes.Store(n)
+}
+
+// Route 将服务 service 的请求转发到注册中心中的 target，target 为空时删除这条规则
+func (g *Gateway) Route(service, target string) {
+	g.update(func(n *routes) {
+		if target == "" {
+			delete(n.exact, service)
+		} else {
+			n.exact[service] = target
+		}
+	})
+}
+
+// RoutePrefix 将服务名以 prefix 开头的请求转发到 target，多条前缀都匹配时使用最长的，target 为空时删除这条规则
+func (g *Gateway) RoutePrefix(prefix, target string) {
+	g.update(func(n *routes) {
+		prefixes := n.prefixes[:0]
+		for _, r := range n.prefixes {
+			if r.prefix != prefix {
+				prefixes = append(prefixes, r)
+			}
+		}
+		if target != "" {
+			i := 0
+			for i < len(prefixes) && len(prefixes[i].prefix) >= len(prefix) {
+				i++
+			}
+			prefixes = append(prefixes, prefixRoute{})
+			copy(prefixes[i+1:], prefixes[i:])
+			prefixes[i] = prefixRoute{prefix: prefix, target: target}
+		}
+		n.prefixes = prefixes
+	})
+}
+
+// SetDefault 没有匹配的规则时转发到 target。target 为空（默认）时使用服务名本身作为注册中心中的服务
+func (g *Gateway) SetDefault(target string) {
+	g.update(func(n *routes) { n.fallback = target })
+}
+
+// target 返回服务 service 对应的后端服务
+func (g *Gateway) target(service string) string {
+	r := g.routes.Load().(*routes)
+	if t, ok := r.exact[service]; ok {
+		return t
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(service, p.prefix) {
+			return p.target
+		}
+	}
+	if r.fallback != "" {
+		return r.fallback
+	}
+	return service
+}
+
+// Handle 转发一个请求，用于 appleseed.WithUnknownServiceHandler
+func (g *Gateway) Handle(ctx context.Context, serviceMethod string, req, reply *codec.RawMessage) error {
+	service := serviceMethod
+	if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+		service = serviceMethod[:dot]
+	}
+	pool, err := g.pool(ctx, poolKey{target: g.target(service), codec: req.Codec})
+	if err != nil {
+		return unavailable(err)
+	}
+	// 上游的 metadata 原样转发，超时时间由 Call 根据 ctx 的 deadline 重新计算
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+	delete(md, metadata.TimeoutKey)
+	var respMD metadata.MD
+	callCtx := client.WithResponseMetadata(metadata.NewOutgoingContext(ctx, md), &respMD)
+	err = pool.Call(callCtx, serviceMethod, req, reply)
+	for k, v := range respMD {
+		appleseed.SetResponseMetadata(ctx, k, v)
+	}
+	var se *status.Status
+	switch {
+	case err == nil, errors.As(err, &se), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	}
+	return unavailable(err)
+}
+
+// unavailable 后端的错误不是来自 handler 时，统一返回 Unavailable
+func unavailable(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.New("connection closed")
+	}
+	return status.Newf(status.Unavailable, "%s: %v", Unavailable, err)
+}
+
+// IsUnavailable 返回 err 是否是因为后端不可用，err 可以是网关返回的错误，也可以是客户端收到的错误。
+// 旧版本的网关返回的错误没有错误码，此时根据错误信息的前缀判断
+func IsUnavailable(err error) bool {
+	return status.CodeOf(err) == status.Unavailable || (err != nil && strings.HasPrefix(err.Error(), Unavailable))
+}
+
+// pool 返回到 key.target 的连接池，第一次使用时创建
+func (g *Gateway) pool(ctx context.Context, key poolKey) (*client.Pool, error) {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if p, ok := g.pools[key]; ok {
+		g.mu.Unlock()
+		return p, nil
+	}
+	g.mu.Unlock()
+
+	name := key.codec
+	newCodec := func(conn io.ReadWriteCloser) codec.ClientCodec {
+		return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec(name), codec.WithMethodInterning())
+	}
+	// 放在最后，保证使用和上游相同的 body 编码
+	opts := append(append([]client.PoolOption(nil), g.poolOpts...), client.WithClientOptions(client.WithCodec(newCodec)))
+	p, err := client.NewPool(ctx, g.reg, key.target, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		p.Close()
+		return nil, ErrClosed
+	}
+	// 其他请求可能已经同时创建了连接池
+	if old, ok := g.pools[key]; ok {
+		p.Close()
+		return old, nil
+	}
+	g.pools[key] = p
+	return p, nil
+}
+
+// Close 关闭所有到后端的连接，之后的请求返回 ErrClosed
+func (g *Gateway) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrClosed
+	}
+	g.closed = true
+	pools := g.pools
+	g.pools = nil
+	g.mu.Unlock()
+	for _, p := range pools {
+		p.Close()
+	}
+	return nil
+}
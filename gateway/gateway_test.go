@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+type Req struct {
+	ID string
+}
+
+type Resp struct {
+	Backend     string
+	Tenant      string // 收到的 metadata
+	HasDeadline bool
+}
+
+type Order struct {
+	canceled chan struct{}
+}
+
+func (o *Order) Get(ctx context.Context, req *Req, resp *Resp) error {
+	if req.ID == "404" {
+		return errors.New("order not found: " + req.ID)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	_, resp.HasDeadline = ctx.Deadline()
+	resp.Backend, resp.Tenant = "orders", md.Get("tenant")
+	appleseed.SetResponseMetadata(ctx, "served-by", "orders")
+	appleseed.SetCacheTTL(ctx, 30*time.Second)
+	return nil
+}
+
+func (o *Order) Slow(ctx context.Context, req *Req, resp *Resp) error {
+	<-ctx.Done()
+	close(o.canceled)
+	return ctx.Err()
+}
+
+type Payment struct{}
+
+func (Payment) Pay(req *Req, resp *Resp) error {
+	resp.Backend = "payments"
+	return nil
+}
+
+// serve 启动一个服务并注册到 reg 中的 name 下
+func serve(t *testing.T, reg *memory.Registry, name string, rcvr any, opts ...appleseed.ServerOption) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(context.Background(), name, "127.0.0.1", port, reg, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcvr != nil {
+		if err := s.Register(rcvr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return lis.Addr().String()
+}
+
+func jsonCodec(conn io.ReadWriteCloser) codec.ClientCodec {
+	return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"))
+}
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	order := &Order{canceled: make(chan struct{})}
+	serve(t, reg, "orders", order)
+	serve(t, reg, "payments", Payment{})
+
+	// 注册了但是已经下线的实例
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	if _, err := reg.RegisterInstance(ctx, "dead", registry.Instance{Addr: dead.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	g := New(reg, WithPoolOptions(client.WithDialTimeout(time.Second)))
+	defer g.Close()
+	g.Route("Order", "orders")
+	g.RoutePrefix("Pay", "payments")
+	g.RoutePrefix("Dea", "dead")
+	addr := serve(t, memory.New(nil), "gateway", nil, appleseed.WithUnknownServiceHandler(g.Handle))
+
+	cli, err := client.Dial(ctx, "tcp", addr, client.WithCodec(jsonCodec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// 路由到不同的后端，metadata 和 deadline 经过网关转发
+	var respMD metadata.MD
+	cctx, cancel := context.WithTimeout(metadata.AppendToOutgoingContext(ctx, "tenant", "acme"), time.Second)
+	defer cancel()
+	var resp Resp
+	if err := cli.Call(client.WithResponseMetadata(cctx, &respMD), "Order.Get", &Req{ID: "1"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp != (Resp{Backend: "orders", Tenant: "acme", HasDeadline: true}) {
+		t.Fatalf("resp = %+v", resp)
+	}
+	if respMD.Get("served-by") != "orders" || respMD.Get(metadata.CacheControlKey) != "max-age=30" {
+		t.Fatalf("response metadata = %v", respMD)
+	}
+	resp = Resp{}
+	if err := cli.Call(ctx, "Payment.Pay", &Req{}, &resp); err != nil || resp.Backend != "payments" {
+		t.Fatalf("resp = %+v, err = %v", resp, err)
+	}
+
+	// handler 返回的错误原样返回，request id 只出现一次
+	cctx = client.WithRequestID(ctx, "req-404")
+	err = cli.Call(cctx, "Order.Get", &Req{ID: "404"}, &resp)
+	if err == nil || !strings.Contains(err.Error(), "order not found: 404") || status.CodeOf(err) != status.Internal ||
+		strings.Count(err.Error(), "req-404") != 1 {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 后端不可用：实例已经下线，或者注册中心中没有实例
+	for _, method := range []string{"Dead.Get", "Missing.Get"} {
+		if err := cli.Call(ctx, method, &Req{}, &resp); status.CodeOf(err) != status.Unavailable {
+			t.Fatalf("%v: err = %v", method, err)
+		}
+	}
+
+	// 路由可以在运行时修改，完整的服务名优先于前缀
+	g.Route("Payment", "dead")
+	if err := cli.Call(ctx, "Payment.Pay", &Req{}, &resp); !IsUnavailable(err) {
+		t.Fatalf("err = %v", err)
+	}
+	g.Route("Payment", "")
+	if err := cli.Call(ctx, "Payment.Pay", &Req{}, &resp); err != nil || resp.Backend != "payments" {
+		t.Fatalf("resp = %+v, err = %v", resp, err)
+	}
+
+	// 调用方超时后，后端的 handler 同样被取消
+	cctx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	// 网关的 deadline 和调用方的同时到达，错误可能来自任意一方
+	if err := cli.Call(cctx, "Order.Slow", &Req{}, &resp); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("err = %v", err)
+	}
+	select {
+	case <-order.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("backend handler was not canceled")
+	}
+
+	// gob 编码的 body 无法转发
+	gob, err := client.Dial(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gob.Close()
+	if err := gob.Call(ctx, "Order.Get", &Req{ID: "1"}, &resp); err == nil || !strings.Contains(err.Error(), codec.ErrRawUnsupported.Error()) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	g := New(memory.New(nil))
+	g.Route("Order", "orders")
+	g.RoutePrefix("Pay", "payments")
+	g.RoutePrefix("PayOut", "payouts")
+	cases := map[string]string{
+		"Order":       "orders",
+		"OrderAudit":  "OrderAudit", // Route 只匹配完整的服务名
+		"Payment":     "payments",
+		"PayOutBatch": "payouts", // 最长的前缀
+		"User":        "User",
+	}
+	for service, want := range cases {
+		if got := g.target(service); got != want {
+			t.Errorf("target(%q) = %q, want %q", service, got, want)
+		}
+	}
+	g.SetDefault("legacy")
+	g.RoutePrefix("PayOut", "")
+	g.Route("Order", "")
+	for service, want := range map[string]string{"User": "legacy", "PayOutBatch": "payments", "Order": "legacy"} {
+		if got := g.target(service); got != want {
+			t.Errorf("target(%q) = %q, want %q", service, got, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package appleseed
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+)
+
+// DefaultGoAwayGrace 见 WithGoAwayGrace
+const DefaultGoAwayGrace = time.Second
+
+// WithGoAwayGrace Shutdown 开始时向每个连接发送 GOAWAY 控制帧，客户端收到后不再在这个连接上发起新的调用
+// （Pool 会换到其他实例），等到已经发出的调用都收到响应后主动关闭连接，所以正在进行的调用不会因为关闭连接而失败。
+//
+// 正在处理的请求都完成之后，如果还有客户端没有关闭连接（比如不支持 GOAWAY 的 net/rpc 客户端，或者请求还在
+// 发送的路上），Shutdown 从发送 GOAWAY 开始最多等待 d，之后关闭剩余的连接。默认为 DefaultGoAwayGrace，
+// d <= 0 时不发送 GOAWAY，请求完成后直接关闭连接
+func WithGoAwayGrace(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.goAwayGrace = d
+		if d == 0 {
+			s.goAwayGrace = -1
+		}
+	}
+}
+
+// activeCodec 一个正在读取请求的 codec，Shutdown 时向它发送 GOAWAY
+type activeCodec struct {
+	c        codec.ServerCodec
+	cc       *codec.CountConn // 为 nil 时不设置写入的期限
+	sendLock *sync.Mutex
+	sending  sync.WaitGroup // 正在发送的 GOAWAY，在 s.mu 中 Add
+}
+
+// trackCodec serveCodec 开始时调用，已经在 Shutdown 时立即发送 GOAWAY
+func (s *Server) trackCodec(c codec.ServerCodec, cc *codec.CountConn, sendLock *sync.Mutex) *activeCodec {
+	a := &activeCodec{c: c, cc: cc, sendLock: sendLock}
+	s.mu.Lock()
+	if s.codecs == nil {
+		s.codecs = make(map[*activeCodec]struct{})
+	}
+	s.codecs[a] = struct{}{}
+	if s.shuttingDown() && s.goAwayGrace >= 0 {
+		a.sending.Add(1)
+		go s.sendGoAway(a, 0)
+	}
+	s.mu.Unlock()
+	return a
+}
+
+// untrackCodec serveCodec 结束时调用，此时所有的响应都已经发送，等待 GOAWAY 发送完，之后连接的统计不再变化
+func (s *Server) untrackCodec(a *activeCodec) {
+	s.mu.Lock()
+	delete(s.codecs, a)
+	s.mu.Unlock()
+	a.sending.Wait()
+}
+
+// goAwayAll 向所有的连接发送 GOAWAY，drainTimeout 为 Shutdown 的 ctx 剩余的时间，没有 deadline 时为 0
+func (s *Server) goAwayAll(ctx context.Context) {
+	var drainTimeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		drainTimeout = time.Until(deadline)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for a := range s.codecs {
+		// 客户端没有读取时写入会阻塞，不能阻塞 Shutdown
+		a.sending.Add(1)
+		go s.sendGoAway(a, drainTimeout)
+	}
+}
+
+func (s *Server) sendGoAway(a *activeCodec, drainTimeout time.Duration) {
+	defer a.sending.Done()
+	resp := &codec.ResponseHeader{Seq: codec.GoAwaySeq}
+	if drainTimeout > 0 {
+		resp.Metadata = map[string]string{metadata.DrainTimeoutKey: drainTimeout.String()}
+	}
+	a.sendLock.Lock()
+	defer a.sendLock.Unlock()
+	s.setWriteDeadline(a.cc)
+	if err := a.c.WriteResponse(resp, invalidRequest); err != nil {
+		log.Println("rpc server: write goaway error: ", err)
+		closeOnWriteTimeout(a.cc, err)
+	}
+}
+
+// awaitingClose 发送 GOAWAY 之后是否还需要等待客户端关闭连接
+func (s *Server) awaitingClose(sent time.Time) bool {
+	if s.goAwayGrace < 0 || time.Since(sent) >= s.goAwayGrace {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.codecs) > 0
+}
@@ -0,0 +1,82 @@
+package appleseed
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// ServerOption 用于配置 Server
+type ServerOption func(*Server)
+
+// WithInterceptors 添加服务端拦截器，按照添加的顺序执行，第一个拦截器在最外层
+func WithInterceptors(interceptors ...Interceptor) ServerOption {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// WithStatsHandler 添加请求的统计回调，比如 tracing、metrics
+func WithStatsHandler(h StatsHandler) ServerOption {
+	return func(s *Server) {
+		s.statsHandlers = append(s.statsHandlers, h)
+	}
+}
+
+// ServerInfo 拦截器和统计回调可以获取的请求信息
+type ServerInfo struct {
+	ServiceMethod string
+	RequestID     string
+	Queued        time.Time // 请求读取完成的时间，到 handler 开始执行之前为排队等待的时间
+}
+
+// Handler 处理一次请求，arg 和 reply 与注册的方法的参数类型相同
+type Handler func(ctx context.Context, arg, reply any) error
+
+// Interceptor 服务端拦截器，可以在 handler 执行前后做一些处理，需要调用 handler 才会继续处理请求，
+// 返回的错误会发送给客户端
+type Interceptor func(ctx context.Context, info *ServerInfo, arg, reply any, handler Handler) error
+
+// chainInterceptors 将 interceptors 和 handler 组合成一个 Handler
+func chainInterceptors(interceptors []Interceptor, info *ServerInfo, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, arg, reply any) error {
+			return interceptor(ctx, info, arg, reply, next)
+		}
+	}
+	return handler
+}
+
+// PanicError handler 或者拦截器 panic 时返回给客户端的错误
+type PanicError struct {
+	ServiceMethod string
+	Value         any // recover() 的返回值
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rpc: panic in %v: %v", e.ServiceMethod, e.Value)
+}
+
+// ServerStats 一次请求的统计
+type ServerStats struct {
+	ServiceMethod string
+	RequestID     string
+	Start         time.Time         // 开始读取请求的时间
+	End           time.Time         // 响应发送完成的时间
+	BytesReceived int64             // 请求（header 和 body）在连接上的大小，即 Received.Total()
+	BytesSent     int64             // 响应（header 和 body）在连接上的大小，即 Sent.Total()
+	Received      codec.MessageSize // 请求的 header 和 body 各自的大小，以及 body 解压缩后的大小
+	Sent          codec.MessageSize // 响应的大小
+	Err           error             // 返回给客户端的错误，handler panic 时同样会转换为错误
+}
+
+// StatsHandler 服务端请求的统计回调
+type StatsHandler interface {
+	// TagRPC 在拦截器和 handler 之前调用，返回的 ctx 会传给拦截器和 handler
+	TagRPC(ctx context.Context, info *ServerInfo) context.Context
+	// HandleRPC 在响应发送之后调用，ctx 为 TagRPC 返回的 ctx
+	HandleRPC(ctx context.Context, stats *ServerStats)
+}
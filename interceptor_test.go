@@ -0,0 +1,257 @@
+package appleseed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+type Ctx struct{}
+
+func (c *Ctx) Deadline(ctx context.Context, args *Args, reply *Reply) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline")
+	}
+	reply.Add = int64(time.Until(deadline))
+	return nil
+}
+
+func (c *Ctx) Panic(args *Args, reply *Reply) error {
+	panic("boom")
+}
+
+// recordStats 记录所有的 ServerStats
+type recordStats struct {
+	mu    sync.Mutex
+	stats []*ServerStats
+}
+
+type tagKey struct{}
+
+func (r *recordStats) TagRPC(ctx context.Context, info *ServerInfo) context.Context {
+	return context.WithValue(ctx, tagKey{}, info.ServiceMethod)
+}
+
+func (r *recordStats) HandleRPC(ctx context.Context, stats *ServerStats) {
+	if ctx.Value(tagKey{}) != stats.ServiceMethod {
+		panic("HandleRPC got a ctx not returned by TagRPC")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = append(r.stats, stats)
+}
+
+func (r *recordStats) last() *ServerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats[len(r.stats)-1]
+}
+
+func TestInterceptorsAndStats(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, info *ServerInfo, arg, reply any, handler Handler) error {
+			mu.Lock()
+			order = append(order, name+" "+info.ServiceMethod)
+			mu.Unlock()
+			if ctx.Value(tagKey{}) == nil {
+				return errors.New("interceptor got a ctx without the stats tag")
+			}
+			return handler(ctx, arg, reply)
+		}
+	}
+	stats := new(recordStats)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := NewServer(context.Background(), "ctx", "127.0.0.1", port, memory.New(nil),
+		WithInterceptors(record("outer"), record("inner")), WithStatsHandler(stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(Ctx)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(context.Background())
+	cli := dialClient(t, s.addr)
+	defer cli.Close()
+
+	// 客户端的 deadline 传递给 handler 的 ctx
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var reply Reply
+	if err := cli.Call(ctx, "Ctx.Deadline", &Args{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if left := time.Duration(reply.Add); left <= 50*time.Second || left > time.Minute {
+		t.Fatalf("deadline in handler %v from now", left)
+	}
+	if got := strings.Join(order, ","); got != "outer Ctx.Deadline,inner Ctx.Deadline" {
+		t.Fatalf("interceptors order: %v", got)
+	}
+	st := stats.last()
+	if st.Err != nil || st.BytesReceived == 0 || st.BytesSent == 0 || st.End.Before(st.Start) || st.RequestID == "" {
+		t.Fatalf("stats = %+v", st)
+	}
+	if err := cli.Call(context.Background(), "Ctx.Deadline", &Args{}, &reply); err == nil {
+		t.Fatal("want error without deadline")
+	}
+
+	// handler panic 不会导致 server 退出，而是返回错误
+	err = cli.Call(context.Background(), "Ctx.Panic", &Args{}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "rpc: panic in Ctx.Panic: boom") {
+		t.Fatalf("err = %v", err)
+	}
+	var pe *PanicError
+	if st := stats.last(); !errors.As(st.Err, &pe) || pe.Value != "boom" {
+		t.Fatalf("stats err = %v", st.Err)
+	}
+	if err := cli.Call(ctx, "Ctx.Deadline", &Args{}, &reply); err != nil {
+		t.Fatalf("call after panic: %v", err)
+	}
+}
+
+// clientStats 记录客户端所有的 CallStats
+type clientStats struct {
+	mu    sync.Mutex
+	stats []*client.CallStats
+}
+
+func (c *clientStats) HandleRPC(stats *client.CallStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = append(c.stats, stats)
+}
+
+// lockedWriter 可以在多个 goroutine 中写入、在测试中读取的 log 输出
+type lockedWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *lockedWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// TestMessageSizeStats 客户端和服务端统计的请求和响应的大小相同，并且累计到每个方法的统计和 access log 中
+func TestMessageSizeStats(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts []client.ClientOption
+	}{
+		{"gob", nil},
+		{"binary", []client.ClientOption{client.WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+			return codec.NewBinaryClientCodec(conn)
+		})}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			serverStats, callStats := new(recordStats), new(clientStats)
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, port, _ := net.SplitHostPort(lis.Addr().String())
+			s, err := NewServer(context.Background(), "size", "127.0.0.1", port, memory.New(nil), WithStatsHandler(serverStats))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Register(new(Ctx)); err != nil {
+				t.Fatal(err)
+			}
+			go s.Serve(lis)
+			defer s.Shutdown(context.Background())
+			logs := new(lockedWriter)
+			log.SetOutput(logs)
+			defer log.SetOutput(os.Stderr)
+
+			cli, err := client.Dial(context.Background(), "tcp", s.addr, append(c.opts, client.WithStatsHandler(callStats))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cli.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			for i := 0; i < 3; i++ {
+				var reply Reply
+				if err := cli.Call(ctx, "Ctx.Deadline", &Args{X: int64(i)}, &reply); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 服务端在响应发送之后才调用 HandleRPC
+			deadline := time.Now().Add(time.Second)
+			for {
+				serverStats.mu.Lock()
+				n := len(serverStats.stats)
+				serverStats.mu.Unlock()
+				if n == 3 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%d server stats", n)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			var sent, received int64
+			serverStats.mu.Lock()
+			defer serverStats.mu.Unlock()
+			callStats.mu.Lock()
+			defer callStats.mu.Unlock()
+			if len(callStats.stats) != 3 {
+				t.Fatalf("%d client stats", len(callStats.stats))
+			}
+			for i, cs := range callStats.stats {
+				ss := serverStats.stats[i]
+				if cs.Sent != ss.Received || cs.Received != ss.Sent || cs.Sent.Header == 0 || cs.Sent.Body == 0 ||
+					cs.Received.Header == 0 || cs.Received.Body == 0 || ss.BytesReceived != ss.Received.Total() {
+					t.Fatalf("call %d: client %+v, server %+v", i, cs, ss)
+				}
+				if cs.ServiceMethod != "Ctx.Deadline" || cs.Err != nil || cs.End.Before(cs.Start) || cs.RequestID == "" {
+					t.Fatalf("call %d: client %+v", i, cs)
+				}
+				sent += cs.Sent.Total()
+				received += cs.Received.Total()
+				if line := fmt.Sprintf("req_bytes=%d resp_bytes=%d", ss.BytesReceived, ss.BytesSent); !strings.Contains(logs.String(), line) {
+					t.Fatalf("access log without %q", line)
+				}
+			}
+			want := MethodStats{Calls: 3, BytesReceived: sent, BytesSent: received}
+			if got := s.MethodStats()["Ctx.Deadline"]; got != want {
+				t.Fatalf("server method stats = %+v, want %+v", got, want)
+			}
+			wantClient := client.MethodStats{Calls: 3, BytesSent: sent, BytesReceived: received}
+			if got := cli.Stats().Methods["Ctx.Deadline"]; got != wantClient {
+				t.Fatalf("client method stats = %+v, want %+v", got, wantClient)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Package slowcall 客户端和服务端共用的慢调用检测：按方法覆盖的阈值，以及限制每秒输出的日志数量
+package slowcall
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultLogLimit 默认每秒最多输出的慢调用日志数量
+const DefaultLogLimit = 10
+
+// Detector 判断调用是否超过阈值，创建之后只读，可以并发使用
+type Detector struct {
+	threshold time.Duration            // <= 0 时只检测 methods 中的方法
+	methods   map[string]time.Duration // 按方法覆盖的阈值，<= 0 表示不检测该方法
+	limiter   Limiter
+}
+
+// New 返回默认阈值为 threshold、每秒最多放行 logLimit 条日志的 Detector，logLimit <= 0 时使用 DefaultLogLimit
+func New(threshold time.Duration, methods map[string]time.Duration, logLimit int) *Detector {
+	if logLimit <= 0 {
+		logLimit = DefaultLogLimit
+	}
+	return &Detector{threshold: threshold, methods: methods, limiter: Limiter{limit: logLimit}}
+}
+
+// Threshold 返回 method 的阈值，<= 0 表示不检测
+func (d *Detector) Threshold(method string) time.Duration {
+	if t, ok := d.methods[method]; ok {
+		return t
+	}
+	return d.threshold
+}
+
+// Slow 返回耗时 elapsed 的 method 是否为慢调用，以及使用的阈值
+func (d *Detector) Slow(method string, elapsed time.Duration) (bool, time.Duration) {
+	t := d.Threshold(method)
+	return t > 0 && elapsed > t, t
+}
+
+// Allow 返回这一条日志是否可以输出，可以输出时同时返回上一条输出之后被丢弃的日志数量
+func (d *Detector) Allow(now time.Time) (bool, int) {
+	return d.limiter.Allow(now)
+}
+
+// Limiter 固定窗口的限流，每秒最多放行 limit 次
+type Limiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Time // 当前窗口的开始时间
+	count   int       // 当前窗口中已经放行的次数
+	dropped int       // 上一次放行之后被拒绝的次数
+}
+
+// Allow 返回是否放行，放行时同时返回上一次放行之后被拒绝的次数并清零
+func (l *Limiter) Allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.window) >= time.Second {
+		l.window, l.count = now, 0
+	}
+	if l.count >= l.limit {
+		l.dropped++
+		return false, 0
+	}
+	l.count++
+	dropped := l.dropped
+	l.dropped = 0
+	return true, dropped
+}
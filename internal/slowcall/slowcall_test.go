@@ -0,0 +1,50 @@
+package slowcall
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetector(t *testing.T) {
+	d := New(100*time.Millisecond, map[string]time.Duration{"A.Slow": time.Second, "A.Off": 0}, 0)
+	for _, c := range []struct {
+		method  string
+		elapsed time.Duration
+		slow    bool
+	}{
+		{"A.Fast", 50 * time.Millisecond, false},
+		{"A.Fast", 150 * time.Millisecond, true},
+		{"A.Slow", 500 * time.Millisecond, false},
+		{"A.Slow", 2 * time.Second, true},
+		{"A.Off", time.Hour, false},
+	} {
+		if slow, _ := d.Slow(c.method, c.elapsed); slow != c.slow {
+			t.Fatalf("Slow(%s, %v) = %v", c.method, c.elapsed, slow)
+		}
+	}
+	// 没有默认阈值时只检测覆盖了阈值的方法
+	d = New(0, map[string]time.Duration{"A.Slow": time.Second}, 0)
+	if slow, _ := d.Slow("A.Fast", time.Hour); slow {
+		t.Fatal("method without threshold reported as slow")
+	}
+	if slow, th := d.Slow("A.Slow", 2*time.Second); !slow || th != time.Second {
+		t.Fatalf("Slow = %v, %v", slow, th)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := Limiter{limit: 2}
+	now := time.Unix(100, 0)
+	for i, want := range []bool{true, true, false, false, false} {
+		if ok, _ := l.Allow(now.Add(time.Duration(i) * time.Millisecond)); ok != want {
+			t.Fatalf("Allow #%d = %v", i, ok)
+		}
+	}
+	// 下一个窗口放行，并报告之前丢弃的数量
+	if ok, dropped := l.Allow(now.Add(time.Second)); !ok || dropped != 3 {
+		t.Fatalf("Allow = %v, dropped %d", ok, dropped)
+	}
+	if ok, dropped := l.Allow(now.Add(time.Second)); !ok || dropped != 0 {
+		t.Fatalf("Allow = %v, dropped %d", ok, dropped)
+	}
+}
@@ -0,0 +1,278 @@
+package appleseed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	reuseport "github.com/kavu/go_reuseport"
+)
+
+// DefaultStopTimeout Lifecycle.Stop 的 ctx 没有 deadline 时，所有阶段一共最多使用的时间
+const DefaultStopTimeout = 30 * time.Second
+
+// Component 由 Lifecycle 按顺序启动和停止的组件，Server、registry.Registration、client.Pool 都实现了它。
+// Start 不能阻塞，需要一直运行的部分放到 goroutine 中；Stop 应当在 ctx 结束前返回
+type Component interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// Hook 使用函数实现 Component，为 nil 的函数什么也不做
+type Hook struct {
+	OnStart func(ctx context.Context) error
+	OnStop  func(ctx context.Context) error
+}
+
+func (h Hook) Start(ctx context.Context) error {
+	if h.OnStart == nil {
+		return nil
+	}
+	return h.OnStart(ctx)
+}
+
+func (h Hook) Stop(ctx context.Context) error {
+	if h.OnStop == nil {
+		return nil
+	}
+	return h.OnStop(ctx)
+}
+
+// PhaseError 一个阶段中的组件返回的错误
+type PhaseError struct {
+	Phase string
+	Err   error
+}
+
+// LifecycleError Stop（或者 Start 失败后回滚）时各个阶段返回的所有错误，errors.Is 对其中任何一个成立时返回 true
+type LifecycleError struct {
+	Errors []PhaseError
+}
+
+func (e *LifecycleError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, pe := range e.Errors {
+		msgs[i] = pe.Phase + ": " + pe.Err.Error()
+	}
+	return "rpc: lifecycle: " + strings.Join(msgs, "; ")
+}
+
+func (e *LifecycleError) Is(target error) bool {
+	for _, pe := range e.Errors {
+		if errors.Is(pe.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// LifecycleOption 用于配置 Lifecycle
+type LifecycleOption func(*Lifecycle)
+
+// WithStopTimeout Stop 的 ctx 没有 deadline 时（比如收到信号时），所有阶段一共最多使用 d，默认为 DefaultStopTimeout
+func WithStopTimeout(d time.Duration) LifecycleOption {
+	return func(l *Lifecycle) {
+		if d > 0 {
+			l.stopTimeout = d
+		}
+	}
+}
+
+// WithSignals Run 收到 sig 中的信号时开始停止，默认为 SIGINT 和 SIGTERM
+func WithSignals(sig ...os.Signal) LifecycleOption {
+	return func(l *Lifecycle) {
+		l.signals = sig
+	}
+}
+
+type phase struct {
+	name       string
+	components []Component
+}
+
+// Lifecycle 按照确定的顺序启动和停止进程中的组件：阶段按照 Add 的顺序启动，按照相反的顺序停止，同一个阶段中的
+// 组件并发启动和停止。一个 server 通常这样组织：
+//
+//	s, err := appleseed.NewServer(ctx, "svc", host, port, reg, appleseed.WithRegisterStopped())
+//	lc := appleseed.NewLifecycle()
+//	lc.Add("downstream", pool)               // 最先启动，最后关闭：server 的请求都处理完之后才关闭到下游的连接
+//	lc.Add("server", s)                      // 停止时发送 GOAWAY，等待正在处理的请求完成
+//	lc.Add("registration", s.Registration()) // 最后启动，最先停止：先设置为 DRAINING 并注销，客户端不再选择本实例
+//	err := lc.Run(ctx)                       // 收到 SIGINT、SIGTERM 或者 ctx 结束时停止
+//
+// 停止时所有的阶段都会执行，一个阶段失败不会中止之后的阶段，错误收集到 LifecycleError 中返回。
+// 每个阶段最多使用剩余时间的平均值（剩余时间 / 剩余的阶段数），提前完成的阶段剩下的时间留给之后的阶段；
+// 超时之后不再等待这个阶段中还没有返回的组件，直接开始下一个阶段
+type Lifecycle struct {
+	stopTimeout time.Duration
+	signals     []os.Signal
+
+	mu      sync.Mutex
+	phases  []phase
+	started int  // 已经启动的阶段数，Stop 只停止这些阶段
+	stopped bool // 已经调用过 Stop
+}
+
+// NewLifecycle 创建一个 Lifecycle
+func NewLifecycle(opts ...LifecycleOption) *Lifecycle {
+	l := &Lifecycle{stopTimeout: DefaultStopTimeout, signals: []os.Signal{os.Interrupt, syscall.SIGTERM}}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Add 添加一个名为 name 的阶段，其中的组件并发启动和停止。需要在 Start 之前调用
+func (l *Lifecycle) Add(name string, components ...Component) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.phases = append(l.phases, phase{name: name, components: components})
+}
+
+// Start 按顺序启动每个阶段，一个阶段中有组件启动失败时，按照相反的顺序停止已经启动的阶段（包括这个阶段），
+// 返回启动的错误
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	phases := l.phases
+	l.mu.Unlock()
+	for i, p := range phases {
+		errs := runPhase(ctx, p, Component.Start)
+		l.mu.Lock()
+		l.started = i + 1
+		l.mu.Unlock()
+		if len(errs) > 0 {
+			err := fmt.Errorf("rpc: lifecycle: start %s: %w", p.name, errs[0].Err)
+			if serr := l.Stop(context.Background()); serr != nil {
+				log.Println("rpc: lifecycle: stop after a failed start:", serr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop 按照相反的顺序停止已经启动的阶段，返回 *LifecycleError 或者 nil。ctx 没有 deadline 时使用
+// WithStopTimeout 的时间。只有第一次调用有效
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		return nil
+	}
+	l.stopped = true
+	phases := l.phases[:l.started]
+	l.mu.Unlock()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.stopTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	var errs []PhaseError
+	for i := len(phases) - 1; i >= 0; i-- {
+		budget := time.Until(deadline) / time.Duration(i+1)
+		pctx, cancel := context.WithTimeout(ctx, budget)
+		errs = append(errs, runPhase(pctx, phases[i], Component.Stop)...)
+		cancel()
+	}
+	if len(errs) > 0 {
+		return &LifecycleError{Errors: errs}
+	}
+	return nil
+}
+
+// Run 启动所有的阶段，收到 WithSignals 的信号或者 ctx 结束之后停止，返回启动或者停止的错误
+func (l *Lifecycle) Run(ctx context.Context) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, l.signals...)
+	defer signal.Stop(sig)
+	if err := l.Start(ctx); err != nil {
+		return err
+	}
+	select {
+	case s := <-sig:
+		log.Printf("rpc: lifecycle: received %v, stopping\n", s)
+	case <-ctx.Done():
+	}
+	// ctx 可能已经结束，停止使用独立的超时时间
+	return l.Stop(context.Background())
+}
+
+// runPhase 并发地对 p 中的每个组件调用 f，等待全部返回或者 ctx 结束，返回所有的错误。
+// ctx 结束时还没有返回的组件记为 ctx.Err()
+func runPhase(ctx context.Context, p phase, f func(Component, context.Context) error) []PhaseError {
+	results := make(chan error, len(p.components))
+	for _, c := range p.components {
+		go func(c Component) {
+			results <- f(c, ctx)
+		}(c)
+	}
+	var errs []PhaseError
+	for range p.components {
+		select {
+		case err := <-results:
+			if err != nil {
+				errs = append(errs, PhaseError{Phase: p.name, Err: err})
+			}
+		case <-ctx.Done():
+			return append(errs, PhaseError{Phase: p.name, Err: ctx.Err()})
+		}
+	}
+	return errs
+}
+
+// WithListener Start 在 lis 上接收连接，而不是监听 NewServer 的地址（或者 WithUnixSocket 的路径）
+func WithListener(lis net.Listener) ServerOption {
+	return func(s *Server) {
+		s.startListener = lis
+	}
+}
+
+// WithRegisterStopped NewServer 将本实例注册为 STOPPED，客户端不会选中它，直到 Registration().Start（或者
+// SetStatus）将其修改为 SERVING。用于 Lifecycle：registration 阶段在 server 阶段之后启动，保证客户端选中本实例时
+// server 已经在接收连接。没有这个选项时实例注册后就是 SERVING
+func WithRegisterStopped() ServerOption {
+	return func(s *Server) {
+		s.registerStopped = true
+	}
+}
+
+// Start 开始在后台接收连接，用于 Lifecycle：使用 WithListener 的 listener，否则监听 WithUnixSocket 的路径
+// 或者 NewServer 的地址。监听失败时返回错误
+func (s *Server) Start(ctx context.Context) error {
+	lis := s.startListener
+	if lis == nil {
+		var err error
+		if s.unixPath != "" {
+			lis, err = ListenUnix(s.unixPath, s.unixMode)
+		} else {
+			lis, err = reuseport.Listen("tcp", s.addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	go func() {
+		if err := s.Serve(lis); err != ErrServerClosed {
+			log.Println("rpc server: serve error: ", err)
+		}
+	}()
+	return nil
+}
+
+// Stop 同 Shutdown，已经关闭时返回 nil
+func (s *Server) Stop(ctx context.Context) error {
+	if err := s.Shutdown(ctx); err != ErrServerClosed {
+		return err
+	}
+	return nil
+}
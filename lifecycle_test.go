@@ -0,0 +1,228 @@
+package appleseed
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+// Relay 等待 release 关闭之后调用下游的 XXX.Add
+type Relay struct {
+	pool    *client.Pool
+	entered chan struct{}
+	release chan struct{}
+	done    int32 // 原子操作，handler 返回时为 1
+}
+
+func (r *Relay) Add(ctx context.Context, args *Args, reply *Reply) error {
+	defer atomic.StoreInt32(&r.done, 1)
+	close(r.entered)
+	<-r.release
+	return r.pool.Call(ctx, "XXX.Add", args, reply)
+}
+
+var errBoom = errors.New("boom")
+
+// closeHook 关闭时调用 onClose 的 listener
+type closeHook struct {
+	net.Listener
+	onClose func()
+}
+
+func (l *closeHook) Close() error {
+	l.onClose()
+	return l.Listener.Close()
+}
+
+// TestLifecycleOrdering 停止时先注销实例，之后 server 才关闭 listener，正在处理的请求在到下游的连接池关闭之前完成，
+// Run 在请求完成之后才返回
+func TestLifecycleOrdering(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	downstream, err := NewServer(ctx, "downstream", "127.0.0.1", port, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := downstream.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	// 没有使用 WithRegisterStopped 时注册后就是 SERVING，不依赖之后通过 Serve、WebSocketHandler 还是 ServerCodec 处理连接
+	if !downstream.Registration().Instance().Serving() {
+		t.Fatalf("downstream status = %v, want SERVING", downstream.Registration().Instance().Status)
+	}
+	go downstream.Serve(lis)
+	defer downstream.Shutdown(ctx)
+	pool, err := client.NewPool(ctx, reg, "downstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listenerClosed := make(chan bool, 1) // 关闭 listener 时实例是否还在注册中心中
+	inner := inproc.Listen("front")
+	front, err := NewServer(ctx, "front", "127.0.0.1", "0", reg, WithListener(&closeHook{Listener: inner, onClose: func() {
+		ins, _ := reg.GetInstances(ctx, "front")
+		listenerClosed <- len(ins) > 0
+	}}), WithRegisterStopped())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &Relay{pool: pool, entered: make(chan struct{}), release: make(chan struct{})}
+	if err := front.RegisterName("Relay", relay); err != nil {
+		t.Fatal(err)
+	}
+
+	// 使用 WithRegisterStopped 时，server 阶段启动之前客户端不能选中本实例
+	if addrs, _ := reg.Get(ctx, "front"); len(addrs) != 0 {
+		t.Fatalf("front is pickable right after NewServer: %v", addrs)
+	}
+	pickableBeforeServer := make(chan []string, 1)
+	lc := NewLifecycle(WithStopTimeout(5 * time.Second))
+	lc.Add("downstream", pool)
+	lc.Add("check", Hook{OnStart: func(ctx context.Context) error {
+		addrs, _ := reg.Get(ctx, "front")
+		pickableBeforeServer <- addrs
+		return nil
+	}})
+	lc.Add("server", front)
+	lc.Add("registration", front.Registration())
+	started := make(chan struct{})
+	lc.Add("started", Hook{OnStart: func(ctx context.Context) error { close(started); return nil }})
+	runCtx, stop := context.WithCancel(ctx)
+	runErr := make(chan error, 1)
+	go func() { runErr <- lc.Run(runCtx) }()
+	<-started
+	if addrs := <-pickableBeforeServer; len(addrs) != 0 {
+		t.Fatalf("front is pickable before the server phase started: %v", addrs)
+	}
+	if addrs, _ := reg.Get(ctx, "front"); len(addrs) != 1 {
+		t.Fatalf("front addrs after start = %v, want it SERVING", addrs)
+	}
+
+	conn, err := inner.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := client.NewClient(conn, "front")
+	defer cli.Close()
+	var reply Reply
+	call := cli.Go(ctx, "Relay.Add", &Args{X: 1, Y: 2}, &reply, make(chan *client.Call, 1))
+	<-relay.entered
+
+	stop() // 相当于收到 SIGTERM
+	select {
+	case registered := <-listenerClosed:
+		if registered {
+			t.Fatal("listener closed while the instance was still registered")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener not closed")
+	}
+	select {
+	case err := <-runErr:
+		t.Fatalf("Run() = %v before the pending request completed", err)
+	default:
+	}
+
+	close(relay.release)
+	if err := <-runErr; err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if atomic.LoadInt32(&relay.done) != 1 {
+		t.Fatal("Run() returned before the handler completed")
+	}
+	<-call.Done
+	if call.Error != nil || reply.Add != 3 {
+		t.Fatalf("pending call = %+v, %v, want it served by the downstream pool", reply, call.Error)
+	}
+	if err := pool.Call(ctx, "XXX.Add", &Args{}, new(Reply)); !errors.Is(err, client.ErrShutdown) {
+		t.Fatalf("pool call after Run() = %v, want the pool closed", err)
+	}
+}
+
+// TestLifecycleErrors 停止时一个阶段失败或者超时不会中止之后的阶段，所有的错误都被返回；启动失败时回滚已经启动的阶段
+func TestLifecycleErrors(t *testing.T) {
+	// 超时的组件在 Stop 返回之后仍然可能在运行，events 需要加锁
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	add := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	record := func(name string, err error) Hook {
+		return Hook{
+			OnStart: func(ctx context.Context) error {
+				add("start " + name)
+				return err
+			},
+			OnStop: func(ctx context.Context) error {
+				add("stop " + name)
+				if name == "slow" {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				if name == "b" {
+					return errBoom
+				}
+				return nil
+			},
+		}
+	}
+
+	lc := NewLifecycle()
+	lc.Add("a", record("a", nil))
+	lc.Add("slow", record("slow", nil))
+	lc.Add("b", record("b", nil))
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := lc.Stop(sctx)
+	var le *LifecycleError
+	if !errors.As(err, &le) || len(le.Errors) != 2 || !errors.Is(err, errBoom) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop() = %v", err)
+	}
+	// slow 只能使用剩余时间的一半，a 仍然有时间停止
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Fatalf("Stop() took %v", d)
+	}
+	mu.Lock()
+	got := strings.Join(events[3:], ",")
+	events = nil
+	mu.Unlock()
+	if want := "stop b,stop slow,stop a"; got != want {
+		t.Fatalf("events = %v, want %s", got, want)
+	}
+
+	lc = NewLifecycle()
+	lc.Add("a", record("a", nil))
+	lc.Add("c", record("c", errBoom))
+	lc.Add("d", record("d", nil))
+	if err := lc.Start(context.Background()); !errors.Is(err, errBoom) {
+		t.Fatalf("Start() = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "start a,start c,stop c,stop a"; strings.Join(events, ",") != want {
+		t.Fatalf("events = %v, want %s", events, want)
+	}
+}
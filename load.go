@@ -0,0 +1,48 @@
+package appleseed
+
+import (
+	"sync/atomic"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// LoadFunc 根据正在处理的请求数 inflight 计算服务端的利用率（0~100，超过 100 时按 100 处理），
+// 可以结合 CPU 使用率、队列长度等指标
+type LoadFunc func(inflight int64) uint32
+
+// WithLoadReport 在每个响应中上报服务端正在处理的请求数和 f 计算的利用率，客户端的负载均衡器（比如 P2C）
+// 据此优先选择空闲的实例。不认识该字段的客户端会忽略它
+func WithLoadReport(f LoadFunc) ServerOption {
+	return func(s *Server) {
+		s.loadFunc = f
+	}
+}
+
+// CapacityLoad 返回按照 inflight / capacity 计算利用率的 LoadFunc，capacity 为服务端可以同时处理的请求数
+func CapacityLoad(capacity int64) LoadFunc {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return func(inflight int64) uint32 {
+		if inflight >= capacity {
+			return 100
+		}
+		return uint32(inflight * 100 / capacity)
+	}
+}
+
+// loadReport 返回当前的负载，没有开启 WithLoadReport 时返回 nil
+func (s *Server) loadReport() *codec.LoadReport {
+	if s.loadFunc == nil {
+		return nil
+	}
+	inflight := atomic.LoadInt64(&s.inflight)
+	if inflight < 0 {
+		inflight = 0
+	}
+	util := s.loadFunc(inflight)
+	if util > 100 {
+		util = 100
+	}
+	return &codec.LoadReport{Inflight: uint32(inflight), Utilization: util}
+}
@@ -0,0 +1,19 @@
+package appleseed
+
+import "testing"
+
+func TestCapacityLoad(t *testing.T) {
+	f := CapacityLoad(8)
+	for inflight, want := range map[int64]uint32{0: 0, 2: 25, 8: 100, 20: 100} {
+		if got := f(inflight); got != want {
+			t.Errorf("CapacityLoad(8)(%d) = %d, want %d", inflight, got, want)
+		}
+	}
+	s := &Server{inflight: 3, loadFunc: func(int64) uint32 { return 250 }}
+	if r := s.loadReport(); r.Inflight != 3 || r.Utilization != 100 {
+		t.Fatalf("loadReport() = %+v", r)
+	}
+	if r := (&Server{}).loadReport(); r != nil {
+		t.Fatalf("loadReport() = %+v without WithLoadReport", r)
+	}
+}
@@ -0,0 +1,194 @@
+package loadbalance
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// balancers 所有内置的负载均衡器，新增的负载均衡器需要加入这里，运行同一套测试
+var balancers = map[string]func() Balancer{
+	"RoundRobin":         func() Balancer { return &RoundRobin{} },
+	"WeightedRoundRobin": func() Balancer { return NewWeightedRoundRobin() },
+	"ConsistentHash":     func() Balancer { return NewConsistentHash(0, nil) },
+	"LeastConn":          func() Balancer { return NewLeastConn() },
+	"P2C":                func() Balancer { return NewP2C(0, 0) },
+	"Sticky":             func() Balancer { return NewSticky(&RoundRobin{}, time.Minute, 0) },
+	"ZoneAware":          func() Balancer { return NewZoneAware("a", 0.5, func() Balancer { return &RoundRobin{} }) },
+	"Subset":             func() Balancer { return NewSubset(&RoundRobin{}, 0, 100) },
+	"Router": func() Balancer {
+		table, _ := NewRouteTable(RouteRule{Service: "s", Default: "v1", Splits: []TrafficSplit{{"v2", 50}}})
+		return NewRouter("s", table, func() Balancer { return &RoundRobin{} })
+	},
+}
+
+func TestConformance(t *testing.T) {
+	for name, newBalancer := range balancers {
+		newBalancer := newBalancer
+		t.Run(name, func(t *testing.T) {
+			t.Run("Empty", func(t *testing.T) { testEmpty(t, newBalancer()) })
+			t.Run("AddDedupe", func(t *testing.T) { testAddDedupe(t, newBalancer()) })
+			t.Run("UpdateDelete", func(t *testing.T) { testUpdateDelete(t, newBalancer()) })
+			t.Run("Set", func(t *testing.T) { testSet(t, newBalancer()) })
+			t.Run("ConcurrentSet", func(t *testing.T) { testConcurrentSet(t, newBalancer()) })
+		})
+	}
+}
+
+func sorted(addrs []string) string {
+	addrs = append([]string(nil), addrs...)
+	sort.Strings(addrs)
+	return fmt.Sprint(addrs)
+}
+
+// picked 调用多次 Get，返回所有被选中的地址
+func picked(lb Balancer, n int) map[string]int {
+	count := make(map[string]int)
+	for i := 0; i < n; i++ {
+		count[lb.Get()]++
+	}
+	return count
+}
+
+func testEmpty(t *testing.T, lb Balancer) {
+	if got := lb.Get(); got != "" {
+		t.Fatalf("Get() = %q on empty balancer", got)
+	}
+	if got := lb.Addrs(); len(got) != 0 {
+		t.Fatalf("Addrs() = %v on empty balancer", got)
+	}
+	if err := lb.Delete("a"); err == nil {
+		t.Fatal("Delete of unknown addr should fail")
+	}
+	if err := lb.Update("a", "b"); err == nil {
+		t.Fatal("Update of unknown addr should fail")
+	}
+}
+
+func testAddDedupe(t *testing.T, lb Balancer) {
+	for _, addr := range []string{"a", "b", "a", "c", "b"} {
+		lb.Add(addr)
+	}
+	if got := sorted(lb.Addrs()); got != "[a b c]" {
+		t.Fatalf("Addrs() = %v", got)
+	}
+	// 每个地址都应该能被选中
+	count := picked(lb, 300)
+	for _, addr := range []string{"a", "b", "c"} {
+		if count[addr] == 0 {
+			t.Fatalf("%v never picked: %v", addr, count)
+		}
+	}
+	if len(count) != 3 {
+		t.Fatalf("unexpected addr picked: %v", count)
+	}
+	// 修改 Addrs 的返回值不会影响负载均衡器
+	addrs := lb.Addrs()
+	addrs[0] = "x"
+	if got := sorted(lb.Addrs()); got != "[a b c]" {
+		t.Fatalf("Addrs() = %v after modifying the returned slice", got)
+	}
+}
+
+func testUpdateDelete(t *testing.T, lb Balancer) {
+	for _, addr := range []string{"a", "b", "c"} {
+		lb.Add(addr)
+	}
+	if err := lb.Update("b", "c"); err == nil {
+		t.Fatal("Update to an existing addr should fail")
+	}
+	if err := lb.Update("b", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Delete("a"); err == nil {
+		t.Fatal("Delete twice should fail")
+	}
+	if got := sorted(lb.Addrs()); got != "[c d]" {
+		t.Fatalf("Addrs() = %v", got)
+	}
+	count := picked(lb, 200)
+	if len(count) != 2 || count["c"] == 0 || count["d"] == 0 {
+		t.Fatalf("picked %v, want c and d", count)
+	}
+}
+
+func testSet(t *testing.T, lb Balancer) {
+	for _, addr := range []string{"a", "b", "c"} {
+		lb.Add(addr)
+	}
+	picked(lb, 10) // 产生一些选择进度
+
+	lb.Set([]string{"c", "d", "d", "e", "c"})
+	if got := sorted(lb.Addrs()); got != "[c d e]" {
+		t.Fatalf("Addrs() = %v after Set", got)
+	}
+	count := picked(lb, 300)
+	if len(count) != 3 || count["c"] == 0 || count["d"] == 0 || count["e"] == 0 {
+		t.Fatalf("picked %v after Set, want c, d and e", count)
+	}
+
+	// Set 之后仍然可以正常的增删
+	lb.Add("f")
+	if err := lb.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sorted(lb.Addrs()); got != "[d e f]" {
+		t.Fatalf("Addrs() = %v", got)
+	}
+
+	lb.Set(nil)
+	if got := lb.Get(); got != "" {
+		t.Fatalf("Get() = %q after Set(nil)", got)
+	}
+}
+
+// testConcurrentSet Set 与 Get 并发执行，Set 返回后 Get 不能再返回被移除的地址
+func testConcurrentSet(t *testing.T, lb Balancer) {
+	sets := [][]string{{"a", "b", "c"}, {"c", "d"}, {"e"}}
+	lb.Set(sets[0])
+
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				switch addr := lb.Get(); addr {
+				case "a", "b", "c", "d", "e":
+				default:
+					t.Errorf("Get() = %q, not in any set", addr)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 300; i++ {
+		set := sets[i%len(sets)]
+		lb.Set(set)
+		allowed := make(map[string]bool)
+		for _, addr := range set {
+			allowed[addr] = true
+		}
+		// Set 返回后，当前 goroutine 的 Get 只会看到新的地址
+		if addr := lb.Get(); !allowed[addr] {
+			close(stop)
+			wg.Wait()
+			t.Fatalf("Get() = %q right after Set(%v)", addr, set)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
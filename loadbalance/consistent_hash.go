@@ -0,0 +1,166 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultReplicas 每个地址默认的虚拟节点数量
+const DefaultReplicas = 100
+
+// HashFunc 将 data 映射到哈希环上
+type HashFunc func(data []byte) uint32
+
+var _ ContextBalancer = &ConsistentHash{}
+
+// ConsistentHash 一致性哈希负载均衡器，相同的 hash key（通过 WithHashKey 设置在 ctx 中）
+// 总是会选中同一个地址，删除一个地址时只有原本属于该地址的 key 会被重新分配。
+// ctx 中没有 hash key 时退化为轮询。并发安全
+type ConsistentHash struct {
+	replicas int
+	hash     HashFunc
+
+	mu    sync.RWMutex
+	addrs []string
+	ring  []uint32          // 所有虚拟节点的哈希值，从小到大排序
+	nodes map[uint32]string // key: 虚拟节点的哈希值 val: 地址
+
+	next uint64 // 没有 hash key 时用于轮询
+}
+
+// NewConsistentHash 创建一个一致性哈希负载均衡器，replicas 为每个地址的虚拟节点数量，
+// 为 0 时使用 DefaultReplicas，hash 为 nil 时使用 crc32
+func NewConsistentHash(replicas int, hash HashFunc) *ConsistentHash {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	if hash == nil {
+		hash = crc32.ChecksumIEEE
+	}
+	return &ConsistentHash{
+		replicas: replicas,
+		hash:     hash,
+		nodes:    make(map[uint32]string),
+	}
+}
+
+// Get 没有 hash key 时使用轮询
+func (c *ConsistentHash) Get() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.addrs) == 0 {
+		return ""
+	}
+	n := atomic.AddUint64(&c.next, 1) - 1
+	return c.addrs[n%uint64(len(c.addrs))]
+}
+
+// GetContext 如果 ctx 中有 hash key，则在哈希环上顺时针找到第一个虚拟节点对应的地址
+func (c *ConsistentHash) GetContext(ctx context.Context) string {
+	key, ok := HashKeyFromContext(ctx)
+	if !ok {
+		return c.Get()
+	}
+	return c.GetByKey(key)
+}
+
+// GetByKey 返回 key 在哈希环上对应的地址
+func (c *ConsistentHash) GetByKey(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.ring) == 0 {
+		return ""
+	}
+	h := c.hash([]byte(key))
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.nodes[c.ring[i]]
+}
+
+func (c *ConsistentHash) Addrs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.addrs...)
+}
+
+// Add 添加一个地址，地址已经存在时不做任何操作
+func (c *ConsistentHash) Add(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range c.addrs {
+		if a == addr {
+			return
+		}
+	}
+	c.addrs = append(c.addrs, addr)
+	c.rebuild()
+}
+
+// Set 替换所有地址并重新构建哈希环，仍然存在的地址对应的 key 不会被重新分配
+func (c *ConsistentHash) Set(addrs []string) {
+	addrs = dedupe(addrs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addrs = addrs
+	c.rebuild()
+	atomic.StoreUint64(&c.next, 0)
+}
+
+func (c *ConsistentHash) Update(oldAddr string, newAddr string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if newAddr != oldAddr {
+		for _, a := range c.addrs {
+			if a == newAddr {
+				return fmt.Errorf("%v already exists", newAddr)
+			}
+		}
+	}
+	for i, a := range c.addrs {
+		if a == oldAddr {
+			c.addrs[i] = newAddr
+			c.rebuild()
+			return nil
+		}
+	}
+	return fmt.Errorf("not found %v", oldAddr)
+}
+
+func (c *ConsistentHash) Delete(addr string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, a := range c.addrs {
+		if a == addr {
+			c.addrs = append(c.addrs[:i:i], c.addrs[i+1:]...)
+			c.rebuild()
+			return nil
+		}
+	}
+	return fmt.Errorf("not found %v", addr)
+}
+
+// rebuild 根据 addrs 重新构建哈希环，调用时需要持有 c.mu
+func (c *ConsistentHash) rebuild() {
+	ring := make([]uint32, 0, len(c.addrs)*c.replicas)
+	nodes := make(map[uint32]string, len(c.addrs)*c.replicas)
+	for _, addr := range c.addrs {
+		for i := 0; i < c.replicas; i++ {
+			h := c.hash([]byte(addr + "#" + strconv.Itoa(i)))
+			// 哈希冲突时保留先出现的虚拟节点
+			if _, ok := nodes[h]; ok {
+				continue
+			}
+			nodes[h] = addr
+			ring = append(ring, h)
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i] < ring[j] })
+	c.ring, c.nodes = ring, nodes
+}
@@ -0,0 +1,80 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"testing"
+)
+
+func TestConsistentHashSameKey(t *testing.T) {
+	c := NewConsistentHash(0, nil)
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		c.Add(addr)
+	}
+	ctx := WithHashKey(context.Background(), "user:42")
+	want := c.GetContext(ctx)
+	for i := 0; i < 100; i++ {
+		if got := Pick(ctx, c); got != want {
+			t.Fatalf("same key picked %v and %v", want, got)
+		}
+	}
+}
+
+func TestConsistentHashRedistribution(t *testing.T) {
+	fnv32 := func(data []byte) uint32 {
+		h := fnv.New32a()
+		h.Write(data)
+		return h.Sum32()
+	}
+	c := NewConsistentHash(200, fnv32)
+	addrs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	for _, addr := range addrs {
+		c.Add(addr)
+	}
+
+	const keys = 10000
+	before := make(map[string]string, keys)
+	count := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		before[key] = c.GetByKey(key)
+		count[before[key]]++
+	}
+	// 虚拟节点使分布比较均匀
+	for _, addr := range addrs {
+		if count[addr] < keys/len(addrs)/2 {
+			t.Fatalf("unbalanced distribution: %v", count)
+		}
+	}
+
+	if err := c.Delete("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	for key, old := range before {
+		now := c.GetByKey(key)
+		if old != "10.0.0.2" && now != old {
+			t.Fatalf("key %v moved from %v to %v although its node was not removed", key, old, now)
+		}
+		if now == "10.0.0.2" {
+			t.Fatalf("key %v still mapped to removed node", key)
+		}
+	}
+}
+
+func TestConsistentHashWithoutKey(t *testing.T) {
+	c := NewConsistentHash(10, nil)
+	c.Add("a")
+	c.Add("b")
+	c.Add("a")
+	count := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		count[Pick(context.Background(), c)]++
+	}
+	if count["a"] != 50 || count["b"] != 50 {
+		t.Fatalf("fallback distribution = %v", count)
+	}
+	if addr := NewConsistentHash(0, nil).GetContext(WithHashKey(context.Background(), "k")); addr != "" {
+		t.Fatalf("empty ring picked %v", addr)
+	}
+}
@@ -0,0 +1,145 @@
+package loadbalance
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	_ Balancer = &LeastConn{}
+	_ Reporter = &LeastConn{}
+)
+
+// LeastConn 最少连接数负载均衡器，记录每个地址上正在进行的调用数量（通过 Reporter 上报），
+// Get 返回正在进行的调用最少的地址，数量相同时随机选择。并发安全
+type LeastConn struct {
+	mu       sync.Mutex
+	addrs    []string
+	inflight map[string]int64 // key: addr val: 正在进行的调用数量
+	rand     *rand.Rand
+}
+
+func NewLeastConn() *LeastConn {
+	return &LeastConn{
+		inflight: make(map[string]int64),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (l *LeastConn) Get() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var (
+		min  int64
+		ties int
+		addr string
+	)
+	for _, a := range l.addrs {
+		n := l.inflight[a]
+		switch {
+		case ties == 0 || n < min:
+			min, ties, addr = n, 1, a
+		case n == min:
+			// 蓄水池抽样，保证数量相同的地址被选中的概率相同
+			ties++
+			if l.rand.Intn(ties) == 0 {
+				addr = a
+			}
+		}
+	}
+	return addr
+}
+
+// Start 增加 addr 上正在进行的调用数量，addr 不在负载均衡器中时忽略
+func (l *LeastConn) Start(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n, ok := l.inflight[addr]; ok {
+		l.inflight[addr] = n + 1
+	}
+}
+
+// Done 减少 addr 上正在进行的调用数量
+func (l *LeastConn) Done(addr string, err error, latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 地址可能在调用期间被删除后又重新添加，此时计数已经被重置，不能减为负数
+	if n, ok := l.inflight[addr]; ok && n > 0 {
+		l.inflight[addr] = n - 1
+	}
+}
+
+// Inflight 返回 addr 上正在进行的调用数量
+func (l *LeastConn) Inflight(addr string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight[addr]
+}
+
+func (l *LeastConn) Addrs() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.addrs...)
+}
+
+// Add 添加一个地址，地址已经存在时不做任何操作
+func (l *LeastConn) Add(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.inflight[addr]; ok {
+		return
+	}
+	l.addrs = append(l.addrs, addr)
+	l.inflight[addr] = 0
+}
+
+// Set 替换所有地址，仍然存在的地址保留正在进行的调用数量
+func (l *LeastConn) Set(addrs []string) {
+	addrs = dedupe(addrs)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inflight := make(map[string]int64, len(addrs))
+	for _, addr := range addrs {
+		inflight[addr] = l.inflight[addr]
+	}
+	l.addrs, l.inflight = addrs, inflight
+}
+
+func (l *LeastConn) Update(oldAddr string, newAddr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.inflight[oldAddr]; !ok {
+		return fmt.Errorf("not found %v", oldAddr)
+	}
+	if _, ok := l.inflight[newAddr]; ok && newAddr != oldAddr {
+		return fmt.Errorf("%v already exists", newAddr)
+	}
+	for i, a := range l.addrs {
+		if a == oldAddr {
+			l.addrs[i] = newAddr
+			break
+		}
+	}
+	// 新地址上还没有任何调用
+	delete(l.inflight, oldAddr)
+	l.inflight[newAddr] = 0
+	return nil
+}
+
+func (l *LeastConn) Delete(addr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.inflight[addr]; !ok {
+		return fmt.Errorf("not found %v", addr)
+	}
+	delete(l.inflight, addr)
+	for i, a := range l.addrs {
+		if a == addr {
+			l.addrs = append(l.addrs[:i:i], l.addrs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package loadbalance
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLeastConnPicksFewestInflight(t *testing.T) {
+	l := NewLeastConn()
+	for _, addr := range []string{"a", "b", "c"} {
+		l.Add(addr)
+	}
+	l.Add("a") // 重复添加会被忽略
+	l.Start("a")
+	l.Start("a")
+	l.Start("b")
+	if got := l.Get(); got != "c" {
+		t.Fatalf("Get() = %v, want c", got)
+	}
+	l.Start("c")
+	l.Start("c")
+	if got := l.Get(); got != "b" {
+		t.Fatalf("Get() = %v, want b", got)
+	}
+
+	// 失败的调用同样需要结束计数
+	l.Done("a", errors.New("boom"), 0)
+	l.Done("a", nil, 0)
+	if got := l.Get(); got != "a" {
+		t.Fatalf("Get() = %v, want a", got)
+	}
+	// 多余的 Done 不会让计数变为负数
+	l.Done("a", nil, 0)
+	if n := l.Inflight("a"); n != 0 {
+		t.Fatalf("inflight = %d", n)
+	}
+}
+
+func TestLeastConnTieBreakIsRandom(t *testing.T) {
+	l := NewLeastConn()
+	for _, addr := range []string{"a", "b", "c"} {
+		l.Add(addr)
+	}
+	count := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		count[l.Get()]++
+	}
+	for _, addr := range []string{"a", "b", "c"} {
+		if count[addr] < 800 {
+			t.Fatalf("tie break is not random: %v", count)
+		}
+	}
+}
+
+func TestLeastConnDelete(t *testing.T) {
+	l := NewLeastConn()
+	l.Add("a")
+	l.Add("b")
+	l.Start("b")
+	if err := l.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get(); got != "b" {
+		t.Fatalf("Get() = %v, want b", got)
+	}
+	// 删除后重新添加，计数从 0 开始，之前调用的 Done 会被忽略
+	l.Delete("b")
+	l.Add("b")
+	l.Done("b", nil, 0)
+	if n := l.Inflight("b"); n != 0 {
+		t.Fatalf("inflight = %d", n)
+	}
+	if err := l.Delete("x"); err == nil {
+		t.Fatal("want error")
+	}
+}
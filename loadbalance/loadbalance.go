@@ -1,5 +1,12 @@
 package loadbalance
 
+import (
+	"context"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
 type Balancer interface {
 	// Addrs 保存所有的服务器地址
 	Addrs() []string
@@ -13,8 +20,9 @@ type Balancer interface {
 	// GetWithWeight 均衡的从 AddrsWithWeight 中根据权重获取一个地址
 	//GetWithWeight() string
 
-	// SetAddrs 重置 addrs
-	//SetAddrs(addrs []string)
+	// Set 使用 addrs 原子地替换负载均衡器中的所有地址（重复的地址只保留一个），并重置轮询的位置等
+	// 选择进度，仍然存在的地址会保留它的权重、调用统计等信息。Set 返回后 Get 不会再返回被移除的地址
+	Set(addrs []string)
 
 	// SetAddrsWithWeight 重置 addrsWithWeight
 	//SetAddrsWithWeight(addrsWithWeight map[string]int64)
@@ -25,6 +33,85 @@ type Balancer interface {
 	// Update 更新负载均衡器中的一个地址
 	Update(oldAddr string, newAddr string) error
 
-	// Delete 删除负载均衡器中的一个地址
+	// Delete 删除负载均衡器中的一个地址，地址不存在时返回错误
 	Delete(addr string) error
 }
+
+// InstanceBalancer 可以使用实例完整信息（权重、zone 等）进行选择的负载均衡器，同时实现了
+// registry.InstanceTarget，Watch 会将实例的所有变化（包括权重的变化）同步给它
+type InstanceBalancer interface {
+	Balancer
+
+	// SetInstances 使用 instances 替换所有的实例，instances 中可能包含非 SERVING 状态的实例，
+	// 这些实例不会被选中
+	SetInstances(instances []registry.Instance)
+}
+
+// SetInstances 如果 lb 实现了 InstanceBalancer，则将 instances 交给它，否则使用其中 SERVING 状态
+// 实例的地址调用 Set
+func SetInstances(lb Balancer, instances []registry.Instance) {
+	if ib, ok := lb.(InstanceBalancer); ok {
+		ib.SetInstances(instances)
+		return
+	}
+	addrs := make([]string, 0, len(instances))
+	for _, ins := range instances {
+		if ins.Serving() {
+			addrs = append(addrs, ins.Addr)
+		}
+	}
+	lb.Set(addrs)
+}
+
+// dedupe 去除 addrs 中重复的地址，保持原有的顺序
+func dedupe(addrs []string) []string {
+	seen := make(map[string]struct{}, len(addrs))
+	ret := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		ret = append(ret, addr)
+	}
+	return ret
+}
+
+// ContextBalancer 可以根据每次调用的 ctx（比如 WithHashKey 设置的 hash key）来选择地址的负载均衡器
+type ContextBalancer interface {
+	Balancer
+
+	// GetContext 根据 ctx 均衡的从 addrs 中获取一个地址
+	GetContext(ctx context.Context) string
+}
+
+// Reporter 接收每次调用的开始和结束，根据调用情况进行选择的负载均衡器（比如最少连接数）需要实现该接口，
+// 调用方在向选中的地址发起调用前调用 Start，调用结束后（无论成功、失败、超时还是连接断开）调用一次 Done
+type Reporter interface {
+	// Start 即将向 addr 发起一次调用
+	Start(addr string)
+
+	// Done 对 addr 的调用已经结束，err 为调用的结果，latency 为调用的耗时
+	Done(addr string, err error, latency time.Duration)
+}
+
+// Pick 从 lb 中选择一个地址，如果 lb 实现了 ContextBalancer，则会使用 ctx 进行选择
+func Pick(ctx context.Context, lb Balancer) string {
+	if cb, ok := lb.(ContextBalancer); ok {
+		return cb.GetContext(ctx)
+	}
+	return lb.Get()
+}
+
+type hashKey struct{}
+
+// WithHashKey 设置本次调用的 hash key，一致性哈希负载均衡器会让相同 key 的调用选中同一个地址
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// HashKeyFromContext 返回 WithHashKey 设置的 hash key
+func HashKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKey{}).(string)
+	return key, ok
+}
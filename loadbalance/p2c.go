@@ -0,0 +1,248 @@
+package loadbalance
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+const (
+	// DefaultDecay 延迟的指数加权移动平均（EWMA）默认的衰减时间，越小越偏向最近的延迟
+	DefaultDecay = 10 * time.Second
+	// DefaultPenalty 调用出错时默认按照该延迟计入 EWMA
+	DefaultPenalty = time.Second
+	// loadWeight 服务端上报的利用率对得分的影响，利用率为 100 时得分是空闲时的 1+loadWeight 倍
+	loadWeight = 4
+)
+
+var (
+	_ Balancer     = &P2C{}
+	_ Reporter     = &P2C{}
+	_ LoadReceiver = &P2C{}
+)
+
+// P2C power of two choices 负载均衡器，每次随机选出两个地址，返回得分更低的一个，
+// 得分为 (延迟的 EWMA + 1) * (正在进行的调用数量 + 1)，调用的延迟和结果通过 Reporter 上报。
+// 出错的调用（status.Code.ServerFault）按照 penalty 计入延迟，随着之后成功的调用逐渐恢复；还没有任何数据的地址
+// 使用其他地址的平均延迟，既不会总是被选中也不会永远不被选中。
+// 服务端上报了负载（见 LoadReceiver）时，得分再乘以 1 + loadWeight * 利用率，利用率随着时间按照 decay 衰减，
+// 避免因为过时的高负载一直不被选中。可以通过 SetSlowStart 开启慢启动。并发安全
+type P2C struct {
+	decay     time.Duration
+	penalty   time.Duration
+	now       func() time.Time
+	slowStart SlowStart
+
+	mu    sync.Mutex
+	addrs []string
+	stats map[string]*p2cStat // key: addr
+	rand  *rand.Rand
+}
+
+type p2cStat struct {
+	inflight int64
+	ewma     float64 // 纳秒
+	last     time.Time
+	observed bool      // 是否已经有延迟数据
+	added    time.Time // 加入的时间，用于慢启动
+	util     float64   // 服务端上报的利用率，0~1
+	utilAt   time.Time // 上报利用率的时间
+}
+
+// NewP2C 创建一个 P2C 负载均衡器，decay 为 EWMA 的衰减时间，penalty 为出错的调用计入的延迟，
+// 为 0 时分别使用 DefaultDecay 和 DefaultPenalty
+func NewP2C(decay, penalty time.Duration) *P2C {
+	if decay <= 0 {
+		decay = DefaultDecay
+	}
+	if penalty <= 0 {
+		penalty = DefaultPenalty
+	}
+	return &P2C{
+		decay:   decay,
+		penalty: penalty,
+		now:     time.Now,
+		stats:   make(map[string]*p2cStat),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *P2C) Get() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch len(p.addrs) {
+	case 0:
+		return ""
+	case 1:
+		return p.addrs[0]
+	}
+	i := p.rand.Intn(len(p.addrs))
+	j := p.rand.Intn(len(p.addrs) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := p.addrs[i], p.addrs[j]
+	prior := p.prior()
+	if p.score(a, prior) > p.score(b, prior) {
+		a, b = b, a
+	}
+	// 慢启动中的地址即使得分更低，也只有 factor 的概率被选中，否则选择另一个地址
+	if p.slowStart.Window > 0 && p.rand.Float64() >= p.slowStart.factor(p.now().Sub(p.stats[a].added)) {
+		return b
+	}
+	return a
+}
+
+// SetSlowStart 开启慢启动，之后加入的地址在 s.Window 时间内逐渐增加到完整的流量
+func (p *P2C) SetSlowStart(s SlowStart) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slowStart = s
+}
+
+// prior 所有已经有数据的地址的平均延迟，作为没有数据的地址的延迟
+func (p *P2C) prior() float64 {
+	var (
+		sum float64
+		n   int
+	)
+	for _, s := range p.stats {
+		if s.observed {
+			sum += s.ewma
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+func (p *P2C) score(addr string, prior float64) float64 {
+	s := p.stats[addr]
+	latency := prior
+	if s.observed {
+		latency = s.ewma
+	}
+	score := (latency + 1) * float64(s.inflight+1)
+	if s.util > 0 {
+		score *= 1 + loadWeight*s.util*math.Exp(-float64(p.now().Sub(s.utilAt))/float64(p.decay))
+	}
+	return score
+}
+
+func (p *P2C) Start(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.stats[addr]; ok {
+		s.inflight++
+	}
+}
+
+// Done 更新 addr 的延迟 EWMA，距离上次更新越久，之前的数据占的比重越小
+func (p *P2C) Done(addr string, err error, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.stats[addr]
+	if !ok {
+		return
+	}
+	if s.inflight > 0 {
+		s.inflight--
+	}
+	// 请求本身的问题（比如 NotFound、InvalidArgument）不说明实例不健康，不计入惩罚
+	if err != nil && status.CodeOf(err).ServerFault() && latency < p.penalty {
+		latency = p.penalty
+	}
+	now := p.now()
+	if !s.observed {
+		s.ewma, s.last, s.observed = float64(latency), now, true
+		return
+	}
+	w := math.Exp(-float64(now.Sub(s.last)) / float64(p.decay))
+	s.ewma = s.ewma*w + float64(latency)*(1-w)
+	s.last = now
+}
+
+// ReportLoad 记录 addr 的服务端上报的利用率
+func (p *P2C) ReportLoad(addr string, load Load) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.stats[addr]; ok {
+		s.util, s.utilAt = math.Min(float64(load.Utilization), 100)/100, p.now()
+	}
+}
+
+func (p *P2C) Addrs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.addrs...)
+}
+
+// Add 添加一个地址，地址已经存在时不做任何操作
+func (p *P2C) Add(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.stats[addr]; ok {
+		return
+	}
+	p.addrs = append(p.addrs, addr)
+	p.stats[addr] = &p2cStat{added: p.now()}
+}
+
+// Set 替换所有地址，仍然存在的地址保留它的延迟和调用统计
+func (p *P2C) Set(addrs []string) {
+	addrs = dedupe(addrs)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make(map[string]*p2cStat, len(addrs))
+	for _, addr := range addrs {
+		s, ok := p.stats[addr]
+		if !ok {
+			s = &p2cStat{added: p.now()}
+		}
+		stats[addr] = s
+	}
+	p.addrs, p.stats = addrs, stats
+}
+
+func (p *P2C) Update(oldAddr string, newAddr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.stats[oldAddr]; !ok {
+		return fmt.Errorf("not found %v", oldAddr)
+	}
+	if _, ok := p.stats[newAddr]; ok && newAddr != oldAddr {
+		return fmt.Errorf("%v already exists", newAddr)
+	}
+	for i, a := range p.addrs {
+		if a == oldAddr {
+			p.addrs[i] = newAddr
+			break
+		}
+	}
+	// 新地址的延迟与旧地址无关，重新开始统计
+	delete(p.stats, oldAddr)
+	p.stats[newAddr] = &p2cStat{added: p.now()}
+	return nil
+}
+
+func (p *P2C) Delete(addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.stats[addr]; !ok {
+		return fmt.Errorf("not found %v", addr)
+	}
+	delete(p.stats, addr)
+	for i, a := range p.addrs {
+		if a == addr {
+			p.addrs = append(p.addrs[:i:i], p.addrs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// fakeClock 用于控制 EWMA 的衰减
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time      { return c.t }
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+func newFakeClock() *fakeClock           { return &fakeClock{t: time.Unix(0, 0)} }
+
+// simulate 每隔 interval 发起一次调用，pick 选择地址，每个地址的调用耗时固定为 latencies[addr]，
+// 返回所有调用的平均延迟
+func simulate(pick func() string, report Reporter, clock *fakeClock, latencies map[string]time.Duration, n int, interval time.Duration) time.Duration {
+	type pending struct {
+		addr string
+		end  time.Time
+	}
+	var (
+		inflight []pending
+		total    time.Duration
+	)
+	for i := 0; i < n; i++ {
+		sort.Slice(inflight, func(i, j int) bool { return inflight[i].end.Before(inflight[j].end) })
+		for len(inflight) > 0 && !inflight[0].end.After(clock.now()) {
+			report.Done(inflight[0].addr, nil, latencies[inflight[0].addr])
+			inflight = inflight[1:]
+		}
+		addr := pick()
+		report.Start(addr)
+		inflight = append(inflight, pending{addr: addr, end: clock.now().Add(latencies[addr])})
+		total += latencies[addr]
+		clock.add(interval)
+	}
+	return total / time.Duration(n)
+}
+
+func TestP2CLowerLatencyThanRandom(t *testing.T) {
+	latencies := make(map[string]time.Duration)
+	var addrs []string
+	for i, ms := range []int{1, 2, 3, 5, 8, 13, 21, 34, 55, 89} {
+		addr := fmt.Sprintf("backend-%d", i)
+		addrs = append(addrs, addr)
+		latencies[addr] = time.Duration(ms) * time.Millisecond
+	}
+
+	clock := newFakeClock()
+	p := NewP2C(time.Second, 0)
+	p.now = clock.now
+	for _, addr := range addrs {
+		p.Add(addr)
+	}
+	p2c := simulate(p.Get, p, clock, latencies, 10000, time.Millisecond)
+
+	r := rand.New(rand.NewSource(1))
+	random := simulate(func() string { return addrs[r.Intn(len(addrs))] }, NewP2C(0, 0), newFakeClock(), latencies, 10000, time.Millisecond)
+
+	t.Logf("p2c: %v, random: %v", p2c, random)
+	if p2c >= random/2 {
+		t.Fatalf("p2c average latency %v is not clearly lower than random %v", p2c, random)
+	}
+}
+
+func TestP2CNeutralPrior(t *testing.T) {
+	clock := newFakeClock()
+	p := NewP2C(0, 0)
+	p.now = clock.now
+	p.Add("fast")
+	p.Add("slow")
+	p.Done("fast", nil, 10*time.Millisecond)
+	p.Done("slow", nil, 30*time.Millisecond)
+	// 新地址使用平均延迟 20ms：比 slow 好，比 fast 差
+	p.Add("fresh")
+
+	count := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		count[p.Get()]++
+	}
+	t.Log(count)
+	if count["fresh"] == 0 || count["slow"] != 0 {
+		t.Fatalf("fresh address should beat slow but not fast: %v", count)
+	}
+	if count["fresh"] >= count["fast"] {
+		t.Fatalf("fresh address picked more than the fast one: %v", count)
+	}
+}
+
+func TestP2CErrorPenaltyRecoversGradually(t *testing.T) {
+	clock := newFakeClock()
+	p := NewP2C(time.Second, time.Second)
+	p.now = clock.now
+	p.Add("a")
+	p.Add("b")
+	p.Done("a", nil, 10*time.Millisecond)
+	p.Done("b", nil, 10*time.Millisecond)
+
+	clock.add(time.Second)
+	p.Done("a", errors.New("boom"), time.Millisecond)
+	if got := p.Get(); got != "b" {
+		t.Fatalf("Get() = %v after a failed, want b", got)
+	}
+
+	// 之后每秒一次成功的调用，a 的延迟逐渐恢复
+	last := p.stats["a"].ewma
+	recovered := 0
+	for i := 1; i <= 10; i++ {
+		clock.add(time.Second)
+		p.Done("a", nil, 10*time.Millisecond)
+		cur := p.stats["a"].ewma
+		if cur >= last {
+			t.Fatalf("latency of a does not decrease: %v -> %v", time.Duration(last), time.Duration(cur))
+		}
+		if i == 1 && cur < 2*p.stats["b"].ewma {
+			t.Fatalf("a recovered immediately after one success: %v", time.Duration(cur))
+		}
+		if cur < 1.1*p.stats["b"].ewma && recovered == 0 {
+			recovered = i
+		}
+		last = cur
+	}
+	if recovered == 0 {
+		t.Fatalf("a never recovered, latency: %v", time.Duration(last))
+	}
+	t.Logf("a recovered after %d successful calls", recovered)
+}
+
+// 请求本身的错误（比如 NotFound）不说明实例不健康，不计入惩罚
+func TestP2CIgnoresClientErrors(t *testing.T) {
+	clock := newFakeClock()
+	p := NewP2C(time.Second, time.Second)
+	p.now = clock.now
+	p.Add("a")
+	p.Done("a", nil, 10*time.Millisecond)
+	clock.add(time.Second)
+	before := p.stats["a"].ewma
+	p.Done("a", status.New(status.NotFound, "no such order"), 10*time.Millisecond)
+	if after := p.stats["a"].ewma; after > before*1.01 {
+		t.Fatalf("NotFound penalized: %v -> %v", time.Duration(before), time.Duration(after))
+	}
+	clock.add(time.Second)
+	p.Done("a", status.New(status.Unavailable, "overloaded"), 10*time.Millisecond)
+	if after := p.stats["a"].ewma; after < 10*before {
+		t.Fatalf("Unavailable not penalized: %v -> %v", time.Duration(before), time.Duration(after))
+	}
+}
+
+// 服务端上报的利用率更高的地址得分更高，随着时间衰减后恢复
+func TestP2CServerLoad(t *testing.T) {
+	clock := newFakeClock()
+	p := NewP2C(time.Second, time.Second)
+	p.now = clock.now
+	p.Set([]string{"busy", "idle"})
+	for _, addr := range []string{"busy", "idle"} {
+		p.Done(addr, nil, 10*time.Millisecond)
+	}
+	// 通过 AsPicker 上报负载，和 Done 一起
+	picker := AsPicker(p)
+	for _, c := range []struct {
+		addr string
+		util uint32
+	}{{"busy", 90}, {"idle", 10}} {
+		p.Start(c.addr)
+		p.ReportLoad(c.addr, Load{Utilization: c.util})
+		p.Done(c.addr, nil, 10*time.Millisecond)
+	}
+	for i := 0; i < 100; i++ {
+		addr, done, err := picker.Pick(context.Background(), PickInfo{})
+		if err != nil || addr != "idle" {
+			t.Fatalf("Pick() = %v, %v, want idle", addr, err)
+		}
+		done(DoneInfo{Latency: 10 * time.Millisecond, Load: &Load{Utilization: 10}})
+	}
+	if p.stats["idle"].util != 0.1 {
+		t.Fatalf("util of idle = %v", p.stats["idle"].util)
+	}
+	// 过时的负载不再影响选择，延迟更低的 busy 重新被选中
+	clock.add(10 * time.Second)
+	p.Done("busy", nil, 5*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if addr := p.Get(); addr != "busy" {
+			t.Fatalf("Get() = %v after the load report of busy expired", addr)
+		}
+	}
+}
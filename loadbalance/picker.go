@@ -0,0 +1,127 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// ErrNoAddr 负载均衡器中没有可以选择的地址
+var ErrNoAddr = errors.New("loadbalance: no available address")
+
+// PickInfo 本次调用的信息，hash key、affinity key 等提示信息保存在 Pick 的 ctx 中
+type PickInfo struct {
+	// ServiceMethod 调用的方法，格式为 "Service.Method"
+	ServiceMethod string
+	// Attempt 本次调用的第几次尝试，从 0 开始，重试的每次尝试都会单独 Pick
+	Attempt int
+}
+
+// ErrorClass 调用结果的分类
+type ErrorClass int
+
+const (
+	// ErrorNone 调用成功
+	ErrorNone ErrorClass = iota
+	// ErrorTimeout 调用超时
+	ErrorTimeout
+	// ErrorCanceled 调用被调用方取消
+	ErrorCanceled
+	// ErrorTransport 无法建立连接或者连接断开
+	ErrorTransport
+	// ErrorServer 服务端返回了错误
+	ErrorServer
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorNone:
+		return "none"
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorCanceled:
+		return "canceled"
+	case ErrorTransport:
+		return "transport"
+	case ErrorServer:
+		return "server"
+	}
+	return "unknown"
+}
+
+// DoneInfo 一次调用的结果
+type DoneInfo struct {
+	Err           error
+	Class         ErrorClass
+	Code          status.Code // 错误码，服务端返回的错误使用其错误码，其他错误根据 Class 选择，成功时为 OK
+	Latency       time.Duration
+	BytesSent     int64 // 请求编码后的大小
+	BytesReceived int64 // 响应编码后的大小，没有收到响应时为 0
+	Load          *Load // 服务端在响应中上报的负载，没有上报时为 nil
+}
+
+// Load 服务端在响应中上报的负载，包括其他客户端的请求，所以可以区分网络慢和服务端过载
+type Load struct {
+	Inflight    uint32 // 服务端正在处理的请求数
+	Utilization uint32 // 服务端计算的利用率，0~100
+}
+
+// LoadReceiver 可以使用服务端上报的负载进行选择的负载均衡器
+type LoadReceiver interface {
+	// ReportLoad 对 addr 的调用收到了服务端上报的负载，在这次调用的 Done 之前调用
+	ReportLoad(addr string, load Load)
+}
+
+// Picker 根据每次调用的信息选择地址，调用结束后调用方需要调用且只调用一次 done 告知调用的结果
+type Picker interface {
+	Pick(ctx context.Context, info PickInfo) (addr string, done func(DoneInfo), err error)
+}
+
+// AsPicker 将 lb 适配为 Picker，lb 已经实现了 Picker 时直接返回。适配后使用 Pick(ctx, lb) 选择地址，
+// 如果 lb 实现了 Reporter，则在选择后调用 Start，在 done 中调用 Done；如果 lb 实现了 LoadReceiver，
+// 则在 done 中把服务端上报的负载交给它。done 被多次调用时只有第一次生效
+func AsPicker(lb Balancer) Picker {
+	if p, ok := lb.(Picker); ok {
+		return p
+	}
+	return balancerPicker{lb}
+}
+
+type balancerPicker struct {
+	lb Balancer
+}
+
+func (b balancerPicker) Pick(ctx context.Context, info PickInfo) (string, func(DoneInfo), error) {
+	return reportPick(b.lb, Pick(ctx, b.lb))
+}
+
+// reportPick 返回 lb 选中 addr 之后的 Pick 结果：如果 lb 实现了 Reporter，则调用 Start，并在 done 中调用 Done；
+// 如果 lb 实现了 LoadReceiver，则在 done 中把服务端上报的负载交给它。addr 为空时返回 ErrNoAddr
+func reportPick(lb Balancer, addr string) (string, func(DoneInfo), error) {
+	if addr == "" {
+		return "", nil, ErrNoAddr
+	}
+	r, ok := lb.(Reporter)
+	lr, _ := lb.(LoadReceiver)
+	if !ok && lr == nil {
+		return addr, func(DoneInfo) {}, nil
+	}
+	if ok {
+		r.Start(addr)
+	}
+	var called int32
+	return addr, func(di DoneInfo) {
+		if !atomic.CompareAndSwapInt32(&called, 0, 1) {
+			return
+		}
+		if lr != nil && di.Load != nil {
+			lr.ReportLoad(addr, *di.Load)
+		}
+		if ok {
+			r.Done(addr, di.Err, di.Latency)
+		}
+	}, nil
+}
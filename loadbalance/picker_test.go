@@ -0,0 +1,31 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAsPicker(t *testing.T) {
+	if _, _, err := AsPicker(&RoundRobin{}).Pick(context.Background(), PickInfo{}); err != ErrNoAddr {
+		t.Fatalf("err = %v, want %v", err, ErrNoAddr)
+	}
+
+	lb := NewLeastConn()
+	lb.Set([]string{"a"})
+	p := AsPicker(lb)
+	addr, done, err := p.Pick(context.Background(), PickInfo{ServiceMethod: "S.M"})
+	if err != nil || addr != "a" {
+		t.Fatalf("Pick() = %v, %v", addr, err)
+	}
+	if n := lb.Inflight("a"); n != 1 {
+		t.Fatalf("inflight = %d, want 1", n)
+	}
+	// 重复调用 done 只有第一次生效
+	done(DoneInfo{Err: errors.New("x"), Class: ErrorServer})
+	done(DoneInfo{})
+	lb.Start("a")
+	if n := lb.Inflight("a"); n != 1 {
+		t.Fatalf("inflight = %d, want 1", n)
+	}
+}
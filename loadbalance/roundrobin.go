@@ -3,15 +3,20 @@ package loadbalance
 import (
 	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
-var addrsIndex int64 // 用于轮询
+var _ Balancer = &RoundRobin{}
 
+// RoundRobin 轮询负载均衡器，零值可以直接使用。并发安全
 type RoundRobin struct {
+	mu    sync.RWMutex
 	addrs []string
 	// key 是地址，val 是该地址在 addrs 中的 index，该字段用于 addrs 的更新和删除操作
 	addrsMap        map[string]int64
 	addrsWithWeight map[string]*weightInfo
+	next            uint64 // 用于轮询，下一次选择的位置
 }
 
 // weightInfo 平滑加权轮询需要该 struct 来保存一些信息
@@ -19,23 +24,25 @@ type weightInfo struct {
 	addr      string
 	weight    int64
 	curWeight int64
+	added     time.Time // 加入的时间，用于慢启动
 }
 
 func (r *RoundRobin) Get() (addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if len(r.addrs) == 0 {
 		return ""
 	}
-	l := len(r.addrs)
-	if addrsIndex == int64(l) {
-		addrsIndex = 0
-	}
-	addr = r.addrs[addrsIndex]
-	addrsIndex++
+	// 地址被删除后 next 可能超出范围
+	addr = r.addrs[r.next%uint64(len(r.addrs))]
+	r.next = (r.next + 1) % uint64(len(r.addrs))
 	return
 }
 
 // GetWithWeight 使用平滑加权轮询算法
 func (r *RoundRobin) GetWithWeight() (addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	var (
 		total     int64
 		retStruct *weightInfo
@@ -56,10 +63,14 @@ func (r *RoundRobin) GetWithWeight() (addr string) {
 }
 
 func (r *RoundRobin) Addrs() []string {
-	return r.addrs
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.addrs...)
 }
 
 func (r *RoundRobin) AddrsWithWeight() (m map[string]int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	m = make(map[string]int64)
 	for k, v := range r.addrsWithWeight {
 		m[k] = v.weight
@@ -67,13 +78,22 @@ func (r *RoundRobin) AddrsWithWeight() (m map[string]int64) {
 	return
 }
 
-// SetAddrs 设置 addrs
-//func (r *RoundRobin) SetAddrs(addrs []string) {
-//	r.addrs = addrs
-//}
+// Set 替换所有地址，并从第一个地址开始重新轮询
+func (r *RoundRobin) Set(addrs []string) {
+	addrs = dedupe(addrs)
+	addrsMap := make(map[string]int64, len(addrs))
+	for i, addr := range addrs {
+		addrsMap[addr] = int64(i)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.addrsMap, r.next = addrs, addrsMap, 0
+}
 
 // SetAddrsWithWeight 设置 addrsWithWeight
 func (r *RoundRobin) SetAddrsWithWeight(addrsWithWeight map[string]int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.addrsWithWeight == nil {
 		r.addrsWithWeight = make(map[string]*weightInfo)
 	}
@@ -82,23 +102,31 @@ func (r *RoundRobin) SetAddrsWithWeight(addrsWithWeight map[string]int64) {
 	}
 }
 
+// Add 添加一个地址，地址已经存在时不做任何操作
 func (r *RoundRobin) Add(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.addrsMap == nil {
 		r.addrsMap = make(map[string]int64)
 	}
+	if _, ok := r.addrsMap[addr]; ok {
+		return
+	}
 	r.addrs = append(r.addrs, addr)
 	r.addrsMap[addr] = int64(len(r.addrs) - 1)
 }
 
 func (r *RoundRobin) Update(oldAddr string, newAddr string) error {
-	if r.addrsMap == nil {
-		r.addrsMap = make(map[string]int64)
-	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	index, ok := r.addrsMap[oldAddr]
 	if !ok {
 		log.Printf("not found %v", oldAddr)
 		return fmt.Errorf("not found %v", oldAddr)
 	}
+	if _, ok := r.addrsMap[newAddr]; ok && newAddr != oldAddr {
+		return fmt.Errorf("%v already exists", newAddr)
+	}
 	r.addrs[index] = newAddr
 	delete(r.addrsMap, oldAddr)
 	r.addrsMap[newAddr] = index
@@ -106,15 +134,18 @@ func (r *RoundRobin) Update(oldAddr string, newAddr string) error {
 }
 
 func (r *RoundRobin) Delete(addr string) error {
-	if r.addrsMap == nil {
-		r.addrsMap = make(map[string]int64)
-	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	index, ok := r.addrsMap[addr]
 	if !ok {
 		log.Printf("not found %v", addr)
 		return fmt.Errorf("not found %v", addr)
 	}
-	r.addrs = append(r.addrs[:index], r.addrs[index+1:]...)
+	r.addrs = append(r.addrs[:index:index], r.addrs[index+1:]...)
 	delete(r.addrsMap, addr)
+	// 被删除的地址之后的地址 index 都减少了 1
+	for _, a := range r.addrs[index:] {
+		r.addrsMap[a]--
+	}
 	return nil
 }
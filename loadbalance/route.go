@@ -0,0 +1,387 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+var (
+	_ ContextBalancer  = &Router{}
+	_ InstanceBalancer = &Router{}
+	_ Reporter         = &Router{}
+	_ LoadReceiver     = &Router{}
+	_ Picker           = &Router{}
+)
+
+type routeLabelKey struct{}
+
+// WithRouteLabel 设置本次调用的路由标签，Router 会把调用发送到规则中该标签对应的版本，比如 "canary"
+func WithRouteLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, routeLabelKey{}, label)
+}
+
+// RouteLabelFromContext 返回 WithRouteLabel 设置的路由标签
+func RouteLabelFromContext(ctx context.Context) (string, bool) {
+	label, ok := ctx.Value(routeLabelKey{}).(string)
+	return label, ok
+}
+
+// TrafficSplit 按比例发送到 Version 的流量
+type TrafficSplit struct {
+	Version string
+	Percent float64 // 0~100
+}
+
+// RouteRule 一个服务（或者其中一个方法）的路由规则：按照实例 metadata 中 Key 的值将实例分组，带有路由标签
+// 并且 Labels 中有对应版本的调用发送到该版本，其余的调用按照 Splits 的比例发送到各个版本，剩余的比例发送到
+// Default。目标版本没有可用的实例时使用 Default，Default 也没有可用的实例时从所有实例中选择
+type RouteRule struct {
+	Service string // 注册中心中的服务名，与 NewRouter 的 service 相同
+	Method  string // "Service.Method"，为空时对服务的所有方法生效，方法的规则优先于服务的规则
+	Key     string // 实例 metadata 中的 key，为空时使用 registry.MetadataVersion
+	Default string
+	Splits  []TrafficSplit
+	Labels  map[string]string // key: 路由标签 val: 版本
+}
+
+func (r *RouteRule) key() string {
+	if r.Key == "" {
+		return registry.MetadataVersion
+	}
+	return r.Key
+}
+
+// target 返回本次调用的目标版本
+func (r *RouteRule) target(ctx context.Context) string {
+	if label, ok := RouteLabelFromContext(ctx); ok {
+		if version, ok := r.Labels[label]; ok {
+			return version
+		}
+	}
+	if len(r.Splits) == 0 {
+		return r.Default
+	}
+	n := rand.Float64() * 100
+	for _, s := range r.Splits {
+		if n < s.Percent {
+			return s.Version
+		}
+		n -= s.Percent
+	}
+	return r.Default
+}
+
+type methodKey struct {
+	service, method string
+}
+
+// routeRules RouteTable 中的所有规则，创建后不再修改
+type routeRules struct {
+	services map[string]*RouteRule
+	methods  map[methodKey]*RouteRule
+}
+
+// RouteTable 所有服务的路由规则，可以被多个 Router 共享，Set 之后新的规则对之后的每次选择立即生效，
+// 不需要重新创建 Router 或者客户端。并发安全
+type RouteTable struct {
+	rules atomic.Value // *routeRules
+}
+
+// NewRouteTable 创建一个路由表，rules 的要求见 Set
+func NewRouteTable(rules ...RouteRule) (*RouteTable, error) {
+	t := &RouteTable{}
+	if err := t.Set(rules); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Set 使用 rules 替换所有的规则，同一个服务或者方法只能有一条规则，Splits 的比例之和不能超过 100，
+// rules 不合法时返回错误并保留原来的规则
+func (t *RouteTable) Set(rules []RouteRule) error {
+	rs := &routeRules{services: make(map[string]*RouteRule), methods: make(map[methodKey]*RouteRule)}
+	for i := range rules {
+		rule := rules[i]
+		if rule.Service == "" {
+			return errors.New("loadbalance: route rule without service")
+		}
+		var total float64
+		for _, s := range rule.Splits {
+			if s.Percent < 0 {
+				return fmt.Errorf("loadbalance: route rule %v %v: negative percent %v", rule.Service, rule.Method, s.Percent)
+			}
+			total += s.Percent
+		}
+		if total > 100 {
+			return fmt.Errorf("loadbalance: route rule %v %v: percent sum %v > 100", rule.Service, rule.Method, total)
+		}
+		rule.Splits = append([]TrafficSplit(nil), rule.Splits...)
+		if rule.Method == "" {
+			if _, ok := rs.services[rule.Service]; ok {
+				return fmt.Errorf("loadbalance: duplicate route rule for %v", rule.Service)
+			}
+			rs.services[rule.Service] = &rule
+			continue
+		}
+		k := methodKey{rule.Service, rule.Method}
+		if _, ok := rs.methods[k]; ok {
+			return fmt.Errorf("loadbalance: duplicate route rule for %v %v", rule.Service, rule.Method)
+		}
+		rs.methods[k] = &rule
+	}
+	t.rules.Store(rs)
+	return nil
+}
+
+// rule 返回 service 的 method 使用的规则，没有规则时返回 nil
+func (t *RouteTable) rule(service, method string) *RouteRule {
+	rs, _ := t.rules.Load().(*routeRules)
+	if rs == nil {
+		return nil
+	}
+	if method != "" {
+		if rule, ok := rs.methods[methodKey{service, method}]; ok {
+			return rule
+		}
+	}
+	return rs.services[service]
+}
+
+// Router 按照 RouteTable 中 service 的规则，先根据实例 metadata 中的版本（或者其他标签）选出一组实例，
+// 再交给这组实例的负载均衡器（由 newBalancer 创建）选择，用于金丝雀发布等场景。实例的 metadata 通过
+// SetInstances 获得，通过 Add、Set 添加的地址没有 metadata，只会在没有规则或者回退到所有实例时被选中。
+// 没有规则时从所有实例中选择。并发安全
+type Router struct {
+	service     string
+	table       *RouteTable
+	newBalancer func() Balancer
+
+	mu        sync.RWMutex
+	all       Balancer
+	instances map[string]registry.Instance   // key: addr
+	groups    map[string]map[string]Balancer // key: metadata 的 key val: 按该 key 的值分组的负载均衡器
+}
+
+// NewRouter 创建一个按照 table 中 service 的规则选择实例的负载均衡器
+func NewRouter(service string, table *RouteTable, newBalancer func() Balancer) *Router {
+	return &Router{
+		service:     service,
+		table:       table,
+		newBalancer: newBalancer,
+		all:         newBalancer(),
+		instances:   make(map[string]registry.Instance),
+		groups:      make(map[string]map[string]Balancer),
+	}
+}
+
+// regroup 按照 key 将实例分组并交给各组的负载均衡器，已经存在的组保留原来的负载均衡器，
+// 调用时需要持有 r.mu 的写锁
+func (r *Router) regroup(key string) {
+	byValue := make(map[string][]registry.Instance)
+	for _, ins := range r.instances {
+		if v, ok := ins.Metadata[key]; ok {
+			byValue[v] = append(byValue[v], ins)
+		}
+	}
+	old := r.groups[key]
+	groups := make(map[string]Balancer, len(byValue))
+	for v, instances := range byValue {
+		lb, ok := old[v]
+		if !ok {
+			lb = r.newBalancer()
+		}
+		SetInstances(lb, instances)
+		groups[v] = lb
+	}
+	r.groups[key] = groups
+}
+
+// sync 实例变化后重新分组，调用时需要持有 r.mu 的写锁
+func (r *Router) sync() {
+	instances := make([]registry.Instance, 0, len(r.instances))
+	for _, ins := range r.instances {
+		instances = append(instances, ins)
+	}
+	SetInstances(r.all, instances)
+	for key := range r.groups {
+		r.regroup(key)
+	}
+}
+
+// group 返回按照 key 分组后值为 value 的负载均衡器，key 第一次使用时才分组
+func (r *Router) group(key, value string) Balancer {
+	r.mu.RLock()
+	groups, ok := r.groups[key]
+	r.mu.RUnlock()
+	if !ok {
+		r.mu.Lock()
+		if _, ok := r.groups[key]; !ok {
+			r.regroup(key)
+		}
+		groups = r.groups[key]
+		r.mu.Unlock()
+	}
+	return groups[value]
+}
+
+// route 根据 ctx 和 method 的规则选择地址
+func (r *Router) route(ctx context.Context, method string) string {
+	rule := r.table.rule(r.service, method)
+	if rule != nil {
+		key := rule.key()
+		for _, version := range []string{rule.target(ctx), rule.Default} {
+			if lb := r.group(key, version); lb != nil {
+				if addr := Pick(ctx, lb); addr != "" {
+					return addr
+				}
+			}
+		}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return Pick(ctx, r.all)
+}
+
+func (r *Router) Get() string {
+	return r.route(context.Background(), "")
+}
+
+// GetContext 只使用服务的规则，方法的规则需要通过 Pick 选择
+func (r *Router) GetContext(ctx context.Context) string {
+	return r.route(ctx, "")
+}
+
+// Pick 使用 info.ServiceMethod 的规则选择地址，调用的开始和结束会转发给 addr 所在的所有负载均衡器
+func (r *Router) Pick(ctx context.Context, info PickInfo) (string, func(DoneInfo), error) {
+	return reportPick(r, r.route(ctx, info.ServiceMethod))
+}
+
+// balancers 返回 addr 所在的所有负载均衡器，调用时需要持有 r.mu
+func (r *Router) balancers(addr string) []Balancer {
+	lbs := []Balancer{r.all}
+	ins, ok := r.instances[addr]
+	if !ok {
+		return lbs
+	}
+	for key, groups := range r.groups {
+		if v, ok := ins.Metadata[key]; ok {
+			if lb, ok := groups[v]; ok {
+				lbs = append(lbs, lb)
+			}
+		}
+	}
+	return lbs
+}
+
+// Start 如果内部的负载均衡器实现了 Reporter，则转发给它们
+func (r *Router) Start(addr string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, lb := range r.balancers(addr) {
+		if rep, ok := lb.(Reporter); ok {
+			rep.Start(addr)
+		}
+	}
+}
+
+// Done 如果内部的负载均衡器实现了 Reporter，则转发给它们
+func (r *Router) Done(addr string, err error, latency time.Duration) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, lb := range r.balancers(addr) {
+		if rep, ok := lb.(Reporter); ok {
+			rep.Done(addr, err, latency)
+		}
+	}
+}
+
+// ReportLoad 如果内部的负载均衡器实现了 LoadReceiver，则转发给它们
+func (r *Router) ReportLoad(addr string, load Load) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, lb := range r.balancers(addr) {
+		if lr, ok := lb.(LoadReceiver); ok {
+			lr.ReportLoad(addr, load)
+		}
+	}
+}
+
+// SetInstances 使用 instances 替换所有的实例并重新分组，只有 SERVING 的实例会被选中
+func (r *Router) SetInstances(instances []registry.Instance) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.instances = make(map[string]registry.Instance, len(instances))
+	for _, ins := range instances {
+		if _, ok := r.instances[ins.Addr]; !ok {
+			r.instances[ins.Addr] = ins
+		}
+	}
+	r.sync()
+}
+
+func (r *Router) Addrs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.all.Addrs()
+}
+
+func (r *Router) Set(addrs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances := make(map[string]registry.Instance, len(addrs))
+	for _, addr := range addrs {
+		if ins, ok := r.instances[addr]; ok {
+			instances[addr] = ins
+		} else {
+			instances[addr] = registry.Instance{Addr: addr}
+		}
+	}
+	r.instances = instances
+	r.sync()
+}
+
+func (r *Router) Add(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.instances[addr]; ok {
+		return
+	}
+	r.instances[addr] = registry.Instance{Addr: addr}
+	r.sync()
+}
+
+func (r *Router) Update(oldAddr string, newAddr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ins, ok := r.instances[oldAddr]
+	if !ok {
+		return fmt.Errorf("not found %v", oldAddr)
+	}
+	if _, ok := r.instances[newAddr]; ok {
+		return fmt.Errorf("%v already exists", newAddr)
+	}
+	// 地址变化但仍然是同一个实例，metadata 不变
+	delete(r.instances, oldAddr)
+	ins.Addr = newAddr
+	r.instances[newAddr] = ins
+	r.sync()
+	return nil
+}
+
+func (r *Router) Delete(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.instances[addr]; !ok {
+		return fmt.Errorf("not found %v", addr)
+	}
+	delete(r.instances, addr)
+	r.sync()
+	return nil
+}
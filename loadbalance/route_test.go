@@ -0,0 +1,180 @@
+package loadbalance
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+func versionInstance(addr, version string, status registry.Status) registry.Instance {
+	return registry.Instance{Addr: addr, Status: status, Metadata: map[string]string{registry.MetadataVersion: version}}
+}
+
+func newTestRouter(t *testing.T, rules []RouteRule, instances ...registry.Instance) (*Router, *RouteTable) {
+	t.Helper()
+	table, err := NewRouteTable(rules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter("echo", table, func() Balancer { return &RoundRobin{} })
+	r.SetInstances(instances)
+	return r, table
+}
+
+// routed 使用 ctx 和 method 选择 n 次
+func routed(t *testing.T, r *Router, ctx context.Context, method string, n int) map[string]int {
+	t.Helper()
+	count := make(map[string]int)
+	for i := 0; i < n; i++ {
+		addr, done, err := r.Pick(ctx, PickInfo{ServiceMethod: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(DoneInfo{})
+		count[addr]++
+	}
+	return count
+}
+
+// TestRouterSplit 按比例分配的流量在二项分布的 5 个标准差以内
+func TestRouterSplit(t *testing.T) {
+	r, _ := newTestRouter(t, []RouteRule{{Service: "echo", Default: "v1", Splits: []TrafficSplit{{"v2", 5}}}},
+		versionInstance("a1", "v1", registry.StatusServing),
+		versionInstance("a2", "v1", registry.StatusServing),
+		versionInstance("b1", "v2", registry.StatusServing),
+	)
+	const n, p = 20000, 0.05
+	count := routed(t, r, context.Background(), "Echo.Ping", n)
+	mean, sigma := n*p, math.Sqrt(n*p*(1-p))
+	if got := float64(count["b1"]); math.Abs(got-mean) > 5*sigma {
+		t.Fatalf("v2 picked %v times, want %v ± %.0f: %v", got, mean, 5*sigma, count)
+	}
+	if count["a1"]+count["a2"]+count["b1"] != n || math.Abs(float64(count["a1"]-count["a2"])) > 1 {
+		t.Fatalf("picked %v", count)
+	}
+}
+
+func TestRouterLabel(t *testing.T) {
+	r, _ := newTestRouter(t, []RouteRule{{Service: "echo", Default: "v1", Labels: map[string]string{"canary": "v2"}}},
+		versionInstance("a1", "v1", registry.StatusServing),
+		versionInstance("b1", "v2", registry.StatusServing),
+	)
+	if count := routed(t, r, WithRouteLabel(context.Background(), "canary"), "Echo.Ping", 100); count["b1"] != 100 {
+		t.Fatalf("canary picked %v", count)
+	}
+	// 规则中没有的标签使用 Default
+	if count := routed(t, r, WithRouteLabel(context.Background(), "other"), "Echo.Ping", 100); count["a1"] != 100 {
+		t.Fatalf("other label picked %v", count)
+	}
+	if count := routed(t, r, context.Background(), "Echo.Ping", 100); count["a1"] != 100 {
+		t.Fatalf("no label picked %v", count)
+	}
+}
+
+// TestRouterFallback 目标版本没有可用的实例时使用 Default，Default 也没有时从所有实例中选择
+func TestRouterFallback(t *testing.T) {
+	r, _ := newTestRouter(t, []RouteRule{{Service: "echo", Default: "v1", Labels: map[string]string{"canary": "v2"}}},
+		versionInstance("a1", "v1", registry.StatusServing),
+		versionInstance("b1", "v2", registry.StatusDraining),
+	)
+	ctx := WithRouteLabel(context.Background(), "canary")
+	if count := routed(t, r, ctx, "Echo.Ping", 100); count["a1"] != 100 {
+		t.Fatalf("canary with draining v2 picked %v", count)
+	}
+
+	// v2 恢复后立即生效
+	r.SetInstances([]registry.Instance{
+		versionInstance("a1", "v1", registry.StatusServing),
+		versionInstance("b1", "v2", registry.StatusServing),
+	})
+	if count := routed(t, r, ctx, "Echo.Ping", 100); count["b1"] != 100 {
+		t.Fatalf("canary picked %v", count)
+	}
+
+	r.SetInstances([]registry.Instance{
+		versionInstance("c1", "v3", registry.StatusServing),
+		{Addr: "d1"},
+	})
+	count := routed(t, r, ctx, "Echo.Ping", 100)
+	if count["c1"] != 50 || count["d1"] != 50 {
+		t.Fatalf("without v1 and v2 picked %v", count)
+	}
+}
+
+// TestRouterRuntimeUpdate 方法的规则优先，规则修改后不需要重新创建 Router
+func TestRouterRuntimeUpdate(t *testing.T) {
+	r, table := newTestRouter(t, nil,
+		versionInstance("a1", "v1", registry.StatusServing),
+		versionInstance("b1", "v2", registry.StatusServing),
+	)
+	count := routed(t, r, context.Background(), "Echo.Ping", 100)
+	if count["a1"] != 50 || count["b1"] != 50 {
+		t.Fatalf("without rules picked %v", count)
+	}
+
+	if err := table.Set([]RouteRule{
+		{Service: "echo", Default: "v1"},
+		{Service: "echo", Method: "Echo.Slow", Default: "v2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count := routed(t, r, context.Background(), "Echo.Ping", 100); count["a1"] != 100 {
+		t.Fatalf("Echo.Ping picked %v", count)
+	}
+	if count := routed(t, r, context.Background(), "Echo.Slow", 100); count["b1"] != 100 {
+		t.Fatalf("Echo.Slow picked %v", count)
+	}
+	if got := r.Get(); got != "a1" {
+		t.Fatalf("Get() = %v, want service rule", got)
+	}
+
+	// 不合法的规则不会替换原来的规则
+	for _, rules := range [][]RouteRule{
+		{{Service: "echo", Splits: []TrafficSplit{{"v1", 60}, {"v2", 50}}}},
+		{{Service: "echo", Splits: []TrafficSplit{{"v1", -1}}}},
+		{{Service: "echo"}, {Service: "echo"}},
+		{{Default: "v1"}},
+	} {
+		if err := table.Set(rules); err == nil {
+			t.Fatalf("Set(%+v) succeeded", rules)
+		}
+	}
+	if count := routed(t, r, context.Background(), "Echo.Slow", 100); count["b1"] != 100 {
+		t.Fatalf("Echo.Slow picked %v after invalid Set", count)
+	}
+}
+
+// TestRouterReport 调用的开始和结束转发给实例所在的所有负载均衡器
+func TestRouterReport(t *testing.T) {
+	table, err := NewRouteTable(RouteRule{Service: "echo", Default: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inner []*LeastConn
+	r := NewRouter("echo", table, func() Balancer {
+		lc := NewLeastConn()
+		inner = append(inner, lc)
+		return lc
+	})
+	r.SetInstances([]registry.Instance{versionInstance("a1", "v1", registry.StatusServing)})
+	addr, done, err := r.Pick(context.Background(), PickInfo{ServiceMethod: "Echo.Ping"})
+	if err != nil || addr != "a1" {
+		t.Fatalf("Pick() = %v, %v", addr, err)
+	}
+	if len(inner) != 2 {
+		t.Fatalf("%d inner balancers", len(inner))
+	}
+	for i, lc := range inner {
+		if got := lc.Inflight("a1"); got != 1 {
+			t.Fatalf("balancer %d inflight = %d", i, got)
+		}
+	}
+	done(DoneInfo{})
+	for i, lc := range inner {
+		if got := lc.Inflight("a1"); got != 0 {
+			t.Fatalf("balancer %d inflight = %d after done", i, got)
+		}
+	}
+}
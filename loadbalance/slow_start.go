@@ -0,0 +1,43 @@
+package loadbalance
+
+import "time"
+
+// DefaultSlowStartMinFactor 刚加入的地址的权重占配置权重的默认比例
+const DefaultSlowStartMinFactor = 0.1
+
+// SlowStart 慢启动：新加入的地址缓存还是冷的，如果立即分到完整的流量会出现延迟尖刺。开启慢启动后，
+// 加入时间不足 Window 的地址的有效权重从配置权重（比如注册中心中的权重）的 MinFactor 逐渐增加到 100%，
+// 被移除后重新加入的地址会重新开始慢启动
+type SlowStart struct {
+	// Window 慢启动的持续时间，为 0 时不开启慢启动
+	Window time.Duration
+	// MinFactor 刚加入时的权重比例，为 0 时使用 DefaultSlowStartMinFactor
+	MinFactor float64
+	// Curve 将慢启动的进度（0 到 1）映射为权重增加的进度（0 到 1），为 nil 时线性增加，
+	// 比如 func(p float64) float64 { return p * p } 在开始时增加得更慢
+	Curve func(progress float64) float64
+}
+
+// factor 返回加入了 elapsed 时间的地址的权重比例
+func (s SlowStart) factor(elapsed time.Duration) float64 {
+	if s.Window <= 0 || elapsed >= s.Window {
+		return 1
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	min := s.MinFactor
+	if min <= 0 || min > 1 {
+		min = DefaultSlowStartMinFactor
+	}
+	progress := float64(elapsed) / float64(s.Window)
+	if s.Curve != nil {
+		progress = s.Curve(progress)
+		if progress < 0 {
+			progress = 0
+		} else if progress > 1 {
+			progress = 1
+		}
+	}
+	return min + (1-min)*progress
+}
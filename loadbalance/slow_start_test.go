@@ -0,0 +1,116 @@
+package loadbalance
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+func TestSlowStartFactor(t *testing.T) {
+	s := SlowStart{Window: 10 * time.Second}
+	for _, c := range []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0.1},
+		{5 * time.Second, 0.55},
+		{10 * time.Second, 1},
+		{time.Minute, 1},
+	} {
+		if got := s.factor(c.elapsed); math.Abs(got-c.want) > 1e-9 {
+			t.Fatalf("factor(%v) = %v, want %v", c.elapsed, got, c.want)
+		}
+	}
+	s.MinFactor, s.Curve = 0.2, func(p float64) float64 { return p * p }
+	if got := s.factor(5 * time.Second); math.Abs(got-0.4) > 1e-9 {
+		t.Fatalf("factor with curve = %v, want 0.4", got)
+	}
+	if got := (SlowStart{}).factor(0); got != 1 {
+		t.Fatalf("factor without slow start = %v, want 1", got)
+	}
+}
+
+// share 调用 n 次 Get，返回 addr 被选中的比例
+func share(lb Balancer, addr string, n int) float64 {
+	return float64(picked(lb, n)[addr]) / float64(n)
+}
+
+func TestWeightedRoundRobinSlowStart(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWeightedRoundRobin()
+	w.now = clock.now
+	w.SetSlowStart(SlowStart{Window: 100 * time.Second})
+
+	// old 已经完成慢启动，new 的权重为 3，完成慢启动后占 3/4 的流量
+	w.SetInstances([]registry.Instance{{Addr: "old", Weight: 1}})
+	clock.add(100 * time.Second)
+	w.SetInstances([]registry.Instance{{Addr: "old", Weight: 1}, {Addr: "new", Weight: 3}})
+
+	last := 0.0
+	for step := 0; step <= 4; step++ {
+		f := 0.1 + 0.9*float64(step)/4
+		want := 3 * f / (1 + 3*f)
+		got := share(w, "new", 4000)
+		t.Logf("after %v: share %.3f, want %.3f", time.Duration(step)*25*time.Second, got, want)
+		if math.Abs(got-want) > 0.02 || got <= last {
+			t.Fatalf("step %d: share %.3f, want %.3f (last %.3f)", step, got, want, last)
+		}
+		last = got
+		clock.add(25 * time.Second)
+	}
+	if w.Weights()["new"] != 3 || w.EffectiveWeights()["new"] != 3 {
+		t.Fatalf("weights = %v, effective = %v", w.Weights(), w.EffectiveWeights())
+	}
+
+	// 移除后重新加入，重新开始慢启动
+	if err := w.Delete("new"); err != nil {
+		t.Fatal(err)
+	}
+	clock.add(time.Second)
+	w.SetInstances([]registry.Instance{{Addr: "old", Weight: 1}, {Addr: "new", Weight: 3}})
+	if got := share(w, "new", 4000); math.Abs(got-0.3/1.3) > 0.02 {
+		t.Fatalf("share after re-add %.3f, want %.3f", got, 0.3/1.3)
+	}
+	// 权重变化不会重新开始慢启动
+	clock.add(100 * time.Second)
+	w.SetInstances([]registry.Instance{{Addr: "old", Weight: 1}, {Addr: "new", Weight: 1}})
+	if got := share(w, "new", 4000); math.Abs(got-0.5) > 0.02 {
+		t.Fatalf("share after weight change %.3f, want 0.5", got)
+	}
+}
+
+func TestP2CSlowStart(t *testing.T) {
+	clock := newFakeClock()
+	p := NewP2C(0, 0)
+	p.now = clock.now
+	p.rand = rand.New(rand.NewSource(1))
+	p.SetSlowStart(SlowStart{Window: 100 * time.Second})
+
+	p.Add("old")
+	clock.add(100 * time.Second)
+	p.Add("new")
+
+	// 两个地址的得分相同，new 完成慢启动后占一半的流量
+	last := 0.0
+	for step := 0; step <= 4; step++ {
+		want := 0.5 * (0.1 + 0.9*float64(step)/4)
+		got := share(p, "new", 4000)
+		t.Logf("after %v: share %.3f, want %.3f", time.Duration(step)*25*time.Second, got, want)
+		if math.Abs(got-want) > 0.03 || got <= last {
+			t.Fatalf("step %d: share %.3f, want %.3f (last %.3f)", step, got, want, last)
+		}
+		last = got
+		clock.add(25 * time.Second)
+	}
+
+	if err := p.Delete("new"); err != nil {
+		t.Fatal(err)
+	}
+	p.Set([]string{"old", "new"})
+	if got := share(p, "new", 4000); math.Abs(got-0.05) > 0.03 {
+		t.Fatalf("share after re-add %.3f, want 0.05", got)
+	}
+}
@@ -0,0 +1,187 @@
+package loadbalance
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+// DefaultStickyMaxSize Sticky 默认最多缓存的 affinity key 数量
+const DefaultStickyMaxSize = 10000
+
+type affinityKey struct{}
+
+// WithAffinityKey 设置本次调用的 affinity key，Sticky 会让相同 key 的调用在一段时间内选中同一个地址
+func WithAffinityKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, affinityKey{}, key)
+}
+
+// AffinityKeyFromContext 返回 WithAffinityKey 设置的 affinity key
+func AffinityKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(affinityKey{}).(string)
+	return key, ok
+}
+
+var (
+	_ ContextBalancer  = &Sticky{}
+	_ InstanceBalancer = &Sticky{}
+	_ Reporter         = &Sticky{}
+	_ LoadReceiver     = &Sticky{}
+)
+
+// Sticky 会话保持，包装任意一个负载均衡器：带有 affinity key（通过 WithAffinityKey 设置在 ctx 中）
+// 的调用第一次由 inner 选择地址，之后的 ttl 时间内相同 key 的调用都会选中这个地址，除非该地址
+// 已经不在 inner 中（比如实例下线），此时重新选择并缓存。缓存的 key 数量超过上限时淘汰最久没有
+// 使用的 key。没有 affinity key 的调用直接由 inner 选择。并发安全
+type Sticky struct {
+	inner   Balancer
+	ttl     time.Duration
+	maxSize int
+	now     func() time.Time
+
+	mu    sync.Mutex
+	lru   *list.List               // 越靠前越是最近使用过的
+	cache map[string]*list.Element // key: affinity key val: *stickyEntry
+}
+
+type stickyEntry struct {
+	key    string
+	addr   string
+	expire time.Time
+}
+
+// NewSticky 创建一个包装 inner 的会话保持负载均衡器，maxSize 为 0 时使用 DefaultStickyMaxSize
+func NewSticky(inner Balancer, ttl time.Duration, maxSize int) *Sticky {
+	if maxSize <= 0 {
+		maxSize = DefaultStickyMaxSize
+	}
+	return &Sticky{
+		inner:   inner,
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+		lru:     list.New(),
+		cache:   make(map[string]*list.Element),
+	}
+}
+
+// Get 没有 affinity key，由 inner 选择
+func (s *Sticky) Get() string {
+	return s.inner.Get()
+}
+
+func (s *Sticky) GetContext(ctx context.Context) string {
+	key, ok := AffinityKeyFromContext(ctx)
+	if !ok {
+		return Pick(ctx, s.inner)
+	}
+	if addr, ok := s.lookup(key); ok {
+		return addr
+	}
+	addr := Pick(ctx, s.inner)
+	if addr != "" {
+		s.store(key, addr)
+	}
+	return addr
+}
+
+// lookup 返回 key 缓存的地址，过期或者地址已经被移除时删除缓存
+func (s *Sticky) lookup(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.cache[key]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*stickyEntry)
+	if !s.now().Before(entry.expire) || !s.healthy(entry.addr) {
+		s.lru.Remove(e)
+		delete(s.cache, key)
+		return "", false
+	}
+	s.lru.MoveToFront(e)
+	return entry.addr, true
+}
+
+// healthy 返回 addr 是否仍然在 inner 中
+func (s *Sticky) healthy(addr string) bool {
+	for _, a := range s.inner.Addrs() {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Sticky) store(key, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &stickyEntry{key: key, addr: addr, expire: s.now().Add(s.ttl)}
+	if e, ok := s.cache[key]; ok {
+		e.Value = entry
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.cache[key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.maxSize {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.cache, oldest.Value.(*stickyEntry).key)
+	}
+}
+
+// Len 返回当前缓存的 affinity key 数量
+func (s *Sticky) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Start 如果 inner 实现了 Reporter，则转发给 inner
+func (s *Sticky) Start(addr string) {
+	if r, ok := s.inner.(Reporter); ok {
+		r.Start(addr)
+	}
+}
+
+// Done 如果 inner 实现了 Reporter，则转发给 inner
+func (s *Sticky) Done(addr string, err error, latency time.Duration) {
+	if r, ok := s.inner.(Reporter); ok {
+		r.Done(addr, err, latency)
+	}
+}
+
+// ReportLoad 如果 inner 实现了 LoadReceiver，则转发给 inner
+func (s *Sticky) ReportLoad(addr string, load Load) {
+	if r, ok := s.inner.(LoadReceiver); ok {
+		r.ReportLoad(addr, load)
+	}
+}
+
+func (s *Sticky) Addrs() []string {
+	return s.inner.Addrs()
+}
+
+func (s *Sticky) Add(addr string) {
+	s.inner.Add(addr)
+}
+
+func (s *Sticky) Set(addrs []string) {
+	s.inner.Set(addrs)
+}
+
+// SetInstances 交给 inner，inner 没有实现 InstanceBalancer 时使用 SERVING 实例的地址调用 Set
+func (s *Sticky) SetInstances(instances []registry.Instance) {
+	SetInstances(s.inner, instances)
+}
+
+func (s *Sticky) Update(oldAddr string, newAddr string) error {
+	return s.inner.Update(oldAddr, newAddr)
+}
+
+func (s *Sticky) Delete(addr string) error {
+	return s.inner.Delete(addr)
+}
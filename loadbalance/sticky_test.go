@@ -0,0 +1,97 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestSticky(ttl time.Duration, maxSize int) (*Sticky, *fakeClock) {
+	s := NewSticky(&RoundRobin{}, ttl, maxSize)
+	clock := newFakeClock()
+	s.now = clock.now
+	for _, addr := range []string{"a", "b", "c"} {
+		s.Add(addr)
+	}
+	return s, clock
+}
+
+func TestStickyAffinity(t *testing.T) {
+	s, _ := newTestSticky(time.Minute, 0)
+	ctx := WithAffinityKey(context.Background(), "session-1")
+	first := s.GetContext(ctx)
+	for i := 0; i < 10; i++ {
+		if got := s.GetContext(ctx); got != first {
+			t.Fatalf("call %d picked %v, want %v", i, got, first)
+		}
+	}
+
+	// 不同的 key 仍然由内部的负载均衡器选择
+	count := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		count[s.GetContext(WithAffinityKey(context.Background(), fmt.Sprint("key-", i)))]++
+	}
+	if len(count) != 3 {
+		t.Fatalf("keys are not spread across addrs: %v", count)
+	}
+	// 没有 key 的调用不会被缓存
+	s.GetContext(context.Background())
+	if n := s.Len(); n != 31 {
+		t.Fatalf("Len() = %d, want 31", n)
+	}
+}
+
+func TestStickyFailover(t *testing.T) {
+	s, _ := newTestSticky(time.Minute, 0)
+	ctx := WithAffinityKey(context.Background(), "session-1")
+	first := s.GetContext(ctx)
+	if err := s.Delete(first); err != nil {
+		t.Fatal(err)
+	}
+	second := s.GetContext(ctx)
+	if second == first || second == "" {
+		t.Fatalf("picked %q after %v was removed", second, first)
+	}
+	// 之后重新保持在新的地址上
+	for i := 0; i < 10; i++ {
+		if got := s.GetContext(ctx); got != second {
+			t.Fatalf("picked %v, want %v", got, second)
+		}
+	}
+}
+
+func TestStickyTTL(t *testing.T) {
+	s, clock := newTestSticky(time.Minute, 0)
+	ctx := WithAffinityKey(context.Background(), "session-1")
+	first := s.GetContext(ctx)
+	clock.add(59 * time.Second)
+	if got := s.GetContext(ctx); got != first {
+		t.Fatalf("picked %v before ttl, want %v", got, first)
+	}
+	// 过期后重新由轮询选择，会选中下一个地址
+	clock.add(time.Second)
+	if got := s.GetContext(ctx); got == first {
+		t.Fatalf("still picked %v after ttl", got)
+	}
+}
+
+func TestStickyLRU(t *testing.T) {
+	s, _ := newTestSticky(time.Minute, 2)
+	k1 := WithAffinityKey(context.Background(), "k1")
+	k2 := WithAffinityKey(context.Background(), "k2")
+	k3 := WithAffinityKey(context.Background(), "k3")
+	s.GetContext(k1)
+	s.GetContext(k2)
+	s.GetContext(k1) // k2 成为最久没有使用的 key
+	s.GetContext(k3)
+	if n := s.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+	if _, ok := s.lookup("k2"); ok {
+		t.Fatal("k2 should be evicted")
+	}
+	if _, ok := s.lookup("k1"); !ok {
+		t.Fatal("k1 should be kept")
+	}
+}
@@ -0,0 +1,224 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+var (
+	_ ContextBalancer  = &Subset{}
+	_ InstanceBalancer = &Subset{}
+	_ Reporter         = &Subset{}
+	_ LoadReceiver     = &Subset{}
+	_ Picker           = &Subset{}
+)
+
+// Subset 确定性子集，包装任意一个负载均衡器：后端实例非常多时，每个客户端只从中选择 size 个实例交给
+// inner，避免每个客户端都和所有实例建立连接。
+//
+// 选择方式与 Google SRE 中的 deterministic subsetting 相同：将所有 SERVING 实例按照地址排序后分为
+// len/size 组，每 len/size 个连续的 clientID 为一轮，同一轮的客户端使用相同的随机种子打乱实例的顺序，
+// 再各自取其中不同的一组，所以 clientID 连续的一批客户端会均匀地分布到所有实例上。
+//
+// 实例发生变化时不会重新计算整个子集（实例数量变化后分组和打乱的顺序都会改变，几乎所有客户端都要
+// 更换连接），而是保留子集中仍然可用的实例，只从新的计算结果中补上被移除的部分，每移除一个实例最多
+// 更换一个连接，新增的实例不会引起任何更换。并发安全
+type Subset struct {
+	inner    Balancer
+	clientID uint64
+	size     int
+
+	mu        sync.Mutex
+	instances map[string]registry.Instance // 所有的实例，key: addr
+	selected  []string                     // 当前交给 inner 的地址
+}
+
+// NewSubset 创建一个只将 size 个实例交给 inner 的负载均衡器，clientID 需要在客户端之间唯一且稳定，
+// 比如实例的序号，clientID 连续时实例的负载最均匀
+func NewSubset(inner Balancer, clientID uint64, size int) *Subset {
+	if size <= 0 {
+		size = 1
+	}
+	return &Subset{
+		inner:     inner,
+		clientID:  clientID,
+		size:      size,
+		instances: make(map[string]registry.Instance),
+	}
+}
+
+// DeterministicSubset 返回 clientID 在 addrs 中应该选择的 size 个地址，addrs 不足 size 个时返回所有地址
+func DeterministicSubset(addrs []string, clientID uint64, size int) []string {
+	addrs = dedupe(addrs)
+	sort.Strings(addrs)
+	if size <= 0 || len(addrs) <= size {
+		return addrs
+	}
+	count := uint64(len(addrs) / size)
+	round := clientID / count
+	r := rand.New(rand.NewSource(int64(round)))
+	r.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	start := int(clientID%count) * size
+	return addrs[start : start+size]
+}
+
+// reselect 保留 selected 中仍然可用的地址，不足 size 个时从 DeterministicSubset 的结果中补充，
+// 并将选中的实例交给 inner，调用时需要持有 s.mu
+func (s *Subset) reselect() {
+	var serving []string
+	for addr, ins := range s.instances {
+		if ins.Serving() {
+			serving = append(serving, addr)
+		}
+	}
+	selected := make([]string, 0, s.size)
+	chosen := make(map[string]bool, s.size)
+	for _, addr := range s.selected {
+		if ins, ok := s.instances[addr]; ok && ins.Serving() && len(selected) < s.size {
+			selected = append(selected, addr)
+			chosen[addr] = true
+		}
+	}
+	for _, addr := range DeterministicSubset(serving, s.clientID, s.size) {
+		if len(selected) == s.size {
+			break
+		}
+		if !chosen[addr] {
+			selected = append(selected, addr)
+			chosen[addr] = true
+		}
+	}
+	s.selected = selected
+
+	instances := make([]registry.Instance, 0, len(selected))
+	for _, addr := range selected {
+		instances = append(instances, s.instances[addr])
+	}
+	SetInstances(s.inner, instances)
+}
+
+// Selected 返回当前选中的地址
+func (s *Subset) Selected() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.selected...)
+}
+
+// SetInstances 使用 instances 替换所有的实例，只有 SERVING 的实例会被选入子集
+func (s *Subset) SetInstances(instances []registry.Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances = make(map[string]registry.Instance, len(instances))
+	for _, ins := range instances {
+		if _, ok := s.instances[ins.Addr]; !ok {
+			s.instances[ins.Addr] = ins
+		}
+	}
+	s.reselect()
+}
+
+func (s *Subset) Set(addrs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instances := make(map[string]registry.Instance, len(addrs))
+	for _, addr := range addrs {
+		if ins, ok := s.instances[addr]; ok {
+			instances[addr] = ins
+		} else {
+			instances[addr] = registry.Instance{Addr: addr}
+		}
+	}
+	s.instances = instances
+	s.reselect()
+}
+
+func (s *Subset) Add(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.instances[addr]; ok {
+		return
+	}
+	s.instances[addr] = registry.Instance{Addr: addr}
+	s.reselect()
+}
+
+func (s *Subset) Update(oldAddr string, newAddr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ins, ok := s.instances[oldAddr]
+	if !ok {
+		return fmt.Errorf("not found %v", oldAddr)
+	}
+	if _, ok := s.instances[newAddr]; ok {
+		return fmt.Errorf("%v already exists", newAddr)
+	}
+	delete(s.instances, oldAddr)
+	ins.Addr = newAddr
+	s.instances[newAddr] = ins
+	// 地址变化的实例保持在子集中原来的位置
+	for i, addr := range s.selected {
+		if addr == oldAddr {
+			s.selected[i] = newAddr
+		}
+	}
+	s.reselect()
+	return nil
+}
+
+func (s *Subset) Delete(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.instances[addr]; !ok {
+		return fmt.Errorf("not found %v", addr)
+	}
+	delete(s.instances, addr)
+	s.reselect()
+	return nil
+}
+
+// Addrs 返回子集中的地址
+func (s *Subset) Addrs() []string {
+	return s.inner.Addrs()
+}
+
+func (s *Subset) Get() string {
+	return s.inner.Get()
+}
+
+func (s *Subset) GetContext(ctx context.Context) string {
+	return Pick(ctx, s.inner)
+}
+
+// Pick 交给 inner，inner 没有实现 Picker 时通过 AsPicker 适配
+func (s *Subset) Pick(ctx context.Context, info PickInfo) (string, func(DoneInfo), error) {
+	return AsPicker(s.inner).Pick(ctx, info)
+}
+
+// Start 如果 inner 实现了 Reporter，则转发给 inner
+func (s *Subset) Start(addr string) {
+	if r, ok := s.inner.(Reporter); ok {
+		r.Start(addr)
+	}
+}
+
+// Done 如果 inner 实现了 Reporter，则转发给 inner
+func (s *Subset) Done(addr string, err error, latency time.Duration) {
+	if r, ok := s.inner.(Reporter); ok {
+		r.Done(addr, err, latency)
+	}
+}
+
+// ReportLoad 如果 inner 实现了 LoadReceiver，则转发给 inner
+func (s *Subset) ReportLoad(addr string, load Load) {
+	if r, ok := s.inner.(LoadReceiver); ok {
+		r.ReportLoad(addr, load)
+	}
+}
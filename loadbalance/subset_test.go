@@ -0,0 +1,185 @@
+package loadbalance
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+func backends(n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256)
+	}
+	return addrs
+}
+
+func TestDeterministicSubsetSpread(t *testing.T) {
+	const (
+		clients = 1000
+		size    = 10
+	)
+	for _, n := range []int{100, 103, 517} {
+		addrs := backends(n)
+		count := make(map[string]int, n)
+		for id := uint64(0); id < clients; id++ {
+			subset := DeterministicSubset(addrs, id, size)
+			if len(subset) != size {
+				t.Fatalf("len(subset) = %d, want %d", len(subset), size)
+			}
+			seen := make(map[string]bool)
+			for _, addr := range subset {
+				if seen[addr] {
+					t.Fatalf("client %d: duplicated %v in %v", id, addr, subset)
+				}
+				seen[addr] = true
+				count[addr]++
+			}
+		}
+		mean := float64(clients*size) / float64(n)
+		min, max := clients, 0
+		for _, addr := range addrs {
+			if count[addr] < min {
+				min = count[addr]
+			}
+			if count[addr] > max {
+				max = count[addr]
+			}
+		}
+		t.Logf("%d backends: mean %.1f, min %d, max %d", n, mean, min, max)
+		if float64(min) < mean*0.8 || float64(max) > mean*1.2 {
+			t.Fatalf("%d backends: assignments spread [%d, %d], mean %.1f", n, min, max, mean)
+		}
+	}
+	// 每一轮的客户端恰好覆盖所有实例一次
+	addrs := backends(100)
+	count := make(map[string]int)
+	for id := uint64(0); id < 10; id++ {
+		for _, addr := range DeterministicSubset(addrs, id, 10) {
+			count[addr]++
+		}
+	}
+	for _, addr := range addrs {
+		if count[addr] != 1 {
+			t.Fatalf("%v assigned %d times in one round", addr, count[addr])
+		}
+	}
+}
+
+func TestDeterministicSubsetStable(t *testing.T) {
+	addrs := backends(50)
+	want := DeterministicSubset(addrs, 42, 5)
+	// 与输入的顺序无关
+	reversed := make([]string, len(addrs))
+	for i, addr := range addrs {
+		reversed[len(addrs)-1-i] = addr
+	}
+	if got := DeterministicSubset(reversed, 42, 5); sorted(got) != sorted(want) {
+		t.Fatalf("subset depends on input order: %v != %v", got, want)
+	}
+	if got := DeterministicSubset(addrs[:3], 42, 5); len(got) != 3 {
+		t.Fatalf("got %v, want all 3 addrs", got)
+	}
+}
+
+// changed 返回 after 中不在 before 中的地址数量
+func changed(before, after []string) int {
+	in := make(map[string]bool)
+	for _, addr := range before {
+		in[addr] = true
+	}
+	n := 0
+	for _, addr := range after {
+		if !in[addr] {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSubsetBoundedChurn(t *testing.T) {
+	addrs := backends(60)
+	s := NewSubset(&RoundRobin{}, 7, 5)
+	s.Set(addrs[:50])
+	before := s.Selected()
+	if sorted(before) != sorted(DeterministicSubset(addrs[:50], 7, 5)) {
+		t.Fatalf("selected %v, want %v", before, DeterministicSubset(addrs[:50], 7, 5))
+	}
+	if sorted(s.Addrs()) != sorted(before) {
+		t.Fatalf("inner addrs %v, want %v", s.Addrs(), before)
+	}
+
+	// 新增实例不会引起更换
+	s.Set(addrs)
+	if after := s.Selected(); changed(before, after) != 0 {
+		t.Fatalf("adding backends changed subset %v -> %v", before, after)
+	}
+
+	// 移除子集之外的实例不会引起更换
+	for _, addr := range addrs {
+		if !contains(before, addr) {
+			if err := s.Delete(addr); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if after := s.Selected(); changed(before, after) != 0 {
+		t.Fatalf("deleting other backend changed subset %v -> %v", before, after)
+	}
+
+	// 移除子集中的一个实例只更换一个
+	if err := s.Delete(before[0]); err != nil {
+		t.Fatal(err)
+	}
+	after := s.Selected()
+	if len(after) != 5 || changed(before, after) != 1 || contains(after, before[0]) {
+		t.Fatalf("deleting %v: subset %v -> %v", before[0], before, after)
+	}
+
+	// 不再 SERVING 的实例同样会被更换
+	var instances []registry.Instance
+	for _, addr := range s.instancesAddrs() {
+		ins := registry.Instance{Addr: addr, Status: registry.StatusServing}
+		if addr == after[1] {
+			ins.Status = registry.StatusDraining
+		}
+		instances = append(instances, ins)
+	}
+	s.SetInstances(instances)
+	if got := s.Selected(); changed(after, got) != 1 || contains(got, after[1]) {
+		t.Fatalf("draining %v: subset %v -> %v", after[1], after, got)
+	}
+}
+
+func (s *Subset) instancesAddrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for addr := range s.instances {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSubsetForwardsInstances(t *testing.T) {
+	inner := NewWeightedRoundRobin()
+	s := NewSubset(inner, 0, 2)
+	s.SetInstances([]registry.Instance{
+		{Addr: "a", Weight: 3},
+		{Addr: "b", Weight: 1},
+	})
+	if w := inner.Weights(); w["a"] != 3 || w["b"] != 1 {
+		t.Fatalf("weights = %v", w)
+	}
+}
@@ -0,0 +1,261 @@
+package loadbalance
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+// DefaultWeight 没有指定权重的地址使用的权重，所有地址权重相同时等价于普通的轮询
+const DefaultWeight int64 = 1
+
+// weightScale 选择时将权重放大的倍数，慢启动按比例缩小权重时不会因为取整失去精度
+const weightScale = 1000
+
+var _ InstanceBalancer = &WeightedRoundRobin{}
+
+// WeightedRoundRobin 平滑加权轮询（nginx 的实现方式），权重为 4 和 16 的两个地址会交替被选中，
+// 而不是先连续选中 16 次再选中 4 次。权重为 0 的地址不会被选中，但是仍然会被保留，
+// 之后可以通过 SetWeight 恢复。可以通过 SetSlowStart 开启慢启动。并发安全
+type WeightedRoundRobin struct {
+	mu        sync.Mutex
+	nodes     []*weightInfo          // 保持添加的顺序，保证选择的结果是确定的
+	index     map[string]*weightInfo // key: addr
+	slowStart SlowStart
+	now       func() time.Time
+}
+
+func NewWeightedRoundRobin() *WeightedRoundRobin {
+	return &WeightedRoundRobin{index: make(map[string]*weightInfo), now: time.Now}
+}
+
+// SetSlowStart 开启慢启动，之后加入的地址在 s.Window 时间内逐渐增加到配置的权重
+func (w *WeightedRoundRobin) SetSlowStart(s SlowStart) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.slowStart = s
+}
+
+// effective 返回 n 在 now 时的有效权重，调用时需要持有 w.mu
+func (w *WeightedRoundRobin) effective(n *weightInfo, now time.Time) int64 {
+	if n.weight <= 0 {
+		return 0
+	}
+	weight := n.weight * weightScale
+	if f := w.slowStart.factor(now.Sub(n.added)); f < 1 {
+		weight = int64(float64(weight) * f)
+		if weight < 1 {
+			weight = 1
+		}
+	}
+	return weight
+}
+
+// EffectiveWeights 返回所有地址当前的有效权重（配置的权重乘以慢启动的比例）
+func (w *WeightedRoundRobin) EffectiveWeights() map[string]float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	m := make(map[string]float64, len(w.nodes))
+	for _, n := range w.nodes {
+		m[n.addr] = float64(w.effective(n, now)) / weightScale
+	}
+	return m
+}
+
+// Get 使用平滑加权轮询选择一个地址：每个地址的 curWeight 加上自己的有效权重，选出 curWeight 最大的地址，
+// 再将它的 curWeight 减去所有有效权重之和
+func (w *WeightedRoundRobin) Get() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var (
+		total int64
+		best  *weightInfo
+		now   = w.now()
+	)
+	for _, n := range w.nodes {
+		weight := w.effective(n, now)
+		if weight <= 0 {
+			continue
+		}
+		total += weight
+		n.curWeight += weight
+		if best == nil || n.curWeight > best.curWeight {
+			best = n
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	best.curWeight -= total
+	return best.addr
+}
+
+// Addrs 返回所有地址，包括权重为 0 的地址
+func (w *WeightedRoundRobin) Addrs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	addrs := make([]string, 0, len(w.nodes))
+	for _, n := range w.nodes {
+		addrs = append(addrs, n.addr)
+	}
+	return addrs
+}
+
+// Weights 返回所有地址以及对应的权重
+func (w *WeightedRoundRobin) Weights() map[string]int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m := make(map[string]int64, len(w.nodes))
+	for _, n := range w.nodes {
+		m[n.addr] = n.weight
+	}
+	return m
+}
+
+// Add 使用默认权重添加一个地址，地址已经存在时不做任何操作
+func (w *WeightedRoundRobin) Add(addr string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.index[addr]; ok {
+		return
+	}
+	w.add(addr, DefaultWeight)
+}
+
+// AddWithWeight 添加一个地址，地址已经存在时更新它的权重
+func (w *WeightedRoundRobin) AddWithWeight(addr string, weight int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n, ok := w.index[addr]; ok {
+		n.setWeight(weight)
+		return
+	}
+	w.add(addr, weight)
+}
+
+func (w *WeightedRoundRobin) add(addr string, weight int64) {
+	n := &weightInfo{addr: addr, added: w.now()}
+	n.setWeight(weight)
+	w.nodes = append(w.nodes, n)
+	w.index[addr] = n
+}
+
+// SetWeight 修改 addr 的权重，权重为 0 的地址可以通过该方法恢复
+func (w *WeightedRoundRobin) SetWeight(addr string, weight int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, ok := w.index[addr]
+	if !ok {
+		return fmt.Errorf("not found %v", addr)
+	}
+	n.setWeight(weight)
+	return nil
+}
+
+// SetWeights 使用 weights 原子地替换所有的地址，仍然存在的地址会保留当前的选择进度
+func (w *WeightedRoundRobin) SetWeights(weights map[string]int64) {
+	addrs := make([]string, 0, len(weights))
+	for addr := range weights {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	nodes := make([]*weightInfo, 0, len(addrs))
+	index := make(map[string]*weightInfo, len(addrs))
+	for _, addr := range addrs {
+		n, ok := w.index[addr]
+		if !ok {
+			n = &weightInfo{addr: addr, added: w.now()}
+		}
+		n.setWeight(weights[addr])
+		nodes = append(nodes, n)
+		index[addr] = n
+	}
+	w.nodes, w.index = nodes, index
+}
+
+// Set 替换所有地址，仍然存在的地址保留它的权重，新的地址使用默认权重，所有地址的选择进度都会被清空
+func (w *WeightedRoundRobin) Set(addrs []string) {
+	addrs = dedupe(addrs)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	nodes := make([]*weightInfo, 0, len(addrs))
+	index := make(map[string]*weightInfo, len(addrs))
+	for _, addr := range addrs {
+		weight, added := DefaultWeight, w.now()
+		if n, ok := w.index[addr]; ok {
+			weight, added = n.weight, n.added
+		}
+		n := &weightInfo{addr: addr, added: added}
+		n.setWeight(weight)
+		nodes = append(nodes, n)
+		index[addr] = n
+	}
+	w.nodes, w.index = nodes, index
+}
+
+// SetInstances 使用 SERVING 状态的实例以及它们的权重替换所有地址，没有设置权重的实例使用默认权重
+func (w *WeightedRoundRobin) SetInstances(instances []registry.Instance) {
+	weights := make(map[string]int64, len(instances))
+	for _, ins := range instances {
+		if !ins.Serving() {
+			continue
+		}
+		weight := ins.Weight
+		if weight == 0 {
+			weight = DefaultWeight
+		}
+		weights[ins.Addr] = weight
+	}
+	w.SetWeights(weights)
+}
+
+func (w *WeightedRoundRobin) Update(oldAddr string, newAddr string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, ok := w.index[oldAddr]
+	if !ok {
+		return fmt.Errorf("not found %v", oldAddr)
+	}
+	if _, ok := w.index[newAddr]; ok && newAddr != oldAddr {
+		return fmt.Errorf("%v already exists", newAddr)
+	}
+	delete(w.index, oldAddr)
+	n.addr = newAddr
+	w.index[newAddr] = n
+	return nil
+}
+
+func (w *WeightedRoundRobin) Delete(addr string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, ok := w.index[addr]
+	if !ok {
+		return fmt.Errorf("not found %v", addr)
+	}
+	delete(w.index, addr)
+	for i, x := range w.nodes {
+		if x == n {
+			w.nodes = append(w.nodes[:i:i], w.nodes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// setWeight 修改权重，权重变为 0 时清空选择进度，恢复后从头开始参与选择
+func (wi *weightInfo) setWeight(weight int64) {
+	if weight < 0 {
+		weight = 0
+	}
+	wi.weight = weight
+	if weight == 0 {
+		wi.curWeight = 0
+	}
+}
@@ -0,0 +1,144 @@
+package loadbalance
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+func TestWeightedRoundRobinDistribution(t *testing.T) {
+	w := NewWeightedRoundRobin()
+	weights := map[string]int64{"4core": 4, "16core": 16, "8core": 8}
+	for addr, weight := range weights {
+		w.AddWithWeight(addr, weight)
+	}
+
+	const num = 10000
+	count := make(map[string]int)
+	for i := 0; i < num; i++ {
+		count[w.Get()]++
+	}
+	var total int64
+	for _, weight := range weights {
+		total += weight
+	}
+	for addr, weight := range weights {
+		want := float64(num) * float64(weight) / float64(total)
+		if math.Abs(float64(count[addr])-want)/want > 0.01 {
+			t.Fatalf("%v picked %d times, want about %.0f", addr, count[addr], want)
+		}
+	}
+}
+
+func TestWeightedRoundRobinSmooth(t *testing.T) {
+	w := NewWeightedRoundRobin()
+	w.AddWithWeight("a", 5)
+	w.AddWithWeight("b", 1)
+	w.AddWithWeight("c", 1)
+	// 平滑加权轮询的结果是交替的：a a b a c a a，而不是 a a a a a b c
+	var seq []string
+	for i := 0; i < 7; i++ {
+		seq = append(seq, w.Get())
+	}
+	if got := fmt.Sprint(seq); got != "[a a b a c a a]" {
+		t.Fatalf("sequence = %v", got)
+	}
+}
+
+func TestWeightedRoundRobinEqualWeights(t *testing.T) {
+	w := NewWeightedRoundRobin()
+	for _, addr := range []string{"a", "b", "c"} {
+		w.Add(addr) // 没有指定权重
+	}
+	w.Add("a") // 重复添加会被忽略
+	var seq []string
+	for i := 0; i < 6; i++ {
+		seq = append(seq, w.Get())
+	}
+	if got := fmt.Sprint(seq); got != "[a b c a b c]" {
+		t.Fatalf("sequence = %v", got)
+	}
+}
+
+func TestWeightedRoundRobinZeroWeight(t *testing.T) {
+	w := NewWeightedRoundRobin()
+	w.AddWithWeight("a", 1)
+	w.AddWithWeight("b", 0)
+	for i := 0; i < 100; i++ {
+		if addr := w.Get(); addr != "a" {
+			t.Fatalf("picked %v", addr)
+		}
+	}
+	if len(w.Addrs()) != 2 {
+		t.Fatalf("zero weight addr should still be tracked: %v", w.Addrs())
+	}
+	if err := w.SetWeight("b", 1); err != nil {
+		t.Fatal(err)
+	}
+	count := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		count[w.Get()]++
+	}
+	if count["a"] != 50 || count["b"] != 50 {
+		t.Fatalf("after revive: %v", count)
+	}
+
+	w.SetWeights(map[string]int64{"a": 0})
+	if addr := w.Get(); addr != "" {
+		t.Fatalf("all weights are zero, picked %v", addr)
+	}
+}
+
+func TestWeightedRoundRobinConcurrent(t *testing.T) {
+	w := NewWeightedRoundRobin()
+	w.SetWeights(map[string]int64{"a": 1, "b": 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				w.Get()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 1000; j++ {
+			w.SetWeights(map[string]int64{"a": 1, "b": 2, "c": int64(j % 3)})
+			w.Delete("c")
+			w.AddWithWeight("d", 1)
+			w.Update("d", "e")
+			w.Delete("e")
+		}
+	}()
+	wg.Wait()
+	for i := 0; i < 30; i++ {
+		if addr := w.Get(); addr != "a" && addr != "b" {
+			t.Fatalf("picked removed addr %v", addr)
+		}
+	}
+}
+
+func TestWeightedRoundRobinSetInstances(t *testing.T) {
+	w := NewWeightedRoundRobin()
+	SetInstances(w, []registry.Instance{
+		{Addr: "a", Weight: 3},
+		{Addr: "b"}, // 没有设置权重，使用默认权重
+		{Addr: "c", Weight: 5, Status: registry.StatusDraining},
+	})
+	if got := fmt.Sprint(w.Weights()); got != "map[a:3 b:1]" {
+		t.Fatalf("weights = %v", got)
+	}
+
+	// 没有实现 InstanceBalancer 的负载均衡器只会收到 SERVING 实例的地址
+	r := &RoundRobin{}
+	SetInstances(r, []registry.Instance{{Addr: "a"}, {Addr: "c", Status: registry.StatusStopped}})
+	if got := fmt.Sprint(r.Addrs()); got != "[a]" {
+		t.Fatalf("addrs = %v", got)
+	}
+}
@@ -0,0 +1,225 @@
+package loadbalance
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+var (
+	_ ContextBalancer  = &ZoneAware{}
+	_ InstanceBalancer = &ZoneAware{}
+	_ Reporter         = &ZoneAware{}
+	_ LoadReceiver     = &ZoneAware{}
+)
+
+// ZoneStats ZoneAware 的选择统计
+type ZoneStats struct {
+	Local     uint64 // 选中本 zone 实例的次数
+	Remote    uint64 // 选中其他 zone 实例的次数
+	SpillOver uint64 // 因为本 zone 没有实例或者健康实例的比例过低，而从所有 zone 中选择的次数
+}
+
+// ZoneAware 优先选择与客户端处于同一个 zone 的实例，包装任意一个负载均衡器（由 newBalancer 创建，
+// 比如 NewWeightedRoundRobin）。实例所在的 zone 通过 SetInstances 获得（registry.MetadataZone），
+// 本 zone 没有可用的实例，或者可用的实例占本 zone 所有实例的比例低于 threshold 时，从所有 zone 的
+// 实例中选择。通过 Add、Set 添加的地址如果不知道所在的 zone，则视为其他 zone 的实例。并发安全
+type ZoneAware struct {
+	zone      string
+	threshold float64
+
+	mu         sync.RWMutex
+	local      Balancer          // 本 zone 可用的实例
+	all        Balancer          // 所有 zone 可用的实例
+	zones      map[string]string // key: addr val: zone
+	localTotal int               // 本 zone 的实例总数，包括不可用的实例
+
+	localPicks  uint64
+	remotePicks uint64
+	spillOvers  uint64
+}
+
+// NewZoneAware 创建一个优先选择 zone 中实例的负载均衡器，threshold 为 0 到 1 之间的比例，
+// 为 0 时只有本 zone 没有可用的实例时才会选择其他 zone 的实例
+func NewZoneAware(zone string, threshold float64, newBalancer func() Balancer) *ZoneAware {
+	return &ZoneAware{
+		zone:      zone,
+		threshold: threshold,
+		local:     newBalancer(),
+		all:       newBalancer(),
+		zones:     make(map[string]string),
+	}
+}
+
+// SetInstances 使用 instances 替换所有的地址，并记录每个实例所在的 zone，只有 SERVING 的实例会被选中，
+// 内部的负载均衡器实现了 InstanceBalancer 时同样会收到实例的完整信息（比如权重）
+func (z *ZoneAware) SetInstances(instances []registry.Instance) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var (
+		local []registry.Instance
+		zones = make(map[string]string, len(instances))
+	)
+	for _, ins := range instances {
+		if _, ok := zones[ins.Addr]; ok {
+			continue
+		}
+		zones[ins.Addr] = ins.Zone()
+		if ins.Zone() == z.zone {
+			local = append(local, ins)
+		}
+	}
+	z.zones, z.localTotal = zones, len(local)
+	SetInstances(z.all, instances)
+	SetInstances(z.local, local)
+}
+
+// spillOver 返回是否需要从所有 zone 中选择，调用时需要持有 z.mu
+func (z *ZoneAware) spillOver() bool {
+	healthy := len(z.local.Addrs())
+	if healthy == 0 {
+		return true
+	}
+	total := z.localTotal
+	if total < healthy {
+		total = healthy
+	}
+	return float64(healthy)/float64(total) < z.threshold
+}
+
+func (z *ZoneAware) Get() string {
+	return z.GetContext(context.Background())
+}
+
+func (z *ZoneAware) GetContext(ctx context.Context) string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if !z.spillOver() {
+		if addr := Pick(ctx, z.local); addr != "" {
+			atomic.AddUint64(&z.localPicks, 1)
+			return addr
+		}
+	}
+	atomic.AddUint64(&z.spillOvers, 1)
+	addr := Pick(ctx, z.all)
+	switch {
+	case addr == "":
+	case z.zones[addr] == z.zone:
+		atomic.AddUint64(&z.localPicks, 1)
+	default:
+		atomic.AddUint64(&z.remotePicks, 1)
+	}
+	return addr
+}
+
+// Stats 返回选择统计
+func (z *ZoneAware) Stats() ZoneStats {
+	return ZoneStats{
+		Local:     atomic.LoadUint64(&z.localPicks),
+		Remote:    atomic.LoadUint64(&z.remotePicks),
+		SpillOver: atomic.LoadUint64(&z.spillOvers),
+	}
+}
+
+// Start 如果内部的负载均衡器实现了 Reporter，则转发给它们
+func (z *ZoneAware) Start(addr string) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	for _, lb := range z.balancers(addr) {
+		if r, ok := lb.(Reporter); ok {
+			r.Start(addr)
+		}
+	}
+}
+
+// Done 如果内部的负载均衡器实现了 Reporter，则转发给它们
+func (z *ZoneAware) Done(addr string, err error, latency time.Duration) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	for _, lb := range z.balancers(addr) {
+		if r, ok := lb.(Reporter); ok {
+			r.Done(addr, err, latency)
+		}
+	}
+}
+
+// ReportLoad 如果内部的负载均衡器实现了 LoadReceiver，则转发给它们
+func (z *ZoneAware) ReportLoad(addr string, load Load) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	for _, lb := range z.balancers(addr) {
+		if r, ok := lb.(LoadReceiver); ok {
+			r.ReportLoad(addr, load)
+		}
+	}
+}
+
+// balancers 返回 addr 所在的内部负载均衡器，调用时需要持有 z.mu
+func (z *ZoneAware) balancers(addr string) []Balancer {
+	if z.zones[addr] == z.zone {
+		return []Balancer{z.local, z.all}
+	}
+	return []Balancer{z.all}
+}
+
+func (z *ZoneAware) Addrs() []string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.all.Addrs()
+}
+
+func (z *ZoneAware) Add(addr string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.all.Add(addr)
+	if zone, ok := z.zones[addr]; ok && zone == z.zone {
+		z.local.Add(addr)
+	}
+}
+
+func (z *ZoneAware) Set(addrs []string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var local []string
+	for _, addr := range addrs {
+		if zone, ok := z.zones[addr]; ok && zone == z.zone {
+			local = append(local, addr)
+		}
+	}
+	z.all.Set(addrs)
+	z.local.Set(local)
+}
+
+func (z *ZoneAware) Update(oldAddr string, newAddr string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.all.Update(oldAddr, newAddr); err != nil {
+		return err
+	}
+	zone, ok := z.zones[oldAddr]
+	if !ok {
+		return nil
+	}
+	// 地址变化但仍然是同一个实例，zone 不变
+	delete(z.zones, oldAddr)
+	z.zones[newAddr] = zone
+	if zone == z.zone {
+		return z.local.Update(oldAddr, newAddr)
+	}
+	return nil
+}
+
+func (z *ZoneAware) Delete(addr string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.all.Delete(addr); err != nil {
+		return err
+	}
+	if zone, ok := z.zones[addr]; ok && zone == z.zone {
+		return z.local.Delete(addr)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+func zoneInstance(addr, zone string, status registry.Status) registry.Instance {
+	return registry.Instance{Addr: addr, Status: status, Metadata: map[string]string{registry.MetadataZone: zone}}
+}
+
+func newTestZoneAware(instances ...registry.Instance) *ZoneAware {
+	z := NewZoneAware("a", 0.5, func() Balancer { return NewWeightedRoundRobin() })
+	z.SetInstances(instances)
+	return z
+}
+
+func TestZoneAwareAllLocalHealthy(t *testing.T) {
+	z := newTestZoneAware(
+		zoneInstance("a1", "a", registry.StatusServing),
+		zoneInstance("a2", "a", registry.StatusServing),
+		zoneInstance("b1", "b", registry.StatusServing),
+	)
+	count := picked(z, 100)
+	if count["b1"] != 0 || count["a1"] != 50 || count["a2"] != 50 {
+		t.Fatalf("picked %v, want only local instances", count)
+	}
+	if stats := z.Stats(); stats != (ZoneStats{Local: 100}) {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestZoneAwarePartialOutage(t *testing.T) {
+	// 本 zone 3 个实例中只有 1 个可用，低于 50%，从所有 zone 中选择
+	z := newTestZoneAware(
+		zoneInstance("a1", "a", registry.StatusServing),
+		zoneInstance("a2", "a", registry.StatusDraining),
+		zoneInstance("a3", "a", registry.StatusStopped),
+		zoneInstance("b1", "b", registry.StatusServing),
+		zoneInstance("b2", "b", registry.StatusServing),
+	)
+	count := picked(z, 300)
+	if count["a2"] != 0 || count["a3"] != 0 {
+		t.Fatalf("unhealthy instance picked: %v", count)
+	}
+	if count["b1"] == 0 || count["b2"] == 0 {
+		t.Fatalf("no spill-over to other zones: %v", count)
+	}
+	stats := z.Stats()
+	if stats.SpillOver != 300 || stats.Local != uint64(count["a1"]) || stats.Remote != uint64(count["b1"]+count["b2"]) {
+		t.Fatalf("stats = %+v, picked %v", stats, count)
+	}
+
+	// 恢复一个实例后达到阈值，不再溢出
+	z.Add("a2")
+	before := z.Stats()
+	count = picked(z, 100)
+	if count["b1"] != 0 || count["b2"] != 0 {
+		t.Fatalf("picked %v after local recovered", count)
+	}
+	if after := z.Stats(); after.SpillOver != before.SpillOver || after.Local != before.Local+100 {
+		t.Fatalf("stats = %+v, before %+v", after, before)
+	}
+
+	// 通过 Delete 移除本 zone 的实例同样会降低可用比例
+	if err := z.Delete("a2"); err != nil {
+		t.Fatal(err)
+	}
+	if count := picked(z, 100); count["b1"] == 0 {
+		t.Fatalf("no spill-over after local instance deleted: %v", count)
+	}
+}
+
+func TestZoneAwareEmptyZone(t *testing.T) {
+	z := newTestZoneAware(
+		zoneInstance("b1", "b", registry.StatusServing),
+		zoneInstance("c1", "c", registry.StatusServing),
+	)
+	count := picked(z, 100)
+	if count["b1"] != 50 || count["c1"] != 50 {
+		t.Fatalf("picked %v", count)
+	}
+	if stats := z.Stats(); stats != (ZoneStats{Remote: 100, SpillOver: 100}) {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	z.SetInstances(nil)
+	if addr := z.Get(); addr != "" {
+		t.Fatalf("Get() = %q without instances", addr)
+	}
+}
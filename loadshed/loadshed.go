@@ -0,0 +1,231 @@
+// Package loadshed 服务端自适应过载保护拦截器：根据最近请求的延迟（排队等待加上 handler 执行的时间）调整可以同时
+// 处理的请求数，超过限制或者延迟高于目标时在执行 handler 之前拒绝一部分请求，避免过载时所有请求都超时：
+//
+//	s := loadshed.New(loadshed.Config{TargetLatency: 50 * time.Millisecond, MaxLimit: 500})
+//	appleseed.NewServer(ctx, name, host, port, reg, appleseed.WithInterceptors(s.Intercept))
+//
+// 请求 metadata 中带有优先级（metadata.PriorityKey）时，优先拒绝优先级低的请求
+package loadshed
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/ratelimit"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// Config 控制器的参数，零值的字段使用默认值
+type Config struct {
+	// TargetLatency 目标延迟，包括排队等待和 handler 执行的时间，默认为 100ms
+	TargetLatency time.Duration
+	// MinLimit、MaxLimit 同时处理的请求数的范围，默认为 1 和 1000
+	MinLimit int
+	MaxLimit int
+	// InitialLimit 初始的限制，默认为 MaxLimit 的 1/10，不小于 MinLimit
+	InitialLimit int
+	// Smoothing 0~1，延迟的指数移动平均以及每次调整限制的平滑系数，越大对变化越敏感，默认为 0.2
+	Smoothing float64
+}
+
+func (c Config) withDefaults() Config {
+	if c.TargetLatency <= 0 {
+		c.TargetLatency = 100 * time.Millisecond
+	}
+	if c.MinLimit < 1 {
+		c.MinLimit = 1
+	}
+	if c.MaxLimit <= 0 {
+		c.MaxLimit = 1000
+	}
+	if c.MaxLimit < c.MinLimit {
+		c.MaxLimit = c.MinLimit
+	}
+	if c.InitialLimit <= 0 {
+		c.InitialLimit = c.MaxLimit / 10
+	}
+	if c.InitialLimit < c.MinLimit {
+		c.InitialLimit = c.MinLimit
+	}
+	if c.InitialLimit > c.MaxLimit {
+		c.InitialLimit = c.MaxLimit
+	}
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		c.Smoothing = 0.2
+	}
+	return c
+}
+
+// Stats 过载保护的统计
+type Stats struct {
+	Limit    int           // 当前的限制
+	Inflight int64         // 正在处理的请求数
+	Latency  time.Duration // 延迟的指数移动平均
+	Admitted uint64
+	Shed     uint64
+}
+
+// ShedError 请求因为过载被拒绝时返回的错误
+type ShedError struct {
+	Reason   string // "limit"：正在处理的请求数超过限制；"latency"：延迟高于目标，按比例拒绝
+	Limit    int
+	Priority int
+}
+
+func (e *ShedError) Error() string {
+	return fmt.Sprintf("%s: server overloaded (%s), limit %d, priority %d", ratelimit.ResourceExhausted, e.Reason, e.Limit, e.Priority)
+}
+
+// Status 返回给客户端的错误，错误码为 status.ResourceExhausted，ratelimit.IsResourceExhausted 同样可以识别
+func (e *ShedError) Status() *status.Status {
+	return status.New(status.ResourceExhausted, e.Error()).WithDetails(map[string]string{
+		"reason": e.Reason,
+		"limit":  strconv.Itoa(e.Limit),
+	})
+}
+
+// Shedder 自适应过载保护，使用梯度算法调整限制：延迟的移动平均高于目标时，按照 目标/延迟 的比例缩小限制，
+// 低于目标并且正在处理的请求数接近限制时逐渐增大限制。
+//
+// 正在处理的请求数超过限制时，拒绝优先级不大于 0 的请求，优先级更高的请求直到 MaxLimit 才会被拒绝；
+// 延迟高于目标时按照 1-目标/延迟 的比例拒绝请求，优先级每高 1 拒绝的比例减半，每低 1 拒绝的比例加倍。
+// 并发安全
+type Shedder struct {
+	cfg Config
+
+	mu      sync.Mutex
+	limit   float64
+	latency float64 // 每轮请求平均延迟的指数移动平均，单位为纳秒，没有样本时为 0
+	window  sampleWindow
+
+	inflight int64 // 原子操作
+	admitted uint64
+	shed     uint64
+	now      func() time.Time
+}
+
+// sampleWindow 一轮请求的延迟样本
+type sampleWindow struct {
+	sum         time.Duration
+	n           int
+	maxInflight int64
+}
+
+// New 创建一个过载保护，cfg 中零值的字段使用默认值
+func New(cfg Config) *Shedder {
+	cfg = cfg.withDefaults()
+	return &Shedder{cfg: cfg, limit: float64(cfg.InitialLimit), now: time.Now}
+}
+
+// Stats 返回当前的限制和统计
+func (s *Shedder) Stats() Stats {
+	s.mu.Lock()
+	limit, latency := s.limit, s.latency
+	s.mu.Unlock()
+	return Stats{
+		Limit:    int(limit),
+		Inflight: atomic.LoadInt64(&s.inflight),
+		Latency:  time.Duration(latency),
+		Admitted: atomic.LoadUint64(&s.admitted),
+		Shed:     atomic.LoadUint64(&s.shed),
+	}
+}
+
+// Priority 返回请求 metadata 中的优先级，没有设置或者不合法时为 0
+func Priority(ctx context.Context) int {
+	md, _ := metadata.FromIncomingContext(ctx)
+	p, err := strconv.Atoi(md.Get(metadata.PriorityKey))
+	if err != nil {
+		return 0
+	}
+	return p
+}
+
+// Intercept 实现 appleseed.Interceptor，被拒绝的请求不会执行 handler
+func (s *Shedder) Intercept(ctx context.Context, info *appleseed.ServerInfo, arg, reply any, handler appleseed.Handler) error {
+	done, err := s.Allow(ctx, info)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return handler(ctx, arg, reply)
+}
+
+// Allow 判断是否处理请求，处理时返回的 done 需要在 handler 结束后调用，用来记录本次请求的延迟
+func (s *Shedder) Allow(ctx context.Context, info *appleseed.ServerInfo) (done func(), err *ShedError) {
+	priority := Priority(ctx)
+	s.mu.Lock()
+	limit, latency := s.limit, s.latency
+	s.mu.Unlock()
+
+	inflight := atomic.AddInt64(&s.inflight, 1)
+	reason := ""
+	switch target := float64(s.cfg.TargetLatency); {
+	case inflight > int64(limit) && (priority <= 0 || inflight > int64(s.cfg.MaxLimit)):
+		reason = "limit"
+	case latency > target && rand.Float64() < (1-target/latency)*math.Pow(2, -float64(priority)):
+		reason = "latency"
+	}
+	if reason != "" {
+		atomic.AddInt64(&s.inflight, -1)
+		atomic.AddUint64(&s.shed, 1)
+		return nil, &ShedError{Reason: reason, Limit: int(limit), Priority: priority}
+	}
+	atomic.AddUint64(&s.admitted, 1)
+
+	start := info.Queued
+	if start.IsZero() {
+		start = s.now()
+	}
+	var once int32
+	return func() {
+		if !atomic.CompareAndSwapInt32(&once, 0, 1) {
+			return
+		}
+		s.observe(s.now().Sub(start), atomic.AddInt64(&s.inflight, -1)+1)
+	}, nil
+}
+
+// observe 记录一个延迟为 sample 的请求，inflight 为它结束前正在处理的请求数。每收集到 limit 个样本
+// （大约一轮请求）才调整一次限制，否则并发很高时每个请求都调整一次，限制会剧烈振荡
+func (s *Shedder) observe(sample time.Duration, inflight int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.window.sum += sample
+	s.window.n++
+	if inflight > s.window.maxInflight {
+		s.window.maxInflight = inflight
+	}
+	if float64(s.window.n) < s.limit {
+		return
+	}
+	avg := float64(s.window.sum) / float64(s.window.n)
+	maxInflight := s.window.maxInflight
+	s.window = sampleWindow{}
+
+	a := s.cfg.Smoothing
+	if s.latency == 0 {
+		s.latency = avg
+	} else {
+		s.latency = (1-a)*s.latency + a*avg
+	}
+	var next float64
+	if gradient := float64(s.cfg.TargetLatency) / s.latency; gradient < 1 {
+		next = s.limit * math.Max(0.5, gradient)
+	} else if float64(maxInflight) >= s.limit/2 {
+		// 延迟低于目标时每次最多增加 sqrt(limit)，请求数远低于限制时延迟低并不能说明可以处理更多的请求
+		next = s.limit + math.Sqrt(s.limit)
+	} else {
+		return
+	}
+	s.limit = (1-a)*s.limit + a*next
+	s.limit = math.Max(float64(s.cfg.MinLimit), math.Min(float64(s.cfg.MaxLimit), s.limit))
+}
@@ -0,0 +1,238 @@
+package loadshed
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/ratelimit"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+func withPriority(priority string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(metadata.PriorityKey, priority))
+}
+
+func TestController(t *testing.T) {
+	s := New(Config{TargetLatency: 10 * time.Millisecond, MinLimit: 2, MaxLimit: 50, InitialLimit: 20})
+	for i := 0; i < 1000; i++ {
+		s.observe(40*time.Millisecond, 20)
+	}
+	if st := s.Stats(); st.Limit != 2 || st.Latency < 30*time.Millisecond {
+		t.Fatalf("after slow requests: %+v", st)
+	}
+
+	// 延迟恢复，但是请求数远低于限制时不增大限制
+	for i := 0; i < 1000; i++ {
+		s.observe(time.Millisecond, 0)
+	}
+	if st := s.Stats(); st.Limit != 2 {
+		t.Fatalf("after idle fast requests: %+v", st)
+	}
+	for i := 0; i < 5000; i++ {
+		s.observe(time.Millisecond, int64(s.Stats().Limit))
+	}
+	if st := s.Stats(); st.Limit != 50 {
+		t.Fatalf("after busy fast requests: %+v", st)
+	}
+}
+
+// TestPriorityOverLimit 超过限制时只拒绝优先级不大于 0 的请求，优先级高的请求直到 MaxLimit 才被拒绝
+func TestPriorityOverLimit(t *testing.T) {
+	s := New(Config{MaxLimit: 4, InitialLimit: 2})
+	var dones []func()
+	for i := 0; i < 2; i++ {
+		done, err := s.Allow(context.Background(), &appleseed.ServerInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dones = append(dones, done)
+	}
+	for _, p := range []string{"", "0", "-1", "x"} {
+		if _, err := s.Allow(withPriority(p), &appleseed.ServerInfo{}); err == nil || err.Reason != "limit" {
+			t.Fatalf("priority %q: err = %v", p, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		done, err := s.Allow(withPriority("1"), &appleseed.ServerInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dones = append(dones, done)
+	}
+	if _, err := s.Allow(withPriority("5"), &appleseed.ServerInfo{}); err == nil {
+		t.Fatal("admitted over MaxLimit")
+	}
+	for _, done := range dones {
+		done()
+		done()
+	}
+	if st := s.Stats(); st.Inflight != 0 || st.Admitted != 4 || st.Shed != 5 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+// TestLatencyShedByPriority 延迟是目标的两倍时拒绝一半优先级为 0 的请求，优先级越高拒绝的越少
+func TestLatencyShedByPriority(t *testing.T) {
+	s := New(Config{TargetLatency: 10 * time.Millisecond, MaxLimit: 100000, InitialLimit: 100000})
+	s.latency = float64(20 * time.Millisecond)
+	const n = 4000
+	shed := make(map[string]int)
+	for _, p := range []string{"-1", "0", "2"} {
+		ctx := withPriority(p)
+		for i := 0; i < n; i++ {
+			if _, err := s.Allow(ctx, &appleseed.ServerInfo{}); err != nil {
+				shed[p]++
+			}
+		}
+	}
+	// 拒绝的比例分别为 1、1/2、1/8
+	if shed["-1"] != n || shed["0"] < n*4/10 || shed["0"] > n*6/10 || shed["2"] < n/20 || shed["2"] > n/5 {
+		t.Fatalf("shed %v of %d", shed, n)
+	}
+}
+
+// resource 同时只能处理 capacity 个请求的资源，每个请求耗时 cost，超出的请求排队等待，所以并发越高延迟越高
+type resource struct {
+	sem  chan struct{}
+	cost time.Duration
+}
+
+func (r *resource) handle(ctx context.Context, arg, reply any) error {
+	r.sem <- struct{}{}
+	time.Sleep(r.cost)
+	<-r.sem
+	return nil
+}
+
+// overload 使用 workers 个 goroutine 持续调用 handler，返回后半段时间内处理的请求的 p90 延迟和处理的请求数
+func overload(intercept appleseed.Interceptor, workers int, d time.Duration) (p90 time.Duration, admitted int) {
+	r := &resource{sem: make(chan struct{}, 4), cost: 5 * time.Millisecond}
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	measure := start.Add(d / 2)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Since(start) < d {
+				info := &appleseed.ServerInfo{ServiceMethod: "R.Handle", Queued: time.Now()}
+				err := intercept(context.Background(), info, nil, nil, r.handle)
+				if err != nil {
+					// 被拒绝的客户端稍后重试
+					time.Sleep(5 * time.Millisecond)
+					continue
+				}
+				if end := time.Now(); end.After(measure) {
+					mu.Lock()
+					latencies = append(latencies, end.Sub(info.Queued))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if len(latencies) == 0 {
+		return 0, 0
+	}
+	return latencies[len(latencies)*9/10], len(latencies)
+}
+
+// TestOverload 并发请求远超过处理能力时，没有过载保护的延迟随排队无限增长，开启后处理的请求的延迟保持在目标附近
+func TestOverload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	const workers, target = 128, 25 * time.Millisecond
+	passthrough := func(ctx context.Context, info *appleseed.ServerInfo, arg, reply any, handler appleseed.Handler) error {
+		return handler(ctx, arg, reply)
+	}
+	base, baseN := overload(passthrough, workers, time.Second)
+
+	s := New(Config{TargetLatency: target, MaxLimit: workers})
+	shed, shedN := overload(s.Intercept, workers, time.Second)
+	st := s.Stats()
+	t.Logf("without shedding p90 %v (%d requests), with shedding p90 %v (%d requests), stats %+v", base, baseN, shed, shedN, st)
+	if base < 4*target {
+		t.Fatalf("baseline p90 %v, handler is not overloaded", base)
+	}
+	if shed > 2*target || shed > base/2 {
+		t.Fatalf("p90 with shedding %v, without %v", shed, base)
+	}
+	// 拒绝请求不应该降低处理能力
+	if shedN < baseN/2 {
+		t.Fatalf("admitted %d requests, %d without shedding", shedN, baseN)
+	}
+	if st.Shed == 0 || st.Limit >= workers || st.Inflight != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+type Echo struct {
+	calls int64
+}
+
+func (e *Echo) Echo(arg *int, reply *int) error {
+	atomic.AddInt64(&e.calls, 1)
+	*reply = *arg
+	return nil
+}
+
+func TestInterceptor(t *testing.T) {
+	s := New(Config{TargetLatency: 10 * time.Millisecond, InitialLimit: 1000, MaxLimit: 1000})
+	s.latency = float64(time.Hour)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	srv, err := appleseed.NewServer(context.Background(), "loadshed", "127.0.0.1", port, memory.New(nil),
+		appleseed.WithInterceptors(s.Intercept))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := new(Echo)
+	if err := srv.Register(echo); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	defer srv.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := client.NewClient(conn, lis.Addr().String())
+	defer cli.Close()
+
+	// 延迟远高于目标，优先级为 0 的请求几乎都被拒绝，并且不会执行 handler
+	arg, reply := 1, 0
+	err = cli.Call(context.Background(), "Echo.Echo", &arg, &reply)
+	st, _ := status.FromError(err)
+	if !ratelimit.IsResourceExhausted(err) || st.Code() != status.ResourceExhausted || st.Details()["reason"] != "latency" {
+		t.Fatalf("err = %v, details = %v", err, st.Details())
+	}
+	if n := atomic.LoadInt64(&echo.calls); n != 0 {
+		t.Fatalf("handler called %d times", n)
+	}
+	// 优先级为 100 的请求被拒绝的比例可以忽略
+	ctx := metadata.AppendToOutgoingContext(context.Background(), metadata.PriorityKey, "100")
+	if err := cli.Call(ctx, "Echo.Echo", &arg, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Stats(); st.Admitted != 1 || st.Shed != 1 || st.Inflight != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
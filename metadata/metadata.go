@@ -0,0 +1,112 @@
+// Package metadata 随请求一起传输的键值对，比如 request id、trace 信息等
+package metadata
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+const (
+	// RequestIDKey request id 在 MD 中的 key
+	RequestIDKey = "request-id"
+	// TimeoutKey 客户端 ctx 剩余的超时时间（time.Duration 的字符串形式）在 MD 中的 key，
+	// 服务端据此为 handler 的 ctx 设置相同的 deadline
+	TimeoutKey = "timeout"
+	// RetryAfterKey 服务端拒绝请求（比如被限流）时，建议客户端等待多久（time.Duration 的字符串形式）
+	// 之后再重试，在响应 MD 中的 key
+	RetryAfterKey = "retry-after"
+	// PriorityKey 请求的优先级（整数的字符串形式）在 MD 中的 key，越大越重要，没有设置时为 0。
+	// 服务端过载时优先拒绝优先级低的请求
+	PriorityKey = "priority"
+	// DrainTimeoutKey GOAWAY 控制帧中服务端最多还会等待多久（time.Duration 的字符串形式）才关闭连接，
+	// 在响应 MD 中的 key
+	DrainTimeoutKey = "drain-timeout"
+	// CacheControlKey 服务端对响应的缓存指示在响应 MD 中的 key，格式同 HTTP 的 Cache-Control 头，
+	// 目前只使用 "no-store" 和 "max-age=<秒>"，见 appleseed.SetCacheTTL、client.Cache
+	CacheControlKey = "cache-control"
+)
+
+// MD 请求的元数据
+type MD map[string]string
+
+// Pairs 使用 key, value, key, value... 创建 MD，kv 的数量为奇数时忽略最后一个
+func Pairs(kv ...string) MD {
+	md := make(MD, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+// Get 返回 key 对应的值，不存在时返回空字符串
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+// Copy 返回 md 的拷贝，修改拷贝不会影响 md
+func (md MD) Copy() MD {
+	c := make(MD, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+type outgoingKey struct{}
+
+type incomingKey struct{}
+
+// NewOutgoingContext 客户端使用返回的 ctx 发起调用时，md 会随请求发送给服务端
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext 在 ctx 已有的 outgoing md 上添加 kv，不会修改原来的 md
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	md = md.Copy()
+	for k, v := range Pairs(kv...) {
+		md[k] = v
+	}
+	return NewOutgoingContext(ctx, md)
+}
+
+// FromOutgoingContext 返回 NewOutgoingContext 设置的 md，调用方不应该修改它
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext 服务端使用收到的 md 创建传给 handler 的 ctx
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext 返回服务端收到的 md，调用方不应该修改它
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
+
+// RequestID 返回使用 ctx 发起调用时应该携带的 request id：优先使用 outgoing md 中的 request id，
+// 其次是服务端收到的 request id（handler 使用同一个 ctx 调用下游服务时沿用上游的 request id），
+// 都没有时返回空字符串
+func RequestID(ctx context.Context) string {
+	if md, ok := FromOutgoingContext(ctx); ok && md[RequestIDKey] != "" {
+		return md[RequestIDKey]
+	}
+	if md, ok := FromIncomingContext(ctx); ok {
+		return md[RequestIDKey]
+	}
+	return ""
+}
+
+// NewRequestID 生成一个随机的 request id
+func NewRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,37 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAppendToOutgoingContext(t *testing.T) {
+	ctx := NewOutgoingContext(context.Background(), Pairs("a", "1"))
+	ctx2 := AppendToOutgoingContext(ctx, "b", "2", "a", "3")
+	md, _ := FromOutgoingContext(ctx)
+	if len(md) != 1 || md.Get("a") != "1" {
+		t.Fatalf("original md modified: %v", md)
+	}
+	md2, _ := FromOutgoingContext(ctx2)
+	if md2.Get("a") != "3" || md2.Get("b") != "2" {
+		t.Fatalf("md = %v", md2)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+	if id := RequestID(ctx); id != "" {
+		t.Fatalf("RequestID() = %q", id)
+	}
+	ctx = NewIncomingContext(ctx, Pairs(RequestIDKey, "upstream"))
+	if id := RequestID(ctx); id != "upstream" {
+		t.Fatalf("RequestID() = %q, want upstream", id)
+	}
+	ctx = AppendToOutgoingContext(ctx, RequestIDKey, "explicit")
+	if id := RequestID(ctx); id != "explicit" {
+		t.Fatalf("RequestID() = %q, want explicit", id)
+	}
+	if a, b := NewRequestID(), NewRequestID(); a == b || len(a) != 32 {
+		t.Fatalf("NewRequestID() = %q, %q", a, b)
+	}
+}
@@ -0,0 +1,145 @@
+package appleseed
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// Legacy 同时可以注册到 net/rpc 和 appleseed 的服务
+type Legacy struct{}
+
+func (Legacy) Add(args Args, reply *Reply) error {
+	if args.X < 0 {
+		return errors.New("negative x")
+	}
+	reply.Add = args.X + args.Y
+	reply.Str = args.Str
+	return nil
+}
+
+// callConcurrently 并发地调用 Legacy.Add，检查每个调用都收到了自己的响应
+func callConcurrently(t *testing.T, call func(args Args, reply *Reply) error) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			var reply Reply
+			if err := call(Args{X: i, Y: i}, &reply); err != nil || reply.Add != 2*i {
+				errs <- errors.New("bad reply")
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNetRPCServer appleseed 的客户端（gob 编码）调用 net/rpc 的服务端
+func TestNetRPCServer(t *testing.T) {
+	srv := rpc.NewServer()
+	if err := srv.Register(Legacy{}); err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go srv.Accept(lis)
+
+	cli, err := client.Dial(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// 请求 header 中的 metadata（request id、超时时间）被 net/rpc 忽略
+	ctx := client.WithRequestID(context.Background(), "req-1")
+	var reply Reply
+	if err := cli.Call(ctx, "Legacy.Add", Args{Str: "a", X: 1, Y: 2}, &reply); err != nil || reply != (Reply{Str: "a", Add: 3}) {
+		t.Fatalf("reply = %+v, err = %v", reply, err)
+	}
+	// net/rpc 只返回错误信息，错误码为 Unknown
+	err = cli.Call(ctx, "Legacy.Add", Args{X: -1}, &reply)
+	if st, ok := status.FromError(err); !ok || st.Code() != status.Unknown || st.Message() != "negative x" {
+		t.Fatalf("err = %v", err)
+	}
+	if err := cli.Call(ctx, "Legacy.Nope", Args{}, &reply); err == nil || !strings.Contains(err.Error(), "can't find method") {
+		t.Fatalf("err = %v", err)
+	}
+	callConcurrently(t, func(args Args, reply *Reply) error {
+		return cli.Call(context.Background(), "Legacy.Add", args, reply)
+	})
+}
+
+// TestNetRPCClient net/rpc 的客户端调用 appleseed 的服务端
+func TestNetRPCClient(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := NewServer(context.Background(), "legacy", "127.0.0.1", port, memory.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(Legacy{}); err != nil {
+		t.Fatal(err)
+	}
+	// 带有 ctx 参数的方法同样可以被 net/rpc 的客户端调用
+	if err := s.Register(&Hop{}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(context.Background())
+
+	cli, err := rpc.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	var reply Reply
+	if err := cli.Call("Legacy.Add", Args{Str: "a", X: 1, Y: 2}, &reply); err != nil || reply != (Reply{Str: "a", Add: 3}) {
+		t.Fatalf("reply = %+v, err = %v", reply, err)
+	}
+	// 错误以 rpc.ServerError 返回，没有 request id 时错误信息不变
+	if err := cli.Call("Legacy.Add", Args{X: -1}, &reply); err != rpc.ServerError("negative x") {
+		t.Fatalf("err = %#v", err)
+	}
+	if err := cli.Call("Legacy.Nope", Args{}, &reply); err != rpc.ServerError("rpc: can't find method Legacy.Nope") {
+		t.Fatalf("err = %#v", err)
+	}
+	fail, hop := false, ""
+	if err := cli.Call("Hop.Forward", &fail, &hop); err != nil {
+		t.Fatal(err)
+	}
+	callConcurrently(t, func(args Args, reply *Reply) error {
+		return cli.Call("Legacy.Add", args, reply)
+	})
+	// 异步调用，seq 由 net/rpc 的客户端分配，从 0 开始
+	calls := make([]*rpc.Call, 10)
+	for i := range calls {
+		calls[i] = cli.Go("Legacy.Add", Args{X: int64(i)}, new(Reply), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil || call.Reply.(*Reply).Add != int64(i) {
+			t.Fatalf("call %d: %+v, %v", i, call.Reply, call.Error)
+		}
+	}
+}
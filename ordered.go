@@ -0,0 +1,117 @@
+package appleseed
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+const (
+	// DefaultOrderedLanes 按 key 顺序执行的请求默认使用的执行队列数量
+	DefaultOrderedLanes = 64
+	// DefaultOrderedQueueDepth 每个执行队列中默认最多等待的请求数量
+	DefaultOrderedQueueDepth = 1024
+)
+
+// WithOrderedMethod serviceMethod 的请求中 key(arg) 相同的按照到达服务端的顺序依次执行，一个执行完才开始下一个，
+// key 不同的仍然并发执行。key 返回空字符串的请求不排序。
+//
+// 请求按照 key 的哈希分配到固定数量的执行队列中（见 WithOrderedLanes），key 不同的请求也可能在同一个队列中排队，
+// 但是内存的占用和 key 的数量无关。队列已满时请求返回 ResourceExhausted
+func WithOrderedMethod(serviceMethod string, key func(arg any) string) ServerOption {
+	return func(s *Server) {
+		if s.ordered == nil {
+			s.ordered = make(map[string]func(arg any) string)
+		}
+		s.ordered[serviceMethod] = key
+	}
+}
+
+// WithOrderedLanes 按 key 顺序执行的请求使用 lanes 个执行队列，每个队列最多等待 depth 个请求（不包括正在执行的），
+// 默认为 DefaultOrderedLanes 和 DefaultOrderedQueueDepth
+func WithOrderedLanes(lanes, depth int) ServerOption {
+	return func(s *Server) {
+		s.laneCount, s.laneDepth = lanes, depth
+	}
+}
+
+// lane 一个执行队列，有请求时启动一个 goroutine 依次执行，队列为空时退出
+type lane struct {
+	mu      sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// push 将 task 加入队列，队列已满时返回 false
+func (l *lane) push(task func(), depth int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) >= depth {
+		return false
+	}
+	l.queue = append(l.queue, task)
+	if !l.running {
+		l.running = true
+		go l.run()
+	}
+	return true
+}
+
+func (l *lane) run() {
+	for {
+		l.mu.Lock()
+		if len(l.queue) == 0 {
+			l.running = false
+			l.queue = nil
+			l.mu.Unlock()
+			return
+		}
+		task := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		l.mu.Unlock()
+		task()
+	}
+}
+
+// newLanes NewServer 时根据 WithOrderedMethod 创建执行队列，没有按 key 顺序执行的方法时为 nil
+func (s *Server) newLanes() {
+	if len(s.ordered) == 0 {
+		return
+	}
+	if s.laneCount <= 0 {
+		s.laneCount = DefaultOrderedLanes
+	}
+	if s.laneDepth <= 0 {
+		s.laneDepth = DefaultOrderedQueueDepth
+	}
+	s.lanes = make([]lane, s.laneCount)
+}
+
+// laneOf 返回请求所在的执行队列，不需要按顺序执行时返回 nil
+func (s *Server) laneOf(serviceMethod string, arg any) *lane {
+	if s.lanes == nil {
+		return nil
+	}
+	key, ok := s.ordered[serviceMethod]
+	if !ok {
+		return nil
+	}
+	k := key(arg)
+	if k == "" {
+		return nil
+	}
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(k); i++ {
+		h ^= uint32(k[i])
+		h *= 16777619
+	}
+	return &s.lanes[h%uint32(len(s.lanes))]
+}
+
+// laneFullError 执行队列已满时返回给客户端的错误
+func laneFullError(serviceMethod string, depth int) error {
+	return status.New(status.ResourceExhausted, fmt.Sprintf("rpc: ordered queue of %s is full (%d waiting)", serviceMethod, depth))
+}
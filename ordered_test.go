@@ -0,0 +1,154 @@
+package appleseed
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+type Op struct {
+	Account string
+	Amount  int64
+}
+
+// Ledger Apply 不加锁地读写余额，同一个账户的请求只有依次执行时结果才是对的
+type Ledger struct {
+	balances map[string]*int64 // 只读，账户提前创建
+	entered  chan string
+	release  chan struct{}
+}
+
+func newLedger(accounts ...string) *Ledger {
+	l := &Ledger{balances: make(map[string]*int64), entered: make(chan string, 16), release: make(chan struct{})}
+	for _, a := range accounts {
+		l.balances[a] = new(int64)
+	}
+	return l
+}
+
+func (l *Ledger) Apply(op *Op, balance *int64) error {
+	p := l.balances[op.Account]
+	v := *p
+	runtime.Gosched()
+	*p = v + op.Amount
+	*balance = *p
+	return nil
+}
+
+// Hold 阻塞到 release 被关闭
+func (l *Ledger) Hold(op *Op, balance *int64) error {
+	l.entered <- op.Account
+	<-l.release
+	return nil
+}
+
+func opAccount(arg any) string {
+	return arg.(*Op).Account
+}
+
+func startLedger(t *testing.T, ledger *Ledger, opts ...ServerOption) (*Server, []*client.Client) {
+	opts = append(opts, WithOrderedMethod("Ledger.Apply", opAccount), WithOrderedMethod("Ledger.Hold", opAccount))
+	s, lis := startHooksServer(t, opts...)
+	if err := s.Register(ledger); err != nil {
+		t.Fatal(err)
+	}
+	clis := make([]*client.Client, 4)
+	for i := range clis {
+		clis[i] = dialHooks(t, lis)
+	}
+	return s, clis
+}
+
+// TestOrderedSameKey 多个连接上同一个账户的 1000 个并发请求依次执行，余额准确
+func TestOrderedSameKey(t *testing.T) {
+	ledger := newLedger("alice")
+	s, clis := startLedger(t, ledger)
+	defer s.Shutdown(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(cli *client.Client) {
+			defer wg.Done()
+			var balance int64
+			if err := cli.Call(context.Background(), "Ledger.Apply", &Op{Account: "alice", Amount: 1}, &balance); err != nil {
+				t.Error(err)
+			}
+		}(clis[i%len(clis)])
+	}
+	wg.Wait()
+	if got := *ledger.balances["alice"]; got != 1000 {
+		t.Fatalf("balance = %d, want 1000", got)
+	}
+}
+
+// TestOrderedDifferentKeys 不同 key 的请求仍然并发执行
+func TestOrderedDifferentKeys(t *testing.T) {
+	ledger := newLedger()
+	s, clis := startLedger(t, ledger)
+	defer s.Shutdown(context.Background())
+
+	// 选出分配到不同执行队列的 key
+	keys := []string{"a"}
+	for c := 'b'; len(keys) < 4; c++ {
+		k := string(c)
+		distinct := true
+		for _, prev := range keys {
+			if s.laneOf("Ledger.Hold", &Op{Account: k}) == s.laneOf("Ledger.Hold", &Op{Account: prev}) {
+				distinct = false
+			}
+		}
+		if distinct {
+			keys = append(keys, k)
+		}
+	}
+	done := make(chan *client.Call, len(keys))
+	for i, k := range keys {
+		clis[i%len(clis)].Go(context.Background(), "Ledger.Hold", &Op{Account: k}, new(int64), done)
+	}
+	timeout := time.After(5 * time.Second)
+	for range keys {
+		select {
+		case <-ledger.entered:
+		case <-timeout:
+			t.Fatal("requests with different keys did not run concurrently")
+		}
+	}
+	close(ledger.release)
+	for range keys {
+		if call := <-done; call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+}
+
+// TestOrderedQueueFull 执行队列已满时返回 ResourceExhausted
+func TestOrderedQueueFull(t *testing.T) {
+	ledger := newLedger()
+	s, clis := startLedger(t, ledger, WithOrderedLanes(1, 2))
+	defer s.Shutdown(context.Background())
+	cli := clis[0]
+
+	done := make(chan *client.Call, 4)
+	cli.Go(context.Background(), "Ledger.Hold", &Op{Account: "a"}, new(int64), done)
+	<-ledger.entered
+	// 第一个请求正在执行，两个等待，第四个超出队列
+	for _, k := range []string{"a", "b", "c"} {
+		cli.Go(context.Background(), "Ledger.Hold", &Op{Account: k}, new(int64), done)
+	}
+	call := <-done
+	if status.CodeOf(call.Error) != status.ResourceExhausted || call.Args.(*Op).Account != "c" {
+		t.Fatalf("first finished call %+v, err = %v", call.Args, call.Error)
+	}
+	close(ledger.release)
+	for i := 0; i < 3; i++ {
+		if call := <-done; call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package appleseed
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred 通过 SO_PEERCRED 获取 unix socket 对端进程的凭证
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ucred *syscall.Ucred
+		cerr  error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		ucred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+	return &PeerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
@@ -0,0 +1,22 @@
+package appleseed
+
+import "github.com/YOUSEEBIGGIRL/appleseed/codec"
+
+// WithPeerName 握手时随 codec.PeerInfo 发送给客户端的名字，比如服务名或者主机名，客户端通过 client.Client.PeerInfo 获取
+func WithPeerName(name string) ServerOption {
+	return func(s *Server) {
+		s.peerName = name
+	}
+}
+
+// Info 返回客户端的版本和能力（见 codec.PeerInfo），用于排查不同版本之间的兼容问题，拦截器可以据此记录日志或者
+// 拒绝过旧的客户端。客户端没有发送时（旧版本）返回根据握手推断的保守值，Legacy 为 true；gob 协议的客户端返回
+// codec.LegacyPeerInfo。在 handler 和拦截器中调用时握手已经完成
+func (p *Peer) Info() codec.PeerInfo {
+	if pi, ok := p.codec.(codec.PeerInfoer); ok {
+		if info, ok := pi.PeerInfo(); ok {
+			return info
+		}
+	}
+	return codec.LegacyPeerInfo()
+}
@@ -0,0 +1,65 @@
+package appleseed
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+// TestPeerInfo 拦截器可以通过 Peer.Info 得到客户端的 PeerInfo，客户端通过 Client.PeerInfo 得到服务端的
+func TestPeerInfo(t *testing.T) {
+	infos := make(chan codec.PeerInfo, 2)
+	s, err := NewServer(context.Background(), "peer", "127.0.0.1", "0", memory.New(nil), WithPeerName("peer-1"),
+		WithInterceptors(func(ctx context.Context, info *ServerInfo, arg, reply any, handler Handler) error {
+			p, _ := PeerFromContext(ctx)
+			infos <- p.Info()
+			return handler(ctx, arg, reply)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	lis := inproc.Listen("peer")
+	go s.Serve(lis)
+	defer s.Shutdown(context.Background())
+
+	for _, binary := range []bool{true, false} {
+		var opts []client.ClientOption
+		if binary {
+			opts = append(opts, client.WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+				return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"), codec.WithPeerName("checkout"))
+			}))
+		}
+		conn, err := lis.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli := client.NewClient(conn, "peer", opts...)
+		var reply Reply
+		if err := cli.Call(context.Background(), "XXX.Add", &Args{X: 1, Y: 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := cli.PeerInfo()
+		cli.Close()
+		peer := <-infos
+		if !binary {
+			if !ok || !got.Legacy || !peer.Legacy || peer.Protocol != 0 {
+				t.Fatalf("gob: client sees %+v, server sees %+v", got, peer)
+			}
+			continue
+		}
+		if !ok || got.Legacy || got.Name != "peer-1" || got.Features&codec.FeatureChunked == 0 {
+			t.Fatalf("client sees %+v, %v", got, ok)
+		}
+		if peer.Legacy || peer.Name != "checkout" || peer.Version != got.Version {
+			t.Fatalf("server sees %+v", peer)
+		}
+	}
+}
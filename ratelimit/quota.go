@@ -0,0 +1,214 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// QuotaLimit 一个调用方的配额：每秒的请求数，以及同时处理的请求数（<= 0 时不限制）
+type QuotaLimit struct {
+	Rate        Rate
+	MaxInFlight int
+}
+
+// Unlimited 返回 l 是否不做限制
+func (l QuotaLimit) Unlimited() bool {
+	return l.Rate.Unlimited() && l.MaxInFlight <= 0
+}
+
+// QuotaOption 用于配置 Quota
+type QuotaOption func(*Quota)
+
+// WithQuotaKeyFunc 使用 f 返回的身份区分调用方（默认为 PeerIdentity），通常是认证拦截器确定的身份
+func WithQuotaKeyFunc(f KeyFunc) QuotaOption {
+	return func(q *Quota) {
+		q.keyFunc = f
+	}
+}
+
+// WithQuotaStore 在 s 中保存配额的使用情况（默认为 NewMemoryStore(0)），比如多个实例共享配额
+func WithQuotaStore(s Store) QuotaOption {
+	return func(q *Quota) {
+		q.store = s
+	}
+}
+
+// PeerIdentity 默认的 KeyFunc：unix socket 连接为对端进程的 uid（"uid:1000"），其他连接为对端的 IP。
+// 客户端在代理之后或者使用了认证时，应该通过 WithQuotaKeyFunc 返回认证后的身份
+func PeerIdentity(ctx context.Context, info *appleseed.ServerInfo) string {
+	p, ok := appleseed.PeerFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if p.Cred != nil {
+		return "uid:" + strconv.FormatUint(uint64(p.Cred.UID), 10)
+	}
+	if p.Addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// quotaLimits 当前的配额，修改时整体替换
+type quotaLimits struct {
+	def      QuotaLimit
+	identity map[string]QuotaLimit
+}
+
+func (l *quotaLimits) limit(identity string) QuotaLimit {
+	if lim, ok := l.identity[identity]; ok {
+		return lim
+	}
+	return l.def
+}
+
+// QuotaError 请求超过调用方的配额时返回的错误
+type QuotaError struct {
+	Identity   string
+	Limit      string        // 超过的限制，比如 "10 req/s" 或者 "3 in-flight"
+	RetryAfter time.Duration // 超过速率时建议的重试间隔，超过同时处理的请求数时为 0
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: quota of %v exceeded for %q", ResourceExhausted, e.Limit, e.Identity)
+}
+
+// Status 返回给客户端的错误，附加信息中带有调用方和超过的限制
+func (e *QuotaError) Status() *status.Status {
+	details := map[string]string{"identity": e.Identity, "limit": e.Limit}
+	if e.RetryAfter > 0 {
+		details[metadata.RetryAfterKey] = e.RetryAfter.String()
+	}
+	return status.New(status.ResourceExhausted, e.Error()).WithDetails(details)
+}
+
+// Quota 按照调用方的身份限制请求：每个身份可以单独配置配额，没有配置的使用默认配额。身份为空的请求不限制。
+// 配额可以在运行时通过 SetDefault、SetLimit、SetLimits 修改，并发安全。
+//
+// Store 返回错误时放行请求并打印日志，共享配额的存储不可用不应该导致服务不可用
+type Quota struct {
+	mu      sync.Mutex   // 保证修改配额时不会互相覆盖
+	limits  atomic.Value // *quotaLimits
+	keyFunc KeyFunc
+	store   Store
+
+	allowed  uint64
+	rejected uint64
+}
+
+// NewQuota 创建配额拦截器，def 为默认配额，perIdentity 为单独配置的身份的配额
+func NewQuota(def QuotaLimit, perIdentity map[string]QuotaLimit, opts ...QuotaOption) *Quota {
+	q := &Quota{keyFunc: PeerIdentity}
+	q.SetLimits(def, perIdentity)
+	for _, opt := range opts {
+		opt(q)
+	}
+	if q.store == nil {
+		q.store = NewMemoryStore(0)
+	}
+	return q
+}
+
+// SetLimits 替换所有的配额
+func (q *Quota) SetLimits(def QuotaLimit, perIdentity map[string]QuotaLimit) {
+	q.update(func(n *quotaLimits) {
+		n.def = def
+		n.identity = make(map[string]QuotaLimit, len(perIdentity))
+		for id, l := range perIdentity {
+			n.identity[id] = l
+		}
+	})
+}
+
+// SetDefault 修改默认配额
+func (q *Quota) SetDefault(l QuotaLimit) {
+	q.update(func(n *quotaLimits) { n.def = l })
+}
+
+// SetLimit 修改 identity 的配额，l 为零值时删除单独的配置，之后使用默认配额
+func (q *Quota) SetLimit(identity string, l QuotaLimit) {
+	q.update(func(n *quotaLimits) {
+		if l == (QuotaLimit{}) {
+			delete(n.identity, identity)
+		} else {
+			n.identity[identity] = l
+		}
+	})
+}
+
+// update 复制当前的配额，交给 f 修改后替换
+func (q *Quota) update(f func(*quotaLimits)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := &quotaLimits{identity: make(map[string]QuotaLimit)}
+	if old, ok := q.limits.Load().(*quotaLimits); ok {
+		n.def = old.def
+		for id, l := range old.identity {
+			n.identity[id] = l
+		}
+	}
+	f(n)
+	q.limits.Store(n)
+}
+
+// Stats 返回放行和拒绝的请求数
+func (q *Quota) Stats() Stats {
+	return Stats{
+		Allowed:  atomic.LoadUint64(&q.allowed),
+		Rejected: atomic.LoadUint64(&q.rejected),
+	}
+}
+
+// Intercept 实现 appleseed.Interceptor，超过配额的请求不会执行 handler
+func (q *Quota) Intercept(ctx context.Context, info *appleseed.ServerInfo, arg, reply any, handler appleseed.Handler) error {
+	identity := q.keyFunc(ctx, info)
+	var lim QuotaLimit
+	if identity != "" {
+		lim = q.limits.Load().(*quotaLimits).limit(identity)
+	}
+
+	// 先占用同时处理的名额，被速率拒绝时释放，令牌不会被浪费
+	if lim.MaxInFlight > 0 {
+		ok, err := q.store.Acquire(ctx, identity, lim.MaxInFlight)
+		if err != nil {
+			log.Println("rpc: quota store error: ", err)
+		} else if !ok {
+			atomic.AddUint64(&q.rejected, 1)
+			return &QuotaError{Identity: identity, Limit: fmt.Sprintf("%d in-flight", lim.MaxInFlight)}
+		} else {
+			defer q.release(identity)
+		}
+	}
+	if !lim.Rate.Unlimited() {
+		ok, retryAfter, err := q.store.Take(ctx, identity, lim.Rate)
+		if err != nil {
+			log.Println("rpc: quota store error: ", err)
+		} else if !ok {
+			atomic.AddUint64(&q.rejected, 1)
+			appleseed.SetResponseMetadata(ctx, metadata.RetryAfterKey, retryAfter.String())
+			return &QuotaError{Identity: identity, Limit: fmt.Sprintf("%v req/s", lim.Rate.Limit), RetryAfter: retryAfter}
+		}
+	}
+	atomic.AddUint64(&q.allowed, 1)
+	return handler(ctx, arg, reply)
+}
+
+// release 释放同时处理的名额，请求的 ctx 可能已经结束，不能用它访问 Store
+func (q *Quota) release(identity string) {
+	if err := q.store.Release(context.Background(), identity); err != nil {
+		log.Println("rpc: quota store error: ", err)
+	}
+}
@@ -0,0 +1,220 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+const tenantKey = "tenant"
+
+// tenant 认证拦截器确定的身份，测试中由客户端通过 metadata 传递
+func tenant(ctx context.Context, info *appleseed.ServerInfo) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return md.Get(tenantKey)
+}
+
+func newTestQuota(def QuotaLimit, perIdentity map[string]QuotaLimit) (*Quota, *MemoryStore, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStore(time.Minute)
+	store.now = clock.Now
+	store.lastSweep = clock.Now().UnixNano()
+	keyFunc := func(ctx context.Context, info *appleseed.ServerInfo) string {
+		id, _ := ctx.Value(identityKey{}).(string)
+		return id
+	}
+	return NewQuota(def, perIdentity, WithQuotaKeyFunc(keyFunc), WithQuotaStore(store)), store, clock
+}
+
+// interceptN 返回 identity 的 n 个请求中被放行的数量
+func interceptN(q *Quota, identity string, n int) int {
+	ctx := context.WithValue(context.Background(), identityKey{}, identity)
+	allowed := 0
+	for i := 0; i < n; i++ {
+		err := q.Intercept(ctx, info("A.B"), nil, nil, func(ctx context.Context, arg, reply any) error { return nil })
+		if err == nil {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestQuotaSetLimit(t *testing.T) {
+	q, _, clock := newTestQuota(QuotaLimit{Rate: Rate{Limit: 1, Burst: 2}}, nil)
+	if got := interceptN(q, "alice", 10); got != 2 {
+		t.Fatalf("alice allowed %d, want 2", got)
+	}
+	// 没有身份的请求不限制
+	if got := interceptN(q, "", 10); got != 10 {
+		t.Fatalf("anonymous allowed %d, want 10", got)
+	}
+
+	// 调高速率后按照新的速率补充令牌
+	q.SetLimit("alice", QuotaLimit{Rate: Rate{Limit: 100, Burst: 1}})
+	if got := interceptN(q, "alice", 10); got != 0 {
+		t.Fatalf("after SetLimit allowed %d, want 0", got)
+	}
+	clock.Advance(10 * time.Millisecond)
+	if got := interceptN(q, "alice", 10); got != 1 {
+		t.Fatalf("after SetLimit allowed %d, want 1", got)
+	}
+	q.SetDefault(QuotaLimit{})
+	if got := interceptN(q, "bob", 10); got != 10 {
+		t.Fatalf("unlimited default allowed %d, want 10", got)
+	}
+	// 删除单独的配置后使用默认配额
+	q.SetLimit("alice", QuotaLimit{})
+	if got := interceptN(q, "alice", 10); got != 10 {
+		t.Fatalf("after removing alice allowed %d, want 10", got)
+	}
+	q.SetLimits(QuotaLimit{Rate: Rate{Limit: 1, Burst: 1}}, map[string]QuotaLimit{"bob": {Rate: Rate{Limit: 1, Burst: 3}}})
+	clock.Advance(time.Hour)
+	if a, b := interceptN(q, "alice", 10), interceptN(q, "bob", 10); a != 1 || b != 3 {
+		t.Fatalf("after SetLimits alice %d bob %d, want 1 and 3", a, b)
+	}
+	if s := q.Stats(); s.Allowed != 37 || s.Rejected != 43 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestQuotaEvictIdle(t *testing.T) {
+	q, store, clock := newTestQuota(QuotaLimit{Rate: Rate{Limit: 1, Burst: 1}, MaxInFlight: 1}, nil)
+	for _, id := range []string{"a", "b", "c"} {
+		interceptN(q, id, 1)
+	}
+	if n := store.Len(); n != 3 {
+		t.Fatalf("%d entries, want 3", n)
+	}
+
+	// c 还有正在处理的请求，不会被删除
+	ctx := context.WithValue(context.Background(), identityKey{}, "c")
+	clock.Advance(time.Minute)
+	q.Intercept(ctx, info("A.B"), nil, nil, func(ctx context.Context, arg, reply any) error {
+		clock.Advance(time.Minute)
+		interceptN(q, "a", 1)
+		if n := store.Len(); n != 2 {
+			t.Errorf("%d entries while c is in flight, want 2", n)
+		}
+		return nil
+	})
+	clock.Advance(time.Minute)
+	interceptN(q, "d", 1)
+	if n := store.Len(); n != 1 {
+		t.Fatalf("%d entries after idle, want 1", n)
+	}
+}
+
+type Slow struct {
+	release chan struct{}
+}
+
+func (s *Slow) Wait(arg *int, reply *int) error {
+	<-s.release
+	*reply = *arg
+	return nil
+}
+
+// TestQuotaIdentities 两个配额不同的身份同时调用同一个服务端，互不影响
+func TestQuotaIdentities(t *testing.T) {
+	q := NewQuota(QuotaLimit{Rate: Rate{Limit: 0.001, Burst: 5}}, map[string]QuotaLimit{
+		"bob":   {Rate: Rate{Limit: 0.001, Burst: 20}},
+		"carol": {MaxInFlight: 2},
+	}, WithQuotaKeyFunc(tenant))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(context.Background(), "quota", "127.0.0.1", port, memory.New(nil),
+		appleseed.WithInterceptors(q.Intercept))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, slow := new(Echo), &Slow{release: make(chan struct{})}
+	s.Register(echo)
+	s.Register(slow)
+	go s.Serve(lis)
+	defer s.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := client.NewClient(conn, lis.Addr().String())
+	defer cli.Close()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		allowed  = make(map[string]int)
+		rejected = make(map[string]*status.Status)
+	)
+	for _, id := range []string{"alice", "bob"} {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				ctx := metadata.AppendToOutgoingContext(context.Background(), tenantKey, id)
+				for j := 0; j < 10; j++ {
+					arg, reply := 1, 0
+					err := cli.Call(ctx, "Echo.Echo", &arg, &reply)
+					mu.Lock()
+					if err == nil {
+						allowed[id]++
+					} else if st, _ := status.FromError(err); st.Code() == status.ResourceExhausted {
+						rejected[id] = st
+					} else {
+						t.Errorf("%s: %v", id, err)
+					}
+					mu.Unlock()
+				}
+			}(id)
+		}
+	}
+	wg.Wait()
+	if allowed["alice"] != 5 || allowed["bob"] != 20 {
+		t.Fatalf("allowed = %v, want alice 5 bob 20", allowed)
+	}
+	if d := rejected["alice"].Details(); d["identity"] != "alice" || d["limit"] != "0.001 req/s" || d[metadata.RetryAfterKey] == "" {
+		t.Fatalf("alice details = %v", d)
+	}
+	if !IsResourceExhausted(rejected["bob"]) {
+		t.Fatalf("bob err = %v", rejected["bob"])
+	}
+
+	// carol 最多同时处理 2 个请求，其他身份不受影响
+	carol := metadata.AppendToOutgoingContext(context.Background(), tenantKey, "carol")
+	done := make(chan *client.Call, 2)
+	for i := 0; i < 2; i++ {
+		arg := i
+		cli.Go(carol, "Slow.Wait", &arg, new(int), done)
+	}
+	for atomic.LoadUint64(&q.allowed) != 27 {
+		time.Sleep(time.Millisecond)
+	}
+	arg, reply := 1, 0
+	err = cli.Call(carol, "Echo.Echo", &arg, &reply)
+	if st, _ := status.FromError(err); st.Code() != status.ResourceExhausted || st.Details()["limit"] != "2 in-flight" || st.Details()["identity"] != "carol" {
+		t.Fatalf("carol err = %v, details %v", err, st.Details())
+	}
+	if err := cli.Call(context.Background(), "Echo.Echo", &arg, &reply); err != nil {
+		t.Fatalf("anonymous err = %v", err)
+	}
+	close(slow.release)
+	for i := 0; i < 2; i++ {
+		if call := <-done; call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+	if err := cli.Call(carol, "Echo.Echo", &arg, &reply); err != nil {
+		t.Fatalf("carol after release err = %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+// Package ratelimit 服务端限流拦截器，使用令牌桶分别限制所有请求、每个方法以及每个调用方（比如认证后的身份）
+// 的速率，超过限制的请求会被立即拒绝而不是排队等待，并在响应 metadata 中带上建议的重试间隔：
+//
+//	l := ratelimit.New(ratelimit.Rate{Limit: 1000, Burst: 100}, map[string]ratelimit.Rate{
+//		"Order.Create": {Limit: 50, Burst: 10},
+//	})
+//	appleseed.NewServer(ctx, name, host, port, reg, appleseed.WithInterceptors(l.Intercept))
+//
+// 多租户的服务可以使用 Quota 为每个调用方单独配置速率和同时处理的请求数：
+//
+//	q := ratelimit.NewQuota(ratelimit.QuotaLimit{Rate: ratelimit.Rate{Limit: 100, Burst: 20}}, map[string]ratelimit.QuotaLimit{
+//		"tenant-a": {Rate: ratelimit.Rate{Limit: 1000, Burst: 100}, MaxInFlight: 50},
+//	}, ratelimit.WithQuotaKeyFunc(identity))
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// ResourceExhausted 请求因为超过限制被拒绝时，返回给客户端的错误信息的前缀，错误码为 status.ResourceExhausted
+const ResourceExhausted = "rpc: resource exhausted"
+
+// sweepInterval 清理空闲的调用方令牌桶的间隔
+const sweepInterval = time.Minute
+
+// Rate 令牌桶每秒放入 Limit 个令牌，最多保存 Burst 个（即允许的突发请求数，小于 1 时按 1 处理）。
+// Limit 小于等于 0 时不限制
+type Rate struct {
+	Limit float64
+	Burst int
+}
+
+// Unlimited 返回 r 是否不做限制
+func (r Rate) Unlimited() bool {
+	return r.Limit <= 0
+}
+
+// params 返回放入一个令牌的间隔，以及桶满时可以提前消耗的时间，单位为纳秒
+func (r Rate) params() (interval, tolerance int64) {
+	interval = int64(float64(time.Second) / r.Limit)
+	if interval < 1 {
+		interval = 1
+	}
+	burst := int64(r.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return interval, interval * burst
+}
+
+// bucket 令牌桶，使用 GCRA 实现：只保存下一个令牌理论上的放入时间 tat，所以可以通过 CAS 无锁地更新，
+// 不会在并发很高时成为瓶颈。tat 不晚于当前时间时桶是满的
+type bucket struct {
+	tat int64 // 原子操作，UnixNano
+}
+
+// take 取出一个令牌，令牌不足时返回需要等待的时间
+func (b *bucket) take(now int64, r Rate) (ok bool, retryAfter time.Duration) {
+	interval, tolerance := r.params()
+	for {
+		tat := atomic.LoadInt64(&b.tat)
+		if tat > now+tolerance {
+			// 速率调高后，按照之前的速率欠下的令牌不需要再补上，从现在开始按照新的速率补充
+			atomic.CompareAndSwapInt64(&b.tat, tat, now+tolerance)
+			continue
+		}
+		next := tat
+		if next < now {
+			next = now
+		}
+		next += interval
+		if wait := next - now - tolerance; wait > 0 {
+			return false, time.Duration(wait)
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, tat, next) {
+			return true, 0
+		}
+	}
+}
+
+// refund 放回一个 take 取出的令牌
+func (b *bucket) refund(r Rate) {
+	interval, _ := r.params()
+	atomic.AddInt64(&b.tat, -interval)
+}
+
+// idle 返回桶是否是满的，满的桶和新建的桶没有区别，可以删除
+func (b *bucket) idle(now int64) bool {
+	return atomic.LoadInt64(&b.tat) <= now
+}
+
+// KeyFunc 返回请求所属的调用方，比如认证后的身份，返回空字符串时不做调用方的限制
+type KeyFunc func(ctx context.Context, info *appleseed.ServerInfo) string
+
+// Option 用于配置 Limiter
+type Option func(*Limiter)
+
+// WithKeyFunc 按照 f 返回的调用方分别限制速率，每个调用方的速率为 rate
+func WithKeyFunc(f KeyFunc, rate Rate) Option {
+	return func(l *Limiter) {
+		l.keyFunc = f
+		l.limits.Load().(*limits).key = rate
+	}
+}
+
+// limits 当前的限制，修改时整体替换
+type limits struct {
+	global  Rate
+	methods map[string]Rate // key: "Service.Method"
+	key     Rate
+}
+
+// Stats 限流的统计
+type Stats struct {
+	Allowed  uint64
+	Rejected uint64
+}
+
+// LimitError 请求被限流时返回的错误
+type LimitError struct {
+	Scope      string        // 超过的限制："global"、方法名，或者 "key " 加上调用方
+	RetryAfter time.Duration // 建议的重试间隔，也会通过响应 metadata 中的 metadata.RetryAfterKey 返回给客户端
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: rate limit of %v exceeded, retry after %v", ResourceExhausted, e.Scope, e.RetryAfter)
+}
+
+// Status 返回给客户端的错误，附加信息中带有超过的限制和建议的重试间隔
+func (e *LimitError) Status() *status.Status {
+	return status.New(status.ResourceExhausted, e.Error()).WithDetails(map[string]string{
+		"scope":                e.Scope,
+		metadata.RetryAfterKey: e.RetryAfter.String(),
+	})
+}
+
+// Limiter 限流器，依次检查调用方、方法以及全局的限制，任意一个超过限制时拒绝请求，并放回之前取出的令牌。
+// 限制可以在运行时通过 SetGlobal、SetMethod、SetKeyRate 修改，并发安全
+type Limiter struct {
+	mu     sync.Mutex   // 保证修改限制时不会互相覆盖
+	limits atomic.Value // *limits
+
+	global  bucket
+	methods sync.Map // key: "Service.Method" val: *bucket
+	keys    sync.Map // key: 调用方 val: *bucket
+
+	keyFunc   KeyFunc
+	lastSweep int64 // 原子操作，上次清理空闲调用方的时间
+	now       func() time.Time
+
+	allowed  uint64
+	rejected uint64
+}
+
+// New 创建限流器，global 为所有请求的速率，perMethod 为每个方法（"Service.Method"）的速率，
+// 零值的 Rate 表示不限制
+func New(global Rate, perMethod map[string]Rate, opts ...Option) *Limiter {
+	l := &Limiter{now: time.Now}
+	methods := make(map[string]Rate, len(perMethod))
+	for m, r := range perMethod {
+		methods[m] = r
+	}
+	l.limits.Store(&limits{global: global, methods: methods})
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.lastSweep = l.now().UnixNano()
+	return l
+}
+
+// update 复制当前的限制，交给 f 修改后替换
+func (l *Limiter) update(f func(*limits)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.limits.Load().(*limits)
+	n := &limits{global: old.global, key: old.key, methods: make(map[string]Rate, len(old.methods))}
+	for m, r := range old.methods {
+		n.methods[m] = r
+	}
+	f(n)
+	l.limits.Store(n)
+}
+
+// SetGlobal 修改所有请求的速率
+func (l *Limiter) SetGlobal(r Rate) {
+	l.update(func(n *limits) { n.global = r })
+}
+
+// SetMethod 修改 method 的速率，r 为零值时取消对该方法的限制
+func (l *Limiter) SetMethod(method string, r Rate) {
+	l.update(func(n *limits) {
+		if r.Unlimited() {
+			delete(n.methods, method)
+		} else {
+			n.methods[method] = r
+		}
+	})
+}
+
+// SetKeyRate 修改每个调用方的速率，只有通过 WithKeyFunc 指定了 KeyFunc 时才有效
+func (l *Limiter) SetKeyRate(r Rate) {
+	l.update(func(n *limits) { n.key = r })
+}
+
+// Stats 返回放行和拒绝的请求数
+func (l *Limiter) Stats() Stats {
+	return Stats{
+		Allowed:  atomic.LoadUint64(&l.allowed),
+		Rejected: atomic.LoadUint64(&l.rejected),
+	}
+}
+
+// Intercept 实现 appleseed.Interceptor，被限流的请求不会执行 handler
+func (l *Limiter) Intercept(ctx context.Context, info *appleseed.ServerInfo, arg, reply any, handler appleseed.Handler) error {
+	if err := l.Allow(ctx, info); err != nil {
+		appleseed.SetResponseMetadata(ctx, metadata.RetryAfterKey, err.RetryAfter.String())
+		return err
+	}
+	return handler(ctx, arg, reply)
+}
+
+// Allow 为请求取出令牌，超过任意一个限制时返回 *LimitError
+func (l *Limiter) Allow(ctx context.Context, info *appleseed.ServerInfo) *LimitError {
+	lim := l.limits.Load().(*limits)
+	now := l.now().UnixNano()
+
+	type taken struct {
+		b *bucket
+		r Rate
+	}
+	var (
+		checks [3]taken
+		n      int
+		scopes [3]string
+	)
+	if l.keyFunc != nil && !lim.key.Unlimited() {
+		if key := l.keyFunc(ctx, info); key != "" {
+			l.sweep(now)
+			checks[n], scopes[n] = taken{l.bucket(&l.keys, key), lim.key}, "key "+key
+			n++
+		}
+	}
+	if r, ok := lim.methods[info.ServiceMethod]; ok && !r.Unlimited() {
+		checks[n], scopes[n] = taken{l.bucket(&l.methods, info.ServiceMethod), r}, info.ServiceMethod
+		n++
+	}
+	if !lim.global.Unlimited() {
+		checks[n], scopes[n] = taken{&l.global, lim.global}, "global"
+		n++
+	}
+
+	for i := 0; i < n; i++ {
+		if ok, retryAfter := checks[i].b.take(now, checks[i].r); !ok {
+			for j := 0; j < i; j++ {
+				checks[j].b.refund(checks[j].r)
+			}
+			atomic.AddUint64(&l.rejected, 1)
+			return &LimitError{Scope: scopes[i], RetryAfter: retryAfter}
+		}
+	}
+	atomic.AddUint64(&l.allowed, 1)
+	return nil
+}
+
+// bucket 返回 m 中 key 对应的令牌桶，不存在时创建一个满的桶
+func (l *Limiter) bucket(m *sync.Map, key string) *bucket {
+	if b, ok := m.Load(key); ok {
+		return b.(*bucket)
+	}
+	b, _ := m.LoadOrStore(key, &bucket{})
+	return b.(*bucket)
+}
+
+// sweep 每隔 sweepInterval 删除已经满了的调用方令牌桶，避免调用方很多时内存无限增长。
+// 删除时如果恰好有请求正在使用这个桶，它取出的令牌不会被记录，最多多放行一个请求
+func (l *Limiter) sweep(now int64) {
+	last := atomic.LoadInt64(&l.lastSweep)
+	if now-last < int64(sweepInterval) || !atomic.CompareAndSwapInt64(&l.lastSweep, last, now) {
+		return
+	}
+	l.keys.Range(func(key, b any) bool {
+		if b.(*bucket).idle(now) {
+			l.keys.Delete(key)
+		}
+		return true
+	})
+}
+
+// IsResourceExhausted 返回 err 是否是因为超过限制被拒绝，err 可以是服务端的 *LimitError，
+// 也可以是客户端收到的错误。旧版本的服务端返回的错误没有错误码，此时根据错误信息的前缀判断
+func IsResourceExhausted(err error) bool {
+	var le *LimitError
+	return errors.As(err, &le) || status.CodeOf(err) == status.ResourceExhausted ||
+		(err != nil && strings.HasPrefix(err.Error(), ResourceExhausted))
+}
+
+// RetryAfter 返回响应 metadata 中服务端建议的重试间隔，客户端通过 client.WithResponseMetadata 获取响应 metadata
+func RetryAfter(md metadata.MD) (time.Duration, bool) {
+	d, err := time.ParseDuration(md.Get(metadata.RetryAfterKey))
+	return d, err == nil
+}
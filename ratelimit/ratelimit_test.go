@@ -0,0 +1,280 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed"
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// fakeClock 手动推进的时钟
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(global Rate, perMethod map[string]Rate, opts ...Option) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := New(global, perMethod, opts...)
+	l.now = clock.Now
+	l.lastSweep = clock.Now().UnixNano()
+	return l, clock
+}
+
+func info(method string) *appleseed.ServerInfo {
+	return &appleseed.ServerInfo{ServiceMethod: method}
+}
+
+// allowN 返回 n 个请求中被放行的数量
+func allowN(l *Limiter, method string, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if l.Allow(context.Background(), info(method)) == nil {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestTokenBucket(t *testing.T) {
+	l, clock := newTestLimiter(Rate{Limit: 10, Burst: 5}, nil)
+	if got := allowN(l, "A.B", 10); got != 5 {
+		t.Fatalf("burst allowed %d, want 5", got)
+	}
+	err := l.Allow(context.Background(), info("A.B"))
+	if err == nil || err.Scope != "global" || err.RetryAfter != 100*time.Millisecond {
+		t.Fatalf("err = %v", err)
+	}
+	clock.Advance(250 * time.Millisecond)
+	if got := allowN(l, "A.B", 10); got != 2 {
+		t.Fatalf("after 250ms allowed %d, want 2", got)
+	}
+	// 长时间空闲后最多只能积累 Burst 个令牌
+	clock.Advance(time.Hour)
+	if got := allowN(l, "A.B", 10); got != 5 {
+		t.Fatalf("after idle allowed %d, want 5", got)
+	}
+	if s := l.Stats(); s.Allowed != 12 || s.Rejected != 19 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestPerMethod(t *testing.T) {
+	l, _ := newTestLimiter(Rate{Limit: 10, Burst: 10}, map[string]Rate{"A.Slow": {Limit: 1, Burst: 2}})
+	if got := allowN(l, "A.Slow", 5); got != 2 {
+		t.Fatalf("A.Slow allowed %d, want 2", got)
+	}
+	// 被方法的限制拒绝的请求不会消耗全局的令牌
+	if got := allowN(l, "A.Fast", 20); got != 8 {
+		t.Fatalf("A.Fast allowed %d, want 8", got)
+	}
+	if err := l.Allow(context.Background(), info("A.Slow")); err == nil || err.Scope != "A.Slow" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestSetRuntime(t *testing.T) {
+	l, clock := newTestLimiter(Rate{}, nil)
+	if got := allowN(l, "A.B", 100); got != 100 {
+		t.Fatalf("unlimited allowed %d", got)
+	}
+	l.SetMethod("A.B", Rate{Limit: 1, Burst: 1})
+	if got := allowN(l, "A.B", 10); got != 1 {
+		t.Fatalf("after SetMethod allowed %d, want 1", got)
+	}
+	// 调高速率后按照新的速率补充令牌
+	l.SetMethod("A.B", Rate{Limit: 100, Burst: 1})
+	if err := l.Allow(context.Background(), info("A.B")); err == nil || err.RetryAfter != 10*time.Millisecond {
+		t.Fatalf("err = %v", err)
+	}
+	clock.Advance(10 * time.Millisecond)
+	if got := allowN(l, "A.B", 10); got != 1 {
+		t.Fatalf("after raising limit allowed %d, want 1", got)
+	}
+	l.SetMethod("A.B", Rate{})
+	l.SetGlobal(Rate{Limit: 1, Burst: 3})
+	if got := allowN(l, "A.B", 10); got != 3 {
+		t.Fatalf("after SetGlobal allowed %d, want 3", got)
+	}
+}
+
+type identityKey struct{}
+
+func TestKeyFunc(t *testing.T) {
+	keyFunc := func(ctx context.Context, info *appleseed.ServerInfo) string {
+		id, _ := ctx.Value(identityKey{}).(string)
+		return id
+	}
+	l, clock := newTestLimiter(Rate{}, nil, WithKeyFunc(keyFunc, Rate{Limit: 1, Burst: 2}))
+	alice := context.WithValue(context.Background(), identityKey{}, "alice")
+	bob := context.WithValue(context.Background(), identityKey{}, "bob")
+	for _, c := range []struct {
+		ctx  context.Context
+		want int
+	}{{alice, 2}, {bob, 2}, {context.Background(), 10}} {
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if l.Allow(c.ctx, info("A.B")) == nil {
+				allowed++
+			}
+		}
+		if allowed != c.want {
+			t.Fatalf("%v allowed %d, want %d", c.ctx.Value(identityKey{}), allowed, c.want)
+		}
+	}
+	if err := l.Allow(alice, info("A.B")); err == nil || err.Scope != "key alice" {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 空闲的调用方在清理后被删除
+	clock.Advance(sweepInterval)
+	l.SetKeyRate(Rate{Limit: 1, Burst: 1})
+	if l.Allow(bob, info("A.B")) != nil {
+		t.Fatal("bob should be allowed after refill")
+	}
+	var keys []any
+	l.keys.Range(func(k, _ any) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if len(keys) != 1 || keys[0] != "bob" {
+		t.Fatalf("keys after sweep = %v", keys)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	l, _ := newTestLimiter(Rate{Limit: 1, Burst: 100}, map[string]Rate{"A.B": {Limit: 1, Burst: 150}})
+	var (
+		wg      sync.WaitGroup
+		allowed int64
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if l.Allow(context.Background(), info("A.B")) == nil {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 100 {
+		t.Fatalf("allowed %d, want 100", allowed)
+	}
+	// 被全局限制拒绝的请求放回了方法的令牌
+	l.SetGlobal(Rate{})
+	if got := allowN(l, "A.B", 100); got != 50 {
+		t.Fatalf("method tokens left %d, want 50", got)
+	}
+}
+
+type Echo struct {
+	calls int64
+}
+
+func (e *Echo) Echo(arg *int, reply *int) error {
+	atomic.AddInt64(&e.calls, 1)
+	*reply = *arg
+	return nil
+}
+
+func TestInterceptor(t *testing.T) {
+	l := New(Rate{Limit: 1, Burst: 2}, nil)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := appleseed.NewServer(context.Background(), "ratelimit", "127.0.0.1", port, memory.New(nil),
+		appleseed.WithInterceptors(l.Intercept))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := new(Echo)
+	if err := s.Register(echo); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := client.NewClient(conn, lis.Addr().String())
+	defer cli.Close()
+
+	arg, reply := 1, 0
+	for i := 0; i < 2; i++ {
+		if err := cli.Call(context.Background(), "Echo.Echo", &arg, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var md metadata.MD
+	err = cli.Call(client.WithResponseMetadata(context.Background(), &md), "Echo.Echo", &arg, &reply)
+	st, _ := status.FromError(err)
+	if !IsResourceExhausted(err) || st.Code() != status.ResourceExhausted || st.Details()["scope"] != "global" {
+		t.Fatalf("err = %v, details = %v", err, st.Details())
+	}
+	retryAfter, ok := RetryAfter(md)
+	if !ok || retryAfter <= 0 || retryAfter > time.Second {
+		t.Fatalf("retry after = %v, %v (md %v)", retryAfter, ok, md)
+	}
+	if n := atomic.LoadInt64(&echo.calls); n != 2 {
+		t.Fatalf("handler called %d times, want 2", n)
+	}
+	time.Sleep(retryAfter)
+	md = nil
+	if err := cli.Call(client.WithResponseMetadata(context.Background(), &md), "Echo.Echo", &arg, &reply); err != nil {
+		t.Fatalf("after retry-after: %v", err)
+	}
+	if len(md) != 0 {
+		t.Fatalf("md = %v", md)
+	}
+}
+
+func BenchmarkAllow(b *testing.B) {
+	keyFunc := func(ctx context.Context, info *appleseed.ServerInfo) string { return info.RequestID }
+	for _, c := range []struct {
+		name string
+		l    *Limiter
+	}{
+		{"unlimited", New(Rate{}, nil)},
+		{"global", New(Rate{Limit: 1e12, Burst: 1000}, nil)},
+		{"method", New(Rate{}, map[string]Rate{"A.B": {Limit: 1e12, Burst: 1000}})},
+		{"global+method+key", New(Rate{Limit: 1e12, Burst: 1000}, map[string]Rate{"A.B": {Limit: 1e12, Burst: 1000}},
+			WithKeyFunc(keyFunc, Rate{Limit: 1e12, Burst: 1000}))},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			var id int64
+			b.RunParallel(func(pb *testing.PB) {
+				info := &appleseed.ServerInfo{ServiceMethod: "A.B", RequestID: strconv.FormatInt(atomic.AddInt64(&id, 1), 10)}
+				for pb.Next() {
+					c.l.Allow(context.Background(), info)
+				}
+			})
+		})
+	}
+}
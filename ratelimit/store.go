@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store 保存每个调用方的配额使用情况，见 Quota。MemoryStore 只在本实例内生效，多个实例需要共享配额时
+// 可以基于 redis 等实现 Store。方法会被并发调用
+type Store interface {
+	// Take 按照 rate 为 key 取出一个令牌，令牌不足时返回 false 和建议的重试间隔
+	Take(ctx context.Context, key string, rate Rate) (ok bool, retryAfter time.Duration, err error)
+	// Acquire key 正在处理的请求少于 max 时占用一个名额并返回 true
+	Acquire(ctx context.Context, key string, max int) (bool, error)
+	// Release 释放 Acquire 占用的名额
+	Release(ctx context.Context, key string) error
+}
+
+var _ Store = &MemoryStore{}
+
+// quotaEntry 一个调用方的令牌桶和正在处理的请求数
+type quotaEntry struct {
+	bucket   bucket
+	inflight int
+	lastUsed int64 // UnixNano
+}
+
+// MemoryStore 在内存中保存配额的 Store，空闲超过 idle 的调用方会被删除，避免调用方很多时内存无限增长
+type MemoryStore struct {
+	idle time.Duration
+	now  func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*quotaEntry
+	lastSweep int64
+}
+
+// NewMemoryStore 创建 MemoryStore，idle <= 0 时使用 sweepInterval
+func NewMemoryStore(idle time.Duration) *MemoryStore {
+	if idle <= 0 {
+		idle = sweepInterval
+	}
+	s := &MemoryStore{idle: idle, now: time.Now, entries: make(map[string]*quotaEntry)}
+	s.lastSweep = s.now().UnixNano()
+	return s
+}
+
+// entry 返回 key 的 quotaEntry，不存在时创建，同时清理空闲的调用方。调用方持有 mu
+func (s *MemoryStore) entry(key string, now int64) *quotaEntry {
+	if now-s.lastSweep >= int64(s.idle) {
+		s.lastSweep = now
+		for k, e := range s.entries {
+			// 令牌桶已经满了并且没有正在处理的请求时，和新建的没有区别
+			if e.inflight == 0 && e.bucket.idle(now) && now-e.lastUsed >= int64(s.idle) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	e, ok := s.entries[key]
+	if !ok {
+		e = &quotaEntry{}
+		s.entries[key] = e
+	}
+	e.lastUsed = now
+	return e
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, rate Rate) (bool, time.Duration, error) {
+	now := s.now().UnixNano()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok, retryAfter := s.entry(key, now).bucket.take(now, rate)
+	return ok, retryAfter, nil
+}
+
+func (s *MemoryStore) Acquire(ctx context.Context, key string, max int) (bool, error) {
+	now := s.now().UnixNano()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key, now)
+	if e.inflight >= max {
+		return false, nil
+	}
+	e.inflight++
+	return true, nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && e.inflight > 0 {
+		e.inflight--
+	}
+	return nil
+}
+
+// Len 返回当前保存的调用方数量
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
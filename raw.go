@@ -0,0 +1,29 @@
+package appleseed
+
+import (
+	"context"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// RawHandler 处理没有注册的服务的请求：req 为没有解码的请求 body，handler 将编码后的响应写入 reply，
+// 编码方式必须和 req.Codec 相同
+type RawHandler func(ctx context.Context, serviceMethod string, req, reply *codec.RawMessage) error
+
+// WithUnknownServiceHandler 请求的服务没有注册时交给 h 处理，而不是返回错误，比如转发给其他实例（见 gateway 包）。
+// 拦截器和统计回调同样生效，arg 和 reply 为 *codec.RawMessage。
+//
+// 只有使用二进制协议和无状态的 body 编码（json、proto 等）的连接支持，其他连接上这样的请求会返回
+// codec.ErrRawUnsupported
+func WithUnknownServiceHandler(h RawHandler) ServerOption {
+	return func(s *Server) {
+		s.unknownService = h
+	}
+}
+
+// rawHandler 将 unknownService 包装为 Handler
+func (s *Server) rawHandler(serviceMethod string) Handler {
+	return func(ctx context.Context, arg, reply any) error {
+		return s.unknownService(ctx, serviceMethod, arg.(*codec.RawMessage), reply.(*codec.RawMessage))
+	}
+}
@@ -0,0 +1,96 @@
+package appleseed
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+func TestUnknownServiceHandler(t *testing.T) {
+	ctx := context.Background()
+	canceled := make(chan struct{})
+	raw := func(ctx context.Context, serviceMethod string, req, reply *codec.RawMessage) error {
+		if serviceMethod == "Remote.Wait" {
+			<-ctx.Done()
+			close(canceled)
+			return ctx.Err()
+		}
+		var args Args
+		if err := json.Unmarshal(req.Data, &args); err != nil {
+			return err
+		}
+		data, _ := json.Marshal(Reply{Add: args.X + args.Y})
+		*reply = codec.RawMessage{Codec: req.Codec, Data: data}
+		return nil
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(ctx, "raw", "127.0.0.1", "0", memory.New(nil), WithUnknownServiceHandler(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(ctx)
+
+	jsonCodec := client.WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+		return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"))
+	})
+	cli, err := client.Dial(ctx, "tcp", lis.Addr().String(), jsonCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	// 注册了的服务不受影响
+	var reply Reply
+	for _, method := range []string{"XXX.Add", "Remote.Add"} {
+		reply = Reply{}
+		if err := cli.Call(ctx, method, &Args{X: 1, Y: 2}, &reply); err != nil || reply.Add != 3 {
+			t.Fatalf("%v: reply = %+v, err = %v", method, reply, err)
+		}
+	}
+	// 客户端同样可以收发 RawMessage
+	var rawReply codec.RawMessage
+	if err := cli.Call(ctx, "Remote.Add", codec.RawMessage{Codec: "json", Data: []byte(`{"X":2,"Y":3}`)}, &rawReply); err != nil ||
+		rawReply.Codec != "json" || !strings.Contains(string(rawReply.Data), `"Add":5`) {
+		t.Fatalf("reply = %+v %s, err = %v", rawReply, rawReply.Data, err)
+	}
+	if err := cli.Call(ctx, "Remote.Add", codec.RawMessage{Codec: "proto"}, &rawReply); err == nil {
+		t.Fatal("raw body with a different codec should fail")
+	}
+
+	// gob 不支持 RawMessage
+	gob, err := client.Dial(ctx, "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gob.Close()
+	if err := gob.Call(ctx, "Remote.Add", &Args{X: 1, Y: 2}, &reply); err == nil || !strings.Contains(err.Error(), codec.ErrRawUnsupported.Error()) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := gob.Call(ctx, "XXX.Add", &Args{X: 1, Y: 2}, &reply); err != nil || reply.Add != 3 {
+		t.Fatalf("reply = %+v, err = %v", reply, err)
+	}
+
+	// 连接断开后正在处理的请求的 ctx 被取消
+	go cli.Call(ctx, "Remote.Wait", &Args{}, &reply)
+	time.Sleep(50 * time.Millisecond)
+	cli.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("handler ctx was not canceled after the client disconnected")
+	}
+}
@@ -0,0 +1,289 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/fsnotify/fsnotify"
+)
+
+var _ registry.Client = &Registry{}
+var _ registry.Watcher = &Registry{}
+
+const defaultPollInterval = time.Second
+
+// fileFormat 文件的格式（json），实例的字段与 registry.Instance 一致，例如：
+//
+//	{
+//	  "namespace": "prod",
+//	  "services": {
+//	    "order": [
+//	      {"addr": "10.0.0.1:8080", "weight": 4, "metadata": {"zone": "a"}},
+//	      {"addr": "10.0.0.2:8080", "status": "DRAINING"}
+//	    ]
+//	  }
+//	}
+//
+// namespace 可以省略，如果指定了，则必须与 registry.WithNamespace 指定的命名空间一致，
+// 避免把其他环境的文件错误地用在当前环境中
+type fileFormat struct {
+	Namespace string                         `json:"namespace"`
+	Services  map[string][]registry.Instance `json:"services"`
+}
+
+// Registry 基于本地文件的注册中心，适用于无法访问任何注册中心的边缘节点。启动时加载文件，
+// 之后通过 fsnotify 监听文件的变化（不可用时退化为定时检查修改时间）并重新加载，
+// 格式错误的文件不会覆盖当前的数据
+type Registry struct {
+	path         string
+	pollInterval time.Duration
+	opts         registry.Options
+
+	mu       sync.RWMutex
+	services map[string][]registry.Instance
+	watchers map[chan struct{}]struct{}
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New 加载 path 指定的文件并开始监听文件的变化，初次加载失败时返回错误，
+// pollInterval 为 fsnotify 不可用时检查文件修改时间的间隔，为 0 时使用默认值
+func New(path string, pollInterval time.Duration, opts ...registry.Option) (*Registry, error) {
+	return newRegistry(path, pollInterval, false, opts...)
+}
+
+func newRegistry(path string, pollInterval time.Duration, forcePoll bool, opts ...registry.Option) (*Registry, error) {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	r := &Registry{
+		path:         path,
+		pollInterval: pollInterval,
+		opts:         registry.NewOptions(opts...),
+		watchers:     make(map[chan struct{}]struct{}),
+		done:         make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	var w *fsnotify.Watcher
+	if !forcePoll {
+		var err error
+		if w, err = r.newWatcher(); err != nil {
+			log.Printf("registry/file: fsnotify unavailable: %v, fallback to polling\n", err)
+		}
+	}
+	if w != nil {
+		go r.watchNotify(ctx, w)
+	} else {
+		go r.watchPoll(ctx)
+	}
+	return r, nil
+}
+
+// newWatcher 监听文件所在的目录而不是文件本身，因为很多编辑器和部署工具是通过
+// 写临时文件再 rename 的方式来修改文件的，直接监听文件会在第一次修改后失效
+func (r *Registry) newWatcher() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(filepath.Dir(r.path)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (r *Registry) watchNotify(ctx context.Context, w *fsnotify.Watcher) {
+	defer close(r.done)
+	defer w.Close()
+	name := filepath.Clean(r.path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			// rename 覆盖目标文件时，目标文件上产生的是 Create 事件；文件被删除时保留当前的数据
+			if filepath.Clean(ev.Name) != name || ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			r.reload()
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Println("registry/file: fsnotify error: ", err)
+		}
+	}
+}
+
+func (r *Registry) watchPoll(ctx context.Context) {
+	defer close(r.done)
+	var modTime time.Time
+	var size int64
+	if fi, err := os.Stat(r.path); err == nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	}
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(r.path)
+			if err != nil {
+				continue
+			}
+			if fi.ModTime().Equal(modTime) && fi.Size() == size {
+				continue
+			}
+			modTime, size = fi.ModTime(), fi.Size()
+			r.reload()
+		}
+	}
+}
+
+func (r *Registry) reload() {
+	if err := r.load(); err != nil {
+		log.Printf("registry/file: reload %v error: %v, keep serving the previous snapshot\n", r.path, err)
+	}
+}
+
+// load 读取并解析文件，成功后替换当前的数据并通知所有 watcher
+func (r *Registry) load() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var f fileFormat
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	if f.Namespace != "" && f.Namespace != r.opts.Namespace {
+		return fmt.Errorf("file namespace %q does not match %q", f.Namespace, r.opts.Namespace)
+	}
+	services := make(map[string][]registry.Instance, len(f.Services))
+	for name, ins := range f.Services {
+		seen := make(map[string]struct{}, len(ins))
+		for _, i := range ins {
+			if i.Addr == "" {
+				return fmt.Errorf("service %v has an instance without addr", name)
+			}
+			if _, ok := seen[i.Addr]; ok {
+				return fmt.Errorf("service %v has duplicate addr %v", name, i.Addr)
+			}
+			seen[i.Addr] = struct{}{}
+			if i.Status == "" {
+				i.Status = registry.StatusServing
+			}
+			services[name] = append(services[name], i)
+		}
+	}
+
+	r.mu.Lock()
+	r.services = services
+	for ch := range r.watchers {
+		select {
+		case ch <- struct{}{}:
+		default: // 已经有未处理的通知，watcher 会读取最新的数据
+		}
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// Close 停止监听文件的变化
+func (r *Registry) Close() error {
+	r.cancel()
+	<-r.done
+	return nil
+}
+
+func (r *Registry) Get(ctx context.Context, serviceName string) (addrs []string, err error) {
+	ins, err := r.GetInstances(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range ins {
+		if i.Serving() {
+			addrs = append(addrs, i.Addr)
+		}
+	}
+	return
+}
+
+func (r *Registry) GetInstances(ctx context.Context, serviceName string) ([]registry.Instance, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]registry.Instance(nil), r.services[serviceName]...), nil
+}
+
+func (r *Registry) ListServices(ctx context.Context) (services []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for name := range r.services {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	return
+}
+
+// Watch 监听 serviceName 的变化，每次文件重新加载后将差异同步到 lo 中，直到 ctx 结束，
+// lo 应当已经使用 Get 的结果初始化过
+func (r *Registry) Watch(ctx context.Context, serviceName string, lo registry.Target) error {
+	ch := make(chan struct{}, 1)
+	known := registry.NewTracker(lo)
+	r.mu.Lock()
+	r.watchers[ch] = struct{}{}
+	for _, ins := range r.services[serviceName] {
+		known.Seed(ins.Addr, ins)
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.watchers, ch)
+		r.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.done:
+			return errors.New("registry/file: registry closed")
+		case <-ch:
+			r.mu.RLock()
+			latest := make(map[string]registry.Instance, len(r.services[serviceName]))
+			for _, ins := range r.services[serviceName] {
+				latest[ins.Addr] = ins
+			}
+			r.mu.RUnlock()
+			// 实例在文件中没有唯一标识，使用地址作为 key
+			known.Reset(latest)
+		}
+	}
+}
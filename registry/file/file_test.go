@@ -0,0 +1,154 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+// setBalancer 记录 Watch 对负载均衡器的修改
+type setBalancer struct {
+	loadbalance.RoundRobin
+	mu    sync.Mutex
+	addrs map[string]bool
+}
+
+func (s *setBalancer) Add(addr string) {
+	s.mu.Lock()
+	s.addrs[addr] = true
+	s.mu.Unlock()
+}
+
+func (s *setBalancer) Delete(addr string) error {
+	s.mu.Lock()
+	delete(s.addrs, addr)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *setBalancer) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for a := range s.addrs {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// writeFile 通过 rename 原子地替换文件，和大多数部署工具的做法一致
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitAddrs(t *testing.T, lb *setBalancer, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !reflect.DeepEqual(lb.list(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("balancer addrs = %v, want %v", lb.list(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testReload(t *testing.T, forcePoll bool) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "registry.json")
+	writeFile(t, path, `{"services": {"order": [{"addr": "10.0.0.1:1", "weight": 4}, {"addr": "10.0.0.2:1"}]}}`)
+
+	r, err := newRegistry(path, 10*time.Millisecond, forcePoll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ins, err := r.GetInstances(ctx, "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 2 || ins[0].Weight != 4 || ins[0].Status != registry.StatusServing {
+		t.Fatalf("instances = %+v", ins)
+	}
+
+	lb := &setBalancer{addrs: map[string]bool{"10.0.0.1:1": true, "10.0.0.2:1": true}}
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go r.Watch(wctx, "order", lb)
+	time.Sleep(20 * time.Millisecond)
+
+	// 删除一个实例，新增一个实例，另一个实例进入 DRAINING
+	writeFile(t, path, `{"services": {"order": [
+		{"addr": "10.0.0.2:1", "status": "DRAINING"},
+		{"addr": "10.0.0.3:1"}
+	], "user": [{"addr": "10.0.1.1:1"}]}}`)
+	waitAddrs(t, lb, []string{"10.0.0.3:1"})
+
+	addrs, _ := r.Get(ctx, "order")
+	if want := []string{"10.0.0.3:1"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("Get = %v, want %v", addrs, want)
+	}
+	services, _ := r.ListServices(ctx)
+	if want := []string{"order", "user"}; !reflect.DeepEqual(services, want) {
+		t.Fatalf("services = %v, want %v", services, want)
+	}
+
+	// 格式错误的文件不会覆盖当前的数据
+	writeFile(t, path, `{"services": {"order": [`)
+	time.Sleep(100 * time.Millisecond)
+	if addrs, _ := r.Get(ctx, "order"); !reflect.DeepEqual(addrs, []string{"10.0.0.3:1"}) {
+		t.Fatalf("malformed file changed state: %v", addrs)
+	}
+	if got := lb.list(); !reflect.DeepEqual(got, []string{"10.0.0.3:1"}) {
+		t.Fatalf("malformed file changed balancer: %v", got)
+	}
+
+	// 修复之后恢复正常
+	writeFile(t, path, `{"services": {"order": [{"addr": "10.0.0.2:1"}, {"addr": "10.0.0.3:1"}]}}`)
+	waitAddrs(t, lb, []string{"10.0.0.2:1", "10.0.0.3:1"})
+}
+
+func TestReloadNotify(t *testing.T) {
+	testReload(t, false)
+}
+
+func TestReloadPoll(t *testing.T) {
+	testReload(t, true)
+}
+
+func TestNamespaceMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	writeFile(t, path, `{"namespace": "staging", "services": {"order": [{"addr": "10.0.0.1:1"}]}}`)
+	if _, err := New(path, 0, registry.WithNamespace("prod")); err == nil {
+		t.Fatal("expected namespace mismatch error")
+	}
+	r, err := New(path, 0, registry.WithNamespace("staging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+}
+
+func TestInvalidInitialFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	writeFile(t, path, `{"services": {"order": [{"weight": 1}]}}`)
+	if _, err := New(path, 0); err == nil {
+		t.Fatal("expected error for instance without addr")
+	}
+}
@@ -0,0 +1,225 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Status 实例的状态，只有 StatusServing 的实例会被客户端选中
+type Status string
+
+const (
+	// StatusServing 正常提供服务
+	StatusServing Status = "SERVING"
+	// StatusDraining 即将下线，客户端不再选择该实例，但已经发出的请求会正常处理完
+	StatusDraining Status = "DRAINING"
+	// StatusStopped 已经停止服务
+	StatusStopped Status = "STOPPED"
+)
+
+// Instance 注册到注册中心中的一个服务实例
+type Instance struct {
+	Addr     string            `json:"addr"`
+	Status   Status            `json:"status,omitempty"`
+	Weight   int64             `json:"weight,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// MetadataZone 实例所在的 zone（可用区）在 Instance.Metadata 中的 key
+const MetadataZone = "zone"
+
+// Zone 返回实例所在的 zone，没有设置时返回空字符串
+func (i Instance) Zone() string {
+	return i.Metadata[MetadataZone]
+}
+
+// MetadataVersion 实例的版本在 Instance.Metadata 中的 key，用于按版本路由（见 loadbalance.Router）
+const MetadataVersion = "version"
+
+// Version 返回实例的版本，没有设置时返回空字符串
+func (i Instance) Version() string {
+	return i.Metadata[MetadataVersion]
+}
+
+// Serving 返回该实例是否可以被选中，未设置状态的实例视为 SERVING
+func (i Instance) Serving() bool {
+	return i.Status == "" || i.Status == StatusServing
+}
+
+// EncodeInstance 将 ins 编码为注册中心中保存的值
+func EncodeInstance(ins Instance) ([]byte, error) {
+	if ins.Status == "" {
+		ins.Status = StatusServing
+	}
+	return json.Marshal(ins)
+}
+
+// DecodeInstance 解析注册中心中保存的值，为了兼容旧版本，无法解析为 json 的值会被当作地址
+func DecodeInstance(val []byte) Instance {
+	var ins Instance
+	if err := json.Unmarshal(val, &ins); err != nil || ins.Addr == "" {
+		return Instance{Addr: string(val), Status: StatusServing}
+	}
+	if ins.Status == "" {
+		ins.Status = StatusServing
+	}
+	return ins
+}
+
+// unixScheme unix socket 地址的前缀，比如 unix:///var/run/app.sock
+const unixScheme = "unix://"
+
+// UnixAddr 返回 unix socket path 在注册中心中的地址
+func UnixAddr(path string) string {
+	return unixScheme + path
+}
+
+// ParseAddr 将注册中心中的地址解析为 net.Dial 使用的 network 和 address：unix://path 为 unix socket，
+// 其他的地址（host:port）为 tcp
+func ParseAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return "unix", strings.TrimPrefix(addr, unixScheme)
+	}
+	return "tcp", addr
+}
+
+// ErrDeregistered 实例已经注销后再调用 SetStatus 时返回
+var ErrDeregistered = errors.New("registry: instance has been deregistered")
+
+// Registration 表示一次服务注册，可以用来修改实例的状态或者注销该实例
+type Registration interface {
+	// Instance 返回当前注册的实例信息
+	Instance() Instance
+
+	// SetStatus 修改实例的状态并写回注册中心
+	SetStatus(ctx context.Context, status Status) error
+
+	// SetWeight 修改实例的权重并写回注册中心，正在 watch 的客户端会按照新的权重选择实例
+	SetWeight(ctx context.Context, weight int64) error
+
+	// Deregister 从注册中心中删除该实例
+	Deregister(ctx context.Context) error
+
+	// Start 将实例的状态设置为 SERVING，和 Stop 一起实现 appleseed.Component，由 appleseed.Lifecycle 调用
+	Start(ctx context.Context) error
+
+	// Stop 见 DrainAndDeregister
+	Stop(ctx context.Context) error
+}
+
+// DrainAndDeregister 先将实例的状态设置为 DRAINING，使 watch 的客户端不再选择它，然后从注册中心中删除。
+// 实例已经注销时返回 nil。Registration 的实现用它实现 Stop
+func DrainAndDeregister(ctx context.Context, r Registration) error {
+	if err := r.SetStatus(ctx, StatusDraining); err != nil {
+		if errors.Is(err, ErrDeregistered) {
+			return nil
+		}
+		return err
+	}
+	return r.Deregister(ctx)
+}
+
+// Tracker 记录 watch 到的所有实例，并将实例的变化（新增、删除、状态变化）同步到负载均衡器中，
+// 只有 SERVING 状态的实例才会出现在负载均衡器中。如果负载均衡器实现了 InstanceTarget，
+// 则每次变化后都将所有实例同步给它，权重等信息的变化也会生效。Tracker 不是并发安全的
+type Tracker struct {
+	lo    Target
+	known map[string]Instance // key: 实例在注册中心中的唯一标识
+}
+
+func NewTracker(lo Target) *Tracker {
+	return &Tracker{lo: lo, known: make(map[string]Instance)}
+}
+
+// Seed 记录当前已有的实例，但不修改负载均衡器（它应当已经使用 Get 的结果初始化过）
+func (t *Tracker) Seed(key string, ins Instance) {
+	t.known[key] = ins
+}
+
+// Put 处理实例的新增或修改
+func (t *Tracker) Put(key string, ins Instance) {
+	old, ok := t.known[key]
+	t.known[key] = ins
+	if t.setInstances() {
+		return
+	}
+	switch {
+	case !ok || !old.Serving():
+		if ins.Serving() {
+			log.Printf("registry: instance[key=%s, addr=%s] serving\n", key, ins.Addr)
+			t.lo.Add(ins.Addr)
+		}
+	case !ins.Serving():
+		log.Printf("registry: instance[key=%s, addr=%s] %s\n", key, ins.Addr, ins.Status)
+		if err := t.lo.Delete(old.Addr); err != nil {
+			log.Println("registry: delete from balancer error: ", err)
+		}
+	case old.Addr != ins.Addr:
+		log.Printf("registry: instance[key=%s] addr update %s -> %s\n", key, old.Addr, ins.Addr)
+		if err := t.lo.Update(old.Addr, ins.Addr); err != nil {
+			log.Println("registry: update balancer error: ", err)
+		}
+	}
+}
+
+// Delete 处理实例的删除
+func (t *Tracker) Delete(key string) {
+	old, ok := t.known[key]
+	if !ok {
+		return
+	}
+	delete(t.known, key)
+	log.Printf("registry: instance[key=%s, addr=%s] deleted\n", key, old.Addr)
+	if t.setInstances() {
+		return
+	}
+	if old.Serving() {
+		if err := t.lo.Delete(old.Addr); err != nil {
+			log.Println("registry: delete from balancer error: ", err)
+		}
+	}
+}
+
+// Reset 使用全量数据 latest 替换当前记录的实例，并将差异同步到负载均衡器中
+func (t *Tracker) Reset(latest map[string]Instance) {
+	if _, ok := t.lo.(InstanceTarget); ok {
+		t.known = make(map[string]Instance, len(latest))
+		for key, ins := range latest {
+			t.known[key] = ins
+		}
+		t.setInstances()
+		return
+	}
+	for key := range t.known {
+		if _, ok := latest[key]; !ok {
+			t.Delete(key)
+		}
+	}
+	for key, ins := range latest {
+		t.Put(key, ins)
+	}
+}
+
+// setInstances 如果负载均衡器实现了 InstanceTarget，则将所有实例同步给它
+func (t *Tracker) setInstances() bool {
+	it, ok := t.lo.(InstanceTarget)
+	if !ok {
+		return false
+	}
+	it.SetInstances(t.Instances())
+	return true
+}
+
+// Instances 返回当前记录的所有实例（包括非 SERVING 状态的实例），按照地址排序
+func (t *Tracker) Instances() []Instance {
+	ins := make([]Instance, 0, len(t.known))
+	for _, i := range t.known {
+		ins = append(ins, i)
+	}
+	sort.Slice(ins, func(i, j int) bool { return ins[i].Addr < ins[j].Addr })
+	return ins
+}
@@ -0,0 +1,367 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+var _ registry.Server = &Registry{}
+var _ registry.Client = &Registry{}
+var _ registry.Watcher = &Registry{}
+
+// event 实例的变化，ins 为 nil 表示该实例被删除
+type event struct {
+	id  string
+	ins *registry.Instance
+}
+
+// watcher 一个 Watch 还没有处理的变化，同一个实例只保留最新的状态，所以占用的内存和实例数量有关，
+// 和 Watch 处理的快慢无关，写操作也不会因为 Watch 处理慢而阻塞
+type watcher struct {
+	ready chan struct{} // 容量为 1，有新的变化时发送
+
+	mu      sync.Mutex
+	pending map[string]*registry.Instance // key: id，nil 表示该实例被删除
+}
+
+func newWatcher() *watcher {
+	return &watcher{ready: make(chan struct{}, 1)}
+}
+
+// add 记录 ev，覆盖同一个实例之前没有处理的变化
+func (w *watcher) add(ev event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending == nil {
+		w.pending = make(map[string]*registry.Instance)
+	}
+	w.pending[ev.id] = ev.ins
+}
+
+// signal 通知 Watch 有新的变化，不会阻塞
+func (w *watcher) signal() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take 取出所有没有处理的变化
+func (w *watcher) take() map[string]*registry.Instance {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending := w.pending
+	w.pending = nil
+	return pending
+}
+
+// Store 保存所有命名空间下的注册信息，多个 Registry 共享同一个 Store 即可模拟一个
+// 共享的注册中心，主要用于测试以及单进程部署
+type Store struct {
+	mu       sync.RWMutex
+	seq      uint64
+	services map[string]map[string]map[string]registry.Instance // namespace -> serviceName -> id -> instance
+	watchers map[string]map[string][]*watcher                   // namespace -> serviceName -> watchers
+}
+
+func NewStore() *Store {
+	return &Store{
+		services: make(map[string]map[string]map[string]registry.Instance),
+		watchers: make(map[string]map[string][]*watcher),
+	}
+}
+
+func (s *Store) nextID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return strconv.FormatUint(s.seq, 10)
+}
+
+func (s *Store) put(namespace, serviceName, id string, ins registry.Instance) {
+	s.mu.Lock()
+	if s.services[namespace] == nil {
+		s.services[namespace] = make(map[string]map[string]registry.Instance)
+	}
+	if s.services[namespace][serviceName] == nil {
+		s.services[namespace][serviceName] = make(map[string]registry.Instance)
+	}
+	s.services[namespace][serviceName][id] = ins
+	watchers := s.notify(namespace, serviceName, event{id: id, ins: &ins})
+	s.mu.Unlock()
+	signal(watchers)
+}
+
+func (s *Store) delete(namespace, serviceName, id string) {
+	s.mu.Lock()
+	instances := s.services[namespace][serviceName]
+	if _, ok := instances[id]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(instances, id)
+	if len(instances) == 0 {
+		delete(s.services[namespace], serviceName)
+	}
+	watchers := s.notify(namespace, serviceName, event{id: id})
+	s.mu.Unlock()
+	signal(watchers)
+}
+
+// notify 将 ev 记录到 serviceName 的每个 watcher 中，返回这些 watcher，释放 s.mu 之后再调用 signal 通知它们。
+// 在持有 s.mu 时记录，保证 watcher 看到的同一个实例的最新状态和 Store 中的一致。调用时需要持有 s.mu
+func (s *Store) notify(namespace, serviceName string, ev event) []*watcher {
+	watchers := append([]*watcher(nil), s.watchers[namespace][serviceName]...)
+	for _, w := range watchers {
+		w.add(ev)
+	}
+	return watchers
+}
+
+func signal(watchers []*watcher) {
+	for _, w := range watchers {
+		w.signal()
+	}
+}
+
+func (s *Store) get(namespace, serviceName string) (ins []registry.Instance) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, i := range s.services[namespace][serviceName] {
+		ins = append(ins, i)
+	}
+	sort.Slice(ins, func(i, j int) bool { return ins[i].Addr < ins[j].Addr })
+	return
+}
+
+func (s *Store) list(namespace string) (services []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for name := range s.services[namespace] {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	return
+}
+
+// watch 注册一个 watcher，同时返回当前已有的实例
+func (s *Store) watch(namespace, serviceName string) (*watcher, map[string]registry.Instance) {
+	w := newWatcher()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchers[namespace] == nil {
+		s.watchers[namespace] = make(map[string][]*watcher)
+	}
+	s.watchers[namespace][serviceName] = append(s.watchers[namespace][serviceName], w)
+	current := make(map[string]registry.Instance)
+	for id, ins := range s.services[namespace][serviceName] {
+		current[id] = ins
+	}
+	return w, current
+}
+
+func (s *Store) unwatch(namespace, serviceName string, w *watcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ws := s.watchers[namespace][serviceName]
+	for i, x := range ws {
+		if x == w {
+			s.watchers[namespace][serviceName] = append(ws[:i:i], ws[i+1:]...)
+			break
+		}
+	}
+}
+
+// Registry 基于内存的注册中心，同时实现了 registry.Server 和 registry.Client，
+// 只能看到自己命名空间下的服务
+type Registry struct {
+	store *Store
+	opts  registry.Options
+
+	mu   sync.Mutex
+	regs map[string][]*registration // key: serviceName val: 本实例的所有注册，用于 Unregister
+}
+
+// New 创建一个基于 store 的注册中心，store 为 nil 时使用一个私有的 Store
+func New(store *Store, opts ...registry.Option) *Registry {
+	if store == nil {
+		store = NewStore()
+	}
+	return &Registry{
+		store: store,
+		opts:  registry.NewOptions(opts...),
+		regs:  make(map[string][]*registration),
+	}
+}
+
+func (r *Registry) Name() string {
+	return "memory"
+}
+
+func (r *Registry) Addr() []string {
+	return nil
+}
+
+// Namespace 返回当前使用的命名空间，没有指定时为空
+func (r *Registry) Namespace() string {
+	return r.opts.Namespace
+}
+
+func (r *Registry) Register(ctx context.Context, serviceName, addr string) error {
+	_, err := r.RegisterInstance(ctx, serviceName, registry.Instance{Addr: addr})
+	return err
+}
+
+func (r *Registry) RegisterInstance(ctx context.Context, serviceName string, ins registry.Instance) (registry.Registration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ins.Status == "" {
+		ins.Status = registry.StatusServing
+	}
+	reg := &registration{r: r, serviceName: serviceName, id: r.store.nextID(), ins: ins}
+	r.store.put(r.opts.Namespace, serviceName, reg.id, ins)
+	r.mu.Lock()
+	r.regs[serviceName] = append(r.regs[serviceName], reg)
+	r.mu.Unlock()
+	return reg, nil
+}
+
+func (r *Registry) Unregister(ctx context.Context, serviceName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	regs := r.regs[serviceName]
+	delete(r.regs, serviceName)
+	r.mu.Unlock()
+	for _, reg := range regs {
+		// 先标记为已注销，之后的 SetStatus、SetWeight 不会把实例重新写回
+		reg.mu.Lock()
+		reg.removed = true
+		reg.mu.Unlock()
+		r.store.delete(r.opts.Namespace, serviceName, reg.id)
+	}
+	return nil
+}
+
+func (r *Registry) Get(ctx context.Context, serviceName string) (addrs []string, err error) {
+	ins, err := r.GetInstances(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range ins {
+		if i.Serving() {
+			addrs = append(addrs, i.Addr)
+		}
+	}
+	return
+}
+
+func (r *Registry) GetInstances(ctx context.Context, serviceName string) ([]registry.Instance, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.store.get(r.opts.Namespace, serviceName), nil
+}
+
+func (r *Registry) ListServices(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.store.list(r.opts.Namespace), nil
+}
+
+// Watch 监听 serviceName 的变化并同步到 lo 中，直到 ctx 被取消，lo 应当已经使用 Get 的结果初始化过
+func (r *Registry) Watch(ctx context.Context, serviceName string, lo registry.Target) error {
+	w, current := r.store.watch(r.opts.Namespace, serviceName)
+	defer r.store.unwatch(r.opts.Namespace, serviceName, w)
+	known := registry.NewTracker(lo)
+	for id, ins := range current {
+		known.Seed(id, ins)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.ready:
+			for id, ins := range w.take() {
+				if ins == nil {
+					known.Delete(id)
+				} else {
+					known.Put(id, *ins)
+				}
+			}
+		}
+	}
+}
+
+type registration struct {
+	r           *Registry
+	serviceName string
+	id          string
+
+	mu      sync.Mutex
+	ins     registry.Instance
+	removed bool // 已经注销，不能再修改状态
+}
+
+func (reg *registration) Instance() registry.Instance {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.ins
+}
+
+func (reg *registration) SetStatus(ctx context.Context, status registry.Status) error {
+	return reg.update(ctx, func(ins *registry.Instance) { ins.Status = status })
+}
+
+func (reg *registration) SetWeight(ctx context.Context, weight int64) error {
+	return reg.update(ctx, func(ins *registry.Instance) { ins.Weight = weight })
+}
+
+func (reg *registration) update(ctx context.Context, fn func(ins *registry.Instance)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.removed {
+		return registry.ErrDeregistered
+	}
+	fn(&reg.ins)
+	reg.r.store.put(reg.r.opts.Namespace, reg.serviceName, reg.id, reg.ins)
+	return nil
+}
+
+func (reg *registration) Start(ctx context.Context) error {
+	return reg.SetStatus(ctx, registry.StatusServing)
+}
+
+func (reg *registration) Stop(ctx context.Context) error {
+	return registry.DrainAndDeregister(ctx, reg)
+}
+
+func (reg *registration) Deregister(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reg.r.mu.Lock()
+	regs := reg.r.regs[reg.serviceName]
+	for i, x := range regs {
+		if x == reg {
+			reg.r.regs[reg.serviceName] = append(regs[:i:i], regs[i+1:]...)
+			break
+		}
+	}
+	reg.r.mu.Unlock()
+	reg.mu.Lock()
+	reg.removed = true
+	reg.mu.Unlock()
+	reg.r.store.delete(reg.r.opts.Namespace, reg.serviceName, reg.id)
+	return nil
+}
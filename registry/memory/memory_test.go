@@ -0,0 +1,225 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+)
+
+func TestNamespaceIsolation(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+	prod := New(store, registry.WithNamespace("prod"))
+	staging := New(store, registry.WithNamespace("staging"))
+	// 未指定命名空间的实例使用默认命名空间，不能看到任何环境的服务
+	def := New(store)
+
+	if err := prod.Register(ctx, "order", "10.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.Register(ctx, "order", "10.1.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	// 一个名字和命名空间相同的服务也不能造成串扰
+	if err := staging.Register(ctx, "prod", "10.1.0.2:8080"); err != nil {
+		t.Fatal(err)
+	}
+
+	prodClient := New(store, registry.WithNamespace("prod"))
+	for i := 0; i < 100; i++ {
+		addr, err := client.GetServerAddr(ctx, prodClient, &loadbalance.RoundRobin{}, "order")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != "10.0.0.1:8080" {
+			t.Fatalf("prod client got non-prod address %v", addr)
+		}
+	}
+
+	addrs, err := def.Get(ctx, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 0 {
+		t.Fatalf("default namespace should not see other namespaces, got %v", addrs)
+	}
+
+	services, err := staging.ListServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"order", "prod"}; !reflect.DeepEqual(services, want) {
+		t.Fatalf("staging services = %v, want %v", services, want)
+	}
+	services, err = prodClient.ListServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"order"}; !reflect.DeepEqual(services, want) {
+		t.Fatalf("prod services = %v, want %v", services, want)
+	}
+}
+
+func TestUnregisterOnlyOwnInstances(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+	a := New(store)
+	b := New(store)
+	if err := a.Register(ctx, "order", "127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Register(ctx, "order", "127.0.0.1:2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unregister(ctx, "order"); err != nil {
+		t.Fatal(err)
+	}
+	addrs, _ := b.Get(ctx, "order")
+	if want := []string{"127.0.0.1:2"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("addrs = %v, want %v", addrs, want)
+	}
+}
+
+// TestUnregisterThenSetStatus Unregister 之后通过 Registration 修改状态返回 ErrDeregistered，实例不会重新出现
+func TestUnregisterThenSetStatus(t *testing.T) {
+	ctx := context.Background()
+	r := New(nil)
+	reg, err := r.RegisterInstance(ctx, "order", registry.Instance{Addr: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Unregister(ctx, "order"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.SetStatus(ctx, registry.StatusDraining); !errors.Is(err, registry.ErrDeregistered) {
+		t.Fatalf("SetStatus() = %v, want ErrDeregistered", err)
+	}
+	if err := reg.SetWeight(ctx, 10); !errors.Is(err, registry.ErrDeregistered) {
+		t.Fatalf("SetWeight() = %v, want ErrDeregistered", err)
+	}
+	if ins, _ := r.GetInstances(ctx, "order"); len(ins) != 0 {
+		t.Fatalf("instances = %v, want none", ins)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store := NewStore()
+	prod := New(store, registry.WithNamespace("prod"))
+	staging := New(store, registry.WithNamespace("staging"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lb := &chanBalancer{added: make(chan string, 10)}
+	done := make(chan error, 1)
+	go func() { done <- prod.Watch(ctx, "order", lb) }()
+	// 等待 watch 建立
+	time.Sleep(10 * time.Millisecond)
+
+	if err := staging.Register(ctx, "order", "10.1.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := prod.Register(ctx, "order", "10.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case addr := <-lb.added:
+		if addr != "10.0.0.1:8080" {
+			t.Fatalf("watched addr = %v", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch timeout")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("watch returned %v", err)
+	}
+	if len(lb.added) != 0 {
+		t.Fatalf("watched addr from other namespace: %v", <-lb.added)
+	}
+}
+
+// TestWatchSlowTarget Watch 的 Target 处理慢或者阻塞时，写操作不会被阻塞，取消之后 Watch 可以正常退出
+func TestWatchSlowTarget(t *testing.T) {
+	ctx := context.Background()
+	r := New(nil)
+	lb := &blockingBalancer{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	watchCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- r.Watch(watchCtx, "order", lb) }()
+	time.Sleep(10 * time.Millisecond)
+
+	reg, err := r.RegisterInstance(ctx, "order", registry.Instance{Addr: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-lb.entered
+	// Watch 阻塞在 Add 中，远超过任何缓冲区大小的写操作仍然立即完成
+	writes := make(chan error, 1)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if err := reg.SetWeight(ctx, int64(i+1)); err != nil {
+				writes <- err
+				return
+			}
+			if err := r.Register(ctx, "order", "127.0.0.2:"+strconv.Itoa(i)); err != nil {
+				writes <- err
+				return
+			}
+		}
+		writes <- nil
+	}()
+	select {
+	case err := <-writes:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked by a slow watcher")
+	}
+
+	cancel()
+	close(lb.release)
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("watch returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not return after cancel")
+	}
+	if err := r.Unregister(ctx, "order"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingBalancer 第一次 Add 阻塞到 release 被关闭
+type blockingBalancer struct {
+	loadbalance.RoundRobin
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBalancer) Add(addr string) {
+	select {
+	case b.entered <- struct{}{}:
+	default:
+	}
+	<-b.release
+}
+
+// chanBalancer 将 Add 的地址发送到 added 中，方便在测试中同步等待
+type chanBalancer struct {
+	loadbalance.RoundRobin
+	added chan string
+}
+
+func (c *chanBalancer) Add(addr string) {
+	c.added <- addr
+}
@@ -2,8 +2,15 @@ package registry
 
 import (
 	"context"
+	"path"
+	"strings"
+	"time"
 )
 
+// DefaultNamespace 未通过 WithNamespace 指定命名空间时使用的命名空间。为空时 key 中没有命名空间，和没有命名空间
+// 之前的格式（<prefix>/<serviceName>/<uuid>）相同，新旧版本的实例在滚动升级期间可以互相发现
+const DefaultNamespace = ""
+
 type Server interface {
 	// Name 返回注册中心名字（比如 Etcd）
 	Name() string
@@ -14,11 +21,155 @@ type Server interface {
 	// Register 注册 serviceName 到注册中心
 	Register(ctx context.Context, serviceName, addr string) error
 
+	// RegisterInstance 注册 serviceName 的一个实例到注册中心，返回的 Registration 可以修改实例的状态
+	RegisterInstance(ctx context.Context, serviceName string, ins Instance) (Registration, error)
+
 	// Unregister 从注册中心中删除 serviceName
 	Unregister(ctx context.Context, serviceName string) (err error)
 }
 
 type Client interface {
-	// Get 从注册中心中获取 serviceName 对应的 address
+	// Get 从注册中心中获取 serviceName 对应的 address，只包含 SERVING 状态的实例
 	Get(ctx context.Context, serviceName string) (addrs []string, err error)
+
+	// GetInstances 从注册中心中获取 serviceName 的所有实例，包括非 SERVING 状态的实例
+	GetInstances(ctx context.Context, serviceName string) (ins []Instance, err error)
+
+	// ListServices 列出当前命名空间下的所有 serviceName
+	ListServices(ctx context.Context) (services []string, err error)
+}
+
+// Target Watch 将实例的变化同步到的目标，通常是一个负载均衡器（loadbalance.Balancer 实现了该接口）。
+// 注册中心只依赖这几个方法，而不依赖 loadbalance，负载均衡器才可以使用 Instance 中的信息
+type Target interface {
+	// Add 添加一个可以被选中的地址
+	Add(addr string)
+
+	// Update 更新一个地址
+	Update(oldAddr string, newAddr string) error
+
+	// Delete 删除一个地址
+	Delete(addr string) error
+}
+
+// InstanceTarget 可以使用实例完整信息（权重、zone 等）的 Target。Watch 每次观察到变化后，都会通过
+// SetInstances 将当前所有的实例（包括非 SERVING 状态的实例）同步给它，而不再调用 Add、Update、Delete
+type InstanceTarget interface {
+	Target
+
+	// SetInstances 使用 instances 替换所有的实例，只有 SERVING 状态的实例可以被选中
+	SetInstances(instances []Instance)
+}
+
+// Watcher 可以监听服务实例变化的注册中心
+type Watcher interface {
+	// Watch 监听 serviceName 的变化并同步到 lo 中，直到 ctx 结束，lo 应当已经使用 Get 的结果初始化过
+	Watch(ctx context.Context, serviceName string, lo Target) error
+}
+
+// State 表示客户端与注册中心之间的连接状态
+type State int
+
+const (
+	StateConnected State = iota
+	StateDisconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// Options 注册中心的公共配置，各个注册中心的实现都需要遵守
+type Options struct {
+	// Namespace 命名空间（比如 dev、staging、prod），所有 key 都会加上该前缀，
+	// 不同命名空间下的服务互相不可见
+	Namespace string
+
+	// 以下配置只对远程注册中心（比如 etcd）有效
+
+	// RetryAttempts 遇到临时错误时的最大尝试次数（包括第一次）
+	RetryAttempts int
+	// RetryBackoff 第一次重试前的等待时间，之后每次翻倍，最大不超过 MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// RequestTimeout 单次请求的超时时间，超时后视为临时错误进行重试（前提是 ctx 还没有结束）
+	RequestTimeout time.Duration
+	// OnStateChange 连接状态发生变化时调用，err 为导致断开的错误，可以用来对长时间断开进行告警
+	OnStateChange func(state State, err error)
+}
+
+type Option func(*Options)
+
+// WithNamespace 指定命名空间，Register/Get/Watch 都只会作用于该命名空间
+func WithNamespace(namespace string) Option {
+	return func(o *Options) {
+		o.Namespace = namespace
+	}
+}
+
+// WithRetry 设置临时错误的重试策略，attempts 为最大尝试次数，backoff 为初始退避时间
+func WithRetry(attempts int, backoff, maxBackoff time.Duration) Option {
+	return func(o *Options) {
+		o.RetryAttempts = attempts
+		o.RetryBackoff = backoff
+		o.MaxRetryBackoff = maxBackoff
+	}
+}
+
+// WithRequestTimeout 设置单次请求的超时时间
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.RequestTimeout = timeout
+	}
+}
+
+// WithStateListener 设置连接状态的回调，只在状态发生变化时调用
+func WithStateListener(fn func(state State, err error)) Option {
+	return func(o *Options) {
+		o.OnStateChange = fn
+	}
+}
+
+// NewOptions 应用 opts 并返回最终的配置
+func NewOptions(opts ...Option) Options {
+	o := Options{
+		Namespace:       DefaultNamespace,
+		RetryAttempts:   5,
+		RetryBackoff:    100 * time.Millisecond,
+		MaxRetryBackoff: 3 * time.Second,
+		RequestTimeout:  3 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.Namespace = strings.Trim(o.Namespace, "/")
+	if o.RetryAttempts < 1 {
+		o.RetryAttempts = 1
+	}
+	return o
+}
+
+// namespaceKey 返回命名空间的 key 前缀，格式为：<prefix>/<namespace>/，namespace 为空时为 <prefix>/
+func namespaceKey(prefix, namespace string) string {
+	return path.Join(prefix, namespace) + "/"
+}
+
+// serviceKey 返回服务的 key 前缀，格式为：<prefix>/<namespace>/<serviceName>/，namespace 为空时为
+// <prefix>/<serviceName>/，末尾的 / 用于避免 service1 匹配到 service10
+func serviceKey(prefix, namespace, serviceName string) string {
+	return path.Join(prefix, namespace, serviceName) + "/"
+}
+
+// isInstanceKey 返回 key 是否为 svcKey（serviceKey 的结果）下的一个实例，即 svcKey 之后只有 uuid。
+// 没有命名空间时，其他命名空间的 key（<prefix>/<namespace>/<serviceName>/<uuid>）也以 <prefix>/<namespace>/
+// 开头，服务名和命名空间相同时不能把它们当作实例
+func isInstanceKey(key, svcKey string) bool {
+	rest := strings.TrimPrefix(key, svcKey)
+	return rest != "" && rest != key && !strings.Contains(rest, "/")
 }
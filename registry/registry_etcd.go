@@ -2,40 +2,57 @@ package registry
 
 import (
 	"context"
-	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"errors"
 	"log"
-	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	client "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const defaultServicePrefix = "/register-servier"
 
 var _ Server = &Etcd{}
 var _ Client = &Etcd{}
+var _ Watcher = &Etcd{}
+
+// errWatchClosed watch channel 被关闭，通常是因为 leader 切换或者连接的节点下线
+var errWatchClosed = errors.New("registry: etcd watch channel closed")
+
+// etcdClient 是 Etcd 用到的 etcd 接口的子集，*client.Client 实现了该接口，测试中可以用 mock 替换
+type etcdClient interface {
+	client.KV
+	client.Watcher
+	client.Lease
+	Close() error
+}
 
 type Etcd struct {
 	endpoints     []string
-	conn          *client.Client
+	conn          etcdClient
 	prefix        string
 	keepAliveTime int64
 	lease         *client.LeaseGrantResponse
+	opts          Options
+
+	mu   sync.Mutex
+	regs map[string][]*etcdRegistration // key: serviceName val: 本实例的所有注册，用于 Unregister
+
+	stateMu sync.Mutex
+	state   State
 }
 
-// NewEtcd 创建一个注册中心，etcdEndpoints 指定 etcd 的地址，prefix 表示公共前缀，
-// 方便查找和分类，如果不指定则使用默认前缀，格式为：<prefix>/<serviceName>/<uuid>，
+// NewEtcd 创建一个注册中心，etcdEndpoints 指定 etcd 的地址（可以有多个，某个节点不可用时会自动切换），
+// prefix 表示公共前缀，方便查找和分类，如果不指定则使用默认前缀，格式为：<prefix>/<namespace>/<serviceName>/<uuid>，
+// 没有指定命名空间时为 <prefix>/<serviceName>/<uuid>，
 // keepAliveTimeout 表示超时时间，如果超过该时间没有发送心跳，则说明此服务器已下线
-func NewEtcd(ctx context.Context, endpoints []string, prefix string, keepAliveTimeout int64) (r *Etcd, err error) {
-	r = &Etcd{}
-	r.endpoints = endpoints
-	if prefix != "" {
-		r.prefix = prefix
-	} else {
-		r.prefix = defaultServicePrefix // 默认前缀
-	}
-	r.keepAliveTime = keepAliveTimeout
-
+func NewEtcd(ctx context.Context, endpoints []string, prefix string, keepAliveTimeout int64, opts ...Option) (r *Etcd, err error) {
 	// 连接到 etcd
 	c, err := client.New(client.Config{
 		Endpoints: endpoints,
@@ -44,18 +61,22 @@ func NewEtcd(ctx context.Context, endpoints []string, prefix string, keepAliveTi
 		log.Println("connecting to etcd error: ", err)
 		return nil, err
 	}
-	r.conn = c
+	r = newEtcd(c, endpoints, prefix, opts...)
+	r.keepAliveTime = keepAliveTimeout
 
 	// 创建租约
-	l := client.NewLease(c)
-	lease, err := l.Grant(ctx, keepAliveTimeout)
+	var lease *client.LeaseGrantResponse
+	err = r.retry(ctx, func(ctx context.Context) (err error) {
+		lease, err = r.conn.Grant(ctx, keepAliveTimeout)
+		return
+	})
 	if err != nil {
 		log.Println("grant lease error: ", err)
 		return nil, err
 	}
 	r.lease = lease
 	// 对租约进行永久保活
-	ch, err := l.KeepAlive(ctx, lease.ID)
+	ch, err := r.conn.KeepAlive(ctx, lease.ID)
 	if err != nil {
 		log.Println("set keepalive error: ", err)
 		return nil, err
@@ -65,19 +86,11 @@ func NewEtcd(ctx context.Context, endpoints []string, prefix string, keepAliveTi
 		for range ch {
 		}
 	}()
-
-	go func() {
-		if err_ := r.Watch(context.Background(), "service1", &loadbalance.RoundRobin{}); err != nil {
-			err = err_
-			return
-		}
-	}()
-
 	return
 }
 
-func NewEtcdClient(endpoints []string) (*Etcd, error) {
-	var e Etcd
+// NewEtcdClient 创建一个只用于服务发现的 etcd 客户端，opts 中的命名空间需要和服务端保持一致
+func NewEtcdClient(endpoints []string, opts ...Option) (*Etcd, error) {
 	// 连接到 etcd
 	c, err := client.New(client.Config{
 		Endpoints: endpoints,
@@ -86,31 +99,157 @@ func NewEtcdClient(endpoints []string) (*Etcd, error) {
 		log.Println("connecting to etcd error: ", err)
 		return nil, err
 	}
-	e.conn = c
-	return &e, nil
+	return newEtcd(c, endpoints, "", opts...), nil
+}
+
+func newEtcd(c etcdClient, endpoints []string, prefix string, opts ...Option) *Etcd {
+	e := &Etcd{
+		endpoints: endpoints,
+		conn:      c,
+		prefix:    prefix,
+		opts:      NewOptions(opts...),
+		regs:      make(map[string][]*etcdRegistration),
+	}
+	if e.prefix == "" {
+		e.prefix = defaultServicePrefix // 默认前缀
+	}
+	return e
 }
 
 // Register 将服务注册到 etcd 中，以 serviceName 作为 key，对应的 addr 作为 val，同时会绑定租约来保持活性
 func (e *Etcd) Register(ctx context.Context, serviceName, addr string) (err error) {
+	_, err = e.RegisterInstance(ctx, serviceName, Instance{Addr: addr})
+	return
+}
+
+// RegisterInstance 将服务的一个实例注册到 etcd 中，val 为 json 编码后的 ins，同时会绑定租约来保持活性
+func (e *Etcd) RegisterInstance(ctx context.Context, serviceName string, ins Instance) (Registration, error) {
 	// 一个 serviceName 可能由多台服务器提供，用一个 uuid 来唯一标识一台服务器，查找时
 	// 将 serviceName 作为前缀查找即可
-	key := path.Join(e.prefix, serviceName, uuid.NewString())
-	// 写入 kv 到 etcd 并绑定租约
-	_, err = e.conn.Put(ctx, key, addr, client.WithLease(e.lease.ID))
-	if err != nil {
+	key := serviceKey(e.prefix, e.opts.Namespace, serviceName) + uuid.NewString()
+	if ins.Status == "" {
+		ins.Status = StatusServing
+	}
+	if err := e.put(ctx, key, ins); err != nil {
 		log.Printf("register service[%v] error: %v\n", serviceName, err)
-		return
+		return nil, err
 	}
+	r := &etcdRegistration{e: e, serviceName: serviceName, key: key, ins: ins}
+	e.mu.Lock()
+	e.regs[serviceName] = append(e.regs[serviceName], r)
+	e.mu.Unlock()
 	log.Printf("register a service, key: %v\n", key)
-	return
+	return r, nil
+}
+
+// put 写入 kv 到 etcd 并绑定租约，key 是唯一的，所以重试是安全的
+func (e *Etcd) put(ctx context.Context, key string, ins Instance) error {
+	val, err := EncodeInstance(ins)
+	if err != nil {
+		return err
+	}
+	return e.retry(ctx, func(ctx context.Context) error {
+		_, err := e.conn.Put(ctx, key, string(val), client.WithLease(e.lease.ID))
+		return err
+	})
+}
+
+func (e *Etcd) delete(ctx context.Context, key string) error {
+	return e.retry(ctx, func(ctx context.Context) error {
+		_, err := e.conn.Delete(ctx, key)
+		return err
+	})
 }
 
-// Unregister 将已注册的服务从 etcd 中移除
+// Unregister 将本实例注册的 serviceName 从 etcd 中移除，其他服务器注册的同名服务不受影响。
+// 之后这些注册的 Registration 再修改状态时返回 ErrDeregistered，不会重新写入 etcd
 func (e *Etcd) Unregister(ctx context.Context, serviceName string) (err error) {
-	_, err = e.conn.Delete(ctx, path.Join(e.prefix, serviceName))
+	e.mu.Lock()
+	regs := e.regs[serviceName]
+	delete(e.regs, serviceName)
+	e.mu.Unlock()
+	for _, r := range regs {
+		r.mu.Lock()
+		r.removed = true
+		r.mu.Unlock()
+	}
+	for _, r := range regs {
+		if err = e.delete(ctx, r.key); err != nil {
+			return
+		}
+	}
 	return
 }
 
+type etcdRegistration struct {
+	e           *Etcd
+	serviceName string
+	key         string
+
+	mu      sync.Mutex
+	ins     Instance
+	removed bool // 已经注销，不能再修改状态
+}
+
+func (r *etcdRegistration) Instance() Instance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ins
+}
+
+func (r *etcdRegistration) SetStatus(ctx context.Context, status Status) error {
+	return r.update(ctx, func(ins *Instance) { ins.Status = status })
+}
+
+func (r *etcdRegistration) SetWeight(ctx context.Context, weight int64) error {
+	return r.update(ctx, func(ins *Instance) { ins.Weight = weight })
+}
+
+// update 修改实例信息并写回 etcd，写入成功后才会修改 r.ins
+func (r *etcdRegistration) update(ctx context.Context, fn func(ins *Instance)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.removed {
+		return ErrDeregistered
+	}
+	ins := r.ins
+	fn(&ins)
+	if err := r.e.put(ctx, r.key, ins); err != nil {
+		return err
+	}
+	r.ins = ins
+	return nil
+}
+
+func (r *etcdRegistration) Start(ctx context.Context) error {
+	return r.SetStatus(ctx, StatusServing)
+}
+
+func (r *etcdRegistration) Stop(ctx context.Context) error {
+	return DrainAndDeregister(ctx, r)
+}
+
+func (r *etcdRegistration) Deregister(ctx context.Context) error {
+	r.e.mu.Lock()
+	regs := r.e.regs[r.serviceName]
+	for i, reg := range regs {
+		if reg == r {
+			r.e.regs[r.serviceName] = append(regs[:i:i], regs[i+1:]...)
+			break
+		}
+	}
+	r.e.mu.Unlock()
+	r.mu.Lock()
+	r.removed = true
+	r.mu.Unlock()
+	return r.e.delete(ctx, r.key)
+}
+
+// Namespace 返回当前使用的命名空间，没有指定时为空
+func (e *Etcd) Namespace() string {
+	return e.opts.Namespace
+}
+
 func (e *Etcd) Name() string {
 	return "etcd"
 }
@@ -119,39 +258,265 @@ func (e *Etcd) Addr() []string {
 	return e.endpoints
 }
 
-// Get 从 etcd 中通过 serviceName 获取该 service 的所有地址，需要客户端自己做负载均衡
+// Close 关闭与 etcd 的连接
+func (e *Etcd) Close() error {
+	return e.conn.Close()
+}
+
+// Get 从 etcd 中通过 serviceName 获取该 service 所有 SERVING 状态实例的地址，需要客户端自己做负载均衡
 func (e *Etcd) Get(ctx context.Context, serviceName string) (addrs []string, err error) {
-	gr, err := e.conn.Get(ctx, path.Join(e.prefix, serviceName), client.WithPrefix())
+	ins, err := e.GetInstances(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range ins {
+		if i.Serving() {
+			addrs = append(addrs, i.Addr)
+		}
+	}
+	return
+}
+
+// GetInstances 从 etcd 中通过 serviceName 获取该 service 的所有实例
+func (e *Etcd) GetInstances(ctx context.Context, serviceName string) (ins []Instance, err error) {
+	key := serviceKey(e.prefix, e.opts.Namespace, serviceName)
+	gr, err := e.get(ctx, key, client.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
 	for _, v := range gr.Kvs {
-		addrs = append(addrs, string(v.Value))
+		if isInstanceKey(string(v.Key), key) {
+			ins = append(ins, DecodeInstance(v.Value))
+		}
+	}
+	return
+}
+
+// ListServices 列出当前命名空间下所有已注册的 serviceName，返回结果中不包含前缀和命名空间
+func (e *Etcd) ListServices(ctx context.Context) (services []string, err error) {
+	nsKey := namespaceKey(e.prefix, e.opts.Namespace)
+	gr, err := e.get(ctx, nsKey, client.WithPrefix(), client.WithKeysOnly())
+	if err != nil {
+		return nil, err
 	}
+	seen := make(map[string]struct{})
+	for _, kv := range gr.Kvs {
+		// key 的格式为 <prefix>/<namespace>/<serviceName>/<uuid>，去掉首尾即可得到 serviceName。
+		// 没有命名空间时跳过其他命名空间的 key，它们比本命名空间的 key 多一级
+		rest := strings.TrimPrefix(string(kv.Key), nsKey)
+		i := strings.LastIndex(rest, "/")
+		if i <= 0 || e.opts.Namespace == "" && strings.Contains(rest[:i], "/") {
+			continue
+		}
+		name := rest[:i]
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		services = append(services, name)
+	}
+	sort.Strings(services)
 	return
 }
 
-func (e *Etcd) Watch(ctx context.Context, serviceName string, lo loadbalance.Balancer) error {
-	watchChan := e.conn.Watch(ctx, path.Join(e.prefix, serviceName), client.WithPrefix(), client.WithPrevKV())
+func (e *Etcd) get(ctx context.Context, key string, opts ...client.OpOption) (gr *client.GetResponse, err error) {
+	err = e.retry(ctx, func(ctx context.Context) (err error) {
+		gr, err = e.conn.Get(ctx, key, opts...)
+		return
+	})
+	return
+}
+
+// Watch 监听 serviceName 下实例的变化并同步到 lo 中，lo 应当已经使用 Get 的结果初始化过，
+// 实例的状态变为非 SERVING 时会从 lo 中删除，直到 ctx 结束才会返回。watch 因为 compaction、leader 切换或者节点下线而中断时，
+// 会从最后一次看到的 revision 开始重新 watch，如果该 revision 已经被 compact，
+// 则重新获取全量数据并将差异同步到 lo 中
+func (e *Etcd) Watch(ctx context.Context, serviceName string, lo Target) error {
+	key := serviceKey(e.prefix, e.opts.Namespace, serviceName)
+	// 记录当前已知的所有实例，用于重新同步时计算差异
+	known := NewTracker(lo)
+	gr, err := e.get(ctx, key, client.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, kv := range gr.Kvs {
+		if isInstanceKey(string(kv.Key), key) {
+			known.Seed(string(kv.Key), DecodeInstance(kv.Value))
+		}
+	}
+	rev := gr.Header.Revision
+
+	backoff := e.opts.RetryBackoff
+	for {
+		// WithRequireLeader：连接的节点与 leader 失联时关闭 watch，而不是一直等待
+		wctx, cancel := context.WithCancel(client.WithRequireLeader(ctx))
+		watchChan := e.conn.Watch(wctx, key, client.WithPrefix(), client.WithPrevKV(), client.WithRev(rev+1))
+		var progressed bool
+		rev, progressed, err = e.consume(ctx, key, watchChan, known, rev)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if progressed {
+			backoff = e.opts.RetryBackoff
+		}
+		if errors.Is(err, rpctypes.ErrCompacted) {
+			log.Printf("registry: watch %v compacted at revision %v, resync\n", key, rev)
+			if rev, err = e.resync(ctx, key, known); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Printf("registry: watch %v interrupted: %v, rewatch from revision %v\n", key, err, rev+1)
+		e.setState(StateDisconnected, err)
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+		backoff = nextBackoff(backoff, e.opts.MaxRetryBackoff)
+	}
+}
+
+// consume 处理 watchChan 中 key 下实例的事件，直到 watch 中断或者 ctx 结束，返回最后一次看到的 revision，
+// progressed 表示本次 watch 是否成功收到过 response
+func (e *Etcd) consume(ctx context.Context, key string, watchChan client.WatchChan, known *Tracker, rev int64) (int64, bool, error) {
+	var progressed bool
 	for {
 		select {
-		case resp := <-watchChan:
+		case <-ctx.Done():
+			return rev, progressed, ctx.Err()
+		case resp, ok := <-watchChan:
+			if !ok {
+				return rev, progressed, errWatchClosed
+			}
+			if err := resp.Err(); err != nil {
+				return rev, progressed, err
+			}
+			progressed = true
+			e.setState(StateConnected, nil)
 			for _, event := range resp.Events {
+				if !isInstanceKey(string(event.Kv.Key), key) {
+					continue
+				}
 				switch event.Type {
 				case client.EventTypePut:
-					if event.IsCreate() { // 新的 key
-						log.Printf("watch a new key[key=%s, val=%s] put\n", event.Kv.Key, event.Kv.Value)
-						lo.Add(string(event.Kv.Value))
-					} else if event.IsModify() { // 已存在的 key 的 val 发生了变化
-						log.Printf("watch a key update[key=%s, new val=%s]\n", event.Kv.Key, event.Kv.Value)
-						if err := lo.Update(string(event.PrevKv.Value), string(event.Kv.Value)); err != nil {
-							return err
-						}
-					}
+					known.Put(string(event.Kv.Key), DecodeInstance(event.Kv.Value))
 				case client.EventTypeDelete:
-					log.Printf("watch a key[key=%s, val=%s] delete\n", event.Kv.Key, event.Kv.Value)
-					if err := lo.Delete(string(event.Kv.Value)); err != nil {
-						return err
-					}
+					// 删除事件中 Kv.Value 为空，Tracker 会使用之前记录的值
+					known.Delete(string(event.Kv.Key))
 				}
 			}
+			if resp.Header.Revision > rev {
+				rev = resp.Header.Revision
+			}
+		}
+	}
+}
+
+// resync 重新获取 key 下的全量数据，并将与 known 的差异同步到负载均衡器中，返回获取数据时的 revision
+func (e *Etcd) resync(ctx context.Context, key string, known *Tracker) (int64, error) {
+	gr, err := e.get(ctx, key, client.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	latest := make(map[string]Instance, len(gr.Kvs))
+	for _, kv := range gr.Kvs {
+		if isInstanceKey(string(kv.Key), key) {
+			latest[string(kv.Key)] = DecodeInstance(kv.Value)
+		}
+	}
+	known.Reset(latest)
+	return gr.Header.Revision, nil
+}
+
+// retry 执行 op，遇到临时错误时按照指数退避进行重试，每次执行都有独立的超时时间，
+// ctx 结束时立即返回
+func (e *Etcd) retry(ctx context.Context, op func(ctx context.Context) error) (err error) {
+	backoff := e.opts.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if e.opts.RequestTimeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, e.opts.RequestTimeout)
+		}
+		err = op(actx)
+		cancel()
+		if err == nil {
+			e.setState(StateConnected, nil)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !isTransient(err) {
+			return err
 		}
+		e.setState(StateDisconnected, err)
+		if attempt >= e.opts.RetryAttempts {
+			return err
+		}
+		log.Printf("registry: etcd request failed: %v, retry after %v\n", err, backoff)
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+		backoff = nextBackoff(backoff, e.opts.MaxRetryBackoff)
+	}
+}
+
+// setState 更新连接状态，只有状态发生变化时才会调用回调
+func (e *Etcd) setState(state State, err error) {
+	e.stateMu.Lock()
+	changed := e.state != state
+	e.state = state
+	e.stateMu.Unlock()
+	if changed && e.opts.OnStateChange != nil {
+		e.opts.OnStateChange(state, err)
+	}
+}
+
+// State 返回当前与 etcd 的连接状态
+func (e *Etcd) State() State {
+	e.stateMu.Lock()
+	defer e.stateMu.Unlock()
+	return e.state
+}
+
+// isTransient 判断 err 是否是临时错误（节点下线、leader 切换、超时等），临时错误可以重试
+func isTransient(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, client.ErrNoAvailableEndpoints),
+		errors.Is(err, rpctypes.ErrNoLeader),
+		errors.Is(err, rpctypes.ErrLeaderChanged),
+		errors.Is(err, rpctypes.ErrTimeout),
+		errors.Is(err, rpctypes.ErrTimeoutDueToLeaderFail),
+		errors.Is(err, rpctypes.ErrTimeoutDueToConnectionLost),
+		errors.Is(err, rpctypes.ErrTooManyRequests):
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+func nextBackoff(cur, max time.Duration) time.Duration {
+	cur *= 2
+	if max > 0 && cur > max {
+		cur = max
+	}
+	return cur
+}
+
+// sleep 等待 d，ctx 提前结束时返回 false
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
 	}
 }
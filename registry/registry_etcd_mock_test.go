@@ -0,0 +1,319 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	client "go.etcd.io/etcd/client/v3"
+)
+
+// mockEtcd 模拟 etcd，可以注入 Get 错误以及控制每次 watch 返回的事件
+type mockEtcd struct {
+	client.KV
+	client.Watcher
+	client.Lease
+
+	mu      sync.Mutex
+	kvs     map[string]string
+	rev     int64
+	getErrs []error // 依次作为 Get 的返回值，用完之后正常返回
+	block   bool    // 为 true 时 Get 一直阻塞到 ctx 结束
+
+	watches chan mockWatch
+}
+
+type mockWatch struct {
+	rev int64
+	ch  chan client.WatchResponse
+}
+
+func newMockEtcd() *mockEtcd {
+	return &mockEtcd{kvs: make(map[string]string), watches: make(chan mockWatch, 10)}
+}
+
+func (m *mockEtcd) Get(ctx context.Context, key string, opts ...client.OpOption) (*client.GetResponse, error) {
+	m.mu.Lock()
+	if m.block {
+		m.mu.Unlock()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if len(m.getErrs) > 0 {
+		err := m.getErrs[0]
+		m.getErrs = m.getErrs[1:]
+		m.mu.Unlock()
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	op := client.OpGet(key, opts...)
+	end := string(op.RangeBytes())
+	resp := &client.GetResponse{Header: &pb.ResponseHeader{Revision: m.rev}}
+	for k, v := range m.kvs {
+		if k == key || end != "" && k >= key && k < end {
+			resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(v)})
+		}
+	}
+	return resp, nil
+}
+
+func (m *mockEtcd) Put(ctx context.Context, key, val string, opts ...client.OpOption) (*client.PutResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kvs[key] = val
+	m.rev++
+	return &client.PutResponse{}, nil
+}
+
+func (m *mockEtcd) Delete(ctx context.Context, key string, opts ...client.OpOption) (*client.DeleteResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.kvs, key)
+	m.rev++
+	return &client.DeleteResponse{}, nil
+}
+
+func (m *mockEtcd) Watch(ctx context.Context, key string, opts ...client.OpOption) client.WatchChan {
+	ch := make(chan client.WatchResponse)
+	m.watches <- mockWatch{rev: client.OpGet(key, opts...).Rev(), ch: ch}
+	return ch
+}
+
+func (m *mockEtcd) Close() error { return nil }
+
+func (m *mockEtcd) set(kvs map[string]string, rev int64) {
+	m.mu.Lock()
+	m.kvs = kvs
+	m.rev = rev
+	m.mu.Unlock()
+}
+
+// recordBalancer 记录 Watch 对负载均衡器的所有修改
+type recordBalancer struct {
+	mu    sync.Mutex
+	addrs map[string]bool
+}
+
+func (r *recordBalancer) Add(addr string) {
+	r.mu.Lock()
+	r.addrs[addr] = true
+	r.mu.Unlock()
+}
+
+func (r *recordBalancer) Update(oldAddr string, newAddr string) error {
+	r.mu.Lock()
+	delete(r.addrs, oldAddr)
+	r.addrs[newAddr] = true
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *recordBalancer) Delete(addr string) error {
+	r.mu.Lock()
+	delete(r.addrs, addr)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *recordBalancer) has(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addrs[addr]
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func putEvent(key, val string) *client.Event {
+	return &client.Event{Type: client.EventTypePut, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(val), CreateRevision: 1, ModRevision: 1}}
+}
+
+func TestEtcdGetRetryTransient(t *testing.T) {
+	m := newMockEtcd()
+	m.set(map[string]string{"/register-servier/order/1": "127.0.0.1:1"}, 1)
+	m.getErrs = []error{rpctypes.ErrNoLeader, rpctypes.ErrTimeoutDueToConnectionLost}
+
+	var mu sync.Mutex
+	var states []State
+	e := newEtcd(m, nil, "", WithRetry(5, time.Millisecond, 10*time.Millisecond),
+		WithStateListener(func(state State, err error) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		}))
+	addrs, err := e.Get(context.Background(), "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1:1" {
+		t.Fatalf("addrs = %v", addrs)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) != 2 || states[0] != StateDisconnected || states[1] != StateConnected {
+		t.Fatalf("states = %v", states)
+	}
+}
+
+func TestEtcdGetNonTransientError(t *testing.T) {
+	m := newMockEtcd()
+	m.getErrs = []error{rpctypes.ErrPermissionDenied, nil}
+	e := newEtcd(m, nil, "", WithRetry(5, time.Millisecond, time.Millisecond))
+	if _, err := e.Get(context.Background(), "order"); !errors.Is(err, rpctypes.ErrPermissionDenied) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestEtcdGetRespectContext(t *testing.T) {
+	m := newMockEtcd()
+	m.block = true
+	e := newEtcd(m, nil, "", WithRequestTimeout(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := e.Get(ctx, "order"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Get did not respect ctx")
+	}
+}
+
+func TestEtcdWatchReestablish(t *testing.T) {
+	const (
+		k1 = "/register-servier/order/1"
+		k2 = "/register-servier/order/2"
+		k3 = "/register-servier/order/3"
+	)
+	m := newMockEtcd()
+	m.set(map[string]string{k1: "a1"}, 10)
+	e := newEtcd(m, nil, "", WithRetry(5, time.Millisecond, time.Millisecond))
+	lb := &recordBalancer{addrs: map[string]bool{"a1": true}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- e.Watch(ctx, "order", lb) }()
+
+	// 第一次 watch 从初始 Get 的下一个 revision 开始
+	w := <-m.watches
+	if w.rev != 11 {
+		t.Fatalf("first watch rev = %v, want 11", w.rev)
+	}
+	w.ch <- client.WatchResponse{Header: pb.ResponseHeader{Revision: 11}, Events: []*client.Event{putEvent(k2, "a2")}}
+	waitFor(t, func() bool { return lb.has("a2") })
+
+	// 节点下线导致 watch channel 关闭，需要从最后看到的 revision 继续
+	close(w.ch)
+	w = <-m.watches
+	if w.rev != 12 {
+		t.Fatalf("rewatch rev = %v, want 12", w.rev)
+	}
+
+	// 历史已经被 compact：重新获取全量数据，k1 被删除，k3 新增
+	m.set(map[string]string{k2: "a2", k3: "a3"}, 20)
+	w.ch <- client.WatchResponse{CompactRevision: 15}
+	w = <-m.watches
+	if w.rev != 21 {
+		t.Fatalf("watch after compaction rev = %v, want 21", w.rev)
+	}
+	if lb.has("a1") || !lb.has("a2") || !lb.has("a3") {
+		t.Fatalf("balancer after resync = %v", lb.addrs)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("watch returned %v", err)
+	}
+}
+
+// TestEtcdLegacyKeys 没有命名空间时使用没有命名空间之前的 key 格式，旧版本注册的实例（值为地址）可以被 GetInstances
+// 和 Watch 发现，其他命名空间中的 key 不会被当作实例
+func TestEtcdLegacyKeys(t *testing.T) {
+	ctx := context.Background()
+	m := newMockEtcd()
+	m.set(map[string]string{
+		"/register-servier/order/1":      "127.0.0.1:1",            // 旧版本注册的实例
+		"/register-servier/order/web/2":  `{"addr":"127.0.0.1:2"}`, // 命名空间 order 中的 web
+		"/register-servier/prod/order/3": `{"addr":"127.0.0.1:3"}`, // 命名空间 prod 中的 order
+	}, 1)
+	e := newEtcd(m, nil, "")
+	e.lease = &client.LeaseGrantResponse{ID: 1}
+
+	ins, err := e.GetInstances(ctx, "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 1 || ins[0].Addr != "127.0.0.1:1" || !ins[0].Serving() {
+		t.Fatalf("instances = %+v, want only the legacy instance", ins)
+	}
+	if services, err := e.ListServices(ctx); err != nil || len(services) != 1 || services[0] != "order" {
+		t.Fatalf("ListServices() = %v, %v", services, err)
+	}
+	reg, err := e.RegisterInstance(ctx, "order", Instance{Addr: "127.0.0.1:4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := reg.(*etcdRegistration).key; !strings.HasPrefix(key, "/register-servier/order/") || strings.Count(key, "/") != 3 {
+		t.Fatalf("registered key = %q, want <prefix>/<serviceName>/<uuid>", key)
+	}
+	prod := newEtcd(m, nil, "", WithNamespace("prod"))
+	if ins, err := prod.GetInstances(ctx, "order"); err != nil || len(ins) != 1 || ins[0].Addr != "127.0.0.1:3" {
+		t.Fatalf("prod instances = %+v, %v", ins, err)
+	}
+
+	lb := &recordBalancer{addrs: map[string]bool{"127.0.0.1:1": true, "127.0.0.1:4": true}}
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- e.Watch(wctx, "order", lb) }()
+	w := <-m.watches
+	w.ch <- client.WatchResponse{Header: pb.ResponseHeader{Revision: 3}, Events: []*client.Event{
+		putEvent("/register-servier/order/web/6", `{"addr":"127.0.0.1:6"}`),
+		putEvent("/register-servier/order/5", "127.0.0.1:5"),
+	}}
+	waitFor(t, func() bool { return lb.has("127.0.0.1:5") })
+	if lb.has("127.0.0.1:6") {
+		t.Fatalf("balancer = %v, instance from namespace order added", lb.addrs)
+	}
+	cancel()
+	<-done
+}
+
+// TestEtcdUnregisterThenSetStatus Unregister 之后通过 Registration 修改状态返回 ErrDeregistered，不会把 key 重新写回
+func TestEtcdUnregisterThenSetStatus(t *testing.T) {
+	ctx := context.Background()
+	m := newMockEtcd()
+	e := newEtcd(m, nil, "")
+	e.lease = &client.LeaseGrantResponse{ID: 1}
+	reg, err := e.RegisterInstance(ctx, "order", Instance{Addr: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Unregister(ctx, "order"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.SetStatus(ctx, StatusDraining); !errors.Is(err, ErrDeregistered) {
+		t.Fatalf("SetStatus() = %v, want ErrDeregistered", err)
+	}
+	if err := reg.SetWeight(ctx, 10); !errors.Is(err, ErrDeregistered) {
+		t.Fatalf("SetWeight() = %v, want ErrDeregistered", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.kvs) != 0 {
+		t.Fatalf("kvs = %v, want none", m.kvs)
+	}
+}
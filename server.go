@@ -8,12 +8,20 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/internal/slowcall"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
 	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport"
 	reuseport "github.com/kavu/go_reuseport"
 )
 
@@ -21,37 +29,110 @@ import (
 var (
 	invalidRequest = struct{}{}
 	typeOfError    = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext  = reflect.TypeOf((*context.Context)(nil)).Elem()
 )
 
+// ErrServerClosed 调用 Shutdown 之后，Serve 会返回该错误
+var ErrServerClosed = errors.New("rpc: server closed")
+
 type Server struct {
-	registerService sync.Map // key: string val: type struct service
-	sendMu          sync.Mutex
-	wg              sync.WaitGroup
-	reqPool         *sync.Pool
-	respPool        *sync.Pool
-	reg             registry.Server
-	addr            string
+	registerService  sync.Map // key: string val: type struct service
+	sendMu           sync.Mutex
+	wg               sync.WaitGroup
+	reqPool          *sync.Pool
+	respPool         *sync.Pool
+	reg              registry.Server
+	registration     registry.Registration // 本实例在注册中心中的注册信息，用于修改状态和注销
+	addr             string
+	interceptors     []Interceptor
+	statsHandlers    []StatsHandler
+	unixPath         string // 不为空时监听 unix socket，见 WithUnixSocket
+	unixMode         os.FileMode
+	transportOpts    []transport.Option
+	transport        *transport.Config // 为 nil 时不修改 socket 选项，见 WithTransport
+	unknownService   RawHandler
+	loadFunc         LoadFunc // 为 nil 时不上报负载，见 WithLoadReport
+	slow             slowConfig
+	slowDetector     *slowcall.Detector // 没有开启慢请求检测时为 nil
+	metadata         map[string]string  // 注册到注册中心的实例 metadata，见 WithInstanceMetadata
+	chunkSize        int                // 见 WithChunking
+	maxBody          int64
+	onConnect        func(remoteAddr net.Addr) (reject bool)
+	onDisconnect     func(remoteAddr net.Addr, err error, stats ConnStats)
+	tapOn            uint32                          // 原子操作，为 1 时开启调试采样，见 SetDebugTap
+	tap              atomic.Value                    // *debugTap
+	ordered          map[string]func(arg any) string // 见 WithOrderedMethod，key: serviceMethod
+	laneCount        int
+	laneDepth        int
+	lanes            []lane         // 没有按 key 顺序执行的方法时为 nil
+	goAwayGrace      time.Duration  // 见 WithGoAwayGrace，< 0 时不发送 GOAWAY
+	writeTimeout     time.Duration  // 见 WithWriteTimeout，<= 0 时不限制
+	frameReadTimeout time.Duration  // 见 WithFrameReadTimeout，<= 0 时不限制
+	peerName         string         // 见 WithPeerName
+	startListener    net.Listener   // 见 WithListener，为 nil 时 Start 监听 addr
+	registerStopped  bool           // 见 WithRegisterStopped
+	bulkheadMu       sync.Mutex     // 只用于 SetBulkhead 的读-改-写
+	bulkheads        atomic.Value   // *bulkheadTable，见 WithBulkhead
+	validators       []ValidateFunc // 见 WithValidator
+
+	mu         sync.Mutex
+	listener   net.Listener
+	conns      map[net.Conn]struct{}     // 所有活跃的连接，Shutdown 时关闭
+	codecs     map[*activeCodec]struct{} // 所有正在读取请求的 codec，Shutdown 时发送 GOAWAY
+	inShutdown int32                     // 原子操作，为 1 时表示正在关闭
+	inflight   int64                     // 原子操作，正在处理的请求数量
 }
 
-func NewServer(ctx context.Context, serviceName, host, port string, reg registry.Server) (*Server, error) {
+func NewServer(ctx context.Context, serviceName, host, port string, reg registry.Server, opts ...ServerOption) (*Server, error) {
 	if reg == nil {
 		panic("register is nil")
 	}
-	s := &Server{}
+	s := &Server{goAwayGrace: DefaultGoAwayGrace}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.slowDetector = s.slow.newDetector()
+	s.newLanes()
 	s.reg = reg
 	s.reqPool = &sync.Pool{New: func() any { return &codec.RequestHeader{} }}
 	s.respPool = &sync.Pool{New: func() any { return &codec.ResponseHeader{} }}
 	s.addr = fmt.Sprintf("%s:%s", host, port)
+	if s.unixPath != "" {
+		s.addr = registry.UnixAddr(s.unixPath)
+	}
+	s.conns = make(map[net.Conn]struct{})
+	if len(s.transportOpts) > 0 {
+		tc, err := transport.New(s.transportOpts...)
+		if err != nil {
+			return nil, err
+		}
+		s.transport = tc
+	}
 	// 同时添加到注册中心
-	if err := s.reg.Register(ctx, serviceName, s.addr); err != nil {
+	ins := registry.Instance{Addr: s.addr, Metadata: s.metadata}
+	if s.registerStopped {
+		ins.Status = registry.StatusStopped
+	}
+	registration, err := s.reg.RegisterInstance(ctx, serviceName, ins)
+	if err != nil {
 		return nil, err
 	}
+	s.registration = registration
 	log.Printf("register [serviceName:%s] to [%s:%v] success, register info: [key:%v value: %v]\n",
 		serviceName, s.reg.Name(), s.reg.Addr(), serviceName, s.addr)
 	return s, nil
 }
 
 func (s *Server) Register(struct_ any) error {
+	return s.register(struct_, "", false)
+}
+
+// RegisterName 同 Register，但是使用 name 作为服务名而不是结构体的类型名，此时结构体不需要可导出
+func (s *Server) RegisterName(name string, struct_ any) error {
+	return s.register(struct_, name, true)
+}
+
+func (s *Server) register(struct_ any, name string, useName bool) error {
 	// 检查 struct_ 是否是一个 struct
 	kind := reflect.TypeOf(struct_).Kind()
 	if kind == reflect.Ptr {
@@ -65,8 +146,11 @@ func (s *Server) Register(struct_ any) error {
 	stype := reflect.TypeOf(struct_)
 	sval := reflect.ValueOf(struct_)
 	sname := reflect.Indirect(sval).Type().Name()
+	if useName {
+		sname = name
+	}
 	// struct 必须可导出
-	if !token.IsExported(sname) {
+	if !useName && !token.IsExported(sname) {
 		errMsg := fmt.Sprintf("rpc.Register: type %v is not exported", stype.String())
 		log.Println(errMsg)
 		return errors.New(errMsg)
@@ -113,11 +197,17 @@ func suitableMethods(typ reflect.Type) map[string]*MethodInfo {
 		mt := method.Type
 		mname := method.Name
 		paramNum := mt.NumIn()
-		// 标准格式的 func 需要有三个参数：接收者，request，response
-		if paramNum != 3 {
+		// 标准格式的 func 需要有三个参数：接收者，request，response，也可以在 request 之前
+		// 加上一个 context.Context 参数，用来获取 request id 等请求的信息
+		withContext := paramNum == 4 && mt.In(1) == typeOfContext
+		if paramNum != 3 && !withContext {
 			log.Printf("rpc.Register: method %q has %d input parameters; needs exactly three\n", mname, paramNum)
 			continue
 		}
+		in := 1
+		if withContext {
+			in = 2
+		}
 		// 标准格式的 func 需要有一个 error 类型的返回值
 		returnNum := mt.NumOut()
 		if returnNum != 1 {
@@ -125,7 +215,7 @@ func suitableMethods(typ reflect.Type) map[string]*MethodInfo {
 			continue
 		}
 
-		argType := mt.In(1)
+		argType := mt.In(in)
 		// 第一个参数必须可导出
 		if !isExportedOrBuiltinType(argType) {
 			log.Printf("rpc.Register: argument type of method %q is not exported: %q\n", mname, argType)
@@ -133,7 +223,7 @@ func suitableMethods(typ reflect.Type) map[string]*MethodInfo {
 		}
 
 		// 标准格式的 func 第二个参数（response）必须为指针类型
-		replyType := mt.In(2)
+		replyType := mt.In(in + 1)
 		if replyType.Kind() != reflect.Ptr {
 			log.Printf("rpc.Register: reply type of method %q is not a pointer: %q\n", mname, replyType)
 			continue
@@ -150,9 +240,10 @@ func suitableMethods(typ reflect.Type) map[string]*MethodInfo {
 		}
 		log.Printf("rpc.Register: method name: %v\n", mname)
 		methods[mname] = &MethodInfo{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+			method:      method,
+			ArgType:     argType,
+			ReplyType:   replyType,
+			withContext: withContext,
 		}
 	}
 	return methods
@@ -169,16 +260,74 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return token.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
+// RequestIDFromContext 返回 handler 的 ctx 中本次请求的 request id，handler 使用同一个 ctx
+// 调用下游服务时会沿用这个 request id
+func RequestIDFromContext(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return md.Get(metadata.RequestIDKey)
+}
+
+// Registration 返回本实例在注册中心中的注册信息，可以用来修改实例的状态（比如 DRAINING）
+func (s *Server) Registration() registry.Registration {
+	return s.registration
+}
+
+// WithTransport Serve 接收的连接使用的 socket 选项，见 transport.Option。选项不合法或者当前平台不支持时
+// NewServer 返回错误，和 listener 的类型不符（比如 unix socket 设置了 nodelay）时 Serve 返回错误
+func WithTransport(opts ...transport.Option) ServerOption {
+	return func(s *Server) {
+		s.transportOpts = append(s.transportOpts, opts...)
+	}
+}
+
+// WithInstanceMetadata 注册到注册中心的实例带有 kv 中的 metadata，比如 registry.MetadataZone、
+// registry.MetadataVersion，客户端的负载均衡器据此选择实例。多次调用时合并，相同的 key 使用后面的值
+func WithInstanceMetadata(kv map[string]string) ServerOption {
+	return func(s *Server) {
+		if s.metadata == nil {
+			s.metadata = make(map[string]string, len(kv))
+		}
+		for k, v := range kv {
+			s.metadata[k] = v
+		}
+	}
+}
+
 func (s *Server) RunWithTCP() error {
 	listen, err := reuseport.Listen("tcp", s.addr)
 	//listen, err := net.Listen("tcp", fmt.Sprintf("%s:%s", host, port))
 	if err != nil {
 		return err
 	}
+	return s.Serve(listen)
+}
+
+// Serve 在 lis 上接收连接并处理请求，直到调用 Shutdown，此时返回 ErrServerClosed
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.shuttingDown() {
+		s.mu.Unlock()
+		lis.Close()
+		return ErrServerClosed
+	}
+	if s.transport != nil {
+		tl, err := s.transport.Listener(lis)
+		if err != nil {
+			s.mu.Unlock()
+			lis.Close()
+			return err
+		}
+		lis = tl
+	}
+	s.listener = lis
+	s.mu.Unlock()
 
 	for {
-		conn, err := listen.Accept()
+		conn, err := lis.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			log.Println(err)
 			continue
 		}
@@ -186,45 +335,222 @@ func (s *Server) RunWithTCP() error {
 	}
 }
 
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) == 1
+}
+
 func (s *Server) serverConn(conn net.Conn) {
-	c := codec.NewGobServerCodec(conn)
-	s.ServerCodec(c)
+	if !s.acceptConn(conn) {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	if s.shuttingDown() {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	cc := codec.NewCountConn(conn)
+	peer := newPeer(conn)
+	c := s.newServerCodec(cc)
+	peer.codec = c
+	ctx := context.WithValue(context.Background(), peerKey{}, peer)
+	s.setFrameReadTimeout(c, cc)
+	requests, badRequests, err := s.serveCodec(ctx, c, cc)
+	if s.onDisconnect == nil {
+		return
+	}
+	switch {
+	case s.shuttingDown():
+		err = ErrServerClosed
+	case err == io.EOF:
+		err = nil
+	}
+	stats := ConnStats{Duration: time.Since(start), Requests: requests, BadRequests: badRequests, BytesRead: cc.BytesRead(), BytesWritten: cc.BytesWritten()}
+	runHook("OnDisconnect", func() { s.onDisconnect(conn.RemoteAddr(), err, stats) })
+}
+
+// newServerCodec 根据连接的第一个字节选择协议：二进制协议的 preface 或者 gob
+func (s *Server) newServerCodec(cc *codec.CountConn) codec.ServerCodec {
+	if b, err := cc.Peek(1); err == nil && codec.IsBinaryPreface(b[0]) {
+		return codec.NewBinaryServerCodec(cc, codec.WithServerChunking(s.chunkSize, s.maxBody), codec.WithServerPeerName(s.peerName))
+	}
+	return codec.NewGobServerCodec(cc)
+}
+
+// shutdownPollInterval Shutdown 检查正在处理的请求是否已经完成的间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown 优雅地关闭 server：先将实例状态设置为 DRAINING，使客户端不再选择该实例，然后停止
+// 接收新的连接并向每个连接发送 GOAWAY（见 WithGoAwayGrace），等待正在处理的请求完成（或者 ctx 结束）
+// 后关闭所有连接，最后从注册中心中注销
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.inShutdown, 0, 1) {
+		return ErrServerClosed
+	}
+	if s.registration != nil {
+		// 已经由 Lifecycle 注销（见 registry.Registration.Stop）时不需要再修改状态
+		if err := s.registration.SetStatus(ctx, registry.StatusDraining); err != nil && !errors.Is(err, registry.ErrDeregistered) {
+			log.Println("rpc server: set draining status error: ", err)
+		}
+	}
+
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	// 通知客户端不再发起新的调用，已经发出的调用都收到响应后由客户端关闭连接
+	goAway := time.Now()
+	if s.goAwayGrace >= 0 {
+		s.goAwayAll(ctx)
+	}
+
+	var err error
+	ticker := time.NewTicker(shutdownPollInterval)
+	for (atomic.LoadInt64(&s.inflight) > 0 || s.awaitingClose(goAway)) && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	ticker.Stop()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	if s.registration != nil {
+		// ctx 可能已经结束，注销使用独立的超时时间，保证实例不会残留在注册中心中
+		dctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if derr := s.registration.Deregister(dctx); derr != nil && err == nil {
+			err = derr
+		}
+		cancel()
+	}
+	return err
 }
 
 // ServerCodec 使用长连接的方式来处理 client 的请求
 func (s *Server) ServerCodec(c codec.ServerCodec) {
+	s.serveCodec(context.Background(), c, nil)
+}
+
+// serveCodec 同 ServerCodec，cc 不为 nil 时用来统计每个请求和响应的大小，每个请求的 ctx 都派生自 connCtx，
+// 连接断开后取消，正在处理的请求的结果已经无法发送给客户端。返回读取到的请求数、其中无法解码的请求数和结束读取的错误
+func (s *Server) serveCodec(connCtx context.Context, c codec.ServerCodec, cc *codec.CountConn) (requests, badRequests int64, err error) {
+	connCtx, cancel := context.WithCancel(connCtx)
+	defer cancel()
 	sendLock := new(sync.Mutex)
+	defer s.untrackCodec(s.trackCodec(c, cc, sendLock))
 	wg := new(sync.WaitGroup)
 	for {
 		// 读取 request
-		service, mtype, req, argv, replyv, keepReading, err := s.readRequest(c)
-		if err != nil {
-			if err != io.EOF {
-				log.Println("rpc: ", err)
+		start := time.Now()
+		var read int64
+		if cc != nil {
+			read = cc.BytesRead()
+		}
+		tapBuf := s.tapRead(cc)
+		service, mtype, req, argv, replyv, keepReading, rerr := s.readRequest(c)
+		if keepReading {
+			requests++
+		}
+		var n int64
+		if cc != nil {
+			n = cc.BytesRead() - read
+		}
+		received := readSize(c, n)
+		if tapBuf != nil {
+			s.tapRequest(connCtx, tapBuf, cc, req, received, start)
+		}
+		queued := time.Now()
+		if rerr != nil {
+			if rerr != io.EOF {
+				log.Println("rpc: ", rerr)
+			}
+			if st, ok := badRequest(rerr); ok {
+				badRequests++
+				rerr = st
 			}
 			// keepReading 为 false 时，说明 err 为 EOF，即对方已断开连接
 			if !keepReading {
+				err = rerr
 				break
 			}
 			if req != nil {
 				// 回应错误信息
-				s.sendResponse(sendLock, req, c, invalidRequest, err.Error())
+				s.sendResponse(sendLock, req, c, cc, invalidRequest, rerr, nil, start, received)
 				req.Reset()
 				s.reqPool.Put(req)
 			}
 			continue
 		}
 		wg.Add(1)
-		go service.call(s, sendLock, wg, mtype, c, req, argv, replyv)
+		atomic.AddInt64(&s.inflight, 1)
+		// 按 key 顺序执行的请求在读取的 goroutine 中加入执行队列，保证按照到达的顺序执行
+		if l := s.laneOf(req.ServiceMethod, argv.Interface()); l != nil {
+			task := func() {
+				service.call(s, connCtx, sendLock, wg, mtype, c, cc, req, argv, replyv, start, queued, received)
+			}
+			if service == nil {
+				handler := s.rawHandler(req.ServiceMethod)
+				task = func() {
+					s.handle(connCtx, sendLock, wg, c, cc, req, handler, argv.Interface(), replyv.Interface(), start, queued, received)
+				}
+			}
+			if !l.push(task, s.laneDepth) {
+				wg.Done()
+				atomic.AddInt64(&s.inflight, -1)
+				s.sendResponse(sendLock, req, c, cc, invalidRequest, laneFullError(req.ServiceMethod, s.laneDepth), nil, start, received)
+				req.Reset()
+				s.reqPool.Put(req)
+			}
+			continue
+		}
+		if service == nil {
+			go s.handle(connCtx, sendLock, wg, c, cc, req, s.rawHandler(req.ServiceMethod), argv.Interface(), replyv.Interface(), start, queued, received)
+			continue
+		}
+		go service.call(s, connCtx, sendLock, wg, mtype, c, cc, req, argv, replyv, start, queued, received)
 	}
+	cancel()
 	wg.Wait()
 	c.Close()
+	if cc != nil {
+		s.tapConnDone(cc)
+	}
+	return requests, badRequests, err
 }
 
 func (s *Server) readRequestHeader(c codec.ServerCodec) (svc *service, mtype *MethodInfo, req *codec.RequestHeader, keepReading bool, err error) {
 	req = s.reqPool.Get().(*codec.RequestHeader)
 	var errMsg string
 	if err = c.ReadRequestHeader(req); err != nil {
+		var me *codec.MessageError
+		if errors.As(err, &me) {
+			// 完整的 frame 无法解码，codec 已经跳过了它，只有这个请求失败。无法知道 seq 时没有办法回应
+			req.Reset()
+			if !me.SeqKnown {
+				s.reqPool.Put(req)
+				return nil, nil, nil, true, err
+			}
+			req.Seq = me.Seq
+			return nil, nil, req, true, err
+		}
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			errMsg = fmt.Sprintf("rcp server: read header error: %v", err.Error())
 			log.Println(errMsg)
@@ -232,7 +558,7 @@ func (s *Server) readRequestHeader(c codec.ServerCodec) (svc *service, mtype *Me
 		}
 		// 如果读取错误为 EOF，说明对方已断开连接，此时 keepReading 返回 false，使得最外层的
 		// serverCodec 的 for {} 可以被终止
-		return nil, nil, nil, false, errors.New(errMsg)
+		return nil, nil, nil, false, err
 	}
 	log.Printf("request head: %+v \n", req)
 
@@ -241,7 +567,7 @@ func (s *Server) readRequestHeader(c codec.ServerCodec) (svc *service, mtype *Me
 	keepReading = true
 	dot := strings.LastIndex(req.ServiceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc: service/method request ill-formed: " + req.ServiceMethod)
+		err = status.New(status.InvalidArgument, "rpc: service/method request ill-formed: "+req.ServiceMethod)
 		return
 	}
 	// 解析出服务名和方法名
@@ -249,14 +575,18 @@ func (s *Server) readRequestHeader(c codec.ServerCodec) (svc *service, mtype *Me
 	methodName := req.ServiceMethod[dot+1:]
 	ser, ok := s.registerService.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc: can't find service " + req.ServiceMethod)
+		if s.unknownService != nil {
+			// svc 为 nil，由 unknownService 处理
+			return
+		}
+		err = status.New(status.Unimplemented, "rpc: can't find service "+req.ServiceMethod)
 		return
 	}
 	svc = ser.(*service)
 	// 获取方法的相关信息
 	mtype = svc.methods[methodName]
 	if mtype == nil {
-		err = errors.New("rpc: can't find method " + req.ServiceMethod)
+		err = status.New(status.Unimplemented, "rpc: can't find method "+req.ServiceMethod)
 	}
 	return
 }
@@ -273,6 +603,14 @@ func (s *Server) readRequest(c codec.ServerCodec) (service *service, mtype *Meth
 		c.ReadRequestBody(nil)
 		return
 	}
+	if service == nil {
+		raw := new(codec.RawMessage)
+		if err = c.ReadRequestBody(raw); err != nil {
+			err = bodyError(err)
+			return
+		}
+		return nil, nil, req, reflect.ValueOf(raw), reflect.ValueOf(new(codec.RawMessage)), true, nil
+	}
 
 	var isValue bool
 	// 构造 arg 和 reply
@@ -289,6 +627,7 @@ func (s *Server) readRequest(c codec.ServerCodec) (service *service, mtype *Meth
 
 	if err = c.ReadRequestBody(argv.Interface()); err != nil {
 		log.Println("rpc server: read argv err: ", err)
+		err = bodyError(err)
 	}
 	// 如果用户传入的 argv 是值类型
 	if isValue {
@@ -308,12 +647,176 @@ func (s *Server) readRequest(c codec.ServerCodec) (service *service, mtype *Meth
 	return
 }
 
-func (s *Server) sendResponse(sendLock *sync.Mutex, req *codec.RequestHeader, c codec.ServerCodec, reply any, errMsg string) {
+// bodyError 转换读取请求 body 的错误，拆分传输的 body 超过 WithChunking 的 maxBody 时只有这个请求失败
+func bodyError(err error) error {
+	if errors.Is(err, codec.ErrBodyTooLarge) {
+		return status.New(status.ResourceExhausted, err.Error())
+	}
+	return err
+}
+
+// responseMetadata handler 和拦截器通过 SetResponseMetadata 设置的响应 metadata
+type responseMetadata struct {
+	mu sync.Mutex
+	md metadata.MD
+}
+
+type responseMetadataKey struct{}
+
+// SetResponseMetadata 在 handler 或者拦截器中调用，kv 会随响应发送给客户端，客户端通过
+// client.WithResponseMetadata 获取。ctx 不是 handler 的 ctx 时返回 false
+func SetResponseMetadata(ctx context.Context, kv ...string) bool {
+	r, ok := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	if !ok {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.md == nil {
+		r.md = make(metadata.MD)
+	}
+	for k, v := range metadata.Pairs(kv...) {
+		r.md[k] = v
+	}
+	return true
+}
+
+// responseMetadataFromContext 返回 handler 的 ctx 中设置的响应 metadata
+func responseMetadataFromContext(ctx context.Context) metadata.MD {
+	r, ok := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	if !ok {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.md.Copy()
+}
+
+// handlerContext 返回传给 handler 的 ctx，派生自连接的 connCtx，其中带有请求的 metadata，客户端设置了
+// 超时时间时，从开始读取请求的时间 start 算起设置相同的超时时间
+func handlerContext(connCtx context.Context, req *codec.RequestHeader, start time.Time) (context.Context, context.CancelFunc) {
+	md := metadata.MD(req.Metadata)
+	ctx := metadata.NewIncomingContext(connCtx, md)
+	ctx = context.WithValue(ctx, responseMetadataKey{}, &responseMetadata{})
+	if timeout, err := time.ParseDuration(md.Get(metadata.TimeoutKey)); err == nil {
+		return context.WithDeadline(ctx, start.Add(timeout))
+	}
+	return context.WithCancel(ctx)
+}
+
+// handle 执行 handler 并发送响应，ctx 中带有请求的 metadata 和 deadline，handler 使用同一个 ctx 调用下游服务时
+// 会沿用 request id 和 deadline
+func (s *Server) handle(connCtx context.Context, sendLock *sync.Mutex, wg *sync.WaitGroup, c codec.ServerCodec, cc *codec.CountConn,
+	req *codec.RequestHeader, handler Handler, arg, reply any, start, queued time.Time, received codec.MessageSize) (sent codec.MessageSize) {
+	if wg != nil {
+		defer wg.Done()
+	}
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	ctx, cancel := handlerContext(connCtx, req, start)
+	defer cancel()
+	info := &ServerInfo{ServiceMethod: req.ServiceMethod, RequestID: metadata.MD(req.Metadata).Get(metadata.RequestIDKey), Queued: queued}
+	for _, h := range s.statsHandlers {
+		ctx = h.TagRPC(ctx, info)
+	}
+	// 等待 bulkhead 的时间不计入 handler 的执行时间
+	b := s.bulkheadOf(info.ServiceMethod)
+	err := b.acquire(ctx, info.ServiceMethod)
+	var invoked time.Time
+	if s.slowDetector != nil {
+		invoked = time.Now()
+	}
+	if err == nil {
+		err = s.invoke(ctx, info, handler, arg, reply)
+		b.release()
+	}
+	var handled time.Time
+	if s.slowDetector != nil {
+		handled = time.Now()
+	}
+	sent, wrote := s.sendResponse(sendLock, req, c, cc, reply, err, responseMetadataFromContext(ctx), start, received)
+	if s.slowDetector != nil {
+		s.checkSlow(info, start, invoked, handled, wrote, err)
+	}
+	if len(s.statsHandlers) > 0 {
+		stats := &ServerStats{
+			ServiceMethod: info.ServiceMethod,
+			RequestID:     info.RequestID,
+			Start:         start,
+			End:           wrote,
+			BytesReceived: received.Total(),
+			BytesSent:     sent.Total(),
+			Received:      received,
+			Sent:          sent,
+			Err:           err,
+		}
+		for _, h := range s.statsHandlers {
+			h.HandleRPC(ctx, stats)
+		}
+	}
+	req.Reset()
+	s.reqPool.Put(req)
+	return sent
+}
+
+// invoke 依次执行拦截器和 handler，handler 或者拦截器 panic 时将其转换为错误返回，不会导致整个进程退出
+func (s *Server) invoke(ctx context.Context, info *ServerInfo, handler Handler, arg, reply any) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rpc: panic in %v: %v\n%s", info.ServiceMethod, r, debug.Stack())
+			err = &PanicError{ServiceMethod: info.ServiceMethod, Value: r}
+		}
+	}()
+	return chainInterceptors(s.interceptors, info, handler)(ctx, arg, reply)
+}
+
+// errorStatus 将 handler 返回的错误转换为发送给客户端的 *status.Status：没有错误码的错误使用 Internal，
+// ctx 的错误使用 Canceled 或者 DeadlineExceeded
+func errorStatus(err error) *status.Status {
+	if st, ok := status.FromError(err); ok {
+		return st
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err)
+	}
+	return status.New(status.Internal, err.Error())
+}
+
+// readSize 返回刚读取的请求的大小，codec 没有实现 codec.SizeReporter 时使用连接上读取的字节数 n
+func readSize(c codec.ServerCodec, n int64) codec.MessageSize {
+	if r, ok := c.(codec.SizeReporter); ok {
+		return r.LastReadSize()
+	}
+	return codec.UnknownSize(n)
+}
+
+// sendResponse 发送响应并记录 access log，start 为开始读取请求的时间，received 为请求的大小，返回给客户端的错误中
+// 会带上 request id，md 为随响应发送的 metadata。返回响应的大小（codec 没有实现 codec.SizeReporter 并且
+// cc 为 nil 时为零值）以及响应写入完成的时间
+func (s *Server) sendResponse(sendLock *sync.Mutex, req *codec.RequestHeader, c codec.ServerCodec, cc *codec.CountConn, reply any, err error, md metadata.MD, start time.Time, received codec.MessageSize) (sent codec.MessageSize, wrote time.Time) {
+	var st *status.Status
+	var errMsg string
+	if err != nil {
+		st = errorStatus(err)
+		errMsg = st.Error()
+	}
+	requestID := req.Metadata[metadata.RequestIDKey]
+
 	respHeader := s.respPool.Get().(*codec.ResponseHeader)
 	respHeader.ServiceMethod = req.ServiceMethod
 	respHeader.Seq = req.Seq
-	if errMsg != "" {
+	if len(md) > 0 {
+		respHeader.Metadata = md
+	}
+	respHeader.Load = s.loadReport()
+	if st != nil {
+		// 错误可能来自同一个 request id 的下游调用，此时已经带有 request id
+		if requestID != "" && !strings.Contains(errMsg, requestID) {
+			errMsg = fmt.Sprintf("%s (request id: %s)", errMsg, requestID)
+		}
 		respHeader.Error = errMsg
+		respHeader.Code = uint32(st.Code())
+		respHeader.Details = st.Details()
 		reply = invalidRequest
 	}
 	// 加锁的作用？
@@ -322,12 +825,32 @@ func (s *Server) sendResponse(sendLock *sync.Mutex, req *codec.RequestHeader, c
 	// goroutine 也在往同一个缓冲区写入，从而导致 err: short write 的错误
 	// 听起来挺有道理的，但是我测试没有出现过这个错误，而是 EOF
 	sendLock.Lock()
+	var written int64
+	if cc != nil {
+		written = cc.BytesWritten()
+	}
+	tapped, tapBuf := s.tapResponse(cc, req.Seq)
+	s.setWriteDeadline(cc)
 	if err := c.WriteResponse(respHeader, reply); err != nil {
 		log.Println("rpc server: write response err: ", err)
+		closeOnWriteTimeout(cc, err)
+	}
+	if r, ok := c.(codec.SizeReporter); ok {
+		sent = r.LastWriteSize()
+	} else if cc != nil {
+		sent = codec.UnknownSize(cc.BytesWritten() - written)
+	}
+	if tapped != nil {
+		s.tapResponseDone(cc, tapped, tapBuf, sent)
 	}
 	sendLock.Unlock()
+	sent = sent.Add(s.writeFragments(sendLock, c, cc, req.Seq))
+	wrote = time.Now()
+	log.Printf("rpc: access method=%v request_id=%v latency=%v req_bytes=%d resp_bytes=%d error=%q\n",
+		req.ServiceMethod, requestID, wrote.Sub(start), received.Total(), sent.Total(), errMsg)
 	log.Println("send ok")
 	// 重新放到对象池中复用
 	respHeader.Reset()
 	s.respPool.Put(respHeader)
+	return sent, wrote
 }
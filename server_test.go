@@ -1,8 +1,21 @@
 package appleseed
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/loadbalance"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
 )
 
 func init() {
@@ -39,3 +52,214 @@ func TestServer(t *testing.T) {
 //	c.ReadBody(reply)
 //	log.Println("reply: ", reply)
 //}
+
+// startServer 在随机端口上启动一个注册到 reg 的 server
+func startServer(t *testing.T, reg registry.Server, serviceName string) *Server {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := NewServer(context.Background(), serviceName, "127.0.0.1", port, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	return s
+}
+
+func dialClient(t *testing.T, addr string) *client.Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.NewClient(conn, addr)
+}
+
+func TestDrainingInstanceNotSelected(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	a := startServer(t, reg, "drain")
+	b := startServer(t, reg, "drain")
+	clients := map[string]*client.Client{a.addr: dialClient(t, a.addr), b.addr: dialClient(t, b.addr)}
+
+	// 在 a 上发起一个慢请求，之后将 a 设置为 DRAINING
+	slow := clients[a.addr].Go(ctx, "XXX.TimeoutFunc", &Args{RunTime: 200 * time.Millisecond}, &Reply{}, nil)
+	time.Sleep(20 * time.Millisecond)
+	if err := a.Registration().SetStatus(ctx, registry.StatusDraining); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		addr, err := client.GetServerAddr(ctx, reg, &loadbalance.RoundRobin{}, "drain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != b.addr {
+			t.Fatalf("draining instance %v selected", addr)
+		}
+		var reply Reply
+		if err := clients[addr].Call(ctx, "XXX.Add", &Args{X: 1, Y: 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 处于 DRAINING 状态的实例仍然可以被观察到
+	ins, err := reg.GetInstances(ctx, "drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 2 {
+		t.Fatalf("instances = %v", ins)
+	}
+
+	call := <-slow.Done
+	if call.Error != nil {
+		t.Fatalf("in-flight call on draining instance failed: %v", call.Error)
+	}
+	if call.Reply.(*Reply).Str != "DONE." {
+		t.Fatalf("reply = %+v", call.Reply)
+	}
+}
+
+func TestShutdownDrainsAndDeregisters(t *testing.T) {
+	ctx := context.Background()
+	reg := memory.New(nil)
+	s := startServer(t, reg, "shutdown")
+	cli := dialClient(t, s.addr)
+
+	slow := cli.Go(ctx, "XXX.TimeoutFunc", &Args{RunTime: 200 * time.Millisecond}, &Reply{}, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- s.Shutdown(ctx) }()
+
+	// Shutdown 等待请求完成期间，实例处于 DRAINING 状态
+	time.Sleep(50 * time.Millisecond)
+	ins, _ := reg.GetInstances(ctx, "shutdown")
+	if len(ins) != 1 || ins[0].Status != registry.StatusDraining {
+		t.Fatalf("instances during shutdown = %v", ins)
+	}
+
+	if call := <-slow.Done; call.Error != nil {
+		t.Fatalf("in-flight call failed: %v", call.Error)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Fatal(err)
+	}
+	if ins, _ := reg.GetInstances(ctx, "shutdown"); len(ins) != 0 {
+		t.Fatalf("instance not deregistered: %v", ins)
+	}
+}
+
+// syncWriter 并发安全的 log 输出
+type syncWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *syncWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// Hop 将请求转发给 next，最后一跳返回收到的 request id
+type Hop struct {
+	next string
+}
+
+func (h *Hop) Forward(ctx context.Context, fail *bool, reply *string) error {
+	if h.next == "" {
+		if *fail {
+			return errors.New("hop failed")
+		}
+		*reply = RequestIDFromContext(ctx)
+		return nil
+	}
+	conn, err := net.Dial("tcp", h.next)
+	if err != nil {
+		return err
+	}
+	cli := client.NewClient(conn, h.next)
+	defer cli.Close()
+	return cli.Call(ctx, "Hop.Forward", fail, reply)
+}
+
+func startHop(t *testing.T, reg registry.Server, next string) *Server {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := NewServer(context.Background(), "hop", "127.0.0.1", port, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(&Hop{next: next}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	logs := new(syncWriter)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	reg := memory.New(nil)
+	b := startHop(t, reg, "")
+	a := startHop(t, reg, b.addr)
+	cli := dialClient(t, a.addr)
+	defer cli.Close()
+
+	// client -> a -> b，b 收到的 request id 与 client 设置的相同
+	ctx := client.WithRequestID(context.Background(), "req-123")
+	if id := client.RequestIDFromContext(ctx); id != "req-123" {
+		t.Fatalf("client.RequestIDFromContext() = %q", id)
+	}
+	fail, reply := false, ""
+	if err := cli.Call(ctx, "Hop.Forward", &fail, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "req-123" {
+		t.Fatalf("request id at last hop = %q, want req-123", reply)
+	}
+	if n := strings.Count(logs.String(), "method=Hop.Forward request_id=req-123 "); n != 2 {
+		t.Fatalf("access log of req-123 appears %d times, want 2:\n%v", n, logs)
+	}
+
+	// 返回给 client 的错误中带有 request id，且只出现一次
+	fail = true
+	err := cli.Call(ctx, "Hop.Forward", &fail, &reply)
+	if err == nil || err.Error() != "hop failed (request id: req-123)" {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 没有设置 request id 时由 client 生成
+	fail = false
+	call := <-cli.Go(context.Background(), "Hop.Forward", &fail, &reply, nil).Done
+	if call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if call.RequestID == "" || reply != call.RequestID {
+		t.Fatalf("generated request id %q, last hop got %q", call.RequestID, reply)
+	}
+	if n := strings.Count(logs.String(), "request_id="+call.RequestID+" "); n != 2 {
+		t.Fatalf("access log of %v appears %d times, want 2", call.RequestID, n)
+	}
+}
@@ -1,10 +1,13 @@
 package appleseed
 
 import (
-	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"context"
 	"log"
 	"reflect"
 	"sync"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
 )
 
 // service 可以理解为是一个对象，它的方法被会被注册到 rpc 中，客户可以调用通过 "对象.方法"
@@ -22,24 +25,59 @@ type MethodInfo struct {
 	ArgType   reflect.Type
 	ReplyType reflect.Type
 	callNum   uint64
+
+	bytesReceived int64 // 所有请求在连接上的大小，和 callNum 一样由 Mutex 保护
+	bytesSent     int64 // 所有响应在连接上的大小
+
+	withContext bool // 方法的第一个参数是否为 context.Context
 }
 
-func (s *service) call(srv *Server, sendLock *sync.Mutex, wg *sync.WaitGroup, method *MethodInfo, c codec.ServerCodec, req *codec.RequestHeader, argv, replyv reflect.Value) {
-	if wg != nil {
-		defer wg.Done()
-	}
+func (s *service) call(srv *Server, connCtx context.Context, sendLock *sync.Mutex, wg *sync.WaitGroup, method *MethodInfo, c codec.ServerCodec, cc *codec.CountConn,
+	req *codec.RequestHeader, argv, replyv reflect.Value, start, queued time.Time, received codec.MessageSize) {
 	method.Lock()
 	method.callNum++
 	method.Unlock()
 
-	returnValues := method.method.Func.Call([]reflect.Value{s.val, argv, replyv})
-	log.Println("after call, reply value: ", replyv.Interface())
-	var errMsg string
-	errRet := returnValues[0].Interface()
-	if errRet != nil {
-		errMsg = errRet.(error).Error()
+	serviceMethod := req.ServiceMethod
+	handler := func(ctx context.Context, arg, reply any) error {
+		if err := srv.validate(ctx, serviceMethod, arg); err != nil {
+			return err
+		}
+		in := []reflect.Value{s.val, reflect.ValueOf(arg), reflect.ValueOf(reply)}
+		if method.withContext {
+			in = []reflect.Value{s.val, reflect.ValueOf(ctx), reflect.ValueOf(arg), reflect.ValueOf(reply)}
+		}
+		returnValues := method.method.Func.Call(in)
+		log.Println("after call, reply value: ", reply)
+		err, _ := returnValues[0].Interface().(error)
+		return err
 	}
-	srv.sendResponse(sendLock, req, c, replyv.Interface(), errMsg)
-	req.Reset()
-	srv.reqPool.Put(req)
+	sent := srv.handle(connCtx, sendLock, wg, c, cc, req, handler, argv.Interface(), replyv.Interface(), start, queued, received)
+	method.Lock()
+	method.bytesReceived += received.Total()
+	method.bytesSent += sent.Total()
+	method.Unlock()
+}
+
+// MethodStats 一个方法的累计统计
+type MethodStats struct {
+	Calls         uint64 // 调用次数，包括正在处理的调用
+	BytesReceived int64  // 所有请求在连接上的大小
+	BytesSent     int64  // 所有响应在连接上的大小
+}
+
+// MethodStats 返回每个注册的方法的累计统计，key 为 "Service.Method"。未知服务的 RawHandler 处理的请求不计入，
+// 否则任意的方法名都会占用一项
+func (s *Server) MethodStats() map[string]MethodStats {
+	stats := make(map[string]MethodStats)
+	s.registerService.Range(func(_, v any) bool {
+		svc := v.(*service)
+		for name, m := range svc.methods {
+			m.Lock()
+			stats[svc.name+"."+name] = MethodStats{Calls: m.callNum, BytesReceived: m.bytesReceived, BytesSent: m.bytesSent}
+			m.Unlock()
+		}
+		return true
+	})
+	return stats
 }
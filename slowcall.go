@@ -0,0 +1,97 @@
+package appleseed
+
+import (
+	"log"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/internal/slowcall"
+)
+
+// SlowCall 一次耗时超过阈值的请求
+type SlowCall struct {
+	ServiceMethod string
+	RequestID     string
+	Elapsed       time.Duration // 从开始读取请求到响应写入完成的时间
+	Handler       time.Duration // handler（包括拦截器）执行的时间
+	// Write 从 handler 返回到响应写入完成的时间，包括等待同一连接上其他响应写入的时间，
+	// 明显大于 Handler 时说明瓶颈在连接的写入（客户端读取慢或者网络拥塞）而不是计算
+	Write     time.Duration
+	Threshold time.Duration
+	Err       error // handler 返回的错误
+}
+
+// slowConfig 慢请求检测的配置，NewServer 时据此创建 slowcall.Detector
+type slowConfig struct {
+	threshold time.Duration
+	methods   map[string]time.Duration
+	logLimit  int
+	handler   func(SlowCall)
+}
+
+// WithSlowCallThreshold 耗时超过 d 的请求会被记录到日志中，包括方法、request id、总耗时以及 handler
+// 和写入响应各自的耗时。日志的数量受 WithSlowCallLogLimit 限制
+func WithSlowCallThreshold(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.slow.threshold = d
+	}
+}
+
+// WithMethodSlowCallThreshold 为 serviceMethod 单独指定阈值，覆盖 WithSlowCallThreshold，
+// d <= 0 时不检测该方法
+func WithMethodSlowCallThreshold(serviceMethod string, d time.Duration) ServerOption {
+	return func(s *Server) {
+		if s.slow.methods == nil {
+			s.slow.methods = make(map[string]time.Duration)
+		}
+		s.slow.methods[serviceMethod] = d
+	}
+}
+
+// WithSlowCallLogLimit 每秒最多输出 n 条慢请求日志，超出的日志被丢弃，丢弃的数量会在下一条日志中给出。
+// 默认为 10
+func WithSlowCallLogLimit(n int) ServerOption {
+	return func(s *Server) {
+		s.slow.logLimit = n
+	}
+}
+
+// WithSlowCallHandler 使用 f 代替日志处理慢请求，每个慢请求都会调用 f，不受 WithSlowCallLogLimit 限制。
+// f 在处理请求的 goroutine 中调用，不能阻塞
+func WithSlowCallHandler(f func(SlowCall)) ServerOption {
+	return func(s *Server) {
+		s.slow.handler = f
+	}
+}
+
+// newDetector 没有设置任何阈值时返回 nil
+func (c *slowConfig) newDetector() *slowcall.Detector {
+	if c.threshold <= 0 && len(c.methods) == 0 {
+		return nil
+	}
+	return slowcall.New(c.threshold, c.methods, c.logLimit)
+}
+
+// checkSlow 响应写入后检查是否为慢请求，invoked、handled 分别为 handler 开始和结束的时间
+func (s *Server) checkSlow(info *ServerInfo, start, invoked, handled, wrote time.Time, err error) {
+	elapsed := wrote.Sub(start)
+	slow, threshold := s.slowDetector.Slow(info.ServiceMethod, elapsed)
+	if !slow {
+		return
+	}
+	sc := SlowCall{ServiceMethod: info.ServiceMethod, RequestID: info.RequestID, Elapsed: elapsed,
+		Handler: handled.Sub(invoked), Write: wrote.Sub(handled), Threshold: threshold, Err: err}
+	if s.slow.handler != nil {
+		s.slow.handler(sc)
+		return
+	}
+	ok, dropped := s.slowDetector.Allow(wrote)
+	if !ok {
+		return
+	}
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	log.Printf("rpc: slow request method=%v request_id=%v elapsed=%v handler=%v write=%v threshold=%v error=%q suppressed=%d\n",
+		sc.ServiceMethod, sc.RequestID, sc.Elapsed, sc.Handler, sc.Write, sc.Threshold, errMsg, dropped)
+}
@@ -0,0 +1,80 @@
+package appleseed
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+type Sleep struct{}
+
+func (s *Sleep) Sleep(args *Args, reply *Reply) error {
+	time.Sleep(time.Duration(args.X))
+	return nil
+}
+
+// TestServerSlowCall 慢请求的耗时分为 handler 和写入两部分，按方法的阈值判断
+func TestServerSlowCall(t *testing.T) {
+	slow := make(chan SlowCall, 4)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := NewServer(context.Background(), "slow", "127.0.0.1", port, memory.New(nil),
+		WithSlowCallThreshold(20*time.Millisecond),
+		WithMethodSlowCallThreshold("Ctx.Deadline", 0),
+		WithSlowCallHandler(func(sc SlowCall) { slow <- sc }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(Sleep)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(Ctx)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(context.Background())
+
+	cli, err := client.Dial(context.Background(), "tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var reply Reply
+	// 没有超过阈值
+	if err := cli.Call(ctx, "Sleep.Sleep", &Args{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Call(ctx, "Sleep.Sleep", &Args{X: int64(40 * time.Millisecond)}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	// Ctx.Deadline 不检测
+	if err := cli.Call(ctx, "Ctx.Deadline", &Args{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case sc := <-slow:
+		if sc.ServiceMethod != "Sleep.Sleep" || sc.RequestID == "" || sc.Threshold != 20*time.Millisecond || sc.Err != nil {
+			t.Fatalf("slow call %+v", sc)
+		}
+		if sc.Handler < 40*time.Millisecond || sc.Write >= sc.Handler || sc.Elapsed < sc.Handler+sc.Write {
+			t.Fatalf("slow call handler=%v write=%v elapsed=%v", sc.Handler, sc.Write, sc.Elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no slow call")
+	}
+	select {
+	case sc := <-slow:
+		t.Fatalf("unexpected slow call %+v", sc)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
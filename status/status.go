@@ -0,0 +1,195 @@
+// Package status 带有错误码和附加信息的错误，服务端返回后客户端可以还原出相同的错误码和附加信息：
+//
+//	// 服务端
+//	return status.New(status.NotFound, "order 123 not found").WithDetails(map[string]string{"order": "123"})
+//
+//	// 客户端
+//	if s, ok := status.FromError(err); ok && s.Code() == status.NotFound {
+//		log.Println(s.Details()["order"])
+//	}
+//
+// handler 返回的普通错误在客户端是 Internal，错误信息不变；包装了 *Status 的错误（fmt.Errorf("...: %w", s)）
+// 使用 *Status 的错误码和附加信息，以及包装后的完整错误信息。旧版本的服务端只返回错误信息，客户端收到的是 Unknown
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Code 错误码，和 gRPC 的取值相同
+type Code uint32
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	DataLoss           Code = 15
+	Unauthenticated    Code = 16
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// Status 带有错误码的错误，创建之后不可修改，可以并发使用
+type Status struct {
+	code    Code
+	msg     string
+	details map[string]string
+}
+
+// New 创建错误码为 code、错误信息为 msg 的错误
+func New(code Code, msg string) *Status {
+	return &Status{code: code, msg: msg}
+}
+
+// Newf 同 New，错误信息使用 fmt.Sprintf 格式化
+func Newf(code Code, format string, a ...any) *Status {
+	return New(code, fmt.Sprintf(format, a...))
+}
+
+// WithDetails 返回附加了 details 的副本，和已有的附加信息合并，key 相同时使用 details 中的值
+func (s *Status) WithDetails(details map[string]string) *Status {
+	n := &Status{code: s.code, msg: s.msg}
+	if len(s.details)+len(details) > 0 {
+		n.details = make(map[string]string, len(s.details)+len(details))
+		for k, v := range s.details {
+			n.details[k] = v
+		}
+		for k, v := range details {
+			n.details[k] = v
+		}
+	}
+	return n
+}
+
+func (s *Status) Code() Code {
+	return s.code
+}
+
+func (s *Status) Message() string {
+	return s.msg
+}
+
+// Details 返回附加信息的副本，没有附加信息时返回 nil
+func (s *Status) Details() map[string]string {
+	if len(s.details) == 0 {
+		return nil
+	}
+	d := make(map[string]string, len(s.details))
+	for k, v := range s.details {
+		d[k] = v
+	}
+	return d
+}
+
+// Error 返回错误信息，和服务端的普通错误的 Error 相同，错误信息为空时返回错误码的名字
+func (s *Status) Error() string {
+	if s.msg == "" {
+		return s.code.String()
+	}
+	return s.msg
+}
+
+// Is 错误码相同时认为是同一个错误，所以可以用 errors.Is(err, status.New(status.NotFound, "")) 判断错误码
+func (s *Status) Is(target error) bool {
+	t, ok := target.(*Status)
+	return ok && t.code == s.code
+}
+
+// FromError 返回 err 对应的 *Status，err 为 nil 时返回 nil, true。
+// err 的错误链中有 *Status 或者实现了 Status() *Status 的错误时 ok 为 true，如果 err 是包装后的错误，
+// 返回的 *Status 使用 err 的完整错误信息；否则返回错误码为 Unknown、错误信息为 err.Error() 的 *Status，ok 为 false
+func FromError(err error) (s *Status, ok bool) {
+	if err == nil {
+		return nil, true
+	}
+	var found *Status
+	var se interface{ Status() *Status }
+	switch {
+	case errors.As(err, &found):
+	case errors.As(err, &se):
+		found = se.Status()
+	default:
+		return New(Unknown, err.Error()), false
+	}
+	if found != err && found.Error() != err.Error() {
+		found = &Status{code: found.code, msg: err.Error(), details: found.details}
+	}
+	return found, true
+}
+
+// Convert 同 FromError，忽略 ok
+func Convert(err error) *Status {
+	s, _ := FromError(err)
+	return s
+}
+
+// CodeOf 返回 err 的错误码，err 为 nil 时返回 OK，不是 *Status 时返回 Unknown
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return Convert(err).Code()
+}
+
+// FromContextError 将 ctx 的错误转换为 Canceled 或者 DeadlineExceeded，其他错误返回 Unknown
+func FromContextError(err error) *Status {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return New(DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return New(Canceled, err.Error())
+	}
+	return New(Unknown, err.Error())
+}
+
+// ServerFault 返回 code 是否表示服务端或者链路的问题（而不是请求本身的问题），负载均衡器据此判断实例是否健康，
+// 这类错误换一个实例重试可能成功
+func (c Code) ServerFault() bool {
+	switch c {
+	case Unknown, DeadlineExceeded, ResourceExhausted, Aborted, Internal, Unavailable, DataLoss:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type limitError struct{}
+
+func (limitError) Error() string   { return "too many requests" }
+func (limitError) Status() *Status { return New(ResourceExhausted, "too many requests") }
+
+func TestFromError(t *testing.T) {
+	notFound := New(NotFound, "order 123 not found").WithDetails(map[string]string{"order": "123"})
+	cases := []struct {
+		name    string
+		err     error
+		ok      bool
+		code    Code
+		msg     string
+		details map[string]string
+	}{
+		{"status", notFound, true, NotFound, "order 123 not found", map[string]string{"order": "123"}},
+		{"wrapped", fmt.Errorf("get order: %w", notFound), true, NotFound, "get order: order 123 not found", map[string]string{"order": "123"}},
+		{"interface", fmt.Errorf("wrap: %w", limitError{}), true, ResourceExhausted, "wrap: too many requests", nil},
+		{"plain", errors.New("boom"), false, Unknown, "boom", nil},
+	}
+	for _, c := range cases {
+		s, ok := FromError(c.err)
+		if ok != c.ok || s.Code() != c.code || s.Message() != c.msg || !reflect.DeepEqual(s.Details(), c.details) {
+			t.Errorf("%v: FromError = %v %q %v, %v", c.name, s.Code(), s.Message(), s.Details(), ok)
+		}
+		if CodeOf(c.err) != c.code {
+			t.Errorf("%v: CodeOf = %v", c.name, CodeOf(c.err))
+		}
+	}
+	if s, ok := FromError(nil); s != nil || !ok || CodeOf(nil) != OK {
+		t.Fatalf("FromError(nil) = %v, %v", s, ok)
+	}
+	// 没有包装时返回同一个 *Status
+	if s, _ := FromError(notFound); s != notFound {
+		t.Fatal("FromError returned a copy")
+	}
+}
+
+func TestIsAs(t *testing.T) {
+	err := fmt.Errorf("wrap: %w", New(NotFound, "order 123 not found"))
+	if !errors.Is(err, New(NotFound, "")) || errors.Is(err, New(Internal, "order 123 not found")) {
+		t.Fatal("errors.Is should compare codes")
+	}
+	var s *Status
+	if !errors.As(err, &s) || s.Code() != NotFound {
+		t.Fatalf("errors.As = %v", s)
+	}
+	if New(PermissionDenied, "").Error() != "PermissionDenied" {
+		t.Fatalf("Error() = %q", New(PermissionDenied, "").Error())
+	}
+	if Code(100).String() != "Code(100)" || Unavailable.String() != "Unavailable" {
+		t.Fatal("Code.String")
+	}
+}
+
+func TestWithDetails(t *testing.T) {
+	a := New(InvalidArgument, "bad").WithDetails(map[string]string{"field": "name", "x": "1"})
+	b := a.WithDetails(map[string]string{"x": "2"})
+	if a.Details()["x"] != "1" || !reflect.DeepEqual(b.Details(), map[string]string{"field": "name", "x": "2"}) {
+		t.Fatalf("a = %v, b = %v", a.Details(), b.Details())
+	}
+	// Details 返回副本
+	a.Details()["field"] = "changed"
+	if a.Details()["field"] != "name" {
+		t.Fatal("details modified through Details()")
+	}
+	if New(OK, "").WithDetails(nil).Details() != nil {
+		t.Fatal("empty details should be nil")
+	}
+}
+
+func TestFromContextError(t *testing.T) {
+	if c := FromContextError(fmt.Errorf("call: %w", context.DeadlineExceeded)).Code(); c != DeadlineExceeded {
+		t.Fatalf("code = %v", c)
+	}
+	if c := FromContextError(context.Canceled).Code(); c != Canceled {
+		t.Fatalf("code = %v", c)
+	}
+}
@@ -0,0 +1,101 @@
+package appleseed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+var errOrderNotFound = status.New(status.NotFound, "order not found")
+
+type Orders struct{}
+
+func (Orders) Get(ctx context.Context, id *string, reply *string) error {
+	switch *id {
+	case "details":
+		return status.New(status.NotFound, "order 123 not found").WithDetails(map[string]string{"order": "123"})
+	case "wrapped":
+		return fmt.Errorf("get %s: %w", *id, errOrderNotFound)
+	case "slow":
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return errors.New("database is down")
+}
+
+func TestStatusErrors(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	s, err := NewServer(context.Background(), "orders", "127.0.0.1", port, memory.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(Orders{}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Shutdown(context.Background())
+
+	cases := []struct {
+		method, id string
+		code       status.Code
+		msg        string
+		details    map[string]string
+	}{
+		{"Orders.Get", "details", status.NotFound, "order 123 not found", map[string]string{"order": "123"}},
+		{"Orders.Get", "wrapped", status.NotFound, "get wrapped: order not found", nil},
+		{"Orders.Get", "plain", status.Internal, "database is down", nil},
+		{"Orders.Get", "slow", status.DeadlineExceeded, context.DeadlineExceeded.Error(), nil},
+		{"Orders.Nope", "", status.Unimplemented, "rpc: can't find method Orders.Nope", nil},
+		{"Orders", "", status.InvalidArgument, "rpc: service/method request ill-formed: Orders", nil},
+	}
+	for _, c := range []struct {
+		name string
+		opts []client.ClientOption
+	}{
+		{"gob", nil},
+		{"binary", []client.ClientOption{client.WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+			return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"))
+		})}},
+	} {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli := client.NewClient(conn, lis.Addr().String(), c.opts...)
+		for _, tc := range cases {
+			ctx := client.WithRequestID(context.Background(), "r1")
+			if tc.id == "slow" {
+				// 客户端不设置 deadline，只通过 metadata 设置服务端的超时时间，保证收到的是服务端的错误
+				ctx = metadata.AppendToOutgoingContext(ctx, metadata.TimeoutKey, (50 * time.Millisecond).String())
+			}
+			var reply string
+			err := cli.Call(ctx, tc.method, &tc.id, &reply)
+			st, ok := status.FromError(err)
+			if !ok || st.Code() != tc.code || st.Message() != tc.msg+" (request id: r1)" || !reflect.DeepEqual(st.Details(), tc.details) {
+				t.Fatalf("%v %v %v: err = %v (%v, %v)", c.name, tc.method, tc.id, err, st.Code(), st.Details())
+			}
+		}
+		// 客户端还原出的错误可以和服务端的哨兵错误比较
+		var reply string
+		id := "wrapped"
+		if err := cli.Call(context.Background(), "Orders.Get", &id, &reply); !errors.Is(err, errOrderNotFound) {
+			t.Fatalf("%v: errors.Is(%v, errOrderNotFound) = false", c.name, err)
+		}
+		cli.Close()
+	}
+}
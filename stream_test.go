@@ -0,0 +1,155 @@
+package appleseed
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+// randomBody 返回 n 字节确定的伪随机数据
+func randomBody(n int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(1)), n)
+}
+
+// trackedReader 记录是否被关闭，读取 failAt 字节之后返回错误（failAt 为 0 时不返回错误）
+type trackedReader struct {
+	r      io.Reader
+	read   int64
+	failAt int64
+	closed *int32
+}
+
+func (r *trackedReader) Read(p []byte) (int, error) {
+	if r.failAt > 0 && r.read >= r.failAt {
+		return 0, errors.New("disk on fire")
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *trackedReader) Close() error {
+	atomic.StoreInt32(r.closed, 1)
+	return nil
+}
+
+type Download struct {
+	closed int32
+}
+
+// Get 返回 size 字节的伪随机数据，size 为负数时读取 -size 字节后失败
+func (d *Download) Get(size *int64, reply *codec.StreamBody) error {
+	r := &trackedReader{r: randomBody(*size), closed: &d.closed}
+	if *size < 0 {
+		r.r, r.failAt = randomBody(-*size*2), -*size
+	}
+	reply.Reader = r
+	return nil
+}
+
+func startDownloadServer(t *testing.T) (*Download, *client.Client) {
+	ctx := context.Background()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(ctx, "download", "127.0.0.1", "0", memory.New(nil), WithChunking(64<<10, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(Download)
+	if err := s.Register(d); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Shutdown(ctx) })
+	cli, err := client.Dial(ctx, "tcp", lis.Addr().String(), client.WithCodec(func(conn io.ReadWriteCloser) codec.ClientCodec {
+		return codec.NewBinaryClientCodec(conn, codec.WithBodyCodec("json"), codec.WithChunking(64<<10, 1<<20))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	// 收到服务端的 preface 之后才会拆分
+	var sink bytes.Buffer
+	if err := cli.Call(ctx, "Download.Get", int64(1), codec.NewWriterSink(&sink, 0)); err != nil {
+		t.Fatal(err)
+	}
+	return d, cli
+}
+
+// TestStreamBody 64 MiB 的响应从服务端的 io.Reader 直接写入客户端的文件，两端都不在内存中保存完整的 body
+func TestStreamBody(t *testing.T) {
+	d, cli := startDownloadServer(t)
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(t.TempDir(), "body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	atomic.StoreInt32(&d.closed, 0)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	sink := codec.NewWriterSink(f, 0)
+	if err := cli.Call(context.Background(), "Download.Get", int64(size), sink); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	// 超过了 max body（1 MiB），写入 BodySink 时不受限制
+	if sink.Written() != size {
+		t.Fatalf("sink written %d bytes, want %d", sink.Written(), size)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/4 {
+		t.Fatalf("allocated %d MiB for a %d MiB body", alloc>>20, size>>20)
+	}
+	if atomic.LoadInt32(&d.closed) != 1 {
+		t.Fatal("source was not closed")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, want := sha256.New(), sha256.New()
+	io.Copy(got, f)
+	io.Copy(want, randomBody(size))
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Fatal("received body differs from the source")
+	}
+
+	// 超过 WriterSink 的 Max 时只有这个调用失败
+	err = cli.Call(context.Background(), "Download.Get", int64(1<<20), codec.NewWriterSink(io.Discard, 1<<19))
+	if err == nil {
+		t.Fatal("Call() with a limited sink succeeded")
+	}
+	if err := cli.Call(context.Background(), "Download.Get", int64(10), codec.NewWriterSink(io.Discard, 0)); err != nil {
+		t.Fatalf("Call() after the limited sink = %v", err)
+	}
+}
+
+// TestStreamBodySourceError 读取 BodySource 失败时已经发送了一部分 fragment，连接被关闭，调用失败而不是一直等待
+func TestStreamBodySourceError(t *testing.T) {
+	d, cli := startDownloadServer(t)
+	atomic.StoreInt32(&d.closed, 0)
+	err := cli.Call(context.Background(), "Download.Get", int64(-(1 << 20)), codec.NewWriterSink(io.Discard, 0))
+	if !errors.Is(err, client.ErrConnectionClosed) {
+		t.Fatalf("Call() = %v, want ErrConnectionClosed", err)
+	}
+	if atomic.LoadInt32(&d.closed) != 1 {
+		t.Fatal("source was not closed")
+	}
+}
@@ -0,0 +1,267 @@
+package appleseed
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+)
+
+const (
+	// DefaultTapEntrySize 调试采样中每个请求或者响应默认最多保存的字节数
+	DefaultTapEntrySize = 4 << 10
+	// DefaultTapBufferSize 调试采样默认最多占用的内存
+	DefaultTapBufferSize = 1 << 20
+)
+
+// TapConfig 调试采样的配置，见 WithDebugTap
+type TapConfig struct {
+	Rate    float64  // 采样的比例，比如 0.001 为 0.1%
+	Every   uint64   // 每 Every 个请求采样一个，不为 0 时忽略 Rate
+	Methods []string // 只保留这些方法的请求，为空时不限制。Rate 和 Every 对所有的请求计算，之后再按照方法过滤
+	// MaxEntrySize 请求和响应各自最多保存的字节数，超出的部分被丢弃，默认为 DefaultTapEntrySize
+	MaxEntrySize int
+	// MaxBytes 所有记录的数据最多占用的字节数，超出时丢弃最早的记录，默认为 DefaultTapBufferSize
+	MaxBytes int
+}
+
+// TapEntry 一个被采样的请求，数据是连接上的原始字节。gob 编码时类型的定义只在连接上第一次出现时发送，
+// 所以单独的一条记录不一定能被解码
+type TapEntry struct {
+	Time          time.Time // 开始读取请求的时间
+	Remote        string
+	ServiceMethod string
+	Seq           uint64
+	RequestID     string
+
+	RequestHeader  []byte
+	RequestBody    []byte
+	ResponseHeader []byte // 还没有响应或者连接在响应之前断开时为空
+	ResponseBody   []byte // 拆分传输的响应（见 WithChunking）只包括第一个 frame
+	Truncated      bool   // 请求或者响应超过 MaxEntrySize 被截断
+}
+
+func (e *TapEntry) size() int {
+	return len(e.RequestHeader) + len(e.RequestBody) + len(e.ResponseHeader) + len(e.ResponseBody)
+}
+
+// tapRecord 缓冲中的一条记录
+type tapRecord struct {
+	TapEntry
+	tap     *debugTap // 记录所在的缓冲，写入响应之前 SetDebugTap 可能已经替换了缓冲
+	evicted bool      // 已经因为超过 MaxBytes 被丢弃
+}
+
+// WithDebugTap 按照 cfg 采样请求和响应在连接上的原始数据，保存在有大小上限的环形缓冲中，通过 Server.DebugTap 获取，
+// 用于排查线上的编解码问题。也可以在运行时通过 Server.SetDebugTap 开启和关闭
+func WithDebugTap(cfg TapConfig) ServerOption {
+	return func(s *Server) {
+		s.SetDebugTap(&cfg)
+	}
+}
+
+// tapKey 等待响应的采样请求
+type tapKey struct {
+	cc  *codec.CountConn
+	seq uint64
+}
+
+// debugTap 一次 SetDebugTap 的配置和采样到的记录
+type debugTap struct {
+	cfg     TapConfig
+	methods map[string]bool
+	count   uint64 // 原子操作，Every 的计数
+
+	mu      sync.Mutex
+	entries []*tapRecord // 从旧到新
+	size    int          // entries 的数据占用的字节数
+	pending map[tapKey]*tapRecord
+}
+
+func newDebugTap(cfg TapConfig) *debugTap {
+	if cfg.MaxEntrySize <= 0 {
+		cfg.MaxEntrySize = DefaultTapEntrySize
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultTapBufferSize
+	}
+	// 保证一条完整的记录放得下
+	if cfg.MaxEntrySize > cfg.MaxBytes/2 {
+		cfg.MaxEntrySize = cfg.MaxBytes / 2
+	}
+	t := &debugTap{cfg: cfg, pending: make(map[tapKey]*tapRecord)}
+	if len(cfg.Methods) > 0 {
+		t.methods = make(map[string]bool, len(cfg.Methods))
+		for _, m := range cfg.Methods {
+			t.methods[m] = true
+		}
+	}
+	return t
+}
+
+func (t *debugTap) sample() bool {
+	if t.cfg.Every > 0 {
+		return atomic.AddUint64(&t.count, 1)%t.cfg.Every == 0
+	}
+	return t.cfg.Rate > 0 && rand.Float64() < t.cfg.Rate
+}
+
+// add 加入一条等待响应的记录，超过 MaxBytes 时丢弃最早的记录
+func (t *debugTap) add(key tapKey, r *tapRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[key] = r
+	t.entries = append(t.entries, r)
+	t.grow(r.size())
+}
+
+// grow 记录的数据增加了 n 个字节，调用方持有 mu
+func (t *debugTap) grow(n int) {
+	t.size += n
+	for t.size > t.cfg.MaxBytes && len(t.entries) > 0 {
+		t.size -= t.entries[0].size()
+		t.entries[0].evicted = true
+		t.entries[0] = nil
+		t.entries = t.entries[1:]
+	}
+}
+
+// capBuffer 最多保存 max 个字节，超出的部分被丢弃
+type capBuffer struct {
+	b         []byte
+	max       int
+	truncated bool
+}
+
+func (b *capBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - len(b.b); n > room {
+		n = room
+		b.truncated = true
+	}
+	b.b = append(b.b, p[:n]...)
+	return len(p), nil
+}
+
+// split 将数据在第 n 个字节处分成 header 和 body，截断后不足 n 个字节时 body 为空
+func (b *capBuffer) split(n int64) (header, body []byte) {
+	if n > int64(len(b.b)) {
+		n = int64(len(b.b))
+	}
+	return b.b[:n:n], b.b[n:]
+}
+
+// SetDebugTap 使用 cfg 重新开始调试采样，之前采样到的记录被丢弃。cfg 为 nil 时停止采样，已经采样到的记录仍然可以通过
+// DebugTap 获取
+func (s *Server) SetDebugTap(cfg *TapConfig) {
+	if cfg == nil {
+		atomic.StoreUint32(&s.tapOn, 0)
+		return
+	}
+	s.tap.Store(newDebugTap(*cfg))
+	atomic.StoreUint32(&s.tapOn, 1)
+}
+
+// DebugTap 返回调试采样到的记录，从旧到新
+func (s *Server) DebugTap() []TapEntry {
+	t, ok := s.tap.Load().(*debugTap)
+	if !ok {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := make([]TapEntry, len(t.entries))
+	for i, r := range t.entries {
+		entries[i] = r.TapEntry
+	}
+	return entries
+}
+
+// tapRead 开始读取一个请求之前调用，采样时开始记录 cc 上读取的数据并返回记录的缓冲，没有开启或者没有被采样时返回 nil。
+// 没有开启时只有一次原子操作
+func (s *Server) tapRead(cc *codec.CountConn) *capBuffer {
+	if atomic.LoadUint32(&s.tapOn) == 0 || cc == nil {
+		return nil
+	}
+	t := s.tap.Load().(*debugTap)
+	if !t.sample() {
+		return nil
+	}
+	buf := &capBuffer{max: t.cfg.MaxEntrySize}
+	cc.CaptureRead(buf)
+	return buf
+}
+
+// tapRequest 读取完请求之后停止记录，请求的方法符合配置时加入记录，并等待响应
+func (s *Server) tapRequest(ctx context.Context, buf *capBuffer, cc *codec.CountConn, req *codec.RequestHeader, received codec.MessageSize, start time.Time) {
+	cc.CaptureRead(nil)
+	t := s.tap.Load().(*debugTap)
+	if req == nil || t.methods != nil && !t.methods[req.ServiceMethod] {
+		return
+	}
+	r := &tapRecord{tap: t, TapEntry: TapEntry{
+		Time:          start,
+		ServiceMethod: req.ServiceMethod,
+		Seq:           req.Seq,
+		RequestID:     req.Metadata[metadata.RequestIDKey],
+		Truncated:     buf.truncated,
+	}}
+	if p, ok := PeerFromContext(ctx); ok && p.Addr != nil {
+		r.Remote = p.Addr.String()
+	}
+	r.RequestHeader, r.RequestBody = buf.split(received.Header)
+	t.add(tapKey{cc: cc, seq: req.Seq}, r)
+}
+
+// tapResponse 在写入响应之前调用，请求被采样时开始记录 cc 上写入的数据，返回 nil 时不需要调用 tapResponseDone。
+// 调用方持有 sendLock
+func (s *Server) tapResponse(cc *codec.CountConn, seq uint64) (*tapRecord, *capBuffer) {
+	if atomic.LoadUint32(&s.tapOn) == 0 || cc == nil {
+		return nil, nil
+	}
+	t := s.tap.Load().(*debugTap)
+	key := tapKey{cc: cc, seq: seq}
+	t.mu.Lock()
+	r, ok := t.pending[key]
+	delete(t.pending, key)
+	t.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	buf := &capBuffer{max: r.tap.cfg.MaxEntrySize}
+	cc.CaptureWrite(buf)
+	return r, buf
+}
+
+// tapResponseDone 写入响应之后停止记录，将响应加入 r。调用方持有 sendLock
+func (s *Server) tapResponseDone(cc *codec.CountConn, r *tapRecord, buf *capBuffer, sent codec.MessageSize) {
+	cc.CaptureWrite(nil)
+	t := r.tap
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.evicted {
+		return
+	}
+	r.ResponseHeader, r.ResponseBody = buf.split(sent.Header)
+	r.Truncated = r.Truncated || buf.truncated
+	t.grow(len(r.ResponseHeader) + len(r.ResponseBody))
+}
+
+// tapConnDone 连接结束时丢弃还在等待响应的采样请求
+func (s *Server) tapConnDone(cc *codec.CountConn) {
+	t, ok := s.tap.Load().(*debugTap)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k := range t.pending {
+		if k.cc == cc {
+			delete(t.pending, k)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package appleseed
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+func TestDebugTapSampleRate(t *testing.T) {
+	tap := newDebugTap(TapConfig{Rate: 0.01})
+	sampled := 0
+	for i := 0; i < 100000; i++ {
+		if tap.sample() {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Fatalf("sampled %d of 100000 at rate 0.01", sampled)
+	}
+	tap = newDebugTap(TapConfig{Every: 7, Rate: 1})
+	sampled = 0
+	for i := 0; i < 700; i++ {
+		if tap.sample() {
+			sampled++
+		}
+	}
+	if sampled != 100 {
+		t.Fatalf("sampled %d of 700 every 7", sampled)
+	}
+}
+
+// TestDebugTap 每 5 个请求采样一个，只保留 XXX.Add，记录的是连接上的原始数据
+func TestDebugTap(t *testing.T) {
+	s, lis := startHooksServer(t, WithDebugTap(TapConfig{Every: 5, Methods: []string{"XXX.Add"}}))
+	defer s.Shutdown(context.Background())
+	cli := dialHooks(t, lis)
+	defer cli.Close()
+
+	for i := 0; i < 40; i++ {
+		method := "XXX.Add"
+		if i%2 == 1 {
+			method = "XXX.TimeoutFunc"
+		}
+		var reply Reply
+		ctx := client.WithRequestID(context.Background(), "req-"+strings.Repeat("x", i))
+		if err := cli.Call(ctx, method, &Args{Str: "payload", X: int64(i)}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := s.DebugTap()
+	// 第 5、10、...、40 个请求被采样，其中偶数个（i 为奇数）是 XXX.TimeoutFunc
+	if len(entries) != 4 {
+		t.Fatalf("%d entries, want 4", len(entries))
+	}
+	for _, e := range entries {
+		if e.ServiceMethod != "XXX.Add" || e.Remote == "" || e.Truncated {
+			t.Fatalf("entry %+v", e)
+		}
+		if !bytes.Contains(e.RequestHeader, []byte("XXX.Add")) || !bytes.Contains(e.RequestHeader, []byte(e.RequestID)) {
+			t.Fatalf("request header %q", e.RequestHeader)
+		}
+		if !bytes.Contains(e.RequestBody, []byte("payload")) || !bytes.Contains(e.ResponseBody, []byte("payload")) {
+			t.Fatalf("request body %q, response body %q", e.RequestBody, e.ResponseBody)
+		}
+		if len(e.ResponseHeader) == 0 {
+			t.Fatalf("no response header for seq %d", e.Seq)
+		}
+	}
+
+	s.SetDebugTap(nil)
+	var reply Reply
+	for i := 0; i < 10; i++ {
+		cli.Call(context.Background(), "XXX.Add", &Args{}, &reply)
+	}
+	if n := len(s.DebugTap()); n != 4 {
+		t.Fatalf("%d entries after disabling, want 4", n)
+	}
+}
+
+// TestDebugTapBounded 每条记录和整个缓冲的大小都不超过上限
+func TestDebugTapBounded(t *testing.T) {
+	const maxBytes = 1000
+	s, lis := startHooksServer(t, WithDebugTap(TapConfig{Every: 1, MaxEntrySize: 100, MaxBytes: maxBytes}))
+	defer s.Shutdown(context.Background())
+	cli := dialHooks(t, lis)
+	defer cli.Close()
+
+	for i := 0; i < 50; i++ {
+		var reply Reply
+		if err := cli.Call(context.Background(), "XXX.Add", &Args{Str: strings.Repeat("a", i*10)}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, e := range s.DebugTap() {
+			req, resp := len(e.RequestHeader)+len(e.RequestBody), len(e.ResponseHeader)+len(e.ResponseBody)
+			if req > 100 || resp > 100 {
+				t.Fatalf("entry of %d + %d bytes", req, resp)
+			}
+			total += req + resp
+		}
+		if total > maxBytes {
+			t.Fatalf("tap holds %d bytes, max %d", total, maxBytes)
+		}
+	}
+	entries := s.DebugTap()
+	if last := entries[len(entries)-1]; !last.Truncated || len(entries) > maxBytes/100 {
+		t.Fatalf("%d entries, last %+v", len(entries), last)
+	}
+}
+
+func TestDebugTapDisabledAllocs(t *testing.T) {
+	s := &Server{}
+	cc := codec.NewCountConn(nil)
+	allocs := testing.AllocsPerRun(1000, func() {
+		if buf := s.tapRead(cc); buf != nil {
+			t.Fatal("sampled while disabled")
+		}
+		if r, _ := s.tapResponse(cc, 1); r != nil {
+			t.Fatal("tapped response while disabled")
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocs per request with the tap disabled", allocs)
+	}
+	s.SetDebugTap(&TapConfig{Every: 1})
+	s.SetDebugTap(nil)
+	if allocs := testing.AllocsPerRun(1000, func() { s.tapRead(cc) }); allocs != 0 {
+		t.Fatalf("%v allocs per request after disabling", allocs)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package transport
+
+import (
+	"os"
+	"syscall"
+)
+
+// setBuffers 设置 socket 的接收和发送缓冲区大小，为 0 的不修改
+func setBuffers(fd uintptr, read, write int) error {
+	if read > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, read); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if write > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, write); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,453 @@
+// Package inproc 进程内的连接，用于不需要真实网络的测试。Pipe 返回一对相连的 *Conn，Listen 返回的 *Listener
+// 可以直接交给 Server.Serve，它的 Dial 返回的连接交给 client.NewClient：
+//
+//	lis := inproc.Listen("echo")
+//	go server.Serve(lis)
+//	conn, _ := lis.Dial(ctx)
+//	cli := client.NewClient(conn, lis.Addr().String())
+//
+// 连接可以模拟延迟和带宽，并注入故障（传输 N 个字节后断开、延迟写入、每次只读到一部分数据），
+// 用于确定性地测试重试、重连、熔断等配置，见 Faults。
+//
+// 确定性的保证：
+//   - 同一个方向上的数据按照写入的顺序到达，一次 Read 不会返回多次 Write 的数据
+//   - Faults.DropAfter 总是恰好在第 N 个字节处断开连接，断开之前写入的数据都会被对端读到，之后读写都返回 ErrDropped
+//   - Faults.MaxRead 时每次 Read 返回的长度是确定的：min(MaxRead, len(p), 当前这次 Write 剩余的数据)
+//   - 依次（不是并发）调用 Listener.Dial 时，Accept 按照 Dial 的顺序返回连接
+//
+// 不保证的：两个方向之间的先后顺序；延迟和带宽按照真实的时间计算，只是数据可以被读到的最早时间，
+// 实际读到的时间还取决于 goroutine 的调度
+package inproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBufferSize 每个方向上已经写入、还没有被读取的数据的默认上限
+const DefaultBufferSize = 64 << 10
+
+// ErrDropped 连接被 Faults.DropAfter 或者 Conn.Drop 断开
+var ErrDropped = errors.New("inproc: connection dropped")
+
+// Addr 进程内连接的地址
+type Addr string
+
+func (a Addr) Network() string { return "inproc" }
+func (a Addr) String() string  { return string(a) }
+
+// Faults 注入到一个方向上的故障，作用于一端写入、另一端读取的数据
+type Faults struct {
+	DropAfter  int64         // 这个方向传输了 DropAfter 个字节后断开整个连接，<= 0 时不断开
+	WriteDelay time.Duration // 每次 Write 开始传输之前等待的时间
+	MaxRead    int           // 对端每次 Read 最多读到的字节数，<= 0 时不限制
+}
+
+type config struct {
+	latency    time.Duration
+	bandwidth  int64
+	bufferSize int
+	faults     Faults
+}
+
+// Option 用于配置连接，对两个方向都生效
+type Option func(*config)
+
+// WithLatency 写入的数据经过 d 之后才能被对端读到
+func WithLatency(d time.Duration) Option {
+	return func(c *config) {
+		c.latency = d
+	}
+}
+
+// WithBandwidth 每个方向每秒最多传输 bytesPerSecond 个字节，<= 0 时不限制
+func WithBandwidth(bytesPerSecond int64) Option {
+	return func(c *config) {
+		c.bandwidth = bytesPerSecond
+	}
+}
+
+// WithBufferSize 每个方向上最多有 n 个字节已经写入、还没有被读取，超过时 Write 等待，默认为 DefaultBufferSize
+func WithBufferSize(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.bufferSize = n
+		}
+	}
+}
+
+// WithFaults 在两个方向上都注入 f，只需要一个方向时使用 Conn.Inject
+func WithFaults(f Faults) Option {
+	return func(c *config) {
+		c.faults = f
+	}
+}
+
+// chunk 一次 Write 的数据
+type chunk struct {
+	data []byte
+	at   time.Time // 可以被读到的时间
+}
+
+// pipe 连接的一个方向
+type pipe struct {
+	link *link
+
+	mu        sync.Mutex
+	changed   chan struct{} // 状态变化时关闭并替换，唤醒等待的读写
+	chunks    []chunk
+	buffered  int
+	free      time.Time // 按照带宽，下一个字节开始传输的时间
+	written   int64     // 注入故障之后写入的字节数
+	faults    Faults
+	cfg       config
+	eof       bool  // 写入的一端已经关闭
+	rclosed   bool  // 读取的一端已经关闭
+	err       error // 连接被断开
+	rdeadline time.Time
+	wdeadline time.Time
+}
+
+func newPipe(l *link, cfg config) *pipe {
+	return &pipe{link: l, changed: make(chan struct{}), faults: cfg.faults, cfg: cfg}
+}
+
+// notify 唤醒等待的读写，调用方持有 mu
+func (p *pipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// wait 等待状态变化、until 或者 deadline 中较早的一个，为零值的时间不等待。调用方持有 mu，返回时仍然持有
+func (p *pipe) wait(until, deadline time.Time) {
+	if until.IsZero() || !deadline.IsZero() && deadline.Before(until) {
+		until = deadline
+	}
+	ch := p.changed
+	p.mu.Unlock()
+	defer p.mu.Lock()
+	if until.IsZero() {
+		<-ch
+		return
+	}
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.rclosed {
+			return 0, net.ErrClosed
+		}
+		var until time.Time
+		if len(p.chunks) > 0 {
+			c := &p.chunks[0]
+			if !time.Now().Before(c.at) {
+				n := len(b)
+				if max := p.faults.MaxRead; max > 0 && n > max {
+					n = max
+				}
+				n = copy(b[:n], c.data)
+				c.data = c.data[n:]
+				if len(c.data) == 0 {
+					p.chunks[0] = chunk{}
+					p.chunks = p.chunks[1:]
+				}
+				p.buffered -= n
+				p.notify()
+				return n, nil
+			}
+			until = c.at
+		} else if p.err != nil {
+			return 0, p.err
+		} else if p.eof {
+			return 0, io.EOF
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		if !p.rdeadline.IsZero() && !time.Now().Before(p.rdeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		p.wait(until, p.rdeadline)
+	}
+}
+
+func (p *pipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	var delayed time.Time
+	if p.faults.WriteDelay > 0 {
+		delayed = time.Now().Add(p.faults.WriteDelay)
+	}
+	n := 0
+	for {
+		switch {
+		case p.eof:
+			p.mu.Unlock()
+			return n, net.ErrClosed
+		case p.err != nil:
+			p.mu.Unlock()
+			return n, p.err
+		case p.rclosed:
+			p.mu.Unlock()
+			return n, io.ErrClosedPipe
+		case !p.wdeadline.IsZero() && !time.Now().Before(p.wdeadline):
+			p.mu.Unlock()
+			return n, os.ErrDeadlineExceeded
+		case n == len(b):
+			p.mu.Unlock()
+			return n, nil
+		case time.Now().Before(delayed):
+			p.wait(delayed, p.wdeadline)
+			continue
+		case p.buffered >= p.cfg.bufferSize:
+			p.wait(time.Time{}, p.wdeadline)
+			continue
+		}
+
+		m := len(b) - n
+		if free := p.cfg.bufferSize - p.buffered; m > free {
+			m = free
+		}
+		drop := false
+		if limit := p.faults.DropAfter; limit > 0 && p.written+int64(m) >= limit {
+			m = int(limit - p.written)
+			drop = true
+		}
+		p.enqueue(b[n : n+m])
+		n += m
+		if drop {
+			p.mu.Unlock()
+			p.link.drop()
+			if n < len(b) {
+				return n, ErrDropped
+			}
+			return n, nil
+		}
+	}
+}
+
+// enqueue 按照带宽和延迟计算 b 可以被读到的时间并加入队列，调用方持有 mu
+func (p *pipe) enqueue(b []byte) {
+	now := time.Now()
+	at := now
+	if p.cfg.bandwidth > 0 {
+		if p.free.Before(now) {
+			p.free = now
+		}
+		p.free = p.free.Add(time.Duration(int64(len(b)) * int64(time.Second) / p.cfg.bandwidth))
+		at = p.free
+	}
+	p.chunks = append(p.chunks, chunk{data: append([]byte(nil), b...), at: at.Add(p.cfg.latency)})
+	p.buffered += len(b)
+	p.written += int64(len(b))
+	p.notify()
+}
+
+// closeRead 读取的一端关闭，丢弃还没有读取的数据，之后写入返回 io.ErrClosedPipe
+func (p *pipe) closeRead() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rclosed = true
+	p.chunks = nil
+	p.buffered = 0
+	p.notify()
+}
+
+// closeWrite 写入的一端关闭，对端读完已经写入的数据后读到 io.EOF
+func (p *pipe) closeWrite() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.eof = true
+	p.notify()
+}
+
+func (p *pipe) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.notify()
+	}
+}
+
+func (p *pipe) inject(f Faults) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = f
+	p.written = 0
+	p.notify()
+}
+
+func (p *pipe) setDeadline(t time.Time, read bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if read {
+		p.rdeadline = t
+	} else {
+		p.wdeadline = t
+	}
+	p.notify()
+}
+
+// link 连接的两个方向
+type link struct {
+	pipes [2]*pipe
+}
+
+func (l *link) drop() {
+	for _, p := range l.pipes {
+		p.fail(ErrDropped)
+	}
+}
+
+// Conn 进程内连接的一端，实现了 net.Conn
+type Conn struct {
+	in, out *pipe
+	local   Addr
+	remote  Addr
+	peer    *Conn
+	closed  int32 // 原子操作
+}
+
+// Pipe 返回一对相连的连接
+func Pipe(opts ...Option) (*Conn, *Conn) {
+	return newPair("pipe-a", "pipe-b", opts)
+}
+
+func newPair(a, b Addr, opts []Option) (*Conn, *Conn) {
+	cfg := config{bufferSize: DefaultBufferSize}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	l := new(link)
+	l.pipes[0], l.pipes[1] = newPipe(l, cfg), newPipe(l, cfg)
+	ca := &Conn{in: l.pipes[1], out: l.pipes[0], local: a, remote: b}
+	cb := &Conn{in: l.pipes[0], out: l.pipes[1], local: b, remote: a}
+	ca.peer, cb.peer = cb, ca
+	return ca, cb
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.out.write(b)
+}
+
+// Close 关闭连接，对端读完已经写入的数据后读到 io.EOF，之后写入返回 io.ErrClosedPipe
+func (c *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return net.ErrClosed
+	}
+	c.in.closeRead()
+	c.out.closeWrite()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t, true)
+	c.out.setDeadline(t, false)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t, true)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.out.setDeadline(t, false)
+	return nil
+}
+
+// Peer 返回连接的另一端，比如在客户端拿到服务端的一端并注入故障
+func (c *Conn) Peer() *Conn {
+	return c.peer
+}
+
+// Inject 替换这一端写入、对端读取的方向上的故障，DropAfter 从此时开始计算
+func (c *Conn) Inject(f Faults) {
+	c.out.inject(f)
+}
+
+// Drop 立即断开连接，两端已经写入的数据仍然可以被读到，之后读写都返回 ErrDropped
+func (c *Conn) Drop() {
+	c.in.link.drop()
+}
+
+// Listener 进程内的 net.Listener，通过 Dial 建立连接
+type Listener struct {
+	addr  Addr
+	opts  []Option
+	conns chan *Conn
+	done  chan struct{}
+	once  sync.Once
+	seq   uint64 // 原子操作，为客户端的一端分配地址
+}
+
+// Listen 返回地址为 name 的 Listener，opts 对之后建立的每个连接都生效
+func Listen(name string, opts ...Option) *Listener {
+	return &Listener{addr: Addr(name), opts: opts, conns: make(chan *Conn), done: make(chan struct{})}
+}
+
+// Accept 等待 Dial 建立的连接，Listener 关闭后返回 net.ErrClosed
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 关闭 Listener，已经建立的连接不受影响
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.done)
+		err = nil
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial 建立到 l 的连接，返回客户端的一端，opts 追加在 Listen 的 opts 之后。等待 Accept 期间 ctx 结束时
+// 返回 ctx.Err()
+func (l *Listener) Dial(ctx context.Context, opts ...Option) (*Conn, error) {
+	name := Addr(fmt.Sprintf("%s#%d", l.addr, atomic.AddUint64(&l.seq, 1)))
+	client, server := newPair(name, l.addr, append(append([]Option(nil), l.opts...), opts...))
+	select {
+	case <-l.done:
+		return nil, fmt.Errorf("inproc: dial %s: %w", l.addr, net.ErrClosed)
+	default:
+	}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("inproc: dial %s: %w", l.addr, net.ErrClosed)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,189 @@
+package inproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var _ net.Conn = (*Conn)(nil)
+var _ net.Listener = (*Listener)(nil)
+
+// readAll 读取 n 个字节，返回每次 Read 的长度
+func readAll(t *testing.T, c *Conn, n int) ([]byte, []int) {
+	t.Helper()
+	var (
+		data  []byte
+		sizes []int
+	)
+	buf := make([]byte, 1024)
+	for len(data) < n {
+		m, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read after %d bytes: %v", len(data), err)
+		}
+		data = append(data, buf[:m]...)
+		sizes = append(sizes, m)
+	}
+	return data, sizes
+}
+
+func TestPipeShortReads(t *testing.T) {
+	a, b := Pipe()
+	a.Inject(Faults{MaxRead: 3})
+	go func() {
+		a.Write([]byte("hello"))
+		a.Write([]byte("world!!"))
+		a.Close()
+	}()
+	data, sizes := readAll(t, b, 12)
+	if string(data) != "helloworld!!" {
+		t.Fatalf("data = %q", data)
+	}
+	// 一次 Read 不会跨越两次 Write
+	if want := []int{3, 2, 3, 3, 1}; fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Fatalf("read sizes = %v, want %v", sizes, want)
+	}
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after close = %v, want io.EOF", err)
+	}
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write to closed peer = %v", err)
+	}
+	if _, err := a.Read(make([]byte, 1)); err != net.ErrClosed {
+		t.Fatalf("read after local close = %v", err)
+	}
+}
+
+// TestDropAfter 恰好在第 N 个字节处断开，之前的数据都能读到，之后两端的读写都返回 ErrDropped
+func TestDropAfter(t *testing.T) {
+	a, b := Pipe(WithFaults(Faults{DropAfter: 7}))
+	if n, err := b.Write([]byte("pong")); n != 4 || err != nil {
+		t.Fatalf("write = %d, %v", n, err)
+	}
+	if n, err := a.Write([]byte("ping")); n != 4 || err != nil {
+		t.Fatalf("write = %d, %v", n, err)
+	}
+	if n, err := a.Write([]byte("pingping")); n != 3 || err != ErrDropped {
+		t.Fatalf("write = %d, %v, want 3, ErrDropped", n, err)
+	}
+	if data, _ := readAll(t, b, 7); string(data) != "pingpin" {
+		t.Fatalf("data = %q", data)
+	}
+	if _, err := b.Read(make([]byte, 1)); err != ErrDropped {
+		t.Fatalf("read after drop = %v", err)
+	}
+	// 断开之前另一个方向写入的数据也能读到
+	if data, _ := readAll(t, a, 4); string(data) != "pong" {
+		t.Fatalf("data = %q", data)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrDropped {
+		t.Fatalf("write after drop = %v", err)
+	}
+}
+
+func TestLatencyAndBandwidth(t *testing.T) {
+	a, b := Pipe(WithLatency(20*time.Millisecond), WithBandwidth(10000))
+	start := time.Now()
+	// 200 字节按照 10000 B/s 需要 20ms，加上 20ms 的延迟
+	a.Write(make([]byte, 100))
+	a.Write(make([]byte, 100))
+	if time.Since(start) > 10*time.Millisecond {
+		t.Fatal("write blocked on latency")
+	}
+	readAll(t, b, 100)
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("first write read after %v, want >= 30ms", d)
+	}
+	readAll(t, b, 100)
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("second write read after %v, want >= 40ms", d)
+	}
+}
+
+func TestWriteDelayAndBuffer(t *testing.T) {
+	a, b := Pipe(WithBufferSize(4))
+	a.Inject(Faults{WriteDelay: 20 * time.Millisecond})
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Write([]byte("12345678"))
+		done <- err
+	}()
+	// 缓冲只有 4 个字节，读取之前 Write 不会返回
+	select {
+	case err := <-done:
+		t.Fatalf("write returned %v with a full buffer", err)
+	case <-time.After(40 * time.Millisecond):
+	}
+	data, _ := readAll(t, b, 8)
+	if string(data) != "12345678" || time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("data = %q after %v", data, time.Since(start))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	a, b := Pipe(WithBufferSize(1))
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := b.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read = %v, want os.ErrDeadlineExceeded", err)
+	}
+	a.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, err := a.Write([]byte("ab")); n != 1 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write = %d, %v", n, err)
+	}
+	// 关闭连接唤醒阻塞的读取
+	b.SetReadDeadline(time.Time{})
+	readAll(t, b, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Close()
+	}()
+	if _, err := b.Read(make([]byte, 1)); err != net.ErrClosed {
+		t.Fatalf("read = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	lis := Listen("svc", WithFaults(Faults{MaxRead: 1}))
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+	for _, want := range []string{"svc#1", "svc#2"} {
+		c, err := lis.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := <-accepted
+		if s.RemoteAddr().String() != want || c.RemoteAddr().String() != "svc" || c.Peer() != s {
+			t.Fatalf("server %v remote %v, client remote %v", s.LocalAddr(), s.RemoteAddr(), c.RemoteAddr())
+		}
+		c.Write([]byte("hi"))
+		if n, _ := s.Read(make([]byte, 2)); n != 1 {
+			t.Fatalf("read %d bytes with MaxRead 1", n)
+		}
+	}
+	lis.Close()
+	if _, ok := <-accepted; ok {
+		t.Fatal("accept after close")
+	}
+	if _, err := lis.Dial(context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("dial after close = %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package transport
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const keepAliveProbesSupported = true
+
+// setKeepAliveProbes 设置 keepalive 探测的间隔（向上取整到秒）和次数，为 0 的不修改
+func setKeepAliveProbes(fd uintptr, interval time.Duration, count int) error {
+	if interval > 0 {
+		secs := int((interval + time.Second - 1) / time.Second)
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if count > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
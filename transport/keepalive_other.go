@@ -0,0 +1,14 @@
+//go:build !linux
+
+package transport
+
+import (
+	"errors"
+	"time"
+)
+
+const keepAliveProbesSupported = false
+
+func setKeepAliveProbes(fd uintptr, interval time.Duration, count int) error {
+	return errors.New("transport: keepalive interval and count are not supported")
+}
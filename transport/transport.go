@@ -0,0 +1,264 @@
+// Package transport 配置 tcp 和 unix 连接的 socket 选项（Nagle、keepalive、缓冲区大小以及建立连接的超时时间），
+// 客户端通过 client.WithTransport，服务端通过 appleseed.WithTransport 使用。
+//
+// 当前平台不支持的选项在 New 时返回错误，而不是静默地忽略
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Option 用于配置 Config
+type Option func(*Config)
+
+// WithNoDelay on 为 true 时关闭 Nagle 算法（设置 TCP_NODELAY，Go 的默认行为），为 false 时开启，
+// 小的写入会被合并之后再发送。只适用于 tcp
+func WithNoDelay(on bool) Option {
+	return func(c *Config) {
+		c.noDelay = &on
+	}
+}
+
+// WithKeepAlive 开启 tcp keepalive：连接空闲 idle 之后开始探测，每隔 interval 发送一次，连续 count 次没有
+// 回应时认为连接已经断开。interval 和 count 为 0 时使用 idle 和系统的默认值，只有 Linux 支持单独设置；
+// idle 小于 0 时关闭 keepalive。时间精确到秒。只适用于 tcp
+func WithKeepAlive(idle, interval time.Duration, count int) Option {
+	return func(c *Config) {
+		c.keepAliveSet = true
+		c.keepAliveIdle, c.keepAliveInterval, c.keepAliveCount = idle, interval, count
+	}
+}
+
+// WithReadBuffer 设置 socket 的接收缓冲区大小（SO_RCVBUF），在建立连接之前设置，以便 tcp 按照它协商窗口大小
+func WithReadBuffer(n int) Option {
+	return func(c *Config) {
+		c.readBuffer = n
+	}
+}
+
+// WithWriteBuffer 设置 socket 的发送缓冲区大小（SO_SNDBUF）
+func WithWriteBuffer(n int) Option {
+	return func(c *Config) {
+		c.writeBuffer = n
+	}
+}
+
+// WithConnectTimeout 建立连接的超时时间，和 ctx 的 deadline 同时生效，以先到的为准
+func WithConnectTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.connectTimeout = d
+	}
+}
+
+// Config 一组 socket 选项，使用 New 创建
+type Config struct {
+	noDelay           *bool // 为 nil 时不修改
+	keepAliveSet      bool
+	keepAliveIdle     time.Duration
+	keepAliveInterval time.Duration
+	keepAliveCount    int
+	readBuffer        int // 为 0 时不修改
+	writeBuffer       int
+	connectTimeout    time.Duration
+}
+
+// New 根据 opts 创建 Config，选项的值不合法或者当前平台不支持时返回错误
+func New(opts ...Option) (*Config, error) {
+	c := &Config{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.readBuffer < 0 || c.writeBuffer < 0 {
+		return nil, errors.New("transport: buffer size must not be negative")
+	}
+	if c.connectTimeout < 0 {
+		return nil, errors.New("transport: connect timeout must not be negative")
+	}
+	if c.keepAliveInterval < 0 || c.keepAliveCount < 0 {
+		return nil, errors.New("transport: keepalive interval and count must not be negative")
+	}
+	if c.keepAliveProbes() {
+		if c.keepAliveIdle < 0 {
+			return nil, errors.New("transport: keepalive interval and count are set but keepalive is disabled")
+		}
+		if !keepAliveProbesSupported {
+			return nil, fmt.Errorf("transport: keepalive interval and count are not supported on %s", runtime.GOOS)
+		}
+	}
+	return c, nil
+}
+
+func (c *Config) keepAliveProbes() bool {
+	return c.keepAliveInterval > 0 || c.keepAliveCount > 0
+}
+
+// tcpOnly 是否设置了只适用于 tcp 的选项
+func (c *Config) tcpOnly() bool {
+	return c.noDelay != nil || c.keepAliveSet
+}
+
+// ContextDialer 建立连接的方式，*net.Dialer 以及 golang.org/x/net/proxy 中的 dialer 都实现了它
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dial 使用 c 中的选项连接到 network 上的 address
+func (c *Config) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return c.DialWith(ctx, nil, network, address)
+}
+
+// DialWith 同 Dial，但是通过 d 建立连接，比如经过代理或者隧道，d 为 nil 时使用 net.Dialer。
+// 连接超时通过 ctx 传给 d；d 返回的连接不是 tcp 连接时，设置 Nagle、keepalive 或者缓冲区大小会返回错误
+func (c *Config) DialWith(ctx context.Context, d ContextDialer, network, address string) (net.Conn, error) {
+	custom := d != nil
+	if !custom {
+		nd := &net.Dialer{Timeout: c.connectTimeout, Control: c.control}
+		if c.keepAliveSet {
+			// 由 Apply 设置
+			nd.KeepAlive = -1
+		}
+		d = nd
+	} else if c.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.connectTimeout)
+		defer cancel()
+	}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if custom {
+		// 缓冲区大小没有在建立连接之前设置
+		if err := c.setConnBuffers(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := c.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setConnBuffers 在已经建立的连接上设置缓冲区大小
+func (c *Config) setConnBuffers(conn net.Conn) error {
+	if c.readBuffer == 0 && c.writeBuffer == 0 {
+		return nil
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("transport: cannot set buffer size on %T", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return c.control("", "", rc)
+}
+
+// control 在建立连接之前设置缓冲区大小
+func (c *Config) control(network, address string, rc syscall.RawConn) error {
+	if c.readBuffer == 0 && c.writeBuffer == 0 {
+		return nil
+	}
+	var err error
+	if cerr := rc.Control(func(fd uintptr) {
+		err = setBuffers(fd, c.readBuffer, c.writeBuffer)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Apply 为已经建立的连接设置 Nagle 和 keepalive，缓冲区大小在 Dial 或者 Listener 中设置。
+// 设置了只适用于 tcp 的选项而 conn 不是 tcp 连接时返回错误
+func (c *Config) Apply(conn net.Conn) error {
+	if !c.tcpOnly() {
+		return nil
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return fmt.Errorf("transport: nodelay and keepalive require a tcp connection, got %T", conn)
+	}
+	if c.noDelay != nil {
+		if err := tc.SetNoDelay(*c.noDelay); err != nil {
+			return err
+		}
+	}
+	if !c.keepAliveSet {
+		return nil
+	}
+	if c.keepAliveIdle < 0 {
+		return tc.SetKeepAlive(false)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if c.keepAliveIdle > 0 {
+		// 同时设置了 idle 和 interval
+		if err := tc.SetKeepAlivePeriod(c.keepAliveIdle); err != nil {
+			return err
+		}
+	}
+	if !c.keepAliveProbes() {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := rc.Control(func(fd uintptr) {
+		err = setKeepAliveProbes(fd, c.keepAliveInterval, c.keepAliveCount)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Listener 将缓冲区大小设置到 lis 的 socket 上（之后 accept 的连接会继承），并返回一个对每个 accept 的连接
+// 调用 Apply 的 net.Listener。lis 的类型不支持 c 中的选项时返回错误
+func (c *Config) Listener(lis net.Listener) (net.Listener, error) {
+	if c.tcpOnly() {
+		if _, ok := lis.(*net.TCPListener); !ok {
+			return nil, fmt.Errorf("transport: nodelay and keepalive require a tcp listener, got %T", lis)
+		}
+	}
+	if c.readBuffer != 0 || c.writeBuffer != 0 {
+		sc, ok := lis.(syscall.Conn)
+		if !ok {
+			return nil, fmt.Errorf("transport: cannot set buffer size on %T", lis)
+		}
+		rc, err := sc.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.control("", "", rc); err != nil {
+			return nil, err
+		}
+	}
+	return &listener{Listener: lis, c: c}, nil
+}
+
+type listener struct {
+	net.Listener
+	c *Config
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.c.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
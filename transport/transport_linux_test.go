@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// getsockopt 读取 conn 的 socket 选项
+func getsockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if cerr := rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), level, opt)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestOptionsReachSocket(t *testing.T) {
+	c, err := New(
+		WithNoDelay(false),
+		WithKeepAlive(2*time.Minute, 1500*time.Millisecond, 4),
+		WithReadBuffer(32<<10),
+		WithWriteBuffer(48<<10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := c.Listener(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dialed, err := c.Dial(context.Background(), "tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	server := <-accepted
+	if server == nil {
+		return
+	}
+	defer server.Close()
+
+	for name, conn := range map[string]net.Conn{"dialed": dialed, "accepted": server} {
+		checks := []struct {
+			name       string
+			level, opt int
+			want       int
+		}{
+			{"TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0},
+			{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1},
+			{"TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 120},
+			{"TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 2}, // 向上取整
+			{"TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 4},
+			// Linux 为内核的簿记保留一倍的空间，返回设置值的两倍
+			{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, 64 << 10},
+			{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, 96 << 10},
+		}
+		for _, ck := range checks {
+			if got := getsockopt(t, conn, ck.level, ck.opt); got != ck.want {
+				t.Errorf("%s: %s = %d, want %d", name, ck.name, got, ck.want)
+			}
+		}
+	}
+
+	// 关闭 keepalive
+	c, err = New(WithKeepAlive(-1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.Dial(context.Background(), "tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 0 {
+		t.Fatalf("SO_KEEPALIVE = %d", v)
+	}
+}
@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewValidates(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []Option
+		err  string
+	}{
+		{"negative buffer", []Option{WithReadBuffer(-1)}, "buffer size"},
+		{"negative timeout", []Option{WithConnectTimeout(-time.Second)}, "connect timeout"},
+		{"negative count", []Option{WithKeepAlive(time.Second, 0, -1)}, "must not be negative"},
+		{"probes without keepalive", []Option{WithKeepAlive(-1, time.Second, 3)}, "disabled"},
+	}
+	for _, c := range cases {
+		if _, err := New(c.opts...); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: err = %v", c.name, err)
+		}
+	}
+	_, err := New(WithKeepAlive(time.Minute, 10*time.Second, 3))
+	if keepAliveProbesSupported != (err == nil) {
+		t.Fatalf("%s: err = %v", runtime.GOOS, err)
+	}
+}
+
+func TestListenerRequiresTCP(t *testing.T) {
+	lis, err := net.Listen("unix", filepath.Join(t.TempDir(), "t.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	c, err := New(WithNoDelay(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Listener(lis); err == nil {
+		t.Fatal("nodelay on a unix listener should fail")
+	}
+	// 缓冲区大小对 unix socket 同样有效
+	c, err = New(WithReadBuffer(64<<10), WithWriteBuffer(64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Listener(lis); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.Dial(context.Background(), "unix", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// pipeDialer 返回 net.Pipe 的一端，记录 ctx 的 deadline
+type pipeDialer struct {
+	deadline time.Time
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.deadline, _ = ctx.Deadline()
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestDialWith(t *testing.T) {
+	c, err := New(WithConnectTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(pipeDialer)
+	conn, err := c.DialWith(context.Background(), d, "tcp", "example:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if until := time.Until(d.deadline); until <= 0 || until > time.Minute {
+		t.Fatalf("connect timeout not passed to the dialer, deadline in %v", until)
+	}
+	// 只适用于 tcp 的选项不会被静默地忽略
+	for _, opt := range []Option{WithNoDelay(false), WithReadBuffer(64 << 10)} {
+		c, err := New(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.DialWith(context.Background(), d, "tcp", "example:1"); err == nil {
+			t.Fatal("socket option on a pipe should fail")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package appleseed
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport"
+)
+
+type Echo struct{}
+
+func (Echo) Echo(args *[]byte, reply *[]byte) error {
+	*reply = *args
+	return nil
+}
+
+// startTransportServer 在 lis 上启动一个使用 opts 的 Echo 服务
+func startTransportServer(tb testing.TB, lis net.Listener, opts ...transport.Option) (*Server, <-chan error) {
+	tb.Helper()
+	s, err := NewServer(context.Background(), "transport", "127.0.0.1", "0", memory.New(nil), WithTransport(opts...))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := s.Register(Echo{}); err != nil {
+		tb.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(lis) }()
+	tb.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s, served
+}
+
+func TestTransport(t *testing.T) {
+	ctx := context.Background()
+	if _, err := NewServer(ctx, "transport", "127.0.0.1", "0", memory.New(nil),
+		WithTransport(transport.WithReadBuffer(-1))); err == nil {
+		t.Fatal("invalid transport options should fail NewServer")
+	}
+
+	// nodelay 只适用于 tcp，Serve 直接返回错误
+	ul, err := net.Listen("unix", filepath.Join(t.TempDir(), "t.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, served := startTransportServer(t, ul, transport.WithNoDelay(false)); <-served == nil {
+		t.Fatal("nodelay on a unix listener should fail Serve")
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTransportServer(t, lis, transport.WithNoDelay(true), transport.WithReadBuffer(64<<10))
+	cli, err := client.Dial(ctx, "tcp", lis.Addr().String(), client.WithTransport(transport.WithNoDelay(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	arg, reply := []byte("hello"), []byte(nil)
+	if err := cli.Call(ctx, "Echo.Echo", &arg, &reply); err != nil || string(reply) != "hello" {
+		t.Fatalf("reply = %q, err = %v", reply, err)
+	}
+	if _, err := client.Dial(ctx, "tcp", lis.Addr().String(),
+		client.WithTransport(transport.WithConnectTimeout(-1))); err == nil {
+		t.Fatal("invalid transport options should fail Dial")
+	}
+}
+
+// BenchmarkNoDelay 多个 goroutine 在同一个连接上进行 64 字节的调用，开启 Nagle 时后发出的请求要等待之前的
+// 数据被确认，延迟明显增加（1 个 CPU）：
+//
+//	go test -run '^$' -bench NoDelay -benchtime 2s
+//
+//	BenchmarkNoDelay/nodelay    114639    20221 ns/op
+//	BenchmarkNoDelay/nagle       64754    33727 ns/op
+func BenchmarkNoDelay(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, noDelay := range []bool{true, false} {
+		name := "nodelay"
+		if !noDelay {
+			name = "nagle"
+		}
+		b.Run(name, func(b *testing.B) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			startTransportServer(b, lis, transport.WithNoDelay(noDelay))
+			cli, err := client.Dial(context.Background(), "tcp", lis.Addr().String(),
+				client.WithTransport(transport.WithNoDelay(noDelay)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer cli.Close()
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				arg, reply := make([]byte, 64), []byte(nil)
+				for pb.Next() {
+					if err := cli.Call(context.Background(), "Echo.Echo", &arg, &reply); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
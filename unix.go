@@ -0,0 +1,112 @@
+package appleseed
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// WithUnixSocket server 监听 unix socket path，注册到注册中心的地址为 unix://path（NewServer 的 host 和
+// port 不再使用），使用 RunWithUnix 启动。mode 不为 0 时将 socket 文件的权限设置为 mode，比如 0660
+// 只允许同组的进程连接
+func WithUnixSocket(path string, mode os.FileMode) ServerOption {
+	return func(s *Server) {
+		s.unixPath, s.unixMode = path, mode
+	}
+}
+
+// RunWithUnix 在 WithUnixSocket 指定的 unix socket 上处理请求，见 ListenUnix
+func (s *Server) RunWithUnix() error {
+	if s.unixPath == "" {
+		return fmt.Errorf("rpc: unix socket path not set, use WithUnixSocket")
+	}
+	lis, err := ListenUnix(s.unixPath, s.unixMode)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
+
+// ListenUnix 监听 unix socket path。之前的进程没有正常退出时会留下 socket 文件，导致无法再次监听，
+// 所以如果 path 是一个没有进程在监听的 socket 文件，会先删除它；path 存在但不是 socket 或者仍然有进程
+// 在监听时返回错误。mode 不为 0 时将 socket 文件的权限设置为 mode。listener 关闭时会删除 socket 文件
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			lis.Close()
+			return nil, err
+		}
+	}
+	return lis, nil
+}
+
+// staleDialTimeout 判断 socket 文件是否还有进程在监听时连接的超时时间
+const staleDialTimeout = time.Second
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("rpc: %v exists and is not a unix socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, staleDialTimeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("rpc: unix socket %v is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// Peer 发起请求的客户端的连接信息
+type Peer struct {
+	Addr net.Addr
+	// Cred 对端进程的凭证，只有 Linux 上的 unix socket 连接才有
+	Cred *PeerCred
+
+	codec codec.ServerCodec // 连接的 codec，见 Info
+}
+
+// PeerCred unix socket 对端进程的凭证（SO_PEERCRED），在连接建立时确定
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+type peerKey struct{}
+
+// PeerFromContext 返回 handler 的 ctx 中发起请求的客户端的连接信息，拦截器可以根据它做鉴权，比如
+// 只允许某个用户的进程通过 unix socket 调用
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// newPeer 返回 conn 的 Peer，unix socket 连接会获取对端进程的凭证
+func newPeer(conn net.Conn) *Peer {
+	p := &Peer{Addr: conn.RemoteAddr()}
+	if uc, ok := conn.(*net.UnixConn); ok {
+		cred, err := peerCred(uc)
+		if err != nil {
+			log.Println("rpc: get peer credentials error: ", err)
+		}
+		p.Cred = cred
+	}
+	return p
+}
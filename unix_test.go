@@ -0,0 +1,120 @@
+package appleseed
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+)
+
+func TestUnixSocket(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "app.sock")
+
+	// 上一个进程留下的 socket 文件
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	var peer *Peer
+	checkPeer := func(ctx context.Context, info *ServerInfo, arg, reply any, handler Handler) error {
+		p, ok := PeerFromContext(ctx)
+		if !ok {
+			return errors.New("no peer")
+		}
+		peer = p
+		return handler(ctx, arg, reply)
+	}
+	reg := memory.New(nil)
+	s, err := NewServer(ctx, "unix", "", "", reg, WithUnixSocket(path, 0600), WithInterceptors(checkPeer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.RunWithUnix() }()
+	defer s.Shutdown(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	var cli *client.Client
+	for {
+		if cli, err = client.Dial(ctx, "unix", path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-served:
+			t.Fatal(err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer cli.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode = %v", fi.Mode())
+	}
+
+	var reply Reply
+	if err := cli.Call(ctx, "XXX.Add", &Args{X: 1, Y: 2}, &reply); err != nil || reply.Add != 3 {
+		t.Fatalf("reply = %+v, err = %v", reply, err)
+	}
+	if peer == nil || peer.Addr.Network() != "unix" {
+		t.Fatalf("peer = %+v", peer)
+	}
+	if runtime.GOOS == "linux" && (peer.Cred == nil || peer.Cred.UID != uint32(os.Getuid()) || peer.Cred.PID != int32(os.Getpid())) {
+		t.Fatalf("peer cred = %+v", peer.Cred)
+	}
+
+	// 注册中心中的地址为 unix://path，Pool 可以直接使用
+	addrs, err := reg.Get(ctx, "unix")
+	if err != nil || len(addrs) != 1 || addrs[0] != "unix://"+path {
+		t.Fatalf("addrs = %v, err = %v", addrs, err)
+	}
+	pool, err := client.NewPool(ctx, reg, "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if err := pool.Call(ctx, "XXX.Add", &Args{X: 3, Y: 4}, &reply); err != nil || reply.Add != 7 {
+		t.Fatalf("reply = %+v, err = %v", reply, err)
+	}
+
+	// 正在使用的 socket 和不是 socket 的文件都不会被删除
+	if _, err := ListenUnix(path, 0); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("err = %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(file, 0); err == nil {
+		t.Fatal("ListenUnix should not remove a regular file")
+	}
+
+	// 关闭后删除 socket 文件
+	s.Shutdown(ctx)
+	if err := <-served; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file not removed: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package appleseed
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+// Validator 请求的参数实现了 Validator（或者 ContextValidator）时，server 在解码之后、handler 执行之前调用 Validate，
+// 返回错误时不执行 handler，客户端收到 InvalidArgument。值类型的参数在指针上实现 Validate 也可以
+type Validator interface {
+	Validate() error
+}
+
+// ContextValidator 同 Validator，ctx 为 handler 的 ctx，可以获取请求的 metadata 和 deadline
+type ContextValidator interface {
+	Validate(ctx context.Context) error
+}
+
+var (
+	typeOfValidator        = reflect.TypeOf((*Validator)(nil)).Elem()
+	typeOfContextValidator = reflect.TypeOf((*ContextValidator)(nil)).Elem()
+)
+
+// ValidateFunc 所有方法的参数校验，比如根据 schema 校验，serviceMethod 为 "Service.Method"，见 WithValidator
+type ValidateFunc func(ctx context.Context, serviceMethod string, arg any) error
+
+// WithValidator 添加全局的参数校验，在参数自身的 Validate 通过之后按照添加的顺序执行，第一个错误作为结果。
+//
+// 校验在拦截器之后、handler 之前执行，拦截器（比如鉴权、日志）能看到校验的错误。返回的错误中没有错误码时转换为
+// InvalidArgument，已经是 *status.Status（或者实现了 Status() *status.Status，比如 *ValidationError）时原样
+// 发送给客户端，其中的 details 也会一起发送。未知服务的 RawHandler 处理的请求不校验
+func WithValidator(f ValidateFunc) ServerOption {
+	return func(s *Server) {
+		s.validators = append(s.validators, f)
+	}
+}
+
+// FieldViolation 一个字段的校验错误
+type FieldViolation struct {
+	Field       string // 字段名，嵌套的字段使用 "address.city" 的形式
+	Description string
+}
+
+// ValidationError 参数校验失败时可以返回的错误，客户端通过 status.FromError 得到错误码为 InvalidArgument 的
+// *status.Status，每个字段的错误在 details 中，key 为 "field." 加上字段名
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Field + ": " + v.Description
+	}
+	return "invalid argument: " + strings.Join(msgs, "; ")
+}
+
+// Status 返回给客户端的错误，details 中带有每个字段的错误
+func (e *ValidationError) Status() *status.Status {
+	details := make(map[string]string, len(e.Violations))
+	for _, v := range e.Violations {
+		details["field."+v.Field] = v.Description
+	}
+	return status.New(status.InvalidArgument, e.Error()).WithDetails(details)
+}
+
+// validate 依次执行 arg 自身的 Validate 和 WithValidator 的校验，返回发送给客户端的错误
+func (s *Server) validate(ctx context.Context, serviceMethod string, arg any) error {
+	var err error
+	switch v := validatorOf(arg).(type) {
+	case ContextValidator:
+		err = v.Validate(ctx)
+	case Validator:
+		err = v.Validate()
+	}
+	for i := 0; err == nil && i < len(s.validators); i++ {
+		err = s.validators[i](ctx, serviceMethod, arg)
+	}
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.New(status.InvalidArgument, err.Error())
+}
+
+// validatorOf 返回 arg 本身，arg 为值类型并且只在指针上实现了 Validate 时返回指向它的副本的指针
+func validatorOf(arg any) any {
+	switch arg.(type) {
+	case Validator, ContextValidator, nil:
+		return arg
+	}
+	v := reflect.ValueOf(arg)
+	if v.Kind() == reflect.Ptr {
+		return arg
+	}
+	if pt := reflect.PtrTo(v.Type()); !pt.Implements(typeOfValidator) && !pt.Implements(typeOfContextValidator) {
+		return arg
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Interface()
+}
@@ -0,0 +1,133 @@
+package appleseed
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/metadata"
+	"github.com/YOUSEEBIGGIRL/appleseed/status"
+)
+
+type Order struct {
+	ID  string
+	Qty int64
+}
+
+func (o *Order) Validate() error {
+	var e ValidationError
+	if o.ID == "" {
+		e.Violations = append(e.Violations, FieldViolation{Field: "id", Description: "is required"})
+	}
+	if o.Qty < 1 || o.Qty > 1000 {
+		e.Violations = append(e.Violations, FieldViolation{Field: "qty", Description: "must be between 1 and 1000"})
+	}
+	if len(e.Violations) > 0 {
+		return &e
+	}
+	return nil
+}
+
+// Coupon 使用 ctx 校验，请求的 metadata 中没有 tenant 时失败
+type Coupon struct {
+	Code string
+}
+
+func (c Coupon) Validate(ctx context.Context) error {
+	if md, _ := metadata.FromIncomingContext(ctx); md.Get("tenant") == "" {
+		return errors.New("missing tenant")
+	}
+	return nil
+}
+
+// Checkout 记录 handler 被调用的次数
+type Checkout struct {
+	calls int64 // 原子操作
+}
+
+func (o *Checkout) Place(order *Order, qty *int64) error {
+	atomic.AddInt64(&o.calls, 1)
+	*qty = order.Qty
+	return nil
+}
+
+// PlaceValue 参数为值类型，Validate 在指针上实现
+func (o *Checkout) PlaceValue(order Order, qty *int64) error {
+	atomic.AddInt64(&o.calls, 1)
+	*qty = order.Qty
+	return nil
+}
+
+func (o *Checkout) Redeem(coupon Coupon, ok *bool) error {
+	atomic.AddInt64(&o.calls, 1)
+	*ok = true
+	return nil
+}
+
+// TestValidate 校验失败时不执行 handler，客户端收到 InvalidArgument 和每个字段的错误，连接上之后的请求正常处理
+func TestValidate(t *testing.T) {
+	var validated []string
+	s, lis := startHooksServer(t, WithValidator(func(ctx context.Context, serviceMethod string, arg any) error {
+		validated = append(validated, serviceMethod)
+		if o, ok := arg.(*Order); ok && o.ID == "blocked" {
+			return errors.New("order is blocked")
+		}
+		return nil
+	}))
+	defer s.Shutdown(context.Background())
+	checkout := new(Checkout)
+	if err := s.Register(checkout); err != nil {
+		t.Fatal(err)
+	}
+	cli := dialHooks(t, lis)
+	defer cli.Close()
+	ctx := context.Background()
+
+	for _, method := range []string{"Checkout.Place", "Checkout.PlaceValue"} {
+		var qty int64
+		err := cli.Call(ctx, method, &Order{Qty: 5000}, &qty)
+		st, _ := status.FromError(err)
+		if st.Code() != status.InvalidArgument || st.Details()["field.id"] != "is required" ||
+			st.Details()["field.qty"] != "must be between 1 and 1000" {
+			t.Fatalf("%s: err = %v, details = %v", method, err, st.Details())
+		}
+		if n := atomic.LoadInt64(&checkout.calls); n != 0 {
+			t.Fatalf("%s: handler called %d times after a failed validation", method, n)
+		}
+	}
+
+	// 全局的校验，没有错误码的错误转换为 InvalidArgument
+	err := cli.Call(ctx, "Checkout.Place", &Order{ID: "blocked", Qty: 1}, new(int64))
+	if st, _ := status.FromError(err); st.Code() != status.InvalidArgument || !strings.HasPrefix(st.Message(), "order is blocked") {
+		t.Fatalf("global validator: err = %v", err)
+	}
+	if n := atomic.LoadInt64(&checkout.calls); n != 0 {
+		t.Fatalf("handler called %d times after a failed validation", n)
+	}
+	if len(validated) != 1 || validated[0] != "Checkout.Place" {
+		t.Fatalf("global validator called for %v, want only after the argument's own Validate passed", validated)
+	}
+
+	// ContextValidator 可以使用 ctx 中请求的 metadata
+	if err := cli.Call(ctx, "Checkout.Redeem", Coupon{Code: "x"}, new(bool)); status.CodeOf(err) != status.InvalidArgument {
+		t.Fatalf("Redeem without tenant: err = %v", err)
+	}
+
+	// 同一个连接上之后的请求正常处理
+	var qty int64
+	if err := cli.Call(ctx, "Checkout.Place", &Order{ID: "a", Qty: 3}, &qty); err != nil || qty != 3 {
+		t.Fatalf("Place = %d, %v", qty, err)
+	}
+	if err := cli.Call(ctx, "Checkout.PlaceValue", Order{ID: "b", Qty: 4}, &qty); err != nil || qty != 4 {
+		t.Fatalf("PlaceValue = %d, %v", qty, err)
+	}
+	var ok bool
+	if err := cli.Call(metadata.AppendToOutgoingContext(ctx, "tenant", "t1"), "Checkout.Redeem", Coupon{Code: "x"}, &ok); err != nil || !ok {
+		t.Fatalf("Redeem = %v, %v", ok, err)
+	}
+	if n := atomic.LoadInt64(&checkout.calls); n != 3 {
+		t.Fatalf("handler called %d times, want 3", n)
+	}
+}
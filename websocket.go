@@ -0,0 +1,37 @@
+package appleseed
+
+import (
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketHandler 返回一个 http.Handler，将请求升级为 WebSocket 后和普通的连接一样处理请求（见
+// client.DialWebSocket），适用于只允许 HTTP(S) 的环境。连接上的数据使用 binary frame 传输，codec 每次
+// flush 对应一个 frame；客户端的 ping 会自动回复 pong，Shutdown 时发送 close frame 后关闭连接。
+//
+// 非浏览器的客户端可能没有 Origin，所以不检查 Origin，需要鉴权时可以在外层包装 http.Handler 检查 header，
+// 或者使用拦截器
+func (s *Server) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			s.serverConn(&wsConn{Conn: ws, remote: wsAddr(ws.Request().RemoteAddr)})
+		},
+	}
+}
+
+// wsConn websocket.Conn 的 RemoteAddr 返回的是 Origin，改为返回客户端的地址
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr { return c.remote }
+
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
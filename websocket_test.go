@@ -0,0 +1,123 @@
+package appleseed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/client"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewServer(ctx, "ws", "127.0.0.1", "0", memory.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	// 握手请求中的 header 用于鉴权
+	h := s.WebSocketHandler()
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http") + "/rpc"
+
+	if _, err := client.DialWebSocket(ctx, url); err == nil {
+		t.Fatal("dial without token should fail")
+	}
+	auth := client.WithHeader(http.Header{"Authorization": {"Bearer token"}})
+	cli, err := client.DialWebSocket(ctx, url, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			var reply Reply
+			if err := cli.Call(ctx, "XXX.Add", &Args{X: i, Y: 1, Str: strings.Repeat("x", 10000)}, &reply); err != nil || reply.Add != i+1 {
+				t.Errorf("reply = %v, err = %v", reply.Add, err)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	// 地址为 ws:// 的实例可以通过 Pool 调用
+	reg := memory.New(nil)
+	if _, err := reg.RegisterInstance(ctx, "ws", registry.Instance{Addr: url}); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := client.NewPool(ctx, reg, "ws", client.WithWebSocketOptions(auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	var reply Reply
+	if err := pool.Call(ctx, "XXX.Add", &Args{X: 1, Y: 2}, &reply); err != nil || reply.Add != 3 {
+		t.Fatalf("reply = %v, err = %v", reply.Add, err)
+	}
+
+	// Shutdown 时服务端发送 close frame，客户端随之关闭
+	call := cli.Go(ctx, "XXX.TimeoutFunc", &Args{RunTime: 2 * time.Second}, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	s.Shutdown(shutdownCtx)
+	select {
+	case call := <-call.Done:
+		if call.Error == nil {
+			t.Fatal("call should fail after the server closed the connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	}
+	if err := cli.Call(ctx, "XXX.Add", &Args{}, &reply); err != client.ErrShutdown {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	// 服务端不读取数据，也就不会回复 pong
+	block := make(chan struct{})
+	hs := httptest.NewServer(websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   func(ws *websocket.Conn) { <-block },
+	})
+	defer hs.Close()
+	defer close(block)
+
+	ctx := context.Background()
+	cli, err := client.DialWebSocket(ctx, "ws"+strings.TrimPrefix(hs.URL, "http"), client.WithKeepalive(10*time.Millisecond, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	var reply Reply
+	done := make(chan error, 1)
+	go func() { done <- cli.Call(ctx, "XXX.Add", &Args{}, &reply) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("call should fail after keepalive timeout")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("keepalive did not close the client")
+	}
+}
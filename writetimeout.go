@@ -0,0 +1,42 @@
+package appleseed
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+)
+
+// WithWriteTimeout 每个响应（包括被拆分的响应的每个 fragment 和 GOAWAY）写入连接时最多等待 d，默认不限制。
+// 客户端长时间不读取时（比如接收窗口为 0），写入会一直阻塞，同一个连接上的其他响应都在等待它。
+// 超时后连接处于未知的状态（响应可能只写入了一部分），会被关闭，客户端需要重新建立连接。
+// 只对 Serve 接受的、实现了 SetWriteDeadline 的连接生效
+func WithWriteTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// writeDeadliner 可以设置写入期限的连接，net.Conn 实现了它
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// setWriteDeadline 写入响应之前设置连接的写入期限，调用方持有 sendLock
+func (s *Server) setWriteDeadline(cc *codec.CountConn) {
+	if s.writeTimeout <= 0 || cc == nil {
+		return
+	}
+	if d, ok := cc.ReadWriteCloser.(writeDeadliner); ok {
+		d.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+}
+
+// closeOnWriteTimeout 写入响应超时后关闭连接，读取请求的 goroutine 随之退出。关闭的是 cc 下面的连接，
+// 可以和其他 goroutine 对 codec 的 Close 并发
+func closeOnWriteTimeout(cc *codec.CountConn, err error) {
+	if cc != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		cc.Close()
+	}
+}
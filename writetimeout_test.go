@@ -0,0 +1,49 @@
+package appleseed
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/YOUSEEBIGGIRL/appleseed/codec"
+	"github.com/YOUSEEBIGGIRL/appleseed/registry/memory"
+	"github.com/YOUSEEBIGGIRL/appleseed/transport/inproc"
+)
+
+// TestWriteTimeout 客户端不读取响应时，写入在 WithWriteTimeout 之后失败，服务端关闭连接
+func TestWriteTimeout(t *testing.T) {
+	disconnected := make(chan time.Time, 1)
+	s, err := NewServer(context.Background(), "stalled", "127.0.0.1", "0", memory.New(nil),
+		WithWriteTimeout(50*time.Millisecond),
+		WithOnDisconnect(func(net.Addr, error, ConnStats) { disconnected <- time.Now() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(XXX)); err != nil {
+		t.Fatal(err)
+	}
+	lis := inproc.Listen("stalled", inproc.WithBufferSize(16))
+	go s.Serve(lis)
+	defer s.Shutdown(context.Background())
+
+	conn, err := lis.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 发送请求之后不再读取，响应在 16 字节的缓冲处阻塞
+	cc := codec.NewGobClientCodec(conn)
+	start := time.Now()
+	if err := cc.WriteRequest(&codec.RequestHeader{ServiceMethod: "XXX.Add", Seq: 1}, &Args{X: 1, Y: 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case at := <-disconnected:
+		if d := at.Sub(start); d < 40*time.Millisecond {
+			t.Fatalf("connection closed after %v, before the write timeout", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server kept the stalled connection open")
+	}
+}